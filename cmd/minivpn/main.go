@@ -19,6 +19,11 @@ import (
 	"github.com/ooni/minivpn/pkg/config"
 	"github.com/ooni/minivpn/pkg/tracex"
 	"github.com/ooni/minivpn/pkg/tunnel"
+
+	// registers the obfs4, shadowsocks and stunnel pluggable transports
+	_ "github.com/ooni/minivpn/obfs4"
+	_ "github.com/ooni/minivpn/shadowsocks"
+	_ "github.com/ooni/minivpn/stunnel"
 )
 
 func runCmd(binaryPath string, args ...string) {
@@ -44,6 +49,7 @@ type cmdConfig struct {
 	configPath string
 	doPing     bool
 	doTrace    bool
+	jsonOutput bool
 	skipRoute  bool
 	timeout    int
 }
@@ -54,6 +60,7 @@ func main() {
 	cfg := &cmdConfig{}
 	flag.StringVar(&cfg.configPath, "config", "", "config file to load")
 	flag.BoolVar(&cfg.doPing, "ping", false, "if true, do ping and exit (for testing)")
+	flag.BoolVar(&cfg.jsonOutput, "json", false, "if true, print the ping result as JSON to stdout")
 	flag.BoolVar(&cfg.doTrace, "trace", false, "if true, do a trace of the handshake and exit (for testing)")
 	flag.BoolVar(&cfg.skipRoute, "skip-route", false, "if true, exit without setting routes (for testing)")
 	flag.IntVar(&cfg.timeout, "timeout", 60, "timeout in seconds (default=60)")
@@ -105,8 +112,13 @@ func main() {
 	log.Infof("Local IP: %s\n", tun.LocalAddr())
 	log.Infof("Gateway:  %s\n", tun.RemoteAddr())
 
-	fmt.Println("initialization-sequence-completed")
-	fmt.Printf("elapsed: %v\n", time.Since(start))
+	// with JSON output, stdout only contains the ping result
+	if cfg.jsonOutput {
+		log.Infof("initialization-sequence-completed in %v", time.Since(start))
+	} else {
+		fmt.Println("initialization-sequence-completed")
+		fmt.Printf("elapsed: %v\n", time.Since(start))
+	}
 
 	if cfg.doTrace {
 		return
@@ -116,13 +128,13 @@ func main() {
 		pinger := ping.New("8.8.8.8", tun)
 		count := 5
 		pinger.Count = count
+		pinger.RecordReplies = cfg.jsonOutput
 
 		err = pinger.Run(context.Background())
+		printPingResult(pinger, cfg.jsonOutput)
 		if err != nil {
-			pinger.PrintStats()
 			log.WithError(err).Fatal("ping error")
 		}
-		pinger.PrintStats()
 		os.Exit(0)
 	}
 
@@ -196,3 +208,14 @@ func main() {
 	}()
 	select {}
 }
+
+// printPingResult prints the result of the pinger, either as JSON or like the ping command.
+func printPingResult(pinger *ping.Pinger, jsonOutput bool) {
+	if !jsonOutput {
+		pinger.PrintStats()
+		return
+	}
+	jsonData, err := json.MarshalIndent(pinger.Result(), "", "  ")
+	runtimex.PanicOnError(err, "cannot serialize ping result")
+	fmt.Println(string(jsonData))
+}
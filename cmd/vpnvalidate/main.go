@@ -0,0 +1,42 @@
+// Command vpnvalidate checks OpenVPN config files without connecting.
+//
+// Usage:
+//
+//	vpnvalidate config.ovpn [config.ovpn...]
+//
+// It prints every problem it finds, and exits with a non-zero status
+// if any of the config files is not valid.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s config.ovpn [config.ovpn...]\n", os.Args[0])
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	status := 0
+	for _, path := range flag.Args() {
+		problems := config.ValidateConfigFile(path)
+		if len(problems) == 0 {
+			fmt.Printf("%s: ok\n", path)
+			continue
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", path, problem)
+		}
+		status = 1
+	}
+	os.Exit(status)
+}
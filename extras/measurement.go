@@ -0,0 +1,134 @@
+package extras
+
+// This file contains a helper to measure the throughput of a
+// connection dialed through a VPN tunnel.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInvalidInterval is returned when the sampling interval is not positive.
+var ErrInvalidInterval = errors.New("invalid sampling interval")
+
+// timeNow is monkeypatchable for testing.
+var timeNow = time.Now
+
+// Dialer is the type used to dial connections through the tunnel (e.g., a
+// userspace network stack on top of the TUN device).
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// ThroughputSample contains the bytes transferred during a sampling interval.
+type ThroughputSample struct {
+	// Elapsed is the time elapsed since the beginning of the measurement.
+	Elapsed time.Duration
+
+	// BytesReceived is the number of bytes received during the interval.
+	BytesReceived int64
+
+	// BytesSent is the number of bytes sent during the interval.
+	BytesSent int64
+}
+
+// Measurement is the result of [RunMeasurement].
+type Measurement struct {
+	// Samples contains the periodic throughput samples.
+	Samples []ThroughputSample
+
+	// Elapsed is the total duration of the measurement.
+	Elapsed time.Duration
+
+	// BytesReceived is the total number of bytes received.
+	BytesReceived int64
+
+	// BytesSent is the total number of bytes sent.
+	BytesSent int64
+
+	// DownloadGoodput is the download goodput, in bytes per second.
+	DownloadGoodput float64
+
+	// UploadGoodput is the upload goodput, in bytes per second.
+	UploadGoodput float64
+}
+
+// RunMeasurement dials address using dialer and runs fn with the resulting conn,
+// sampling the bytes transferred in both directions every interval. It returns
+// the [*Measurement] along with the error returned by fn, if any.
+func RunMeasurement(
+	ctx context.Context,
+	dialer Dialer,
+	network, address string,
+	interval time.Duration,
+	fn func(ctx context.Context, conn net.Conn) error,
+) (*Measurement, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	cc := &countingConn{Conn: conn}
+	defer cc.Close()
+
+	m := &Measurement{}
+	start := timeNow()
+	var lastReceived, lastSent int64
+	sample := func() {
+		received, sent := cc.received.Load(), cc.sent.Load()
+		m.Samples = append(m.Samples, ThroughputSample{
+			Elapsed:       timeNow().Sub(start),
+			BytesReceived: received - lastReceived,
+			BytesSent:     sent - lastSent,
+		})
+		lastReceived, lastSent = received, sent
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx, cc)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sample()
+		case err = <-done:
+			sample()
+			m.Elapsed = timeNow().Sub(start)
+			m.BytesReceived = cc.received.Load()
+			m.BytesSent = cc.sent.Load()
+			if seconds := m.Elapsed.Seconds(); seconds > 0 {
+				m.DownloadGoodput = float64(m.BytesReceived) / seconds
+				m.UploadGoodput = float64(m.BytesSent) / seconds
+			}
+			return m, err
+		}
+	}
+}
+
+// countingConn is a [net.Conn] counting the bytes read and written.
+type countingConn struct {
+	net.Conn
+	received atomic.Int64
+	sent     atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+	return n, err
+}
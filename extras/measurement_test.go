@@ -0,0 +1,134 @@
+package extras
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooni/minivpn/internal/vpntest"
+)
+
+func TestRunMeasurement(t *testing.T) {
+	newDialer := func() Dialer {
+		conn := &vpntest.Conn{
+			MockRead: func(b []byte) (int, error) {
+				return 1000, nil
+			},
+			MockWrite: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+			MockClose: func() error {
+				return nil
+			},
+		}
+		return &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return conn, nil
+			},
+		}
+	}
+
+	t.Run("we compute the goodput from the bytes transferred", func(t *testing.T) {
+		// the first call marks the start, all the others happen two seconds later
+		start := time.Now()
+		calls := 0
+		timeNow = func() time.Time {
+			calls++
+			if calls == 1 {
+				return start
+			}
+			return start.Add(2 * time.Second)
+		}
+		defer func() { timeNow = time.Now }()
+
+		m, err := RunMeasurement(context.Background(), newDialer(), "tcp", "10.0.0.1:80", time.Hour,
+			func(ctx context.Context, conn net.Conn) error {
+				buf := make([]byte, 1000)
+				for i := 0; i < 10; i++ {
+					if _, err := conn.Read(buf); err != nil {
+						return err
+					}
+				}
+				for i := 0; i < 4; i++ {
+					if _, err := conn.Write(buf[:500]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.BytesReceived != 10000 {
+			t.Errorf("BytesReceived = %d, want 10000", m.BytesReceived)
+		}
+		if m.BytesSent != 2000 {
+			t.Errorf("BytesSent = %d, want 2000", m.BytesSent)
+		}
+		if m.Elapsed != 2*time.Second {
+			t.Errorf("Elapsed = %v, want 2s", m.Elapsed)
+		}
+		if m.DownloadGoodput != 5000 {
+			t.Errorf("DownloadGoodput = %v, want 5000", m.DownloadGoodput)
+		}
+		if m.UploadGoodput != 1000 {
+			t.Errorf("UploadGoodput = %v, want 1000", m.UploadGoodput)
+		}
+		if len(m.Samples) != 1 {
+			t.Fatalf("len(Samples) = %d, want 1", len(m.Samples))
+		}
+		if m.Samples[0].BytesReceived != 10000 || m.Samples[0].BytesSent != 2000 {
+			t.Errorf("Samples[0] = %+v", m.Samples[0])
+		}
+	})
+
+	t.Run("samples are taken periodically and add up to the totals", func(t *testing.T) {
+		m, err := RunMeasurement(context.Background(), newDialer(), "tcp", "10.0.0.1:80", time.Millisecond,
+			func(ctx context.Context, conn net.Conn) error {
+				buf := make([]byte, 1000)
+				for i := 0; i < 5; i++ {
+					conn.Read(buf)
+					conn.Write(buf[:100])
+					time.Sleep(5 * time.Millisecond)
+				}
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Samples) < 2 {
+			t.Fatalf("expected more than one sample, got %d", len(m.Samples))
+		}
+		var received, sent int64
+		for _, s := range m.Samples {
+			received += s.BytesReceived
+			sent += s.BytesSent
+		}
+		if received != m.BytesReceived || sent != m.BytesSent {
+			t.Errorf("samples add up to %d/%d, want %d/%d", received, sent, m.BytesReceived, m.BytesSent)
+		}
+	})
+
+	t.Run("we return the error from fn along with the measurement", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		m, err := RunMeasurement(context.Background(), newDialer(), "tcp", "10.0.0.1:80", time.Hour,
+			func(ctx context.Context, conn net.Conn) error {
+				return expected
+			})
+		if !errors.Is(err, expected) {
+			t.Errorf("err = %v, want %v", err, expected)
+		}
+		if m == nil {
+			t.Error("expected a measurement")
+		}
+	})
+
+	t.Run("we reject a non positive interval", func(t *testing.T) {
+		_, err := RunMeasurement(context.Background(), newDialer(), "tcp", "10.0.0.1:80", 0, nil)
+		if !errors.Is(err, ErrInvalidInterval) {
+			t.Errorf("err = %v, want %v", err, ErrInvalidInterval)
+		}
+	})
+}
@@ -56,6 +56,13 @@ func (c Config) Check() error {
 	return nil
 }
 
+// WaitTime returns a random duration drawn from the memoryless distribution
+// described by the config and clamped between Min and Max. This function
+// assumes that the config has no errors.
+func (c Config) WaitTime() time.Duration {
+	return c.waittime()
+}
+
 // newTimer constructs and returns a timer. This function assumes that the
 // config has no errors.
 func newTimer(c Config) *time.Timer {
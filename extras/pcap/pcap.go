@@ -0,0 +1,84 @@
+// Package pcap writes the decrypted IP packets moving through the tunnel into a pcap file,
+// which can be opened with Wireshark. Use it as the capture sink of the tunnel config:
+//
+//	file, _ := os.Create("tunnel.pcap")
+//	writer, _ := pcap.NewWriter(file)
+//	cfg := config.NewConfig(config.WithCaptureSink(writer.Capture))
+package pcap
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/ooni/minivpn/internal/model"
+)
+
+// snapLen is the maximum size of the packets we capture.
+const snapLen = 65535
+
+// Writer writes IP packets into a pcap file using the raw IP link type. The zero value
+// is invalid; please, use [NewWriter]. It is safe to use it from several goroutines.
+type Writer struct {
+	// mu serializes the writes and protects err.
+	mu sync.Mutex
+
+	// err is the first error we got while writing.
+	err error
+
+	// now returns the current time, and is mockable for testing.
+	now func() time.Time
+
+	// w is the underlying pcap writer.
+	w *pcapgo.Writer
+}
+
+// NewWriter writes the pcap global header to w, and returns a [Writer] that appends
+// the packets to it. It is the caller's responsibility to close w when done.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(snapLen, layers.LinkTypeRaw); err != nil {
+		return nil, err
+	}
+	return &Writer{now: time.Now, w: pw}, nil
+}
+
+// WritePacket writes an IP packet captured at the given time.
+func (w *Writer) WritePacket(t time.Time, packet []byte) error {
+	length := len(packet)
+	if length > snapLen {
+		packet = packet[:snapLen]
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     t,
+		CaptureLength: len(packet),
+		Length:        length,
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.WritePacket(ci, packet)
+}
+
+// Capture writes the passed packet, timestamped with the current time, and has the
+// signature expected by the capture sink of the tunnel config. Since a sink cannot fail,
+// we stop writing after the first error, which is available using [Writer.Err].
+func (w *Writer) Capture(direction model.Direction, packet []byte) {
+	if w.Err() != nil {
+		return
+	}
+	if err := w.WritePacket(w.now(), packet); err != nil {
+		w.mu.Lock()
+		w.err = err
+		w.mu.Unlock()
+	}
+}
+
+// Err returns the first error that occurred in [Writer.Capture], if any.
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
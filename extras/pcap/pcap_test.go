@@ -0,0 +1,100 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ooni/minivpn/internal/model"
+)
+
+func TestWriter(t *testing.T) {
+	t.Run("we write the global header and a record for each packet", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w, err := NewWriter(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.now = func() time.Time { return time.Unix(1700000000, 123456000) }
+
+		packets := [][]byte{
+			{0x45, 0x00, 0x00, 0x14, 0x01, 0x02},
+			{0x45, 0x00, 0x00, 0x14, 0x03, 0x04, 0x05},
+		}
+		w.Capture(model.DirectionOutgoing, packets[0])
+		w.Capture(model.DirectionIncoming, packets[1])
+		if err := w.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		if len(data) < 24 {
+			t.Fatalf("got %d bytes, want at least the global header", len(data))
+		}
+		le := binary.LittleEndian
+		header := []uint32{le.Uint32(data[0:4]), le.Uint32(data[16:20]), le.Uint32(data[20:24])}
+		if header[0] != 0xa1b2c3d4 || le.Uint16(data[4:6]) != 2 || le.Uint16(data[6:8]) != 4 {
+			t.Errorf("bad magic or version: %x", data[:8])
+		}
+		if header[1] != snapLen || header[2] != 101 {
+			t.Errorf("snaplen = %d, link type = %d, want %d and 101 (RAW)", header[1], header[2], snapLen)
+		}
+
+		data = data[24:]
+		for i, packet := range packets {
+			if len(data) < 16+len(packet) {
+				t.Fatalf("record %d is truncated", i)
+			}
+			if sec, usec := le.Uint32(data[0:4]), le.Uint32(data[4:8]); sec != 1700000000 || usec != 123456 {
+				t.Errorf("record %d: timestamp = %d.%06d", i, sec, usec)
+			}
+			if incl, orig := le.Uint32(data[8:12]), le.Uint32(data[12:16]); incl != uint32(len(packet)) || orig != incl {
+				t.Errorf("record %d: lengths = %d/%d, want %d", i, incl, orig, len(packet))
+			}
+			if !bytes.Equal(data[16:16+len(packet)], packet) {
+				t.Errorf("record %d: payload = %x, want %x", i, data[16:16+len(packet)], packet)
+			}
+			data = data[16+len(packet):]
+		}
+		if len(data) != 0 {
+			t.Errorf("%d trailing bytes", len(data))
+		}
+	})
+
+	t.Run("we remember the first write error", func(t *testing.T) {
+		fw := &failingWriter{}
+		w, err := NewWriter(fw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.written = 0
+		fw.err = errors.New("disk full")
+		w.Capture(model.DirectionOutgoing, []byte{0x45})
+		if w.Err() == nil {
+			t.Fatal("expected an error")
+		}
+
+		// after the first error, we stop writing
+		fw.err = nil
+		w.Capture(model.DirectionOutgoing, []byte{0x45})
+		if fw.written != 0 {
+			t.Errorf("wrote %d bytes after the error", fw.written)
+		}
+	})
+}
+
+// failingWriter is an io.Writer returning err, if set.
+type failingWriter struct {
+	err     error
+	written int
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	if fw.err != nil {
+		return 0, fw.err
+	}
+	fw.written += len(b)
+	return len(b), nil
+}
@@ -0,0 +1,63 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// MultiPinger pings several hosts, one after the other, over a single conn (e.g., a
+// tunnel), so that we establish the tunnel only once regardless of the number of hosts.
+type MultiPinger struct {
+	// Targets contains the IP addresses of the hosts to ping.
+	Targets []string
+
+	// Count is the number of packets we send to each host. Default is 5.
+	Count int
+
+	// Interval is the wait time between each packet send. Default is 1s.
+	Interval time.Duration
+
+	// Timeout is the maximum time we spend pinging each host. Default is 10s.
+	Timeout time.Duration
+
+	// If true, omit all output during measurement.
+	Silent bool
+
+	// conn is the conn we share among the pingers.
+	conn net.Conn
+}
+
+// NewMultiPinger returns a new MultiPinger pinging the given targets. This function
+// TAKES OWNERSHIP of the conn argument and closes it when Run terminates.
+func NewMultiPinger(targets []string, conn net.Conn) *MultiPinger {
+	return &MultiPinger{
+		Targets:  targets,
+		Count:    5,
+		Interval: time.Second,
+		Timeout:  10 * time.Second,
+		conn:     conn,
+	}
+}
+
+// Run pings each target in turn, and returns the statistics for each target, indexed by
+// target. In case of error, it stops and returns the statistics collected so far along
+// with an error mentioning the target we were pinging.
+func (mp *MultiPinger) Run(ctx context.Context) (map[string]*Statistics, error) {
+	defer mp.conn.Close()
+	stats := make(map[string]*Statistics)
+	for _, target := range mp.Targets {
+		pinger := NewFromSharedConnection(target, mp.conn)
+		pinger.Count = mp.Count
+		pinger.Interval = mp.Interval
+		pinger.Timeout = mp.Timeout
+		pinger.Silent = mp.Silent
+		err := pinger.Run(ctx)
+		stats[target] = pinger.Statistics()
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", target, err)
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,85 @@
+package ping
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ooni/minivpn/internal/mocks"
+)
+
+// makeConnEcho returns a conn answering the echo requests sent to any destination but
+// the ones in silent.
+func makeConnEcho(t *testing.T, silent ...string) *mocks.Conn {
+	replies := make(chan []byte, 64)
+	conn := makeConn()
+	conn.MockWrite = func(b []byte) (int, error) {
+		request := &layers.IPv4{}
+		if err := request.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+			t.Fatal(err)
+		}
+		for _, dst := range silent {
+			if request.DstIP.String() == dst {
+				return len(b), nil
+			}
+		}
+		replies <- echoReply(t, b)
+		return len(b), nil
+	}
+	conn.MockRead = func(b []byte) (int, error) {
+		select {
+		case reply := <-replies:
+			return copy(b, reply), nil
+		case <-time.After(time.Millisecond):
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	return conn
+}
+
+func TestMultiPinger(t *testing.T) {
+	t.Run("we ping each host over the same conn", func(t *testing.T) {
+		conn := makeConnEcho(t)
+		closed := 0
+		conn.MockClose = func() error {
+			closed++
+			return nil
+		}
+		mp := NewMultiPinger([]string{"10.0.0.1", "10.0.0.2"}, conn)
+		mp.Count = 3
+		mp.Interval = time.Millisecond
+		mp.Silent = true
+
+		stats, err := mp.Run(context.Background())
+		AssertNoError(t, err)
+		for _, target := range mp.Targets {
+			s := stats[target]
+			if s == nil || s.Addr != target || s.PacketsSent != 3 || s.PacketsRecv != 3 {
+				t.Errorf("stats for %s = %+v, want 3 packets sent and received", target, s)
+			}
+		}
+		if closed != 1 {
+			t.Errorf("conn closed %d times, want once", closed)
+		}
+	})
+
+	t.Run("a silent host does not affect the others", func(t *testing.T) {
+		mp := NewMultiPinger([]string{"10.0.0.1", "10.0.0.3", "10.0.0.2"}, makeConnEcho(t, "10.0.0.3"))
+		mp.Count = 2
+		mp.Interval = time.Millisecond
+		mp.Timeout = 100 * time.Millisecond
+		mp.Silent = true
+
+		stats, err := mp.Run(context.Background())
+		AssertNoError(t, err)
+		want := map[string]int{"10.0.0.1": 2, "10.0.0.2": 2, "10.0.0.3": 0}
+		for target, recv := range want {
+			if s := stats[target]; s == nil || s.PacketsRecv != recv {
+				t.Errorf("stats for %s = %+v, want %d packets received", target, s, recv)
+			}
+		}
+	})
+}
@@ -115,6 +115,12 @@ type Pinger struct {
 	// Debug runs in debug mode
 	Debug bool
 
+	// ContinueOnError tells pinger not to stop when it fails to send a packet
+	// or to read a reply (e.g., because of a transient tunnel error). The error
+	// is logged, the packet is counted as lost, and the run proceeds with the
+	// next sequence.
+	ContinueOnError bool
+
 	// Number of packets sent
 	PacketsSent int
 
@@ -124,6 +130,9 @@ type Pinger struct {
 	// Number of duplicate packets received
 	PacketsRecvDuplicates int
 
+	// Number of packets answered with ICMP Destination Unreachable
+	PacketsUnreachable int
+
 	// Round trip time statistics
 	minRtt    time.Duration
 	maxRtt    time.Duration
@@ -141,6 +150,8 @@ type Pinger struct {
 
 	replies []PingReply
 
+	unreachables []Unreachable
+
 	// OnSetup is called when Pinger has finished setting up the listening socket
 	OnSetup func()
 
@@ -156,6 +167,9 @@ type Pinger struct {
 	// OnDuplicateRecv is called when a packet is received that has already been received.
 	OnDuplicateRecv func(*Packet)
 
+	// OnUnreachable is called when a packet is answered with ICMP Destination Unreachable.
+	OnUnreachable func(*Unreachable)
+
 	// Size of packet being sent
 	Size int
 
@@ -239,6 +253,13 @@ type Statistics struct {
 	// PacketsRecvDuplicates is the number of duplicate responses there were to a sent packet.
 	PacketsRecvDuplicates int
 
+	// PacketsUnreachable is the number of packets answered with ICMP Destination Unreachable,
+	// which are still counted as lost.
+	PacketsUnreachable int
+
+	// Unreachables contains the ICMP Destination Unreachable answers.
+	Unreachables []Unreachable
+
 	// PacketLoss is the percentage of packets lost.
 	PacketLoss float64
 
@@ -264,6 +285,14 @@ type Statistics struct {
 	StdDevRtt time.Duration
 }
 
+// packetsAnswered returns the number of packets answered with either an echo reply or an
+// ICMP Destination Unreachable. It is safe to call while the pinger is running.
+func (p *Pinger) packetsAnswered() int {
+	p.statsMu.RLock()
+	defer p.statsMu.RUnlock()
+	return p.PacketsRecv + p.PacketsUnreachable
+}
+
 func (p *Pinger) updateStatistics(pkt *Packet) {
 	p.statsMu.Lock()
 	defer p.statsMu.Unlock()
@@ -303,18 +332,21 @@ func (p *Pinger) updateStatistics(pkt *Packet) {
 // Run runs the pinger. Accepts a single argument that is a Context. This is a
 // blocking function that will exit when it's done (or when the context expires).
 // If Count or Interval are not specified, it will run continuously until
-// it is interrupted or the context expires.
+// it is interrupted or the context expires. When the context expires, we stop
+// sending and receiving packets, and we return immediately.
 func (p *Pinger) Run(ctx context.Context) (err error) {
+	if p.Size < timeSliceLength+trackerLength {
+		return fmt.Errorf("size %d is less than minimum required size %d", p.Size, timeSliceLength+trackerLength)
+	}
 	errch := make(chan error, 1)
 	go func() {
-		if p.Size < timeSliceLength+trackerLength {
-			errch <- fmt.Errorf("size %d is less than minimum required size %d", p.Size, timeSliceLength+trackerLength)
-		}
 		errch <- p.run(p.conn)
 	}()
 	select {
 	case err = <-errch:
 	case <-ctx.Done():
+		// stop the send and receive loops, which would otherwise keep running
+		p.Stop()
 		err = ctx.Err()
 	}
 	return
@@ -386,16 +418,22 @@ func (p *Pinger) runLoop(recvCh <-chan *packet) error {
 
 			icmpPacket := newIcmpData(&srcIP, &dstIP, 8, p.TTL, p.PacketsSent, p.id, currentUUID)
 			_, err := p.conn.Write(icmpPacket)
-			if err != nil {
+			if err != nil && !p.ContinueOnError {
 				return fmt.Errorf("%w: %s", errCannotWrite, err)
 			}
+			if err != nil {
+				// we never receive a reply, so this sequence counts as lost
+				log.Printf("warn: cannot write icmp_seq=%d: %s", p.PacketsSent, err)
+				p.PacketsSent++
+				continue
+			}
 
 			// mark this sequence as in-flight
 			p.awaitingSequences[currentUUID][p.PacketsSent] = struct{}{}
 			p.PacketsSent++
 
 		}
-		if p.Count > 0 && p.PacketsRecv >= p.Count {
+		if p.Count > 0 && p.packetsAnswered() >= p.Count {
 			p.done <- true
 			return nil
 		}
@@ -438,6 +476,8 @@ func (p *Pinger) Statistics() *Statistics {
 		PacketsSent:           sent,
 		PacketsRecv:           p.PacketsRecv,
 		PacketsRecvDuplicates: p.PacketsRecvDuplicates,
+		PacketsUnreachable:    p.PacketsUnreachable,
+		Unreachables:          p.unreachables,
 		PacketLoss:            loss,
 		Replies:               p.replies,
 		Addr:                  p.addr,
@@ -484,7 +524,7 @@ func (p *Pinger) recvICMP(recv chan<- *packet) error {
 		case <-p.done:
 			return nil
 		default:
-			if p.PacketsRecv >= p.Count {
+			if p.packetsAnswered() >= p.Count {
 				return nil
 			}
 			buf := make([]byte, 512)
@@ -499,6 +539,11 @@ func (p *Pinger) recvICMP(recv chan<- *packet) error {
 					delay = expBackoff.Get()
 					continue
 				}
+				if p.ContinueOnError {
+					log.Printf("warn: cannot read: %s", err)
+					delay = expBackoff.Get()
+					continue
+				}
 				return fmt.Errorf("%w: %s", errCannotRead, err)
 			}
 
@@ -533,6 +578,11 @@ func (p *Pinger) getCurrentTrackerUUID() uuid.UUID {
 }
 
 func (p *Pinger) processPacket(recv *packet) error {
+	if unreachable := p.parseUnreachable(recv.bytes[:recv.nbytes]); unreachable != nil {
+		p.processUnreachable(unreachable)
+		return nil
+	}
+
 	pkt := p.parseEchoReply(recv.bytes)
 
 	if pkt == nil || pkt.Data == nil {
@@ -633,6 +683,9 @@ func (p *Pinger) PrintStats() {
 	}
 	fmt.Println("--- " + p.Target + " ping statistics ---")
 	fmt.Printf("%d packets transmitted, %d received, %d%% packet loss\n", p.PacketsSent, p.PacketsRecv, int(p.PacketLoss()))
+	if p.PacketsUnreachable > 0 {
+		fmt.Printf("%d destination unreachable\n", p.PacketsUnreachable)
+	}
 	fmt.Printf("rtt min/avg/max/stdev = %v, %v, %v, %v\n", p.minRtt, p.avgRtt, p.maxRtt, p.stdDevRtt)
 }
 
@@ -6,12 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"runtime/debug"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ooni/minivpn/internal/mocks"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/uuid"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
@@ -512,3 +516,130 @@ func Test_NewFromSharedConnectionDoesNotCloseConn(t *testing.T) {
 		}
 	})
 }
+
+// echoReply returns the echo reply to the given echo request crafted by newIcmpData.
+func echoReply(t *testing.T, request []byte) []byte {
+	ip := &layers.IPv4{}
+	icmpLayer := &layers.ICMPv4{}
+	payload := gopacket.Payload{}
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, ip, icmpLayer, &payload)
+	decoded := []gopacket.LayerType{}
+	if err := parser.DecodeLayers(request, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+	icmpLayer.TypeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, icmpLayer, payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// makeConnFlakyRead returns a conn that answers each echo request, except for the
+// request with the given sequence number, whose reply is replaced by a read error.
+func makeConnFlakyRead(t *testing.T, failingSeq int) net.Conn {
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 16)
+	written := 0
+	conn := makeConn()
+	conn.MockWrite = func(b []byte) (int, error) {
+		if written == failingSeq {
+			results <- result{err: errors.New("transient read error")}
+		} else {
+			results <- result{data: echoReply(t, b)}
+		}
+		written++
+		return len(b), nil
+	}
+	conn.MockRead = func(b []byte) (int, error) {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				return 0, r.err
+			}
+			return copy(b, r.data), nil
+		case <-time.After(time.Millisecond):
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	return conn
+}
+
+func TestRunContinueOnError(t *testing.T) {
+	t.Run("a transient read error counts as a loss and the run completes", func(t *testing.T) {
+		pinger := New("127.0.0.2", makeConnFlakyRead(t, 1))
+		pinger.Count = 3
+		pinger.Interval = time.Millisecond
+		pinger.Timeout = 500 * time.Millisecond
+		pinger.Silent = true
+		pinger.ContinueOnError = true
+
+		err := pinger.Run(context.Background())
+		AssertNoError(t, err)
+
+		stats := pinger.Statistics()
+		if stats.PacketsSent != 3 || stats.PacketsRecv != 2 {
+			t.Errorf("sent = %d, recv = %d, want 3 and 2", stats.PacketsSent, stats.PacketsRecv)
+		}
+		if loss := pinger.PacketLoss(); loss != 33 {
+			t.Errorf("PacketLoss() = %d, want 33", loss)
+		}
+	})
+
+	t.Run("without ContinueOnError a transient read error aborts the run", func(t *testing.T) {
+		pinger := New("127.0.0.2", makeConnFlakyRead(t, 0))
+		pinger.Count = 3
+		pinger.Interval = time.Millisecond
+		pinger.Timeout = 500 * time.Millisecond
+		pinger.Silent = true
+
+		err := pinger.Run(context.Background())
+		if !errors.Is(err, errCannotRead) {
+			t.Errorf("Run() error = %v, want %v", err, errCannotRead)
+		}
+	})
+}
+
+func TestRunCanceled(t *testing.T) {
+	var writes atomic.Int64
+	conn := makeConn()
+	conn.MockWrite = func(b []byte) (int, error) {
+		writes.Add(1)
+		return len(b), nil
+	}
+	conn.MockRead = func([]byte) (int, error) {
+		time.Sleep(time.Millisecond)
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	pinger := New("127.0.0.2", conn)
+	pinger.Count = 1000
+	pinger.Interval = 5 * time.Millisecond
+	pinger.Timeout = time.Minute
+	pinger.Silent = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := pinger.Run(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run() returned after %v", elapsed)
+	}
+
+	// once canceled, we do not keep pinging in the background
+	time.Sleep(20 * time.Millisecond)
+	sent := writes.Load()
+	time.Sleep(50 * time.Millisecond)
+	if got := writes.Load(); got != sent {
+		t.Errorf("got %d writes after cancellation, want %d", got, sent)
+	}
+}
@@ -0,0 +1,86 @@
+package ping
+
+import (
+	"time"
+)
+
+// Result is the machine-readable result of a [Pinger] run, which serializes to JSON
+// with the round-trip times expressed in milliseconds.
+type Result struct {
+	// Target is the IP address we pinged.
+	Target string `json:"target"`
+
+	// PacketsSent is the number of echo requests we sent.
+	PacketsSent int `json:"packets_sent"`
+
+	// PacketsRecv is the number of echo replies we received.
+	PacketsRecv int `json:"packets_recv"`
+
+	// PacketsRecvDuplicates is the number of duplicate echo replies.
+	PacketsRecvDuplicates int `json:"packets_recv_duplicates"`
+
+	// PacketsUnreachable is the number of echo requests answered with ICMP
+	// Destination Unreachable.
+	PacketsUnreachable int `json:"packets_unreachable"`
+
+	// PacketLoss is the percentage of echo requests that were lost.
+	PacketLoss float64 `json:"packet_loss"`
+
+	// MinRtt, AvgRtt, MaxRtt and StdDevRtt are the round-trip time aggregates.
+	MinRtt    float64 `json:"min_rtt_ms"`
+	AvgRtt    float64 `json:"avg_rtt_ms"`
+	MaxRtt    float64 `json:"max_rtt_ms"`
+	StdDevRtt float64 `json:"stddev_rtt_ms"`
+
+	// Replies contains the echo replies, if the pinger records them (see
+	// [Pinger.RecordReplies]); otherwise, it is empty.
+	Replies []ResultReply `json:"replies"`
+}
+
+// ResultReply is a single echo reply in a [Result].
+type ResultReply struct {
+	// Seq is the 1-indexed sequence number.
+	Seq int `json:"seq"`
+
+	// TTL is the TTL of the reply.
+	TTL int `json:"ttl"`
+
+	// Rtt is the round-trip time.
+	Rtt float64 `json:"rtt_ms"`
+}
+
+// Result returns the [Result] of the run. Like [Pinger.Statistics], it can be called
+// while the pinger is running, or after it is finished.
+func (p *Pinger) Result() *Result {
+	stats := p.Statistics()
+	result := &Result{
+		Target:                p.Target,
+		PacketsSent:           stats.PacketsSent,
+		PacketsRecv:           stats.PacketsRecv,
+		PacketsRecvDuplicates: stats.PacketsRecvDuplicates,
+		PacketsUnreachable:    stats.PacketsUnreachable,
+		PacketLoss:            stats.PacketLoss,
+		MinRtt:                toMilliseconds(stats.MinRtt),
+		AvgRtt:                toMilliseconds(stats.AvgRtt),
+		MaxRtt:                toMilliseconds(stats.MaxRtt),
+		StdDevRtt:             toMilliseconds(stats.StdDevRtt),
+		Replies:               []ResultReply{},
+	}
+	if stats.PacketsSent == 0 {
+		// the statistics say NaN, which we cannot serialize
+		result.PacketLoss = 0
+	}
+	for _, reply := range stats.Replies {
+		result.Replies = append(result.Replies, ResultReply{
+			Seq: reply.Seq,
+			TTL: reply.TTL,
+			Rtt: toMilliseconds(reply.Rtt),
+		})
+	}
+	return result
+}
+
+// toMilliseconds converts a duration to fractional milliseconds.
+func toMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
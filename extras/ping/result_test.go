@@ -0,0 +1,64 @@
+package ping
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ooni/minivpn/internal/mocks"
+)
+
+func TestPinger_Result(t *testing.T) {
+	t.Run("a completed run serializes with replies and aggregates", func(t *testing.T) {
+		p := New("10.0.0.1", &mocks.Conn{})
+		p.RecordReplies = true
+		p.PacketsSent = 2
+		p.updateStatistics(&Packet{Seq: 0, Ttl: 64, Rtt: 10 * time.Millisecond})
+		p.updateStatistics(&Packet{Seq: 1, Ttl: 63, Rtt: 30 * time.Millisecond})
+		p.stdDevRtt = 10 * time.Millisecond
+
+		data, err := json.Marshal(p.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]any
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]any{
+			"target":                  "10.0.0.1",
+			"packets_sent":            float64(2),
+			"packets_recv":            float64(2),
+			"packets_recv_duplicates": float64(0),
+			"packets_unreachable":     float64(0),
+			"packet_loss":             float64(0),
+			"min_rtt_ms":              float64(10),
+			"avg_rtt_ms":              float64(20),
+			"max_rtt_ms":              float64(30),
+			"stddev_rtt_ms":           float64(10),
+			"replies": []any{
+				map[string]any{"seq": float64(1), "ttl": float64(64), "rtt_ms": float64(10)},
+				map[string]any{"seq": float64(2), "ttl": float64(63), "rtt_ms": float64(30)},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Error(diff)
+		}
+	})
+
+	t.Run("a run without packets serializes", func(t *testing.T) {
+		p := New("10.0.0.1", &mocks.Conn{})
+		data, err := json.Marshal(p.Result())
+		if err != nil {
+			t.Fatalf("json.Marshal() error = %v", err)
+		}
+		var got Result
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.PacketLoss != 0 || got.Replies == nil || len(got.Replies) != 0 {
+			t.Errorf("unexpected result: %+v", got)
+		}
+	})
+}
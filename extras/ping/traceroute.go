@@ -0,0 +1,143 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Hop is the result of a traceroute probe.
+type Hop struct {
+	// TTL is the TTL of the probe.
+	TTL int
+
+	// Addr is the address of the host that answered the probe, or nil
+	// when nobody answered before the timeout.
+	Addr net.IP
+
+	// Rtt is the round-trip time of the probe.
+	Rtt time.Duration
+
+	// Reached is true when the answer is an echo reply from the target.
+	Reached bool
+}
+
+// Traceroute sends probes to the target with increasing TTL, starting from one, and
+// records the hosts sending back ICMP Time Exceeded, which gives the path beyond the
+// tunnel egress. It stops when the target answers, or after maxHops probes. Each probe
+// waits for an answer for Interval. Traceroute does not change the statistics, and it
+// does not close the conn; it returns early when the context is done.
+func (p *Pinger) Traceroute(ctx context.Context, maxHops int) ([]Hop, error) {
+	srcIP := net.ParseIP(p.conn.LocalAddr().String())
+	dstIP := net.ParseIP(p.Target)
+	trackerUUID := p.getCurrentTrackerUUID()
+
+	var hops []Hop
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if err := ctx.Err(); err != nil {
+			return hops, err
+		}
+		sentAt := time.Now()
+		probe := newIcmpData(&srcIP, &dstIP, 8, ttl, ttl, p.id, trackerUUID)
+		if _, err := p.conn.Write(probe); err != nil {
+			return hops, fmt.Errorf("%w: %s", errCannotWrite, err)
+		}
+		hop, err := p.awaitHop(ttl, sentAt.Add(p.Interval))
+		if err != nil {
+			return hops, err
+		}
+		if hop.Addr != nil {
+			hop.Rtt = time.Since(sentAt)
+		}
+		if !p.Silent {
+			fmt.Printf("%d %s %.1f ms\n", hop.TTL, hop.Addr, hop.Rtt.Seconds()*1e3)
+		}
+		hops = append(hops, hop)
+		if hop.Reached {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// awaitHop reads until we receive the answer to the probe sent with the given TTL, or
+// until the deadline, in which case the returned hop has a nil address.
+func (p *Pinger) awaitHop(ttl int, deadline time.Time) (Hop, error) {
+	hop := Hop{TTL: ttl}
+	buf := make([]byte, 512)
+	for {
+		if err := p.conn.SetReadDeadline(deadline); err != nil {
+			return hop, fmt.Errorf("%w: %s", errCannotSetReadDeadline, err)
+		}
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return hop, nil
+			}
+			return hop, fmt.Errorf("%w: %s", errCannotRead, err)
+		}
+		src, seq, reached, ok := p.parseTracerouteReply(buf[:n])
+		if ok && seq == ttl {
+			hop.Addr, hop.Reached = src, reached
+			return hop, nil
+		}
+		if time.Now().After(deadline) {
+			return hop, nil
+		}
+	}
+}
+
+// parseTracerouteReply parses an echo reply from the target, or a Time Exceeded quoting
+// one of our probes, and returns the sender, the sequence number of the probe, and whether
+// the sender is the target. The last return value is false for any other packet.
+func (p *Pinger) parseTracerouteReply(data []byte) (net.IP, int, bool, bool) {
+	ip := layers.IPv4{}
+	icmp := layers.ICMPv4{}
+	payload := gopacket.Payload{}
+	decoded := []gopacket.LayerType{}
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip, &icmp, &payload)
+	if err := parser.DecodeLayers(data, &decoded); err != nil && len(decoded) < 2 {
+		return nil, 0, false, false
+	}
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv4TypeEchoReply:
+		if int(icmp.Id) != p.id || ip.SrcIP.String() != p.Target {
+			return nil, 0, false, false
+		}
+		return ip.SrcIP, int(icmp.Seq), true, true
+
+	case layers.ICMPv4TypeTimeExceeded:
+		id, seq, ok := parseQuotedEcho(payload.Payload())
+		if !ok || id != p.id {
+			return nil, 0, false, false
+		}
+		return ip.SrcIP, seq, false, true
+
+	default:
+		return nil, 0, false, false
+	}
+}
+
+// parseQuotedEcho parses the original datagram quoted by an ICMP error message, which
+// contains the IP header and the first eight bytes of the payload, and returns the ID and
+// the sequence number, when the original datagram is one of our echo requests.
+func parseQuotedEcho(quoted []byte) (int, int, bool) {
+	ip := layers.IPv4{}
+	if err := ip.DecodeFromBytes(quoted, gopacket.NilDecodeFeedback); err != nil {
+		return 0, 0, false
+	}
+	icmp := layers.ICMPv4{}
+	if err := icmp.DecodeFromBytes(ip.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return 0, 0, false
+	}
+	if icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+		return 0, 0, false
+	}
+	return int(icmp.Id), int(icmp.Seq), true
+}
@@ -0,0 +1,113 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// icmpError returns an ICMP error of the given type sent by src, which quotes the
+// header and the first eight bytes of the payload of the given request.
+func icmpError(t *testing.T, src net.IP, typeCode layers.ICMPv4TypeCode, request []byte) []byte {
+	quoted := &layers.IPv4{}
+	if err := quoted.DecodeFromBytes(request, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    src,
+		DstIP:    quoted.SrcIP,
+	}
+	icmpLayer := &layers.ICMPv4{TypeCode: typeCode}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	payload := gopacket.Payload(request[:int(quoted.IHL)*4+8])
+	if err := gopacket.SerializeLayers(buf, opts, ip, icmpLayer, payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// makeConnTraceroute returns a conn where the probes with TTL lower than hops get a Time
+// Exceeded from 10.0.0.TTL, and the others get an echo reply from the target.
+func makeConnTraceroute(t *testing.T, hops int) net.Conn {
+	replies := make(chan []byte, 16)
+	conn := makeConn()
+	conn.MockWrite = func(b []byte) (int, error) {
+		request := &layers.IPv4{}
+		if err := request.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+			t.Fatal(err)
+		}
+		if int(request.TTL) < hops {
+			router := net.IPv4(10, 0, 0, request.TTL)
+			timeExceeded := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded)
+			replies <- icmpError(t, router, timeExceeded, b)
+		} else {
+			replies <- echoReply(t, b)
+		}
+		return len(b), nil
+	}
+	conn.MockRead = func(b []byte) (int, error) {
+		select {
+		case reply := <-replies:
+			return copy(b, reply), nil
+		case <-time.After(10 * time.Millisecond):
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	return conn
+}
+
+func TestTraceroute(t *testing.T) {
+	t.Run("we record the routers and stop at the target", func(t *testing.T) {
+		pinger := New("127.0.0.2", makeConnTraceroute(t, 3))
+		pinger.Silent = true
+
+		hops, err := pinger.Traceroute(context.Background(), 10)
+		AssertNoError(t, err)
+		if len(hops) != 3 {
+			t.Fatalf("got %d hops, want 3: %v", len(hops), hops)
+		}
+		for i, want := range []string{"10.0.0.1", "10.0.0.2", "127.0.0.2"} {
+			if hops[i].TTL != i+1 || hops[i].Addr.String() != want {
+				t.Errorf("hop %d = %+v, want TTL %d from %s", i, hops[i], i+1, want)
+			}
+		}
+		if hops[0].Reached || hops[1].Reached || !hops[2].Reached {
+			t.Errorf("only the last hop should reach the target: %+v", hops)
+		}
+	})
+
+	t.Run("we stop after max hops", func(t *testing.T) {
+		pinger := New("127.0.0.2", makeConnTraceroute(t, 30))
+		pinger.Silent = true
+
+		hops, err := pinger.Traceroute(context.Background(), 5)
+		AssertNoError(t, err)
+		if len(hops) != 5 || hops[4].Reached {
+			t.Errorf("got hops %+v, want 5 hops without reaching the target", hops)
+		}
+	})
+
+	t.Run("a silent hop has no address", func(t *testing.T) {
+		conn := makeConn()
+		conn.MockWrite = func(b []byte) (int, error) { return len(b), nil }
+		conn.MockRead = func([]byte) (int, error) { return 0, os.ErrDeadlineExceeded }
+		pinger := New("127.0.0.2", conn)
+		pinger.Silent = true
+		pinger.Interval = time.Millisecond
+
+		hops, err := pinger.Traceroute(context.Background(), 2)
+		AssertNoError(t, err)
+		if len(hops) != 2 || hops[0].Addr != nil || hops[1].Addr != nil {
+			t.Errorf("got hops %+v, want 2 silent hops", hops)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package ping
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Unreachable is an ICMP Destination Unreachable (or ICMPv6 type 1) answer to one of
+// our packets, which tells us that the destination is down, rather than simply lost.
+type Unreachable struct {
+	// Seq is the sequence number of the packet, normalized to be 1-indexed like
+	// the one in [PingReply].
+	Seq int
+
+	// From is the address of the host sending the answer.
+	From net.IP
+
+	// Code is the code embedded in the answer (e.g., 1 for host unreachable).
+	Code int
+}
+
+// parseUnreachable returns the Destination Unreachable contained in data, or nil if data
+// is not a Destination Unreachable quoting one of our echo requests.
+func (p *Pinger) parseUnreachable(data []byte) *Unreachable {
+	if len(data) < 1 {
+		return nil
+	}
+	switch data[0] >> 4 {
+	case 4:
+		ip := layers.IPv4{}
+		icmp := layers.ICMPv4{}
+		if ip.DecodeFromBytes(data, gopacket.NilDecodeFeedback) != nil ||
+			ip.Protocol != layers.IPProtocolICMPv4 ||
+			icmp.DecodeFromBytes(ip.Payload, gopacket.NilDecodeFeedback) != nil ||
+			icmp.TypeCode.Type() != layers.ICMPv4TypeDestinationUnreachable {
+			return nil
+		}
+		id, seq, ok := parseQuotedEcho(icmp.Payload)
+		if !ok || id != p.id {
+			return nil
+		}
+		return &Unreachable{Seq: seq + 1, From: ip.SrcIP, Code: int(icmp.TypeCode.Code())}
+
+	case 6:
+		ip := layers.IPv6{}
+		icmp := layers.ICMPv6{}
+		if ip.DecodeFromBytes(data, gopacket.NilDecodeFeedback) != nil ||
+			ip.NextHeader != layers.IPProtocolICMPv6 ||
+			icmp.DecodeFromBytes(ip.Payload, gopacket.NilDecodeFeedback) != nil ||
+			icmp.TypeCode.Type() != layers.ICMPv6TypeDestinationUnreachable || len(icmp.Payload) < 4 {
+			return nil
+		}
+		// the quoted packet follows four unused bytes
+		id, seq, ok := parseQuotedEchoV6(icmp.Payload[4:])
+		if !ok || id != p.id {
+			return nil
+		}
+		return &Unreachable{Seq: seq + 1, From: ip.SrcIP, Code: int(icmp.TypeCode.Code())}
+
+	default:
+		return nil
+	}
+}
+
+// parseQuotedEchoV6 is like parseQuotedEcho, but for ICMPv6 echo requests.
+func parseQuotedEchoV6(quoted []byte) (int, int, bool) {
+	ip := layers.IPv6{}
+	if err := ip.DecodeFromBytes(quoted, gopacket.NilDecodeFeedback); err != nil {
+		return 0, 0, false
+	}
+	echo := ip.Payload
+	if ip.NextHeader != layers.IPProtocolICMPv6 || len(echo) < 8 || echo[0] != layers.ICMPv6TypeEchoRequest {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(echo[4:6])), int(binary.BigEndian.Uint16(echo[6:8])), true
+}
+
+// processUnreachable records the Destination Unreachable answer to an in-flight packet.
+func (p *Pinger) processUnreachable(unreachable *Unreachable) {
+	seq := unreachable.Seq - 1
+	trackerUUID := p.getCurrentTrackerUUID()
+	if _, inflight := p.awaitingSequences[trackerUUID][seq]; !inflight {
+		return
+	}
+	delete(p.awaitingSequences[trackerUUID], seq)
+
+	if !p.Silent {
+		fmt.Printf("from %s: icmp_seq=%d destination unreachable (code %d)\n", unreachable.From, seq, unreachable.Code)
+	}
+
+	p.statsMu.Lock()
+	p.PacketsUnreachable++
+	p.unreachables = append(p.unreachables, *unreachable)
+	p.statsMu.Unlock()
+
+	if handler := p.OnUnreachable; handler != nil {
+		handler(unreachable)
+	}
+}
@@ -0,0 +1,95 @@
+package ping
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// unreachableV6 returns an ICMPv6 Destination Unreachable sent by src, which quotes an
+// ICMPv6 echo request with the given ID and sequence number.
+func unreachableV6(t *testing.T, src net.IP, id, seq int) []byte {
+	serialize := func(l ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, l...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	quoted := serialize(
+		&layers.IPv6{Version: 6, NextHeader: layers.IPProtocolICMPv6, HopLimit: 64,
+			SrcIP: net.ParseIP("fd00::6"), DstIP: net.ParseIP("2001:db8::2")},
+		&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)},
+		&layers.ICMPv6Echo{Identifier: uint16(id), SeqNumber: uint16(seq)},
+	)
+	return serialize(
+		&layers.IPv6{Version: 6, NextHeader: layers.IPProtocolICMPv6, HopLimit: 64,
+			SrcIP: src, DstIP: net.ParseIP("fd00::6")},
+		&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, 3)},
+		gopacket.Payload(append([]byte{0, 0, 0, 0}, quoted...)),
+	)
+}
+
+func TestProcessPacket_Unreachable(t *testing.T) {
+	t.Run("an ipv4 destination unreachable is recorded with its code", func(t *testing.T) {
+		pinger := makeTestPinger()
+		pinger.Silent = true
+		var got *Unreachable
+		pinger.OnUnreachable = func(u *Unreachable) { got = u }
+		pinger.OnRecv = func(*Packet) { t.Error("OnRecv should not be called") }
+
+		src, dst := net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")
+		trackerUUID := pinger.getCurrentTrackerUUID()
+		request := newIcmpData(&src, &dst, 8, 64, 0, pinger.id, trackerUUID)
+		pinger.awaitingSequences[trackerUUID][0] = struct{}{}
+		pinger.PacketsSent = 1
+
+		router := net.ParseIP("10.0.0.1")
+		hostUnreachable := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost)
+		data := icmpError(t, router, hostUnreachable, request)
+		err := pinger.processPacket(&packet{bytes: data, nbytes: len(data)})
+		AssertNoError(t, err)
+
+		if got == nil || got.Seq != 1 || !got.From.Equal(router) || got.Code != int(layers.ICMPv4CodeHost) {
+			t.Fatalf("OnUnreachable got %+v, want seq 1 from %s with code %d", got, router, layers.ICMPv4CodeHost)
+		}
+		stats := pinger.Statistics()
+		if stats.PacketsUnreachable != 1 || len(stats.Unreachables) != 1 || stats.PacketsRecv != 0 {
+			t.Errorf("got stats %+v, want one unreachable and no replies", stats)
+		}
+
+		// a duplicate answer is ignored
+		AssertNoError(t, pinger.processPacket(&packet{bytes: data, nbytes: len(data)}))
+		AssertTrue(t, pinger.PacketsUnreachable == 1)
+	})
+
+	t.Run("an icmpv6 destination unreachable is recorded with its code", func(t *testing.T) {
+		pinger := makeTestPinger()
+		pinger.Silent = true
+		pinger.awaitingSequences[pinger.getCurrentTrackerUUID()][4] = struct{}{}
+
+		router := net.ParseIP("2001:db8::1")
+		data := unreachableV6(t, router, pinger.id, 4)
+		AssertNoError(t, pinger.processPacket(&packet{bytes: data, nbytes: len(data)}))
+
+		stats := pinger.Statistics()
+		if len(stats.Unreachables) != 1 {
+			t.Fatalf("got unreachables %+v, want one", stats.Unreachables)
+		}
+		if got := stats.Unreachables[0]; got.Seq != 5 || !got.From.Equal(router) || got.Code != 3 {
+			t.Errorf("got %+v, want seq 5 from %s with code 3", got, router)
+		}
+	})
+
+	t.Run("a destination unreachable for another pinger is ignored", func(t *testing.T) {
+		pinger := makeTestPinger()
+		pinger.Silent = true
+		pinger.awaitingSequences[pinger.getCurrentTrackerUUID()][0] = struct{}{}
+
+		data := unreachableV6(t, net.ParseIP("2001:db8::1"), pinger.id+1, 0)
+		AssertNoError(t, pinger.processPacket(&packet{bytes: data, nbytes: len(data)}))
+		AssertTrue(t, pinger.PacketsUnreachable == 0)
+	})
+}
@@ -0,0 +1,85 @@
+package extras
+
+// This file contains a scheduler that can be used to spread periodic
+// measurements over a VPN tunnel according to a memoryless distribution.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ooni/minivpn/extras/memoryless"
+)
+
+// Scheduler delivers ticks on C, separated by memoryless-distributed intervals
+// clamped between the configured Min and Max. Like a [time.Ticker], it drops
+// ticks to make up for slow receivers. Call Stop to release its resources.
+type Scheduler struct {
+	// C is the channel on which the ticks are delivered.
+	C <-chan time.Time
+
+	config   memoryless.Config
+	done     chan struct{}
+	newTimer timerFactory
+	once     sync.Once
+}
+
+// timerFactory arms a timer firing after the given duration and returns
+// its channel along with a function to stop it.
+type timerFactory func(d time.Duration) (<-chan time.Time, func() bool)
+
+// newSystemTimer is the [timerFactory] backed by [time.NewTimer].
+func newSystemTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// NewScheduler returns a [*Scheduler] using the given config, or an error
+// if the config does not make sense. When config.Once is true, the scheduler
+// delivers a single tick and then closes C.
+func NewScheduler(config memoryless.Config) (*Scheduler, error) {
+	return newScheduler(config, newSystemTimer)
+}
+
+// newScheduler is like [NewScheduler] but allows to choose the [timerFactory].
+func newScheduler(config memoryless.Config, newTimer timerFactory) (*Scheduler, error) {
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+	ticks := make(chan time.Time, 1)
+	s := &Scheduler{
+		C:        ticks,
+		config:   config,
+		done:     make(chan struct{}),
+		newTimer: newTimer,
+	}
+	go s.loop(ticks)
+	return s, nil
+}
+
+func (s *Scheduler) loop(ticks chan<- time.Time) {
+	defer close(ticks)
+	for {
+		// we have already checked the config, so the wait time is within bounds
+		expired, stop := s.newTimer(s.config.WaitTime())
+		select {
+		case tick := <-expired:
+			select {
+			case ticks <- tick:
+			default:
+			}
+			if s.config.Once {
+				return
+			}
+		case <-s.done:
+			stop()
+			return
+		}
+	}
+}
+
+// Stop stops the scheduler and closes C. It is safe to call Stop more than once.
+func (s *Scheduler) Stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
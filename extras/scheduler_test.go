@@ -0,0 +1,133 @@
+package extras
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ooni/minivpn/extras/memoryless"
+)
+
+func TestNewScheduler(t *testing.T) {
+	t.Run("a config that makes no sense is rejected", func(t *testing.T) {
+		_, err := NewScheduler(memoryless.Config{Expected: time.Second, Min: 2 * time.Second})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("the intervals between ticks stay within min and max", func(t *testing.T) {
+		const (
+			min      = 5 * time.Millisecond
+			max      = 20 * time.Millisecond
+			numTicks = 30
+		)
+		clock := newFakeClock(numTicks + 1)
+		s, err := newScheduler(memoryless.Config{Expected: 10 * time.Millisecond, Min: min, Max: max}, clock.newTimer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+
+		for i := 0; i < numTicks; i++ {
+			timer := <-clock.armed
+			if timer.d < min || timer.d > max {
+				t.Errorf("tick %d: interval %v not within [%v, %v]", i, timer.d, min, max)
+			}
+			deadline := clock.advance(timer.d)
+			timer.c <- deadline
+			// test that the tick is delivered with the exact deadline of the timer
+			if tick := <-s.C; !tick.Equal(deadline) {
+				t.Errorf("tick %d: expected %v, got %v", i, deadline, tick)
+			}
+		}
+	})
+
+	t.Run("stop stops the pending timer", func(t *testing.T) {
+		clock := newFakeClock(1)
+		s, err := newScheduler(memoryless.Config{Expected: time.Hour}, clock.newTimer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timer := <-clock.armed
+		s.Stop()
+		if _, ok := <-s.C; ok {
+			t.Fatal("unexpected tick")
+		}
+		if !timer.stopped() {
+			t.Fatal("expected the timer to be stopped")
+		}
+	})
+
+	t.Run("a once scheduler delivers a single tick", func(t *testing.T) {
+		s, err := NewScheduler(memoryless.Config{Expected: time.Millisecond, Max: time.Millisecond, Once: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+		if _, ok := <-s.C; !ok {
+			t.Fatal("expected a tick")
+		}
+		if _, ok := <-s.C; ok {
+			t.Fatal("expected the channel to be closed")
+		}
+	})
+
+	t.Run("stop closes the channel and can be called twice", func(t *testing.T) {
+		s, err := NewScheduler(memoryless.Config{Expected: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Stop()
+		s.Stop()
+		select {
+		case _, ok := <-s.C:
+			if ok {
+				t.Fatal("unexpected tick")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("stop did not close the channel")
+		}
+	})
+}
+
+// fakeTimer is a timer armed by a [fakeClock].
+type fakeTimer struct {
+	c    chan time.Time
+	d    time.Duration
+	stop *atomic.Bool
+}
+
+// stopped returns whether the scheduler stopped the timer.
+func (ft *fakeTimer) stopped() bool {
+	return ft.stop.Load()
+}
+
+// fakeClock is a [timerFactory] whose timers only fire when the test says so.
+type fakeClock struct {
+	armed chan *fakeTimer
+	now   time.Time
+}
+
+// newFakeClock returns a [*fakeClock] that can buffer up to size armed timers.
+func newFakeClock(size int) *fakeClock {
+	return &fakeClock{
+		armed: make(chan *fakeTimer, size),
+		now:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// advance moves the clock forward by d and returns the new time.
+func (fc *fakeClock) advance(d time.Duration) time.Time {
+	fc.now = fc.now.Add(d)
+	return fc.now
+}
+
+// newTimer implements [timerFactory].
+func (fc *fakeClock) newTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	ft := &fakeTimer{c: make(chan time.Time, 1), d: d, stop: &atomic.Bool{}}
+	fc.armed <- ft
+	return ft.c, func() bool {
+		return !ft.stop.Swap(true)
+	}
+}
@@ -43,6 +43,21 @@ func GenRandomBytes(size int) ([]byte, error) {
 	return b, err
 }
 
+// ReadRandomBytes is like [GenRandomBytes] but reads the bytes from the given source.
+func ReadRandomBytes(source io.Reader, size int) ([]byte, error) {
+	b := make([]byte, size)
+	_, err := io.ReadFull(source, b)
+	return b, err
+}
+
+// ZeroBytes overwrites the given buffer with zeroes. We use it to wipe
+// secrets from memory once we don't need them anymore.
+func ZeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 // EncodeOptionStringToBytes is used to encode the options string, username and password.
 //
 // According to the OpenVPN protocol, options are represented as a two-byte word,
@@ -52,12 +67,18 @@ func GenRandomBytes(size int) ([]byte, error) {
 //
 // This function returns errEncodeOption in case of failure.
 func EncodeOptionStringToBytes(s string) ([]byte, error) {
-	if len(s) >= math.MaxUint16 { // Using >= b/c we need to account for the final \0
+	return EncodeOptionBytesToBytes([]byte(s))
+}
+
+// EncodeOptionBytesToBytes is like [EncodeOptionStringToBytes] but takes a byte slice,
+// which allows the caller to wipe secrets (e.g., the password) once used.
+func EncodeOptionBytesToBytes(b []byte) ([]byte, error) {
+	if len(b) >= math.MaxUint16 { // Using >= b/c we need to account for the final \0
 		return nil, fmt.Errorf("%w:%s", ErrEncodeOption, "string too large")
 	}
-	data := make([]byte, 2)
-	binary.BigEndian.PutUint16(data, uint16(len(s))+1)
-	data = append(data, []byte(s)...)
+	data := make([]byte, 2, len(b)+3)
+	binary.BigEndian.PutUint16(data, uint16(len(b))+1)
+	data = append(data, b...)
 	data = append(data, 0x00)
 	return data, nil
 }
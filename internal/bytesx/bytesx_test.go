@@ -21,6 +21,32 @@ func Test_GenRandomBytes(t *testing.T) {
 	}
 }
 
+func Test_ReadRandomBytes(t *testing.T) {
+	t.Run("we read the bytes from the source", func(t *testing.T) {
+		data, err := ReadRandomBytes(bytes.NewReader([]byte("abcdef")), 4)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if string(data) != "abcd" {
+			t.Fatalf("unexpected data: %q", data)
+		}
+	})
+
+	t.Run("a short source fails", func(t *testing.T) {
+		if _, err := ReadRandomBytes(bytes.NewReader([]byte("ab")), 4); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func Test_ZeroBytes(t *testing.T) {
+	data := []byte("deadbeef")
+	ZeroBytes(data)
+	if !bytes.Equal(data, make([]byte, 8)) {
+		t.Fatalf("expected zeroed buffer, got %v", data)
+	}
+}
+
 func Test_EncodeOptionStringToBytes(t *testing.T) {
 	type args struct {
 		s string
@@ -61,6 +87,14 @@ func Test_EncodeOptionStringToBytes(t *testing.T) {
 			if diff := cmp.Diff(tt.want, got); diff != "" {
 				t.Fatal(diff)
 			}
+			// test that the byte slice version encodes the same way
+			got, err = EncodeOptionBytesToBytes([]byte(tt.args.s))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EncodeOptionBytesToBytes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatal(diff)
+			}
 		})
 	}
 }
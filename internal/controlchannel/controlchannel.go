@@ -45,6 +45,7 @@ func (svc *Service) StartWorkers(
 ) {
 	ws := &workersState{
 		logger:               config.Logger(),
+		maxPayload:           config.MaxControlPayload(),
 		notifyTLS:            *svc.NotifyTLS,
 		controlToReliable:    *svc.ControlToReliable,
 		reliableToControl:    svc.ReliableToControl,
@@ -60,6 +61,7 @@ func (svc *Service) StartWorkers(
 // workersState contains the control channel state.
 type workersState struct {
 	logger               model.Logger
+	maxPayload           int
 	notifyTLS            chan<- *model.Notification
 	controlToReliable    chan<- *model.Packet
 	reliableToControl    <-chan *model.Packet
@@ -96,7 +98,30 @@ func (ws *workersState) moveUpWorker() {
 				if ws.sessionManager.NegotiationState() < model.S_GENERATED_KEYS {
 					continue
 				}
+
+				// Unlike a hard reset, a SOFT_RESET keeps the session: we negotiate a
+				// new key in the slot chosen by the server, while the data channel keeps
+				// using the current key until the new one is ready.
+				if err := ws.sessionManager.StartRenegotiation(packet.KeyID); err != nil {
+					ws.logger.Warnf("%s: cannot renegotiate: %s", workerName, err.Error())
+					continue
+				}
 				ws.sessionManager.SetNegotiationState(model.S_INITIAL)
+
+				// Like the reference implementation, we answer with our own SOFT_RESET,
+				// which is the first control packet of the new key, with packet ID zero.
+				reply, err := ws.sessionManager.NewPacket(model.P_CONTROL_SOFT_RESET_V1, []byte{})
+				if err != nil {
+					ws.logger.Warnf("%s: NewPacket: %s", workerName, err.Error())
+					return
+				}
+				select {
+				case ws.controlToReliable <- reply:
+					// nothing
+
+				case <-ws.workersManager.ShouldShutdown():
+					return
+				}
 				// TODO(ainghazal): revisit this step.
 				// when we implement key rotation.  OpenVPN has
 				// the concept of a "lame duck", i.e., the
@@ -146,20 +171,23 @@ func (ws *workersState) moveDownWorker() {
 		// POSSIBLY BLOCK on reading the TLS record moving down the stack
 		select {
 		case record := <-ws.tlsRecordToControl:
-			// transform the record into a control message
-			packet, err := ws.sessionManager.NewPacket(model.P_CONTROL_V1, record)
-			if err != nil {
-				ws.logger.Warnf("%s: NewPacket: %s", workerName, err.Error())
-				return
-			}
+			// transform the record into one or more control messages, which
+			// the remote reassembles since TLS runs over a byte stream
+			for _, chunk := range splitPayload(record, ws.maxPayload) {
+				packet, err := ws.sessionManager.NewPacket(model.P_CONTROL_V1, chunk)
+				if err != nil {
+					ws.logger.Warnf("%s: NewPacket: %s", workerName, err.Error())
+					return
+				}
 
-			// POSSIBLY BLOCK on sending the packet down the stack
-			select {
-			case ws.controlToReliable <- packet:
-				// nothing
+				// POSSIBLY BLOCK on sending the packet down the stack
+				select {
+				case ws.controlToReliable <- packet:
+					// nothing
 
-			case <-ws.workersManager.ShouldShutdown():
-				return
+				case <-ws.workersManager.ShouldShutdown():
+					return
+				}
 			}
 
 		case <-ws.workersManager.ShouldShutdown():
@@ -167,3 +195,17 @@ func (ws *workersState) moveDownWorker() {
 		}
 	}
 }
+
+// splitPayload splits the given payload into chunks of at most maxSize bytes. When maxSize
+// is not positive, it returns the payload as a single chunk.
+func splitPayload(payload []byte, maxSize int) [][]byte {
+	if maxSize <= 0 || len(payload) <= maxSize {
+		return [][]byte{payload}
+	}
+	var chunks [][]byte
+	for len(payload) > maxSize {
+		chunks = append(chunks, payload[:maxSize])
+		payload = payload[maxSize:]
+	}
+	return append(chunks, payload)
+}
@@ -0,0 +1,182 @@
+package controlchannel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/session"
+	"github.com/ooni/minivpn/internal/workers"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+func Test_splitPayload(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xab}, 25)
+	tests := []struct {
+		name    string
+		maxSize int
+		want    []int
+	}{
+		{"no limit", 0, []int{25}},
+		{"the payload fits", 25, []int{25}},
+		{"the last chunk is shorter", 10, []int{10, 10, 5}},
+		{"exact multiple", 5, []int{5, 5, 5, 5, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitPayload(payload, tt.maxSize)
+			var sizes []int
+			for _, chunk := range chunks {
+				sizes = append(sizes, len(chunk))
+			}
+			if len(sizes) != len(tt.want) {
+				t.Fatalf("splitPayload() sizes = %v, want %v", sizes, tt.want)
+			}
+			for i := range sizes {
+				if sizes[i] != tt.want[i] {
+					t.Fatalf("splitPayload() sizes = %v, want %v", sizes, tt.want)
+				}
+			}
+			if !bytes.Equal(bytes.Join(chunks, nil), payload) {
+				t.Error("the chunks do not reassemble into the payload")
+			}
+		})
+	}
+}
+
+func TestService_maxControlPayload(t *testing.T) {
+	cfg := config.NewConfig(config.WithLogger(log.Log), config.WithMaxControlPayload(1000))
+	sessionManager, err := session.NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workersManager := workers.NewManager(log.Log)
+	defer func() {
+		workersManager.StartShutdown()
+		workersManager.WaitWorkersShutdown()
+	}()
+
+	notifyTLS := make(chan *model.Notification, 1)
+	controlToReliable := make(chan *model.Packet)
+	tlsRecordFromControl := make(chan []byte)
+	svc := &Service{
+		NotifyTLS:            &notifyTLS,
+		ControlToReliable:    &controlToReliable,
+		ReliableToControl:    make(chan *model.Packet),
+		TLSRecordToControl:   make(chan []byte),
+		TLSRecordFromControl: &tlsRecordFromControl,
+	}
+	svc.StartWorkers(cfg, workersManager, sessionManager)
+
+	record := bytes.Repeat([]byte{0xcd}, 2500)
+	svc.TLSRecordToControl <- record
+
+	var got []byte
+	var lastID model.PacketID
+	for _, want := range []int{1000, 1000, 500} {
+		select {
+		case packet := <-controlToReliable:
+			if packet.Opcode != model.P_CONTROL_V1 {
+				t.Fatalf("got opcode %s, want %s", packet.Opcode, model.P_CONTROL_V1)
+			}
+			if len(packet.Payload) != want {
+				t.Fatalf("got a %d-byte payload, want %d bytes", len(packet.Payload), want)
+			}
+			if packet.ID <= lastID && lastID != 0 {
+				t.Fatalf("packet IDs are not increasing: %d after %d", packet.ID, lastID)
+			}
+			lastID = packet.ID
+			got = append(got, packet.Payload...)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for a control packet")
+		}
+	}
+	if !bytes.Equal(got, record) {
+		t.Error("the packets do not reassemble into the record")
+	}
+}
+
+func TestService_softReset(t *testing.T) {
+	cfg := config.NewConfig(config.WithLogger(log.Log))
+	sessionManager, err := session.NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { <-sessionManager.Ready }()
+	workersManager := workers.NewManager(log.Log)
+	defer func() {
+		workersManager.StartShutdown()
+		workersManager.WaitWorkersShutdown()
+	}()
+
+	notifyTLS := make(chan *model.Notification, 1)
+	controlToReliable := make(chan *model.Packet)
+	tlsRecordFromControl := make(chan []byte)
+	svc := &Service{
+		NotifyTLS:            &notifyTLS,
+		ControlToReliable:    &controlToReliable,
+		ReliableToControl:    make(chan *model.Packet),
+		TLSRecordToControl:   make(chan []byte),
+		TLSRecordFromControl: &tlsRecordFromControl,
+	}
+	svc.StartWorkers(cfg, workersManager, sessionManager)
+
+	sessionManager.SetNegotiationState(model.S_GENERATED_KEYS)
+	firstKey, err := sessionManager.ActiveKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.ReliableToControl <- model.NewPacket(model.P_CONTROL_SOFT_RESET_V1, 1, nil)
+
+	// we answer with our own soft reset, which restarts the packet IDs for the new key
+	select {
+	case packet := <-controlToReliable:
+		if packet.Opcode != model.P_CONTROL_SOFT_RESET_V1 || packet.KeyID != 1 || packet.ID != 0 {
+			t.Fatalf("unexpected packet: %s key id %d packet id %d", packet.Opcode, packet.KeyID, packet.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for our soft reset")
+	}
+
+	select {
+	case notif := <-notifyTLS:
+		if notif.Flags&model.NotificationReset == 0 {
+			t.Fatalf("unexpected notification flags: %v", notif.Flags)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the TLS notification")
+	}
+
+	// we renegotiate within the same session rather than reconnecting
+	if state := sessionManager.NegotiationState(); state != model.S_INITIAL {
+		t.Errorf("expected %s, got %s", model.S_INITIAL, state)
+	}
+	if id := sessionManager.NegotiationKeyID(); id != 1 {
+		t.Errorf("expected to negotiate key id 1, got %d", id)
+	}
+	if id := sessionManager.CurrentKeyID(); id != 0 {
+		t.Errorf("expected the data channel to keep key id 0, got %d", id)
+	}
+	newKey, err := sessionManager.ActiveKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey == firstKey || newKey.Ready() {
+		t.Error("expected a new key slot that is not ready yet")
+	}
+
+	// a soft reset for the key id we are already using is ignored
+	sessionManager.SetNegotiationState(model.S_GENERATED_KEYS)
+	svc.ReliableToControl <- model.NewPacket(model.P_CONTROL_SOFT_RESET_V1, 1, nil)
+	select {
+	case <-notifyTLS:
+		t.Fatal("did not expect a TLS notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if state := sessionManager.NegotiationState(); state != model.S_GENERATED_KEYS {
+		t.Errorf("expected %s, got %s", model.S_GENERATED_KEYS, state)
+	}
+}
@@ -0,0 +1,55 @@
+package datachannel
+
+import "math"
+
+const (
+	// compressThreshold is the minimum size of a payload for which compression can be
+	// worthwhile. It is the same value used by the reference implementation.
+	compressThreshold = 100
+
+	// maxCompressibleEntropy is the entropy, in bits per byte, above which we consider a
+	// payload incompressible (e.g., because it is already compressed or encrypted).
+	maxCompressibleEntropy = 7.0
+
+	// noCompressByte is the compression byte of a packet sent uncompressed with comp-lzo.
+	noCompressByte = 0xfa
+)
+
+// lzoCompress compresses a payload using LZO. It is nil because we do not implement LZO
+// yet, which means that we send every packet uncompressed, which the remote accepts.
+var lzoCompress func(b []byte) []byte
+
+// compressAdaptive frames the given payload for the "comp-lzo adaptive" mode, in which
+// we decide for each packet whether to compress it: we only compress the payloads that
+// [adaptiveShouldCompress] deems compressible, and we send the payload uncompressed when
+// compress is nil or the compressed payload is not smaller than the original one.
+func compressAdaptive(b []byte, compress func(b []byte) []byte) []byte {
+	if compress != nil && adaptiveShouldCompress(b) {
+		if compressed := compress(b); len(compressed) < len(b) {
+			return append([]byte{lzoCompressByte}, compressed...)
+		}
+	}
+	return append([]byte{noCompressByte}, b...)
+}
+
+// adaptiveShouldCompress is the heuristic for the "comp-lzo adaptive" mode: it returns
+// true when the payload is large enough and its byte entropy is low enough that
+// compressing it is likely to save bytes.
+func adaptiveShouldCompress(b []byte) bool {
+	if len(b) < compressThreshold {
+		return false
+	}
+	var freq [256]int
+	for _, c := range b {
+		freq[c]++
+	}
+	entropy := 0.0
+	for _, n := range freq {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(b))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy <= maxCompressibleEntropy
+}
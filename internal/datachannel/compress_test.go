@@ -0,0 +1,84 @@
+package datachannel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func Test_adaptiveShouldCompress(t *testing.T) {
+	random := make([]byte, 1500)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"repetitive data is compressible", bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 64), true},
+		{"random data is not compressible", random, false},
+		{"small payloads are not worth compressing", []byte("aaaaaaaaaa"), false},
+		{"empty payloads are not worth compressing", []byte{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := adaptiveShouldCompress(tt.b); got != tt.want {
+				t.Errorf("adaptiveShouldCompress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_compressAdaptive(t *testing.T) {
+	random := make([]byte, 1500)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	repetitive := bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 64)
+
+	// shrink is a mocked compressor keeping the first half of the payload
+	shrink := func(b []byte) []byte {
+		return b[:len(b)/2]
+	}
+	// grow is a mocked compressor making the payload bigger
+	grow := func(b []byte) []byte {
+		return append(b, 0x00)
+	}
+
+	tests := []struct {
+		name      string
+		b         []byte
+		compress  func([]byte) []byte
+		wantByte  byte
+		wantCalls int
+	}{
+		{"compressible data is compressed", repetitive, shrink, lzoCompressByte, 1},
+		{"incompressible data is not compressed", random, shrink, noCompressByte, 0},
+		{"small payloads are not compressed", []byte("aaaaaaaaaa"), shrink, noCompressByte, 0},
+		{"compressed payloads that are not smaller are sent uncompressed", repetitive, grow, noCompressByte, 1},
+		{"without a compressor we send uncompressed payloads", repetitive, nil, noCompressByte, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			var compress func([]byte) []byte
+			if tt.compress != nil {
+				compress = func(b []byte) []byte {
+					calls++
+					return tt.compress(b)
+				}
+			}
+			got := compressAdaptive(tt.b, compress)
+			if got[0] != tt.wantByte {
+				t.Errorf("compressAdaptive(): compression byte = %x, want %x", got[0], tt.wantByte)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("compressAdaptive(): compressor calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantByte == noCompressByte && !bytes.Equal(got[1:], tt.b) {
+				t.Errorf("compressAdaptive(): expected the payload to be sent unchanged")
+			}
+		})
+	}
+}
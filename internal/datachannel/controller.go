@@ -5,6 +5,7 @@ import (
 	"crypto/hmac"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/apex/log"
 	"github.com/ooni/minivpn/internal/bytesx"
@@ -19,20 +20,28 @@ type dataChannelHandler interface {
 	setupKeys(*session.DataChannelKey) error
 	writePacket([]byte) (*model.Packet, error)
 	readPacket(*model.Packet) ([]byte, error)
-	decodeEncryptedPayload([]byte, *dataChannelState) (*encryptedData, error)
+	decodeEncryptedPayload(*model.Packet, *dataChannelState) (*encryptedData, error)
 	encryptAndEncodePayload([]byte, *dataChannelState) ([]byte, error)
 }
 
 // DataChannel represents the data "channel", that will encrypt and decrypt the tunnel payloads.
 // data implements the dataHandler interface.
 type DataChannel struct {
+	// mu protects the keys, the cipher and the packet IDs, which the keyWorker replaces
+	// on renegotiation while the moveUpWorker and the moveDownWorker are using them.
+	mu sync.RWMutex
+
 	options         *config.OpenVPNOptions
 	sessionManager  *session.Manager
 	state           *dataChannelState
-	decodeFn        func(model.Logger, []byte, *session.Manager, *dataChannelState) (*encryptedData, error)
+	decodeFn        func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error)
 	encryptEncodeFn func(model.Logger, []byte, *session.Manager, *dataChannelState) ([]byte, error)
 	decryptFn       func([]byte, *encryptedData) ([]byte, error)
 	log             model.Logger
+
+	// negotiated tells whether we have already switched to the negotiated cipher, which
+	// we do once, with the first key, since renegotiating the keys does not change it.
+	negotiated bool
 }
 
 var _ dataChannelHandler = &DataChannel{} // Ensure that we implement dataChannelHandler
@@ -58,22 +67,13 @@ func NewDataChannelFromOptions(logger model.Logger,
 	if err != nil {
 		return data, err
 	}
-	data.state.dataCipher = dataCipher
-	switch dataCipher.isAEAD() {
-	case true:
-		data.decodeFn = decodeEncryptedPayloadAEAD
-		data.encryptEncodeFn = encryptAndEncodePayloadAEAD
-	case false:
-		data.decodeFn = decodeEncryptedPayloadNonAEAD
-		data.encryptEncodeFn = encryptAndEncodePayloadNonAEAD
-	}
+	data.setDataCipher(dataCipher)
 
 	hmacHash, ok := newHMACFactory(strings.ToLower(opt.Auth))
 	if !ok {
 		return data, fmt.Errorf("%w: %s", ErrInitError, fmt.Sprintf("no such mac: %v", opt.Auth))
 	}
 	data.state.hash = hmacHash
-	data.decryptFn = state.dataCipher.decrypt
 
 	logger.Info(fmt.Sprintf("Cipher: %s", opt.Cipher))
 	logger.Info(fmt.Sprintf("Auth:   %s", opt.Auth))
@@ -81,18 +81,75 @@ func NewDataChannelFromOptions(logger model.Logger,
 	return data, nil
 }
 
+// setDataCipher configures the data channel to use the given cipher.
+func (d *DataChannel) setDataCipher(dataCipher dataCipher) {
+	d.state.dataCipher = dataCipher
+	switch dataCipher.isAEAD() {
+	case true:
+		d.decodeFn = decodeEncryptedPayloadAEAD
+		d.encryptEncodeFn = encryptAndEncodePayloadAEAD
+	case false:
+		d.decodeFn = decodeEncryptedPayloadNonAEAD
+		d.encryptEncodeFn = encryptAndEncodePayloadNonAEAD
+	}
+	d.decryptFn = dataCipher.decrypt
+}
+
+// setupNegotiatedCipher switches the data channel to the cipher pushed by the remote, if
+// any, which is the result of the cipher negotiation and takes precedence over the configured
+// one. This way, we use as much of the key material as the negotiated cipher needs.
+func (d *DataChannel) setupNegotiatedCipher() error {
+	pushed := d.sessionManager.TunnelInfo().Cipher
+	if pushed == "" || (d.options != nil && strings.EqualFold(pushed, d.options.Cipher)) {
+		return nil
+	}
+	dataCipher, err := newDataCipherFromCipherSuite(strings.ToUpper(pushed))
+	if err != nil {
+		return fmt.Errorf("%w: pushed cipher %s: %s", ErrInitError, pushed, err)
+	}
+	d.setDataCipher(dataCipher)
+	log.Infof("Negotiated cipher: %s", pushed)
+	return nil
+}
+
 // DecodeEncryptedPayload calls the corresponding function for AEAD or Non-AEAD decryption.
-func (d *DataChannel) decodeEncryptedPayload(b []byte, dcs *dataChannelState) (*encryptedData, error) {
-	return d.decodeFn(d.log, b, d.sessionManager, dcs)
+func (d *DataChannel) decodeEncryptedPayload(p *model.Packet, dcs *dataChannelState) (*encryptedData, error) {
+	return d.decodeFn(d.log, p, d.sessionManager, dcs)
 }
 
 // setSetupKeys performs the key expansion from the local and remote
-// keySources, initializing the data channel state.
+// keySources, initializing the data channel state. When we are renegotiating, it replaces
+// the keys in use and restarts the packet IDs, which are scoped to the key.
 func (d *DataChannel) setupKeys(dck *session.DataChannelKey) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.setupKeysLocked(dck); err != nil {
+		return err
+	}
+	d.state.resetPacketIDs()
+	d.sessionManager.PromoteKey()
+	return nil
+}
+
+// setupKeysLocked is like setupKeys but assumes we are holding the lock.
+func (d *DataChannel) setupKeysLocked(dck *session.DataChannelKey) error {
 	runtimex.Assert(dck != nil, "data channel key cannot be nil")
 	if !dck.Ready() {
 		return fmt.Errorf("%w: %s", errDataChannelKey, "key not ready")
 	}
+	if d.options != nil && d.options.AuthNoCache {
+		// we do not need the key sources once the keys have been derived
+		defer dck.Wipe()
+	}
+	if !d.negotiated {
+		if err := d.setupNegotiatedCipher(); err != nil {
+			return err
+		}
+		d.negotiated = true
+	}
+	if dck.Local().Method1 != nil {
+		return d.setupKeysMethod1(dck)
+	}
 	master := prf(
 		dck.Local().PreMaster[:],
 		[]byte("OpenVPN master secret"),
@@ -110,6 +167,10 @@ func (d *DataChannel) setupKeys(dck *session.DataChannelKey) error {
 		d.sessionManager.RemoteSessionID(),
 		256)
 
+	// make sure the intermediate key material does not linger in memory
+	defer bytesx.ZeroBytes(master)
+	defer bytesx.ZeroBytes(keys)
+
 	var keyLocal, hmacLocal, keyRemote, hmacRemote keySlot
 	copy(keyLocal[:], keys[0:64])
 	copy(hmacLocal[:], keys[64:128])
@@ -126,26 +187,56 @@ func (d *DataChannel) setupKeys(dck *session.DataChannelKey) error {
 	log.Debugf("Hmac key local:    %x", hmacLocal)
 	log.Debugf("Hmac key remote:   %x", hmacRemote)
 
-	hashSize := d.state.hash().Size()
-	d.state.hmacLocal = hmac.New(d.state.hash, hmacLocal[:hashSize])
-	d.state.hmacRemote = hmac.New(d.state.hash, hmacRemote[:hashSize])
+	d.setupHMAC(hmacLocal, hmacRemote)
 
 	log.Info("Key derivation OK")
 	return nil
 }
 
+// setupKeysMethod1 initializes the data channel state with the keys that have been
+// exchanged using key-method 1: we encrypt with our keys, and decrypt with the remote keys.
+func (d *DataChannel) setupKeysMethod1(dck *session.DataChannelKey) error {
+	if dck.Remote().Method1 == nil {
+		return fmt.Errorf("%w: %s", errDataChannelKey, "missing remote key-method 1 keys")
+	}
+	d.state.cipherKeyLocal = keySlot(dck.Local().Method1.Cipher)
+	d.state.hmacKeyLocal = keySlot(dck.Local().Method1.HMAC)
+	d.state.cipherKeyRemote = keySlot(dck.Remote().Method1.Cipher)
+	d.state.hmacKeyRemote = keySlot(dck.Remote().Method1.HMAC)
+
+	d.setupHMAC(d.state.hmacKeyLocal, d.state.hmacKeyRemote)
+
+	log.Info("Key setup OK (key-method 1)")
+	return nil
+}
+
+// setupHMAC initializes the local and remote hmac from the passed keys.
+func (d *DataChannel) setupHMAC(hmacLocal, hmacRemote keySlot) {
+	hashSize := d.state.hash().Size()
+	d.state.hmacLocal = hmac.New(d.state.hash, hmacLocal[:hashSize])
+	d.state.hmacRemote = hmac.New(d.state.hash, hmacRemote[:hashSize])
+}
+
 //
 // write + encrypt
 //
 
 func (d *DataChannel) writePacket(payload []byte) (*model.Packet, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	runtimex.Assert(d.state != nil, "data: nil state")
 	runtimex.Assert(d.state.dataCipher != nil, "data.state: nil dataCipher")
 	var err error
 
 	switch d.state.dataCipher.isAEAD() {
 	case false: // non-aead
-		localPacketID, _ := d.sessionManager.LocalDataPacketID()
+		localPacketID, err := d.sessionManager.LocalDataPacketID()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCannotEncrypt, fmt.Errorf("%w: %s", ErrExpiredKey, err))
+		}
+		if err := d.state.UseLocalPacketID(localPacketID); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCannotEncrypt, err)
+		}
 		payload = prependPacketID(localPacketID, payload)
 	case true:
 	}
@@ -159,7 +250,8 @@ func (d *DataChannel) writePacket(payload []byte) (*model.Packet, error) {
 	// parts in the packet.
 	encrypted, err := d.encryptAndEncodePayload(payload, d.state)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %s", ErrCannotEncrypt, err)
+		// note: we keep the wrapped error so that callers can detect ErrExpiredKey
+		return nil, err
 	}
 
 	// TODO(ainghazal): increment counter for used bytes
@@ -190,7 +282,7 @@ func (d *DataChannel) encryptAndEncodePayload(plaintext []byte, dcs *dataChannel
 
 	encrypted, err := d.encryptEncodeFn(d.log, padded, d.sessionManager, d.state)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%w: %s", ErrCannotEncrypt, err)
+		return []byte{}, fmt.Errorf("%w: %w", ErrCannotEncrypt, err)
 	}
 	return encrypted, nil
 
@@ -201,12 +293,14 @@ func (d *DataChannel) encryptAndEncodePayload(plaintext []byte, dcs *dataChannel
 //
 
 func (d *DataChannel) readPacket(p *model.Packet) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	if len(p.Payload) == 0 {
 		return nil, fmt.Errorf("%w: %s", ErrCannotDecrypt, "empty payload")
 	}
 	runtimex.Assert(p.IsData(), "ReadPacket expects data packet")
 
-	plaintext, err := d.decrypt(p.Payload)
+	plaintext, err := d.decrypt(p)
 	if err != nil {
 		return nil, err
 	}
@@ -215,7 +309,7 @@ func (d *DataChannel) readPacket(p *model.Packet) ([]byte, error) {
 	return maybeDecompress(plaintext, d.state, d.options)
 }
 
-func (d *DataChannel) decrypt(encrypted []byte) ([]byte, error) {
+func (d *DataChannel) decrypt(p *model.Packet) ([]byte, error) {
 	if d.decryptFn == nil {
 		return []byte{}, ErrInitError
 	}
@@ -223,7 +317,7 @@ func (d *DataChannel) decrypt(encrypted []byte) ([]byte, error) {
 		d.log.Warn("decrypt: not ready yet")
 		return nil, ErrCannotDecrypt
 	}
-	encryptedData, err := d.decodeEncryptedPayload(encrypted, d.state)
+	encryptedData, err := d.decodeEncryptedPayload(p, d.state)
 	if err != nil {
 		return []byte{}, fmt.Errorf("%w: %s", ErrCannotDecrypt, err)
 	}
@@ -2,7 +2,11 @@ package datachannel
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"errors"
+	"math"
 	"testing"
 
 	"github.com/apex/log"
@@ -76,6 +80,170 @@ func Test_DataChannel_setupKeys(t *testing.T) {
 	}
 }
 
+func Test_DataChannel_setupKeys_authNoCache(t *testing.T) {
+	isWiped := func(k *session.KeySource) bool {
+		return k.R1 == [32]byte{} && k.R2 == [32]byte{} && k.PreMaster == [48]byte{}
+	}
+
+	t.Run("key sources are wiped after key derivation with auth-nocache", func(t *testing.T) {
+		dck := makeTestingDataChannelKey()
+		dc := &DataChannel{
+			options:        &config.OpenVPNOptions{AuthNoCache: true},
+			sessionManager: makeTestingSession(),
+			state:          makeTestingStateAEAD(),
+		}
+		if err := dc.setupKeys(dck); err != nil {
+			t.Fatalf("setupKeys() error = %v", err)
+		}
+		if !isWiped(dck.Local()) || !isWiped(dck.Remote()) {
+			t.Error("expected key sources to be wiped")
+		}
+		if dc.state.cipherKeyLocal == (keySlot{}) || dc.state.hmacKeyRemote == (keySlot{}) {
+			t.Error("expected derived keys to be set")
+		}
+	})
+
+	t.Run("key sources are kept without auth-nocache", func(t *testing.T) {
+		dck := makeTestingDataChannelKey()
+		dc := &DataChannel{
+			options:        &config.OpenVPNOptions{},
+			sessionManager: makeTestingSession(),
+			state:          makeTestingStateAEAD(),
+		}
+		if err := dc.setupKeys(dck); err != nil {
+			t.Fatalf("setupKeys() error = %v", err)
+		}
+		if isWiped(dck.Local()) || isWiped(dck.Remote()) {
+			t.Error("expected key sources to be kept")
+		}
+	})
+}
+
+func Test_DataChannel_setupKeys_negotiatedCipher(t *testing.T) {
+	tests := []struct {
+		name        string
+		pushed      string
+		wantKeySize int
+		wantErr     error
+	}{
+		{"without a pushed cipher we use the configured one", "", 16, nil},
+		{"the pushed cipher takes precedence", "AES-256-GCM", 32, nil},
+		{"the pushed cipher is case insensitive", "aes-256-cbc", 32, nil},
+		{"we fail with an unsupported pushed cipher", "CHACHA20-POLY1305", 16, ErrInitError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := makeTestingSession()
+			session.UpdateTunnelInfo(&model.TunnelInfo{Cipher: tt.pushed})
+			options := &config.OpenVPNOptions{Cipher: "AES-128-GCM", Auth: "SHA1"}
+			dc, err := NewDataChannelFromOptions(log.Log, options, session)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dc.setupKeys(makeTestingDataChannelKey()); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("setupKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := dc.state.dataCipher.keySizeBytes(); got != tt.wantKeySize {
+				t.Fatalf("keySizeBytes() = %d, want %d", got, tt.wantKeySize)
+			}
+			if tt.wantErr != nil || !dc.state.dataCipher.isAEAD() {
+				return
+			}
+
+			// make sure we encrypt using as much key material as the negotiated cipher needs
+			iv := bytes.Repeat([]byte{0x01}, 12)
+			data := &plaintextData{iv: iv, plaintext: []byte("hello"), aead: []byte{0x02}}
+			encrypted, err := dc.state.dataCipher.encrypt(dc.state.cipherKeyLocal[:], data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, err := aes.NewCipher(dc.state.cipherKeyLocal[:tt.wantKeySize])
+			if err != nil {
+				t.Fatal(err)
+			}
+			gcm, err := cipher.NewGCM(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := gcm.Open(nil, iv, encrypted, data.aead); err != nil {
+				t.Errorf("cannot decrypt using a %d-byte key: %v", tt.wantKeySize, err)
+			}
+		})
+	}
+}
+
+func Test_DataChannel_setupKeys_negotiatedCipherOnce(t *testing.T) {
+	session := makeTestingSession()
+	session.UpdateTunnelInfo(&model.TunnelInfo{Cipher: "AES-256-GCM"})
+	options := &config.OpenVPNOptions{Cipher: "AES-128-GCM", Auth: "SHA1"}
+	dc, err := NewDataChannelFromOptions(log.Log, options, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.setupKeys(makeTestingDataChannelKey()); err != nil {
+		t.Fatalf("setupKeys() error = %v", err)
+	}
+	negotiated := dc.state.dataCipher
+
+	// a later key must not swap the cipher under the feet of the running workers
+	session.UpdateTunnelInfo(&model.TunnelInfo{Cipher: "AES-128-CBC"})
+	if err := dc.setupKeys(makeTestingDataChannelKey()); err != nil {
+		t.Fatalf("setupKeys() error = %v", err)
+	}
+	if dc.state.dataCipher != negotiated {
+		t.Errorf("setupKeys() changed the cipher when renegotiating the keys")
+	}
+}
+
+func Test_DataChannel_setupKeysMethod1(t *testing.T) {
+	local := &session.KeyMaterial{}
+	remote := &session.KeyMaterial{}
+	copy(local.Cipher[:], bytes.Repeat([]byte{0x01}, 64))
+	copy(local.HMAC[:], bytes.Repeat([]byte{0x02}, 64))
+	copy(remote.Cipher[:], bytes.Repeat([]byte{0x03}, 64))
+	copy(remote.HMAC[:], bytes.Repeat([]byte{0x04}, 64))
+
+	t.Run("exchanged keys are used without expansion", func(t *testing.T) {
+		dck := &session.DataChannelKey{}
+		dck.AddLocalKey(&session.KeySource{Method1: local})
+		dck.AddRemoteKey(&session.KeySource{Method1: remote})
+
+		dc := &DataChannel{
+			sessionManager: makeTestingSession(),
+			state:          makeTestingStateAEAD(),
+		}
+		if err := dc.setupKeys(dck); err != nil {
+			t.Fatalf("setupKeys() error = %v", err)
+		}
+		if dc.state.cipherKeyLocal != keySlot(local.Cipher) {
+			t.Errorf("unexpected local cipher key")
+		}
+		if dc.state.hmacKeyLocal != keySlot(local.HMAC) {
+			t.Errorf("unexpected local hmac key")
+		}
+		if dc.state.cipherKeyRemote != keySlot(remote.Cipher) {
+			t.Errorf("unexpected remote cipher key")
+		}
+		if dc.state.hmacKeyRemote != keySlot(remote.HMAC) {
+			t.Errorf("unexpected remote hmac key")
+		}
+	})
+
+	t.Run("missing remote keys should fail", func(t *testing.T) {
+		dck := &session.DataChannelKey{}
+		dck.AddLocalKey(&session.KeySource{Method1: local})
+		dck.AddRemoteKey(&session.KeySource{})
+
+		dc := &DataChannel{
+			sessionManager: makeTestingSession(),
+			state:          makeTestingStateAEAD(),
+		}
+		if err := dc.setupKeys(dck); !errors.Is(err, errDataChannelKey) {
+			t.Errorf("setupKeys() error = %v, wantErr %v", err, errDataChannelKey)
+		}
+	})
+}
+
 func Test_DataChannel_writePacket(t *testing.T) {
 	type fields struct {
 		options *config.OpenVPNOptions
@@ -157,9 +325,221 @@ func Test_DataChannel_writePacket(t *testing.T) {
 	}
 }
 
+func Test_DataChannel_writePacketRefusesPacketIDReuse(t *testing.T) {
+	tests := []struct {
+		name            string
+		state           *dataChannelState
+		encryptEncodeFn func(model.Logger, []byte, *session.Manager, *dataChannelState) ([]byte, error)
+	}{
+		{"aead", makeTestingStateAEAD(), encryptAndEncodePayloadAEAD},
+		{"non-aead", makeTestingStateNonAEAD(), encryptAndEncodePayloadNonAEAD},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &DataChannel{
+				log:             log.Log,
+				options:         &config.OpenVPNOptions{Compress: config.CompressionEmpty},
+				sessionManager:  makeTestingSession(),
+				state:           tt.state,
+				encryptEncodeFn: tt.encryptEncodeFn,
+			}
+			if _, err := dc.writePacket([]byte("hello test")); err != nil {
+				t.Fatalf("first write should not fail: %v", err)
+			}
+
+			// advance the packet ID to the boundary: the session would now give
+			// us an ID we already used, and we must refuse to encrypt with it.
+			dc.state.localPacketID = math.MaxUint32
+			_, err := dc.writePacket([]byte("hello test"))
+			if !errors.Is(err, ErrExpiredKey) {
+				t.Fatalf("data.WritePacket() error = %v, wantErr %v", err, ErrExpiredKey)
+			}
+			if !errors.Is(err, ErrCannotEncrypt) {
+				t.Fatalf("data.WritePacket() error = %v, wantErr %v", err, ErrCannotEncrypt)
+			}
+		})
+	}
+}
+
+func Test_DataChannel_peerIDRoundTrip(t *testing.T) {
+	// reversed returns a copy of the state with local and remote keys swapped,
+	// so that it can decrypt what the original state encrypts.
+	reversed := func(st *dataChannelState) *dataChannelState {
+		rev := &dataChannelState{
+			hash:            st.hash,
+			dataCipher:      st.dataCipher,
+			cipherKeyLocal:  st.cipherKeyRemote,
+			cipherKeyRemote: st.cipherKeyLocal,
+			hmacKeyLocal:    st.hmacKeyRemote,
+			hmacKeyRemote:   st.hmacKeyLocal,
+		}
+		rev.hmacLocal = hmac.New(rev.hash, rev.hmacKeyLocal[:20])
+		rev.hmacRemote = hmac.New(rev.hash, rev.hmacKeyRemote[:20])
+		return rev
+	}
+
+	tests := []struct {
+		name            string
+		state           *dataChannelState
+		encryptEncodeFn func(model.Logger, []byte, *session.Manager, *dataChannelState) ([]byte, error)
+		decodeFn        func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error)
+	}{
+		{"aead", makeTestingStateAEAD(), encryptAndEncodePayloadAEAD, decodeEncryptedPayloadAEAD},
+		{"non-aead", makeTestingStateNonAEAD(), encryptAndEncodePayloadNonAEAD, decodeEncryptedPayloadNonAEAD},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := makeTestingSession()
+			session.UpdateTunnelInfo(&model.TunnelInfo{PeerID: 0x123456})
+			options := &config.OpenVPNOptions{Compress: config.CompressionEmpty}
+
+			writer := &DataChannel{
+				log:             log.Log,
+				options:         options,
+				sessionManager:  session,
+				state:           tt.state,
+				encryptEncodeFn: tt.encryptEncodeFn,
+			}
+			packet, err := writer.writePacket([]byte("hello peer"))
+			if err != nil {
+				t.Fatalf("writePacket() error = %v", err)
+			}
+			if packet.Opcode != model.P_DATA_V2 {
+				t.Fatalf("writePacket() opcode = %v, want %v", packet.Opcode, model.P_DATA_V2)
+			}
+			wantPeerID := model.PeerID{0x12, 0x34, 0x56}
+			if packet.PeerID != wantPeerID {
+				t.Fatalf("writePacket() peer-id = %x, want %x", packet.PeerID, wantPeerID)
+			}
+
+			raw, err := packet.Bytes()
+			if err != nil {
+				t.Fatalf("Bytes() error = %v", err)
+			}
+			wantHeader := []byte{byte(model.P_DATA_V2) << 3, 0x12, 0x34, 0x56}
+			if diff := cmp.Diff(raw[:4], wantHeader); diff != "" {
+				t.Fatalf("unexpected wire header: %s", diff)
+			}
+
+			parsed, err := model.ParsePacket(raw)
+			if err != nil {
+				t.Fatalf("ParsePacket() error = %v", err)
+			}
+			if parsed.Opcode != model.P_DATA_V2 || parsed.PeerID != wantPeerID {
+				t.Fatalf("ParsePacket() = %v/%x, want %v/%x", parsed.Opcode, parsed.PeerID, model.P_DATA_V2, wantPeerID)
+			}
+
+			reader := &DataChannel{
+				log:            log.Log,
+				options:        options,
+				sessionManager: session,
+				state:          reversed(tt.state),
+				decodeFn:       tt.decodeFn,
+				decryptFn:      tt.state.dataCipher.decrypt,
+			}
+			got, err := reader.readPacket(parsed)
+			if err != nil {
+				t.Fatalf("readPacket() error = %v", err)
+			}
+			// note: the AEAD read path hands back the block padding added on write
+			if !bytes.HasPrefix(got, []byte("hello peer")) {
+				t.Errorf("readPacket() = %q, want %q", got, "hello peer")
+			}
+		})
+	}
+}
+
+func Test_DataChannel_rekey(t *testing.T) {
+	// mirror returns a data channel using the keys of the given one in the opposite direction,
+	// so that it can read what the given one writes and vice versa.
+	mirror := func(dc *DataChannel) *DataChannel {
+		dc.mu.RLock()
+		defer dc.mu.RUnlock()
+		peer := &DataChannel{
+			log:            log.Log,
+			options:        dc.options,
+			sessionManager: makeTestingSession(),
+			state: &dataChannelState{
+				hash:            dc.state.hash,
+				cipherKeyLocal:  dc.state.cipherKeyRemote,
+				cipherKeyRemote: dc.state.cipherKeyLocal,
+				hmacKeyLocal:    dc.state.hmacKeyRemote,
+				hmacKeyRemote:   dc.state.hmacKeyLocal,
+			},
+		}
+		peer.setDataCipher(dc.state.dataCipher)
+		peer.setupHMAC(peer.state.hmacKeyLocal, peer.state.hmacKeyRemote)
+		return peer
+	}
+
+	// exchange sends a few packets in both directions.
+	exchange := func(t *testing.T, client, server *DataChannel, wantKeyID uint8) {
+		for i := 0; i < 3; i++ {
+			for _, dir := range [][2]*DataChannel{{client, server}, {server, client}} {
+				packet, err := dir[0].writePacket([]byte("hello peer"))
+				if err != nil {
+					t.Fatalf("writePacket() error = %v", err)
+				}
+				if dir[0] == client && packet.KeyID != wantKeyID {
+					t.Fatalf("writePacket() key ID = %d, want %d", packet.KeyID, wantKeyID)
+				}
+				raw, err := packet.Bytes()
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := model.ParsePacket(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := dir[1].readPacket(parsed)
+				if err != nil {
+					t.Fatalf("readPacket() error = %v", err)
+				}
+				if !bytes.HasPrefix(got, []byte("hello peer")) {
+					t.Fatalf("readPacket() = %q, want %q", got, "hello peer")
+				}
+			}
+		}
+	}
+
+	for _, cipher := range []string{"AES-128-GCM", "AES-128-CBC"} {
+		t.Run(cipher, func(t *testing.T) {
+			manager := makeTestingSession()
+			options := &config.OpenVPNOptions{Cipher: cipher, Auth: "SHA1", Compress: config.CompressionEmpty}
+			client, err := NewDataChannelFromOptions(log.Log, options, manager)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.log = log.Log
+			if err := client.setupKeys(makeTestingDataChannelKey()); err != nil {
+				t.Fatalf("setupKeys() error = %v", err)
+			}
+			exchange(t, client, mirror(client), 0)
+
+			// the server starts a soft reset using key ID 1
+			if err := manager.StartRenegotiation(1); err != nil {
+				t.Fatal(err)
+			}
+			key, err := manager.ActiveKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote, err := session.NewKeySource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key.AddRemoteKey(remote)
+			if err := client.setupKeys(key); err != nil {
+				t.Fatalf("setupKeys() error = %v", err)
+			}
+			exchange(t, client, mirror(client), 1)
+		})
+	}
+}
+
 func Test_DataChannel_deadPacket(t *testing.T) {
 
-	goodMockDecodeFn := func(model.Logger, []byte, *session.Manager, *dataChannelState) (*encryptedData, error) {
+	goodMockDecodeFn := func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error) {
 		d := &encryptedData{
 			iv:         []byte{0xee},
 			ciphertext: []byte("garbledpayload"),
@@ -175,7 +555,7 @@ func Test_DataChannel_deadPacket(t *testing.T) {
 	type fields struct {
 		options   *config.OpenVPNOptions
 		state     *dataChannelState
-		decodeFn  func(model.Logger, []byte, *session.Manager, *dataChannelState) (*encryptedData, error)
+		decodeFn  func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error)
 		decryptFn func([]byte, *encryptedData) ([]byte, error)
 	}
 	type args struct {
@@ -243,7 +623,7 @@ func Test_Data_decrypt(t *testing.T) {
 		session         *session.Manager
 		state           *dataChannelState
 		decryptFn       func([]byte, *encryptedData) ([]byte, error)
-		decodeFn        func(model.Logger, []byte, *session.Manager, *dataChannelState) (*encryptedData, error)
+		decodeFn        func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error)
 		encryptEncodeFn func(model.Logger, []byte, *session.Manager, *dataChannelState) ([]byte, error)
 	}
 	type args struct {
@@ -262,7 +642,7 @@ func Test_Data_decrypt(t *testing.T) {
 				options: &config.OpenVPNOptions{},
 				session: makeTestingSession(),
 				state:   makeTestingStateAEAD(),
-				decodeFn: func(model.Logger, []byte, *session.Manager, *dataChannelState) (*encryptedData, error) {
+				decodeFn: func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error) {
 					return &encryptedData{}, nil
 				},
 				decryptFn: goodMockDecryptFn,
@@ -279,7 +659,7 @@ func Test_Data_decrypt(t *testing.T) {
 				options: &config.OpenVPNOptions{},
 				session: makeTestingSession(),
 				state:   makeTestingStateAEAD(),
-				decodeFn: func(model.Logger, []byte, *session.Manager, *dataChannelState) (*encryptedData, error) {
+				decodeFn: func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error) {
 					return &encryptedData{}, nil
 				},
 				decryptFn: goodMockDecryptFn,
@@ -296,7 +676,7 @@ func Test_Data_decrypt(t *testing.T) {
 				options: &config.OpenVPNOptions{},
 				session: makeTestingSession(),
 				state:   makeTestingStateAEAD(),
-				decodeFn: func(model.Logger, []byte, *session.Manager, *dataChannelState) (*encryptedData, error) {
+				decodeFn: func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error) {
 					return &encryptedData{}, nil
 				},
 				encryptEncodeFn: nil,
@@ -314,7 +694,7 @@ func Test_Data_decrypt(t *testing.T) {
 				options: &config.OpenVPNOptions{},
 				session: makeTestingSession(),
 				state:   makeTestingStateAEAD(),
-				decodeFn: func(model.Logger, []byte, *session.Manager, *dataChannelState) (*encryptedData, error) {
+				decodeFn: func(model.Logger, *model.Packet, *session.Manager, *dataChannelState) (*encryptedData, error) {
 					return &encryptedData{ciphertext: []byte("asdf")}, nil
 				},
 				decryptFn: goodMockDecryptFn,
@@ -336,7 +716,7 @@ func Test_Data_decrypt(t *testing.T) {
 				decryptFn:       tt.fields.decryptFn,
 				encryptEncodeFn: tt.fields.encryptEncodeFn,
 			}
-			got, err := d.decrypt(tt.args.encrypted)
+			got, err := d.decrypt(&model.Packet{Opcode: model.P_DATA_V2, Payload: tt.args.encrypted})
 			if !errors.Is(err, tt.wantErr) {
 				t.Errorf("data.decrypt() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -10,13 +10,12 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/sha512"
 	"fmt"
 	"hash"
-	"log"
+	"strings"
 
 	"github.com/ooni/minivpn/internal/bytesx"
+	"github.com/ooni/minivpn/internal/model"
 ) //#nosec G501,G505
 //  We know that sha1 and md5 are insecure, but we do not control the openvpn protocol.
 
@@ -99,6 +98,31 @@ type dataCipherAES struct {
 
 var _ dataCipher = &dataCipherAES{} // Ensure we implement dataCipher
 
+// blockFactory creates a block cipher from the given key (e.g., aes.NewCipher).
+type blockFactory func(key []byte) (cipher.Block, error)
+
+// dataCipherRegistered implements dataCipher for a cipher registered with
+// config.RegisterDataCipher, which uses the same modes as AES but creates
+// the block cipher using the registered constructor.
+type dataCipherRegistered struct {
+	dataCipherAES
+
+	// newBlock is the registered constructor of the block cipher.
+	newBlock blockFactory
+}
+
+var _ dataCipher = &dataCipherRegistered{} // Ensure we implement dataCipher
+
+// decrypt implements dataCipher.decrypt
+func (r *dataCipherRegistered) decrypt(key []byte, data *encryptedData) ([]byte, error) {
+	return r.decryptWith(r.newBlock, key, data)
+}
+
+// encrypt implements dataCipher.encrypt
+func (r *dataCipherRegistered) encrypt(key []byte, data *plaintextData) ([]byte, error) {
+	return r.encryptWith(r.newBlock, key, data)
+}
+
 // keySizeBytes implements dataCipher.keySizeBytes
 func (a *dataCipherAES) keySizeBytes() int {
 	return a.ksb
@@ -123,6 +147,11 @@ func (a *dataCipherAES) blockSize() uint8 {
 // Since key comes from a prf derivation, we only take as many bytes as we need to match
 // our key size.
 func (a *dataCipherAES) decrypt(key []byte, data *encryptedData) ([]byte, error) {
+	return a.decryptWith(aes.NewCipher, key, data)
+}
+
+// decryptWith is like decrypt but creates the block cipher using newBlock.
+func (a *dataCipherAES) decryptWith(newBlock blockFactory, key []byte, data *encryptedData) ([]byte, error) {
 	// TODO(ainghazal): split this function, it's too large
 	if len(key) < a.keySizeBytes() {
 		return nil, ErrInvalidKeySize
@@ -130,7 +159,7 @@ func (a *dataCipherAES) decrypt(key []byte, data *encryptedData) ([]byte, error)
 
 	// they key material might be longer
 	k := key[:a.keySizeBytes()]
-	block, err := aes.NewCipher(k)
+	block, err := newBlock(k)
 	if err != nil {
 		return nil, err
 	}
@@ -161,7 +190,6 @@ func (a *dataCipherAES) decrypt(key []byte, data *encryptedData) ([]byte, error)
 
 		plaintext, err := aesGCM.Open(nil, data.iv, data.ciphertext, data.aead)
 		if err != nil {
-			log.Println("gdm decryption failed:", err.Error())
 			return nil, err
 		}
 		return plaintext, nil
@@ -179,11 +207,16 @@ func (a *dataCipherAES) cipherMode() cipherMode {
 // Since key comes from a prf derivation, we only take as many bytes as we need to match
 // our key size.
 func (a *dataCipherAES) encrypt(key []byte, data *plaintextData) ([]byte, error) {
+	return a.encryptWith(aes.NewCipher, key, data)
+}
+
+// encryptWith is like encrypt but creates the block cipher using newBlock.
+func (a *dataCipherAES) encryptWith(newBlock blockFactory, key []byte, data *plaintextData) ([]byte, error) {
 	if len(key) < a.keySizeBytes() {
 		return nil, ErrInvalidKeySize
 	}
 	k := key[:a.keySizeBytes()]
-	block, err := aes.NewCipher(k)
+	block, err := newBlock(k)
 	if err != nil {
 		return nil, err
 	}
@@ -224,22 +257,20 @@ func (a *dataCipherAES) encrypt(key []byte, data *plaintextData) ([]byte, error)
 	}
 }
 
-// newDataCipherFromCipherSuite constructs a new dataCipher from the cipher suite string.
+// newDataCipherFromCipherSuite constructs a new dataCipher from the cipher suite string,
+// using the registry of the data channel ciphers (see [model.RegisterDataCipher]).
 func newDataCipherFromCipherSuite(c string) (dataCipher, error) {
-	switch c {
-	case "AES-128-CBC":
-		return newDataCipher(cipherNameAES, 128, cipherModeCBC)
-	case "AES-192-CBC":
-		return newDataCipher(cipherNameAES, 192, cipherModeCBC)
-	case "AES-256-CBC":
-		return newDataCipher(cipherNameAES, 256, cipherModeCBC)
-	case "AES-128-GCM":
-		return newDataCipher(cipherNameAES, 128, cipherModeGCM)
-	case "AES-256-GCM":
-		return newDataCipher(cipherNameAES, 256, cipherModeGCM)
-	default:
+	dc, found := model.LookupDataCipher(c)
+	if !found {
 		return nil, ErrUnsupportedCipher
 	}
+	if dc.NewBlock != nil {
+		// the registry has already validated the key size and the mode
+		base := dataCipherAES{ksb: dc.KeyBits / 8, mode: cipherMode(dc.Mode)}
+		return &dataCipherRegistered{dataCipherAES: base, newBlock: dc.NewBlock}, nil
+	}
+	// all the built-in ciphers use AES
+	return newDataCipher(cipherNameAES, dc.KeyBits, cipherMode(dc.Mode))
 }
 
 // newDataCipher constructs a new dataCipher from the given name, bits, and mode.
@@ -268,16 +299,12 @@ func newDataCipher(name cipherName, bits int, mode cipherMode) (dataCipher, erro
 // values: a function that will return a Hash implementation, and a boolean
 // indicating if the operation was successful.
 func newHMACFactory(name string) (func() hash.Hash, bool) {
-	switch name {
-	case "sha1":
-		return sha1.New, true
-	case "sha256":
-		return sha256.New, true
-	case "sha512":
-		return sha512.New, true
-	default:
-		return nil, false
+	for _, auth := range model.DataAuths {
+		if strings.EqualFold(auth.Name, name) {
+			return auth.New, true
+		}
 	}
+	return nil, false
 }
 
 // prf function is used to derive master and client keys
@@ -2,6 +2,8 @@ package datachannel
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
@@ -10,9 +12,11 @@ import (
 	"hash"
 	"log"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/ooni/minivpn/internal/bytesx"
+	"github.com/ooni/minivpn/pkg/config"
 )
 
 func Test_dataCipherAES_decrypt(t *testing.T) {
@@ -255,6 +259,53 @@ func Test_dataCipherAES_encrypt(t *testing.T) {
 	}
 }
 
+func Test_dataCipherAES_keyAndPaddingErrors(t *testing.T) {
+	iv12 := make([]byte, 12)
+	iv16 := make([]byte, 16)
+	for _, mode := range []cipherMode{cipherModeCBC, cipherModeGCM} {
+		iv := iv16
+		if mode == cipherModeGCM {
+			iv = iv12
+		}
+		dc := &dataCipherAES{ksb: 16, mode: mode}
+
+		t.Run(string(mode)+": a short key fails with ErrInvalidKeySize", func(t *testing.T) {
+			key := bytes.Repeat([]byte("A"), 15)
+			if _, err := dc.encrypt(key, &plaintextData{iv: iv, plaintext: make([]byte, 16)}); !errors.Is(err, ErrInvalidKeySize) {
+				t.Errorf("encrypt() error = %v, wantErr %v", err, ErrInvalidKeySize)
+			}
+			if _, err := dc.decrypt(key, &encryptedData{iv: iv, ciphertext: make([]byte, 32)}); !errors.Is(err, ErrInvalidKeySize) {
+				t.Errorf("decrypt() error = %v, wantErr %v", err, ErrInvalidKeySize)
+			}
+		})
+
+		t.Run(string(mode)+": a longer key is truncated to the key size", func(t *testing.T) {
+			plaintext, _ := doPadding([]byte("hello"), "", dc.blockSize())
+			long := bytes.Repeat([]byte("A"), 64)
+			exact := long[:16]
+			got, err := dc.encrypt(long, &plaintextData{iv: iv, plaintext: plaintext})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := dc.encrypt(exact, &plaintextData{iv: iv, plaintext: plaintext})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("expected the same ciphertext with the truncated key")
+			}
+		})
+	}
+
+	t.Run("cbc: an unpadded plaintext fails with ErrCannotEncrypt", func(t *testing.T) {
+		dc := &dataCipherAES{ksb: 16, mode: cipherModeCBC}
+		key := bytes.Repeat([]byte("A"), 16)
+		if _, err := dc.encrypt(key, &plaintextData{iv: iv16, plaintext: []byte("hello")}); !errors.Is(err, ErrCannotEncrypt) {
+			t.Errorf("encrypt() error = %v, wantErr %v", err, ErrCannotEncrypt)
+		}
+	})
+}
+
 func Test_dataCipher(t *testing.T) {
 	t.Run("aes-128-cbc", func(t *testing.T) {
 		if _, err := newDataCipher("aes", 128, "cbc"); err != nil {
@@ -336,6 +387,7 @@ func Test_newDataCipherFromCipherSuite(t *testing.T) {
 		{"aes-192-cbc", args{"AES-192-CBC"}, &dataCipherAES{24, "cbc"}, nil},
 		{"aes-256-cbc", args{"AES-256-CBC"}, &dataCipherAES{32, "cbc"}, nil},
 		{"aes-128-gcm", args{"AES-128-GCM"}, &dataCipherAES{16, "gcm"}, nil},
+		{"aes-192-gcm", args{"AES-192-GCM"}, &dataCipherAES{24, "gcm"}, nil},
 		{"aes-256-gcm", args{"AES-256-GCM"}, &dataCipherAES{32, "gcm"}, nil},
 		{"bad-256-gcm", args{"AES-512-GCM"}, nil, ErrUnsupportedCipher},
 	}
@@ -353,6 +405,110 @@ func Test_newDataCipherFromCipherSuite(t *testing.T) {
 	}
 }
 
+func TestRegisterDataCipher(t *testing.T) {
+	t.Run("a registered cipher is constructed using its block cipher", func(t *testing.T) {
+		for _, mode := range []config.DataCipherMode{config.DataCipherModeCBC, config.DataCipherModeGCM} {
+			name := "TEST-CIPHER-" + strings.ToUpper(string(mode))
+			var calls int
+			newBlock := func(key []byte) (cipher.Block, error) {
+				calls++
+				return aes.NewCipher(key)
+			}
+			if err := config.RegisterDataCipher(name, 192, mode, newBlock); err != nil {
+				t.Fatalf("RegisterDataCipher() error = %v", err)
+			}
+			t.Cleanup(func() { config.UnregisterDataCipher(name) })
+			calls = 0 // registering checks the constructor once
+
+			dc, err := newDataCipherFromCipherSuite(name)
+			if err != nil {
+				t.Fatalf("newDataCipherFromCipherSuite() error = %v", err)
+			}
+			if dc.keySizeBytes() != 24 || dc.cipherMode() != cipherMode(mode) {
+				t.Errorf("newDataCipherFromCipherSuite() = %v", dc)
+			}
+			if _, err := config.ParseConfig(strings.NewReader("cipher "+name), ""); err != nil {
+				t.Errorf("the config does not accept %s: %v", name, err)
+			}
+
+			// test that encryption and decryption round trip using the registered block cipher
+			key := bytes.Repeat([]byte{0x01}, 64)
+			plaintext := bytes.Repeat([]byte{0x02}, 32)
+			iv := bytes.Repeat([]byte{0x03}, 16)
+			input := plaintext
+			if dc.isAEAD() {
+				iv = iv[:12]
+			} else {
+				input, _ = bytesx.BytesPadPKCS7(plaintext, int(dc.blockSize()))
+			}
+			ciphertext, err := dc.encrypt(key, &plaintextData{iv: iv, plaintext: input})
+			if err != nil {
+				t.Fatalf("encrypt() error = %v", err)
+			}
+			got, err := dc.decrypt(key, &encryptedData{iv: iv, ciphertext: ciphertext})
+			if err != nil {
+				t.Fatalf("decrypt() error = %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("decrypt() = %x, want %x", got, plaintext)
+			}
+			if calls != 2 {
+				t.Errorf("expected the block cipher to be created twice, got %d", calls)
+			}
+		}
+	})
+
+	t.Run("an invalid cipher is rejected", func(t *testing.T) {
+		err := config.RegisterDataCipher("TEST-AES-64-CBC", 64, config.DataCipherModeCBC, aes.NewCipher)
+		if !errors.Is(err, config.ErrBadDataCipher) {
+			t.Fatalf("RegisterDataCipher() error = %v, want %v", err, config.ErrBadDataCipher)
+		}
+		if _, err := newDataCipherFromCipherSuite("TEST-AES-64-CBC"); !errors.Is(err, ErrUnsupportedCipher) {
+			t.Errorf("newDataCipherFromCipherSuite() error = %v, want %v", err, ErrUnsupportedCipher)
+		}
+	})
+
+	t.Run("built-in ciphers are still available", func(t *testing.T) {
+		got, err := newDataCipherFromCipherSuite("AES-256-GCM")
+		if err != nil {
+			t.Fatalf("newDataCipherFromCipherSuite() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, &dataCipherAES{32, "gcm"}) {
+			t.Errorf("newDataCipherFromCipherSuite() = %v", got)
+		}
+	})
+}
+
+// test that the algorithms advertised by the config are the ones the factories accept.
+func TestSupportedAlgorithmsMatchFactories(t *testing.T) {
+	ciphers := config.SupportedCiphers
+	if len(ciphers) == 0 {
+		t.Fatal("expected some supported ciphers")
+	}
+	for _, name := range ciphers {
+		if _, err := newDataCipherFromCipherSuite(name); err != nil {
+			t.Errorf("cipher %s is supported but the factory fails: %v", name, err)
+		}
+	}
+	auths := config.SupportedAuth
+	if len(auths) == 0 {
+		t.Fatal("expected some supported auth algorithms")
+	}
+	for _, name := range auths {
+		if _, ok := newHMACFactory(strings.ToLower(name)); !ok {
+			t.Errorf("auth %s is supported but the factory fails", name)
+		}
+	}
+	for _, name := range []string{"AES-512-GCM", "CHACHA20-POLY1305", "BF-CBC"} {
+		if _, err := newDataCipherFromCipherSuite(name); !errors.Is(err, ErrUnsupportedCipher) {
+			t.Errorf("cipher %s is not supported but the factory returns %v", name, err)
+		}
+	}
+	if _, ok := newHMACFactory("md5"); ok {
+		t.Error("auth MD5 is not supported but the factory accepts it")
+	}
+}
+
 // this particular test is basically equivalent to reimplementing the factory, but still
 // it's somehow useful to catch allowed values.
 func Test_newHMACFactory(t *testing.T) {
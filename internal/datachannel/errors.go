@@ -25,4 +25,12 @@ var (
 	ErrSerialization = errors.New("cannot create packet")
 	ErrCannotEncrypt = errors.New("cannot encrypt")
 	ErrCannotDecrypt = errors.New("cannot decrypt")
+
+	// ErrMuxerBusy indicates that we dropped an outgoing packet because the layer
+	// below could not accept it, according to the configured write policy.
+	ErrMuxerBusy = errors.New("muxer is busy")
+
+	// errCompressionNotAllowed indicates that the remote sent a compressed packet,
+	// which allow-compression does not allow.
+	errCompressionNotAllowed = errors.New("compression not allowed")
 )
@@ -0,0 +1,77 @@
+package datachannel
+
+//
+// Keepalive (ping and ping-restart)
+//
+
+import (
+	"time"
+
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+// keepaliveUnit is the unit of the ping and ping-restart intervals. We override it in tests.
+var keepaliveUnit = time.Second
+
+// keepaliveIntervals returns the ping and ping-restart intervals. The values pushed by the
+// remote take precedence over the local options. A zero interval means disabled.
+func keepaliveIntervals(options *config.OpenVPNOptions, tinfo model.TunnelInfo) (time.Duration, time.Duration) {
+	var ping, pingRestart int
+	if options != nil {
+		ping, pingRestart = options.Ping, options.PingRestart
+	}
+	if tinfo.Ping > 0 {
+		ping = tinfo.Ping
+	}
+	if tinfo.PingRestart > 0 {
+		pingRestart = tinfo.PingRestart
+	}
+	return time.Duration(ping) * keepaliveUnit, time.Duration(pingRestart) * keepaliveUnit
+}
+
+// keepaliveTimer wraps a [*time.Timer] that may be disabled. The channel of a disabled
+// timer is nil, so that selecting on it blocks forever.
+type keepaliveTimer struct {
+	interval time.Duration
+	timer    *time.Timer
+}
+
+// newKeepaliveTimer returns a [*keepaliveTimer] expiring after the given interval.
+func newKeepaliveTimer(interval time.Duration) *keepaliveTimer {
+	kt := &keepaliveTimer{interval: interval}
+	if interval > 0 {
+		kt.timer = time.NewTimer(interval)
+	}
+	return kt
+}
+
+// C returns the channel where the timer expiration is delivered.
+func (kt *keepaliveTimer) C() <-chan time.Time {
+	if kt == nil || kt.timer == nil {
+		return nil
+	}
+	return kt.timer.C
+}
+
+// Reset restarts the timer, if enabled.
+func (kt *keepaliveTimer) Reset() {
+	if kt == nil || kt.timer == nil {
+		return
+	}
+	if !kt.timer.Stop() {
+		select {
+		case <-kt.timer.C:
+		default:
+		}
+	}
+	kt.timer.Reset(kt.interval)
+}
+
+// Stop stops the timer, if enabled.
+func (kt *keepaliveTimer) Stop() {
+	if kt == nil || kt.timer == nil {
+		return
+	}
+	kt.timer.Stop()
+}
@@ -0,0 +1,99 @@
+package datachannel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/session"
+	"github.com/ooni/minivpn/internal/workers"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+func Test_keepaliveIntervals(t *testing.T) {
+	tests := []struct {
+		name            string
+		options         *config.OpenVPNOptions
+		tinfo           model.TunnelInfo
+		wantPing        time.Duration
+		wantPingRestart time.Duration
+	}{
+		{
+			name:            "disabled by default",
+			options:         &config.OpenVPNOptions{},
+			tinfo:           model.TunnelInfo{},
+			wantPing:        0,
+			wantPingRestart: 0,
+		},
+		{
+			name:            "local options",
+			options:         &config.OpenVPNOptions{Ping: 5, PingRestart: 60},
+			tinfo:           model.TunnelInfo{},
+			wantPing:        5 * time.Second,
+			wantPingRestart: 60 * time.Second,
+		},
+		{
+			name:            "pushed options override local options",
+			options:         &config.OpenVPNOptions{Ping: 5, PingRestart: 60},
+			tinfo:           model.TunnelInfo{Ping: 10, PingRestart: 120},
+			wantPing:        10 * time.Second,
+			wantPingRestart: 120 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ping, pingRestart := keepaliveIntervals(tt.options, tt.tinfo)
+			if ping != tt.wantPing {
+				t.Errorf("ping = %v, want %v", ping, tt.wantPing)
+			}
+			if pingRestart != tt.wantPingRestart {
+				t.Errorf("pingRestart = %v, want %v", pingRestart, tt.wantPingRestart)
+			}
+		})
+	}
+}
+
+func TestService_keepalive(t *testing.T) {
+	keepaliveUnit = time.Millisecond
+	defer func() {
+		keepaliveUnit = time.Second
+	}()
+
+	dataToMuxer := make(chan *model.Packet, 100)
+	keyReady := make(chan *session.DataChannelKey)
+
+	s := Service{
+		MuxerToData:          make(chan *model.Packet, 100),
+		DataOrControlToMuxer: &dataToMuxer,
+		TUNToData:            make(chan []byte, 100),
+		DataToTUN:            make(chan []byte, 100),
+		KeyReady:             keyReady,
+	}
+	workersManager := workers.NewManager(log.Log)
+	sessionManager := makeTestingSession()
+	sessionManager.UpdateTunnelInfo(&model.TunnelInfo{Ping: 10, PingRestart: 200})
+
+	opts := makeTestingOptions(t, "AES-128-GCM", "sha512")
+	s.StartWorkers(config.NewConfig(config.WithOpenVPNOptions(opts)), workersManager, sessionManager)
+	keyReady <- makeTestingDataChannelKey()
+	<-sessionManager.Ready
+
+	// we should send pings while idle
+	select {
+	case packet := <-dataToMuxer:
+		if packet.Opcode != model.P_DATA_V2 {
+			t.Errorf("unexpected opcode: %v", packet.Opcode)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a ping")
+	}
+
+	// without receiving anything, ping-restart should shut down the workers
+	select {
+	case <-workersManager.ShouldShutdown():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected ping-restart to shut down the workers")
+	}
+	workersManager.WaitWorkersShutdown()
+}
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/ooni/minivpn/internal/bytesx"
 	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/runtimex"
 	"github.com/ooni/minivpn/internal/session"
@@ -19,12 +18,16 @@ var (
 	ErrBadRemoteHMAC = errors.New("bad remote hmac")
 )
 
-func decodeEncryptedPayloadAEAD(log model.Logger, buf []byte, session *session.Manager, state *dataChannelState) (*encryptedData, error) {
+func decodeEncryptedPayloadAEAD(log model.Logger, p *model.Packet, session *session.Manager, state *dataChannelState) (*encryptedData, error) {
 	//   P_DATA_V2 GCM data channel crypto format
 	//   48000001 00000005 7e7046bd 444a7e28 cc6387b1 64a4d6c1 380275a...
 	//   [ OP32 ] [seq # ] [             auth tag            ] [ payload ... ]
 	//   - means authenticated -    * means encrypted *
 	//   [ - opcode/peer-id - ] [ - packet ID - ] [ TAG ] [ * packet payload * ]
+	//
+	// We authenticate the header we received rather than our own, which differs
+	// when the peer uses P_DATA_V1 or another key ID (see aeadAdditionalData).
+	buf := p.Payload
 
 	// preconditions
 	runtimex.Assert(state != nil, "passed nil state")
@@ -38,11 +41,7 @@ func decodeEncryptedPayloadAEAD(log model.Logger, buf []byte, session *session.M
 	}
 	remoteHMAC := state.hmacKeyRemote[:8]
 	packet_id := buf[:4]
-
-	headers := &bytes.Buffer{}
-	headers.WriteByte(opcodeAndKeyHeader(session))
-	bytesx.WriteUint24(headers, uint32(session.TunnelInfo().PeerID))
-	headers.Write(packet_id)
+	aead := aeadAdditionalData(p.Opcode, p.KeyID, p.PeerID, model.PacketID(binary.BigEndian.Uint32(packet_id)))
 
 	// we need to swap because decryption expects payload|tag
 	// but we've got tag | payload instead
@@ -58,14 +57,15 @@ func decodeEncryptedPayloadAEAD(log model.Logger, buf []byte, session *session.M
 	encrypted := &encryptedData{
 		iv:         iv.Bytes(),
 		ciphertext: payload.Bytes(),
-		aead:       headers.Bytes(),
+		aead:       aead,
 	}
 	return encrypted, nil
 }
 
 var ErrCannotDecode = errors.New("cannot decode")
 
-func decodeEncryptedPayloadNonAEAD(log model.Logger, buf []byte, session *session.Manager, state *dataChannelState) (*encryptedData, error) {
+func decodeEncryptedPayloadNonAEAD(log model.Logger, p *model.Packet, session *session.Manager, state *dataChannelState) (*encryptedData, error) {
+	buf := p.Payload
 	runtimex.Assert(state != nil, "passed nil state")
 	runtimex.Assert(state.dataCipher != nil, "data cipher not initialized")
 
@@ -88,7 +88,6 @@ func decodeEncryptedPayloadNonAEAD(log model.Logger, buf []byte, session *sessio
 	computedHMAC := state.hmacRemote.Sum(nil)
 
 	if !hmac.Equal(computedHMAC, receivedHMAC) {
-		log.Warnf("expected: %x, got: %x", computedHMAC, receivedHMAC)
 		return &encryptedData{}, fmt.Errorf("%w: %s", ErrCannotDecrypt, ErrBadHMAC)
 	}
 
@@ -100,10 +99,19 @@ func decodeEncryptedPayloadNonAEAD(log model.Logger, buf []byte, session *sessio
 	return encrypted, nil
 }
 
+const (
+	// lzoCompressByte is the compression byte of a packet compressed using LZO.
+	lzoCompressByte = 0x66
+
+	// lz4CompressByte is the compression byte of a packet compressed using LZ4.
+	lz4CompressByte = 0x69
+)
+
 // maybeDecompress de-serializes the data from the payload according to the framing
 // given by different compression methods. only the different no-compression
-// modes are supported at the moment, so no real decompression is done. It
-// returns a byte array, and an error if the operation could not be completed
+// modes are supported at the moment, so no real decompression is done: we reject
+// compressed packets, with errCompressionNotAllowed unless allow-compression allows
+// them. It returns a byte array, and an error if the operation could not be completed
 // successfully.
 func maybeDecompress(b []byte, st *dataChannelState, opt *config.OpenVPNOptions) ([]byte, error) {
 	if st == nil || st.dataCipher == nil {
@@ -122,7 +130,7 @@ func maybeDecompress(b []byte, st *dataChannelState, opt *config.OpenVPNOptions)
 	switch st.dataCipher.isAEAD() {
 	case true:
 		switch opt.Compress {
-		case config.CompressionStub, config.CompressionLZONo:
+		case config.CompressionStub, config.CompressionLZONo, config.CompressionLZOAdaptive:
 			// these are deprecated in openvpn 2.5.x
 			compr = b[0]
 			payload = b[1:]
@@ -142,7 +150,7 @@ func maybeDecompress(b []byte, st *dataChannelState, opt *config.OpenVPNOptions)
 		st.SetRemotePacketID(remotePacketID)
 
 		switch opt.Compress {
-		case config.CompressionStub, config.CompressionLZONo:
+		case config.CompressionStub, config.CompressionLZONo, config.CompressionLZOAdaptive:
 			compr = b[4]
 			payload = b[5:]
 		default:
@@ -165,6 +173,11 @@ func maybeDecompress(b []byte, st *dataChannelState, opt *config.OpenVPNOptions)
 		// 0xfa is the old no compression or comp-lzo no case.
 		// http://build.openvpn.net/doxygen/comp_8h_source.html
 		// see: https://community.openvpn.net/openvpn/ticket/952#comment:5
+	case lzoCompressByte, lz4CompressByte:
+		if !opt.CompressionAllowed() {
+			return []byte{}, fmt.Errorf("%w: received a compressed packet (%x)", errCompressionNotAllowed, compr)
+		}
+		return []byte{}, fmt.Errorf("%w: cannot decompress %x: LZO and LZ4 are not implemented", errBadCompression, compr)
 	default:
 		return []byte{}, fmt.Errorf("%w: cannot handle compression %x", errBadCompression, compr)
 	}
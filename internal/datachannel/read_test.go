@@ -2,12 +2,15 @@ package datachannel
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"encoding/hex"
 	"errors"
 	"reflect"
 	"testing"
 
 	"github.com/apex/log"
+	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/session"
 )
 
@@ -66,7 +69,7 @@ func Test_decodeEncryptedPayloadAEAD(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := decodeEncryptedPayloadAEAD(log.Log, tt.args.buf, tt.args.session, tt.args.state)
+			got, err := decodeEncryptedPayloadAEAD(log.Log, &model.Packet{Opcode: model.P_DATA_V2, Payload: tt.args.buf}, tt.args.session, tt.args.state)
 			if !errors.Is(err, tt.wantErr) {
 				t.Errorf("decodeEncryptedPayloadAEAD() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -78,6 +81,100 @@ func Test_decodeEncryptedPayloadAEAD(t *testing.T) {
 	}
 }
 
+func Test_aeadAdditionalData(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode model.Opcode
+		want   string
+	}{
+		{"P_DATA_V2 authenticates the opcode, the key ID and the peer-id", model.P_DATA_V2, "4900000700000005"},
+		{"P_DATA_V1 authenticates only the packet-id", model.P_DATA_V1, "00000005"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := aeadAdditionalData(tt.opcode, 1, model.PeerID{0, 0, 7}, 5)
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("aeadAdditionalData() = %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// sealReferenceAEAD seals the plaintext using AES-GCM directly, following the data channel
+// layout of the reference implementation (see openvpn_encrypt_aead): the nonce is the
+// packet-id followed by the first 8 bytes of the hmac key, the additional data is the
+// header up to the packet-id (only the packet-id for P_DATA_V1), and the packet is the
+// header followed by the tag and the ciphertext. We do not use our own encryption code,
+// so that the packets do not depend on it.
+func sealReferenceAEAD(cipherKey, hmacKey, header, packetID, plaintext []byte, opcodeLen int) []byte {
+	block, _ := aes.NewCipher(cipherKey)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := append(append([]byte{}, packetID...), hmacKey[:8]...)
+	additional := append(append([]byte{}, header[opcodeLen:]...), packetID...)
+	sealed := gcm.Seal(nil, nonce, plaintext, additional)
+	boundary := len(sealed) - gcm.Overhead()
+	packet := append(append([]byte{}, header...), packetID...)
+	packet = append(packet, sealed[boundary:]...)
+	return append(packet, sealed[:boundary]...)
+}
+
+// Test_decodeEncryptedPayloadAEAD_knownAnswer decrypts GCM data packets sent by a peer
+// using key ID 1 and peer-id 7, while our session uses key ID 0 and peer-id 0: we must
+// authenticate the received header. We could not capture packets from the reference
+// implementation here, so the vectors are the output of [sealReferenceAEAD].
+func Test_decodeEncryptedPayloadAEAD_knownAnswer(t *testing.T) {
+	remoteCipherKey := bytes.Repeat([]byte{0x66}, 16)
+	remoteHMACKey := bytes.Repeat([]byte{0x68}, 8)
+	packetID := []byte{0x00, 0x00, 0x00, 0x05}
+	plaintext := []byte("hello, openvpn!\n")
+
+	tests := []struct {
+		name      string
+		header    []byte
+		opcodeLen int
+		raw       string
+	}{{
+		name: "P_DATA_V2",
+		// the additional data includes the opcode/key-id and the peer-id
+		header:    []byte{0x49, 0x00, 0x00, 0x07},
+		opcodeLen: 0,
+		//    [op/key-id/peer-id] [packet-id] [              tag               ] [          ciphertext            ]
+		raw: "49000007" + "00000005" + "fadd12646666300f3dc5ed4ca5fb3481" + "558cd9525f65d274ba5c86beaed0596a",
+	}, {
+		name: "P_DATA_V1",
+		// the additional data does not include the opcode/key-id
+		header:    []byte{0x31},
+		opcodeLen: 1,
+		//    [op/key-id] [packet-id] [              tag               ] [          ciphertext            ]
+		raw: "31" + "00000005" + "02119092b8a6fb36d66f55f880d28fdb" + "558cd9525f65d274ba5c86beaed0596a",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, _ := hex.DecodeString(tt.raw)
+			sealed := sealReferenceAEAD(remoteCipherKey, remoteHMACKey, tt.header, packetID, plaintext, tt.opcodeLen)
+			if !bytes.Equal(raw, sealed) {
+				t.Fatalf("the vector does not match the reference layout: %x", sealed)
+			}
+			packet, err := model.ParsePacket(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := makeTestingStateAEAD()
+			encrypted, err := decodeEncryptedPayloadAEAD(log.Log, packet, makeTestingSession(), state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := state.dataCipher.decrypt(state.cipherKeyRemote[:], encrypted)
+			if err != nil {
+				t.Fatalf("decrypt() error = %v", err)
+			}
+			if string(got) != "hello, openvpn!\n" {
+				t.Errorf("decrypt() = %q, want %q", got, "hello, openvpn!\n")
+			}
+		})
+	}
+}
+
 func Test_decodeEncryptedPayloadNonAEAD(t *testing.T) {
 
 	goodInput, _ := hex.DecodeString("fdf9b069b2e5a637fa7b5c9231166ea96307e4123031323334353637383930313233343581e4878c5eec602c2d2f5a95139c84af")
@@ -131,7 +228,7 @@ func Test_decodeEncryptedPayloadNonAEAD(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := decodeEncryptedPayloadNonAEAD(log.Log, tt.args.buf, tt.args.session, tt.args.state)
+			got, err := decodeEncryptedPayloadNonAEAD(log.Log, &model.Packet{Opcode: model.P_DATA_V2, Payload: tt.args.buf}, tt.args.session, tt.args.state)
 			if !errors.Is(err, tt.wantErr) {
 				t.Errorf("decodeEncryptedPayloadNonAEAD() error = %v, wantErr %v", err, tt.wantErr)
 				return
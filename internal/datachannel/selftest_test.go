@@ -0,0 +1,63 @@
+package datachannel
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+// corruptHex returns the hex string with its first digit changed.
+func corruptHex(s string) string {
+	if s[0] == '0' {
+		return "1" + s[1:]
+	}
+	return "0" + s[1:]
+}
+
+func TestSelfTest(t *testing.T) {
+	t.Run("the self-test passes for all the built-in ciphers and hmacs", func(t *testing.T) {
+		if err := SelfTest(); err != nil {
+			t.Fatalf("SelfTest() error = %v", err)
+		}
+	})
+
+	t.Run("all the built-in ciphers have a test vector", func(t *testing.T) {
+		for _, name := range config.SupportedCiphers {
+			found := false
+			for _, v := range cipherTestVectors {
+				found = found || v.cipher == name
+			}
+			if !found {
+				t.Errorf("missing test vector for %s", name)
+			}
+		}
+	})
+
+	t.Run("a corrupted cipher vector makes the self-test fail", func(t *testing.T) {
+		for i := range cipherTestVectors {
+			ciphers := append([]cipherTestVector{}, cipherTestVectors...)
+			ciphers[i].ciphertext = corruptHex(ciphers[i].ciphertext)
+			if err := selfTest(ciphers, hmacTestVectors); !errors.Is(err, ErrSelfTest) {
+				t.Errorf("%s: selfTest() error = %v, want %v", ciphers[i].cipher, err, ErrSelfTest)
+			}
+		}
+	})
+
+	t.Run("a corrupted hmac vector makes the self-test fail", func(t *testing.T) {
+		for i := range hmacTestVectors {
+			hmacs := append([]hmacTestVector{}, hmacTestVectors...)
+			hmacs[i].mac = corruptHex(hmacs[i].mac)
+			if err := selfTest(cipherTestVectors, hmacs); !errors.Is(err, ErrSelfTest) {
+				t.Errorf("%s: selfTest() error = %v, want %v", hmacs[i].auth, err, ErrSelfTest)
+			}
+		}
+	})
+
+	t.Run("an unsupported cipher makes the self-test fail", func(t *testing.T) {
+		ciphers := []cipherTestVector{{cipher: "CHACHA20-POLY1305"}}
+		if err := selfTest(ciphers, nil); !errors.Is(err, ErrSelfTest) {
+			t.Errorf("selfTest() error = %v, want %v", err, ErrSelfTest)
+		}
+	})
+}
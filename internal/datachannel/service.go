@@ -5,9 +5,13 @@ package datachannel
 //
 
 import (
-	"encoding/hex"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/session"
@@ -36,6 +40,164 @@ type Service struct {
 
 	// KeyReady is where the TLSState layer passes us any new keys
 	KeyReady chan *session.DataChannelKey
+
+	// OnDroppedPacket is an OPTIONAL callback invoked, from the worker goroutines, every
+	// time we drop an outgoing data packet because the muxer is busy (see [ErrMuxerBusy]
+	// and [config.WithWritePolicy]). Packets we cannot decrypt are not reported here: see
+	// [Service.DecryptFailures] instead.
+	OnDroppedPacket func(direction model.Direction, err error)
+
+	// droppedPackets counts the data packets dropped because the muxer was busy.
+	droppedPackets atomic.Int64
+
+	// decryptFailures counts the incoming data packets we dropped because we could
+	// not decrypt them (e.g., because of a wrong key or a corrupt packet).
+	decryptFailures atomic.Int64
+
+	// settledPackets counts the packets read from TUNToData that we either
+	// delivered to the muxer or dropped.
+	settledPackets atomic.Int64
+
+	// pingOnce ensures we create pingNow just once.
+	pingOnce sync.Once
+
+	// pingNow asks the moveDownWorker to send a ping right away.
+	pingNow chan any
+
+	// probesMu protects probes.
+	probesMu sync.Mutex
+
+	// probes contains the channels to close when we receive the next data packet.
+	probes []chan any
+}
+
+// NewService returns a [*Service] whose data channels can hold bufferSize packets. The
+// DataOrControlToMuxer channel is nil and should be connected to the muxer. The KeyReady
+// channel always has room for one key, so that the TLS session does not block on us.
+func NewService(bufferSize int) *Service {
+	return &Service{
+		MuxerToData:          make(chan *model.Packet, bufferSize),
+		DataOrControlToMuxer: nil,
+		TUNToData:            make(chan []byte, bufferSize),
+		DataToTUN:            make(chan []byte, bufferSize),
+		KeyReady:             make(chan *session.DataChannelKey, 1),
+	}
+}
+
+// DroppedPackets returns the number of outgoing data packets we have dropped so far
+// because the muxer was busy.
+func (s *Service) DroppedPackets() int64 {
+	return s.droppedPackets.Load()
+}
+
+// Stats contains the data channel counters.
+type Stats struct {
+	// DroppedPackets is the number of outgoing data packets we dropped because
+	// the layer below was busy.
+	DroppedPackets int64
+
+	// DecryptFailures is the number of incoming data packets we dropped because we
+	// could not decrypt them (e.g., because of a wrong key or a corrupt packet).
+	DecryptFailures int64
+}
+
+// Stats returns a snapshot of the data channel counters. It is safe to call
+// it concurrently with the workers.
+func (s *Service) Stats() Stats {
+	return Stats{
+		DroppedPackets:  s.droppedPackets.Load(),
+		DecryptFailures: s.decryptFailures.Load(),
+	}
+}
+
+// DecryptFailures returns the number of incoming data packets we have dropped so far
+// because we could not decrypt them.
+func (s *Service) DecryptFailures() int64 {
+	return s.decryptFailures.Load()
+}
+
+// SettledPackets returns the number of packets read from TUNToData that we have either
+// delivered to the muxer or dropped. When it equals the number of packets written to
+// TUNToData, there are no outgoing packets left in the data channel.
+func (s *Service) SettledPackets() int64 {
+	return s.settledPackets.Load()
+}
+
+// onSettledPacket accounts for a packet read from TUNToData that we're done with.
+func (s *Service) onSettledPacket() {
+	s.settledPackets.Add(1)
+}
+
+// pingChannel returns the channel asking the moveDownWorker to send a ping right away.
+func (s *Service) pingChannel() chan any {
+	s.pingOnce.Do(func() {
+		s.pingNow = make(chan any, 1)
+	})
+	return s.pingNow
+}
+
+// HealthCheck sends a ping to the remote, and waits until we receive the next ping from the
+// remote, which answers ours or is its own keepalive. Other data packets do not count, since
+// the remote may have sent them before we pinged it. It returns the elapsed time, or the
+// context error if the context is done first.
+func (s *Service) HealthCheck(ctx context.Context) (time.Duration, error) {
+	probe := make(chan any)
+	s.probesMu.Lock()
+	s.probes = append(s.probes, probe)
+	s.probesMu.Unlock()
+
+	start := time.Now()
+	select {
+	case s.pingChannel() <- true:
+	default:
+		// a ping is already pending
+	}
+
+	select {
+	case <-probe:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		s.removeProbe(probe)
+		return 0, ctx.Err()
+	}
+}
+
+// removeProbe removes a probe registered by [Service.HealthCheck], if still there.
+func (s *Service) removeProbe(probe chan any) {
+	s.probesMu.Lock()
+	defer s.probesMu.Unlock()
+	for idx, p := range s.probes {
+		if p == probe {
+			s.probes = append(s.probes[:idx], s.probes[idx+1:]...)
+			return
+		}
+	}
+}
+
+// onPing completes the pending health checks when we receive a ping from the remote.
+func (s *Service) onPing() {
+	s.probesMu.Lock()
+	defer s.probesMu.Unlock()
+	for _, probe := range s.probes {
+		close(probe)
+	}
+	s.probes = nil
+}
+
+// onReadFailure accounts for an incoming packet we could not read.
+func (s *Service) onReadFailure(err error) {
+	if errors.Is(err, ErrCannotDecrypt) {
+		s.decryptFailures.Add(1)
+	}
+}
+
+// onDroppedPacket accounts for a packet dropped because the muxer is busy and invokes
+// the user callback, if any.
+func (s *Service) onDroppedPacket(direction model.Direction, err error) {
+	s.droppedPackets.Add(1)
+	if s.OnDroppedPacket != nil {
+		s.OnDroppedPacket(direction, err)
+	}
 }
 
 // StartWorkers starts the data-channel workers.
@@ -46,7 +208,8 @@ type Service struct {
 // eventually BLOCKS on tunUp to deliver it;
 //
 // 2. moveDownWorker BLOCKS on tunDown to read a packet and
-// eventually BLOCKS on dataOrControlToMuxer to deliver it;
+// eventually BLOCKS on dataOrControlToMuxer to deliver it, according
+// to the configured write policy;
 //
 // 3. keyWorker BLOCKS on keyUp to read a dataChannelKey and
 // initializes the internal state with the resulting key;
@@ -60,36 +223,57 @@ func (s *Service) StartWorkers(
 		config.Logger().Warnf("cannot initialize channel %v", err)
 		return
 	}
+	writePolicy, writeTimeout := config.WritePolicy()
 	ws := &workersState{
+		captureSink:          config.CaptureSink(),
 		dataChannel:          dc,
 		dataOrControlToMuxer: *s.DataOrControlToMuxer,
+		decryptLogThrottle:   newLogThrottle(decryptLogInterval),
+		dropLogThrottle:      newLogThrottle(dropLogInterval),
 		dataToTUN:            s.DataToTUN,
 		keyReady:             s.KeyReady,
 		logger:               config.Logger(),
 		muxerToData:          s.MuxerToData,
+		onDroppedPacket:      s.onDroppedPacket,
+		onPing:               s.onPing,
+		onReadFailure:        s.onReadFailure,
+		onSettledPacket:      s.onSettledPacket,
+		pingNow:              s.pingChannel(),
 		sessionManager:       sessionManager,
 		tunToData:            s.TUNToData,
 		workersManager:       workersManager,
+		writePolicy:          writePolicy,
+		writeTimeout:         writeTimeout,
 	}
 
 	firstKeyReady := make(chan any)
 
-	workersManager.StartWorker(ws.moveUpWorker)
+	workersManager.StartWorker(func() { ws.moveUpWorker(firstKeyReady) })
 	workersManager.StartWorker(func() { ws.moveDownWorker(firstKeyReady) })
 	workersManager.StartWorker(func() { ws.keyWorker(firstKeyReady) })
 }
 
 // workersState contains the data channel state.
 type workersState struct {
+	captureSink          func(model.Direction, []byte)
 	dataChannel          *DataChannel
 	dataOrControlToMuxer chan<- *model.Packet
 	dataToTUN            chan<- []byte
+	decryptLogThrottle   *logThrottle
+	dropLogThrottle      *logThrottle
 	keyReady             <-chan *session.DataChannelKey
 	logger               model.Logger
 	muxerToData          <-chan *model.Packet
+	onDroppedPacket      func(model.Direction, error)
+	onPing               func()
+	onReadFailure        func(error)
+	onSettledPacket      func()
+	pingNow              <-chan any
 	sessionManager       *session.Manager
 	tunToData            <-chan []byte
 	workersManager       *workers.Manager
+	writePolicy          config.WritePolicy
+	writeTimeout         time.Duration
 }
 
 // moveDownWorker moves packets down the stack. It will BLOCK on PacketDown
@@ -105,33 +289,124 @@ func (ws *workersState) moveDownWorker(firstKeyReady <-chan any) {
 	select {
 	// wait for the first key to be ready
 	case <-firstKeyReady:
+		// we send a ping when we have not sent anything for the ping interval
+		ping, _ := keepaliveIntervals(ws.dataChannel.options, ws.sessionManager.TunnelInfo())
+		pingTimer := newKeepaliveTimer(ping)
+		defer pingTimer.Stop()
+
 		for {
+			var (
+				data    []byte
+				fromTUN bool
+			)
 			select {
-			case data := <-ws.tunToData:
-				// TODO: writePacket should get the ACTIVE KEY (verify this)
-				packet, err := ws.dataChannel.writePacket(data)
-				if err != nil {
-					ws.logger.Warnf("error encrypting: %v", err)
-					continue
-				}
-
-				select {
-				case ws.dataOrControlToMuxer <- packet:
-				case <-ws.workersManager.ShouldShutdown():
-					return
-				}
-
+			case data = <-ws.tunToData:
+				ws.capture(model.DirectionOutgoing, data)
+				fromTUN = true
+			case <-pingTimer.C():
+				data = model.PingPayload()
+			case <-ws.pingNow:
+				data = model.PingPayload()
 			case <-ws.workersManager.ShouldShutdown():
 				return
 			}
+			pingTimer.Reset()
+
+			// TODO: writePacket should get the ACTIVE KEY (verify this)
+			packet, err := ws.dataChannel.writePacket(data)
+			if err != nil {
+				ws.logger.Warnf("error encrypting: %v", err)
+				ws.settle(fromTUN)
+				continue
+			}
+
+			if !ws.deliverDown(packet) {
+				return
+			}
+			ws.settle(fromTUN)
 		}
 	case <-ws.workersManager.ShouldShutdown():
 		return
 	}
 }
 
-// moveUpWorker moves packets up the stack
-func (ws *workersState) moveUpWorker() {
+// deliverDown delivers a packet to the muxer according to the write policy, dropping it
+// if the muxer is busy for too long. It returns false if we should shut down.
+func (ws *workersState) deliverDown(packet *model.Packet) bool {
+	// with the drop policy, we only deliver packets the muxer can accept right away
+	if ws.writePolicy == config.WritePolicyDrop {
+		select {
+		case ws.dataOrControlToMuxer <- packet:
+		default:
+			ws.dropBusy()
+		}
+		return true
+	}
+
+	// otherwise, we block until the timeout, if any; a nil channel blocks forever
+	var timeout <-chan time.Time
+	if ws.writeTimeout > 0 {
+		timer := time.NewTimer(ws.writeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case ws.dataOrControlToMuxer <- packet:
+	case <-timeout:
+		ws.dropBusy()
+	case <-ws.workersManager.ShouldShutdown():
+		return false
+	}
+	return true
+}
+
+// settle accounts for an outgoing packet we're done with, if it came from the TUN.
+func (ws *workersState) settle(fromTUN bool) {
+	if fromTUN && ws.onSettledPacket != nil {
+		ws.onSettledPacket()
+	}
+}
+
+// capture passes an IP packet to the capture sink, if any.
+func (ws *workersState) capture(direction model.Direction, packet []byte) {
+	if ws.captureSink != nil {
+		ws.captureSink(direction, packet)
+	}
+}
+
+// dropLogInterval is the minimum interval between two logs about dropped packets.
+var dropLogInterval = 5 * time.Second
+
+// dropBusy accounts for an outgoing packet dropped because the muxer is busy. Since this
+// happens for every packet under sustained backpressure, we rate limit the logs; use
+// [Service.DroppedPackets] to know how many packets we dropped.
+func (ws *workersState) dropBusy() {
+	if ok, suppressed := ws.dropLogThrottle.allow(); ok {
+		ws.logger.Warnf("%s: dropping outgoing packet: %s (suppressed %d similar warnings)",
+			serviceName, ErrMuxerBusy.Error(), suppressed)
+	}
+	ws.onDroppedPacket(model.DirectionOutgoing, ErrMuxerBusy)
+}
+
+// decryptLogInterval is the minimum interval between two logs about decryption failures.
+var decryptLogInterval = 5 * time.Second
+
+// logReadError logs the error reading an incoming data packet. Since anyone on the path can
+// send us packets we cannot decrypt, we rate limit these logs, which are at debug level;
+// use [Service.DecryptFailures] to know how many packets we could not decrypt.
+func (ws *workersState) logReadError(workerName string, err error) {
+	if !errors.Is(err, ErrCannotDecrypt) {
+		ws.logger.Warnf("%s: error reading packet: %v", workerName, err)
+		return
+	}
+	if ok, suppressed := ws.decryptLogThrottle.allow(); ok {
+		ws.logger.Debugf("%s: error decrypting: %v (suppressed %d similar errors)", workerName, err, suppressed)
+	}
+}
+
+// moveUpWorker moves packets up the stack. Once the first key is ready, it also shuts down
+// the workers if we do not receive any packet within the ping-restart interval.
+func (ws *workersState) moveUpWorker(firstKeyReady <-chan any) {
 	workerName := fmt.Sprintf("%s: moveUpWorker", serviceName)
 
 	defer func() {
@@ -141,25 +416,49 @@ func (ws *workersState) moveUpWorker() {
 	}()
 	ws.logger.Debugf("%s: started", workerName)
 
+	var pingRestartTimer *keepaliveTimer
+	defer func() {
+		pingRestartTimer.Stop()
+	}()
+
 	for {
 		select {
 		// TODO: opportunistically try to kill lame duck
 
+		case <-firstKeyReady:
+			// from now on, the remote should be sending us packets or pings
+			_, pingRestart := keepaliveIntervals(ws.dataChannel.options, ws.sessionManager.TunnelInfo())
+			pingRestartTimer = newKeepaliveTimer(pingRestart)
+			firstKeyReady = nil
+
+		case <-pingRestartTimer.C():
+			ws.logger.Warnf("%s: ping-restart timeout, shutting down", workerName)
+			return
+
 		case pkt := <-ws.muxerToData:
+			pingRestartTimer.Reset()
+
 			// TODO(ainghazal): factor out as handler function
 			decrypted, err := ws.dataChannel.readPacket(pkt)
 			if err != nil {
-				ws.logger.Warnf("error decrypting: %v", err)
+				ws.logReadError(workerName, err)
+				ws.onReadFailure(err)
+				continue
+			}
+			if bytes.Equal(decrypted, model.PingPayload()) {
+				// a keepalive ping, which we do not deliver to the TUN
+				ws.onPing()
 				continue
 			}
 
-			if len(decrypted) == 16 {
-				// TODO: should reply to this keepalive ping
-				// "2a 18 7b f3 64 1e b4 cb  07 ed 2d 0a 98 1f c7 48"
-				fmt.Println(hex.Dump(decrypted))
+			if model.IsOCCPayload(decrypted) {
+				// an OCC message (e.g., exit-notify), which we do not deliver to the TUN
+				ws.logger.Debugf("%s: received OCC message: %x", workerName, decrypted)
 				continue
 			}
 
+			ws.capture(model.DirectionIncoming, decrypted)
+
 			// POSSIBLY BLOCK writing up towards TUN
 			ws.dataToTUN <- decrypted
 		case <-ws.workersManager.ShouldShutdown():
@@ -183,10 +482,8 @@ func (ws *workersState) keyWorker(firstKeyReady chan<- any) {
 	for {
 		select {
 		case key := <-ws.keyReady:
-			// TODO(ainghazal): thread safety here - need to lock.
-			// When we actually get to key rotation, we need to add locks.
-			// Use RW lock, reader locks.
-
+			// note: setupKeys swaps the keys under the data channel lock, so that
+			// the other workers never see a half-installed key.
 			err := ws.dataChannel.setupKeys(key)
 			if err != nil {
 				ws.logger.Warnf("error on key derivation: %v", err)
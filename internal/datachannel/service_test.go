@@ -1,7 +1,14 @@
 package datachannel
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/ooni/minivpn/internal/model"
@@ -36,3 +43,490 @@ func TestService_StartWorkers(t *testing.T) {
 	workers.StartShutdown()
 	workers.WaitWorkersShutdown()
 }
+
+func TestService_DroppedPackets(t *testing.T) {
+	// the muxer does not read, so the channel toward it is always full
+	dataToMuxer := make(chan *model.Packet)
+	keyReady := make(chan *session.DataChannelKey)
+	muxerToData := make(chan *model.Packet, 100)
+	dropped := make(chan error, 100)
+
+	s := &Service{
+		MuxerToData:          muxerToData,
+		DataOrControlToMuxer: &dataToMuxer,
+		TUNToData:            make(chan []byte, 100),
+		DataToTUN:            make(chan []byte, 100),
+		KeyReady:             keyReady,
+		OnDroppedPacket: func(direction model.Direction, err error) {
+			if direction != model.DirectionOutgoing {
+				err = fmt.Errorf("unexpected direction: %v", direction)
+			}
+			dropped <- err
+		},
+	}
+	workers := workers.NewManager(log.Log)
+	session := makeTestingSession()
+
+	opts := makeTestingOptions(t, "AES-128-GCM", "sha512")
+	cfg := config.NewConfig(config.WithOpenVPNOptions(opts), config.WithWritePolicy(config.WritePolicyDrop, 0))
+	s.StartWorkers(cfg, workers, session)
+
+	keyReady <- makeTestingDataChannelKey()
+	<-session.Ready
+
+	// these packets cannot be decrypted, which is not a drop
+	muxerToData <- &model.Packet{Opcode: model.P_DATA_V1, Payload: []byte("aaa")}
+	muxerToData <- &model.Packet{Opcode: model.P_DATA_V1, Payload: []byte("bbb")}
+
+	// these packets find the muxer busy, so we drop them
+	s.TUNToData <- []byte("aaa")
+	s.TUNToData <- []byte("bbb")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-dropped:
+			if !errors.Is(err, ErrMuxerBusy) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the callback to fire")
+		}
+	}
+	if count := s.DroppedPackets(); count != 2 {
+		t.Errorf("DroppedPackets() = %d, want 2", count)
+	}
+
+	workers.StartShutdown()
+	workers.WaitWorkersShutdown()
+}
+
+func TestService_WritePolicy(t *testing.T) {
+	// startWithSlowMuxer starts the workers with a muxer that does not read, and writes
+	// two packets to the data channel. It returns the muxer channel and the service.
+	startWithSlowMuxer := func(t *testing.T, option config.Option) (chan *model.Packet, *Service) {
+		dataToMuxer := make(chan *model.Packet)
+		keyReady := make(chan *session.DataChannelKey)
+		s := &Service{
+			MuxerToData:          make(chan *model.Packet, 100),
+			DataOrControlToMuxer: &dataToMuxer,
+			TUNToData:            make(chan []byte, 100),
+			DataToTUN:            make(chan []byte, 100),
+			KeyReady:             keyReady,
+		}
+		workers := workers.NewManager(log.Log)
+		t.Cleanup(func() {
+			workers.StartShutdown()
+			workers.WaitWorkersShutdown()
+		})
+		session := makeTestingSession()
+
+		opts := makeTestingOptions(t, "AES-128-GCM", "sha512")
+		s.StartWorkers(config.NewConfig(config.WithOpenVPNOptions(opts), option), workers, session)
+		keyReady <- makeTestingDataChannelKey()
+		<-session.Ready
+
+		s.TUNToData <- []byte("aaa")
+		s.TUNToData <- []byte("bbb")
+		return dataToMuxer, s
+	}
+
+	t.Run("the block policy applies backpressure rather than dropping", func(t *testing.T) {
+		dataToMuxer, s := startWithSlowMuxer(t, config.WithWritePolicy(config.WritePolicyBlock, 0))
+		time.Sleep(100 * time.Millisecond)
+		if count := s.DroppedPackets(); count != 0 {
+			t.Fatalf("DroppedPackets() = %d, want 0", count)
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case <-dataToMuxer:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the blocked packets to be delivered")
+			}
+		}
+	})
+
+	t.Run("the block policy drops after the timeout", func(t *testing.T) {
+		_, s := startWithSlowMuxer(t, config.WithWritePolicy(config.WritePolicyBlock, 10*time.Millisecond))
+		deadline := time.Now().Add(5 * time.Second)
+		for s.DroppedPackets() != 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if count := s.DroppedPackets(); count != 2 {
+			t.Fatalf("DroppedPackets() = %d, want 2", count)
+		}
+	})
+
+	t.Run("the drop policy drops right away", func(t *testing.T) {
+		_, s := startWithSlowMuxer(t, config.WithWritePolicy(config.WritePolicyDrop, time.Hour))
+		deadline := time.Now().Add(5 * time.Second)
+		for s.DroppedPackets() != 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if count := s.DroppedPackets(); count != 2 {
+			t.Fatalf("DroppedPackets() = %d, want 2", count)
+		}
+	})
+}
+
+func TestNewService(t *testing.T) {
+	// burst tries to enqueue packets without blocking, and returns how many
+	// packets we could not enqueue because the buffer was full.
+	burst := func(ch chan []byte, count int) int {
+		overflow := 0
+		for i := 0; i < count; i++ {
+			select {
+			case ch <- []byte("deadbeef"):
+			default:
+				overflow++
+			}
+		}
+		return overflow
+	}
+
+	const burstSize = 32
+
+	t.Run("a small buffer overflows with a burst", func(t *testing.T) {
+		s := NewService(4)
+		if overflow := burst(s.TUNToData, burstSize); overflow != burstSize-4 {
+			t.Errorf("expected %d packets to overflow, got %d", burstSize-4, overflow)
+		}
+	})
+
+	t.Run("a larger buffer absorbs the same burst", func(t *testing.T) {
+		s := NewService(64)
+		if overflow := burst(s.TUNToData, burstSize); overflow != 0 {
+			t.Errorf("expected no overflow, got %d", overflow)
+		}
+		if cap(s.MuxerToData) != 64 || cap(s.DataToTUN) != 64 {
+			t.Error("expected all the data channels to be sized")
+		}
+		if cap(s.KeyReady) != 1 {
+			t.Error("expected KeyReady to hold one key")
+		}
+	})
+}
+
+func TestService_HealthCheck(t *testing.T) {
+	// start starts the workers with a key-method 1 key, and returns the muxer channels, the
+	// service, and the data channel of the remote, which uses the same keys the other way.
+	start := func(t *testing.T) (chan *model.Packet, chan *model.Packet, *Service, *DataChannel) {
+		local, remote := &session.KeyMaterial{}, &session.KeyMaterial{}
+		copy(local.Cipher[:], bytes.Repeat([]byte{0x01}, 64))
+		copy(local.HMAC[:], bytes.Repeat([]byte{0x02}, 64))
+		copy(remote.Cipher[:], bytes.Repeat([]byte{0x03}, 64))
+		copy(remote.HMAC[:], bytes.Repeat([]byte{0x04}, 64))
+		clientKey := &session.DataChannelKey{}
+		clientKey.AddLocalKey(&session.KeySource{Method1: local})
+		clientKey.AddRemoteKey(&session.KeySource{Method1: remote})
+		serverKey := &session.DataChannelKey{}
+		serverKey.AddLocalKey(&session.KeySource{Method1: remote})
+		serverKey.AddRemoteKey(&session.KeySource{Method1: local})
+
+		// we use CBC, whose read path strips the padding our write path adds
+		opts := makeTestingOptions(t, "AES-128-CBC", "sha512")
+		peer, err := NewDataChannelFromOptions(log.Log, opts, makeTestingSession())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.setupKeys(serverKey); err != nil {
+			t.Fatal(err)
+		}
+
+		dataToMuxer := make(chan *model.Packet, 100)
+		muxerToData := make(chan *model.Packet, 100)
+		keyReady := make(chan *session.DataChannelKey)
+		s := &Service{
+			MuxerToData:          muxerToData,
+			DataOrControlToMuxer: &dataToMuxer,
+			TUNToData:            make(chan []byte, 100),
+			DataToTUN:            make(chan []byte, 100),
+			KeyReady:             keyReady,
+		}
+		workers := workers.NewManager(log.Log)
+		t.Cleanup(func() {
+			workers.StartShutdown()
+			workers.WaitWorkersShutdown()
+		})
+		sessionManager := makeTestingSession()
+		s.StartWorkers(config.NewConfig(config.WithOpenVPNOptions(opts)), workers, sessionManager)
+		keyReady <- clientKey
+		<-sessionManager.Ready
+		return dataToMuxer, muxerToData, s, peer
+	}
+
+	// wire serializes and parses the packet, like the muxers on the two sides do.
+	wire := func(packet *model.Packet) (*model.Packet, error) {
+		raw, err := packet.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return model.ParsePacket(raw)
+	}
+
+	// answer makes the remote read our ping, and send the given payload back.
+	answer := func(t *testing.T, dataToMuxer, muxerToData chan *model.Packet, peer *DataChannel, payload []byte) {
+		ping, err := wire(<-dataToMuxer)
+		if err != nil {
+			t.Errorf("wire() error = %v", err)
+			return
+		}
+		received, err := peer.readPacket(ping)
+		if err != nil {
+			t.Errorf("readPacket() error = %v", err)
+			return
+		}
+		if !bytes.Equal(received, model.PingPayload()) {
+			t.Errorf("the remote received %x, want a ping", received)
+			return
+		}
+		packet, err := peer.writePacket(payload)
+		if err != nil {
+			t.Errorf("writePacket() error = %v", err)
+			return
+		}
+		if packet, err = wire(packet); err != nil {
+			t.Errorf("wire() error = %v", err)
+			return
+		}
+		muxerToData <- packet
+	}
+
+	t.Run("we send a ping and succeed when the remote pings us", func(t *testing.T) {
+		dataToMuxer, muxerToData, s, peer := start(t)
+		go answer(t, dataToMuxer, muxerToData, peer, model.PingPayload())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := s.HealthCheck(ctx); err != nil {
+			t.Fatalf("HealthCheck() error = %v", err)
+		}
+	})
+
+	t.Run("other data packets do not complete the check", func(t *testing.T) {
+		dataToMuxer, muxerToData, s, peer := start(t)
+		go answer(t, dataToMuxer, muxerToData, peer, []byte("not a ping"))
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if _, err := s.HealthCheck(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("HealthCheck() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("we fail when the remote does not answer", func(t *testing.T) {
+		dataToMuxer, _, s, _ := start(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := s.HealthCheck(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("HealthCheck() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+		select {
+		case packet := <-dataToMuxer:
+			if packet.Opcode != model.P_DATA_V2 && packet.Opcode != model.P_DATA_V1 {
+				t.Errorf("expected a data packet, got %v", packet.Opcode)
+			}
+		default:
+			t.Error("expected to send a ping")
+		}
+		s.probesMu.Lock()
+		defer s.probesMu.Unlock()
+		if len(s.probes) != 0 {
+			t.Errorf("expected no pending probes, got %d", len(s.probes))
+		}
+	})
+}
+
+func TestService_CaptureSink(t *testing.T) {
+	dataToMuxer := make(chan *model.Packet, 100)
+	keyReady := make(chan *session.DataChannelKey)
+	s := &Service{
+		MuxerToData:          make(chan *model.Packet, 100),
+		DataOrControlToMuxer: &dataToMuxer,
+		TUNToData:            make(chan []byte, 100),
+		DataToTUN:            make(chan []byte, 100),
+		KeyReady:             keyReady,
+	}
+	captured := make(chan []byte, 100)
+	sink := func(direction model.Direction, packet []byte) {
+		if direction == model.DirectionOutgoing {
+			captured <- packet
+		}
+	}
+	workers := workers.NewManager(log.Log)
+	session := makeTestingSession()
+
+	opts := makeTestingOptions(t, "AES-128-GCM", "sha512")
+	s.StartWorkers(config.NewConfig(config.WithOpenVPNOptions(opts), config.WithCaptureSink(sink)), workers, session)
+	keyReady <- makeTestingDataChannelKey()
+	<-session.Ready
+
+	s.TUNToData <- []byte("aaa")
+	select {
+	case packet := <-captured:
+		if string(packet) != "aaa" {
+			t.Errorf("captured %q, want %q", packet, "aaa")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the sink to capture the packet")
+	}
+
+	workers.StartShutdown()
+	workers.WaitWorkersShutdown()
+}
+
+func TestService_SettledPackets(t *testing.T) {
+	dataToMuxer := make(chan *model.Packet, 100)
+	keyReady := make(chan *session.DataChannelKey)
+	s := &Service{
+		MuxerToData:          make(chan *model.Packet, 100),
+		DataOrControlToMuxer: &dataToMuxer,
+		TUNToData:            make(chan []byte, 100),
+		DataToTUN:            make(chan []byte, 100),
+		KeyReady:             keyReady,
+	}
+	workers := workers.NewManager(log.Log)
+	defer func() {
+		workers.StartShutdown()
+		workers.WaitWorkersShutdown()
+	}()
+	session := makeTestingSession()
+
+	opts := makeTestingOptions(t, "AES-128-GCM", "sha512")
+	s.StartWorkers(config.NewConfig(config.WithOpenVPNOptions(opts)), workers, session)
+	keyReady <- makeTestingDataChannelKey()
+	<-session.Ready
+
+	s.TUNToData <- []byte("aaa")
+	s.TUNToData <- []byte("bbb")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.SettledPackets() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := s.SettledPackets(); count != 2 {
+		t.Fatalf("SettledPackets() = %d, want 2", count)
+	}
+	if len(dataToMuxer) != 2 {
+		t.Errorf("the muxer got %d packets, want 2", len(dataToMuxer))
+	}
+}
+
+// decryptLogCounter counts the debug messages about decryption errors, and it is
+// safe to use from many goroutines.
+type decryptLogCounter struct {
+	model.TestLogger
+	mu    sync.Mutex
+	count int
+}
+
+// Debugf implements model.Logger
+func (dc *decryptLogCounter) Debugf(format string, v ...any) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if strings.Contains(fmt.Sprintf(format, v...), "error decrypting") {
+		dc.count++
+	}
+}
+
+func (dc *decryptLogCounter) logged() int {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.count
+}
+
+func TestService_DecryptFailures(t *testing.T) {
+	dataToMuxer := make(chan *model.Packet, 100)
+	keyReady := make(chan *session.DataChannelKey)
+	muxerToData := make(chan *model.Packet, 100)
+
+	s := &Service{
+		MuxerToData:          muxerToData,
+		DataOrControlToMuxer: &dataToMuxer,
+		TUNToData:            make(chan []byte, 100),
+		DataToTUN:            make(chan []byte, 100),
+		KeyReady:             keyReady,
+		OnDroppedPacket: func(direction model.Direction, err error) {
+			t.Error("decryption failures should not be reported as drops")
+		},
+	}
+	workers := workers.NewManager(log.Log)
+	session := makeTestingSession()
+
+	logger := &decryptLogCounter{}
+	opts := makeTestingOptions(t, "AES-128-GCM", "sha512")
+	s.StartWorkers(config.NewConfig(config.WithLogger(logger), config.WithOpenVPNOptions(opts)), workers, session)
+	defer func() {
+		workers.StartShutdown()
+		workers.WaitWorkersShutdown()
+	}()
+
+	keyReady <- makeTestingDataChannelKey()
+	<-session.Ready
+
+	// none of these packets can be decrypted
+	const count = 50
+	for i := 0; i < count; i++ {
+		muxerToData <- &model.Packet{Opcode: model.P_DATA_V2, Payload: bytes.Repeat([]byte{byte(i)}, 64)}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.DecryptFailures() != count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := s.DecryptFailures(); got != count {
+		t.Errorf("DecryptFailures() = %d, want %d", got, count)
+	}
+	if stats := s.Stats(); stats.DecryptFailures != count || stats.DroppedPackets != 0 {
+		t.Errorf("Stats() = %+v, want %d decrypt failures and no dropped packets", stats, count)
+	}
+	if logged := logger.logged(); logged != 1 {
+		t.Errorf("expected a single log about decryption failures, got %d", logged)
+	}
+}
+
+func Test_workersState_dropBusy(t *testing.T) {
+	now := time.Now()
+	throttle := newLogThrottle(time.Second)
+	throttle.timeNow = func() time.Time { return now }
+	logger := model.NewTestLogger()
+	var dropped int
+	ws := &workersState{
+		dropLogThrottle: throttle,
+		logger:          logger,
+		onDroppedPacket: func(model.Direction, error) { dropped++ },
+	}
+
+	// test that we report every drop but only log once per interval
+	for i := 0; i < 100; i++ {
+		ws.dropBusy()
+	}
+	if dropped != 100 {
+		t.Errorf("expected 100 drops to be reported, got %d", dropped)
+	}
+	if len(logger.Lines) != 1 {
+		t.Fatalf("expected a single log, got %d", len(logger.Lines))
+	}
+
+	now = now.Add(time.Second)
+	ws.dropBusy()
+	if len(logger.Lines) != 2 || !strings.Contains(logger.Lines[1], "suppressed 99 similar warnings") {
+		t.Errorf("expected a summary of the suppressed logs, got %v", logger.Lines)
+	}
+}
+
+func Test_logThrottle(t *testing.T) {
+	now := time.Now()
+	lt := newLogThrottle(time.Second)
+	lt.timeNow = func() time.Time { return now }
+
+	if ok, suppressed := lt.allow(); !ok || suppressed != 0 {
+		t.Fatalf("allow() = %v, %d, want true, 0", ok, suppressed)
+	}
+	for i := 0; i < 3; i++ {
+		now = now.Add(100 * time.Millisecond)
+		if ok, _ := lt.allow(); ok {
+			t.Fatal("expected allow() to throttle")
+		}
+	}
+	now = now.Add(time.Second)
+	if ok, suppressed := lt.allow(); !ok || suppressed != 3 {
+		t.Fatalf("allow() = %v, %d, want true, 3", ok, suppressed)
+	}
+}
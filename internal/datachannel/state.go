@@ -1,6 +1,7 @@
 package datachannel
 
 import (
+	"fmt"
 	"hash"
 	"math"
 	"sync"
@@ -23,15 +24,15 @@ type dataChannelState struct {
 	hmacKeyLocal    keySlot
 	hmacKeyRemote   keySlot
 
-	// TODO(ainghazal): we need to keep a local packetID too. It should be separated from the control channel.
 	// TODO: move this to sessionManager perhaps?
 	remotePacketID model.PacketID
 
+	// localPacketID is the last packet ID we used for encrypting. In GCM mode, the
+	// nonce is derived from it, so we must never use the same packet ID twice.
+	localPacketID model.PacketID
+
 	hash func() hash.Hash
 	mu   sync.Mutex
-
-	// not used at the moment, paving the way for key rotation.
-	// keyID           int
 }
 
 // SetRemotePacketID stores the passed packetID internally.
@@ -41,6 +42,28 @@ func (dcs *dataChannelState) SetRemotePacketID(id model.PacketID) {
 	dcs.remotePacketID = model.PacketID(id)
 }
 
+// UseLocalPacketID records that we are about to encrypt using the given packetID. It returns
+// [ErrExpiredKey] if the packetID is not greater than the last one we used, since encrypting
+// would then reuse a nonce; the caller should renegotiate the key instead.
+func (dcs *dataChannelState) UseLocalPacketID(id model.PacketID) error {
+	dcs.mu.Lock()
+	defer dcs.mu.Unlock()
+	if id <= dcs.localPacketID {
+		return fmt.Errorf("%w: refusing to reuse packet ID %d", ErrExpiredKey, id)
+	}
+	dcs.localPacketID = id
+	return nil
+}
+
+// resetPacketIDs forgets the packet IDs we have used and seen, which we do when we
+// start using a new key, since the packet IDs are scoped to the key.
+func (dcs *dataChannelState) resetPacketIDs() {
+	dcs.mu.Lock()
+	defer dcs.mu.Unlock()
+	dcs.localPacketID = 0
+	dcs.remotePacketID = 0
+}
+
 // RemotePacketID returns the last known remote packetID. It returns an error
 // if the stored packet id has reached the maximum capacity of the packetID
 // type.
@@ -0,0 +1,40 @@
+package datachannel
+
+import "time"
+
+// logThrottle rate limits a recurring log message, so that whoever can send us packets
+// cannot flood our logs. It is not safe for concurrent use: each worker owns its own.
+type logThrottle struct {
+	// interval is the minimum interval between two messages.
+	interval time.Duration
+
+	// last is when we last allowed a message.
+	last time.Time
+
+	// suppressed counts the messages we suppressed since the last one we allowed.
+	suppressed int64
+
+	// timeNow allows to mock time.Now in tests.
+	timeNow func() time.Time
+}
+
+// newLogThrottle returns a [*logThrottle] allowing one message per interval.
+func newLogThrottle(interval time.Duration) *logThrottle {
+	return &logThrottle{
+		interval: interval,
+		timeNow:  time.Now,
+	}
+}
+
+// allow returns whether we should emit the message now and, if so, how many messages
+// we have suppressed since the last one we emitted.
+func (lt *logThrottle) allow() (bool, int64) {
+	now := lt.timeNow()
+	if !lt.last.IsZero() && now.Sub(lt.last) < lt.interval {
+		lt.suppressed++
+		return false, 0
+	}
+	suppressed := lt.suppressed
+	lt.last, lt.suppressed = now, 0
+	return true, suppressed
+}
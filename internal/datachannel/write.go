@@ -21,17 +21,16 @@ import (
 func encryptAndEncodePayloadAEAD(log model.Logger, padded []byte, session *session.Manager, state *dataChannelState) ([]byte, error) {
 	nextPacketID, err := session.LocalDataPacketID()
 	if err != nil {
-		return []byte{}, fmt.Errorf("bad packet id")
+		return []byte{}, fmt.Errorf("%w: %s", ErrExpiredKey, err)
+	}
+	if err := state.UseLocalPacketID(nextPacketID); err != nil {
+		return []byte{}, err
 	}
 
-	// in AEAD mode, we authenticate:
-	// - 1 byte: opcode/key
-	// - 3 bytes: peer-id (we're using P_DATA_V2)
-	// - 4 bytes: packet-id
-	aead := &bytes.Buffer{}
-	aead.WriteByte(opcodeAndKeyHeader(session))
-	bytesx.WriteUint24(aead, uint32(session.TunnelInfo().PeerID))
-	bytesx.WriteUint32(aead, uint32(nextPacketID))
+	// in AEAD mode, we authenticate the P_DATA_V2 header and the packet-id
+	id := session.TunnelInfo().PeerID
+	peerID := model.PeerID{byte(id >> 16), byte(id >> 8), byte(id)}
+	aead := aeadAdditionalData(model.P_DATA_V2, byte(session.CurrentKeyID()), peerID, nextPacketID)
 
 	// the iv is the packetID (again) concatenated with the 8 bytes of the
 	// key derived for local hmac (which we do not use for anything else in AEAD mode).
@@ -42,7 +41,7 @@ func encryptAndEncodePayloadAEAD(log model.Logger, padded []byte, session *sessi
 	data := &plaintextData{
 		iv:        iv.Bytes(),
 		plaintext: padded,
-		aead:      aead.Bytes(),
+		aead:      aead,
 	}
 
 	encryptFn := state.dataCipher.encrypt
@@ -120,6 +119,8 @@ func doCompress(b []byte, compress config.Compression) ([]byte, error) {
 	case "lzo-no":
 		// old "comp-lzo no" option
 		b = append([]byte{0xfa}, b...)
+	case config.CompressionLZOAdaptive:
+		b = compressAdaptive(b, lzoCompress)
 	}
 	return b, nil
 }
@@ -164,6 +165,23 @@ func prependPacketID(p model.PacketID, buf []byte) []byte {
 	return newbuf.Bytes()
 }
 
+// aeadAdditionalData returns the additional data that the AEAD modes authenticate without
+// encrypting it, which, like in the reference implementation, is:
+//
+//	P_DATA_V2: [ opcode/key-id (1) ] [ peer-id (3) ] [ packet-id (4) ]
+//	P_DATA_V1: [ packet-id (4) ]
+//
+// since the P_DATA_V1 header has no peer-id, and OpenVPN does not authenticate its opcode.
+func aeadAdditionalData(opcode model.Opcode, keyID byte, peerID model.PeerID, packetID model.PacketID) []byte {
+	aead := &bytes.Buffer{}
+	if opcode == model.P_DATA_V2 {
+		aead.WriteByte((byte(opcode) << 3) | (keyID & 0x07))
+		aead.Write(peerID[:])
+	}
+	bytesx.WriteUint32(aead, uint32(packetID))
+	return aead.Bytes()
+}
+
 // opcodeAndKeyHeader returns the header byte encoding the opcode and keyID (3 upper
 // and 5 lower bits, respectively)
 func opcodeAndKeyHeader(session *session.Manager) byte {
@@ -273,6 +273,15 @@ func Test_doCompress(t *testing.T) {
 			want:    []byte{0xfb, 0xad, 0xbe, 0xef, 0xde},
 			wantErr: nil,
 		},
+		{
+			name: "lzo-adaptive adds 0xfa preamble to small payloads",
+			args: args{
+				b:   []byte{0xde, 0xad, 0xbe, 0xef},
+				opt: config.CompressionLZOAdaptive,
+			},
+			want:    []byte{0xfa, 0xde, 0xad, 0xbe, 0xef},
+			wantErr: nil,
+		},
 		{
 			name: "lzo-no adds 0xfa preamble",
 			args: args{
@@ -309,6 +318,16 @@ func Test_doPadding(t *testing.T) {
 		want    []byte
 		wantErr error
 	}{
+		{
+			name: "empty payload fails with errPadding",
+			args: args{
+				b:         []byte{},
+				compress:  config.Compression(""),
+				blockSize: 4,
+			},
+			want:    nil,
+			wantErr: errPadding,
+		},
 		{
 			name: "add a whole padding block if len equal to block size, no padding stub",
 			args: args{
@@ -529,6 +548,36 @@ func Test_maybeDecompress(t *testing.T) {
 			want:    []byte{0x00, 0xbb, 0xcc},
 			wantErr: nil,
 		},
+		{
+			name: "aead cipher, an lz4 packet is rejected without allow-compression",
+			args: args{
+				b:   []byte{lz4CompressByte, 0xbb, 0xcc},
+				st:  makeTestingStateAEAD(),
+				opt: &config.OpenVPNOptions{Compress: "stub"},
+			},
+			want:    []byte{},
+			wantErr: errCompressionNotAllowed,
+		},
+		{
+			name: "aead cipher, an lzo packet is rejected with allow-compression no",
+			args: args{
+				b:   []byte{lzoCompressByte, 0xbb, 0xcc},
+				st:  makeTestingStateAEAD(),
+				opt: &config.OpenVPNOptions{Compress: "lzo-no", AllowCompression: config.AllowCompressionNo},
+			},
+			want:    []byte{},
+			wantErr: errCompressionNotAllowed,
+		},
+		{
+			name: "aead cipher, an lz4 packet cannot be decompressed with allow-compression asym",
+			args: args{
+				b:   []byte{lz4CompressByte, 0xbb, 0xcc},
+				st:  makeTestingStateAEAD(),
+				opt: &config.OpenVPNOptions{Compress: "stub", AllowCompression: config.AllowCompressionAsym},
+			},
+			want:    []byte{},
+			wantErr: errBadCompression,
+		},
 		{
 			name: "non-aead cipher, replay detected (equal remote packetID)",
 			args: args{
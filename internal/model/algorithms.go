@@ -0,0 +1,152 @@
+package model
+
+import (
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+// DataCipher describes a data channel cipher we support.
+type DataCipher struct {
+	// Name is the name used by the cipher option (e.g., AES-256-GCM).
+	Name string
+
+	// KeyBits is the size of the key in bits.
+	KeyBits int
+
+	// Mode is the block cipher mode, either "cbc" or "gcm".
+	Mode string
+
+	// NewBlock creates the block cipher from a key of KeyBits bits. It is nil
+	// for the built-in ciphers, which use AES.
+	NewBlock func(key []byte) (cipher.Block, error)
+}
+
+var (
+	// dataCiphersMu protects dataCiphers.
+	dataCiphersMu sync.Mutex
+
+	// dataCiphers is the registry of the data channel ciphers we support, in registration
+	// order. This is the source of truth both for validating the config and for constructing
+	// the data channel ciphers. The built-in ciphers are registered by default.
+	dataCiphers = []DataCipher{
+		{Name: "AES-128-CBC", KeyBits: 128, Mode: "cbc"},
+		{Name: "AES-192-CBC", KeyBits: 192, Mode: "cbc"},
+		{Name: "AES-256-CBC", KeyBits: 256, Mode: "cbc"},
+		{Name: "AES-128-GCM", KeyBits: 128, Mode: "gcm"},
+		{Name: "AES-192-GCM", KeyBits: 192, Mode: "gcm"},
+		{Name: "AES-256-GCM", KeyBits: 256, Mode: "gcm"},
+	}
+)
+
+// ErrDataCipherAlreadyRegistered indicates that a data channel cipher with the same
+// name is already registered.
+var ErrDataCipherAlreadyRegistered = errors.New("data cipher already registered")
+
+// ErrBadDataCipher indicates that we cannot register a data channel cipher.
+var ErrBadDataCipher = errors.New("bad data cipher")
+
+// dataCipherBlockSize is the block size that the data channel ciphers must have. Like
+// the AES ciphers, they must work with GCM, which requires 16-byte blocks.
+const dataCipherBlockSize = 16
+
+// RegisterDataCipher adds the given cipher to the registry of the data channel ciphers, so
+// that the config accepts its name and the data channel can construct it. It fails with
+// [ErrDataCipherAlreadyRegistered] if the name (compared case-insensitively) is taken, and
+// with [ErrBadDataCipher] if the cipher is not valid.
+func RegisterDataCipher(dc DataCipher) error {
+	if err := checkDataCipher(dc); err != nil {
+		return err
+	}
+	dataCiphersMu.Lock()
+	defer dataCiphersMu.Unlock()
+	for _, registered := range dataCiphers {
+		if strings.EqualFold(registered.Name, dc.Name) {
+			return fmt.Errorf("%w: %s", ErrDataCipherAlreadyRegistered, dc.Name)
+		}
+	}
+	dataCiphers = append(dataCiphers, dc)
+	return nil
+}
+
+// checkDataCipher returns an error if we cannot register the given cipher.
+func checkDataCipher(dc DataCipher) error {
+	// the name goes in the options string and in the colon-separated data-ciphers
+	if dc.Name == "" || strings.ContainsAny(dc.Name, ":, \t\r\n") {
+		return fmt.Errorf("%w: invalid name: %q", ErrBadDataCipher, dc.Name)
+	}
+	// the key material we derive for each direction is 64 bytes long
+	if dc.KeyBits%8 != 0 || dc.KeyBits < 128 || dc.KeyBits > 512 {
+		return fmt.Errorf("%w: %s: invalid key size: %d", ErrBadDataCipher, dc.Name, dc.KeyBits)
+	}
+	if dc.Mode != "cbc" && dc.Mode != "gcm" {
+		return fmt.Errorf("%w: %s: invalid mode: %q", ErrBadDataCipher, dc.Name, dc.Mode)
+	}
+	if dc.NewBlock == nil {
+		return fmt.Errorf("%w: %s: missing block cipher constructor", ErrBadDataCipher, dc.Name)
+	}
+	block, err := dc.NewBlock(make([]byte, dc.KeyBits/8))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrBadDataCipher, dc.Name, err)
+	}
+	if block.BlockSize() != dataCipherBlockSize {
+		return fmt.Errorf("%w: %s: invalid block size: %d", ErrBadDataCipher, dc.Name, block.BlockSize())
+	}
+	return nil
+}
+
+// UnregisterDataCipher removes the cipher with the given name, which we compare
+// case-insensitively, from the registry. We never remove the built-in ciphers.
+func UnregisterDataCipher(name string) {
+	dataCiphersMu.Lock()
+	defer dataCiphersMu.Unlock()
+	for idx, dc := range dataCiphers {
+		if strings.EqualFold(dc.Name, name) && dc.NewBlock != nil {
+			dataCiphers = append(dataCiphers[:idx:idx], dataCiphers[idx+1:]...)
+			return
+		}
+	}
+}
+
+// DataCiphers returns a copy of the registry of the data channel ciphers.
+func DataCiphers() []DataCipher {
+	dataCiphersMu.Lock()
+	defer dataCiphersMu.Unlock()
+	return append([]DataCipher{}, dataCiphers...)
+}
+
+// LookupDataCipher returns the registered data channel cipher with the given name, which
+// we compare case-insensitively, and whether we found it.
+func LookupDataCipher(name string) (DataCipher, bool) {
+	dataCiphersMu.Lock()
+	defer dataCiphersMu.Unlock()
+	for _, dc := range dataCiphers {
+		if strings.EqualFold(dc.Name, name) {
+			return dc, true
+		}
+	}
+	return DataCipher{}, false
+}
+
+// DataAuth describes a data channel HMAC digest we support.
+type DataAuth struct {
+	// Name is the name used by the auth option (e.g., SHA512).
+	Name string
+
+	// New returns a new instance of the hash.
+	New func() hash.Hash
+}
+
+// DataAuths lists the data channel HMAC digests we support. This is the source of truth
+// both for validating the config and for constructing the data channel HMACs.
+var DataAuths = []DataAuth{
+	{Name: "SHA1", New: sha1.New},
+	{Name: "SHA256", New: sha256.New},
+	{Name: "SHA512", New: sha512.New},
+}
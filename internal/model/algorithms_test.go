@@ -0,0 +1,92 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"errors"
+	"testing"
+)
+
+func TestRegisterDataCipher(t *testing.T) {
+	t.Run("the built-in ciphers are registered by default", func(t *testing.T) {
+		for _, name := range []string{"AES-128-CBC", "AES-256-GCM"} {
+			if _, found := LookupDataCipher(name); !found {
+				t.Errorf("%s is not registered", name)
+			}
+		}
+	})
+
+	t.Run("a registered cipher can be looked up ignoring case", func(t *testing.T) {
+		t.Cleanup(func() { UnregisterDataCipher("TEST-CIPHER") })
+		want := DataCipher{Name: "TEST-CIPHER", KeyBits: 128, Mode: "cbc", NewBlock: aes.NewCipher}
+		if err := RegisterDataCipher(want); err != nil {
+			t.Fatalf("RegisterDataCipher() error = %v", err)
+		}
+		got, found := LookupDataCipher("test-cipher")
+		if !found || got.Name != want.Name || got.KeyBits != want.KeyBits || got.Mode != want.Mode || got.NewBlock == nil {
+			t.Errorf("LookupDataCipher() = %v, %v", got, found)
+		}
+		ciphers := DataCiphers()
+		if ciphers[len(ciphers)-1].Name != want.Name {
+			t.Errorf("DataCiphers() = %v", ciphers)
+		}
+	})
+
+	t.Run("we cannot register the same name twice", func(t *testing.T) {
+		err := RegisterDataCipher(DataCipher{Name: "aes-256-gcm", KeyBits: 128, Mode: "cbc", NewBlock: aes.NewCipher})
+		if !errors.Is(err, ErrDataCipherAlreadyRegistered) {
+			t.Errorf("RegisterDataCipher() error = %v, want %v", err, ErrDataCipherAlreadyRegistered)
+		}
+		if dc, _ := LookupDataCipher("AES-256-GCM"); dc.KeyBits != 256 || dc.Mode != "gcm" {
+			t.Errorf("the built-in cipher was replaced: %v", dc)
+		}
+	})
+
+	t.Run("we reject invalid ciphers", func(t *testing.T) {
+		failing := func([]byte) (cipher.Block, error) {
+			return nil, errors.New("mocked error")
+		}
+		tests := []struct {
+			name string
+			dc   DataCipher
+		}{
+			{"empty name", DataCipher{Name: "", KeyBits: 128, Mode: "cbc", NewBlock: aes.NewCipher}},
+			{"name with a colon", DataCipher{Name: "A:B", KeyBits: 128, Mode: "cbc", NewBlock: aes.NewCipher}},
+			{"name with a space", DataCipher{Name: "A B", KeyBits: 128, Mode: "cbc", NewBlock: aes.NewCipher}},
+			{"key too small", DataCipher{Name: "TEST-64", KeyBits: 64, Mode: "cbc", NewBlock: aes.NewCipher}},
+			{"key too large", DataCipher{Name: "TEST-1024", KeyBits: 1024, Mode: "cbc", NewBlock: aes.NewCipher}},
+			{"key not in bytes", DataCipher{Name: "TEST-129", KeyBits: 129, Mode: "cbc", NewBlock: aes.NewCipher}},
+			{"unknown mode", DataCipher{Name: "TEST-CTR", KeyBits: 128, Mode: "ctr", NewBlock: aes.NewCipher}},
+			{"missing constructor", DataCipher{Name: "TEST-NIL", KeyBits: 128, Mode: "cbc"}},
+			{"constructor rejecting the key", DataCipher{Name: "TEST-FAIL", KeyBits: 128, Mode: "cbc", NewBlock: failing}},
+			{"key size not accepted by the constructor", DataCipher{Name: "TEST-AES-384", KeyBits: 384, Mode: "gcm", NewBlock: aes.NewCipher}},
+			{"wrong block size", DataCipher{Name: "TEST-3DES", KeyBits: 192, Mode: "cbc", NewBlock: des.NewTripleDESCipher}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if err := RegisterDataCipher(tt.dc); !errors.Is(err, ErrBadDataCipher) {
+					t.Errorf("RegisterDataCipher() error = %v, want %v", err, ErrBadDataCipher)
+				}
+				if _, found := LookupDataCipher(tt.dc.Name); found {
+					t.Errorf("%q was registered", tt.dc.Name)
+				}
+			})
+		}
+	})
+
+	t.Run("unregister removes a registered cipher but not the built-in ones", func(t *testing.T) {
+		dc := DataCipher{Name: "TEST-REMOVED", KeyBits: 256, Mode: "gcm", NewBlock: aes.NewCipher}
+		if err := RegisterDataCipher(dc); err != nil {
+			t.Fatalf("RegisterDataCipher() error = %v", err)
+		}
+		UnregisterDataCipher("test-removed")
+		if _, found := LookupDataCipher(dc.Name); found {
+			t.Error("the cipher is still registered")
+		}
+		UnregisterDataCipher("AES-256-GCM")
+		if _, found := LookupDataCipher("AES-256-GCM"); !found {
+			t.Error("the built-in cipher was removed")
+		}
+	})
+}
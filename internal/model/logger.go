@@ -20,3 +20,67 @@ type Logger interface {
 	// Warnf formats and emits a warning message.
 	Warnf(format string, v ...any)
 }
+
+// LogLevel is the level of the least severe messages emitted by a [NewLevelLogger].
+type LogLevel int
+
+const (
+	// LogLevelWarn only emits the warnings.
+	LogLevelWarn = LogLevel(iota)
+
+	// LogLevelInfo emits the warnings and the informational messages.
+	LogLevelInfo
+
+	// LogLevelDebug emits all the messages.
+	LogLevelDebug
+)
+
+// NewLevelLogger returns a [Logger] forwarding to logger only the messages
+// that are at least as severe as the given level.
+func NewLevelLogger(logger Logger, level LogLevel) Logger {
+	return &levelLogger{logger: logger, level: level}
+}
+
+// levelLogger is the [Logger] returned by [NewLevelLogger].
+type levelLogger struct {
+	logger Logger
+	level  LogLevel
+}
+
+// Debug implements Logger
+func (l *levelLogger) Debug(msg string) {
+	if l.level >= LogLevelDebug {
+		l.logger.Debug(msg)
+	}
+}
+
+// Debugf implements Logger
+func (l *levelLogger) Debugf(format string, v ...any) {
+	if l.level >= LogLevelDebug {
+		l.logger.Debugf(format, v...)
+	}
+}
+
+// Info implements Logger
+func (l *levelLogger) Info(msg string) {
+	if l.level >= LogLevelInfo {
+		l.logger.Info(msg)
+	}
+}
+
+// Infof implements Logger
+func (l *levelLogger) Infof(format string, v ...any) {
+	if l.level >= LogLevelInfo {
+		l.logger.Infof(format, v...)
+	}
+}
+
+// Warn implements Logger
+func (l *levelLogger) Warn(msg string) {
+	l.logger.Warn(msg)
+}
+
+// Warnf implements Logger
+func (l *levelLogger) Warnf(format string, v ...any) {
+	l.logger.Warnf(format, v...)
+}
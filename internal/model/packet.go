@@ -30,6 +30,8 @@ const (
 	P_CONTROL_HARD_RESET_CLIENT_V2                    // 7
 	P_CONTROL_HARD_RESET_SERVER_V2                    // 8
 	P_DATA_V2                                         // 9
+	P_CONTROL_HARD_RESET_CLIENT_V3                    // 10
+	P_CONTROL_WKC_V1                                  // 11
 )
 
 // NewOpcodeFromString returns an opcode from a string representation, and an error if it cannot parse the opcode
@@ -54,6 +56,10 @@ func NewOpcodeFromString(s string) (Opcode, error) {
 		return P_CONTROL_HARD_RESET_SERVER_V2, nil
 	case "DATA_V2":
 		return P_DATA_V2, nil
+	case "CONTROL_HARD_RESET_CLIENT_V3":
+		return P_CONTROL_HARD_RESET_CLIENT_V3, nil
+	case "CONTROL_WKC_V1":
+		return P_CONTROL_WKC_V1, nil
 	default:
 		return 0, errors.New("unknown opcode")
 	}
@@ -89,6 +95,12 @@ func (op Opcode) String() string {
 	case P_DATA_V2:
 		return "P_DATA_V2"
 
+	case P_CONTROL_HARD_RESET_CLIENT_V3:
+		return "P_CONTROL_HARD_RESET_CLIENT_V3"
+
+	case P_CONTROL_WKC_V1:
+		return "P_CONTROL_WKC_V1"
+
 	default:
 		return "P_UNKNOWN"
 	}
@@ -102,7 +114,9 @@ func (op Opcode) IsControl() bool {
 		P_CONTROL_SOFT_RESET_V1,
 		P_CONTROL_V1,
 		P_CONTROL_HARD_RESET_CLIENT_V2,
-		P_CONTROL_HARD_RESET_SERVER_V2:
+		P_CONTROL_HARD_RESET_SERVER_V2,
+		P_CONTROL_HARD_RESET_CLIENT_V3,
+		P_CONTROL_WKC_V1:
 		return true
 	default:
 		return false
@@ -339,6 +353,28 @@ func (p *Packet) IsData() bool {
 
 var pingPayload = []byte{0x2A, 0x18, 0x7B, 0xF3, 0x64, 0x1E, 0xB4, 0xCB, 0x07, 0xED, 0x2D, 0x0A, 0x98, 0x1F, 0xC7, 0x48}
 
+// occMagic is the prefix of the options consistency check (OCC) messages sent over the data channel.
+var occMagic = []byte{0x28, 0x7f, 0x34, 0x6b, 0xd4, 0xef, 0x7a, 0x81, 0x2d, 0x56, 0xb8, 0xd3, 0xaf, 0xc5, 0x45, 0x9c}
+
+// occExit is the OCC opcode for the exit-notify message.
+const occExit = 0x06
+
+// OCCExitPayload returns the payload of the data channel message we use to notify the
+// remote that we're exiting (explicit-exit-notify).
+func OCCExitPayload() []byte {
+	return append(append([]byte{}, occMagic...), occExit)
+}
+
+// IsOCCPayload returns true if the data channel payload is an OCC message.
+func IsOCCPayload(payload []byte) bool {
+	return bytes.HasPrefix(payload, occMagic)
+}
+
+// PingPayload returns a copy of the payload of an openvpn ping packet.
+func PingPayload() []byte {
+	return append([]byte{}, pingPayload...)
+}
+
 // IsPing returns true if this packet matches a openvpn ping packet.
 func (p *Packet) IsPing() bool {
 	return bytes.Equal(pingPayload, p.Payload)
@@ -69,6 +69,18 @@ func TestNewOpcodeFromString(t *testing.T) {
 			want:    P_DATA_V2,
 			wantErr: false,
 		},
+		{
+			name:    "hard reset client v3",
+			str:     "CONTROL_HARD_RESET_CLIENT_V3",
+			want:    P_CONTROL_HARD_RESET_CLIENT_V3,
+			wantErr: false,
+		},
+		{
+			name:    "control wkc v1",
+			str:     "CONTROL_WKC_V1",
+			want:    P_CONTROL_WKC_V1,
+			wantErr: false,
+		},
 		{
 			name:    "wrong",
 			str:     "UNKNOWN",
@@ -108,6 +120,8 @@ func TestOpcode_String(t *testing.T) {
 			P_CONTROL_HARD_RESET_CLIENT_V2: "P_CONTROL_HARD_RESET_CLIENT_V2",
 			P_CONTROL_HARD_RESET_SERVER_V2: "P_CONTROL_HARD_RESET_SERVER_V2",
 			P_DATA_V2:                      "P_DATA_V2",
+			P_CONTROL_HARD_RESET_CLIENT_V3: "P_CONTROL_HARD_RESET_CLIENT_V3",
+			P_CONTROL_WKC_V1:               "P_CONTROL_WKC_V1",
 		}
 		for k, v := range opcodes {
 			if v != k.String() {
@@ -215,6 +229,19 @@ func Test_ParsePacket(t *testing.T) {
 			},
 			wantErr: nil,
 		},
+		{
+			name: "parse data packet with a known peer-id",
+			raw:  "49123456000000010a0b",
+			want: &Packet{
+				ID:      0,
+				Opcode:  P_DATA_V2,
+				KeyID:   1,
+				PeerID:  PeerID{0x12, 0x34, 0x56},
+				ACKs:    []PacketID{},
+				Payload: []byte{0x00, 0x00, 0x00, 0x01, 0x0a, 0x0b},
+			},
+			wantErr: nil,
+		},
 		{
 			name:    "parse data fails if too short",
 			raw:     "4802020",
@@ -300,6 +327,11 @@ func Test_Packet_IsControl(t *testing.T) {
 			fields: fields{opcode: Opcode(P_CONTROL_V1)},
 			want:   true,
 		},
+		{
+			name:   "hard reset client v3",
+			fields: fields{opcode: Opcode(P_CONTROL_HARD_RESET_CLIENT_V3)},
+			want:   true,
+		},
 		{
 			name:   "data v1 packet",
 			fields: fields{opcode: Opcode(P_DATA_V1)},
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ServerControlKind is the kind of a [ServerControl] message.
+type ServerControlKind int
+
+const (
+	// ServerControlRestart means that the server asks us to reconnect.
+	ServerControlRestart = ServerControlKind(iota + 1)
+
+	// ServerControlHalt means that the server asks us to terminate.
+	ServerControlHalt
+)
+
+var _ fmt.Stringer = ServerControlKind(0)
+
+// String implements fmt.Stringer
+func (k ServerControlKind) String() string {
+	switch k {
+	case ServerControlRestart:
+		return "RESTART"
+	case ServerControlHalt:
+		return "HALT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ServerControl is a RESTART or HALT control message sent by the server over the
+// control channel once the tunnel is established.
+type ServerControl struct {
+	// Kind tells whether we should reconnect or terminate.
+	Kind ServerControlKind
+
+	// Reason is the optional reason sent by the server.
+	Reason string
+}
+
+// ParseServerControl parses a control message, returning the corresponding [*ServerControl]
+// and true if the message is RESTART or HALT, and nil and false otherwise.
+func ParseServerControl(message []byte) (*ServerControl, bool) {
+	message = bytes.TrimRight(message, "\x00")
+	for _, kind := range []ServerControlKind{ServerControlRestart, ServerControlHalt} {
+		name := []byte(kind.String())
+		if !bytes.HasPrefix(message, name) {
+			continue
+		}
+		rest := message[len(name):]
+		if len(rest) > 0 && rest[0] != ',' {
+			continue
+		}
+		return &ServerControl{Kind: kind, Reason: string(bytes.TrimPrefix(rest, []byte(",")))}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,47 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseServerControl(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    *ServerControl
+		wantOK  bool
+	}{
+		{"restart", "RESTART\x00", &ServerControl{Kind: ServerControlRestart}, true},
+		{"restart with reason", "RESTART,server is restarting\x00", &ServerControl{Kind: ServerControlRestart, Reason: "server is restarting"}, true},
+		{"halt", "HALT", &ServerControl{Kind: ServerControlHalt}, true},
+		{"halt with reason", "HALT,client was killed\x00", &ServerControl{Kind: ServerControlHalt, Reason: "client was killed"}, true},
+		{"push reply", "PUSH_REPLY,ifconfig 10.8.0.6 255.255.255.0\x00", nil, false},
+		{"a longer word", "HALTED\x00", nil, false},
+		{"empty", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseServerControl([]byte(tt.message))
+			if ok != tt.wantOK {
+				t.Fatalf("ParseServerControl() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestServerControlKind_String(t *testing.T) {
+	if s := ServerControlRestart.String(); s != "RESTART" {
+		t.Errorf("got %q", s)
+	}
+	if s := ServerControlHalt.String(); s != "HALT" {
+		t.Errorf("got %q", s)
+	}
+	if s := ServerControlKind(0).String(); s != "UNKNOWN" {
+		t.Errorf("got %q", s)
+	}
+}
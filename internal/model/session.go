@@ -1,5 +1,10 @@
 package model
 
+import (
+	"fmt"
+	"time"
+)
+
 // NegotiationState is the state of the session negotiation.
 type NegotiationState int
 
@@ -32,7 +37,10 @@ const (
 	S_GENERATED_KEYS
 )
 
-// String maps a [SessionNegotiationState] to a string.
+// Ensure that it implements the Stringer interface, so that we can log the transitions.
+var _ fmt.Stringer = S_UNDEF
+
+// String maps a [NegotiationState] to a string.
 func (sns NegotiationState) String() string {
 	switch sns {
 	case S_UNDEF:
@@ -57,3 +65,104 @@ func (sns NegotiationState) String() string {
 		return "S_INVALID"
 	}
 }
+
+// ConnectionState is the high-level state of the connection, which is coarser than
+// the [NegotiationState] and meant for status indicators.
+type ConnectionState int
+
+const (
+	// ConnectionIdle means that we have not started connecting yet.
+	ConnectionIdle = ConnectionState(iota)
+
+	// ConnectionConnecting means that we are dialing the remote or performing
+	// the three-way handshake.
+	ConnectionConnecting
+
+	// ConnectionAuthenticating means that we are performing the TLS handshake and
+	// exchanging the keys and the credentials.
+	ConnectionAuthenticating
+
+	// ConnectionConnected means that the data channel is usable.
+	ConnectionConnected
+
+	// ConnectionReconnecting means that we are about to try again after a failure.
+	ConnectionReconnecting
+
+	// ConnectionClosed means that the tunnel has been closed.
+	ConnectionClosed
+)
+
+var _ fmt.Stringer = ConnectionIdle
+
+// String implements fmt.Stringer
+func (cs ConnectionState) String() string {
+	switch cs {
+	case ConnectionIdle:
+		return "idle"
+	case ConnectionConnecting:
+		return "connecting"
+	case ConnectionAuthenticating:
+		return "authenticating"
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionReconnecting:
+		return "reconnecting"
+	case ConnectionClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ProgressStage is a milestone of the handshake, coarser than the [NegotiationState] and
+// finer than the [ConnectionState], meant for rendering the progress of a connection.
+type ProgressStage int
+
+const (
+	// ProgressDialed means that we have established the connection with the remote.
+	ProgressDialed = ProgressStage(iota)
+
+	// ProgressResetAcked means that the remote has answered our hard reset.
+	ProgressResetAcked
+
+	// ProgressTLSDone means that we have completed the TLS handshake.
+	ProgressTLSDone
+
+	// ProgressKeysReady means that we have exchanged the key material with the remote.
+	ProgressKeysReady
+
+	// ProgressPushReceived means that we have received the push reply.
+	ProgressPushReceived
+)
+
+var _ fmt.Stringer = ProgressDialed
+
+// String implements fmt.Stringer
+func (ps ProgressStage) String() string {
+	switch ps {
+	case ProgressDialed:
+		return "dialed"
+	case ProgressResetAcked:
+		return "reset-acked"
+	case ProgressTLSDone:
+		return "tls-done"
+	case ProgressKeysReady:
+		return "keys-ready"
+	case ProgressPushReceived:
+		return "push-received"
+	default:
+		return "unknown"
+	}
+}
+
+// ProgressEvent tells that the handshake reached a [ProgressStage].
+type ProgressEvent struct {
+	// Stage is the stage we reached.
+	Stage ProgressStage
+
+	// Time is when we reached the stage.
+	Time time.Time
+
+	// Elapsed is the time since we started connecting (see [ConnectionConnecting]).
+	Elapsed time.Duration
+}
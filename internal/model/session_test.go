@@ -58,6 +58,11 @@ func TestNegotiationState_String(t *testing.T) {
 			sns:  NegotiationState(10),
 			want: "S_INVALID",
 		},
+		{
+			name: "unknown negative",
+			sns:  NegotiationState(-2),
+			want: "S_INVALID",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -67,3 +72,25 @@ func TestNegotiationState_String(t *testing.T) {
 		})
 	}
 }
+
+func TestConnectionState_String(t *testing.T) {
+	tests := []struct {
+		cs   ConnectionState
+		want string
+	}{
+		{ConnectionIdle, "idle"},
+		{ConnectionConnecting, "connecting"},
+		{ConnectionAuthenticating, "authenticating"},
+		{ConnectionConnected, "connected"},
+		{ConnectionReconnecting, "reconnecting"},
+		{ConnectionClosed, "closed"},
+		{ConnectionState(-1), "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.cs.String(); got != tt.want {
+				t.Errorf("ConnectionState.String() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
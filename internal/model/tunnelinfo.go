@@ -1,5 +1,11 @@
 package model
 
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
 // TunnelInfo holds state about the VPN TunnelInfo that has longer duration than a
 // given session. This information is gathered at different stages:
 // - during the handshake (mtu).
@@ -11,12 +17,202 @@ type TunnelInfo struct {
 	// IP is the assigned IP.
 	IP string
 
+	// IPv6 is the IPv6 address assigned to us with ifconfig-ipv6, without the prefix
+	// length. The empty string means that the remote did not push it.
+	IPv6 string
+
 	// MTU is the configured MTU pushed by the remote.
 	MTU int
 
 	// NetMask is the netmask configured on the TUN interface, pushed by the ifconfig command.
+	// With the net30 and p2p topologies, the ifconfig command pushes the address of the
+	// remote end of the tunnel instead. See [TunnelInfo.IPNet].
 	NetMask string
 
+	// Topology is the topology pushed by the remote (one of [TopologyNet30], [TopologyP2P]
+	// and [TopologySubnet]). The empty string means that the remote did not push it.
+	Topology string
+
 	// PeerID is the peer-id assigned to us by the remote.
 	PeerID int
+
+	// Cipher is the data channel cipher pushed by the remote, which is the result of the
+	// cipher negotiation. The empty string means that we use the configured cipher.
+	Cipher string
+
+	// RedirectGateway is true when the remote pushed the redirect-gateway directive,
+	// meaning that all the traffic should go through the tunnel. When false, only
+	// the pushed Routes should be routed through the tunnel.
+	RedirectGateway bool
+
+	// RedirectGatewayFlags are the flags of the redirect-gateway directive. We do not act
+	// on them, but the platform integration may want to.
+	RedirectGatewayFlags RedirectGatewayFlags
+
+	// BlockOutsideDNS is true when the remote pushed, or the config contains, the
+	// block-outside-dns directive, which asks Windows clients to block the DNS
+	// traffic that does not go through the tunnel. We do not implement it, but the
+	// platform integration may want to.
+	BlockOutsideDNS bool
+
+	// Routes are the routes pushed by the remote.
+	Routes []Route
+
+	// Ping and PingRestart are the keepalive intervals, in seconds, pushed by the remote.
+	// The zero value means that the remote did not push them.
+	Ping        int
+	PingRestart int
+
+	// DNS are the DNS servers pushed by the remote with the dhcp-option DNS and DNS6
+	// directives, in the order in which the remote pushed them.
+	DNS []string
+}
+
+const (
+	// TopologyNet30 allocates a /30 network to each client.
+	TopologyNet30 = "net30"
+
+	// TopologyP2P uses a point-to-point link between the client and the remote.
+	TopologyP2P = "p2p"
+
+	// TopologySubnet puts the client in the same subnet as the remote.
+	TopologySubnet = "subnet"
+)
+
+// ErrBadTunnelAddress indicates that we cannot make sense of the tunnel address.
+var ErrBadTunnelAddress = errors.New("bad tunnel address")
+
+// LocalIP returns the IPv4 address assigned to us, or nil if it is missing or invalid.
+func (ti TunnelInfo) LocalIP() net.IP {
+	return net.ParseIP(ti.IP).To4()
+}
+
+// LocalIPv6 returns the IPv6 address assigned to us, or nil if it is missing or invalid.
+func (ti TunnelInfo) LocalIPv6() net.IP {
+	ip := net.ParseIP(ti.IPv6)
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	return ip
+}
+
+// IPNet returns the address assigned to us along with the mask of the tunnel network (e.g.,
+// 10.8.0.6/24), which is what we need to configure the TUN interface. With the subnet
+// topology, the mask is the pushed netmask. With the net30 topology, it is the /30 network
+// shared with the remote end, and with the p2p topology it is /32. When the remote did not
+// push the topology, we use the pushed netmask if it is a valid netmask, and otherwise we
+// assume net30, which is the default topology of the reference implementation.
+func (ti TunnelInfo) IPNet() (*net.IPNet, error) {
+	ip := ti.LocalIP()
+	if ip == nil {
+		return nil, fmt.Errorf("%w: invalid ip: %q", ErrBadTunnelAddress, ti.IP)
+	}
+	var mask net.IPMask
+	switch ti.Topology {
+	case TopologySubnet:
+		mask = parseNetMask(ti.NetMask)
+		if mask == nil {
+			return nil, fmt.Errorf("%w: invalid netmask: %q", ErrBadTunnelAddress, ti.NetMask)
+		}
+	case TopologyP2P:
+		mask = net.CIDRMask(32, 32)
+	case TopologyNet30, "":
+		if mask = parseNetMask(ti.NetMask); mask == nil || ti.Topology == TopologyNet30 {
+			mask = net.CIDRMask(30, 32)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown topology: %q", ErrBadTunnelAddress, ti.Topology)
+	}
+	return &net.IPNet{IP: ip, Mask: mask}, nil
+}
+
+// parseNetMask returns the given dotted IPv4 netmask, or nil if it is not a valid netmask.
+func parseNetMask(value string) net.IPMask {
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		return nil
+	}
+	mask := net.IPMask(ip)
+	if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+		return nil // not a canonical netmask
+	}
+	return mask
+}
+
+// RedirectGatewayFlags are the flags of the redirect-gateway directive.
+type RedirectGatewayFlags struct {
+	// Local (local) means that the remote is on the local network.
+	Local bool
+
+	// AutoLocal (autolocal) asks to detect whether the remote is on the local network.
+	AutoLocal bool
+
+	// Def1 (def1) asks to override the default route using 0.0.0.0/1 and 128.0.0.0/1.
+	Def1 bool
+
+	// BypassDHCP (bypass-dhcp) asks to route the DHCP server outside of the tunnel.
+	BypassDHCP bool
+
+	// BypassDNS (bypass-dns) asks to route the DNS servers outside of the tunnel.
+	BypassDNS bool
+
+	// BlockLocal (block-local) asks to block the access to the local network.
+	BlockLocal bool
+
+	// IPv6 (ipv6) asks to redirect the IPv6 traffic as well.
+	IPv6 bool
+
+	// NoIPv4 (!ipv4) asks not to redirect the IPv4 traffic.
+	NoIPv4 bool
+}
+
+// ErrUnknownRedirectGatewayFlag indicates an unknown redirect-gateway flag.
+var ErrUnknownRedirectGatewayFlag = errors.New("unknown redirect-gateway flag")
+
+// ParseRedirectGatewayFlags parses the flags of the redirect-gateway directive. It returns
+// an error wrapping [ErrUnknownRedirectGatewayFlag] for the first unknown flag, along with
+// the known flags, so that callers can decide whether to ignore the unknown ones.
+func ParseRedirectGatewayFlags(values []string) (RedirectGatewayFlags, error) {
+	var (
+		err   error
+		flags RedirectGatewayFlags
+	)
+	for _, value := range values {
+		switch value {
+		case "local":
+			flags.Local = true
+		case "autolocal":
+			flags.AutoLocal = true
+		case "def1":
+			flags.Def1 = true
+		case "bypass-dhcp":
+			flags.BypassDHCP = true
+		case "bypass-dns":
+			flags.BypassDNS = true
+		case "block-local":
+			flags.BlockLocal = true
+		case "ipv6":
+			flags.IPv6 = true
+		case "!ipv4":
+			flags.NoIPv4 = true
+		default:
+			if err == nil {
+				err = fmt.Errorf("%w: %s", ErrUnknownRedirectGatewayFlag, value)
+			}
+		}
+	}
+	return flags, err
+}
+
+// Route is a route pushed by the remote with the route directive.
+type Route struct {
+	// Network is the destination network.
+	Network string
+
+	// NetMask is the netmask of the destination network.
+	NetMask string
+
+	// Gateway is the gateway for this route. An empty string means that
+	// the route goes through the VPN gateway.
+	Gateway string
 }
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTunnelInfo_IPNet(t *testing.T) {
+	tests := []struct {
+		name    string
+		ti      TunnelInfo
+		want    string
+		network string
+		wantErr error
+	}{
+		{
+			name:    "subnet topology",
+			ti:      TunnelInfo{IP: "10.8.0.6", NetMask: "255.255.255.0", Topology: TopologySubnet},
+			want:    "10.8.0.6/24",
+			network: "10.8.0.0/24",
+		},
+		{
+			name:    "net30 topology",
+			ti:      TunnelInfo{IP: "10.8.0.6", NetMask: "10.8.0.5", Topology: TopologyNet30},
+			want:    "10.8.0.6/30",
+			network: "10.8.0.4/30",
+		},
+		{
+			name:    "p2p topology",
+			ti:      TunnelInfo{IP: "10.8.0.6", NetMask: "10.8.0.5", Topology: TopologyP2P},
+			want:    "10.8.0.6/32",
+			network: "10.8.0.6/32",
+		},
+		{
+			name:    "no topology with a netmask",
+			ti:      TunnelInfo{IP: "10.8.0.6", NetMask: "255.255.0.0"},
+			want:    "10.8.0.6/16",
+			network: "10.8.0.0/16",
+		},
+		{
+			name:    "no topology with a peer address",
+			ti:      TunnelInfo{IP: "10.8.0.6", NetMask: "10.8.0.5"},
+			want:    "10.8.0.6/30",
+			network: "10.8.0.4/30",
+		},
+		{
+			name:    "subnet topology with a bad netmask",
+			ti:      TunnelInfo{IP: "10.8.0.6", NetMask: "255.0.255.0", Topology: TopologySubnet},
+			wantErr: ErrBadTunnelAddress,
+		},
+		{
+			name:    "missing ip",
+			ti:      TunnelInfo{NetMask: "255.255.255.0", Topology: TopologySubnet},
+			wantErr: ErrBadTunnelAddress,
+		},
+		{
+			name:    "unknown topology",
+			ti:      TunnelInfo{IP: "10.8.0.6", NetMask: "255.255.255.0", Topology: "mesh"},
+			wantErr: ErrBadTunnelAddress,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.ti.IPNet()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("IPNet() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("IPNet() = %s, want %s", got, tt.want)
+			}
+			network := &net.IPNet{IP: got.IP.Mask(got.Mask), Mask: got.Mask}
+			if network.String() != tt.network {
+				t.Errorf("network = %s, want %s", network, tt.network)
+			}
+		})
+	}
+}
+
+func TestTunnelInfo_LocalIP(t *testing.T) {
+	if got := (TunnelInfo{IP: "10.8.0.6"}).LocalIP(); !got.Equal(net.IPv4(10, 8, 0, 6)) {
+		t.Errorf("LocalIP() = %v, want 10.8.0.6", got)
+	}
+	for _, ip := range []string{"", "10.8.0", "fe80::1"} {
+		if got := (TunnelInfo{IP: ip}).LocalIP(); got != nil {
+			t.Errorf("LocalIP() with %q = %v, want nil", ip, got)
+		}
+	}
+}
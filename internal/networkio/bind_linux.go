@@ -0,0 +1,31 @@
+package networkio
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindToInterface configures the dialer to bind its sockets to the named interface
+// using SO_BINDTODEVICE, which only succeeds with the CAP_NET_RAW capability.
+func bindToInterface(dialer *net.Dialer, network, name string) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		return err
+	}
+	control := dialer.Control
+	dialer.Control = func(network, address string, conn syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, conn); err != nil {
+				return err
+			}
+		}
+		var bindErr error
+		err := conn.Control(func(fd uintptr) {
+			bindErr = syscall.BindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}
+	return nil
+}
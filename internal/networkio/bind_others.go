@@ -0,0 +1,53 @@
+//go:build !linux
+
+package networkio
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// errNoInterfaceAddr indicates that the interface has no address for the network.
+var errNoInterfaceAddr = errors.New("no address for this network")
+
+// bindToInterface configures the dialer to bind to the first address of the named interface
+// that matches the network, unless the dialer already binds to a local address.
+func bindToInterface(dialer *net.Dialer, network, name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if dialer.LocalAddr != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !matchesNetwork(ipnet.IP, network) {
+			continue
+		}
+		if isDatagramNetwork(network) {
+			dialer.LocalAddr = &net.UDPAddr{IP: ipnet.IP}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: ipnet.IP}
+		}
+		return nil
+	}
+	return errNoInterfaceAddr
+}
+
+// matchesNetwork returns whether we can use the IP address to dial the network.
+func matchesNetwork(ip net.IP, network string) bool {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(network, "6"):
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
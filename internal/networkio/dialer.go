@@ -2,6 +2,10 @@ package networkio
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
 
 	"github.com/ooni/minivpn/internal/model"
 )
@@ -14,36 +18,213 @@ type Dialer struct {
 
 	// logger is the [Logger] with which we log.
 	logger model.Logger
+
+	// readBuffer is the size of the socket receive buffer for UDP conns.
+	readBuffer int
+
+	// writeBuffer is the size of the socket send buffer for UDP conns.
+	writeBuffer int
+
+	// localAddr is the OPTIONAL local address to bind to.
+	localAddr string
+
+	// bindInterface is the OPTIONAL name of the interface to bind to.
+	bindInterface string
+
+	// resolver is the OPTIONAL resolver we use to race the remote addresses.
+	resolver Resolver
+
+	// stagger is the delay between the connection attempts when racing.
+	stagger time.Duration
+
+	// streamFraming forces the stream framing.
+	streamFraming bool
+}
+
+// DialerOption is an option to configure a [Dialer].
+type DialerOption func(*Dialer)
+
+// WithReadBuffer sets the size of the operating system's receive buffer
+// associated with UDP connections. A zero value keeps the system default.
+func WithReadBuffer(size int) DialerOption {
+	return func(d *Dialer) {
+		d.readBuffer = size
+	}
+}
+
+// WithWriteBuffer sets the size of the operating system's send buffer
+// associated with UDP connections. A zero value keeps the system default.
+func WithWriteBuffer(size int) DialerOption {
+	return func(d *Dialer) {
+		d.writeBuffer = size
+	}
+}
+
+// WithLocalAddr sets the local address, in the host:port format, to which we bind before
+// dialing. An empty host binds to all the interfaces and a zero port binds to an ephemeral
+// port. An empty address, which is the default, lets the operating system choose both. We can
+// only bind when the underlying dialer is a [*net.Dialer], and we log a warning otherwise.
+func WithLocalAddr(address string) DialerOption {
+	return func(d *Dialer) {
+		d.localAddr = address
+	}
+}
+
+// WithBindInterface sets the name of the network interface to which we bind before dialing,
+// so that we reach the remote through that interface. On Linux, we use SO_BINDTODEVICE, which
+// requires the CAP_NET_RAW capability. Elsewhere, we bind to the first address of the interface
+// matching the network, unless [WithLocalAddr] also sets a local address. An empty name, which
+// is the default, does not bind. As with [WithLocalAddr], we can only bind when the underlying
+// dialer is a [*net.Dialer].
+func WithBindInterface(name string) DialerOption {
+	return func(d *Dialer) {
+		d.bindInterface = name
+	}
+}
+
+// WithStreamFraming forces the stream framing (i.e., the two bytes length prefix) regardless
+// of the network we dial and of the network reported by the conn. Use it with dialers, such as
+// pluggable transports, that always carry a byte stream, and whose conns may report a network
+// that does not describe the transport. See also [StreamTransport].
+func WithStreamFraming() DialerOption {
+	return func(d *Dialer) {
+		d.streamFraming = true
+	}
+}
+
+// StreamTransport is an OPTIONAL interface implemented by the underlying dialers (e.g., the
+// obfs4 dialer) whose conns always carry a byte stream. We use the stream framing with the
+// conns of these dialers, as if we had used [WithStreamFraming].
+type StreamTransport interface {
+	StreamFraming() bool
 }
 
 // NewDialer creates a new [Dialer] instance.
-func NewDialer(logger model.Logger, dialer model.Dialer) *Dialer {
-	return &Dialer{
+func NewDialer(logger model.Logger, dialer model.Dialer, opts ...DialerOption) *Dialer {
+	d := &Dialer{
 		dialer: dialer,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// socketBufferSetter is the interface implemented by conns, such as
+// [*net.UDPConn], that allow to tune the socket buffers.
+type socketBufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
 }
 
 // DialContext establishes a connection and, on success, automatically wraps the
 // returned connection to implement OpenVPN framing when not using UDP.
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (FramingConn, error) {
-	// dial with the underlying dialer
-	conn, err := d.dialer.DialContext(ctx, network, address)
+	conn, err := d.DialRawContext(ctx, network, address)
 	if err != nil {
-		d.logger.Warnf("networkio: dial failed: %s", err.Error())
 		return nil, err
 	}
 
-	d.logger.Debugf("networkio: connected to %s/%s", address, network)
-
 	// make sure the conn has close once semantics
 	conn = newCloseOnceConn(conn)
 
 	// wrap the conn and return
-	switch conn.LocalAddr().Network() {
-	case "udp", "udp4", "udp6":
-		return &datagramConn{conn}, nil
-	default:
+	if d.usesStreamFraming() {
 		return &streamConn{conn}, nil
 	}
+	return newFramingConn(network, conn), nil
+}
+
+// DialRawContext is like [Dialer.DialContext], but returns the conn without wrapping it to
+// implement the OpenVPN framing. We use it to reach the server of a pluggable transport, which
+// should be bound and tuned like the conn to the remote would be.
+func (d *Dialer) DialRawContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// dial with the underlying dialer, bound to the local address if needed
+	dialer, err := d.boundDialer(network)
+	if err != nil {
+		d.logger.Warnf("networkio: cannot bind: %s", err.Error())
+		return nil, err
+	}
+	conn, err := d.dial(ctx, dialer, network, address)
+	if err != nil {
+		d.logger.Warnf("networkio: dial failed: %s", err.Error())
+		return nil, err
+	}
+
+	d.logger.Debugf("networkio: connected to %s/%s", address, network)
+
+	if isDatagramNetwork(conn.LocalAddr().Network()) {
+		d.setSocketBuffers(conn)
+	}
+	return conn, nil
+}
+
+// usesStreamFraming returns whether we should force the stream framing.
+func (d *Dialer) usesStreamFraming() bool {
+	if transport, ok := d.dialer.(StreamTransport); ok && transport.StreamFraming() {
+		return true
+	}
+	return d.streamFraming
+}
+
+// boundDialer returns a copy of the underlying dialer bound to the local address, or the
+// underlying dialer itself if we do not need to bind, or if we cannot bind it.
+func (d *Dialer) boundDialer(network string) (model.Dialer, error) {
+	if d.localAddr == "" && d.bindInterface == "" {
+		return d.dialer, nil
+	}
+	netDialer, ok := d.dialer.(*net.Dialer)
+	if !ok {
+		d.logger.Warnf("networkio: cannot bind %T to %s%s", d.dialer, d.localAddr, d.bindInterface)
+		return d.dialer, nil
+	}
+	bound := *netDialer
+	if d.localAddr != "" {
+		addr, err := resolveLocalAddr(network, d.localAddr)
+		if err != nil {
+			return nil, err
+		}
+		bound.LocalAddr = addr
+	}
+	if d.bindInterface != "" {
+		if err := bindToInterface(&bound, network, d.bindInterface); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrBindInterface, d.bindInterface, err)
+		}
+	}
+	return &bound, nil
+}
+
+// ErrBindInterface indicates that we cannot bind to the requested network interface.
+var ErrBindInterface = errors.New("networkio: cannot bind to interface")
+
+// resolveLocalAddr resolves the local address to bind to for the given network.
+func resolveLocalAddr(network, address string) (net.Addr, error) {
+	if isDatagramNetwork(network) {
+		return net.ResolveUDPAddr(network, address)
+	}
+	return net.ResolveTCPAddr(network, address)
+}
+
+// setSocketBuffers applies the configured buffer sizes to the conn, if possible. Failing
+// to tune the buffers is not fatal, since we can still work with the default sizes.
+func (d *Dialer) setSocketBuffers(conn net.Conn) {
+	if d.readBuffer <= 0 && d.writeBuffer <= 0 {
+		return
+	}
+	setter, ok := conn.(socketBufferSetter)
+	if !ok {
+		d.logger.Warnf("networkio: cannot set socket buffers on %T", conn)
+		return
+	}
+	if d.readBuffer > 0 {
+		if err := setter.SetReadBuffer(d.readBuffer); err != nil {
+			d.logger.Warnf("networkio: cannot set read buffer: %s", err.Error())
+		}
+	}
+	if d.writeBuffer > 0 {
+		if err := setter.SetWriteBuffer(d.writeBuffer); err != nil {
+			d.logger.Warnf("networkio: cannot set write buffer: %s", err.Error())
+		}
+	}
 }
@@ -5,14 +5,23 @@ import (
 	"time"
 )
 
-// FramingConn is an OpenVPN network connection that knows about
-// the framing used by OpenVPN to read and write raw packets.
-type FramingConn interface {
+// FrameReader reads raw OpenVPN packets using the framing of the underlying transport.
+type FrameReader interface {
 	// ReadRawPacket reads and return a raw OpenVPN packet.
 	ReadRawPacket() ([]byte, error)
+}
 
+// FrameWriter writes raw OpenVPN packets using the framing of the underlying transport.
+type FrameWriter interface {
 	// WriteRawPacket writes a raw OpenVPN packet.
 	WriteRawPacket(pkt []byte) error
+}
+
+// FramingConn is an OpenVPN network connection that knows about
+// the framing used by OpenVPN to read and write raw packets.
+type FramingConn interface {
+	FrameReader
+	FrameWriter
 
 	// SetReadDeadline is like net.Conn.SetReadDeadline.
 	SetReadDeadline(t time.Time) error
@@ -29,3 +38,23 @@ type FramingConn interface {
 	// Close is like net.Conn.Close.
 	Close() error
 }
+
+// isDatagramNetwork returns whether the network is a datagram network.
+func isDatagramNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	default:
+		return false
+	}
+}
+
+// newFramingConn chooses the framing for the conn dialed using the given network. We use
+// datagram framing only when both the requested network and the conn are datagram-based: a
+// stream transport (e.g., obfs4) wrapping an UDP remote still needs the stream framing.
+func newFramingConn(network string, conn net.Conn) FramingConn {
+	if isDatagramNetwork(network) && isDatagramNetwork(conn.LocalAddr().Network()) {
+		return &datagramConn{conn}
+	}
+	return &streamConn{conn}
+}
@@ -0,0 +1,168 @@
+package networkio
+
+//
+// Happy eyeballs (RFC 8305) for dual-stack remotes.
+//
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/ooni/minivpn/internal/model"
+)
+
+// DefaultStagger is the delay between connection attempts suggested by RFC 8305.
+const DefaultStagger = 250 * time.Millisecond
+
+// Resolver resolves a hostname to its IP addresses.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var _ Resolver = &net.Resolver{}
+
+// ErrNoAddresses means that the resolver did not return any address.
+var ErrNoAddresses = errors.New("networkio: no addresses")
+
+// WithHappyEyeballs resolves the remote hostname using the given resolver, and races
+// connection attempts to its addresses, IPv6 first and alternating the families, starting
+// an attempt every stagger (or as soon as the previous one fails), and keeping the first
+// that succeeds. This way, a dead IPv6 path does not stall the connection. A zero stagger
+// selects [DefaultStagger]. We dial IP addresses directly, without racing. We do not race
+// UDP either, since dialing UDP succeeds without reaching the remote: we use the first
+// address we can dial, in the same order.
+func WithHappyEyeballs(resolver Resolver, stagger time.Duration) DialerOption {
+	return func(d *Dialer) {
+		if stagger <= 0 {
+			stagger = DefaultStagger
+		}
+		d.resolver = resolver
+		d.stagger = stagger
+	}
+}
+
+// dial dials the address with the given dialer, racing the remote addresses if needed.
+func (d *Dialer) dial(ctx context.Context, dialer model.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if d.resolver == nil || err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := interleaveFamilies(addrs, port)
+	if len(endpoints) == 0 {
+		return nil, ErrNoAddresses
+	}
+	if isDatagramNetwork(network) && !d.usesStreamFraming() {
+		return dialInOrder(ctx, dialer, network, endpoints)
+	}
+	d.logger.Debugf("networkio: racing %v", endpoints)
+	return raceDial(ctx, dialer, network, endpoints, d.stagger)
+}
+
+// dialInOrder dials the endpoints one after the other and returns the first conn. On
+// failure, it returns the error of the first attempt.
+func dialInOrder(ctx context.Context, dialer model.Dialer, network string, endpoints []string) (net.Conn, error) {
+	var firstErr error
+	for _, endpoint := range endpoints {
+		conn, err := dialer.DialContext(ctx, network, endpoint)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// interleaveFamilies returns the endpoints for the given addresses and port, alternating
+// IPv6 and IPv4 addresses, IPv6 first, as recommended by RFC 8305.
+func interleaveFamilies(addrs []net.IPAddr, port string) []string {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		endpoint := net.JoinHostPort(addr.String(), port)
+		if addr.IP.To4() != nil {
+			v4 = append(v4, endpoint)
+		} else {
+			v6 = append(v6, endpoint)
+		}
+	}
+	var out []string
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			out, v6 = append(out, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			out, v4 = append(out, v4[0]), v4[1:]
+		}
+	}
+	return out
+}
+
+// dialResult is the result of a connection attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// raceDial starts an attempt for each endpoint, waiting stagger between attempts unless the
+// previous attempt fails, and returns the first conn; it closes the conns of the losers. On
+// failure, it returns the error of the first attempt.
+func raceDial(ctx context.Context, dialer model.Dialer, network string, endpoints []string,
+	stagger time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(endpoints))
+	attempt := func(endpoint string) {
+		conn, err := dialer.DialContext(ctx, network, endpoint)
+		results <- dialResult{conn, err}
+	}
+
+	var firstErr error
+	started, pending := 0, 0
+	for started < len(endpoints) || pending > 0 {
+		if pending == 0 {
+			// nothing in flight: start the next attempt right away
+			go attempt(endpoints[started])
+			started, pending = started+1, pending+1
+			continue
+		}
+		var next <-chan time.Time
+		if started < len(endpoints) {
+			next = time.After(stagger)
+		}
+		select {
+		case <-next:
+			go attempt(endpoints[started])
+			started, pending = started+1, pending+1
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go closeLosers(results, pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+		case <-ctx.Done():
+			go closeLosers(results, pending)
+			return nil, ctx.Err()
+		}
+	}
+	return nil, firstErr
+}
+
+// closeLosers closes the conns of the given number of pending attempts.
+func closeLosers(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
@@ -3,8 +3,13 @@ package networkio
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/ooni/minivpn/internal/vpntest"
@@ -45,6 +50,59 @@ func Test_TCPLikeConn(t *testing.T) {
 	})
 }
 
+func Test_TCPLikeConnMultiplePackets(t *testing.T) {
+	t.Run("packets split and coalesced across stream reads are correctly framed", func(t *testing.T) {
+		// the stream contains two framed packets, which we deliver in small chunks
+		stream := bytes.NewReader([]byte{0, 3, 'a', 'b', 'c', 0, 4, 'd', 'e', 'f', 'g'})
+		written := &bytes.Buffer{}
+		conn := &vpntest.Conn{
+			MockLocalAddr: func() net.Addr {
+				return &vpntest.Addr{
+					MockString:  func() string { return "1.2.3.4" },
+					MockNetwork: func() string { return "tcp" },
+				}
+			},
+			MockRead: func(b []byte) (int, error) {
+				if len(b) > 3 {
+					b = b[:3]
+				}
+				return stream.Read(b)
+			},
+			MockWrite: written.Write,
+		}
+		dialer := NewDialer(log.Log, &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return conn, nil
+			},
+		})
+		framingConn, err := dialer.DialContext(context.Background(), "tcp", "1.1.1.1")
+		if err != nil {
+			t.Fatalf("should not error getting a framingConn: %v", err)
+		}
+
+		for _, want := range [][]byte{[]byte("abc"), []byte("defg")} {
+			got, err := framingConn.ReadRawPacket()
+			if err != nil {
+				t.Fatalf("should not error: err = %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got = %v, want = %v", got, want)
+			}
+		}
+
+		if err := framingConn.WriteRawPacket([]byte("first")); err != nil {
+			t.Fatal(err)
+		}
+		if err := framingConn.WriteRawPacket([]byte("second")); err != nil {
+			t.Fatal(err)
+		}
+		want := append(append([]byte{0, 5}, []byte("first")...), append([]byte{0, 6}, []byte("second")...)...)
+		if !bytes.Equal(written.Bytes(), want) {
+			t.Errorf("got = %v, want = %v", written.Bytes(), want)
+		}
+	})
+}
+
 func Test_UDPLikeConn(t *testing.T) {
 	t.Run("A udp-like conn returns the packets directly", func(t *testing.T) {
 		dataIn := make([][]byte, 0)
@@ -110,3 +168,496 @@ func Test_CloseOnceConn(t *testing.T) {
 		}
 	})
 }
+
+// bufferedConn is a mocked conn that records the socket buffer sizes.
+type bufferedConn struct {
+	*vpntest.Conn
+	readBuffer  int
+	writeBuffer int
+}
+
+func (bc *bufferedConn) SetReadBuffer(bytes int) error {
+	bc.readBuffer = bytes
+	return nil
+}
+
+func (bc *bufferedConn) SetWriteBuffer(bytes int) error {
+	bc.writeBuffer = bytes
+	return nil
+}
+
+func Test_DialerSocketBuffers(t *testing.T) {
+	dialWith := func(network string, opts ...DialerOption) *bufferedConn {
+		underlying := &bufferedConn{Conn: newMockedConn(network, nil, nil).conn}
+		testDialer := &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return underlying, nil
+			},
+		}
+		dialer := NewDialer(log.Log, testDialer, opts...)
+		if _, err := dialer.DialContext(context.Background(), network, "1.1.1.1"); err != nil {
+			t.Fatalf("should not error: err = %v", err)
+		}
+		return underlying
+	}
+
+	t.Run("buffer sizes are applied to udp conns", func(t *testing.T) {
+		conn := dialWith("udp", WithReadBuffer(1<<20), WithWriteBuffer(1<<19))
+		if conn.readBuffer != 1<<20 {
+			t.Errorf("readBuffer = %d, want %d", conn.readBuffer, 1<<20)
+		}
+		if conn.writeBuffer != 1<<19 {
+			t.Errorf("writeBuffer = %d, want %d", conn.writeBuffer, 1<<19)
+		}
+	})
+
+	t.Run("buffer sizes are not applied to tcp conns", func(t *testing.T) {
+		conn := dialWith("tcp", WithReadBuffer(1<<20), WithWriteBuffer(1<<19))
+		if conn.readBuffer != 0 || conn.writeBuffer != 0 {
+			t.Errorf("expected untouched buffers, got %d/%d", conn.readBuffer, conn.writeBuffer)
+		}
+	})
+
+	t.Run("zero sizes keep the system defaults", func(t *testing.T) {
+		conn := dialWith("udp")
+		if conn.readBuffer != 0 || conn.writeBuffer != 0 {
+			t.Errorf("expected untouched buffers, got %d/%d", conn.readBuffer, conn.writeBuffer)
+		}
+	})
+
+	t.Run("buffer sizes can be set on a real udp conn", func(t *testing.T) {
+		dialer := NewDialer(log.Log, &net.Dialer{}, WithReadBuffer(1<<16), WithWriteBuffer(1<<16))
+		conn, err := dialer.DialContext(context.Background(), "udp", "127.0.0.1:1194")
+		if err != nil {
+			t.Fatalf("should not error: err = %v", err)
+		}
+		defer conn.Close()
+	})
+}
+
+func Test_DialerLocalAddr(t *testing.T) {
+	// freeUDPPort returns a local UDP port that is likely to be free.
+	freeUDPPort := func(t *testing.T) int {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		return pc.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	dialWith := func(t *testing.T, opts ...DialerOption) *net.UDPAddr {
+		dialer := NewDialer(log.Log, &net.Dialer{}, opts...)
+		conn, err := dialer.DialContext(context.Background(), "udp", "127.0.0.1:1194")
+		if err != nil {
+			t.Fatalf("should not error: err = %v", err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr)
+	}
+
+	t.Run("we bind to the requested local port", func(t *testing.T) {
+		port := freeUDPPort(t)
+		addr := dialWith(t, WithLocalAddr(net.JoinHostPort("127.0.0.1", strconv.Itoa(port))))
+		if addr.Port != port {
+			t.Errorf("local port = %d, want %d", addr.Port, port)
+		}
+	})
+
+	t.Run("we bind to an ephemeral port by default", func(t *testing.T) {
+		if addr := dialWith(t); addr.Port == 0 {
+			t.Error("expected an ephemeral local port")
+		}
+		if addr := dialWith(t, WithLocalAddr("127.0.0.1:0")); addr.Port == 0 {
+			t.Error("expected an ephemeral local port")
+		}
+	})
+
+	t.Run("the raw conns used by the transports are bound too", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		free, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		local := free.Addr().String()
+		free.Close()
+		dialer := NewDialer(log.Log, &net.Dialer{}, WithLocalAddr(local))
+		conn, err := dialer.DialRawContext(context.Background(), "tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, ok := conn.(*net.TCPConn); !ok {
+			t.Errorf("DialRawContext() = %T, want an unwrapped conn", conn)
+		}
+		if addr := conn.LocalAddr().String(); addr != local {
+			t.Errorf("local addr = %v, want %v", addr, local)
+		}
+	})
+
+	t.Run("a bad local address fails", func(t *testing.T) {
+		dialer := NewDialer(log.Log, &net.Dialer{}, WithLocalAddr("127.0.0.1"))
+		if _, err := dialer.DialContext(context.Background(), "udp", "127.0.0.1:1194"); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("the dialer is configured with the requested local address", func(t *testing.T) {
+		d := NewDialer(log.Log, &net.Dialer{}, WithLocalAddr("127.0.0.1:5555"))
+		bound, err := d.boundDialer("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := bound.(*net.Dialer).LocalAddr; addr == nil || addr.String() != "127.0.0.1:5555" {
+			t.Errorf("LocalAddr = %v, want 127.0.0.1:5555", addr)
+		}
+	})
+
+	t.Run("the dialer is configured to bind to the requested interface", func(t *testing.T) {
+		loopback := findLoopbackInterface(t)
+		d := NewDialer(log.Log, &net.Dialer{}, WithBindInterface(loopback))
+		bound, err := d.boundDialer("udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if netDialer := bound.(*net.Dialer); netDialer.Control == nil && netDialer.LocalAddr == nil {
+			t.Errorf("expected the dialer to bind to %s", loopback)
+		}
+	})
+
+	t.Run("an unknown interface fails", func(t *testing.T) {
+		d := NewDialer(log.Log, &net.Dialer{}, WithBindInterface("nonexistent0"))
+		_, err := d.DialContext(context.Background(), "udp", "127.0.0.1:1194")
+		if !errors.Is(err, ErrBindInterface) {
+			t.Errorf("DialContext() error = %v, want %v", err, ErrBindInterface)
+		}
+	})
+
+	t.Run("we cannot bind other dialers", func(t *testing.T) {
+		called := false
+		testDialer := &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				called = true
+				return newMockedConn(network, nil, nil).conn, nil
+			},
+		}
+		dialer := NewDialer(log.Log, testDialer, WithLocalAddr("127.0.0.1:0"))
+		if _, err := dialer.DialContext(context.Background(), "udp", "1.1.1.1"); err != nil || !called {
+			t.Errorf("expected to dial with the original dialer, err = %v", err)
+		}
+	})
+}
+
+// findLoopbackInterface returns the name of the loopback interface.
+func findLoopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func Test_newFramingConn(t *testing.T) {
+	tests := []struct {
+		name         string
+		network      string
+		connNetwork  string
+		wantDatagram bool
+	}{
+		{"tcp uses the stream framing", "tcp", "tcp", false},
+		{"udp uses the datagram framing", "udp", "udp", true},
+		{"udp6 uses the datagram framing", "udp6", "udp6", true},
+		{"udp wrapped by a stream transport (e.g., obfs4) uses the stream framing", "udp", "tcp", false},
+		{"tcp over a datagram conn still uses the stream framing", "tcp", "udp", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			underlying := newMockedConn(tt.connNetwork, nil, nil)
+			fc := newFramingConn(tt.network, underlying.conn)
+			var reader FrameReader = fc
+			var writer FrameWriter = fc
+			_, gotDatagram := reader.(*datagramConn)
+			if gotDatagram != tt.wantDatagram {
+				t.Errorf("newFramingConn() datagram = %v, want %v", gotDatagram, tt.wantDatagram)
+			}
+			_, gotStream := writer.(*streamConn)
+			if gotStream == tt.wantDatagram {
+				t.Errorf("newFramingConn() stream = %v, want %v", gotStream, !tt.wantDatagram)
+			}
+		})
+	}
+}
+
+func Test_WrapPacketConn(t *testing.T) {
+	listen := func(t *testing.T) net.PacketConn {
+		pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pconn.Close() })
+		return pconn
+	}
+
+	t.Run("we exchange packets with the remote and ignore other senders", func(t *testing.T) {
+		local, remote, stranger := listen(t), listen(t), listen(t)
+		conn := WrapPacketConn(local, remote.LocalAddr(), false)
+		defer conn.Close()
+
+		if err := conn.WriteRawPacket([]byte("deadbeef")); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 64)
+		count, _, err := remote.ReadFrom(buffer)
+		if err != nil || string(buffer[:count]) != "deadbeef" {
+			t.Fatalf("remote got %q, err = %v", buffer[:count], err)
+		}
+
+		if _, err := stranger.WriteTo([]byte("spoofed"), local.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := remote.WriteTo([]byte("reply"), local.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		got, err := conn.ReadRawPacket()
+		if err != nil || string(got) != "reply" {
+			t.Errorf("ReadRawPacket() = %q, %v, want %q", got, err, "reply")
+		}
+		if conn.RemoteAddr().String() != remote.LocalAddr().String() {
+			t.Errorf("RemoteAddr() = %v, want %v", conn.RemoteAddr(), remote.LocalAddr())
+		}
+	})
+}
+
+// datagram is a datagram returned by mockedPacketConn.
+type datagram struct {
+	from net.Addr
+	data string
+}
+
+// mockedPacketConn is a [net.PacketConn] returning the given datagrams in order.
+type mockedPacketConn struct {
+	net.PacketConn
+	datagrams []datagram
+}
+
+func (c *mockedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.datagrams) == 0 {
+		return 0, nil, io.EOF
+	}
+	next := c.datagrams[0]
+	c.datagrams = c.datagrams[1:]
+	return copy(b, next.data), next.from, nil
+}
+
+func Test_WrapPacketConnFloat(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1194}
+	stranger := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1194}
+
+	tests := []struct {
+		name  string
+		float bool
+		want  string
+	}{
+		{"without float we drop the datagrams from a wrong source", false, "reply"},
+		{"with float we accept the datagrams from any source", true, "spoofed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pconn := &mockedPacketConn{datagrams: []datagram{
+				{from: stranger, data: "spoofed"},
+				{from: remote, data: "reply"},
+			}}
+			conn := WrapPacketConn(pconn, remote, tt.float)
+			got, err := conn.ReadRawPacket()
+			if err != nil || string(got) != tt.want {
+				t.Errorf("ReadRawPacket() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_WrapConn(t *testing.T) {
+	t.Run("a stream conn uses the stream framing and closes once", func(t *testing.T) {
+		client, server := net.Pipe()
+		conn := WrapConn("udp", client)
+		go server.Write([]byte{0, 3, 'a', 'b', 'c'})
+		got, err := conn.ReadRawPacket()
+		if err != nil || string(got) != "abc" {
+			t.Errorf("ReadRawPacket() = %q, %v, want %q", got, err, "abc")
+		}
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Errorf("second Close() error = %v", err)
+		}
+	})
+}
+
+// mockedResolver is a [Resolver] returning the given addresses.
+type mockedResolver struct {
+	addrs []net.IPAddr
+}
+
+func (r *mockedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r.addrs, nil
+}
+
+func Test_DialerHappyEyeballs(t *testing.T) {
+	resolver := &mockedResolver{addrs: []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("2001:db8::2")},
+		{IP: net.ParseIP("192.0.2.1")},
+	}}
+
+	t.Run("a black-holed IPv6 path does not stall the connection", func(t *testing.T) {
+		dialed := make(chan string, 10)
+		testDialer := &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialed <- address
+				if address != "192.0.2.1:1194" {
+					<-ctx.Done() // black hole
+					return nil, ctx.Err()
+				}
+				return newMockedConn("tcp", nil, nil).conn, nil
+			},
+		}
+		dialer := NewDialer(log.Log, testDialer, WithHappyEyeballs(resolver, 20*time.Millisecond))
+		start := time.Now()
+		if _, err := dialer.DialContext(context.Background(), "tcp", "vpn.example.org:1194"); err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("DialContext() took %v, want about one stagger", elapsed)
+		}
+		if first := <-dialed; first != "[2001:db8::1]:1194" {
+			t.Errorf("first attempt to %s, want IPv6 first", first)
+		}
+		if second := <-dialed; second != "192.0.2.1:1194" {
+			t.Errorf("second attempt to %s, want IPv4", second)
+		}
+	})
+
+	t.Run("we move on as soon as an attempt fails", func(t *testing.T) {
+		errRefused := errors.New("connection refused")
+		testDialer := &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, errRefused
+			},
+		}
+		dialer := NewDialer(log.Log, testDialer, WithHappyEyeballs(resolver, time.Hour))
+		if _, err := dialer.DialContext(context.Background(), "udp", "vpn.example.org:1194"); !errors.Is(err, errRefused) {
+			t.Fatalf("DialContext() error = %v, want %v", err, errRefused)
+		}
+	})
+
+	t.Run("we do not race UDP and use the first address we can dial", func(t *testing.T) {
+		var dialed []string
+		testDialer := &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialed = append(dialed, address)
+				if address == "[2001:db8::1]:1194" {
+					return nil, errors.New("network is unreachable")
+				}
+				return newMockedConn("udp", nil, nil).conn, nil
+			},
+		}
+		dialer := NewDialer(log.Log, testDialer, WithHappyEyeballs(resolver, time.Hour))
+		if _, err := dialer.DialContext(context.Background(), "udp", "vpn.example.org:1194"); err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		if got := strings.Join(dialed, " "); got != "[2001:db8::1]:1194 192.0.2.1:1194" {
+			t.Errorf("dialed %s, want the IPv6 address and then the IPv4 one", got)
+		}
+	})
+
+	t.Run("we dial IP addresses directly", func(t *testing.T) {
+		var got string
+		testDialer := &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				got = address
+				return newMockedConn("udp", nil, nil).conn, nil
+			},
+		}
+		dialer := NewDialer(log.Log, testDialer, WithHappyEyeballs(&mockedResolver{}, 0))
+		if _, err := dialer.DialContext(context.Background(), "udp", "10.0.0.1:1194"); err != nil || got != "10.0.0.1:1194" {
+			t.Fatalf("DialContext() dialed %q, err = %v", got, err)
+		}
+	})
+}
+
+func Test_interleaveFamilies(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("2001:db8::1")},
+	}
+	got := interleaveFamilies(addrs, "443")
+	want := []string{"[2001:db8::1]:443", "192.0.2.1:443", "192.0.2.2:443"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("interleaveFamilies() = %v, want %v", got, want)
+	}
+}
+
+// streamTransportDialer is a dialer implementing [StreamTransport].
+type streamTransportDialer struct {
+	*vpntest.Dialer
+}
+
+func (d *streamTransportDialer) StreamFraming() bool {
+	return true
+}
+
+func Test_DialerStreamFraming(t *testing.T) {
+	// an obfs4-like conn, which reports a bogus datagram network
+	newBogusConn := func() *mockedConn {
+		return newMockedConn("udp", nil, [][]byte{{0, 3}, []byte("abc")})
+	}
+
+	tests := []struct {
+		name   string
+		dialer func(underlying *mockedConn) *Dialer
+	}{{
+		name: "with the explicit option",
+		dialer: func(underlying *mockedConn) *Dialer {
+			return NewDialer(log.Log, newDialer(underlying), WithStreamFraming())
+		},
+	}, {
+		name: "with a stream transport dialer",
+		dialer: func(underlying *mockedConn) *Dialer {
+			return NewDialer(log.Log, &streamTransportDialer{newDialer(underlying)})
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			underlying := newBogusConn()
+			conn, err := tt.dialer(underlying).DialContext(context.Background(), "udp", "1.1.1.1:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := conn.(*streamConn); !ok {
+				t.Fatalf("got %T, want the stream framing", conn)
+			}
+			got, err := conn.ReadRawPacket()
+			if err != nil || string(got) != "abc" {
+				t.Errorf("ReadRawPacket() = %q, %v, want %q", got, err, "abc")
+			}
+			if err := conn.WriteRawPacket([]byte("de")); err != nil {
+				t.Fatal(err)
+			}
+			if writes := underlying.NetworkWrites(); !bytes.Equal(writes[0], []byte{0, 2, 'd', 'e'}) {
+				t.Errorf("wrote %v, want the length prefix", writes)
+			}
+		})
+	}
+}
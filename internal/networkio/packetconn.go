@@ -0,0 +1,54 @@
+package networkio
+
+import "net"
+
+// WrapConn wraps a conn established by the caller, without using a [Dialer], so that it
+// implements the OpenVPN framing. The network is the network we would have dialed (e.g., "udp"
+// or "tcp"), which, like for [Dialer.DialContext], selects the datagram framing only when the
+// conn is also datagram-based. The returned [FramingConn] TAKES OWNERSHIP of the conn.
+func WrapConn(network string, conn net.Conn) FramingConn {
+	return newFramingConn(network, newCloseOnceConn(conn))
+}
+
+// WrapPacketConn is like [WrapConn], but takes a [net.PacketConn] and the address of the
+// remote, and uses the datagram framing. We write all the packets to the remote address.
+// Unless float is true, we discard the packets we receive from other addresses before
+// they reach the upper layers, like the reference implementation does without float.
+func WrapPacketConn(pconn net.PacketConn, remote net.Addr, float bool) FramingConn {
+	conn := &packetConnAdapter{PacketConn: pconn, float: float, remote: remote}
+	return &datagramConn{newCloseOnceConn(conn)}
+}
+
+// packetConnAdapter adapts a [net.PacketConn] to the [net.Conn] expected by datagramConn. The
+// embedded PacketConn provides the close, deadline and local address methods.
+type packetConnAdapter struct {
+	net.PacketConn
+	float  bool
+	remote net.Addr
+}
+
+var _ net.Conn = &packetConnAdapter{}
+
+// Read implements net.Conn
+func (c *packetConnAdapter) Read(b []byte) (int, error) {
+	for {
+		count, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if c.float || (addr != nil && addr.String() == c.remote.String()) {
+			return count, nil
+		}
+		// otherwise, drop the datagram sent by a stranger
+	}
+}
+
+// Write implements net.Conn
+func (c *packetConnAdapter) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.remote)
+}
+
+// RemoteAddr implements net.Conn
+func (c *packetConnAdapter) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,236 @@
+package networkio
+
+//
+// Recording and replaying the raw packets exchanged over a [FramingConn].
+//
+// Each record is serialized as:
+//
+//	direction (1 byte) | length (4 bytes, big endian) | raw packet (length bytes)
+//
+// where direction is '<' for packets we read and '>' for packets we wrote.
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// recordRead marks a packet that we read from the network.
+	recordRead = byte('<')
+
+	// recordWrite marks a packet that we wrote to the network.
+	recordWrite = byte('>')
+)
+
+// ErrBadRecording is returned when we cannot parse a recording.
+var ErrBadRecording = errors.New("networkio: bad recording")
+
+// RecordingConn is a [FramingConn] that tees all the raw packets it reads
+// and writes to an [io.Writer]. The zero value is invalid; please, use
+// the [NewRecordingConn] constructor.
+type RecordingConn struct {
+	FramingConn
+
+	// mu serializes writes to w.
+	mu sync.Mutex
+
+	// w is where we write the records.
+	w io.Writer
+}
+
+var _ FramingConn = &RecordingConn{}
+
+// NewRecordingConn returns a [RecordingConn] that wraps conn and writes
+// the records to w.
+func NewRecordingConn(conn FramingConn, w io.Writer) *RecordingConn {
+	return &RecordingConn{
+		FramingConn: conn,
+		mu:          sync.Mutex{},
+		w:           w,
+	}
+}
+
+// ReadRawPacket implements FramingConn
+func (c *RecordingConn) ReadRawPacket() ([]byte, error) {
+	pkt, err := c.FramingConn.ReadRawPacket()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.record(recordRead, pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// WriteRawPacket implements FramingConn
+func (c *RecordingConn) WriteRawPacket(pkt []byte) error {
+	if err := c.FramingConn.WriteRawPacket(pkt); err != nil {
+		return err
+	}
+	return c.record(recordWrite, pkt)
+}
+
+// record writes a record for the given direction and packet.
+func (c *RecordingConn) record(direction byte, pkt []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := make([]byte, 5)
+	header[0] = direction
+	binary.BigEndian.PutUint32(header[1:], uint32(len(pkt)))
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+	_, err := c.w.Write(pkt)
+	return err
+}
+
+// ReplayConn is a [FramingConn] that returns the packets read in a recording
+// produced by [RecordingConn]. Written packets are discarded. The zero value
+// is invalid; please, use the [NewReplayConn] constructor.
+type ReplayConn struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// closed is true after Close has been called.
+	closed bool
+
+	// network is the network we return for the addresses.
+	network string
+
+	// next is the index of the next read to return.
+	next int
+
+	// reads contains the recorded reads.
+	reads [][]byte
+
+	// writes contains the packets written to the conn.
+	writes [][]byte
+}
+
+var _ FramingConn = &ReplayConn{}
+
+// NewReplayConn parses the recording in r and returns a [ReplayConn] whose
+// addresses use the given network (e.g., "udp").
+func NewReplayConn(r io.Reader, network string) (*ReplayConn, error) {
+	conn := &ReplayConn{
+		mu:      sync.Mutex{},
+		network: network,
+	}
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return conn, nil
+			}
+			return nil, fmt.Errorf("%w: %s", ErrBadRecording, err)
+		}
+		pkt := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadRecording, err)
+		}
+		switch header[0] {
+		case recordRead:
+			conn.reads = append(conn.reads, pkt)
+		case recordWrite:
+			// we don't need to replay our own writes
+		default:
+			return nil, fmt.Errorf("%w: unknown direction: %d", ErrBadRecording, header[0])
+		}
+	}
+}
+
+// Seek sets the index of the next recorded read to return.
+func (c *ReplayConn) Seek(index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index < 0 || index > len(c.reads) {
+		return fmt.Errorf("%w: index out of range: %d", ErrBadRecording, index)
+	}
+	c.next = index
+	return nil
+}
+
+// Writes returns the packets that have been written to this conn.
+func (c *ReplayConn) Writes() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte{}, c.writes...)
+}
+
+// ReadRawPacket implements FramingConn. It returns [io.EOF] once all
+// the recorded reads have been returned.
+func (c *ReplayConn) ReadRawPacket() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if c.next >= len(c.reads) {
+		return nil, io.EOF
+	}
+	pkt := c.reads[c.next]
+	c.next++
+	return pkt, nil
+}
+
+// WriteRawPacket implements FramingConn
+func (c *ReplayConn) WriteRawPacket(pkt []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.writes = append(c.writes, pkt)
+	return nil
+}
+
+// SetReadDeadline implements FramingConn
+func (c *ReplayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline implements FramingConn
+func (c *ReplayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// LocalAddr implements FramingConn
+func (c *ReplayConn) LocalAddr() net.Addr {
+	return &replayAddr{c.network}
+}
+
+// RemoteAddr implements FramingConn
+func (c *ReplayConn) RemoteAddr() net.Addr {
+	return &replayAddr{c.network}
+}
+
+// Close implements FramingConn
+func (c *ReplayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// replayAddr is the type of address returned by [*ReplayConn].
+type replayAddr struct {
+	network string
+}
+
+var _ net.Addr = &replayAddr{}
+
+// Network implements net.Addr
+func (a *replayAddr) Network() string {
+	return a.network
+}
+
+// String implements net.Addr
+func (a *replayAddr) String() string {
+	return "replay"
+}
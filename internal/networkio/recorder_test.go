@@ -0,0 +1,120 @@
+package networkio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/apex/log"
+)
+
+func TestRecordingConn(t *testing.T) {
+	t.Run("reads and writes are recorded in order", func(t *testing.T) {
+		dataOut := [][]byte{[]byte("deadbeef")}
+		underlying := newMockedConn("udp", [][]byte{}, dataOut)
+		dialer := NewDialer(log.Log, newDialer(underlying))
+		framingConn, err := dialer.DialContext(context.Background(), "udp", "1.1.1.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recording := &bytes.Buffer{}
+		conn := NewRecordingConn(framingConn, recording)
+		if err := conn.WriteRawPacket([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.ReadRawPacket(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []byte{'>', 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o', '<', 0, 0, 0, 8, 'd', 'e', 'a', 'd', 'b', 'e', 'e', 'f'}
+		if !bytes.Equal(recording.Bytes(), want) {
+			t.Errorf("recording = %v, want %v", recording.Bytes(), want)
+		}
+	})
+}
+
+func TestReplayConn(t *testing.T) {
+	recording := []byte{
+		'<', 0, 0, 0, 3, 'o', 'n', 'e',
+		'>', 0, 0, 0, 2, 'h', 'i',
+		'<', 0, 0, 0, 3, 't', 'w', 'o',
+	}
+
+	t.Run("recorded reads are replayed in order", func(t *testing.T) {
+		conn, err := NewReplayConn(bytes.NewReader(recording), "udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"one", "two"} {
+			got, err := conn.ReadRawPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("ReadRawPacket() = %s, want %s", got, want)
+			}
+		}
+		if _, err := conn.ReadRawPacket(); !errors.Is(err, io.EOF) {
+			t.Errorf("ReadRawPacket() error = %v, want %v", err, io.EOF)
+		}
+	})
+
+	t.Run("seek allows to replay from a given read", func(t *testing.T) {
+		conn, err := NewReplayConn(bytes.NewReader(recording), "udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Seek(1); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := conn.ReadRawPacket()
+		if string(got) != "two" {
+			t.Errorf("ReadRawPacket() = %s, want two", got)
+		}
+		if err := conn.Seek(3); !errors.Is(err, ErrBadRecording) {
+			t.Errorf("Seek() error = %v, want %v", err, ErrBadRecording)
+		}
+	})
+
+	t.Run("writes are collected", func(t *testing.T) {
+		conn, err := NewReplayConn(bytes.NewReader(recording), "udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteRawPacket([]byte("abc"))
+		if writes := conn.Writes(); len(writes) != 1 || string(writes[0]) != "abc" {
+			t.Errorf("unexpected writes: %v", writes)
+		}
+		if conn.LocalAddr().Network() != "udp" {
+			t.Errorf("unexpected network: %s", conn.LocalAddr().Network())
+		}
+	})
+
+	t.Run("a closed conn fails", func(t *testing.T) {
+		conn, err := NewReplayConn(bytes.NewReader(recording), "udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if _, err := conn.ReadRawPacket(); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("a truncated recording fails", func(t *testing.T) {
+		_, err := NewReplayConn(bytes.NewReader(recording[:10]), "udp")
+		if !errors.Is(err, ErrBadRecording) {
+			t.Errorf("NewReplayConn() error = %v, want %v", err, ErrBadRecording)
+		}
+	})
+
+	t.Run("an unknown direction fails", func(t *testing.T) {
+		_, err := NewReplayConn(bytes.NewReader([]byte{'?', 0, 0, 0, 0}), "udp")
+		if !errors.Is(err, ErrBadRecording) {
+			t.Errorf("NewReplayConn() error = %v, want %v", err, ErrBadRecording)
+		}
+	})
+}
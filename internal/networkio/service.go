@@ -1,7 +1,9 @@
 package networkio
 
 import (
+	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/workers"
@@ -35,8 +37,10 @@ func (svc *Service) StartWorkers(
 		conn:           conn,
 		logger:         config.Logger(),
 		manager:        manager,
+		packetDumps:    config.PacketDumps(),
 		muxerToNetwork: svc.MuxerToNetwork,
 		networkToMuxer: *svc.NetworkToMuxer,
+		receiveSink:    config.ReceiveTimestampSink(),
 	}
 
 	manager.StartWorker(ws.moveUpWorker)
@@ -54,6 +58,9 @@ type workersState struct {
 	// manager controls the workers lifecycle
 	manager *workers.Manager
 
+	// packetDumps tells whether to log the hex dumps of the packets
+	packetDumps bool
+
 	// muxerToNetwork is the channel for reading outgoing packets
 	// that are coming down to us
 	muxerToNetwork <-chan []byte
@@ -61,6 +68,9 @@ type workersState struct {
 	// networkToMuxer is the channel for writing incoming packets
 	// that are coming up to us from the net
 	networkToMuxer chan<- []byte
+
+	// receiveSink, if set, receives each packet we read along with its arrival time
+	receiveSink func(time.Time, []byte)
 }
 
 // moveUpWorker moves packets up the stack.
@@ -84,6 +94,10 @@ func (ws *workersState) moveUpWorker() {
 			ws.logger.Debugf("%s: ReadRawPacket: %s", workerName, err.Error())
 			return
 		}
+		if ws.receiveSink != nil {
+			ws.receiveSink(time.Now(), pkt)
+		}
+		ws.dumpPacket("read", pkt)
 
 		// POSSIBLY BLOCK on the channel to deliver the packet
 		select {
@@ -112,6 +126,8 @@ func (ws *workersState) moveDownWorker() {
 		// POSSIBLY BLOCK when receiving from channel.
 		select {
 		case pkt := <-ws.muxerToNetwork:
+			ws.dumpPacket("write", pkt)
+
 			// POSSIBLY BLOCK on the connection to write the packet
 			if err := ws.conn.WriteRawPacket(pkt); err != nil {
 				ws.logger.Infof("%s: WriteRawPacket: %s", workerName, err.Error())
@@ -123,3 +139,10 @@ func (ws *workersState) moveDownWorker() {
 		}
 	}
 }
+
+// dumpPacket logs the hex dump of the packet if packet dumps are enabled.
+func (ws *workersState) dumpPacket(operation string, pkt []byte) {
+	if ws.packetDumps {
+		ws.logger.Debugf("%s: %s %d bytes\n%s", serviceName, operation, len(pkt), hex.Dump(pkt))
+	}
+}
@@ -3,9 +3,15 @@ package networkio
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/runtimex"
 	"github.com/ooni/minivpn/internal/workers"
 	"github.com/ooni/minivpn/pkg/config"
@@ -62,3 +68,108 @@ func TestService_StartStopWorkers(t *testing.T) {
 		t.Errorf("network writes do not match")
 	}
 }
+
+// lockedLogger is a [model.TestLogger] that the workers can use concurrently.
+type lockedLogger struct {
+	mu     sync.Mutex
+	logger *model.TestLogger
+}
+
+func (ll *lockedLogger) Debug(msg string) {
+	ll.Debugf("%s", msg)
+}
+
+func (ll *lockedLogger) Debugf(format string, v ...any) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	ll.logger.Debugf(format, v...)
+}
+
+func (ll *lockedLogger) Info(msg string)               {}
+func (ll *lockedLogger) Infof(format string, v ...any) {}
+func (ll *lockedLogger) Warn(msg string)               {}
+func (ll *lockedLogger) Warnf(format string, v ...any) {}
+
+func (ll *lockedLogger) lines() string {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return strings.Join(ll.logger.Lines, "\n")
+}
+
+// test that a high verbosity enables the hex dumps of the packets.
+func TestService_PacketDumps(t *testing.T) {
+	for _, verb := range []int{3, 9} {
+		t.Run(fmt.Sprintf("verb %d", verb), func(t *testing.T) {
+			logger := &lockedLogger{logger: model.NewTestLogger()}
+			workersManager := workers.NewManager(logger)
+
+			underlying := newMockedConn("udp", nil, [][]byte{[]byte("deadbeef")})
+			framingConn, err := NewDialer(logger, newDialer(underlying)).DialContext(
+				context.Background(), "udp", "1.1.1.1")
+			runtimex.PanicOnError(err, "should not error on getting new context")
+
+			muxerToNetwork := make(chan []byte, 1)
+			networkToMuxer := make(chan []byte, 1)
+			s := Service{
+				MuxerToNetwork: muxerToNetwork,
+				NetworkToMuxer: &networkToMuxer,
+			}
+			options := &config.OpenVPNOptions{Verb: verb, VerbSet: true}
+			s.StartWorkers(config.NewConfig(config.WithLogger(logger), config.WithOpenVPNOptions(options)),
+				workersManager, framingConn)
+			<-networkToMuxer
+			workersManager.StartShutdown()
+			workersManager.WaitWorkersShutdown()
+
+			dumped := strings.Contains(logger.lines(), hex.Dump([]byte("deadbeef")))
+			if wantDump := verb >= config.PacketDumpsVerb; dumped != wantDump {
+				t.Errorf("expected the packet dump: %v, got lines:\n%s", wantDump, logger.lines())
+			}
+		})
+	}
+}
+
+func TestService_ReceiveTimestampSink(t *testing.T) {
+	logger := &lockedLogger{logger: model.NewTestLogger()}
+	workersManager := workers.NewManager(logger)
+
+	packets := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	underlying := newMockedConn("udp", nil, packets)
+	framingConn, err := NewDialer(logger, newDialer(underlying)).DialContext(
+		context.Background(), "udp", "1.1.1.1")
+	runtimex.PanicOnError(err, "should not error on getting new context")
+
+	type arrival struct {
+		received time.Time
+		packet   string
+	}
+	arrivals := make(chan arrival, len(packets))
+	sink := func(received time.Time, packet []byte) {
+		arrivals <- arrival{received, string(packet)}
+	}
+
+	networkToMuxer := make(chan []byte, len(packets))
+	s := Service{
+		MuxerToNetwork: make(chan []byte),
+		NetworkToMuxer: &networkToMuxer,
+	}
+	s.StartWorkers(config.NewConfig(config.WithLogger(logger), config.WithReceiveTimestampSink(sink)),
+		workersManager, framingConn)
+	for range packets {
+		<-networkToMuxer
+	}
+	workersManager.StartShutdown()
+	workersManager.WaitWorkersShutdown()
+
+	var previous time.Time
+	for _, want := range packets {
+		got := <-arrivals
+		if got.packet != string(want) {
+			t.Errorf("got packet %q, want %q", got.packet, want)
+		}
+		if got.received.IsZero() || got.received.Before(previous) {
+			t.Errorf("timestamp %v is not after %v", got.received, previous)
+		}
+		previous = got.received
+	}
+}
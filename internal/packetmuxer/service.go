@@ -16,9 +16,15 @@ var (
 	serviceName = "packetmuxer"
 )
 
+// ErrHandshakeResetFailed indicates that the server did not answer any of our hard resets.
+var ErrHandshakeResetFailed = errors.New("hard reset failed")
+
 const (
 	// A sufficiently long wakup period to initialize a ticker with.
 	longWakeup = time.Hour * 24 * 30
+
+	// maxHardResetBackoff is the maximum wait between hard resets, in units of the interval.
+	maxHardResetBackoff = 8
 )
 
 // Service is the packetmuxer service. Make sure you initialize
@@ -55,9 +61,12 @@ func (s *Service) StartWorkers(
 	workersManager *workers.Manager,
 	sessionManager *session.Manager,
 ) {
+	hardResetInterval, hardResetAttempts := config.HardResetRetry()
 	ws := &workersState{
-		logger:    config.Logger(),
-		hardReset: s.HardReset,
+		logger:            config.Logger(),
+		hardReset:         s.HardReset,
+		hardResetInterval: hardResetInterval,
+		hardResetAttempts: hardResetAttempts,
 		// initialize to a sufficiently long time from now
 		hardResetTicker:      time.NewTicker(longWakeup),
 		notifyTLS:            *s.NotifyTLS,
@@ -88,6 +97,12 @@ type workersState struct {
 	// hardResetTicker is a channel to retry the initial send of hard reset packet.
 	hardResetTicker *time.Ticker
 
+	// hardResetInterval is how long we wait for the reply to the first hard reset.
+	hardResetInterval time.Duration
+
+	// hardResetAttempts is how many hard resets we send before giving up.
+	hardResetAttempts int
+
 	// notifyTLS is used to send notifications to the TLS service.
 	notifyTLS chan<- *model.Notification
 
@@ -138,6 +153,17 @@ func (ws *workersState) moveUpWorker() {
 			}
 
 		case <-ws.hardResetTicker.C:
+			// give up if the server did not answer any of our hard resets
+			if ws.hardResetCount >= ws.hardResetAttempts {
+				err := fmt.Errorf("%w: after %d attempts", ErrHandshakeResetFailed, ws.hardResetCount)
+				ws.logger.Warnf("%s: %s", workerName, err.Error())
+				select {
+				case ws.sessionManager.Failure <- err:
+				case <-ws.workersManager.ShouldShutdown():
+				}
+				return
+			}
+
 			// retry the hard reset, it probably was lost
 			if err := ws.startHardReset(); err != nil {
 				// error already logged
@@ -145,6 +171,8 @@ func (ws *workersState) moveUpWorker() {
 			}
 
 		case <-ws.hardReset:
+			// an explicit request starts a new round of attempts
+			ws.hardResetCount = 0
 			if err := ws.startHardReset(); err != nil {
 				// error already logged
 				return
@@ -172,7 +200,7 @@ func (ws *workersState) moveDownWorker() {
 		select {
 		case packet := <-ws.dataOrControlToMuxer:
 			// serialize the packet
-			rawPacket, err := packet.Bytes()
+			rawPacket, err := ws.serialize(packet)
 			if err != nil {
 				ws.logger.Warnf("%s: cannot serialize packet: %s", workerName, err.Error())
 				continue
@@ -208,14 +236,34 @@ func (ws *workersState) startHardReset() error {
 		return err
 	}
 
-	// resend if not received the server's reply in 2 seconds.
-	ws.hardResetTicker.Reset(time.Second * 2)
+	// resend if not received the server's reply in time, backing off after each attempt.
+	ws.hardResetTicker.Reset(ws.hardResetBackoff())
 
 	return nil
 }
 
+// hardResetBackoff returns how long to wait for the reply to the last hard reset we sent,
+// which doubles after each attempt up to maxHardResetBackoff times the interval.
+func (ws *workersState) hardResetBackoff() time.Duration {
+	factor := 1
+	for i := 1; i < ws.hardResetCount && factor < maxHardResetBackoff; i++ {
+		factor *= 2
+	}
+	return ws.hardResetInterval * time.Duration(factor)
+}
+
 // handleRawPacket is the code invoked to handle a raw packet.
 func (ws *workersState) handleRawPacket(rawPacket []byte) error {
+	// unwrap control packets if we're using tls-crypt-v2 or tls-auth
+	if wrapper := ws.sessionManager.TLSCrypt(); wrapper != nil && isControlChannelPacket(rawPacket) {
+		unwrapped, err := wrapper.Unwrap(rawPacket)
+		if err != nil {
+			ws.logger.Warnf("packetmuxer: moveUpWorker: Unwrap: %s", err.Error())
+			return nil // keep running
+		}
+		rawPacket = unwrapped
+	}
+
 	// make sense of the packet
 	packet, err := model.ParsePacket(rawPacket)
 	if err != nil {
@@ -296,7 +344,7 @@ func (ws *workersState) finishThreeWayHandshake(packet *model.Packet) error {
 // serializeAndEmit will write a serialized packet on the channel going down to the networkio layer.
 func (ws *workersState) serializeAndEmit(packet *model.Packet) error {
 	// serialize it
-	rawPacket, err := packet.Bytes()
+	rawPacket, err := ws.serialize(packet)
 	if err != nil {
 		return err
 	}
@@ -319,3 +367,27 @@ func (ws *workersState) serializeAndEmit(packet *model.Packet) error {
 	packet.Log(ws.logger, model.DirectionOutgoing)
 	return nil
 }
+
+// serialize serializes the packet, and wraps control packets if we're using tls-crypt-v2 or tls-auth.
+func (ws *workersState) serialize(packet *model.Packet) ([]byte, error) {
+	rawPacket, err := packet.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	wrapper := ws.sessionManager.TLSCrypt()
+	if wrapper == nil || packet.IsData() {
+		return rawPacket, nil
+	}
+	if packet.Opcode == model.P_CONTROL_HARD_RESET_CLIENT_V3 {
+		return wrapper.WrapHardReset(rawPacket)
+	}
+	return wrapper.Wrap(rawPacket)
+}
+
+// isControlChannelPacket returns true if the raw packet belongs to the control channel.
+func isControlChannelPacket(rawPacket []byte) bool {
+	if len(rawPacket) < 1 {
+		return false
+	}
+	return !model.Opcode(rawPacket[0] >> 3).IsData()
+}
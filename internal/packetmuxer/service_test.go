@@ -0,0 +1,198 @@
+package packetmuxer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/networkio"
+	"github.com/ooni/minivpn/internal/session"
+	"github.com/ooni/minivpn/internal/vpntest"
+	"github.com/ooni/minivpn/internal/workers"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+// makeServerHardReset returns a serialized HARD_RESET_SERVER_V2 packet.
+func makeServerHardReset(t *testing.T, remoteSessionID model.SessionID) []byte {
+	packet := model.NewPacket(model.P_CONTROL_HARD_RESET_SERVER_V2, 0, []byte{})
+	packet.LocalSessionID = model.SessionID{1, 2, 3, 4, 5, 6, 7, 8}
+	packet.RemoteSessionID = remoteSessionID
+	packet.ACKs = []model.PacketID{0}
+	raw, err := packet.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// newMockedFramingConn returns a FramingConn that returns the given raw packets
+// and then fails reading.
+func newMockedFramingConn(t *testing.T, packets [][]byte) networkio.FramingConn {
+	conn := &vpntest.Conn{
+		MockLocalAddr: func() net.Addr {
+			return &vpntest.Addr{
+				MockString:  func() string { return "1.2.3.4" },
+				MockNetwork: func() string { return "udp" },
+			}
+		},
+		MockRead: func(b []byte) (int, error) {
+			if len(packets) == 0 {
+				return 0, errors.New("EOF")
+			}
+			n := copy(b, packets[0])
+			packets = packets[1:]
+			return n, nil
+		},
+		MockWrite: func(b []byte) (int, error) {
+			return len(b), nil
+		},
+		MockClose: func() error {
+			return nil
+		},
+	}
+	dialer := networkio.NewDialer(log.Log, &vpntest.Dialer{
+		MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return conn, nil
+		},
+	})
+	framingConn, err := dialer.DialContext(context.Background(), "udp", "1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return framingConn
+}
+
+// runMuxerUntilShutdown runs the networkio and packetmuxer services over the given
+// conn until the conn has no more packets to read, and returns the session manager.
+func runMuxerUntilShutdown(t *testing.T, conn networkio.FramingConn) *session.Manager {
+	cfg := config.NewConfig(config.WithLogger(log.Log))
+	sessionManager, err := session.NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pretend that we've already sent the hard reset
+	sessionManager.SetNegotiationState(model.S_PRE_START)
+
+	workersManager := workers.NewManager(cfg.Logger())
+
+	muxerToNetwork := make(chan []byte)
+	networkToMuxer := make(chan []byte)
+	muxerToReliable := make(chan *model.Packet, 1)
+	muxerToData := make(chan *model.Packet, 1)
+	notifyTLS := make(chan *model.Notification, 1)
+
+	nio := &networkio.Service{
+		MuxerToNetwork: muxerToNetwork,
+		NetworkToMuxer: &networkToMuxer,
+	}
+	muxer := &Service{
+		HardReset:            make(chan any, 1),
+		NotifyTLS:            &notifyTLS,
+		MuxerToReliable:      &muxerToReliable,
+		MuxerToData:          &muxerToData,
+		DataOrControlToMuxer: make(chan *model.Packet),
+		MuxerToNetwork:       &muxerToNetwork,
+		NetworkToMuxer:       networkToMuxer,
+	}
+	nio.StartWorkers(cfg, workersManager, conn)
+	muxer.StartWorkers(cfg, workersManager, sessionManager)
+	workersManager.WaitWorkersShutdown()
+	return sessionManager
+}
+
+func TestService_ReplayHandshake(t *testing.T) {
+	ourSessionID := model.SessionID{0xa, 0xb, 0xc, 0xd, 0xe, 0xf, 0x1, 0x2}
+	hardReset := makeServerHardReset(t, ourSessionID)
+
+	// record the handshake with the mocked server
+	recording := &bytes.Buffer{}
+	recorder := networkio.NewRecordingConn(newMockedFramingConn(t, [][]byte{hardReset}), recording)
+	recorded := runMuxerUntilShutdown(t, recorder)
+
+	// replay the recording
+	replay, err := networkio.NewReplayConn(bytes.NewReader(recording.Bytes()), "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := runMuxerUntilShutdown(t, replay)
+
+	if recorded.NegotiationState() != model.S_START {
+		t.Errorf("unexpected recorded state: %v", recorded.NegotiationState())
+	}
+	if replayed.NegotiationState() != recorded.NegotiationState() {
+		t.Errorf("replayed state = %v, recorded state = %v",
+			replayed.NegotiationState(), recorded.NegotiationState())
+	}
+	if !bytes.Equal(replayed.RemoteSessionID(), recorded.RemoteSessionID()) {
+		t.Errorf("replayed remote session = %x, recorded = %x",
+			replayed.RemoteSessionID(), recorded.RemoteSessionID())
+	}
+}
+
+func TestService_hardResetAttempts(t *testing.T) {
+	const attempts = 3
+	cfg := config.NewConfig(
+		config.WithLogger(log.Log),
+		config.WithHardResetRetry(time.Millisecond, attempts),
+	)
+	sessionManager, err := session.NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workersManager := workers.NewManager(cfg.Logger())
+
+	// the server never answers our hard resets
+	muxerToNetwork := make(chan []byte)
+	muxerToReliable := make(chan *model.Packet, 1)
+	muxerToData := make(chan *model.Packet, 1)
+	notifyTLS := make(chan *model.Notification, 1)
+	muxer := &Service{
+		HardReset:            make(chan any, 1),
+		NotifyTLS:            &notifyTLS,
+		MuxerToReliable:      &muxerToReliable,
+		MuxerToData:          &muxerToData,
+		DataOrControlToMuxer: make(chan *model.Packet),
+		MuxerToNetwork:       &muxerToNetwork,
+		NetworkToMuxer:       make(chan []byte),
+	}
+	muxer.StartWorkers(cfg, workersManager, sessionManager)
+	defer func() {
+		workersManager.StartShutdown()
+		workersManager.WaitWorkersShutdown()
+	}()
+	muxer.HardReset <- true
+
+	var sent int
+	for {
+		select {
+		case <-muxerToNetwork:
+			sent++
+		case err := <-sessionManager.Failure:
+			if !errors.Is(err, ErrHandshakeResetFailed) {
+				t.Fatalf("expected %v, got %v", ErrHandshakeResetFailed, err)
+			}
+			if sent != attempts {
+				t.Fatalf("expected %d hard resets, got %d", attempts, sent)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the failure")
+		}
+	}
+}
+
+func Test_workersState_hardResetBackoff(t *testing.T) {
+	ws := &workersState{hardResetInterval: time.Second}
+	expect := []time.Duration{1, 1, 2, 4, 8, 8, 8}
+	for count, want := range expect {
+		ws.hardResetCount = count
+		if got := ws.hardResetBackoff(); got != want*time.Second {
+			t.Errorf("hardResetBackoff() with count %d = %v, want %v", count, got, want*time.Second)
+		}
+	}
+}
@@ -128,4 +128,10 @@ func (seq incomingSequence) Less(i, j int) bool {
 type incomingPacketSeen struct {
 	id   optional.Value[model.PacketID]
 	acks optional.Value[[]model.PacketID]
+
+	// keyID is the key ID of the packet, since the packet IDs are scoped to a key ID.
+	keyID uint8
+
+	// softReset tells that the packet is a soft reset, which starts a new key ID.
+	softReset bool
 }
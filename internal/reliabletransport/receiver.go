@@ -53,11 +53,51 @@ func (ws *workersState) moveUpWorker() {
 
 			// TODO(ainghazal): drop a packet that is a replay (id <= lastConsumed, but != ACK...?)
 
+			// a soft reset starts a new key, whose packet IDs restart from zero: we pass
+			// it up right away, so that the control channel starts the renegotiation
+			if packet.Opcode == model.P_CONTROL_SOFT_RESET_V1 {
+				if !receiver.maybeStartKey(packet.KeyID) {
+					ws.counters.duplicatesDropped.Add(1)
+					ws.logger.Debugf("Dropping duplicate soft reset for key id %d", packet.KeyID)
+					continue
+				}
+				select {
+				case ws.reliableToControl <- packet:
+				case <-ws.workersManager.ShouldShutdown():
+					return
+				}
+				continue
+			}
+
 			// we only want to insert control packets going to the tls layer
 			if packet.Opcode != model.P_CONTROL_V1 {
 				continue
 			}
 
+			// the packets of a previous key belong to a TLS session we do not use anymore
+			if packet.KeyID != receiver.keyID {
+				ws.tracer.OnDroppedPacket(
+					model.DirectionIncoming,
+					ws.sessionManager.NegotiationState(),
+					packet)
+				ws.logger.Debugf("Dropping packet %v for stale key id %d", packet.ID, packet.KeyID)
+				continue
+			}
+
+			// we have already acked it again, but we must not pass it up twice
+			if receiver.isDuplicate(packet) {
+				ws.counters.duplicatesDropped.Add(1)
+				ws.tracer.OnDroppedPacket(
+					model.DirectionIncoming,
+					ws.sessionManager.NegotiationState(),
+					packet)
+				ws.logger.Debugf("Dropping duplicate packet: %v", packet.ID)
+				continue
+			}
+			if receiver.isOutOfOrder(packet) {
+				ws.counters.outOfOrder.Add(1)
+			}
+
 			if inserted := receiver.MaybeInsertIncoming(packet); !inserted {
 				// this packet was not inserted in the queue: we drop it
 				// TODO: add reason
@@ -133,6 +173,9 @@ type reliableReceiver struct {
 
 	// lastConsumed is the last [model.PacketID] that we have passed to the control layer above us.
 	lastConsumed model.PacketID
+
+	// keyID is the key ID of the packets we pass to the control layer above us.
+	keyID uint8
 }
 
 func newReliableReceiver(logger model.Logger, ch chan incomingPacketSeen) *reliableReceiver {
@@ -144,6 +187,19 @@ func newReliableReceiver(logger model.Logger, ch chan incomingPacketSeen) *relia
 	}
 }
 
+// maybeStartKey starts receiving the packets of the given key ID, which a soft reset with
+// packet ID zero begins, and returns true, unless we are already using this key ID.
+func (r *reliableReceiver) maybeStartKey(keyID uint8) bool {
+	if keyID == r.keyID {
+		return false
+	}
+	r.logger.Debugf("reliabletransport: starting key id %d", keyID)
+	r.keyID = keyID
+	r.lastConsumed = 0
+	r.incomingPackets = make([]*model.Packet, 0)
+	return true
+}
+
 func (r *reliableReceiver) MaybeInsertIncoming(p *model.Packet) bool {
 	// we drop if at capacity, by default double the size of the outgoing buffer
 	if len(r.incomingPackets) >= RELIABLE_RECV_BUFFER_SIZE {
@@ -156,6 +212,25 @@ func (r *reliableReceiver) MaybeInsertIncoming(p *model.Packet) bool {
 	return true
 }
 
+// isDuplicate returns true if we have already passed the packet up, or if it is
+// already waiting in the incoming queue.
+func (r *reliableReceiver) isDuplicate(p *model.Packet) bool {
+	if p.ID <= r.lastConsumed {
+		return true
+	}
+	for _, queued := range r.incomingPackets {
+		if queued.ID == p.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// isOutOfOrder returns true if the packet is not the next one we expect.
+func (r *reliableReceiver) isOutOfOrder(p *model.Packet) bool {
+	return p.ID != r.lastConsumed+1
+}
+
 func (r *reliableReceiver) NextIncomingSequence() incomingSequence {
 	last := r.lastConsumed
 	ready := make([]*model.Packet, 0, RELIABLE_RECV_BUFFER_SIZE)
@@ -181,7 +256,10 @@ func (r *reliableReceiver) NextIncomingSequence() incomingSequence {
 }
 
 func (r *reliableReceiver) newIncomingPacketSeen(p *model.Packet) incomingPacketSeen {
-	incomingPacket := incomingPacketSeen{}
+	incomingPacket := incomingPacketSeen{
+		keyID:     p.KeyID,
+		softReset: p.Opcode == model.P_CONTROL_SOFT_RESET_V1,
+	}
 	if p.Opcode == model.P_ACK_V1 {
 		incomingPacket.acks = optional.Some(p.ACKs)
 	} else {
@@ -171,3 +171,35 @@ func Test_reliableQueue_NextIncomingSequence(t *testing.T) {
 		})
 	}
 }
+
+// test that a soft reset restarts the packet IDs we expect for the new key
+func Test_reliableReceiver_maybeStartKey(t *testing.T) {
+	rr := newReliableReceiver(log.Log, make(chan incomingPacketSeen))
+	rr.MaybeInsertIncoming(&model.Packet{ID: 1})
+	rr.MaybeInsertIncoming(&model.Packet{ID: 2})
+	rr.MaybeInsertIncoming(&model.Packet{ID: 5})
+	if ready := rr.NextIncomingSequence(); len(ready) != 2 {
+		t.Fatalf("expected two packets, got %d", len(ready))
+	}
+
+	if rr.maybeStartKey(0) {
+		t.Fatal("did not expect to start the key id we are using")
+	}
+	if !rr.maybeStartKey(1) {
+		t.Fatal("expected to start key id 1")
+	}
+	if rr.keyID != 1 || rr.lastConsumed != 0 || len(rr.incomingPackets) != 0 {
+		t.Fatalf("unexpected state: key id %d, last consumed %d, %d queued",
+			rr.keyID, rr.lastConsumed, len(rr.incomingPackets))
+	}
+
+	// the first control packet of the new key follows the soft reset with ID zero
+	p := &model.Packet{Opcode: model.P_CONTROL_V1, KeyID: 1, ID: 1}
+	if rr.isDuplicate(p) {
+		t.Fatal("the first packet of the new key is not a duplicate")
+	}
+	rr.MaybeInsertIncoming(p)
+	if ready := rr.NextIncomingSequence(); len(ready) != 1 || ready[0] != p {
+		t.Fatalf("expected the first packet of the new key, got %v", ready)
+	}
+}
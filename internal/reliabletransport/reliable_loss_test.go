@@ -272,3 +272,48 @@ func TestReliable_WithLoss(t *testing.T) {
 		})
 	}
 }
+
+// test that the sender counts the packets it has to send again because of losses.
+func TestReliable_StatsWithLoss(t *testing.T) {
+	s := &Service{}
+
+	dataIn := make(chan *model.Packet, 1024)
+	dataOut := make(chan *model.Packet, 1024)
+	s.ControlToReliable = dataIn
+	s.ReliableToControl = &dataOut
+
+	toMuxer := make(chan *model.Packet, 1024)
+	s.DataOrControlToMuxer = &toMuxer
+	toNetwork := make(chan *model.Packet, 1024)
+	fromMuxer := make(chan *model.Packet, 1024)
+	s.MuxerToReliable = fromMuxer
+
+	workers, session := initManagers()
+
+	echoServer := vpntest.NewEchoServer(toNetwork, fromMuxer)
+	echoServer.RemoteSessionID = model.SessionID(session.LocalSessionID())
+	session.SetRemoteSessionID(echoServer.LocalSessionID)
+
+	t0 := time.Now()
+	s.StartWorkers(config.NewConfig(config.WithLogger(log.Log)), workers, session)
+
+	writer := vpntest.NewPacketWriter(dataIn)
+	go writer.WriteSequenceWithFixedPayload([]string{"[1..3] CONTROL_V1 +10ms"}, "aaabbbccc", 3)
+
+	// the first packet is lost once
+	relay := vpntest.NewPacketRelay(toMuxer, toNetwork)
+	go relay.RelayWithLosses([]int{1})
+	defer relay.Stop()
+
+	go echoServer.Start()
+	defer echoServer.Stop()
+
+	witness := vpntest.NewWitnessFromChannel(dataOut)
+	if ok := witness.VerifyOrderedPayload("aaabbbccc", t0); !ok {
+		t.Fatalf("payload does not match. got=%s, want=%s", witness.Payload(), "aaabbbccc")
+	}
+
+	if got := s.Stats().Retransmits; got < 1 {
+		t.Errorf("Stats().Retransmits = %d, want at least 1", got)
+	}
+}
@@ -139,3 +139,44 @@ func TestReliable_Reordering_UP(t *testing.T) {
 		})
 	}
 }
+
+// test that the receiver counts the out-of-order and the duplicate packets it gets from the muxer.
+func TestReliable_StatsDuplicatesAndOutOfOrder(t *testing.T) {
+	s := &Service{}
+
+	// just to properly initialize it, we don't care about these
+	s.ControlToReliable = make(chan *model.Packet)
+	dataToMuxer := make(chan *model.Packet, 1024)
+	s.DataOrControlToMuxer = &dataToMuxer
+
+	dataIn := make(chan *model.Packet, 1024)
+	dataOut := make(chan *model.Packet, 1024)
+	s.MuxerToReliable = dataIn
+	s.ReliableToControl = &dataOut
+
+	workers, session := initManagers()
+	t0 := time.Now()
+	s.StartWorkers(config.NewConfig(config.WithLogger(log.Log)), workers, session)
+
+	writer := vpntest.NewPacketWriter(dataIn)
+	initializeSessionIDForWriter(writer, session)
+
+	// [2] is out of order, the second [1] and [2] are duplicates
+	go writer.WriteSequence([]string{
+		"[2] CONTROL_V1 +1ms",
+		"[1] CONTROL_V1 +1ms",
+		"[1] CONTROL_V1 +1ms",
+		"[2] CONTROL_V1 +1ms",
+		"[3] CONTROL_V1 +1ms",
+	})
+
+	reader := vpntest.NewPacketReader(dataOut)
+	if ok := reader.WaitForSequence([]int{1, 2, 3}, t0); !ok {
+		t.Fatalf("got = %v, want %v", reader.Log().IDSequence(), []int{1, 2, 3})
+	}
+
+	want := Stats{DuplicatesDropped: 2, OutOfOrder: 1}
+	if got := s.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
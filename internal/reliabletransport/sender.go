@@ -77,6 +77,9 @@ func (ws *workersState) blockOnTryingToSend(sender *reliableSender, ticker *time
 	if len(scheduledNow) > 0 {
 		// we flush everything that is ready to be sent.
 		for _, p := range scheduledNow {
+			if p.retries > 0 {
+				ws.counters.retransmits.Add(1)
+			}
 			p.ScheduleForRetransmission(now)
 
 			// append any pending ACKs
@@ -110,6 +113,8 @@ func (ws *workersState) blockOnTryingToSend(sender *reliableSender, ticker *time
 		ws.logger.Warnf("moveDownWorker: tryToSend: cannot create ack: %v", err.Error())
 		return
 	}
+	// the IDs we ack belong to the key we are sending
+	ACK.KeyID = sender.keyID
 	ACK.Log(ws.logger, model.DirectionOutgoing)
 	select {
 	case ws.dataOrControlToMuxer <- ACK:
@@ -132,6 +137,9 @@ type reliableSender struct {
 
 	// pendingACKsToSend is a set of packets that we still need to ACK.
 	pendingACKsToSend *ackSet
+
+	// keyID is the key ID of the packets in flight and of the packets we ACK.
+	keyID uint8
 }
 
 // newReliableSender returns a new instance of reliableOutgoing.
@@ -144,8 +152,23 @@ func newReliableSender(logger model.Logger, ch chan incomingPacketSeen) *reliabl
 	}
 }
 
+// maybeStartKey switches to the given key ID, if we are not using it already. Since the
+// packet IDs restart from zero with each key, we forget about the packets in flight and the
+// packets to ACK for the previous key, which belong to a TLS session we do not use anymore.
+func (r *reliableSender) maybeStartKey(keyID uint8) {
+	if keyID == r.keyID {
+		return
+	}
+	r.logger.Debugf("reliabletransport: sending with key id %d", keyID)
+	r.keyID = keyID
+	r.inFlight = make([]*inFlightPacket, 0, RELIABLE_SEND_BUFFER_SIZE)
+	r.pendingACKsToSend = newACKSet()
+}
+
 // implement outgoingPacketWriter
 func (r *reliableSender) TryInsertOutgoingPacket(p *model.Packet) bool {
+	// our own soft reset starts the new key
+	r.maybeStartKey(p.KeyID)
 	if len(r.inFlight) >= RELIABLE_SEND_BUFFER_SIZE {
 		r.logger.Warn("outgoing array full, dropping packet")
 		return false
@@ -156,6 +179,15 @@ func (r *reliableSender) TryInsertOutgoingPacket(p *model.Packet) bool {
 
 // OnIncomingPacketSeen implements seenPacketHandler
 func (r *reliableSender) OnIncomingPacketSeen(seen incomingPacketSeen) {
+	// a soft reset from the remote starts a new key, and we ignore the other packets of
+	// the previous keys, since their IDs would clash with the ones of the current key
+	if seen.softReset {
+		r.maybeStartKey(seen.keyID)
+	}
+	if seen.keyID != r.keyID {
+		return
+	}
+
 	// we have received an incomingPacketSeen on the shared channel, we need to do two things:
 
 	// 1. add the ID to the set of packets to be acknowledged.
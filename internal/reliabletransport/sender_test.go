@@ -649,3 +649,45 @@ func Test_ackSet_nextToACK_empties_set(t *testing.T) {
 		t.Errorf("ackSet.nextToACK() = %v, want %v", got, want3)
 	}
 }
+
+// test that a new key resets the packets in flight and the packets to ACK
+func Test_reliableSender_maybeStartKey(t *testing.T) {
+	t.Run("a soft reset from the remote starts the new key", func(t *testing.T) {
+		s := newReliableSender(log.Log, make(chan incomingPacketSeen))
+		s.TryInsertOutgoingPacket(&model.Packet{ID: 7})
+		s.OnIncomingPacketSeen(incomingPacketSeen{id: optional.Some(model.PacketID(9))})
+
+		s.OnIncomingPacketSeen(incomingPacketSeen{
+			id:        optional.Some(model.PacketID(0)),
+			acks:      optional.Some([]model.PacketID{}),
+			keyID:     1,
+			softReset: true,
+		})
+		if s.keyID != 1 || len(s.inFlight) != 0 {
+			t.Fatalf("unexpected state: key id %d, %d in flight", s.keyID, len(s.inFlight))
+		}
+		if got := s.NextPacketIDsToACK(); !slices.Equal(got, []model.PacketID{0}) {
+			t.Fatalf("expected to ACK the soft reset only, got %v", got)
+		}
+
+		// the ACKs for the previous key must not evict the packets of the new key
+		s.TryInsertOutgoingPacket(&model.Packet{KeyID: 1, ID: 0})
+		s.OnIncomingPacketSeen(incomingPacketSeen{acks: optional.Some([]model.PacketID{0})})
+		if len(s.inFlight) != 1 {
+			t.Fatalf("expected one packet in flight, got %d", len(s.inFlight))
+		}
+		s.OnIncomingPacketSeen(incomingPacketSeen{acks: optional.Some([]model.PacketID{0}), keyID: 1})
+		if len(s.inFlight) != 0 {
+			t.Fatalf("expected no packets in flight, got %d", len(s.inFlight))
+		}
+	})
+
+	t.Run("our own soft reset starts the new key", func(t *testing.T) {
+		s := newReliableSender(log.Log, make(chan incomingPacketSeen))
+		s.TryInsertOutgoingPacket(&model.Packet{ID: 7})
+		s.TryInsertOutgoingPacket(&model.Packet{Opcode: model.P_CONTROL_SOFT_RESET_V1, KeyID: 1, ID: 0})
+		if s.keyID != 1 || len(s.inFlight) != 1 || s.inFlight[0].packet.ID != 0 {
+			t.Fatalf("unexpected state: key id %d, %d in flight", s.keyID, len(s.inFlight))
+		}
+	})
+}
@@ -1,6 +1,8 @@
 package reliabletransport
 
 import (
+	"sync/atomic"
+
 	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/session"
 	"github.com/ooni/minivpn/internal/workers"
@@ -25,6 +27,42 @@ type Service struct {
 
 	// ReliableToControl moves packets up from us to the control layer above
 	ReliableToControl *chan *model.Packet
+
+	// counters are updated by the workers and read by [Service.Stats].
+	counters counters
+}
+
+// Stats contains the reliability counters of the control channel, which are
+// useful to debug lossy links.
+type Stats struct {
+	// Retransmits is the number of control packets we sent again because
+	// they were not acknowledged in time.
+	Retransmits int64
+
+	// DuplicatesDropped is the number of incoming control packets we dropped
+	// because we had already received them.
+	DuplicatesDropped int64
+
+	// OutOfOrder is the number of incoming control packets that arrived before
+	// a packet with a lower ID.
+	OutOfOrder int64
+}
+
+// counters holds the atomic counters backing [Stats].
+type counters struct {
+	retransmits       atomic.Int64
+	duplicatesDropped atomic.Int64
+	outOfOrder        atomic.Int64
+}
+
+// Stats returns a snapshot of the reliability counters. It is safe to call
+// it concurrently with the workers.
+func (s *Service) Stats() Stats {
+	return Stats{
+		Retransmits:       s.counters.retransmits.Load(),
+		DuplicatesDropped: s.counters.duplicatesDropped.Load(),
+		OutOfOrder:        s.counters.outOfOrder.Load(),
+	}
 }
 
 // StartWorkers starts the reliable-transport workers. See the [ARCHITECTURE]
@@ -40,6 +78,7 @@ func (s *Service) StartWorkers(
 	// processing in the sender goroutine.
 	ws := &workersState{
 		controlToReliable:    s.ControlToReliable,
+		counters:             &s.counters,
 		dataOrControlToMuxer: *s.DataOrControlToMuxer,
 		incomingSeen:         make(chan incomingPacketSeen, 100),
 		logger:               config.Logger(),
@@ -58,6 +97,9 @@ type workersState struct {
 	// controlToReliable is the channel from which we read packets going down the stack.
 	controlToReliable <-chan *model.Packet
 
+	// counters are the service reliability counters.
+	counters *counters
+
 	// dataOrControlToMuxer is the channel where we write packets going down the stack.
 	dataOrControlToMuxer chan<- *model.Packet
 
@@ -18,8 +18,8 @@ var (
 // The setup of the keys for a given data channel (that is, for every key_id)
 // is made by expanding the keysources using the prf function.
 //
-// Do note that we are not yet implementing key renegotiation - but the index
-// is provided for convenience when/if we support that in the future.
+// When the server sends a soft reset, we negotiate a new dataChannelKey for the
+// key_id it chooses. See [Manager.StartRenegotiation].
 type DataChannelKey struct {
 	index  uint32
 	ready  bool
@@ -59,6 +59,17 @@ func (dck *DataChannelKey) AddLocalKey(k *KeySource) error {
 	return nil
 }
 
+// Wipe overwrites both the local and the remote [KeySource] with zeroes.
+func (dck *DataChannelKey) Wipe() {
+	dck.mu.Lock()
+	defer dck.mu.Unlock()
+	for _, k := range []*KeySource{dck.local, dck.remote} {
+		if k != nil {
+			k.Wipe()
+		}
+	}
+}
+
 // Ready returns whether the [DataChannelKey] is ready.
 func (dck *DataChannelKey) Ready() bool {
 	dck.mu.Lock()
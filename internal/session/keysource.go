@@ -19,6 +19,41 @@ type KeySource struct {
 	R1        [32]byte
 	R2        [32]byte
 	PreMaster [48]byte
+
+	// Method1 contains the keys exchanged when using key-method 1. It is
+	// nil when we're using key-method 2.
+	Method1 *KeyMaterial
+}
+
+// KeyMaterial contains the cipher and hmac keys that each peer generates and sends to
+// the other peer when using key-method 1. Each peer encrypts with the keys it
+// has generated, and decrypts with the keys received from the other peer.
+type KeyMaterial struct {
+	Cipher [64]byte
+	HMAC   [64]byte
+}
+
+// Wipe overwrites the [KeyMaterial] with zeroes.
+func (km *KeyMaterial) Wipe() {
+	km.Cipher = [64]byte{}
+	km.HMAC = [64]byte{}
+}
+
+// NewKeyMaterial constructs a new random [KeyMaterial].
+func NewKeyMaterial() (*KeyMaterial, error) {
+	return newKeyMaterial(randomFn)
+}
+
+// newKeyMaterial is like [NewKeyMaterial] but uses the given random function.
+func newKeyMaterial(randomFn func(int) ([]byte, error)) (*KeyMaterial, error) {
+	random, err := randomFn(128)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errRandomBytes, err.Error())
+	}
+	km := &KeyMaterial{}
+	copy(km.Cipher[:], random[:64])
+	copy(km.HMAC[:], random[64:])
+	return km, nil
 }
 
 // Bytes returns the byte representation of a [KeySource].
@@ -30,8 +65,24 @@ func (k *KeySource) Bytes() []byte {
 	return buf.Bytes()
 }
 
+// Wipe overwrites the random material of the [KeySource] with zeroes. Once the data
+// channel keys have been derived, we don't need the [KeySource] anymore.
+func (k *KeySource) Wipe() {
+	k.R1 = [32]byte{}
+	k.R2 = [32]byte{}
+	k.PreMaster = [48]byte{}
+	if k.Method1 != nil {
+		k.Method1.Wipe()
+	}
+}
+
 // NewKeySource constructs a new [KeySource].
 func NewKeySource() (*KeySource, error) {
+	return newKeySource(randomFn)
+}
+
+// newKeySource is like [NewKeySource] but uses the given random function.
+func newKeySource(randomFn func(int) ([]byte, error)) (*KeySource, error) {
 	random1, err := randomFn(32)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", errRandomBytes, err.Error())
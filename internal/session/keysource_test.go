@@ -2,6 +2,7 @@ package session
 
 import (
 	"bytes"
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -52,7 +53,7 @@ func TestNewKeySource(t *testing.T) {
 	}
 
 	r1, r2, premaster := makeTestKeys()
-	ks := &KeySource{r1, r2, premaster}
+	ks := &KeySource{R1: r1, R2: r2, PreMaster: premaster}
 
 	tests := []struct {
 		name string
@@ -110,3 +111,38 @@ func Test_keySource_Bytes(t *testing.T) {
 		})
 	}
 }
+
+func TestNewKeyMaterial(t *testing.T) {
+	defer func(orig func(int) ([]byte, error)) {
+		randomFn = orig
+	}(randomFn)
+
+	t.Run("the random bytes are split into cipher and hmac keys", func(t *testing.T) {
+		randomFn = func(size int) ([]byte, error) {
+			out := make([]byte, size)
+			for i := range out {
+				out[i] = byte(i)
+			}
+			return out, nil
+		}
+		km, err := NewKeyMaterial()
+		if err != nil {
+			t.Fatalf("NewKeyMaterial() error = %v", err)
+		}
+		if km.Cipher[0] != 0 || km.Cipher[63] != 63 {
+			t.Errorf("unexpected cipher key: %x", km.Cipher)
+		}
+		if km.HMAC[0] != 64 || km.HMAC[63] != 127 {
+			t.Errorf("unexpected hmac key: %x", km.HMAC)
+		}
+	})
+
+	t.Run("random failure is propagated", func(t *testing.T) {
+		randomFn = func(int) ([]byte, error) {
+			return nil, errors.New("mocked error")
+		}
+		if _, err := NewKeyMaterial(); !errors.Is(err, errRandomBytes) {
+			t.Errorf("NewKeyMaterial() error = %v, want %v", err, errRandomBytes)
+		}
+	})
+}
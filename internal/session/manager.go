@@ -8,10 +8,13 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/ooni/minivpn/internal/bytesx"
 	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/optional"
 	"github.com/ooni/minivpn/internal/runtimex"
+	"github.com/ooni/minivpn/internal/tlscrypt"
 	"github.com/ooni/minivpn/pkg/config"
+	"golang.org/x/exp/slices"
 )
 
 var (
@@ -25,6 +28,8 @@ var (
 // Manager manages the session. The zero value is invalid. Please, construct
 // using [NewManager]. This struct is concurrency safe.
 type Manager struct {
+	authToken            string
+	dataKeyID            uint8
 	keyID                uint8
 	keys                 []*DataChannelKey
 	localControlPacketID model.PacketID
@@ -36,6 +41,20 @@ type Manager struct {
 	remoteSessionID      optional.Value[model.SessionID]
 	tunnelInfo           model.TunnelInfo
 	tracer               model.HandshakeTracer
+	tlsCrypt             tlscrypt.ControlWrapper
+	tlsCryptV2           bool
+
+	// newLocalKey generates the local key source for a new key slot.
+	newLocalKey func() (*KeySource, error)
+
+	// readyOnce ensures we signal Ready only for the first key, not for renegotiations.
+	readyOnce sync.Once
+
+	// setConnectionState reports the high-level connection state to the config.
+	setConnectionState func(model.ConnectionState)
+
+	// reportProgress reports the handshake milestones to the config.
+	reportProgress func(model.ProgressStage)
 
 	// Ready is a channel where we signal that we can start accepting data, because we've
 	// successfully generated key material for the data channel.
@@ -60,6 +79,8 @@ func NewManager(config *config.Config) (*Manager, error) {
 		remoteSessionID:      optional.None[model.SessionID](),
 		tunnelInfo:           model.TunnelInfo{},
 		tracer:               config.Tracer(),
+		setConnectionState:   config.SetConnectionState,
+		reportProgress:       config.ReportProgress,
 
 		// empirically, it seems that the reference OpenVPN server misbehaves if we initialize
 		// the data packet ID counter to zero.
@@ -69,14 +90,52 @@ func NewManager(config *config.Config) (*Manager, error) {
 		Failure: make(chan error),
 	}
 
-	randomBytes, err := randomFn(8)
+	if key := config.OpenVPNOptions().TLSCryptV2; len(key) > 0 {
+		clientKey, err := tlscrypt.ParseClientKey(key)
+		if err != nil {
+			return sessionManager, err
+		}
+		sessionManager.tlsCrypt = tlscrypt.NewWrapper(clientKey)
+		sessionManager.tlsCryptV2 = true
+	} else if key := config.OpenVPNOptions().TLSAuth; len(key) > 0 {
+		wrapper, err := newTLSAuthWrapper(key, config.OpenVPNOptions())
+		if err != nil {
+			return sessionManager, err
+		}
+		sessionManager.tlsCrypt = wrapper
+	}
+
+	random := randomFn
+	if source := config.RandomSource(); source != nil {
+		sessionManager.logger.Warn("session: using a custom random source instead of crypto/rand")
+		random = func(size int) ([]byte, error) {
+			return bytesx.ReadRandomBytes(source, size)
+		}
+	}
+
+	randomBytes, err := random(8)
 	if err != nil {
 		return sessionManager, err
 	}
 
 	sessionManager.localSessionID = (model.SessionID)(randomBytes[:8])
 
-	localKey, err := NewKeySource()
+	keyMethod1 := config.OpenVPNOptions().KeyMethod == 1
+	sessionManager.newLocalKey = func() (*KeySource, error) {
+		localKey, err := newKeySource(random)
+		if err != nil {
+			return nil, err
+		}
+		if keyMethod1 {
+			localKey.Method1, err = newKeyMaterial(random)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return localKey, nil
+	}
+
+	localKey, err := sessionManager.newLocalKey()
 	if err != nil {
 		return sessionManager, err
 	}
@@ -166,8 +225,13 @@ func (m *Manager) NewPacket(opcode model.Opcode, payload []byte) (*model.Packet,
 // its packet ID. Normally retransmission is handled at the reliabletransport layer,
 // but we send hard resets at the muxer.
 func (m *Manager) NewHardResetPacket() *model.Packet {
+	opcode := model.P_CONTROL_HARD_RESET_CLIENT_V2
+	if m.tlsCryptV2 {
+		// with tls-crypt-v2 we need to send the WKc along with the hard reset
+		opcode = model.P_CONTROL_HARD_RESET_CLIENT_V3
+	}
 	packet := model.NewPacket(
-		model.P_CONTROL_HARD_RESET_CLIENT_V2,
+		opcode,
 		m.keyID,
 		[]byte{},
 	)
@@ -217,23 +281,103 @@ func (m *Manager) NegotiationState() model.NegotiationState {
 	return m.negState
 }
 
+// connectionStates maps the negotiation states that begin a phase of the
+// connection lifecycle to the corresponding connection state.
+var connectionStates = map[model.NegotiationState]model.ConnectionState{
+	model.S_PRE_START:      model.ConnectionConnecting,
+	model.S_START:          model.ConnectionAuthenticating,
+	model.S_GENERATED_KEYS: model.ConnectionConnected,
+}
+
+// progressStages maps the negotiation states that are milestones of the handshake
+// to the corresponding progress stage. See also [Manager.ReportProgress].
+var progressStages = map[model.NegotiationState]model.ProgressStage{
+	model.S_START:   model.ProgressResetAcked,
+	model.S_GOT_KEY: model.ProgressKeysReady,
+}
+
+// ReportProgress reports a handshake milestone that is not a negotiation state change.
+func (m *Manager) ReportProgress(stage model.ProgressStage) {
+	m.reportProgress(stage)
+}
+
 // SetNegotiationState sets the state of the negotiation.
 func (m *Manager) SetNegotiationState(sns model.NegotiationState) {
-	defer m.mu.Unlock()
 	m.mu.Lock()
 	m.logger.Infof("[@] %s -> %s", m.negState, sns)
 	m.tracer.OnStateChange(sns)
 	m.negState = sns
+	m.mu.Unlock()
+
+	// we report the connection state without holding the lock, so that the
+	// callback can safely query the tunnel (e.g., to get the tunnel IP).
+	if state, found := connectionStates[sns]; found {
+		m.setConnectionState(state)
+	}
+	if stage, found := progressStages[sns]; found {
+		m.reportProgress(stage)
+	}
 	if sns == model.S_GENERATED_KEYS {
-		m.Ready <- true
+		m.PromoteKey()
+		m.readyOnce.Do(func() {
+			m.Ready <- true
+		})
+	}
+}
+
+// PromoteKey starts using the key we have just negotiated for the data channel. Since
+// data packet IDs are scoped to the key, we restart them when the key changes. We call it
+// when reaching [model.S_GENERATED_KEYS], but the data channel calls it as well while it
+// installs the new keys, so that it never uses the new keys with the old key ID.
+func (m *Manager) PromoteKey() {
+	defer m.mu.Unlock()
+	m.mu.Lock()
+	if m.dataKeyID != m.keyID {
+		m.dataKeyID = m.keyID
+		m.localDataPacketID = 1
 	}
 }
 
-// ActiveKey returns the dataChannelKey that is actively being used.
+// maxKeyID is the largest key ID, which must fit into the three bits of the opcode byte.
+const maxKeyID = 7
+
+// StartRenegotiation creates a new key slot with fresh local key material for the given
+// key ID, which the server chooses when it sends us a soft reset. The control channel uses
+// the new key ID from now on, and its packet IDs restart from zero, which is the ID of the
+// soft reset we send back. The data channel keeps using the current keys until we reach
+// [model.S_GENERATED_KEYS] again. Key ID zero is reserved to the first key, and we refuse
+// to renegotiate the key ID we are already using.
+func (m *Manager) StartRenegotiation(keyID uint8) error {
+	if keyID == 0 || keyID > maxKeyID {
+		return fmt.Errorf("%w: invalid key id %d", ErrDataChannelKey, keyID)
+	}
+	localKey, err := m.newLocalKey()
+	if err != nil {
+		return err
+	}
+	dck := &DataChannelKey{index: uint32(keyID)}
+	dck.AddLocalKey(localKey)
+
+	defer m.mu.Unlock()
+	m.mu.Lock()
+	if keyID == m.keyID {
+		return fmt.Errorf("%w: key id %d already in use", ErrDataChannelKey, keyID)
+	}
+	for len(m.keys) <= int(keyID) {
+		m.keys = append(m.keys, nil)
+	}
+	m.keys[keyID] = dck
+	m.keyID = keyID
+	m.localControlPacketID = 0
+	return nil
+}
+
+// ActiveKey returns the dataChannelKey that is actively being used, which, during a
+// renegotiation, is the one we are negotiating.
 func (m *Manager) ActiveKey() (*DataChannelKey, error) {
 	defer m.mu.Unlock()
 	m.mu.Lock()
-	if len(m.keys) > math.MaxUint8 || m.keyID >= uint8(len(m.keys)) {
+	if len(m.keys) > math.MaxUint8 || m.keyID >= uint8(len(m.keys)) || m.keys[m.keyID] == nil {
 		return nil, fmt.Errorf("%w: %s", ErrDataChannelKey, "no such key id")
 	}
 	dck := m.keys[m.keyID]
@@ -248,8 +392,16 @@ func (m *Manager) SetRemoteSessionID(remoteSessionID model.SessionID) {
 	m.remoteSessionID = optional.Some(remoteSessionID)
 }
 
-// CurrentKeyID returns the key ID currently in use.
+// CurrentKeyID returns the key ID currently in use by the data channel.
 func (m *Manager) CurrentKeyID() uint8 {
+	defer m.mu.Unlock()
+	m.mu.Lock()
+	return m.dataKeyID
+}
+
+// NegotiationKeyID returns the key ID used by the control channel, which differs from
+// [Manager.CurrentKeyID] while we renegotiate the keys.
+func (m *Manager) NegotiationKeyID() uint8 {
 	defer m.mu.Unlock()
 	m.mu.Lock()
 	return m.keyID
@@ -297,24 +449,96 @@ func (m *Manager) UpdateTunnelInfo(ti *model.TunnelInfo) {
 	m.mu.Lock()
 
 	m.tunnelInfo.IP = ti.IP
+	m.tunnelInfo.IPv6 = ti.IPv6
 	m.tunnelInfo.GW = ti.GW
 	m.tunnelInfo.PeerID = ti.PeerID
+	m.tunnelInfo.Cipher = ti.Cipher
 	m.tunnelInfo.NetMask = ti.NetMask
+	m.tunnelInfo.Topology = ti.Topology
+	m.tunnelInfo.RedirectGateway = ti.RedirectGateway
+	m.tunnelInfo.RedirectGatewayFlags = ti.RedirectGatewayFlags
+	m.tunnelInfo.BlockOutsideDNS = ti.BlockOutsideDNS
+	m.tunnelInfo.Routes = append([]model.Route{}, ti.Routes...)
+	m.tunnelInfo.DNS = append([]string{}, ti.DNS...)
+	m.tunnelInfo.Ping = ti.Ping
+	m.tunnelInfo.PingRestart = ti.PingRestart
 
 	m.logger.Infof("Tunnel IP: %s", ti.IP)
 	m.logger.Infof("Gateway IP: %s", ti.GW)
 	m.logger.Infof("Peer ID: %d", ti.PeerID)
 }
 
+// AuthToken returns the auth-token pushed by the server, or an empty string.
+func (m *Manager) AuthToken() string {
+	defer m.mu.Unlock()
+	m.mu.Lock()
+	return m.authToken
+}
+
+// SetAuthToken sets the auth-token pushed by the server. Once set, the token
+// replaces the password in the subsequent renegotiations.
+func (m *Manager) SetAuthToken(token string) {
+	defer m.mu.Unlock()
+	m.mu.Lock()
+	m.authToken = token
+}
+
+// ErrBadTLSAuth indicates that we cannot use the configured tls-auth key.
+var ErrBadTLSAuth = errors.New("cannot use tls-auth")
+
+// newTLSAuthWrapper returns the [tlscrypt.AuthWrapper] for the configured tls-auth key. Like
+// the reference implementation, the HMAC uses the digest of the auth option (SHA1 by default).
+func newTLSAuthWrapper(data []byte, opt *config.OpenVPNOptions) (*tlscrypt.AuthWrapper, error) {
+	key, err := tlscrypt.ParseStaticKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadTLSAuth, err)
+	}
+	digest := opt.Auth
+	if digest == "" {
+		digest = "SHA1"
+	}
+	idx := slices.IndexFunc(model.DataAuths, func(auth model.DataAuth) bool {
+		return strings.EqualFold(auth.Name, digest)
+	})
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: unsupported auth: %s", ErrBadTLSAuth, digest)
+	}
+	direction := tlscrypt.KeyDirectionBidirectional
+	switch opt.KeyDirection {
+	case config.KeyDirectionNormal:
+		direction = tlscrypt.KeyDirectionNormal
+	case config.KeyDirectionInverse:
+		direction = tlscrypt.KeyDirectionInverse
+	}
+	return tlscrypt.NewAuthWrapper(key, direction, model.DataAuths[idx].New), nil
+}
+
+// TLSCrypt returns the [tlscrypt.ControlWrapper] for the control channel packets, or nil
+// if we're using neither tls-crypt-v2 nor tls-auth.
+func (m *Manager) TLSCrypt() tlscrypt.ControlWrapper {
+	return m.tlsCrypt
+}
+
 // TunnelInfo returns a copy the current TunnelInfo
 func (m *Manager) TunnelInfo() model.TunnelInfo {
 	defer m.mu.Unlock()
 	m.mu.Lock()
 	return model.TunnelInfo{
-		GW:      m.tunnelInfo.GW,
-		IP:      m.tunnelInfo.IP,
-		MTU:     m.tunnelInfo.MTU,
-		NetMask: m.tunnelInfo.NetMask,
-		PeerID:  m.tunnelInfo.PeerID,
+		GW:       m.tunnelInfo.GW,
+		IP:       m.tunnelInfo.IP,
+		IPv6:     m.tunnelInfo.IPv6,
+		MTU:      m.tunnelInfo.MTU,
+		NetMask:  m.tunnelInfo.NetMask,
+		Topology: m.tunnelInfo.Topology,
+		PeerID:   m.tunnelInfo.PeerID,
+		Cipher:   m.tunnelInfo.Cipher,
+
+		RedirectGateway:      m.tunnelInfo.RedirectGateway,
+		RedirectGatewayFlags: m.tunnelInfo.RedirectGatewayFlags,
+		BlockOutsideDNS:      m.tunnelInfo.BlockOutsideDNS,
+		Routes:               append([]model.Route{}, m.tunnelInfo.Routes...),
+		DNS:                  append([]string{}, m.tunnelInfo.DNS...),
+		Ping:                 m.tunnelInfo.Ping,
+		PingRestart:          m.tunnelInfo.PingRestart,
 	}
 }
@@ -0,0 +1,242 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	mathrand "math/rand"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/tlscrypt"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+// makeTestingTLSCryptV2Key returns a PEM-encoded tls-crypt-v2 client key with a dummy WKc.
+func makeTestingTLSCryptV2Key() []byte {
+	raw := make([]byte, 256+16)
+	binary.BigEndian.PutUint16(raw[len(raw)-2:], 16)
+	return pem.EncodeToMemory(&pem.Block{Type: "OpenVPN tls-crypt-v2 client key", Bytes: raw})
+}
+
+// makeTestingTLSAuthKey returns a hex-encoded tls-auth static key.
+func makeTestingTLSAuthKey() []byte {
+	return []byte("-----BEGIN OpenVPN Static key V1-----\n" + strings.Repeat("ab", 256) +
+		"\n-----END OpenVPN Static key V1-----\n")
+}
+
+func TestManager_NewHardResetPacket(t *testing.T) {
+	t.Run("without tls-crypt-v2 we send a HARD_RESET_CLIENT_V2", func(t *testing.T) {
+		m, err := NewManager(config.NewConfig(config.WithLogger(model.NewTestLogger())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.TLSCrypt() != nil {
+			t.Fatal("expected nil tls-crypt wrapper")
+		}
+		packet := m.NewHardResetPacket()
+		if packet.Opcode != model.P_CONTROL_HARD_RESET_CLIENT_V2 {
+			t.Errorf("unexpected opcode: %v", packet.Opcode)
+		}
+	})
+
+	t.Run("with tls-crypt-v2 we send a HARD_RESET_CLIENT_V3", func(t *testing.T) {
+		m, err := NewManager(config.NewConfig(
+			config.WithLogger(model.NewTestLogger()),
+			config.WithOpenVPNOptions(&config.OpenVPNOptions{TLSCryptV2: makeTestingTLSCryptV2Key()}),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.TLSCrypt() == nil {
+			t.Fatal("expected a tls-crypt wrapper")
+		}
+		packet := m.NewHardResetPacket()
+		if packet.Opcode != model.P_CONTROL_HARD_RESET_CLIENT_V3 {
+			t.Errorf("unexpected opcode: %v", packet.Opcode)
+		}
+	})
+
+	t.Run("with tls-auth we send a HARD_RESET_CLIENT_V2", func(t *testing.T) {
+		m, err := NewManager(config.NewConfig(
+			config.WithLogger(model.NewTestLogger()),
+			config.WithOpenVPNOptions(&config.OpenVPNOptions{
+				TLSAuth:      makeTestingTLSAuthKey(),
+				KeyDirection: config.KeyDirectionInverse,
+				Auth:         "SHA512",
+			}),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.TLSCrypt().(*tlscrypt.AuthWrapper); !ok {
+			t.Fatalf("expected a tls-auth wrapper, got %T", m.TLSCrypt())
+		}
+		packet := m.NewHardResetPacket()
+		if packet.Opcode != model.P_CONTROL_HARD_RESET_CLIENT_V2 {
+			t.Errorf("unexpected opcode: %v", packet.Opcode)
+		}
+	})
+
+	t.Run("a bad tls-auth key fails", func(t *testing.T) {
+		_, err := NewManager(config.NewConfig(
+			config.WithLogger(model.NewTestLogger()),
+			config.WithOpenVPNOptions(&config.OpenVPNOptions{TLSAuth: []byte("garbage")}),
+		))
+		if !errors.Is(err, ErrBadTLSAuth) {
+			t.Errorf("NewManager() error = %v, want %v", err, ErrBadTLSAuth)
+		}
+	})
+
+	t.Run("a bad tls-crypt-v2 key fails", func(t *testing.T) {
+		_, err := NewManager(config.NewConfig(
+			config.WithLogger(model.NewTestLogger()),
+			config.WithOpenVPNOptions(&config.OpenVPNOptions{TLSCryptV2: []byte("garbage")}),
+		))
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestNewManagerWithRandomSource(t *testing.T) {
+	// newManager returns a manager whose random bytes come from a seeded generator.
+	newManager := func(seed int64) *Manager {
+		m, err := NewManager(config.NewConfig(
+			config.WithLogger(model.NewTestLogger()),
+			config.WithRandomSource(mathrand.New(mathrand.NewSource(seed))),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	localKey := func(m *Manager) []byte {
+		key, err := m.ActiveKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key.Local().Bytes()
+	}
+
+	first, second, other := newManager(1), newManager(1), newManager(2)
+	if !bytes.Equal(first.LocalSessionID(), second.LocalSessionID()) {
+		t.Error("expected the same session ID with the same seed")
+	}
+	if !bytes.Equal(localKey(first), localKey(second)) {
+		t.Error("expected the same key source with the same seed")
+	}
+	if bytes.Equal(first.LocalSessionID(), other.LocalSessionID()) {
+		t.Error("expected a different session ID with a different seed")
+	}
+	if bytes.Equal(localKey(first), localKey(other)) {
+		t.Error("expected a different key source with a different seed")
+	}
+}
+
+func TestManager_UpdateTunnelInfo(t *testing.T) {
+	m, err := NewManager(config.NewConfig(config.WithLogger(model.NewTestLogger())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.TunnelInfo{
+		GW:              "10.8.0.1",
+		IP:              "10.8.0.6",
+		IPv6:            "fd00::1000",
+		NetMask:         "255.255.255.0",
+		Topology:        model.TopologySubnet,
+		PeerID:          1,
+		Cipher:          "AES-256-GCM",
+		RedirectGateway: true,
+		BlockOutsideDNS: true,
+		Routes:          []model.Route{{Network: "192.168.1.0", NetMask: "255.255.255.0"}},
+		DNS:             []string{"10.8.0.1"},
+		Ping:            10,
+		PingRestart:     120,
+	}
+	m.UpdateTunnelInfo(&want)
+	if diff := cmp.Diff(want, m.TunnelInfo()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestManager_SetNegotiationStateReportsConnectionState(t *testing.T) {
+	var got []model.ConnectionState
+	m, err := NewManager(config.NewConfig(
+		config.WithLogger(model.NewTestLogger()),
+		config.WithStateChangeCallback(func(state model.ConnectionState) {
+			got = append(got, state)
+		}),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { <-m.Ready }()
+
+	// a renegotiation goes back to S_INITIAL and must not be reported as a new connection
+	for _, sns := range []model.NegotiationState{
+		model.S_INITIAL, model.S_PRE_START, model.S_START, model.S_SENT_KEY, model.S_GOT_KEY,
+		model.S_ACTIVE, model.S_GENERATED_KEYS, model.S_INITIAL, model.S_SENT_KEY,
+	} {
+		m.SetNegotiationState(sns)
+	}
+	want := []model.ConnectionState{
+		model.ConnectionConnecting,
+		model.ConnectionAuthenticating,
+		model.ConnectionConnected,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestManager_StartRenegotiation(t *testing.T) {
+	m, err := NewManager(config.NewConfig(config.WithLogger(model.NewTestLogger())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { <-m.Ready }()
+	m.SetNegotiationState(model.S_GENERATED_KEYS)
+	if _, err := m.LocalDataPacketID(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyID := range []uint8{0, 8} {
+		if err := m.StartRenegotiation(keyID); !errors.Is(err, ErrDataChannelKey) {
+			t.Errorf("StartRenegotiation(%d) = %v, want %v", keyID, err, ErrDataChannelKey)
+		}
+	}
+
+	if err := m.StartRenegotiation(1); err != nil {
+		t.Fatal(err)
+	}
+	if m.NegotiationKeyID() != 1 || m.CurrentKeyID() != 0 {
+		t.Fatalf("unexpected key ids: negotiation %d, current %d", m.NegotiationKeyID(), m.CurrentKeyID())
+	}
+
+	// the control packet IDs restart from zero with the new key
+	for _, want := range []model.PacketID{0, 1} {
+		packet, err := m.NewPacket(model.P_CONTROL_V1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.KeyID != 1 || packet.ID != want {
+			t.Errorf("NewPacket() key id %d, packet id %d, want key id 1, packet id %d", packet.KeyID, packet.ID, want)
+		}
+	}
+	if err := m.StartRenegotiation(1); !errors.Is(err, ErrDataChannelKey) {
+		t.Errorf("StartRenegotiation(1) twice = %v, want %v", err, ErrDataChannelKey)
+	}
+
+	// once we generate the new keys, the data channel switches key and restarts the packet IDs
+	m.SetNegotiationState(model.S_GENERATED_KEYS)
+	if m.CurrentKeyID() != 1 {
+		t.Errorf("expected the data channel to use key id 1, got %d", m.CurrentKeyID())
+	}
+	if id, err := m.LocalDataPacketID(); err != nil || id != 1 {
+		t.Errorf("LocalDataPacketID() = %d, %v, want 1", id, err)
+	}
+}
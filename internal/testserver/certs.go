@@ -0,0 +1,110 @@
+package testserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+)
+
+// credentials contains the PEM-encoded certificates and keys we generate for each server.
+type credentials struct {
+	caPEM         []byte
+	serverCertPEM []byte
+	serverKeyPEM  []byte
+	clientCertPEM []byte
+	clientKeyPEM  []byte
+}
+
+// newCredentials generates a CA, and a server and a client certificate signed by it,
+// which are valid from one hour ago to one day from now.
+func newCredentials() (*credentials, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := newCertTemplate(1, "minivpn testserver CA")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	serverCert, serverKey, err := newLeaf(ca, caKey, 2, "server", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, err
+	}
+	clientCert, clientKey, err := newLeaf(ca, caKey, 3, "client", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	creds := &credentials{
+		caPEM:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		serverCertPEM: serverCert,
+		serverKeyPEM:  serverKey,
+		clientCertPEM: clientCert,
+		clientKeyPEM:  clientKey,
+	}
+	return creds, nil
+}
+
+// newCertTemplate returns a certificate template with the given serial number and common name.
+func newCertTemplate(serial int64, commonName string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+}
+
+// newLeaf returns the PEM-encoded certificate and key of a leaf signed by the given CA.
+func newLeaf(ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64,
+	commonName string, usage x509.ExtKeyUsage) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := newCertTemplate(serial, commonName)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// tlsConfig returns the server TLS config, which requires a client certificate signed by the CA.
+func (c *credentials) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(c.serverCertPEM, c.serverKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(c.caPEM)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return config, nil
+}
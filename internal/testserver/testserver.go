@@ -0,0 +1,519 @@
+// Package testserver implements just enough of an OpenVPN server to run the client handshake
+// end to end in tests, without a real server: it answers the hard reset, performs the TLS
+// handshake over the control channel, exchanges the key material using key-method 2, and
+// answers the push request. It can also renegotiate the keys with a soft reset. It does not
+// implement the data channel, and it assumes that the transport does not lose or reorder
+// packets (e.g., an in-memory pipe).
+package testserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ooni/minivpn/internal/bytesx"
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+// DefaultPushReply is the push reply sent by a new [Server].
+const DefaultPushReply = "PUSH_REPLY,route-gateway 10.8.0.1,topology subnet,ping 10,ping-restart 60," +
+	"ifconfig 10.8.0.6 255.255.255.0"
+
+// serverOptions is the options string we send along with our key material.
+const serverOptions = "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto TCPv4_SERVER,cipher AES-256-GCM," +
+	"auth SHA512,keysize 256,key-method 2,tls-server"
+
+// maxControlPayload is the maximum size of the TLS bytes we send in a single control packet.
+const maxControlPayload = 1024
+
+// ErrProtocol indicates that the client did not behave as we expected.
+var ErrProtocol = errors.New("testserver: protocol error")
+
+// Server is a minimal OpenVPN server. The zero value is invalid; please, use [New].
+type Server struct {
+	// PushReply is the push reply we send to the client, without the trailing NUL byte.
+	PushReply string
+
+	// NoAuthReply makes the server never answer the key material sent by the client after
+	// the TLS handshake, so that the client is stuck in the key exchange.
+	NoAuthReply bool
+
+	// CheckAuth, when set, checks the username and password sent by the client. When it
+	// returns an error, we reply to the push request with AUTH_FAILED and the error as the
+	// reason, like a server rejecting the credentials.
+	CheckAuth func(username, password string) error
+
+	// Renegotiate, when set, makes the server renegotiate the keys with a soft reset using
+	// the next key ID each time we receive from it, after the previous key exchange is done.
+	Renegotiate chan struct{}
+
+	// creds contains the certificates and keys for the server and the client.
+	creds *credentials
+
+	// logger is the logger to use.
+	logger model.Logger
+
+	// tlsConfig is the server TLS config.
+	tlsConfig *tls.Config
+}
+
+// New returns a new [Server] with freshly generated credentials, which sends
+// [DefaultPushReply] to the clients.
+func New(logger model.Logger) (*Server, error) {
+	creds, err := newCredentials()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := creds.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{
+		PushReply: DefaultPushReply,
+		creds:     creds,
+		logger:    logger,
+		tlsConfig: tlsConfig,
+	}
+	return srv, nil
+}
+
+// Options returns client options using TCP and the credentials accepted by this server.
+func (s *Server) Options() *config.OpenVPNOptions {
+	return &config.OpenVPNOptions{
+		Remote: "10.0.0.1",
+		Port:   "1194",
+		Proto:  config.ProtoTCP,
+		CA:     s.creds.caPEM,
+		Cert:   s.creds.clientCertPEM,
+		Key:    s.creds.clientKeyPEM,
+		Cipher: "AES-256-GCM",
+		Auth:   "SHA512",
+	}
+}
+
+// DialContext implements model.Dialer. It returns one end of an in-memory pipe, and serves
+// the client on the other end in a background goroutine, until the client closes the conn.
+func (s *Server) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		if err := s.Serve(server); err != nil {
+			s.logger.Warnf("testserver: %s", err.Error())
+		}
+	}()
+	return client, nil
+}
+
+// Serve serves a client over the given stream conn, using the OpenVPN TCP framing, until
+// the client closes the conn or misbehaves. This function TAKES OWNERSHIP of the conn.
+func (s *Server) Serve(conn net.Conn) error {
+	sess, err := newServerSession(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer sess.close()
+
+	// perform the TLS and the key exchange in the background while we read packets
+	errch := make(chan error, 1)
+	go func() {
+		errch <- s.exchangeKeys(sess)
+	}()
+
+	readErr := sess.readLoop()
+	sess.close()
+	if err := <-errch; err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+	if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrClosedPipe) {
+		return nil
+	}
+	return readErr
+}
+
+// exchangeKeys performs the TLS handshake, the key-method 2 exchange and the push request,
+// and then consumes the control messages sent by the client, renegotiating the keys when
+// the Renegotiate channel says so.
+func (s *Server) exchangeKeys(sess *serverSession) error {
+	conn := sess.controlConn()
+	for {
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		if err := s.negotiate(tlsConn); err != nil {
+			return err
+		}
+		if s.Renegotiate == nil {
+			// we do not expect anything else, but we keep reading until the client goes away
+			_, err := io.Copy(io.Discard, tlsConn)
+			return err
+		}
+
+		// keep reading until the client goes away or we renegotiate, which stops the
+		// reads, since the TLS bytes of the new key go to a new pipe
+		errch := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(io.Discard, tlsConn)
+			errch <- err
+		}()
+		select {
+		case err := <-errch:
+			return err
+		case <-s.Renegotiate:
+		}
+		var err error
+		if conn, err = sess.softReset(); err != nil {
+			return err
+		}
+	}
+}
+
+// negotiate runs the TLS handshake, the key-method 2 exchange and the push request.
+func (s *Server) negotiate(tlsConn *tls.Conn) error {
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 1<<17)
+	count, err := tlsConn.Read(buffer)
+	if err != nil {
+		return err
+	}
+	if count < 5 || !bytes.Equal(buffer[:4], []byte{0, 0, 0, 0}) || buffer[4] != 0x02 {
+		return fmt.Errorf("%w: unexpected auth request: %x", ErrProtocol, buffer[:count])
+	}
+	pushReply := s.PushReply
+	if s.CheckAuth != nil {
+		username, password, err := parseCredentials(buffer[5:count])
+		if err != nil {
+			return err
+		}
+		if err := s.CheckAuth(username, password); err != nil {
+			pushReply = "AUTH_FAILED," + err.Error()
+		}
+	}
+	if s.NoAuthReply {
+		_, err = io.Copy(io.Discard, tlsConn)
+		return err
+	}
+	reply, err := newAuthReply()
+	if err != nil {
+		return err
+	}
+	if _, err := tlsConn.Write(reply); err != nil {
+		return err
+	}
+
+	count, err = tlsConn.Read(buffer)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(buffer[:count], []byte("PUSH_REQUEST")) {
+		return fmt.Errorf("%w: expected push request: %q", ErrProtocol, buffer[:count])
+	}
+	_, err = tlsConn.Write(append([]byte(pushReply), 0x00))
+	return err
+}
+
+// keySourceSize is the size of the key material sent by the client using key-method 2.
+const keySourceSize = 48 + 32 + 32
+
+// parseCredentials returns the username and the password contained in the key-method 2
+// message sent by the client, after the header and the key method byte.
+func parseCredentials(message []byte) (string, string, error) {
+	if len(message) < keySourceSize {
+		return "", "", fmt.Errorf("%w: auth request too short", ErrProtocol)
+	}
+	rest := message[keySourceSize:]
+	var fields [3]string // options, username and password
+	for idx := range fields {
+		if len(rest) < 2 {
+			return "", "", fmt.Errorf("%w: truncated auth request", ErrProtocol)
+		}
+		length := int(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+		if length < 1 || len(rest) < length || rest[length-1] != 0x00 {
+			return "", "", fmt.Errorf("%w: invalid string in auth request", ErrProtocol)
+		}
+		fields[idx], rest = string(rest[:length-1]), rest[length:]
+	}
+	return fields[1], fields[2], nil
+}
+
+// newAuthReply returns our key-method 2 message with random key material.
+func newAuthReply() ([]byte, error) {
+	random, err := bytesx.GenRandomBytes(64)
+	if err != nil {
+		return nil, err
+	}
+	options, err := bytesx.EncodeOptionStringToBytes(serverOptions)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.Write([]byte{0, 0, 0, 0}) // header
+	out.WriteByte(0x02)           // key method
+	out.Write(random)             // random1 and random2
+	out.Write(options)
+	return out.Bytes(), nil
+}
+
+// serverSession is the state of the session with a single client.
+type serverSession struct {
+	// conn is the conn with the client.
+	conn net.Conn
+
+	// localSessionID is our session ID.
+	localSessionID model.SessionID
+
+	// remoteSessionID is the client session ID, which we learn from the hard reset.
+	remoteSessionID model.SessionID
+
+	// mu serializes the writes to the conn and protects the fields below.
+	mu sync.Mutex
+
+	// keyID is the key ID of the control packets, which changes with each soft reset.
+	keyID uint8
+
+	// awaitingSoftReset tells that we sent a soft reset, which the client must answer with
+	// its own soft reset before sending the TLS bytes of the new key.
+	awaitingSoftReset bool
+
+	// lastIncomingID is the ID of the last control packet we received from the client.
+	lastIncomingID model.PacketID
+
+	// tlsReader and tlsWriter move the TLS bytes sent by the client to the TLS server. We
+	// use a new pipe for each key.
+	tlsReader *io.PipeReader
+	tlsWriter *io.PipeWriter
+
+	// nextOutgoingID is the ID of the next control packet we send.
+	nextOutgoingID model.PacketID
+
+	// closeOnce ensures we close only once.
+	closeOnce sync.Once
+}
+
+// newServerSession creates a new serverSession with a random session ID.
+func newServerSession(conn net.Conn) (*serverSession, error) {
+	random, err := bytesx.GenRandomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	sess := &serverSession{
+		conn:           conn,
+		localSessionID: model.SessionID(random),
+		tlsReader:      reader,
+		tlsWriter:      writer,
+		nextOutgoingID: 1, // zero is the hard reset
+	}
+	return sess, nil
+}
+
+// close closes the conn and the TLS pipe.
+func (sess *serverSession) close() {
+	sess.closeOnce.Do(func() {
+		sess.conn.Close()
+		sess.mu.Lock()
+		reader, writer := sess.tlsReader, sess.tlsWriter
+		sess.mu.Unlock()
+		writer.CloseWithError(io.EOF)
+		reader.Close()
+	})
+}
+
+// softReset starts renegotiating the keys using the next key ID, like a server does when
+// the reneg-sec interval expires, and returns the conn carrying the TLS bytes of the new key.
+func (sess *serverSession) softReset() (net.Conn, error) {
+	reader, writer := io.Pipe()
+	sess.mu.Lock()
+	previous := sess.tlsWriter
+	sess.keyID = sess.keyID%7 + 1 // zero is reserved to the first key
+	sess.awaitingSoftReset = true
+	sess.tlsReader, sess.tlsWriter = reader, writer
+	sess.nextOutgoingID = 1 // zero is the soft reset
+	packet := model.NewPacket(model.P_CONTROL_SOFT_RESET_V1, sess.keyID, nil)
+	sess.mu.Unlock()
+	previous.CloseWithError(io.EOF)
+
+	packet.LocalSessionID = sess.localSessionID
+	packet.ID = 0
+	if err := sess.writeRawPacket(packet); err != nil {
+		return nil, err
+	}
+	return sess.controlConn(), nil
+}
+
+// onSoftReset handles the soft reset with which the client answers ours. Since the client
+// restarts the control packet IDs with the new key, its soft reset must have ID zero.
+func (sess *serverSession) onSoftReset(packet *model.Packet) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	switch {
+	case packet.KeyID != sess.keyID:
+		return fmt.Errorf("%w: soft reset for key id %d, want %d", ErrProtocol, packet.KeyID, sess.keyID)
+	case !sess.awaitingSoftReset:
+		return nil // a retransmission
+	case packet.ID != 0:
+		return fmt.Errorf("%w: soft reset with packet id %d, want 0", ErrProtocol, packet.ID)
+	}
+	sess.awaitingSoftReset = false
+	sess.lastIncomingID = 0
+	return nil
+}
+
+// acceptControl checks the given control packet, and returns the pipe where we should write
+// its TLS bytes, or nil when we should ignore it (e.g., a retransmission).
+func (sess *serverSession) acceptControl(packet *model.Packet) (*io.PipeWriter, error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	switch {
+	case packet.KeyID != sess.keyID:
+		return nil, nil // a late packet for the previous key
+	case sess.awaitingSoftReset:
+		return nil, fmt.Errorf("%w: expected a soft reset for key id %d", ErrProtocol, sess.keyID)
+	case packet.ID <= sess.lastIncomingID:
+		return nil, nil // a retransmission
+	case packet.ID != sess.lastIncomingID+1:
+		return nil, fmt.Errorf("%w: got packet id %d, want %d", ErrProtocol, packet.ID, sess.lastIncomingID+1)
+	}
+	sess.lastIncomingID++
+	return sess.tlsWriter, nil
+}
+
+// readLoop reads and handles the packets sent by the client, until the conn is closed.
+func (sess *serverSession) readLoop() error {
+	for {
+		raw, err := sess.readRawPacket()
+		if err != nil {
+			return err
+		}
+		packet, err := model.ParsePacket(raw)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrProtocol, err)
+		}
+		switch packet.Opcode {
+		case model.P_CONTROL_HARD_RESET_CLIENT_V2:
+			sess.remoteSessionID = packet.LocalSessionID
+			reply := model.NewPacket(model.P_CONTROL_HARD_RESET_SERVER_V2, 0, nil)
+			if err := sess.writePacket(reply, packet.ID, 0); err != nil {
+				return err
+			}
+
+		case model.P_CONTROL_SOFT_RESET_V1:
+			if err := sess.writePacket(model.NewPacket(model.P_ACK_V1, packet.KeyID, nil), packet.ID, 0); err != nil {
+				return err
+			}
+			if err := sess.onSoftReset(packet); err != nil {
+				return err
+			}
+
+		case model.P_CONTROL_V1:
+			if err := sess.writePacket(model.NewPacket(model.P_ACK_V1, packet.KeyID, nil), packet.ID, 0); err != nil {
+				return err
+			}
+			writer, err := sess.acceptControl(packet)
+			if err != nil {
+				return err
+			}
+			if writer == nil {
+				continue
+			}
+			if _, err := writer.Write(packet.Payload); err != nil {
+				return err
+			}
+
+		default:
+			// we do not care about the ACKs, since we never retransmit, nor about the data
+		}
+	}
+}
+
+// controlConn returns a net.Conn that reads the TLS bytes sent by the client with the
+// current key and sends the written TLS bytes to the client using control packets.
+func (sess *serverSession) controlConn() net.Conn {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return &controlConn{Conn: sess.conn, reader: sess.tlsReader, sess: sess}
+}
+
+// writePacket sets the session IDs of the given packet, acks the given packet ID, sets the
+// packet ID, and sends the packet to the client.
+func (sess *serverSession) writePacket(packet *model.Packet, ack, id model.PacketID) error {
+	packet.LocalSessionID = sess.localSessionID
+	packet.RemoteSessionID = sess.remoteSessionID
+	packet.ACKs = []model.PacketID{ack}
+	packet.ID = id
+	return sess.writeRawPacket(packet)
+}
+
+// writeControl sends TLS bytes to the client using the next outgoing packet ID.
+func (sess *serverSession) writeControl(payload []byte) error {
+	sess.mu.Lock()
+	id := sess.nextOutgoingID
+	sess.nextOutgoingID++
+	packet := model.NewPacket(model.P_CONTROL_V1, sess.keyID, payload)
+	sess.mu.Unlock()
+	packet.LocalSessionID = sess.localSessionID
+	packet.ID = id
+	return sess.writeRawPacket(packet)
+}
+
+// writeRawPacket serializes the packet and writes it using the TCP framing.
+func (sess *serverSession) writeRawPacket(packet *model.Packet) error {
+	raw, err := packet.Bytes()
+	if err != nil {
+		return err
+	}
+	framed := make([]byte, 2, 2+len(raw))
+	binary.BigEndian.PutUint16(framed, uint16(len(raw)))
+	framed = append(framed, raw...)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	_, err = sess.conn.Write(framed)
+	return err
+}
+
+// readRawPacket reads a packet using the TCP framing.
+func (sess *serverSession) readRawPacket() ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(sess.conn, length); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(sess.conn, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// controlConn adapts the control channel of a serverSession to the net.Conn expected by TLS.
+type controlConn struct {
+	net.Conn
+	reader *io.PipeReader
+	sess   *serverSession
+}
+
+// Read implements net.Conn
+func (c *controlConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Write implements net.Conn
+func (c *controlConn) Write(b []byte) (int, error) {
+	for offset := 0; offset < len(b); offset += maxControlPayload {
+		end := offset + maxControlPayload
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := c.sess.writeControl(b[offset:end]); err != nil {
+			return offset, err
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,8 @@
+// Package tlscrypt implements the tls-crypt-v2 wrapping of control channel packets.
+// With tls-crypt-v2, every client owns a key (Kc) that is used to encrypt and authenticate
+// all the control channel packets. The server does not need to store the client keys: the
+// client sends a wrapped copy of its key (WKc) in the initial hard reset.
+//
+// This package also implements the tls-auth wrapping, which authenticates the control
+// channel packets using a static key shared by all the clients, without encrypting them.
+package tlscrypt
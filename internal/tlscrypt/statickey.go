@@ -0,0 +1,83 @@
+package tlscrypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrBadStaticKey is returned when we cannot parse an OpenVPN static key.
+var ErrBadStaticKey = errors.New("tls-auth: bad static key")
+
+const (
+	// staticKeyBegin and staticKeyEnd delimit the hex-encoded static key.
+	staticKeyBegin = "-----BEGIN OpenVPN Static key V1-----"
+	staticKeyEnd   = "-----END OpenVPN Static key V1-----"
+)
+
+// KeyDirection selects which halves of a static key we use to send and to receive.
+type KeyDirection int
+
+const (
+	// KeyDirectionBidirectional uses the first half of the key in both directions.
+	KeyDirectionBidirectional = KeyDirection(iota)
+
+	// KeyDirectionNormal (i.e., key-direction 0) sends using the first half of the key
+	// and receives using the second half. This is what servers usually use.
+	KeyDirectionNormal
+
+	// KeyDirectionInverse (i.e., key-direction 1) sends using the second half of the key
+	// and receives using the first half. This is what clients usually use.
+	KeyDirectionInverse
+)
+
+// StaticKey is an OpenVPN static key, as generated by `openvpn --genkey`.
+type StaticKey struct {
+	// Keys contains two pairs of cipher and hmac keys.
+	Keys [kcLen]byte
+}
+
+// ParseStaticKey parses a hex-encoded OpenVPN static key.
+func ParseStaticKey(data []byte) (*StaticKey, error) {
+	begin := bytes.Index(data, []byte(staticKeyBegin))
+	end := bytes.Index(data, []byte(staticKeyEnd))
+	if begin < 0 || end < begin {
+		return nil, fmt.Errorf("%w: %s", ErrBadStaticKey, "cannot find the key markers")
+	}
+	var encoded []byte
+	for _, line := range bytes.Split(data[begin+len(staticKeyBegin):end], []byte("\n")) {
+		encoded = append(encoded, bytes.TrimSpace(line)...)
+	}
+	raw, err := hex.DecodeString(string(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadStaticKey, err)
+	}
+	if len(raw) != kcLen {
+		return nil, fmt.Errorf("%w: bad key length: %d", ErrBadStaticKey, len(raw))
+	}
+	key := &StaticKey{}
+	copy(key.Keys[:], raw)
+	return key, nil
+}
+
+// keyPair is a pair of cipher and hmac keys, each keyLen bytes long.
+type keyPair struct {
+	cipher []byte
+	hmac   []byte
+}
+
+// directionalKeys returns the key pairs we use to send and to receive with the given
+// direction. The keys contain two pairs of cipher and hmac keys, in this order.
+func directionalKeys(keys *[kcLen]byte, direction KeyDirection) (send, recv keyPair) {
+	first := keyPair{cipher: keys[0:keyLen], hmac: keys[keyLen : 2*keyLen]}
+	second := keyPair{cipher: keys[2*keyLen : 3*keyLen], hmac: keys[3*keyLen : 4*keyLen]}
+	switch direction {
+	case KeyDirectionNormal:
+		return first, second
+	case KeyDirectionInverse:
+		return second, first
+	default:
+		return first, first
+	}
+}
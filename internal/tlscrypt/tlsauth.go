@@ -0,0 +1,117 @@
+package tlscrypt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+// ControlWrapper wraps and unwraps control channel packets. Both [Wrapper] and
+// [AuthWrapper] implement this interface.
+type ControlWrapper interface {
+	// Wrap wraps a serialized control channel packet.
+	Wrap(raw []byte) ([]byte, error)
+
+	// WrapHardReset wraps a serialized hard reset packet.
+	WrapHardReset(raw []byte) ([]byte, error)
+
+	// Unwrap verifies an incoming wrapped control channel packet, and returns
+	// the serialized packet that we can parse.
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+var (
+	_ ControlWrapper = &Wrapper{}
+	_ ControlWrapper = &AuthWrapper{}
+)
+
+// replayLen is the length of the packet ID and of the net time we add with tls-auth.
+const replayLen = 4 + 4
+
+// AuthWrapper wraps and unwraps control channel packets using tls-auth, which adds an
+// HMAC to the packets without encrypting them. The zero value is invalid; please construct
+// using [NewAuthWrapper]. This struct is concurrency safe.
+type AuthWrapper struct {
+	newHash func() hash.Hash
+	sendKey []byte
+	recvKey []byte
+
+	mu       sync.Mutex
+	packetID uint32
+}
+
+// NewAuthWrapper returns an [AuthWrapper] for the given static key, computing the HMAC with
+// the given hash. The direction selects which halves of the key we use to send and to receive.
+func NewAuthWrapper(key *StaticKey, direction KeyDirection, newHash func() hash.Hash) *AuthWrapper {
+	send, recv := directionalKeys(&key.Keys, direction)
+	// the HMAC uses as many bytes of the key as the size of the digest
+	size := newHash().Size()
+	return &AuthWrapper{
+		newHash: newHash,
+		sendKey: send.hmac[:size],
+		recvKey: recv.hmac[:size],
+	}
+}
+
+// Wrap wraps a serialized control channel packet. The packet on the wire contains the opcode
+// and the session ID, the HMAC, the packet ID and the net time, and the rest of the packet.
+func (w *AuthWrapper) Wrap(raw []byte) ([]byte, error) {
+	if len(raw) < opcodeAndSessionIDLen {
+		return nil, fmt.Errorf("%w: %s", ErrCannotWrap, "packet too short")
+	}
+	w.mu.Lock()
+	w.packetID++
+	packetID := w.packetID
+	w.mu.Unlock()
+
+	replay := make([]byte, replayLen)
+	binary.BigEndian.PutUint32(replay, packetID)
+	binary.BigEndian.PutUint32(replay[4:], uint32(timeNowFn().Unix()))
+
+	header, rest := raw[:opcodeAndSessionIDLen], raw[opcodeAndSessionIDLen:]
+	out := &bytes.Buffer{}
+	out.Write(header)
+	out.Write(w.computeHMAC(w.sendKey, replay, header, rest))
+	out.Write(replay)
+	out.Write(rest)
+	return out.Bytes(), nil
+}
+
+// WrapHardReset is like Wrap, since tls-auth treats the hard reset like any other packet.
+func (w *AuthWrapper) WrapHardReset(raw []byte) ([]byte, error) {
+	return w.Wrap(raw)
+}
+
+// Unwrap verifies an incoming wrapped control channel packet, and returns the
+// serialized packet that we can parse.
+func (w *AuthWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	size := len(w.recvKey)
+	if len(wrapped) < opcodeAndSessionIDLen+size+replayLen {
+		return nil, fmt.Errorf("%w: %s", ErrCannotUnwrap, "packet too short")
+	}
+	header := wrapped[:opcodeAndSessionIDLen]
+	mac := wrapped[opcodeAndSessionIDLen : opcodeAndSessionIDLen+size]
+	replay := wrapped[opcodeAndSessionIDLen+size : opcodeAndSessionIDLen+size+replayLen]
+	rest := wrapped[opcodeAndSessionIDLen+size+replayLen:]
+	if !hmac.Equal(mac, w.computeHMAC(w.recvKey, replay, header, rest)) {
+		return nil, fmt.Errorf("%w: %s", ErrCannotUnwrap, "bad hmac")
+	}
+	out := &bytes.Buffer{}
+	out.Write(header)
+	out.Write(rest)
+	return out.Bytes(), nil
+}
+
+// computeHMAC returns the HMAC over the packet ID and net time, the opcode and the
+// session ID, and the rest of the packet, which is the order used by the reference
+// implementation.
+func (w *AuthWrapper) computeHMAC(key, replay, header, rest []byte) []byte {
+	mac := hmac.New(w.newHash, key)
+	mac.Write(replay)
+	mac.Write(header)
+	mac.Write(rest)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,182 @@
+package tlscrypt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// makeTestingStaticKey returns a static key whose bytes are their own index.
+func makeTestingStaticKey() *StaticKey {
+	key := &StaticKey{}
+	for i := range key.Keys {
+		key.Keys[i] = byte(i)
+	}
+	return key
+}
+
+// makeTestingStaticKeyFile returns the given static key in the format of `openvpn --genkey`.
+func makeTestingStaticKeyFile(key *StaticKey) []byte {
+	encoded := hex.EncodeToString(key.Keys[:])
+	var lines []string
+	lines = append(lines, "#", "# 2048 bit OpenVPN static key", "#", staticKeyBegin)
+	for i := 0; i < len(encoded); i += 32 {
+		lines = append(lines, encoded[i:i+32])
+	}
+	lines = append(lines, staticKeyEnd, "")
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func TestParseStaticKey(t *testing.T) {
+	t.Run("a well-formed key is parsed", func(t *testing.T) {
+		want := makeTestingStaticKey()
+		key, err := ParseStaticKey(makeTestingStaticKeyFile(want))
+		if err != nil {
+			t.Fatalf("ParseStaticKey() error = %v", err)
+		}
+		if key.Keys != want.Keys {
+			t.Errorf("unexpected keys")
+		}
+	})
+
+	t.Run("a short key fails", func(t *testing.T) {
+		data := []byte(staticKeyBegin + "\n0011\n" + staticKeyEnd)
+		if _, err := ParseStaticKey(data); !errors.Is(err, ErrBadStaticKey) {
+			t.Errorf("ParseStaticKey() error = %v, want %v", err, ErrBadStaticKey)
+		}
+	})
+
+	t.Run("a key without markers fails", func(t *testing.T) {
+		if _, err := ParseStaticKey([]byte("0011")); !errors.Is(err, ErrBadStaticKey) {
+			t.Errorf("ParseStaticKey() error = %v, want %v", err, ErrBadStaticKey)
+		}
+	})
+
+	t.Run("a key that is not hex fails", func(t *testing.T) {
+		data := []byte(staticKeyBegin + "\nzz\n" + staticKeyEnd)
+		if _, err := ParseStaticKey(data); !errors.Is(err, ErrBadStaticKey) {
+			t.Errorf("ParseStaticKey() error = %v, want %v", err, ErrBadStaticKey)
+		}
+	})
+}
+
+func Test_directionalKeys(t *testing.T) {
+	key := makeTestingStaticKey()
+	// the first byte of each of the four keys
+	const (
+		cipher0 = 0
+		hmac0   = keyLen
+		cipher1 = 2 * keyLen
+		hmac1   = 3 * keyLen
+	)
+	tests := []struct {
+		name      string
+		direction KeyDirection
+		want      [4]byte // send cipher, send hmac, recv cipher, recv hmac
+	}{
+		{"key-direction 0", KeyDirectionNormal, [4]byte{cipher0, hmac0, cipher1, hmac1}},
+		{"key-direction 1", KeyDirectionInverse, [4]byte{cipher1, hmac1, cipher0, hmac0}},
+		{"bidirectional", KeyDirectionBidirectional, [4]byte{cipher0, hmac0, cipher0, hmac0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send, recv := directionalKeys(&key.Keys, tt.direction)
+			got := [4]byte{send.cipher[0], send.hmac[0], recv.cipher[0], recv.hmac[0]}
+			if got != tt.want {
+				t.Errorf("directionalKeys() = %v, want %v", got, tt.want)
+			}
+			for _, k := range [][]byte{send.cipher, send.hmac, recv.cipher, recv.hmac} {
+				if len(k) != keyLen {
+					t.Errorf("len(key) = %d, want %d", len(k), keyLen)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthWrapper_WrapUnwrap(t *testing.T) {
+	key := makeTestingStaticKey()
+	raw := append(bytes.Repeat([]byte{0x38}, opcodeAndSessionIDLen), []byte("the rest of the packet")...)
+
+	t.Run("the packet contains the hmac and the replay fields after the session ID", func(t *testing.T) {
+		wrapped, err := NewAuthWrapper(key, KeyDirectionInverse, sha512.New).Wrap(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wrapped) != len(raw)+sha512.Size+replayLen {
+			t.Errorf("len(wrapped) = %d, want %d", len(wrapped), len(raw)+sha512.Size+replayLen)
+		}
+		if !bytes.Equal(wrapped[:opcodeAndSessionIDLen], raw[:opcodeAndSessionIDLen]) {
+			t.Error("expected the opcode and the session ID in front")
+		}
+		if !bytes.HasSuffix(wrapped, raw[opcodeAndSessionIDLen:]) {
+			t.Error("expected the rest of the packet in cleartext")
+		}
+	})
+
+	tests := []struct {
+		name     string
+		client   KeyDirection
+		server   KeyDirection
+		wantFail bool // whether the server rejects the client packets
+	}{
+		{"client 1 and server 0", KeyDirectionInverse, KeyDirectionNormal, false},
+		{"client 0 and server 1", KeyDirectionNormal, KeyDirectionInverse, false},
+		{"both bidirectional", KeyDirectionBidirectional, KeyDirectionBidirectional, false},
+		{"both 1", KeyDirectionInverse, KeyDirectionInverse, true},
+		{"client 1 and bidirectional server", KeyDirectionInverse, KeyDirectionBidirectional, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewAuthWrapper(key, tt.client, sha1.New)
+			server := NewAuthWrapper(key, tt.server, sha1.New)
+			pairs := [][2]*AuthWrapper{{client, server}, {server, client}}
+			if tt.wantFail {
+				pairs = pairs[:1]
+			}
+			for _, pair := range pairs {
+				wrapped, err := pair[0].WrapHardReset(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				unwrapped, err := pair[1].Unwrap(wrapped)
+				if tt.wantFail {
+					if !errors.Is(err, ErrCannotUnwrap) {
+						t.Errorf("Unwrap() error = %v, want %v", err, ErrCannotUnwrap)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Unwrap() error = %v", err)
+				}
+				if !bytes.Equal(unwrapped, raw) {
+					t.Errorf("Unwrap() = %x, want %x", unwrapped, raw)
+				}
+			}
+		})
+	}
+
+	t.Run("a tampered packet fails", func(t *testing.T) {
+		client := NewAuthWrapper(key, KeyDirectionInverse, sha1.New)
+		server := NewAuthWrapper(key, KeyDirectionNormal, sha1.New)
+		wrapped, _ := client.Wrap(raw)
+		wrapped[len(wrapped)-1] ^= 0x01
+		if _, err := server.Unwrap(wrapped); !errors.Is(err, ErrCannotUnwrap) {
+			t.Errorf("Unwrap() error = %v, want %v", err, ErrCannotUnwrap)
+		}
+	})
+
+	t.Run("short packets fail", func(t *testing.T) {
+		w := NewAuthWrapper(key, KeyDirectionInverse, sha1.New)
+		if _, err := w.Wrap([]byte{0x38}); !errors.Is(err, ErrCannotWrap) {
+			t.Errorf("Wrap() error = %v, want %v", err, ErrCannotWrap)
+		}
+		if _, err := w.Unwrap(make([]byte, 20)); !errors.Is(err, ErrCannotUnwrap) {
+			t.Errorf("Unwrap() error = %v, want %v", err, ErrCannotUnwrap)
+		}
+	})
+}
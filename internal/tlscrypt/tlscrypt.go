@@ -0,0 +1,186 @@
+package tlscrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBadClientKey is returned when we cannot parse a tls-crypt-v2 client key.
+	ErrBadClientKey = errors.New("tls-crypt-v2: bad client key")
+
+	// ErrCannotWrap is returned when we cannot wrap an outgoing packet.
+	ErrCannotWrap = errors.New("tls-crypt-v2: cannot wrap packet")
+
+	// ErrCannotUnwrap is returned when we cannot unwrap an incoming packet.
+	ErrCannotUnwrap = errors.New("tls-crypt-v2: cannot unwrap packet")
+)
+
+const (
+	// clientKeyPEMType is the type of the PEM block containing a client key.
+	clientKeyPEMType = "OpenVPN tls-crypt-v2 client key"
+
+	// keyLen is the length of a single key (cipher or hmac) in the key2 structure.
+	keyLen = 64
+
+	// kcLen is the length of the client key (Kc): two pairs of cipher and hmac keys.
+	kcLen = 4 * keyLen
+
+	// headerLen is the length of the cleartext header: opcode, session ID, packet ID and net time.
+	headerLen = 1 + 8 + 4 + 4
+
+	// tagLen is the length of the HMAC-SHA256 authentication tag.
+	tagLen = sha256.Size
+
+	// opcodeAndSessionIDLen is the length of the opcode and local session ID that
+	// we move from the plaintext packet into the wrapped header.
+	opcodeAndSessionIDLen = 1 + 8
+)
+
+// ClientKey is a tls-crypt-v2 client key.
+type ClientKey struct {
+	// Kc is the client key, made of two pairs of cipher and hmac keys.
+	Kc [kcLen]byte
+
+	// WKc is the wrapped client key, that we send to the server in the hard reset.
+	WKc []byte
+}
+
+// ParseClientKey parses a PEM-encoded tls-crypt-v2 client key.
+func ParseClientKey(data []byte) (*ClientKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != clientKeyPEMType {
+		return nil, fmt.Errorf("%w: %s", ErrBadClientKey, "cannot decode PEM block")
+	}
+	raw := block.Bytes
+	// the WKc ends with its own length, as a big endian uint16.
+	if len(raw) < kcLen+2 {
+		return nil, fmt.Errorf("%w: %s", ErrBadClientKey, "key too short")
+	}
+	wkc := raw[kcLen:]
+	if wkcLen := int(binary.BigEndian.Uint16(wkc[len(wkc)-2:])); wkcLen != len(wkc) {
+		return nil, fmt.Errorf("%w: bad WKc length: %d", ErrBadClientKey, wkcLen)
+	}
+	key := &ClientKey{WKc: append([]byte{}, wkc...)}
+	copy(key.Kc[:], raw[:kcLen])
+	return key, nil
+}
+
+// timeNowFn allows to mock the time in tests.
+var timeNowFn = time.Now
+
+// Wrapper wraps and unwraps control channel packets. The zero value is invalid;
+// please construct using [NewWrapper]. This struct is concurrency safe.
+type Wrapper struct {
+	encryptCipher []byte
+	encryptHMAC   []byte
+	decryptCipher []byte
+	decryptHMAC   []byte
+	wkc           []byte
+
+	mu       sync.Mutex
+	packetID uint32
+}
+
+// NewWrapper returns a client-side [Wrapper] for the given key. The client encrypts
+// with the second key pair in Kc, and decrypts with the first one: with tls-crypt, the
+// direction depends on the role, and the key-direction option does not apply.
+func NewWrapper(key *ClientKey) *Wrapper {
+	send, recv := directionalKeys(&key.Kc, KeyDirectionInverse)
+	// AES-256-CTR and HMAC-SHA256 use the first 32 bytes of each key.
+	return &Wrapper{
+		encryptCipher: send.cipher[:32],
+		encryptHMAC:   send.hmac[:32],
+		decryptCipher: recv.cipher[:32],
+		decryptHMAC:   recv.hmac[:32],
+		wkc:           key.WKc,
+		packetID:      0,
+	}
+}
+
+// Wrap wraps a serialized control channel packet.
+func (w *Wrapper) Wrap(raw []byte) ([]byte, error) {
+	if len(raw) < opcodeAndSessionIDLen {
+		return nil, fmt.Errorf("%w: %s", ErrCannotWrap, "packet too short")
+	}
+	w.mu.Lock()
+	w.packetID++
+	packetID := w.packetID
+	w.mu.Unlock()
+
+	header := &bytes.Buffer{}
+	header.Write(raw[:opcodeAndSessionIDLen])
+	binary.Write(header, binary.BigEndian, packetID)
+	binary.Write(header, binary.BigEndian, uint32(timeNowFn().Unix()))
+
+	plaintext := raw[opcodeAndSessionIDLen:]
+	tag := computeTag(w.encryptHMAC, header.Bytes(), plaintext)
+	ciphertext, err := xorKeyStream(w.encryptCipher, tag[:aes.BlockSize], plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCannotWrap, err)
+	}
+
+	out := header
+	out.Write(tag)
+	out.Write(ciphertext)
+	return out.Bytes(), nil
+}
+
+// WrapHardReset wraps a serialized hard reset packet, and appends the WKc so that
+// the server can recover our client key.
+func (w *Wrapper) WrapHardReset(raw []byte) ([]byte, error) {
+	wrapped, err := w.Wrap(raw)
+	if err != nil {
+		return nil, err
+	}
+	return append(wrapped, w.wkc...), nil
+}
+
+// Unwrap verifies and decrypts an incoming wrapped control channel packet, and
+// returns the serialized packet that we can parse.
+func (w *Wrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < headerLen+tagLen {
+		return nil, fmt.Errorf("%w: %s", ErrCannotUnwrap, "packet too short")
+	}
+	header := wrapped[:headerLen]
+	tag := wrapped[headerLen : headerLen+tagLen]
+	plaintext, err := xorKeyStream(w.decryptCipher, tag[:aes.BlockSize], wrapped[headerLen+tagLen:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCannotUnwrap, err)
+	}
+	if !hmac.Equal(tag, computeTag(w.decryptHMAC, header, plaintext)) {
+		return nil, fmt.Errorf("%w: %s", ErrCannotUnwrap, "bad authentication tag")
+	}
+	out := &bytes.Buffer{}
+	out.Write(header[:opcodeAndSessionIDLen])
+	out.Write(plaintext)
+	return out.Bytes(), nil
+}
+
+// computeTag returns the HMAC-SHA256 over the header and the plaintext.
+func computeTag(key, header, plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	mac.Write(plaintext)
+	return mac.Sum(nil)
+}
+
+// xorKeyStream encrypts or decrypts the input with AES-256-CTR.
+func xorKeyStream(key, iv, input []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(input))
+	cipher.NewCTR(block, iv).XORKeyStream(out, input)
+	return out, nil
+}
@@ -0,0 +1,323 @@
+package tlscrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+// makeTestingClientKeyPEM returns a PEM-encoded client key with a deterministic Kc
+// and a dummy WKc of the given length.
+func makeTestingClientKeyPEM(wkcLen int) []byte {
+	raw := make([]byte, kcLen+wkcLen)
+	for i := 0; i < kcLen; i++ {
+		raw[i] = byte(i)
+	}
+	for i := kcLen; i < len(raw)-2; i++ {
+		raw[i] = 0xee
+	}
+	binary.BigEndian.PutUint16(raw[len(raw)-2:], uint16(wkcLen))
+	return pem.EncodeToMemory(&pem.Block{Type: clientKeyPEMType, Bytes: raw})
+}
+
+// testingServerKey is the tls-crypt-v2 server key we use to wrap the client keys: a key
+// structure with a 64-byte cipher key followed by a 64-byte hmac key.
+var testingServerKey = func() []byte {
+	key := make([]byte, 2*keyLen)
+	for i := range key {
+		key[i] = byte(0xff - i)
+	}
+	return key
+}()
+
+// wrapClientKey returns the WKc for the given Kc and metadata, like the server does in the
+// reference implementation (see tls_crypt_v2_wrap_client_key): WKc = T || AES-256-CTR(Ke,
+// T, Kc || metadata) || len, where T = HMAC-SHA256(Ka, len || Kc || metadata) and len is the
+// big endian uint16 length of the WKc.
+func wrapClientKey(serverKey, kc, metadata []byte) []byte {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(tagLen+len(kc)+len(metadata)+2))
+	mac := hmac.New(sha256.New, serverKey[keyLen:keyLen+32])
+	mac.Write(length)
+	mac.Write(kc)
+	mac.Write(metadata)
+	tag := mac.Sum(nil)
+	block, _ := aes.NewCipher(serverKey[:32])
+	plaintext := append(append([]byte{}, kc...), metadata...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, tag[:aes.BlockSize]).XORKeyStream(ciphertext, plaintext)
+	return append(append(tag, ciphertext...), length...)
+}
+
+// unwrapClientKey is the inverse of wrapClientKey, and returns the Kc and the metadata.
+func unwrapClientKey(serverKey, wkc []byte) ([]byte, []byte, error) {
+	if len(wkc) < tagLen+kcLen+2 {
+		return nil, nil, errors.New("WKc too short")
+	}
+	tag, ciphertext := wkc[:tagLen], wkc[tagLen:len(wkc)-2]
+	block, _ := aes.NewCipher(serverKey[:32])
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, tag[:aes.BlockSize]).XORKeyStream(plaintext, ciphertext)
+	mac := hmac.New(sha256.New, serverKey[keyLen:keyLen+32])
+	mac.Write(wkc[len(wkc)-2:])
+	mac.Write(plaintext)
+	if !hmac.Equal(tag, mac.Sum(nil)) {
+		return nil, nil, errors.New("bad WKc tag")
+	}
+	return plaintext[:kcLen], plaintext[kcLen:], nil
+}
+
+// makeRealisticClientKeyPEM returns a PEM-encoded client key whose WKc wraps the Kc with
+// [testingServerKey] and carries a timestamp metadata, like the keys generated using
+// openvpn --genkey tls-crypt-v2-client.
+func makeRealisticClientKeyPEM() []byte {
+	kc := make([]byte, kcLen)
+	for i := range kc {
+		kc[i] = byte(i)
+	}
+	// TLS_CRYPT_METADATA_TYPE_TIMESTAMP followed by a big endian 64-bit timestamp
+	metadata := []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x65, 0x00, 0x00, 0x00}
+	raw := append(kc, wrapClientKey(testingServerKey, kc, metadata)...)
+	return pem.EncodeToMemory(&pem.Block{Type: clientKeyPEMType, Bytes: raw})
+}
+
+// makeTestingServerWrapper returns a wrapper with the server-side key directions.
+func makeTestingServerWrapper(key *ClientKey) *Wrapper {
+	return &Wrapper{
+		encryptCipher: key.Kc[0:32],
+		encryptHMAC:   key.Kc[keyLen : keyLen+32],
+		decryptCipher: key.Kc[2*keyLen : 2*keyLen+32],
+		decryptHMAC:   key.Kc[3*keyLen : 3*keyLen+32],
+	}
+}
+
+func TestParseClientKey(t *testing.T) {
+	t.Run("a well-formed key is parsed", func(t *testing.T) {
+		key, err := ParseClientKey(makeTestingClientKeyPEM(42))
+		if err != nil {
+			t.Fatalf("ParseClientKey() error = %v", err)
+		}
+		if key.Kc[0] != 0 || key.Kc[kcLen-1] != 0xff {
+			t.Errorf("unexpected Kc")
+		}
+		if len(key.WKc) != 42 {
+			t.Errorf("len(WKc) = %d, want 42", len(key.WKc))
+		}
+	})
+
+	t.Run("the WKc of a realistic key unwraps to its Kc", func(t *testing.T) {
+		key, err := ParseClientKey(makeRealisticClientKeyPEM())
+		if err != nil {
+			t.Fatalf("ParseClientKey() error = %v", err)
+		}
+		// T, the encrypted Kc, the timestamp metadata and the length
+		if len(key.WKc) != tagLen+kcLen+9+2 {
+			t.Fatalf("len(WKc) = %d", len(key.WKc))
+		}
+		kc, metadata, err := unwrapClientKey(testingServerKey, key.WKc)
+		if err != nil {
+			t.Fatalf("unwrapClientKey() error = %v", err)
+		}
+		if !bytes.Equal(kc, key.Kc[:]) {
+			t.Errorf("the WKc does not wrap the Kc")
+		}
+		if len(metadata) != 9 || metadata[0] != 0x01 {
+			t.Errorf("unexpected metadata: %x", metadata)
+		}
+	})
+
+	t.Run("a bad WKc length fails", func(t *testing.T) {
+		data := makeTestingClientKeyPEM(42)
+		block, _ := pem.Decode(data)
+		block.Bytes[len(block.Bytes)-1] = 0x01
+		if _, err := ParseClientKey(pem.EncodeToMemory(block)); !errors.Is(err, ErrBadClientKey) {
+			t.Errorf("ParseClientKey() error = %v, want %v", err, ErrBadClientKey)
+		}
+	})
+
+	t.Run("a short key fails", func(t *testing.T) {
+		data := pem.EncodeToMemory(&pem.Block{Type: clientKeyPEMType, Bytes: make([]byte, 10)})
+		if _, err := ParseClientKey(data); !errors.Is(err, ErrBadClientKey) {
+			t.Errorf("ParseClientKey() error = %v, want %v", err, ErrBadClientKey)
+		}
+	})
+
+	t.Run("a different PEM type fails", func(t *testing.T) {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: make([]byte, 300)})
+		if _, err := ParseClientKey(data); !errors.Is(err, ErrBadClientKey) {
+			t.Errorf("ParseClientKey() error = %v, want %v", err, ErrBadClientKey)
+		}
+	})
+}
+
+func TestWrapper_WrapHardReset(t *testing.T) {
+	defer func(orig func() time.Time) {
+		timeNowFn = orig
+	}(timeNowFn)
+	timeNowFn = func() time.Time {
+		return time.Unix(0x01020304, 0)
+	}
+
+	key, err := ParseClientKey(makeRealisticClientKeyPEM())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a P_CONTROL_HARD_RESET_CLIENT_V3 with session ID 0x11..0x18, no acks and packet ID zero.
+	hardReset := []byte{
+		0x50,
+		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+		0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	got, err := NewWrapper(key).WrapHardReset(hardReset)
+	if err != nil {
+		t.Fatalf("WrapHardReset() error = %v", err)
+	}
+
+	wantHeader := []byte{
+		0x50,
+		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+		0x00, 0x00, 0x00, 0x01, // tls-crypt packet ID
+		0x01, 0x02, 0x03, 0x04, // net time
+	}
+	plaintext := hardReset[opcodeAndSessionIDLen:]
+
+	if len(got) != len(wantHeader)+tagLen+len(plaintext)+len(key.WKc) {
+		t.Fatalf("unexpected length: %d", len(got))
+	}
+	if !bytes.Equal(got[:headerLen], wantHeader) {
+		t.Errorf("header = %x, want %x", got[:headerLen], wantHeader)
+	}
+
+	// the tag is the HMAC-SHA256 of header and plaintext, keyed with the client hmac key.
+	mac := hmac.New(sha256.New, key.Kc[192:224])
+	mac.Write(wantHeader)
+	mac.Write(plaintext)
+	wantTag := mac.Sum(nil)
+	if !bytes.Equal(got[headerLen:headerLen+tagLen], wantTag) {
+		t.Errorf("tag = %x, want %x", got[headerLen:headerLen+tagLen], wantTag)
+	}
+
+	// the ciphertext is AES-256-CTR with the client cipher key, and the tag as IV.
+	block, _ := aes.NewCipher(key.Kc[128:160])
+	wantCiphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, wantTag[:aes.BlockSize]).XORKeyStream(wantCiphertext, plaintext)
+	ciphertext := got[headerLen+tagLen : len(got)-len(key.WKc)]
+	if !bytes.Equal(ciphertext, wantCiphertext) {
+		t.Errorf("ciphertext = %x, want %x", ciphertext, wantCiphertext)
+	}
+
+	// the WKc is appended in the clear, and like the server we find it using the length
+	// at the end of the packet, and unwrap it to recover the Kc.
+	wkcLen := int(binary.BigEndian.Uint16(got[len(got)-2:]))
+	if wkcLen != len(key.WKc) || !bytes.Equal(got[len(got)-wkcLen:], key.WKc) {
+		t.Fatalf("expected the WKc at the end of the packet")
+	}
+	kc, _, err := unwrapClientKey(testingServerKey, got[len(got)-wkcLen:])
+	if err != nil {
+		t.Fatalf("unwrapClientKey() error = %v", err)
+	}
+	server := makeTestingServerWrapper(&ClientKey{Kc: [kcLen]byte(kc)})
+	unwrapped, err := server.Unwrap(got[:len(got)-wkcLen])
+	if err != nil {
+		t.Fatalf("Unwrap() error = %v", err)
+	}
+	if !bytes.Equal(unwrapped, hardReset) {
+		t.Errorf("Unwrap() = %x, want %x", unwrapped, hardReset)
+	}
+
+	// we could not capture this packet from the reference implementation, so we pin the
+	// bytes we produce with the checks above, to notice if they ever change
+	const wantHex = "5011121314151617180000000101020304343ccf29f4c90994bd0e78487ef45aed1c947c6f954c5b3af90909887867c0" +
+		"b4154f568b771263aced51249c09d1d9aa4af5ed053ff42db6d80cfb696c93efc39cdeb626aa8913b978a62f20600af8" +
+		"7237f786947633838590e1c45734af027609b1432917cb69f423bce511ded85b2e0fc9ca5156218b538e5d3776f99912" +
+		"dcd7563b8e84bafae9d6efec362199805a642e4c855b3e4e1a10d72a82ff33e845951723df27df8e40698f8f01fc6adb" +
+		"bbf96c0c2b604641c751466f7119e56fd42e3a8f2c033230cd3c19bcf747839cd8cef231b04bbe7da49a9a592c8dc531" +
+		"d2d3f66745bcffb0740e4d04a72577a93cce6e7cbefe9c3ea6f03202876f92d0c974524c03ab4492693f9bbecf5b6164" +
+		"374ffc34cda9b04883169e5e30bc46dddd941362aecdc114ef513a0017494a216fa66d368a1c502423f578b09c79bc5a" +
+		"92a5dee35a65785ae25c91cc540a27012b"
+	if hex.EncodeToString(got) != wantHex {
+		t.Errorf("WrapHardReset() = %x", got)
+	}
+}
+
+func TestWrapper_WrapUnwrap(t *testing.T) {
+	key, err := ParseClientKey(makeTestingClientKeyPEM(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewWrapper(key)
+	server := makeTestingServerWrapper(key)
+
+	packet := []byte{0x20, 1, 2, 3, 4, 5, 6, 7, 8, 0x00, 0x00, 0x00, 0x00, 0x01, 'h', 'e', 'l', 'l', 'o'}
+
+	t.Run("the server can unwrap what the client wraps", func(t *testing.T) {
+		wrapped, err := client.Wrap(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := server.Unwrap(wrapped)
+		if err != nil {
+			t.Fatalf("Unwrap() error = %v", err)
+		}
+		if !bytes.Equal(got, packet) {
+			t.Errorf("Unwrap() = %x, want %x", got, packet)
+		}
+	})
+
+	t.Run("the client can unwrap what the server wraps", func(t *testing.T) {
+		wrapped, err := server.Wrap(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := client.Unwrap(wrapped)
+		if err != nil {
+			t.Fatalf("Unwrap() error = %v", err)
+		}
+		if !bytes.Equal(got, packet) {
+			t.Errorf("Unwrap() = %x, want %x", got, packet)
+		}
+	})
+
+	t.Run("the packet ID increases with each wrapped packet", func(t *testing.T) {
+		w := NewWrapper(key)
+		first, _ := w.Wrap(packet)
+		second, _ := w.Wrap(packet)
+		if binary.BigEndian.Uint32(first[9:13]) != 1 || binary.BigEndian.Uint32(second[9:13]) != 2 {
+			t.Errorf("unexpected packet IDs")
+		}
+	})
+
+	t.Run("a tampered packet fails to unwrap", func(t *testing.T) {
+		wrapped, err := client.Wrap(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped[len(wrapped)-1] ^= 0xff
+		if _, err := server.Unwrap(wrapped); !errors.Is(err, ErrCannotUnwrap) {
+			t.Errorf("Unwrap() error = %v, want %v", err, ErrCannotUnwrap)
+		}
+	})
+
+	t.Run("a short packet fails to unwrap", func(t *testing.T) {
+		if _, err := client.Unwrap([]byte{0x01}); !errors.Is(err, ErrCannotUnwrap) {
+			t.Errorf("Unwrap() error = %v, want %v", err, ErrCannotUnwrap)
+		}
+	})
+
+	t.Run("a short packet fails to wrap", func(t *testing.T) {
+		if _, err := client.Wrap([]byte{0x01}); !errors.Is(err, ErrCannotWrap) {
+			t.Errorf("Wrap() error = %v, want %v", err, ErrCannotWrap)
+		}
+	})
+}
@@ -12,9 +12,9 @@ package tlssession
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 
@@ -22,13 +22,25 @@ import (
 	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/session"
 	"github.com/ooni/minivpn/pkg/config"
+	"golang.org/x/exp/slices"
 )
 
+// encodeStaticChallengeResponse encodes the password and the response to a static
+// challenge using the SCRV1 scheme of the reference implementation.
+func encodeStaticChallengeResponse(password, response string) string {
+	return fmt.Sprintf(
+		"SCRV1:%s:%s",
+		base64.StdEncoding.EncodeToString([]byte(password)),
+		base64.StdEncoding.EncodeToString([]byte(response)),
+	)
+}
+
 // encodeClientControlMessage returns a byte array with the payload for a control channel packet.
 // This is the packet that the client sends to the server with the key
 // material, local options and credentials (if username+password authentication is used).
-func encodeClientControlMessageAsBytes(k *session.KeySource, o *config.OpenVPNOptions) ([]byte, error) {
-	opt, err := bytesx.EncodeOptionStringToBytes(o.ServerOptionsString())
+// The password is separate from the options, so that the caller can wipe it after use.
+func encodeClientControlMessageAsBytes(k *session.KeySource, o *config.OpenVPNOptions, serverOptions string, password []byte) ([]byte, error) {
+	opt, err := bytesx.EncodeOptionStringToBytes(serverOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -36,10 +48,11 @@ func encodeClientControlMessageAsBytes(k *session.KeySource, o *config.OpenVPNOp
 	if err != nil {
 		return nil, err
 	}
-	pass, err := bytesx.EncodeOptionStringToBytes(string(o.Password))
+	pass, err := bytesx.EncodeOptionBytesToBytes(password)
 	if err != nil {
 		return nil, err
 	}
+	defer bytesx.ZeroBytes(pass)
 
 	var out bytes.Buffer
 	out.Write(controlMessageHeader)
@@ -52,11 +65,61 @@ func encodeClientControlMessageAsBytes(k *session.KeySource, o *config.OpenVPNOp
 	// we could send IV_PLAT too, but afaik declaring the platform does not
 	// make any difference for our purposes.
 	rawInfo := fmt.Sprintf("IV_VER=%s\nIV_PROTO=%s\n", ivVer, ivProto)
+	if len(o.DataCiphers) > 0 {
+		// announce the ciphers we accept for the cipher negotiation
+		rawInfo += fmt.Sprintf("IV_CIPHERS=%s\n", strings.Join(o.DataCiphers, ":"))
+	}
 	peerInfo, _ := bytesx.EncodeOptionStringToBytes(rawInfo)
 	out.Write(peerInfo)
 	return out.Bytes(), nil
 }
 
+// encodeClientControlMessageKeyMethod1AsBytes returns the payload for the control channel
+// packet that the client sends to the server when using key-method 1. Differently from key-method 2,
+// there is no header: like write_key in the reference implementation, we send the cipher and hmac
+// key lengths, followed by the cipher and hmac keys we're going to use to encrypt, followed by the
+// NUL-terminated options string. Username and password are not sent.
+func encodeClientControlMessageKeyMethod1AsBytes(k *session.KeySource, o *config.OpenVPNOptions, serverOptions string) ([]byte, error) {
+	if k.Method1 == nil {
+		return nil, fmt.Errorf("%w: %s", errBadKeyMethod, "missing key-method 1 keys")
+	}
+	cipherLen, hmacLen, err := keyMethod1Lengths(o)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteByte(byte(cipherLen))
+	out.WriteByte(byte(hmacLen))
+	out.Write(k.Method1.Cipher[:cipherLen])
+	out.Write(k.Method1.HMAC[:hmacLen])
+	out.WriteString(serverOptions)
+	out.WriteByte(0x00)
+	return out.Bytes(), nil
+}
+
+// keyMethod1Lengths returns the cipher and hmac key lengths (in bytes) that we exchange when
+// using key-method 1, according to the configured cipher and auth.
+func keyMethod1Lengths(o *config.OpenVPNOptions) (int, int, error) {
+	dc, found := model.LookupDataCipher(o.Cipher)
+	if !found {
+		return 0, 0, fmt.Errorf("%w: bad cipher: %s", errBadKeyMethod, o.Cipher)
+	}
+	bits := dc.KeyBits
+	var hmacLen int
+	switch strings.ToLower(o.Auth) {
+	case "sha1":
+		hmacLen = 20
+	case "sha256":
+		hmacLen = 32
+	case "sha512":
+		hmacLen = 64
+	default:
+		return 0, 0, fmt.Errorf("%w: bad auth: %s", errBadKeyMethod, o.Auth)
+	}
+	return bits / 8, hmacLen, nil
+}
+
 // controlMessageHeader is the header prefixed to control messages
 var controlMessageHeader = []byte{0x00, 0x00, 0x00, 0x00}
 
@@ -113,6 +176,37 @@ func parseServerControlMessage(message []byte) (*session.KeySource, string, erro
 	return remoteKey, options, nil
 }
 
+// parseServerControlMessageKeyMethod1 gets a server control message sent using key-method 1 and
+// returns the remote key, the server remote options, and an error indicating if the operation
+// could not be completed. Like read_key in the reference implementation, we require the key
+// lengths to match the ones of the configured cipher and auth.
+func parseServerControlMessageKeyMethod1(message []byte, o *config.OpenVPNOptions) (*session.KeySource, string, error) {
+	cipherLen, hmacLen, err := keyMethod1Lengths(o)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(message) < 2 {
+		return nil, "", fmt.Errorf("%w: %s", errBadControlMessage, "missing key lengths")
+	}
+	if int(message[0]) != cipherLen || int(message[1]) != hmacLen {
+		return nil, "", fmt.Errorf("%w: bad key lengths: %d, %d", errBadControlMessage, message[0], message[1])
+	}
+	buf := bytes.NewBuffer(message[2:])
+	if buf.Len() < cipherLen+hmacLen {
+		return nil, "", fmt.Errorf("%w: %s", errBadControlMessage, "truncated keys")
+	}
+	km := &session.KeyMaterial{}
+	copy(km.Cipher[:], buf.Next(cipherLen))
+	copy(km.HMAC[:], buf.Next(hmacLen))
+
+	options, err := buf.ReadString(0x00)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s", errBadControlMessage, "bad options string")
+	}
+	remoteKey := &session.KeySource{Method1: km}
+	return remoteKey, strings.TrimSuffix(options, "\x00"), nil
+}
+
 // serverBadAuth indicates that the authentication failed
 var serverBadAuth = []byte("AUTH_FAILED")
 
@@ -122,6 +216,40 @@ var serverPushReply = []byte("PUSH_REPLY")
 // errBadAuth means we could not authenticate
 var errBadAuth = errors.New("server says: bad auth")
 
+// AuthError is the error returned when the server replies with AUTH_FAILED. It matches
+// errBadAuth with [errors.Is], and carries the reason sent by the server, if any.
+type AuthError struct {
+	// Reason is the reason sent by the server after AUTH_FAILED (e.g., "SESSION: your
+	// session has expired"), or an empty string if the server did not send any.
+	Reason string
+}
+
+// Error implements error.
+func (e *AuthError) Error() string {
+	if e.Reason == "" {
+		return errBadAuth.Error()
+	}
+	return fmt.Sprintf("%s: %s", errBadAuth.Error(), e.Reason)
+}
+
+// Is allows to match an [*AuthError] with errBadAuth.
+func (e *AuthError) Is(target error) bool {
+	return target == errBadAuth
+}
+
+// SessionExpired returns whether the server rejected an expired session or auth-token,
+// in which case we should authenticate again using the original credentials.
+func (e *AuthError) SessionExpired() bool {
+	return strings.HasPrefix(e.Reason, "SESSION:")
+}
+
+// newAuthError parses an AUTH_FAILED reply and returns the corresponding [*AuthError].
+func newAuthError(resp []byte) *AuthError {
+	reason := bytes.TrimPrefix(resp, serverBadAuth)
+	reason = bytes.TrimPrefix(reason, []byte(","))
+	return &AuthError{Reason: strings.TrimSpace(strings.TrimRight(string(reason), "\x00"))}
+}
+
 // errBadServerReply indicates we didn't get one of the few responses we expected
 var errBadServerReply = errors.New("bad server reply")
 
@@ -129,7 +257,7 @@ var errBadServerReply = errors.New("bad server reply")
 func parseServerPushReply(logger model.Logger, resp []byte) (*model.TunnelInfo, error) {
 	// make sure the server's response contains the expected result
 	if bytes.HasPrefix(resp, serverBadAuth) {
-		return nil, errBadAuth
+		return nil, newAuthError(resp)
 	}
 	if !bytes.HasPrefix(resp, serverPushReply) {
 		return nil, fmt.Errorf("%w:%s", errBadServerReply, "expected push reply")
@@ -137,19 +265,103 @@ func parseServerPushReply(logger model.Logger, resp []byte) (*model.TunnelInfo,
 
 	optsMap := pushedOptionsAsMap(resp)
 	logger.Infof("Server pushed options: %v", optsMap)
-	ti := newTunnelInfoFromPushedOptions(optsMap)
+	ti := newTunnelInfoFromPushedOptions(logger, optsMap)
+	ti.Routes = parsePushedRoutes(resp)
+	ti.DNS = parsePushedDNS(resp)
 	return ti, nil
 }
 
+// errPushRejected indicates that the remote pushed an option rejected by a pull-filter.
+var errPushRejected = errors.New("pushed option rejected by pull-filter")
+
+// noPullOptions are the pushed options we drop when route-nopull is set.
+var noPullOptions = []string{
+	"route",
+	"route-ipv6",
+	"redirect-gateway",
+	"redirect-private",
+	"dhcp-option",
+	"block-outside-dns",
+}
+
+// errCompressionNotAllowed indicates that the remote pushed compression, which allow-compression
+// does not allow.
+var errCompressionNotAllowed = errors.New("pushed compression not allowed by allow-compression")
+
+// filterPushReply applies the pull-filter and route-nopull options to a push reply, and returns
+// a push reply that only contains the options we accept. It fails if the remote pushed an option
+// rejected by a pull-filter, or compression that allow-compression does not allow. When the
+// policy allows the pushed compression, we keep it, so that the OCC reports the mismatch with
+// our compression framing. Other replies are returned unchanged.
+func filterPushReply(logger model.Logger, o *config.OpenVPNOptions, resp []byte) ([]byte, error) {
+	if !bytes.HasPrefix(resp, serverPushReply) {
+		return resp, nil
+	}
+	body := strings.TrimSuffix(string(resp), "\x00")
+	parts := strings.Split(body, ",")
+	kept := parts[:1]
+	for _, opt := range parts[1:] {
+		action := config.PullFilterAccept
+		for _, filter := range o.PullFilters {
+			if strings.HasPrefix(opt, filter.Text) {
+				action = filter.Action
+				break
+			}
+		}
+		if action == config.PullFilterAccept && o.RouteNoPull {
+			if key, _, _ := strings.Cut(opt, " "); slices.Contains(noPullOptions, key) {
+				action = config.PullFilterIgnore
+			}
+		}
+		if action == config.PullFilterAccept && isPushedCompression(opt) {
+			if !o.CompressionAllowed() {
+				return nil, fmt.Errorf("%w: %s", errCompressionNotAllowed, opt)
+			}
+			logger.Warnf("The remote pushed %s, but we cannot decompress, so we will drop compressed packets", opt)
+		}
+		switch action {
+		case config.PullFilterReject:
+			return nil, fmt.Errorf("%w: %s", errPushRejected, opt)
+		case config.PullFilterIgnore:
+			logger.Infof("Ignoring pushed option: %s", opt)
+		default:
+			kept = append(kept, opt)
+		}
+	}
+	out := []byte(strings.Join(kept, ","))
+	if len(body) != len(resp) {
+		out = append(out, 0x00)
+	}
+	return out, nil
+}
+
+// isPushedCompression returns whether the given pushed option enables compression, as
+// opposed to just the compression framing (e.g., compress stub or comp-lzo no).
+func isPushedCompression(opt string) bool {
+	fields := strings.Fields(opt)
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "compress":
+		return len(fields) > 1 && !slices.Contains([]string{"stub", "stub-v2", "migrate"}, fields[1])
+	case "comp-lzo":
+		return len(fields) == 1 || fields[1] != "no"
+	default:
+		return false
+	}
+}
+
 type remoteOptions map[string][]string
 
 // newTunnelInfoFromPushedOptions takes a remoteOptions map, and returns
 // a new tunnel struct with the relevant info.
-func newTunnelInfoFromPushedOptions(opts remoteOptions) *model.TunnelInfo {
+func newTunnelInfoFromPushedOptions(logger model.Logger, opts remoteOptions) *model.TunnelInfo {
 	t := &model.TunnelInfo{}
-	if r := opts["route"]; len(r) >= 1 {
+	// the route-gateway is the gateway, and only without it we fall back to the first route
+	if r := opts["route-gateway"]; len(r) >= 1 {
 		t.GW = r[0]
-	} else if r := opts["route-gateway"]; len(r) >= 1 {
+	} else if r := opts["route"]; len(r) >= 1 {
 		t.GW = r[0]
 	}
 	ifconfig := opts["ifconfig"]
@@ -159,11 +371,25 @@ func newTunnelInfoFromPushedOptions(opts remoteOptions) *model.TunnelInfo {
 	if len(ifconfig) >= 2 {
 		t.NetMask = ifconfig[1]
 	}
+	if ifconfig6 := opts["ifconfig-ipv6"]; len(ifconfig6) >= 1 {
+		// the address comes with the prefix length (e.g., fd00::1000/64)
+		t.IPv6, _, _ = strings.Cut(ifconfig6[0], "/")
+	}
+	if topology := opts["topology"]; len(topology) == 1 {
+		t.Topology = topology[0]
+	}
+	t.RedirectGateway, t.RedirectGatewayFlags = parseRedirectGateway(logger, opts)
+	_, t.BlockOutsideDNS = opts["block-outside-dns"]
+	if cipher := opts["cipher"]; len(cipher) == 1 {
+		t.Cipher = cipher[0]
+	}
+	t.Ping = parsePushedSeconds(logger, opts, "ping")
+	t.PingRestart = parsePushedSeconds(logger, opts, "ping-restart")
 	peerID := opts["peer-id"]
 	if len(peerID) == 1 {
 		peer, err := strconv.Atoi(peerID[0])
 		if err != nil {
-			log.Println("Cannot parse peer-id:", err.Error())
+			logger.Warnf("Cannot parse peer-id: %s", err.Error())
 		} else {
 			t.PeerID = peer
 		}
@@ -176,17 +402,107 @@ func newTunnelInfoFromPushedOptions(opts remoteOptions) *model.TunnelInfo {
 // This function always returns an initialized map, even if empty.
 func pushedOptionsAsMap(pushedOptions []byte) remoteOptions {
 	optMap := make(remoteOptions)
-	if len(pushedOptions) == 0 {
-		return optMap
+	for _, vals := range splitPushedOptions(pushedOptions) {
+		k, v := vals[0], vals[1:]
+		optMap[k] = v
 	}
+	return optMap
+}
 
+// splitPushedOptions returns the server-pushed options in order, each one split
+// into its space-separated fields. Unlike [pushedOptionsAsMap], repeated options are preserved.
+func splitPushedOptions(pushedOptions []byte) [][]string {
+	if len(pushedOptions) == 0 {
+		return [][]string{}
+	}
 	optStr := string(pushedOptions[:len(pushedOptions)-1])
+	out := [][]string{}
+	for _, opt := range strings.Split(optStr, ",") {
+		out = append(out, strings.Split(opt, " "))
+	}
+	return out
+}
 
-	opts := strings.Split(optStr, ",")
-	for _, opt := range opts {
-		vals := strings.Split(opt, " ")
-		k, v := vals[0], vals[1:]
-		optMap[k] = v
+// parsePushedSeconds returns the interval, in seconds, pushed with the given directive, or zero
+// if the remote did not push such directive.
+func parsePushedSeconds(logger model.Logger, opts remoteOptions, key string) int {
+	value := opts[key]
+	if len(value) != 1 {
+		return 0
 	}
-	return optMap
+	seconds, err := strconv.Atoi(value[0])
+	if err != nil || seconds < 0 {
+		logger.Warnf("Cannot parse %s: %s", key, value[0])
+		return 0
+	}
+	return seconds
+}
+
+// parseRedirectGateway returns whether the remote asked us to route all the traffic
+// through the tunnel, and the flags (def1, bypass-dhcp, etc.) it used. The flags are
+// irrelevant for deciding the routing intent, so we ignore the unknown ones.
+func parseRedirectGateway(logger model.Logger, opts remoteOptions) (bool, model.RedirectGatewayFlags) {
+	values, ok := opts["redirect-gateway"]
+	if !ok {
+		return false, model.RedirectGatewayFlags{}
+	}
+	flags, err := model.ParseRedirectGatewayFlags(values)
+	if err != nil {
+		logger.Warnf("Ignoring pushed redirect-gateway flag: %s", err.Error())
+	}
+	return true, flags
+}
+
+// mergeLocalRouting adds the redirect-gateway and block-outside-dns directives of the
+// config file to the tunnel info, when the remote did not push them.
+func mergeLocalRouting(o *config.OpenVPNOptions, ti *model.TunnelInfo) {
+	if o.RedirectGateway && !ti.RedirectGateway {
+		ti.RedirectGateway = true
+		ti.RedirectGatewayFlags = o.RedirectGatewayFlags
+	}
+	ti.BlockOutsideDNS = ti.BlockOutsideDNS || o.BlockOutsideDNS
+}
+
+// parsePushedRoutes returns all the routes pushed by the remote. The format of each
+// route directive is "route network [netmask] [gateway] [metric]".
+func parsePushedRoutes(pushedOptions []byte) []model.Route {
+	routes := []model.Route{}
+	for _, vals := range splitPushedOptions(pushedOptions) {
+		if vals[0] != "route" || len(vals) < 2 {
+			continue
+		}
+		route := model.Route{
+			Network: vals[1],
+			NetMask: "255.255.255.255",
+		}
+		if len(vals) >= 3 {
+			route.NetMask = vals[2]
+		}
+		if len(vals) >= 4 && vals[3] != "vpn_gateway" {
+			route.Gateway = vals[3]
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// parsePushedDNS returns all the DNS servers pushed by the remote with the
+// "dhcp-option DNS address" and "dhcp-option DNS6 address" directives.
+func parsePushedDNS(pushedOptions []byte) []string {
+	servers := []string{}
+	for _, vals := range splitPushedOptions(pushedOptions) {
+		if len(vals) == 3 && vals[0] == "dhcp-option" && (vals[1] == "DNS" || vals[1] == "DNS6") {
+			servers = append(servers, vals[2])
+		}
+	}
+	return servers
+}
+
+// parsePushedAuthToken returns the token pushed by the remote with the auth-token
+// directive, or an empty string if there's no such token.
+func parsePushedAuthToken(pushedOptions []byte) string {
+	if token := pushedOptionsAsMap(pushedOptions)["auth-token"]; len(token) == 1 {
+		return token[0]
+	}
+	return ""
 }
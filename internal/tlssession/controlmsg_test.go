@@ -3,10 +3,13 @@ package tlssession
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/session"
+	"github.com/ooni/minivpn/pkg/config"
 )
 
 func Test_NewTunnelInfoFromRemoteOptionsString(t *testing.T) {
@@ -64,7 +67,21 @@ func Test_NewTunnelInfoFromRemoteOptionsString(t *testing.T) {
 			want: &model.TunnelInfo{
 				IP:      "10.0.8.1",
 				NetMask: "255.255.255.0",
-				GW:      "1.1.3.3",
+				GW:      "1.1.2.2",
+			},
+		},
+		{
+			name: "get topology",
+			args: args{
+				remoteOptions{
+					"ifconfig": []string{"10.0.8.6", "10.0.8.5"},
+					"topology": []string{"net30"},
+				},
+			},
+			want: &model.TunnelInfo{
+				IP:       "10.0.8.6",
+				NetMask:  "10.0.8.5",
+				Topology: model.TopologyNet30,
 			},
 		},
 		{
@@ -84,12 +101,323 @@ func Test_NewTunnelInfoFromRemoteOptionsString(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			diff := cmp.Diff(newTunnelInfoFromPushedOptions(tt.args.remoteOpts), tt.want)
+			diff := cmp.Diff(newTunnelInfoFromPushedOptions(model.NewTestLogger(), tt.args.remoteOpts), tt.want)
 			if diff != "" {
 				t.Error(diff)
 			}
 		})
 	}
+
+	t.Run("the values we cannot parse are logged with the logger", func(t *testing.T) {
+		logger := model.NewTestLogger()
+		opts := remoteOptions{"peer-id": {"x"}, "ping": {"-1"}}
+		if diff := cmp.Diff(newTunnelInfoFromPushedOptions(logger, opts), &model.TunnelInfo{}); diff != "" {
+			t.Error(diff)
+		}
+		if len(logger.Lines) != 2 {
+			t.Errorf("expected two warnings, got %v", logger.Lines)
+		}
+	})
+}
+
+func Test_parseServerPushReply_routing(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want *model.TunnelInfo
+	}{
+		{
+			name: "redirect-gateway def1 bypass-dhcp",
+			resp: "PUSH_REPLY,redirect-gateway def1 bypass-dhcp,route-gateway 10.8.0.1,ifconfig 10.8.0.2 255.255.255.0\x00",
+			want: &model.TunnelInfo{
+				GW:                   "10.8.0.1",
+				IP:                   "10.8.0.2",
+				NetMask:              "255.255.255.0",
+				RedirectGateway:      true,
+				RedirectGatewayFlags: model.RedirectGatewayFlags{Def1: true, BypassDHCP: true},
+				Routes:               []model.Route{},
+				DNS:                  []string{},
+			},
+		},
+		{
+			name: "route-only push",
+			resp: "PUSH_REPLY,route-gateway 10.8.0.1,route 192.168.1.0 255.255.255.0,route 10.10.0.1,route 172.16.0.0 255.240.0.0 vpn_gateway,route 10.20.0.0 255.255.0.0 10.8.0.5\x00",
+			want: &model.TunnelInfo{
+				GW: "10.8.0.1",
+				Routes: []model.Route{
+					{Network: "192.168.1.0", NetMask: "255.255.255.0"},
+					{Network: "10.10.0.1", NetMask: "255.255.255.255"},
+					{Network: "172.16.0.0", NetMask: "255.240.0.0"},
+					{Network: "10.20.0.0", NetMask: "255.255.0.0", Gateway: "10.8.0.5"},
+				},
+				DNS: []string{},
+			},
+		},
+		{
+			name: "ping, ping-restart and cipher",
+			resp: "PUSH_REPLY,route-gateway 10.8.0.1,ping 10,ping-restart 120,ifconfig 10.8.0.2 255.255.255.0,cipher AES-256-GCM\x00",
+			want: &model.TunnelInfo{
+				Cipher:      "AES-256-GCM",
+				GW:          "10.8.0.1",
+				IP:          "10.8.0.2",
+				NetMask:     "255.255.255.0",
+				Ping:        10,
+				PingRestart: 120,
+				Routes:      []model.Route{},
+				DNS:         []string{},
+			},
+		},
+		{
+			name: "block-outside-dns and redirect-gateway with unknown flags",
+			resp: "PUSH_REPLY,block-outside-dns,redirect-gateway autolocal ipv6 !ipv4 frobnicate\x00",
+			want: &model.TunnelInfo{
+				RedirectGateway:      true,
+				RedirectGatewayFlags: model.RedirectGatewayFlags{AutoLocal: true, IPv6: true, NoIPv4: true},
+				BlockOutsideDNS:      true,
+				Routes:               []model.Route{},
+				DNS:                  []string{},
+			},
+		},
+		{
+			name: "dns servers",
+			resp: "PUSH_REPLY,dhcp-option DNS 10.8.0.1,dhcp-option DOMAIN example.org,dhcp-option DNS 1.1.1.1\x00",
+			want: &model.TunnelInfo{
+				Routes: []model.Route{},
+				DNS:    []string{"10.8.0.1", "1.1.1.1"},
+			},
+		},
+		{
+			name: "ipv6 address and dns servers",
+			resp: "PUSH_REPLY,ifconfig-ipv6 fd00::1000/64 fd00::1,dhcp-option DNS6 fd00::1,dhcp-option DNS 10.8.0.1\x00",
+			want: &model.TunnelInfo{
+				IPv6:   "fd00::1000",
+				Routes: []model.Route{},
+				DNS:    []string{"fd00::1", "10.8.0.1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerPushReply(model.NewTestLogger(), []byte(tt.resp))
+			if err != nil {
+				t.Fatalf("parseServerPushReply() error = %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_mergeLocalRouting(t *testing.T) {
+	local := &config.OpenVPNOptions{
+		RedirectGateway:      true,
+		RedirectGatewayFlags: model.RedirectGatewayFlags{Local: true},
+		BlockOutsideDNS:      true,
+	}
+	tests := []struct {
+		name    string
+		options *config.OpenVPNOptions
+		pushed  *model.TunnelInfo
+		want    *model.TunnelInfo
+	}{
+		{
+			name:    "without local directives we keep the pushed ones",
+			options: &config.OpenVPNOptions{},
+			pushed:  &model.TunnelInfo{RedirectGateway: true, RedirectGatewayFlags: model.RedirectGatewayFlags{Def1: true}},
+			want:    &model.TunnelInfo{RedirectGateway: true, RedirectGatewayFlags: model.RedirectGatewayFlags{Def1: true}},
+		},
+		{
+			name:    "the local directives apply when the remote did not push them",
+			options: local,
+			pushed:  &model.TunnelInfo{},
+			want: &model.TunnelInfo{
+				RedirectGateway:      true,
+				RedirectGatewayFlags: model.RedirectGatewayFlags{Local: true},
+				BlockOutsideDNS:      true,
+			},
+		},
+		{
+			name:    "the pushed redirect-gateway flags win",
+			options: local,
+			pushed:  &model.TunnelInfo{RedirectGateway: true, RedirectGatewayFlags: model.RedirectGatewayFlags{Def1: true}},
+			want: &model.TunnelInfo{
+				RedirectGateway:      true,
+				RedirectGatewayFlags: model.RedirectGatewayFlags{Def1: true},
+				BlockOutsideDNS:      true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mergeLocalRouting(tt.options, tt.pushed)
+			if diff := cmp.Diff(tt.want, tt.pushed); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_filterPushReply(t *testing.T) {
+	resp := "PUSH_REPLY,route-gateway 10.8.0.1,dhcp-option DNS 10.8.0.1,redirect-gateway def1," +
+		"dhcp-option DNS 1.1.1.1,ifconfig 10.8.0.2 255.255.255.0\x00"
+
+	tests := []struct {
+		name    string
+		options *config.OpenVPNOptions
+		want    *model.TunnelInfo
+		wantErr error
+	}{
+		{
+			name:    "without filters we keep everything",
+			options: &config.OpenVPNOptions{},
+			want: &model.TunnelInfo{
+				GW:                   "10.8.0.1",
+				IP:                   "10.8.0.2",
+				NetMask:              "255.255.255.0",
+				RedirectGateway:      true,
+				RedirectGatewayFlags: model.RedirectGatewayFlags{Def1: true},
+				Routes:               []model.Route{},
+				DNS:                  []string{"10.8.0.1", "1.1.1.1"},
+			},
+		},
+		{
+			name: "ignoring dhcp-option removes the DNS servers",
+			options: &config.OpenVPNOptions{
+				PullFilters: []config.PullFilter{{Action: config.PullFilterIgnore, Text: "dhcp-option"}},
+			},
+			want: &model.TunnelInfo{
+				GW:                   "10.8.0.1",
+				IP:                   "10.8.0.2",
+				NetMask:              "255.255.255.0",
+				RedirectGateway:      true,
+				RedirectGatewayFlags: model.RedirectGatewayFlags{Def1: true},
+				Routes:               []model.Route{},
+				DNS:                  []string{},
+			},
+		},
+		{
+			name: "the first matching filter wins",
+			options: &config.OpenVPNOptions{
+				PullFilters: []config.PullFilter{
+					{Action: config.PullFilterAccept, Text: "dhcp-option DNS 1.1.1.1"},
+					{Action: config.PullFilterIgnore, Text: "dhcp-option DNS"},
+					{Action: config.PullFilterIgnore, Text: "redirect-gateway"},
+				},
+			},
+			want: &model.TunnelInfo{
+				GW:      "10.8.0.1",
+				IP:      "10.8.0.2",
+				NetMask: "255.255.255.0",
+				Routes:  []model.Route{},
+				DNS:     []string{"1.1.1.1"},
+			},
+		},
+		{
+			name:    "route-nopull drops routes and dhcp options",
+			options: &config.OpenVPNOptions{RouteNoPull: true},
+			want: &model.TunnelInfo{
+				GW:      "10.8.0.1",
+				IP:      "10.8.0.2",
+				NetMask: "255.255.255.0",
+				Routes:  []model.Route{},
+				DNS:     []string{},
+			},
+		},
+		{
+			name: "a rejected option fails",
+			options: &config.OpenVPNOptions{
+				PullFilters: []config.PullFilter{{Action: config.PullFilterReject, Text: "redirect-gateway"}},
+			},
+			wantErr: errPushRejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := filterPushReply(model.NewTestLogger(), tt.options, []byte(resp))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("filterPushReply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			got, err := parseServerPushReply(model.NewTestLogger(), data)
+			if err != nil {
+				t.Fatalf("parseServerPushReply() error = %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+
+	t.Run("route-nopull drops the pushed routes", func(t *testing.T) {
+		options := &config.OpenVPNOptions{RouteNoPull: true}
+		data, err := filterPushReply(model.NewTestLogger(), options, []byte("PUSH_REPLY,route 10.0.0.0 255.0.0.0,ping 10\x00"))
+		if err != nil || string(data) != "PUSH_REPLY,ping 10\x00" {
+			t.Errorf("filterPushReply() = %q, %v", data, err)
+		}
+	})
+
+	t.Run("allow-compression no rejects a pushed compression", func(t *testing.T) {
+		options := &config.OpenVPNOptions{Compress: config.CompressionStub, AllowCompression: config.AllowCompressionNo}
+		for _, opt := range []string{"compress lz4", "comp-lzo", "comp-lzo yes"} {
+			reply := []byte("PUSH_REPLY," + opt + ",ping 10\x00")
+			if _, err := filterPushReply(model.NewTestLogger(), options, reply); !errors.Is(err, errCompressionNotAllowed) {
+				t.Errorf("filterPushReply(%q) error = %v, want %v", opt, err, errCompressionNotAllowed)
+			}
+		}
+	})
+
+	t.Run("allow-compression no keeps the pushed compression framing", func(t *testing.T) {
+		options := &config.OpenVPNOptions{Compress: config.CompressionStub}
+		data, err := filterPushReply(model.NewTestLogger(), options, []byte("PUSH_REPLY,compress stub,ping 10\x00"))
+		if err != nil || string(data) != "PUSH_REPLY,compress stub,ping 10\x00" {
+			t.Errorf("filterPushReply() = %q, %v", data, err)
+		}
+	})
+
+	t.Run("allow-compression asym keeps a pushed compression", func(t *testing.T) {
+		options := &config.OpenVPNOptions{AllowCompression: config.AllowCompressionAsym}
+		data, err := filterPushReply(model.NewTestLogger(), options, []byte("PUSH_REPLY,compress lz4,ping 10\x00"))
+		if err != nil || string(data) != "PUSH_REPLY,compress lz4,ping 10\x00" {
+			t.Errorf("filterPushReply() = %q, %v", data, err)
+		}
+	})
+
+	t.Run("other replies are not changed", func(t *testing.T) {
+		options := &config.OpenVPNOptions{RouteNoPull: true}
+		data, err := filterPushReply(model.NewTestLogger(), options, []byte("AUTH_FAILED,route x\x00"))
+		if err != nil || string(data) != "AUTH_FAILED,route x\x00" {
+			t.Errorf("filterPushReply() = %q, %v", data, err)
+		}
+	})
+}
+
+func Test_isPushedCompression(t *testing.T) {
+	tests := []struct {
+		opt  string
+		want bool
+	}{
+		{"compress lz4", true},
+		{"compress lzo", true},
+		{"comp-lzo", true},
+		{"comp-lzo yes", true},
+		{"comp-lzo adaptive", true},
+		{"compress", false},
+		{"compress stub", false},
+		{"compress stub-v2", false},
+		{"compress migrate", false},
+		{"comp-lzo no", false},
+		{"route-gateway 10.8.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.opt, func(t *testing.T) {
+			if got := isPushedCompression(tt.opt); got != tt.want {
+				t.Errorf("isPushedCompression(%q) = %v, want %v", tt.opt, got, tt.want)
+			}
+		})
+	}
 }
 
 func Test_pushedOptionsAsMap(t *testing.T) {
@@ -145,3 +473,179 @@ func Test_parseServerControlMessage(t *testing.T) {
 		t.Errorf("parseServerControlMessage(). got R2 = %v, want %v", gotKeySource.R2, wantRandom2)
 	}
 }
+
+func Test_encodeClientControlMessageKeyMethod1AsBytes(t *testing.T) {
+	km := &session.KeyMaterial{}
+	for i := range km.Cipher {
+		km.Cipher[i] = 0xaa
+		km.HMAC[i] = 0xbb
+	}
+	ks := &session.KeySource{Method1: km}
+	opts := &config.OpenVPNOptions{
+		Cipher:    "AES-128-CBC",
+		Auth:      "SHA1",
+		Proto:     config.ProtoUDP,
+		KeyMethod: 1,
+		Username:  "user",
+		Password:  "password",
+	}
+
+	t.Run("key-method 1 layout", func(t *testing.T) {
+		got, err := encodeClientControlMessageKeyMethod1AsBytes(ks, opts, opts.ServerOptionsString())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := &bytes.Buffer{}
+		want.WriteByte(16)
+		want.WriteByte(20)
+		want.Write(bytes.Repeat([]byte{0xaa}, 16))
+		want.Write(bytes.Repeat([]byte{0xbb}, 20))
+		want.WriteString(opts.ServerOptionsString())
+		want.WriteByte(0x00)
+		if diff := cmp.Diff(want.Bytes(), got); diff != "" {
+			t.Error(diff)
+		}
+	})
+
+	t.Run("key-method 1 differs from key-method 2", func(t *testing.T) {
+		method1, err := encodeClientControlMessageKeyMethod1AsBytes(ks, opts, opts.ServerOptionsString())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		method2, err := encodeClientControlMessageAsBytes(ks, opts, opts.ServerOptionsString(), []byte(opts.Password))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// key-method 2 has the all-zero header followed by the key method.
+		if !bytes.Equal(method2[:5], []byte{0x00, 0x00, 0x00, 0x00, 0x02}) {
+			t.Errorf("unexpected key-method 2 header: %x", method2[:5])
+		}
+		// key-method 1 starts with the key lengths, and does not carry credentials.
+		if !bytes.Equal(method1[:2], []byte{16, 20}) {
+			t.Errorf("unexpected key-method 1 header: %x", method1[:2])
+		}
+		if bytes.Contains(method1, []byte("password")) {
+			t.Error("key-method 1 should not send credentials")
+		}
+		if !bytes.Contains(method1, []byte("key-method 1")) {
+			t.Error("key-method 1 should advertise key-method 1 in the options string")
+		}
+	})
+
+	t.Run("missing key material should fail", func(t *testing.T) {
+		_, err := encodeClientControlMessageKeyMethod1AsBytes(&session.KeySource{}, opts, opts.ServerOptionsString())
+		if !errors.Is(err, errBadKeyMethod) {
+			t.Errorf("expected errBadKeyMethod, got %v", err)
+		}
+	})
+
+	t.Run("unknown auth should fail", func(t *testing.T) {
+		badOpts := *opts
+		badOpts.Auth = "MD4"
+		_, err := encodeClientControlMessageKeyMethod1AsBytes(ks, &badOpts, badOpts.ServerOptionsString())
+		if !errors.Is(err, errBadKeyMethod) {
+			t.Errorf("expected errBadKeyMethod, got %v", err)
+		}
+	})
+}
+
+func Test_parseServerControlMessageKeyMethod1(t *testing.T) {
+	opts := &config.OpenVPNOptions{Cipher: "AES-128-CBC", Auth: "SHA1", KeyMethod: 1}
+
+	t.Run("parse a well-formed message", func(t *testing.T) {
+		msg := &bytes.Buffer{}
+		msg.WriteByte(16)
+		msg.WriteByte(20)
+		msg.Write(bytes.Repeat([]byte{0x01}, 16))
+		msg.Write(bytes.Repeat([]byte{0x02}, 20))
+		msg.WriteString("V4,key-method 1,tls-server")
+		msg.WriteByte(0x00)
+
+		ks, options, err := parseServerControlMessageKeyMethod1(msg.Bytes(), opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if options != "V4,key-method 1,tls-server" {
+			t.Errorf("unexpected options: %q", options)
+		}
+		if !bytes.Equal(ks.Method1.Cipher[:16], bytes.Repeat([]byte{0x01}, 16)) {
+			t.Errorf("unexpected cipher key: %x", ks.Method1.Cipher)
+		}
+		if !bytes.Equal(ks.Method1.HMAC[:20], bytes.Repeat([]byte{0x02}, 20)) {
+			t.Errorf("unexpected hmac key: %x", ks.Method1.HMAC)
+		}
+	})
+
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty message", []byte{}},
+		{"unexpected cipher key length", append([]byte{32, 20}, bytes.Repeat([]byte{0x01}, 52)...)},
+		{"unexpected hmac key length", append([]byte{16, 32}, bytes.Repeat([]byte{0x01}, 48)...)},
+		{"truncated key", []byte{16, 20, 0x01, 0x02}},
+		{"missing options terminator", append(append([]byte{16, 20}, bytes.Repeat([]byte{0x01}, 36)...), 'V', '4')},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := parseServerControlMessageKeyMethod1(tt.msg, opts); !errors.Is(err, errBadControlMessage) {
+				t.Errorf("expected errBadControlMessage, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_keyMethod1RoundTrip(t *testing.T) {
+	km, err := session.NewKeyMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &config.OpenVPNOptions{Cipher: "AES-256-CBC", Auth: "SHA256", KeyMethod: 1}
+	encoded, err := encodeClientControlMessageKeyMethod1AsBytes(&session.KeySource{Method1: km}, opts, opts.ServerOptionsString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, options, err := parseServerControlMessageKeyMethod1(encoded, opts)
+	if err != nil {
+		t.Fatalf("parseServerControlMessageKeyMethod1() error = %v", err)
+	}
+	if options != opts.ServerOptionsString() {
+		t.Errorf("unexpected options: %q", options)
+	}
+	if !bytes.Equal(ks.Method1.Cipher[:32], km.Cipher[:32]) || !bytes.Equal(ks.Method1.HMAC[:32], km.HMAC[:32]) {
+		t.Error("the parsed keys differ from the encoded ones")
+	}
+}
+
+func Test_parseServerPushReply_authFailed(t *testing.T) {
+	tests := []struct {
+		name               string
+		resp               string
+		wantReason         string
+		wantSessionExpired bool
+	}{
+		{"without reason", "AUTH_FAILED\x00", "", false},
+		{"bad credentials", "AUTH_FAILED,Invalid username or password\x00", "Invalid username or password", false},
+		{"expired session", "AUTH_FAILED,SESSION: your session has expired\x00", "SESSION: your session has expired", true},
+		{"expired auth-token", "AUTH_FAILED,SESSION:Your session token has expired", "SESSION:Your session token has expired", true},
+		{"temporary failure", "AUTH_FAILED,TEMP: server busy, try later\x00", "TEMP: server busy, try later", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseServerPushReply(model.NewTestLogger(), []byte(tt.resp))
+			if !errors.Is(err, errBadAuth) {
+				t.Fatalf("expected %v, got %v", errBadAuth, err)
+			}
+			var authErr *AuthError
+			if !errors.As(err, &authErr) {
+				t.Fatalf("expected an *AuthError, got %T", err)
+			}
+			if authErr.Reason != tt.wantReason {
+				t.Errorf("Reason = %q, want %q", authErr.Reason, tt.wantReason)
+			}
+			if authErr.SessionExpired() != tt.wantSessionExpired {
+				t.Errorf("SessionExpired() = %v, want %v", authErr.SessionExpired(), tt.wantSessionExpired)
+			}
+		})
+	}
+}
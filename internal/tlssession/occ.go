@@ -0,0 +1,116 @@
+package tlssession
+
+//
+// Options consistency check (OCC)
+//
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ooni/minivpn/internal/model"
+)
+
+// errOptionsMismatch indicates that the remote options are not compatible with ours.
+var errOptionsMismatch = errors.New("options mismatch")
+
+// optionsStringAsMap returns a map for the comma-separated options string exchanged
+// during the handshake (e.g., "V4,dev-type tun,cipher AES-256-GCM,...").
+func optionsStringAsMap(options string) remoteOptions {
+	optMap := make(remoteOptions)
+	for _, opt := range strings.Split(options, ",") {
+		vals := strings.Split(opt, " ")
+		optMap[vals[0]] = vals[1:]
+	}
+	return optMap
+}
+
+// compressionFromOptions returns a normalized representation of the compression
+// declared in the options, or an empty string if there's no compression.
+func compressionFromOptions(opts remoteOptions) string {
+	if v, ok := opts["compress"]; ok {
+		return strings.TrimSpace("compress " + strings.Join(v, " "))
+	}
+	if v, ok := opts["comp-lzo"]; ok {
+		return strings.TrimSpace("comp-lzo " + strings.Join(v, " "))
+	}
+	if v, ok := opts["lzo-comp"]; ok {
+		return strings.TrimSpace("comp-lzo " + strings.Join(v, " "))
+	}
+	return ""
+}
+
+// firstValue returns the first value for the given key, or an empty string.
+func firstValue(opts remoteOptions, key string) string {
+	if v := opts[key]; len(v) >= 1 {
+		return v[0]
+	}
+	return ""
+}
+
+// checkOptionsConsistency compares our options string with the options string sent by the remote
+// and with the options pushed by the remote, and returns an error listing the incompatible
+// options, if any. We only check the options that would lead to a broken data channel (cipher,
+// auth, compression and MTU); other differences (e.g., link-mtu) are expected. The negotiated
+// argument is the data channel cipher returned by [config.OpenVPNOptions.NegotiateCipher], or
+// the empty string when we use the cipher in our options string.
+func checkOptionsConsistency(local, remote, negotiated string, pushed remoteOptions) error {
+	localOpts := optionsStringAsMap(local)
+	remoteOpts := optionsStringAsMap(remote)
+	mismatches := []string{}
+
+	// with NCP we use the negotiated cipher, which may differ from the configured one, and
+	// a pushed cipher is the result of the negotiation and takes precedence
+	localCipher := firstValue(localOpts, "cipher")
+	if negotiated != "" {
+		localCipher = negotiated
+	}
+	remoteCipher := firstValue(remoteOpts, "cipher")
+	if pushedCipher := firstValue(pushed, "cipher"); pushedCipher != "" {
+		remoteCipher = pushedCipher
+	}
+	if remoteCipher != "" && !strings.EqualFold(localCipher, remoteCipher) {
+		mismatches = append(mismatches, fmt.Sprintf("cipher %s != %s", localCipher, remoteCipher))
+	}
+
+	// AEAD ciphers do not use the auth digest, so the remote advertises a null digest
+	isAEAD := isAEADCipher(localCipher)
+	localAuth := firstValue(localOpts, "auth")
+	remoteAuth := firstValue(remoteOpts, "auth")
+	if !isAEAD && remoteAuth != "" && !strings.EqualFold(localAuth, remoteAuth) {
+		mismatches = append(mismatches, fmt.Sprintf("auth %s != %s", localAuth, remoteAuth))
+	}
+
+	// the remote can either declare the compression in the options string or push it
+	localCompress := compressionFromOptions(localOpts)
+	remoteCompress := compressionFromOptions(remoteOpts)
+	if pushedCompress := compressionFromOptions(pushed); pushedCompress != "" {
+		remoteCompress = pushedCompress
+	}
+	if localCompress != remoteCompress {
+		mismatches = append(mismatches, fmt.Sprintf("compression %q != %q", localCompress, remoteCompress))
+	}
+
+	localMTU := firstValue(localOpts, "tun-mtu")
+	remoteMTU := firstValue(remoteOpts, "tun-mtu")
+	if pushedMTU := firstValue(pushed, "tun-mtu"); pushedMTU != "" {
+		remoteMTU = pushedMTU
+	}
+	if remoteMTU != "" && localMTU != remoteMTU {
+		mismatches = append(mismatches, fmt.Sprintf("tun-mtu %s != %s", localMTU, remoteMTU))
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%w: %s", errOptionsMismatch, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// isAEADCipher returns whether the given data channel cipher is an AEAD cipher.
+func isAEADCipher(name string) bool {
+	if dc, ok := model.LookupDataCipher(name); ok {
+		return dc.Mode == "gcm"
+	}
+	return strings.HasSuffix(strings.ToUpper(name), "-GCM")
+}
@@ -0,0 +1,93 @@
+package tlssession
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_checkOptionsConsistency(t *testing.T) {
+	const local = "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-256-GCM,auth SHA512,keysize 256,key-method 2,tls-client,compress stub"
+
+	tests := []struct {
+		name       string
+		local      string
+		remote     string
+		negotiated string
+		pushed     remoteOptions
+		wantErr    error
+	}{
+		{
+			name:    "matching options",
+			local:   local,
+			remote:  "V4,dev-type tun,link-mtu 1551,tun-mtu 1500,proto UDPv4_SERVER,cipher AES-256-GCM,auth [null-digest],keysize 256,key-method 2,tls-server,compress stub",
+			pushed:  remoteOptions{},
+			wantErr: nil,
+		},
+		{
+			name:    "a pushed cipher overrides the remote options string",
+			local:   local,
+			remote:  "V4,dev-type tun,tun-mtu 1500,cipher BF-CBC,auth SHA1,key-method 2,tls-server,compress stub",
+			pushed:  remoteOptions{"cipher": {"AES-256-GCM"}},
+			wantErr: nil,
+		},
+		{
+			name:       "a negotiated cipher that differs from the configured one",
+			local:      "V4,dev-type tun,tun-mtu 1500,cipher AES-256-CBC,auth SHA1,keysize 256,key-method 2,tls-client",
+			remote:     "V4,dev-type tun,tun-mtu 1500,cipher AES-256-CBC,auth [null-digest],key-method 2,tls-server",
+			negotiated: "AES-256-GCM",
+			pushed:     remoteOptions{"cipher": {"AES-256-GCM"}},
+			wantErr:    nil,
+		},
+		{
+			name:       "the negotiated fallback cipher is checked against the remote options string",
+			local:      "V4,dev-type tun,tun-mtu 1500,cipher AES-256-GCM,auth SHA1,keysize 256,key-method 2,tls-client",
+			remote:     "V4,dev-type tun,tun-mtu 1500,cipher AES-128-CBC,auth SHA1,key-method 2,tls-server",
+			negotiated: "AES-128-CBC",
+			pushed:     remoteOptions{},
+			wantErr:    nil,
+		},
+		{
+			name:    "a pushed compression overrides the remote options string",
+			local:   local,
+			remote:  "V4,dev-type tun,tun-mtu 1500,cipher AES-256-GCM,auth [null-digest],key-method 2,tls-server",
+			pushed:  remoteOptions{"compress": {"stub"}},
+			wantErr: nil,
+		},
+		{
+			name:    "cipher mismatch",
+			local:   local,
+			remote:  "V4,dev-type tun,tun-mtu 1500,cipher AES-128-CBC,auth SHA1,key-method 2,tls-server,compress stub",
+			pushed:  remoteOptions{},
+			wantErr: errOptionsMismatch,
+		},
+		{
+			name:    "auth mismatch with a non-AEAD cipher",
+			local:   "V4,dev-type tun,tun-mtu 1500,cipher AES-128-CBC,auth SHA512,key-method 2,tls-client",
+			remote:  "V4,dev-type tun,tun-mtu 1500,cipher AES-128-CBC,auth SHA1,key-method 2,tls-server",
+			pushed:  remoteOptions{},
+			wantErr: errOptionsMismatch,
+		},
+		{
+			name:    "compression mismatch",
+			local:   local,
+			remote:  "V4,dev-type tun,tun-mtu 1500,cipher AES-256-GCM,auth [null-digest],key-method 2,tls-server,comp-lzo",
+			pushed:  remoteOptions{},
+			wantErr: errOptionsMismatch,
+		},
+		{
+			name:    "mtu mismatch",
+			local:   local,
+			remote:  "V4,dev-type tun,tun-mtu 1400,cipher AES-256-GCM,auth [null-digest],key-method 2,tls-server,compress stub",
+			pushed:  remoteOptions{},
+			wantErr: errOptionsMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOptionsConsistency(tt.local, tt.remote, tt.negotiated, tt.pushed)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkOptionsConsistency() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
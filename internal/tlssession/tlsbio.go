@@ -9,7 +9,10 @@ import (
 	"github.com/ooni/minivpn/internal/model"
 )
 
-// tlsBio allows to use channels to read and write
+// tlsBio allows to use channels to read and write. Reads see the payloads of the
+// control packets as a byte stream, in the order in which the control channel delivers
+// them, hence a TLS record split across several control packets (e.g., a large server
+// certificate chain) is reassembled by the TLS layer reading from the stream.
 type tlsBio struct {
 	closeOnce     sync.Once
 	directionDown chan<- []byte
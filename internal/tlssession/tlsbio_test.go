@@ -1,6 +1,9 @@
 package tlssession
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"testing"
 	"time"
 
@@ -35,6 +38,33 @@ func Test_tlsBio(t *testing.T) {
 		}
 	})
 
+	t.Run("a TLS record split across control packets is reassembled in order", func(t *testing.T) {
+		body := make([]byte, 3000)
+		for i := range body {
+			body[i] = byte(i)
+		}
+		record := append([]byte{0x16, 0x03, 0x03, 0x0b, 0xb8}, body...) // handshake, 3000 bytes
+
+		up := make(chan []byte, 10)
+		down := make(chan []byte, 10)
+		up <- record[:1000]
+		up <- record[1000:]
+		tls := newTLSBio(log.Log, up, down)
+
+		// read like the TLS layer does: first the header, then the body
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(tls, header); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		if _, err := io.ReadFull(tls, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Error("the record body was not reassembled in order")
+		}
+	})
+
 	t.Run("write sends bytes down", func(t *testing.T) {
 		up := make(chan []byte, 10)
 		down := make(chan []byte, 10)
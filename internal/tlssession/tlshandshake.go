@@ -1,17 +1,23 @@
 package tlssession
 
 import (
+	"crypto"
+	"crypto/sha256"
+	stdtls "crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 
 	"github.com/ooni/minivpn/internal/runtimex"
 	"github.com/ooni/minivpn/pkg/config"
 
 	tls "github.com/refraction-networking/utls"
+	"golang.org/x/exp/slices"
 )
 
 var (
@@ -47,22 +53,23 @@ var certVerifyOptions = certVerifyOptionsNoCommonNameCheck
 // certPaths holds the paths for the cert, key, and ca used for OpenVPN
 // certificate authentication.
 type certPaths struct {
-	certPath string
-	keyPath  string
-	caPath   string
+	certPath     string
+	keyPath      string
+	caPath       string
+	extraCAPaths []string
+	caDir        string
+
+	// pinned is true when we pin the server certificate, so that the CA is OPTIONAL.
+	pinned bool
 }
 
 // loadCertAndCAFromPath parses the PEM certificates contained in the paths pointed by
 // the passed certPaths and return a certConfig with the client and CA certificates.
+// All the CA files, and all the files in the CA directory, go into the same pool.
 func loadCertAndCAFromPath(pth certPaths) (*certConfig, error) {
-	ca := x509.NewCertPool()
-	caData, err := os.ReadFile(pth.caPath)
+	ca, err := loadCAPool(pth)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %s", ErrBadCA, err)
-	}
-	ok := ca.AppendCertsFromPEM(caData)
-	if !ok {
-		return nil, fmt.Errorf("%w: %s", ErrBadCA, "cannot parse ca cert")
+		return nil, err
 	}
 
 	cfg := &certConfig{ca: ca}
@@ -76,21 +83,69 @@ func loadCertAndCAFromPath(pth certPaths) (*certConfig, error) {
 	return cfg, nil
 }
 
+// loadCAPool returns a certpool with the CA certificates found in the CA files and
+// in the CA directory of the passed certPaths. Every CA file must contain at least a
+// certificate, while we skip the files in the CA directory that do not.
+func loadCAPool(pth certPaths) (*x509.CertPool, error) {
+	ca := x509.NewCertPool()
+	files := pth.extraCAPaths
+	if pth.caPath != "" {
+		files = append([]string{pth.caPath}, files...)
+	}
+	for _, file := range files {
+		caData, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadCA, err)
+		}
+		if ok := ca.AppendCertsFromPEM(caData); !ok {
+			return nil, fmt.Errorf("%w: %s: %s", ErrBadCA, "cannot parse ca cert", file)
+		}
+	}
+
+	found := len(files) > 0
+	if pth.caDir != "" {
+		entries, err := os.ReadDir(pth.caDir)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadCA, err)
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			caData, err := os.ReadFile(filepath.Join(pth.caDir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrBadCA, err)
+			}
+			if ca.AppendCertsFromPEM(caData) {
+				found = true
+			}
+		}
+	}
+	if !found && !pth.pinned {
+		return nil, fmt.Errorf("%w: %s", ErrBadCA, "cannot find any ca cert")
+	}
+	return ca, nil
+}
+
 // certBytes holds the byte arrays for the cert, key, and ca used for OpenVPN
 // certificate authentication.
 type certBytes struct {
 	cert []byte
 	key  []byte
 	ca   []byte
+
+	// pinned is true when we pin the server certificate, so that the CA is OPTIONAL.
+	pinned bool
 }
 
 // loadCertAndCAFromBytes parses the PEM certificates from the byte arrays in the
 // the passed certBytes, and return a certConfig with the client and CA certificates.
 func loadCertAndCAFromBytes(crt certBytes) (*certConfig, error) {
 	ca := x509.NewCertPool()
-	ok := ca.AppendCertsFromPEM(crt.ca)
-	if !ok {
-		return nil, fmt.Errorf("%w: %s", ErrBadCA, "cannot parse ca cert")
+	if len(crt.ca) != 0 || !crt.pinned {
+		if ok := ca.AppendCertsFromPEM(crt.ca); !ok {
+			return nil, fmt.Errorf("%w: %s", ErrBadCA, "cannot parse ca cert")
+		}
 	}
 	cfg := &certConfig{ca: ca}
 	if crt.cert != nil && crt.key != nil {
@@ -103,40 +158,181 @@ func loadCertAndCAFromBytes(crt certBytes) (*certConfig, error) {
 	return cfg, nil
 }
 
+// loadCertWithSigner parses the PEM client certificate in certPEM and returns a
+// tls.Certificate that delegates the handshake signature to the passed signer.
+func loadCertWithSigner(certPEM []byte, signer crypto.Signer) (tls.Certificate, error) {
+	cert := tls.Certificate{PrivateKey: signer}
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("%w: %s", ErrBadKeypair, "cannot parse client cert")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%w: %s", ErrBadKeypair, err)
+	}
+	if !publicKeyMatches(leaf.PublicKey, signer.Public()) {
+		return tls.Certificate{}, fmt.Errorf("%w: %s", ErrBadKeypair, "signer does not match cert")
+	}
+	return cert, nil
+}
+
+// publicKeyMatches returns true if the two public keys are equal.
+func publicKeyMatches(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
 // authorityPinner is any object from which we can obtain a certpool containing
-// a pinned Certificate Authority for verification.
+// a pinned Certificate Authority for verification, and the SHA-256 fingerprints
+// of the pinned server certificates, if any.
 type authorityPinner interface {
 	authority() *x509.CertPool
+	peerFingerprints() [][32]byte
+	hostname() string
 }
 
 // certConfig holds the parsed certificate and CA used for OpenVPN mutual
 // certificate authentication.
 type certConfig struct {
-	cert tls.Certificate
-	ca   *x509.CertPool
+	cert         tls.Certificate
+	ca           *x509.CertPool
+	fingerprints [][32]byte
+
+	// cipherSuites are the TLS 1.2 cipher suites we allow, if restricted. We restrict the
+	// TLS 1.3 cipher suites, when parroting, in the [tlsFactory] (see [tlsFactoryFromOptions]).
+	cipherSuites []uint16
+
+	// verifyHostname is the name we send as SNI and verify in the server certificate.
+	// When empty, we do not send SNI and we do not verify the name.
+	verifyHostname string
+
+	// verifyPeerCertificate, when set, replaces the verify function returned by
+	// customVerifyFactory.
+	verifyPeerCertificate verifyFun
 }
 
 // newCertConfigFromOptions is a constructor that returns a certConfig object initialized
 // from the paths specified in the passed Options object, and an error if it
 // could not be properly built.
 func newCertConfigFromOptions(o *config.OpenVPNOptions) (*certConfig, error) {
+	creds, err := o.LoadCredentials(func() (*config.Credentials, error) {
+		loaded, err := loadCertConfig(o)
+		if err != nil {
+			return nil, err
+		}
+		return &config.Credentials{Certificate: stdCertificate(loaded.cert), CAPool: loaded.ca}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &certConfig{cert: utlsCertificate(creds.Certificate), ca: creds.CAPool}
+	cfg.fingerprints = o.PeerFingerprints
+	cfg.verifyHostname = o.VerifyHostname()
+	cfg.verifyPeerCertificate = o.VerifyPeerCertificate
+	if len(o.TLSCipher) > 0 {
+		cfg.cipherSuites = append([]uint16{}, o.TLSCipher...)
+	}
+	return cfg, nil
+}
+
+// stdCertificate converts a uTLS certificate into the equivalent standard library one.
+func stdCertificate(cert tls.Certificate) stdtls.Certificate {
+	return stdtls.Certificate{
+		Certificate:                 cert.Certificate,
+		PrivateKey:                  cert.PrivateKey,
+		OCSPStaple:                  cert.OCSPStaple,
+		SignedCertificateTimestamps: cert.SignedCertificateTimestamps,
+		Leaf:                        cert.Leaf,
+	}
+}
+
+// utlsCertificate converts a standard library certificate into the equivalent uTLS one.
+func utlsCertificate(cert stdtls.Certificate) tls.Certificate {
+	return tls.Certificate{
+		Certificate:                 cert.Certificate,
+		PrivateKey:                  cert.PrivateKey,
+		OCSPStaple:                  cert.OCSPStaple,
+		SignedCertificateTimestamps: cert.SignedCertificateTimestamps,
+		Leaf:                        cert.Leaf,
+	}
+}
+
+// loadCertConfig reads and parses the client certificate, key and CA configured in the
+// passed options, and returns a certConfig containing them.
+func loadCertConfig(o *config.OpenVPNOptions) (*certConfig, error) {
 	var cfg *certConfig
 	var err error
 
-	if o.ShouldLoadCertsFromPath() {
+	if o.Signer != nil {
+		cfg, err = newCertConfigWithSigner(o)
+	} else if o.ShouldLoadCertsFromPath() {
 		cfg, err = loadCertAndCAFromPath(certPaths{
-			certPath: o.CertPath,
-			keyPath:  o.KeyPath,
-			caPath:   o.CAPath,
+			certPath:     o.CertPath,
+			keyPath:      o.KeyPath,
+			caPath:       o.CAPath,
+			extraCAPaths: o.ExtraCAPaths,
+			caDir:        o.CADir,
+			pinned:       len(o.PeerFingerprints) != 0,
 		})
 	} else {
 		cfg, err = loadCertAndCAFromBytes(certBytes{
-			cert: o.Cert,
-			key:  o.Key,
-			ca:   o.CA,
+			cert:   o.Cert,
+			key:    o.Key,
+			ca:     o.CA,
+			pinned: len(o.PeerFingerprints) != 0,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// newCertConfigWithSigner returns a certConfig whose client certificate uses
+// the Signer in the passed options, so that the private key is never loaded.
+func newCertConfigWithSigner(o *config.OpenVPNOptions) (*certConfig, error) {
+	var cfg *certConfig
+	var err error
+	var certPEM []byte
+
+	if o.ShouldLoadCertsFromPath() {
+		cfg, err = loadCertAndCAFromPath(certPaths{
+			caPath:       o.CAPath,
+			extraCAPaths: o.ExtraCAPaths,
+			caDir:        o.CADir,
+			pinned:       len(o.PeerFingerprints) != 0,
 		})
+		if err != nil {
+			return nil, err
+		}
+		certPEM, err = os.ReadFile(o.CertPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadKeypair, err)
+		}
+	} else {
+		cfg, err = loadCertAndCAFromBytes(certBytes{ca: o.CA, pinned: len(o.PeerFingerprints) != 0})
+		if err != nil {
+			return nil, err
+		}
+		certPEM = o.Cert
 	}
-	return cfg, err
+
+	cert, err := loadCertWithSigner(certPEM, o.Signer)
+	if err != nil {
+		return nil, err
+	}
+	cfg.cert = cert
+	return cfg, nil
 }
 
 // authority implements authorityPinner interface.
@@ -144,6 +340,16 @@ func (c *certConfig) authority() *x509.CertPool {
 	return c.ca
 }
 
+// peerFingerprints implements authorityPinner interface.
+func (c *certConfig) peerFingerprints() [][32]byte {
+	return c.fingerprints
+}
+
+// hostname implements authorityPinner interface.
+func (c *certConfig) hostname() string {
+	return c.verifyHostname
+}
+
 // ensure certConfig implements authorityPinner.
 var _ authorityPinner = &certConfig{}
 
@@ -166,8 +372,24 @@ func customVerifyFactory(pinner authorityPinner) verifyFun {
 		if leaf == nil {
 			return fmt.Errorf("%w: %s", ErrCannotVerifyCertChain, "nothing to verify")
 		}
-		// By default has DNSName verification disabled.
+		// When the server certificate is pinned (as with peer-fingerprint in the
+		// reference implementation), we accept the leaf only if it matches one of the
+		// pins, and we do not build the chain, so that self-signed certificates work.
+		if pins := pinner.peerFingerprints(); len(pins) > 0 {
+			fingerprint := sha256.Sum256(rawCerts[0])
+			for _, pin := range pins {
+				if pin == fingerprint {
+					return nil
+				}
+			}
+			return fmt.Errorf("%w: %s", ErrCannotVerifyCertChain, "peer fingerprint does not match")
+		}
+		// By default has DNSName verification disabled, unless we dialed a fixed IP
+		// address for a known hostname (see config.OpenVPNOptions.RemoteIP).
 		opts := certVerifyOptions()
+		if name := pinner.hostname(); name != "" {
+			opts.DNSName = name
+		}
 		// Set the configured CA(s) as the certificate pool to verify against.
 		opts.Roots = pinner.authority()
 
@@ -183,19 +405,28 @@ func customVerifyFactory(pinner authorityPinner) verifyFun {
 // the verify function returned by the global customVerifyFactory,
 // verification function since verifying the ServerName does not make sense in
 // the context of establishing a VPN session: we perform mutual TLS
-// Authentication with the custom CA.
+// Authentication with the custom CA. The exception is when we dial a fixed IP
+// address for a known hostname: we then send the hostname as SNI and verify it.
+// The caller may replace the verify function using the VerifyPeerCertificate option.
 func initTLS(cfg *certConfig) (*tls.Config, error) {
 	runtimex.Assert(cfg != nil, "passed nil configuration")
 
 	customVerify := customVerifyFactory(cfg)
+	if cfg.verifyPeerCertificate != nil {
+		customVerify = cfg.verifyPeerCertificate
+	}
 
 	tlsConf := &tls.Config{
 		// the certificate we've loaded from the config file
 		Certificates: []tls.Certificate{cfg.cert},
+		// the SNI, if any; customVerify checks it against the certificate
+		ServerName: cfg.verifyHostname,
 		// crypto/tls wants either ServerName or InsecureSkipVerify set ...
 		InsecureSkipVerify: true,
 		// ...but we pass our own verification function that verifies against the CA and ignores the ServerName
 		VerifyPeerCertificate: customVerify,
+		// the TLS 1.2 cipher suites we allow; when empty, the default ones are used.
+		CipherSuites: cfg.cipherSuites,
 		// disable DynamicRecordSizing to lower distinguishability.
 		DynamicRecordSizingDisabled: true,
 		// uTLS does not pick min/max version from the passed spec
@@ -208,8 +439,8 @@ func initTLS(cfg *certConfig) (*tls.Config, error) {
 
 // tlsHandshake performs the TLS handshake over the control channel, and return
 // the TLS Client as a net.Conn; returns also any error during the handshake.
-func tlsHandshake(tlsConn net.Conn, tlsConf *tls.Config) (net.Conn, error) {
-	tlsClient, err := tlsFactoryFn(tlsConn, tlsConf)
+func tlsHandshake(tlsConn net.Conn, tlsConf *tls.Config, factory tlsFactory) (net.Conn, error) {
+	tlsClient, err := factory(tlsConn, tlsConf)
 	if err != nil {
 		return nil, err
 	}
@@ -226,9 +457,53 @@ type handshaker interface {
 	Handshake() error
 }
 
+// tlsFactory is the type of the functions returning the handshaker wrapping a conn.
+type tlsFactory func(net.Conn, *tls.Config) (handshaker, error)
+
+// tlsFactoryFromOptions returns the tlsFactory selected by the TLS mode and by the
+// ClientHello to parrot in the passed options, and an error if they are not valid.
+func tlsFactoryFromOptions(o *config.OpenVPNOptions) (tlsFactory, error) {
+	switch o.TLSMode {
+	case "", config.TLSModeParrot:
+	case config.TLSModeDefault:
+		// we cannot parrot a ClientHello without uTLS, so do not silently ignore it
+		if o.ClientHelloID != "" || o.ClientHelloHex != "" {
+			return nil, fmt.Errorf("%w: %s", ErrBadTLSInit, "cannot parrot a client hello with the default tls mode")
+		}
+		return defaultTLSFactory, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown tls mode: %s", ErrBadTLSInit, o.TLSMode)
+	}
+
+	var specFn func() (*tls.ClientHelloSpec, error)
+	switch {
+	case o.ClientHelloID != "" && o.ClientHelloHex != "":
+		return nil, fmt.Errorf("%w: %s", ErrBadParrot, "cannot use both a client hello id and hex")
+	case o.ClientHelloID != "":
+		specFn = func() (*tls.ClientHelloSpec, error) {
+			return clientHelloSpecFromPreset(o.ClientHelloID)
+		}
+	case o.ClientHelloHex != "":
+		specFn = func() (*tls.ClientHelloSpec, error) {
+			return clientHelloSpecFromHex(o.ClientHelloHex)
+		}
+	case len(o.TLSCipherSuites) > 0:
+		specFn = func() (*tls.ClientHelloSpec, error) {
+			return clientHelloSpecFromHex(vpnClientHelloHex)
+		}
+	default:
+		return parrotTLSFactory, nil
+	}
+	// make sure we fail early with a bad ClientHello
+	if _, err := specFn(); err != nil {
+		return nil, err
+	}
+	return newParrotTLSFactory(specFn, o.TLSCipherSuites), nil
+}
+
 // defaultTLSFactory returns an implementer of the handshaker interface; that
 // is, the default tls.Client factory; and an error.
-// we're not using the default factory right now, but it comes handy to be able
+// It is used with config.TLSModeDefault, and it also comes handy to be able
 // to compare the fingerprints with a golang TLS handshake.
 // TODO(ainghazal): implement some sort of test that extracts/compares the TLS client hello.
 func defaultTLSFactory(conn net.Conn, config *tls.Config) (handshaker, error) {
@@ -243,27 +518,101 @@ func defaultTLSFactory(conn net.Conn, config *tls.Config) (handshaker, error) {
 var vpnClientHelloHex = `1603010114010001100303534e0a0f2687b240f7c7dfbb51c4aac33639f28173aa5d7bcebb159695ab0855208b835bf240a83df66885d6747b5bbf1b631e8c34ae469c629d7eb76e247128eb0032130213031301c02cc030009fcca9cca8ccaac02bc02f009ec024c028006bc023c0270067c00ac0140039c009c013003300ff01000095000b000403000102000a00160014001d0017001e00190018010001010102010301040016000000170000000d002a0028040305030603080708080809080a080b080408050806040105010601030303010302040205020602002b0009080304030303020301002d00020101003300260024001d0020a10bc24becb583293c317220e6725205d3a177a4a974090f6ffcf13a43da7035`
 
 // parrotTLSFactory returns an implementer of the handshaker interface; in this
-// case, a parroting implementation; and an error.
+// case, a parroting implementation of the reference ClientHello; and an error.
 func parrotTLSFactory(conn net.Conn, config *tls.Config) (handshaker, error) {
+	return newParrotTLSFactory(func() (*tls.ClientHelloSpec, error) {
+		return clientHelloSpecFromHex(vpnClientHelloHex)
+	}, nil)(conn, config)
+}
+
+// newParrotTLSFactory returns a tlsFactory parroting the ClientHelloSpec returned
+// by specFn, which we call for each conn because uTLS modifies the spec. We restrict the
+// parroted TLS 1.2 cipher suites to the ones in the config, and the TLS 1.3 cipher suites
+// to tls13Suites, if any: uTLS sends the suites in the spec, regardless of the config.
+func newParrotTLSFactory(specFn func() (*tls.ClientHelloSpec, error), tls13Suites []uint16) tlsFactory {
+	return func(conn net.Conn, config *tls.Config) (handshaker, error) {
+		spec, err := specFn()
+		if err != nil {
+			return nil, err
+		}
+		if len(config.CipherSuites)+len(tls13Suites) > 0 {
+			spec.CipherSuites = filterCipherSuites(spec.CipherSuites, config.CipherSuites, tls13Suites)
+			if len(spec.CipherSuites) == 0 {
+				return nil, fmt.Errorf("%w: %s", ErrBadParrot, "no allowed cipher suite")
+			}
+		}
+		client := tls.UClient(conn, config, tls.HelloCustom)
+		if err := client.ApplyPreset(spec); err != nil {
+			return nil, fmt.Errorf("%w: cannot apply spec: %s", ErrBadParrot, err)
+		}
+		return client, nil
+	}
+}
+
+// clientHelloSpecFromHex returns the ClientHelloSpec fingerprinted from the hex
+// representation of a captured ClientHello record.
+func clientHelloSpecFromHex(hexHello string) (*tls.ClientHelloSpec, error) {
 	fingerprinter := &tls.Fingerprinter{AllowBluntMimicry: true}
-	rawOpenVPNClientHelloBytes, err := hex.DecodeString(vpnClientHelloHex)
+	rawClientHelloBytes, err := hex.DecodeString(hexHello)
 	if err != nil {
 		return nil, fmt.Errorf("%w: cannot decode raw fingerprint: %s", ErrBadParrot, err)
 	}
-	generatedSpec, err := fingerprinter.FingerprintClientHello(rawOpenVPNClientHelloBytes)
+	generatedSpec, err := fingerprinter.FingerprintClientHello(rawClientHelloBytes)
 	if err != nil {
 		return nil, fmt.Errorf("%w: fingerprinting failed: %s", ErrBadParrot, err)
 	}
-	client := tls.UClient(conn, config, tls.HelloCustom)
-	if err := client.ApplyPreset(generatedSpec); err != nil {
-		return nil, fmt.Errorf("%w: cannot apply spec: %s", ErrBadParrot, err)
+	return generatedSpec, nil
+}
+
+// clientHelloPresets maps the names we accept for config.OpenVPNOptions.ClientHelloID
+// to the corresponding uTLS presets.
+var clientHelloPresets = map[string]tls.ClientHelloID{
+	"HelloChrome_Auto":  tls.HelloChrome_Auto,
+	"HelloFirefox_Auto": tls.HelloFirefox_Auto,
+	"HelloEdge_Auto":    tls.HelloEdge_Auto,
+	"HelloSafari_Auto":  tls.HelloSafari_Auto,
+	"HelloIOS_Auto":     tls.HelloIOS_Auto,
+}
+
+// clientHelloSpecFromPreset returns the ClientHelloSpec of the named uTLS preset.
+func clientHelloSpecFromPreset(name string) (*tls.ClientHelloSpec, error) {
+	id, found := clientHelloPresets[name]
+	if !found {
+		return nil, fmt.Errorf("%w: unknown client hello id: %s", ErrBadParrot, name)
+	}
+	spec, err := tls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadParrot, err)
+	}
+	return &spec, nil
+}
+
+// filterCipherSuites returns the suites in the parroted ClientHello that are allowed. We
+// check the TLS 1.3 suites against allowed13 and any other suite against allowed12, and we
+// keep all the suites of a TLS version when its list is empty, since restricting the
+// suites of a version must not prevent us from using the other one.
+func filterCipherSuites(suites, allowed12, allowed13 []uint16) []uint16 {
+	var filtered []uint16
+	for _, suite := range suites {
+		allowed := allowed12
+		if isTLS13CipherSuite(suite) {
+			allowed = allowed13
+		}
+		if len(allowed) == 0 || slices.Contains(allowed, suite) {
+			filtered = append(filtered, suite)
+		}
 	}
-	return client, nil
+	return filtered
+}
+
+// isTLS13CipherSuite returns whether the given suite is a TLS 1.3 cipher suite, all of
+// which have 0x13 as their first byte.
+func isTLS13CipherSuite(suite uint16) bool {
+	return suite>>8 == 0x13
 }
 
 // global variables to allow monkeypatching in tests.
 var (
 	initTLSFn      = initTLS
-	tlsFactoryFn   = parrotTLSFactory
 	tlsHandshakeFn = tlsHandshake
 )
@@ -1,14 +1,23 @@
 package tlssession
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	stdtls "crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"io"
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -254,7 +263,7 @@ func Test_loadCertAndCAFromPath(t *testing.T) {
 				if err != nil {
 					t.Errorf("error while testing: %v", err)
 				}
-				return args{pth: certPaths{crt.cert, crt.key, crt.ca}}
+				return args{pth: certPaths{certPath: crt.cert, keyPath: crt.key, caPath: crt.ca}}
 
 			}(),
 			want:    nil,
@@ -267,7 +276,7 @@ func Test_loadCertAndCAFromPath(t *testing.T) {
 				if err != nil {
 					t.Errorf("error while testing: %v", err)
 				}
-				return args{pth: certPaths{crt.cert, crt.key, crt.ca}}
+				return args{pth: certPaths{certPath: crt.cert, keyPath: crt.key, caPath: crt.ca}}
 
 			}(),
 			want:    nil,
@@ -280,7 +289,7 @@ func Test_loadCertAndCAFromPath(t *testing.T) {
 				if err != nil {
 					t.Errorf("error while testing: %v", err)
 				}
-				return args{pth: certPaths{crt.cert, crt.key, crt.ca}}
+				return args{pth: certPaths{certPath: crt.cert, keyPath: crt.key, caPath: crt.ca}}
 
 			}(),
 			want:    nil,
@@ -293,7 +302,7 @@ func Test_loadCertAndCAFromPath(t *testing.T) {
 				if err != nil {
 					t.Errorf("error while testing: %v", err)
 				}
-				return args{pth: certPaths{crt.cert, crt.key, crt.ca}}
+				return args{pth: certPaths{certPath: crt.cert, keyPath: crt.key, caPath: crt.ca}}
 
 			}(),
 			want:    nil,
@@ -314,6 +323,79 @@ func Test_loadCertAndCAFromPath(t *testing.T) {
 	}
 }
 
+func Test_loadCertAndCAFromPath_multipleCAs(t *testing.T) {
+	rawCerts1, _, _, _, err := makeRawCertsForTesting()
+	if err != nil {
+		t.Fatal("error getting raw certs")
+	}
+	rawCerts2, _, _, _, err := makeRawCertsForTesting()
+	if err != nil {
+		t.Fatal("error getting raw certs")
+	}
+	toPEM := func(der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	writeFile := func(t *testing.T, name string, data []byte) {
+		if err := os.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// verifyBoth checks that a leaf signed by either CA validates against the pool.
+	verifyBoth := func(t *testing.T, cfg *certConfig) {
+		for _, rawCerts := range [][][]byte{rawCerts1, rawCerts2} {
+			if err := customVerifyFactory(cfg)(rawCerts, nil); err != nil {
+				t.Errorf("customVerify() error = %v", err)
+			}
+		}
+	}
+
+	t.Run("two ca files go into the same pool", func(t *testing.T) {
+		d := t.TempDir()
+		ca1, ca2 := filepath.Join(d, "ca1.crt"), filepath.Join(d, "ca2.crt")
+		writeFile(t, ca1, toPEM(rawCerts1[1]))
+		writeFile(t, ca2, toPEM(rawCerts2[1]))
+
+		cfg, err := loadCertAndCAFromPath(certPaths{caPath: ca1, extraCAPaths: []string{ca2}})
+		if err != nil {
+			t.Fatalf("loadCertAndCAFromPath() error = %v", err)
+		}
+		verifyBoth(t, cfg)
+	})
+
+	t.Run("a ca directory is scanned skipping files without certs", func(t *testing.T) {
+		d := t.TempDir()
+		writeFile(t, filepath.Join(d, "ca1.pem"), toPEM(rawCerts1[1]))
+		writeFile(t, filepath.Join(d, "ca2.pem"), toPEM(rawCerts2[1]))
+		writeFile(t, filepath.Join(d, "README"), []byte("not a cert"))
+
+		cfg, err := loadCertAndCAFromPath(certPaths{caDir: d})
+		if err != nil {
+			t.Fatalf("loadCertAndCAFromPath() error = %v", err)
+		}
+		verifyBoth(t, cfg)
+	})
+
+	t.Run("a ca directory without certs should fail", func(t *testing.T) {
+		d := t.TempDir()
+		writeFile(t, filepath.Join(d, "README"), []byte("not a cert"))
+
+		_, err := loadCertAndCAFromPath(certPaths{caDir: d})
+		if !errors.Is(err, ErrBadCA) {
+			t.Errorf("loadCertAndCAFromPath() error = %v, wantErr %v", err, ErrBadCA)
+		}
+	})
+
+	t.Run("appended inline cas go into the same pool", func(t *testing.T) {
+		bundle := append(toPEM(rawCerts1[1]), toPEM(rawCerts2[1])...)
+		cfg, err := loadCertAndCAFromBytes(certBytes{ca: bundle})
+		if err != nil {
+			t.Fatalf("loadCertAndCAFromBytes() error = %v", err)
+		}
+		verifyBoth(t, cfg)
+	})
+}
+
 func Test_loadCertAndCAFromBytes(t *testing.T) {
 	type args struct {
 		crt certBytes
@@ -415,6 +497,29 @@ func Test_initTLSLoadTestCertificates(t *testing.T) {
 			t.Errorf("initTLS() error = %v, want: nil", err)
 		}
 	})
+
+	t.Run("restricted cipher suites populate the tls config", func(t *testing.T) {
+		cfg, err := newCertConfigFromOptions(
+			&config.OpenVPNOptions{
+				Cert:            pemTestingCertificate,
+				Key:             pemTestingKey,
+				CA:              pemTestingCa,
+				TLSCipher:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+				TLSCipherSuites: []uint16{tls.TLS_AES_256_GCM_SHA384},
+			})
+		if err != nil {
+			t.Fatalf("error while testing: %v", err)
+		}
+		tlsConf, err := initTLS(cfg)
+		if err != nil {
+			t.Fatalf("initTLS() error = %v, want: nil", err)
+		}
+		// the TLS 1.3 cipher suites are restricted by the parroting factory
+		want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+		if !reflect.DeepEqual(tlsConf.CipherSuites, want) {
+			t.Errorf("initTLS() CipherSuites = %v, want %v", tlsConf.CipherSuites, want)
+		}
+	})
 }
 
 //
@@ -462,18 +567,14 @@ func errorRaisingTLSFactory(net.Conn, *tls.Config) (handshaker, error) {
 func Test_tlsHandshake(t *testing.T) {
 
 	t.Run("mocked good handshake should not fail", func(t *testing.T) {
-		origTLS := tlsFactoryFn
-		tlsFactoryFn = dummyTLSFactory
-		defer func() {
-			tlsFactoryFn = origTLS
-		}()
+		factory := dummyTLSFactory
 
 		conn := &mocks.Conn{}
 		conf := &tls.Config{
 			InsecureSkipVerify: true,
 		}
 
-		_, err := tlsHandshake(conn, conf)
+		_, err := tlsHandshake(conn, conf, factory)
 		if err != nil {
 			t.Errorf("tlsHandshake() error = %v, wantErr %v", err, nil)
 			return
@@ -481,11 +582,7 @@ func Test_tlsHandshake(t *testing.T) {
 	})
 
 	t.Run("mocked bad handshake should fail", func(t *testing.T) {
-		origTLS := tlsFactoryFn
-		tlsFactoryFn = dummyTLSFactoryBadHandshake
-		defer func() {
-			tlsFactoryFn = origTLS
-		}()
+		factory := dummyTLSFactoryBadHandshake
 
 		conn := &mocks.Conn{}
 		conf := &tls.Config{
@@ -493,7 +590,7 @@ func Test_tlsHandshake(t *testing.T) {
 		}
 
 		wantErr := ErrBadTLSHandshake
-		_, err := tlsHandshake(conn, conf)
+		_, err := tlsHandshake(conn, conf, factory)
 		if !errors.Is(err, wantErr) {
 			t.Errorf("tlsHandshake() error = %v, wantErr %v", err, wantErr)
 			return
@@ -501,11 +598,7 @@ func Test_tlsHandshake(t *testing.T) {
 	})
 
 	t.Run("any error from the factory should be bubbled up", func(t *testing.T) {
-		origTLS := tlsFactoryFn
-		tlsFactoryFn = errorRaisingTLSFactory
-		defer func() {
-			tlsFactoryFn = origTLS
-		}()
+		factory := errorRaisingTLSFactory
 		wantErr := tlsFactoryError
 
 		conn := &mocks.Conn{}
@@ -513,7 +606,7 @@ func Test_tlsHandshake(t *testing.T) {
 			InsecureSkipVerify: true,
 		}
 
-		_, err := tlsHandshake(conn, conf)
+		_, err := tlsHandshake(conn, conf, factory)
 		if !errors.Is(err, wantErr) {
 			t.Errorf("tlsHandshake() error = %v, wantErr %v", err, wantErr)
 			return
@@ -521,6 +614,158 @@ func Test_tlsHandshake(t *testing.T) {
 	})
 }
 
+func Test_tlsFactoryFromOptions(t *testing.T) {
+	t.Run("the tls mode selects the factory", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			mode    config.TLSMode
+			want    tlsFactory
+			wantErr error
+		}{
+			{"the zero value parrots", "", parrotTLSFactory, nil},
+			{"parrot mode", config.TLSModeParrot, parrotTLSFactory, nil},
+			{"default mode", config.TLSModeDefault, defaultTLSFactory, nil},
+			{"unknown mode", config.TLSMode("chrome"), nil, ErrBadTLSInit},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := tlsFactoryFromOptions(&config.OpenVPNOptions{TLSMode: tt.mode})
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("tlsFactoryFromOptions() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if reflect.ValueOf(got).Pointer() != reflect.ValueOf(tt.want).Pointer() {
+					t.Errorf("tlsFactoryFromOptions(%q) returned the wrong factory", tt.mode)
+				}
+			})
+		}
+	})
+
+	t.Run("a custom client hello is parroted", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			options *config.OpenVPNOptions
+			wantErr error
+		}{
+			{
+				name:    "a valid preset",
+				options: &config.OpenVPNOptions{ClientHelloID: "HelloChrome_Auto"},
+			},
+			{
+				name:    "a valid custom hex",
+				options: &config.OpenVPNOptions{ClientHelloHex: vpnClientHelloHex},
+			},
+			{
+				name:    "restricted TLS 1.3 cipher suites",
+				options: &config.OpenVPNOptions{TLSCipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256}},
+			},
+			{
+				name:    "an unknown preset",
+				options: &config.OpenVPNOptions{ClientHelloID: "HelloNetscape_Auto"},
+				wantErr: ErrBadParrot,
+			},
+			{
+				name:    "an invalid hex",
+				options: &config.OpenVPNOptions{ClientHelloHex: "deadbeef"},
+				wantErr: ErrBadParrot,
+			},
+			{
+				name: "both a preset and a hex",
+				options: &config.OpenVPNOptions{
+					ClientHelloID:  "HelloChrome_Auto",
+					ClientHelloHex: vpnClientHelloHex,
+				},
+				wantErr: ErrBadParrot,
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				factory, err := tlsFactoryFromOptions(tt.options)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("tlsFactoryFromOptions() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				client, err := factory(&mocks.Conn{}, &tls.Config{InsecureSkipVerify: true})
+				if err != nil {
+					t.Fatalf("factory() error = %v", err)
+				}
+				if _, ok := client.(*tls.UConn); !ok {
+					t.Errorf("factory() returned %T, want *tls.UConn", client)
+				}
+			})
+		}
+	})
+
+	t.Run("a custom client hello is rejected in default mode", func(t *testing.T) {
+		for _, o := range []*config.OpenVPNOptions{
+			{TLSMode: config.TLSModeDefault, ClientHelloID: "HelloChrome_Auto"},
+			{TLSMode: config.TLSModeDefault, ClientHelloHex: vpnClientHelloHex},
+		} {
+			if _, err := tlsFactoryFromOptions(o); !errors.Is(err, ErrBadTLSInit) {
+				t.Errorf("tlsFactoryFromOptions() error = %v, wantErr %v", err, ErrBadTLSInit)
+			}
+		}
+	})
+}
+
+func Test_filterCipherSuites(t *testing.T) {
+	suites := []uint16{
+		tls.TLS_AES_256_GCM_SHA384,
+		tls.TLS_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+	tests := []struct {
+		name      string
+		allowed12 []uint16
+		allowed13 []uint16
+		want      []uint16
+	}{
+		{
+			name:      "restricting TLS 1.2 keeps all the TLS 1.3 suites",
+			allowed12: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			want: []uint16{
+				tls.TLS_AES_256_GCM_SHA384,
+				tls.TLS_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			},
+		},
+		{
+			name:      "restricting TLS 1.3 keeps all the TLS 1.2 suites",
+			allowed13: []uint16{tls.TLS_AES_128_GCM_SHA256},
+			want: []uint16{
+				tls.TLS_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			},
+		},
+		{
+			name:      "restricting both",
+			allowed12: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+			allowed13: []uint16{tls.TLS_AES_256_GCM_SHA384},
+			want:      []uint16{tls.TLS_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		},
+		{
+			name:      "a TLS 1.3 suite in the TLS 1.2 list does not allow it",
+			allowed12: []uint16{tls.TLS_AES_256_GCM_SHA384},
+			allowed13: []uint16{tls.TLS_AES_128_GCM_SHA256},
+			want:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterCipherSuites(suites, tt.allowed12, tt.allowed13)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterCipherSuites() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_defaultTLSFactory(t *testing.T) {
 	conn := &mocks.Conn{}
 	conf := &tls.Config{}
@@ -539,6 +784,20 @@ func Test_parrotTLSFactory(t *testing.T) {
 		}
 	})
 
+	t.Run("the parroted cipher suites are restricted to the allowed ones", func(t *testing.T) {
+		specFn := func() (*tls.ClientHelloSpec, error) {
+			return clientHelloSpecFromHex(vpnClientHelloHex)
+		}
+		conf := &tls.Config{InsecureSkipVerify: true, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}}
+		if _, err := newParrotTLSFactory(specFn, []uint16{tls.TLS_AES_128_GCM_SHA256})(conn, conf); err != nil {
+			t.Errorf("newParrotTLSFactory() error = %v, wantErr %v", err, nil)
+		}
+		conf.CipherSuites = []uint16{0x1234}
+		if _, err := newParrotTLSFactory(specFn, []uint16{0x1399})(conn, conf); !errors.Is(err, ErrBadParrot) {
+			t.Errorf("newParrotTLSFactory() error = %v, wantErr %v", err, ErrBadParrot)
+		}
+	})
+
 	t.Run("an hex clienthello that cannot be decoded to raw bytes should raise ErrBadParrot", func(t *testing.T) {
 		defer func(original string) {
 			vpnClientHelloHex = original
@@ -828,3 +1087,461 @@ func Test_customVerify(t *testing.T) {
 		}
 	})
 }
+
+func Test_customVerify_hostname(t *testing.T) {
+	rawCerts, ca, vpnCert, vpnKey, err := makeRawCertsForTesting()
+	if err != nil {
+		t.Fatal("error getting raw certs")
+	}
+	tests := []struct {
+		name     string
+		hostname string
+		wantErr  error
+	}{
+		{"without a hostname we do not verify the name", "", nil},
+		{"the hostname matches the certificate", "random.gateway", nil},
+		{"the hostname does not match the certificate", "other.gateway", ErrCannotVerifyCertChain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := makeCertAndCAFromMemory(ca, vpnCert, vpnKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth.verifyHostname = tt.hostname
+			if err := customVerifyFactory(auth)(rawCerts, nil); !errors.Is(err, tt.wantErr) {
+				t.Errorf("customVerify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_initTLS_remoteIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		remote   string
+		remoteIP string
+		want     string
+	}{
+		{"without a remote IP we do not send SNI", "vpn.example.org", "", ""},
+		{"with a remote IP we send the hostname as SNI", "vpn.example.org", "10.0.0.1", "vpn.example.org"},
+		{"with an IP as remote we do not send SNI", "10.0.0.2", "10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := newCertConfigFromOptions(&config.OpenVPNOptions{
+				Remote:   tt.remote,
+				RemoteIP: tt.remoteIP,
+				Cert:     pemTestingCertificate,
+				Key:      pemTestingKey,
+				CA:       pemTestingCa,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConf, err := initTLS(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tlsConf.ServerName != tt.want {
+				t.Errorf("initTLS() ServerName = %q, want %q", tlsConf.ServerName, tt.want)
+			}
+		})
+	}
+}
+
+func Test_customVerify_peerFingerprints(t *testing.T) {
+	rawCerts, ca, vpnCert, vpnKey, err := makeRawCertsForTesting()
+	if err != nil {
+		t.Fatal("error getting raw certs")
+	}
+	_, otherCA, _, _, err := makeRawCertsForTesting()
+	if err != nil {
+		t.Fatal("error getting raw certs")
+	}
+	leafPin := sha256.Sum256(rawCerts[0])
+	otherPin := sha256.Sum256([]byte("not the leaf"))
+
+	tests := []struct {
+		name    string
+		ca      *x509.Certificate
+		pins    [][32]byte
+		wantErr error
+	}{
+		{
+			name:    "a matching pin is accepted without building the chain",
+			ca:      otherCA,
+			pins:    [][32]byte{otherPin, leafPin},
+			wantErr: nil,
+		},
+		{
+			name:    "a non-matching pin is rejected even if the ca is good",
+			ca:      ca,
+			pins:    [][32]byte{otherPin},
+			wantErr: ErrCannotVerifyCertChain,
+		},
+		{
+			name:    "without pins we fall back to verifying against the ca",
+			ca:      ca,
+			pins:    nil,
+			wantErr: nil,
+		},
+		{
+			name:    "without pins a bad ca is still rejected",
+			ca:      otherCA,
+			pins:    nil,
+			wantErr: ErrCannotVerifyCertChain,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := makeCertAndCAFromMemory(tt.ca, vpnCert, vpnKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth.fingerprints = tt.pins
+			err = customVerifyFactory(auth)(rawCerts, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("customVerify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_newCertConfigFromOptions_peerFingerprintsWithoutCA(t *testing.T) {
+	rawCerts, _, _, _, err := makeRawCertsForTesting()
+	if err != nil {
+		t.Fatal("error getting raw certs")
+	}
+	pins := [][32]byte{sha256.Sum256(rawCerts[0])}
+
+	crt, err := writeTestingCerts(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options *config.OpenVPNOptions
+		wantErr error
+	}{
+		{
+			name:    "inline cert and key with a pin",
+			options: &config.OpenVPNOptions{Cert: pemTestingCertificate, Key: pemTestingKey, PeerFingerprints: pins},
+		},
+		{
+			name:    "cert and key paths with a pin",
+			options: &config.OpenVPNOptions{CertPath: crt.cert, KeyPath: crt.key, PeerFingerprints: pins},
+		},
+		{
+			name:    "without a pin the ca is required",
+			options: &config.OpenVPNOptions{Cert: pemTestingCertificate, Key: pemTestingKey},
+			wantErr: ErrBadCA,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr == nil && !tt.options.HasAuthInfo() {
+				t.Fatal("expected the options to have auth info")
+			}
+			cfg, err := newCertConfigFromOptions(tt.options)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newCertConfigFromOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// test that we accept the pinned server certificate
+			if err := customVerifyFactory(cfg)(rawCerts, nil); err != nil {
+				t.Errorf("customVerify() error = %v", err)
+			}
+		})
+	}
+}
+
+// recordingSigner is a crypto.Signer that wraps an in-memory key and records
+// how many times it has been asked to sign.
+type recordingSigner struct {
+	crypto.Signer
+	calls int
+}
+
+func (s *recordingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.calls++
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+func newRecordingSignerForTesting(t *testing.T) *recordingSigner {
+	block, _ := pem.Decode(pemTestingKey)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &recordingSigner{Signer: key.(crypto.Signer)}
+}
+
+// newTestingServerConfig returns a stdlib TLS server config with a self-signed
+// certificate that requires a client certificate.
+func newTestingServerConfig(t *testing.T) *stdtls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &stdtls.Config{
+		Certificates: []stdtls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		ClientAuth:   stdtls.RequireAnyClientCert,
+	}
+}
+
+func Test_newCertConfigFromOptions_withSigner(t *testing.T) {
+	t.Run("signer is used for the client key from bytes", func(t *testing.T) {
+		signer := newRecordingSignerForTesting(t)
+		cfg, err := newCertConfigFromOptions(&config.OpenVPNOptions{
+			Cert:   pemTestingCertificate,
+			CA:     pemTestingCa,
+			Signer: signer,
+		})
+		if err != nil {
+			t.Fatalf("newCertConfigFromOptions() error = %v", err)
+		}
+		if cfg.cert.PrivateKey != signer {
+			t.Errorf("expected the certificate to use the signer")
+		}
+	})
+
+	t.Run("signer is used for the client key from path", func(t *testing.T) {
+		crt, err := writeTestingCerts(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer := newRecordingSignerForTesting(t)
+		cfg, err := newCertConfigFromOptions(&config.OpenVPNOptions{
+			CertPath: crt.cert,
+			CAPath:   crt.ca,
+			Signer:   signer,
+		})
+		if err != nil {
+			t.Fatalf("newCertConfigFromOptions() error = %v", err)
+		}
+		if cfg.cert.PrivateKey != signer {
+			t.Errorf("expected the certificate to use the signer")
+		}
+	})
+
+	t.Run("signer not matching the cert should fail", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = newCertConfigFromOptions(&config.OpenVPNOptions{
+			Cert:   pemTestingCertificate,
+			CA:     pemTestingCa,
+			Signer: key,
+		})
+		if !errors.Is(err, ErrBadKeypair) {
+			t.Errorf("newCertConfigFromOptions() error = %v, want %v", err, ErrBadKeypair)
+		}
+	})
+
+	t.Run("bad cert should fail", func(t *testing.T) {
+		_, err := newCertConfigFromOptions(&config.OpenVPNOptions{
+			Cert:   []byte("not a cert"),
+			CA:     pemTestingCa,
+			Signer: newRecordingSignerForTesting(t),
+		})
+		if !errors.Is(err, ErrBadKeypair) {
+			t.Errorf("newCertConfigFromOptions() error = %v, want %v", err, ErrBadKeypair)
+		}
+	})
+
+	t.Run("handshake delegates the client signature to the signer", func(t *testing.T) {
+		signer := newRecordingSignerForTesting(t)
+		cfg, err := newCertConfigFromOptions(&config.OpenVPNOptions{
+			Cert:   pemTestingCertificate,
+			CA:     pemTestingCa,
+			Signer: signer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConf, err := initTLS(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the server certificate is not signed by the testing CA
+		tlsConf.VerifyPeerCertificate = nil
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		server := stdtls.Server(serverConn, newTestingServerConfig(t))
+		errch := make(chan error, 1)
+		go func() {
+			errch <- server.Handshake()
+		}()
+
+		client, err := defaultTLSFactory(clientConn, tlsConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("client handshake error = %v", err)
+		}
+		if err := <-errch; err != nil {
+			t.Fatalf("server handshake error = %v", err)
+		}
+		if signer.calls == 0 {
+			t.Errorf("expected the signer to be used during the handshake")
+		}
+	})
+}
+
+func Test_initTLS_VerifyPeerCertificate(t *testing.T) {
+	errRejected := errors.New("rejected by policy")
+	tests := []struct {
+		name    string
+		verdict error
+	}{
+		{"the custom verifier can accept a self-signed server", nil},
+		{"the custom verifier can reject the server", errRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			var leaf []byte
+			cfg, err := newCertConfigFromOptions(&config.OpenVPNOptions{
+				Cert: pemTestingCertificate,
+				Key:  pemTestingKey,
+				CA:   pemTestingCa,
+				VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+					calls++
+					leaf = rawCerts[0]
+					return tt.verdict
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConf, err := initTLS(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// we use loopback TCP rather than a pipe, since, when we reject the server, we
+			// write an alert while the server is still writing its handshake messages
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			serverConf := newTestingServerConfig(t)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				stdtls.Server(conn, serverConf).Handshake()
+			}()
+			clientConn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clientConn.Close()
+
+			client, err := defaultTLSFactory(clientConn, tlsConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Handshake(); !errors.Is(err, tt.verdict) {
+				t.Fatalf("client handshake error = %v, want %v", err, tt.verdict)
+			}
+			if calls != 1 {
+				t.Errorf("custom verifier called %d times, want 1", calls)
+			}
+			if !bytes.Equal(leaf, serverConf.Certificates[0].Certificate[0]) {
+				t.Errorf("custom verifier did not receive the server leaf certificate")
+			}
+		})
+	}
+}
+
+func Test_newCertConfigFromOptions_persistKey(t *testing.T) {
+	// removeCerts deletes the files, so that loading them again fails
+	removeCerts := func(t *testing.T, crt testingCert) {
+		for _, file := range []string{crt.cert, crt.key, crt.ca} {
+			if err := os.Remove(file); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("with persist-key we do not read the files again", func(t *testing.T) {
+		crt, err := writeTestingCerts(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &config.OpenVPNOptions{CertPath: crt.cert, KeyPath: crt.key, CAPath: crt.ca, PersistKey: true}
+		first, err := newCertConfigFromOptions(opts)
+		if err != nil {
+			t.Fatalf("newCertConfigFromOptions() error = %v", err)
+		}
+		removeCerts(t, crt)
+		second, err := newCertConfigFromOptions(opts)
+		if err != nil {
+			t.Fatalf("newCertConfigFromOptions() error = %v after removing the files", err)
+		}
+		if second.ca != first.ca || !bytes.Equal(second.cert.Certificate[0], first.cert.Certificate[0]) {
+			t.Error("expected to reuse the parsed credentials")
+		}
+	})
+
+	t.Run("without persist-key we read the files again", func(t *testing.T) {
+		crt, err := writeTestingCerts(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &config.OpenVPNOptions{CertPath: crt.cert, KeyPath: crt.key, CAPath: crt.ca}
+		if _, err := newCertConfigFromOptions(opts); err != nil {
+			t.Fatalf("newCertConfigFromOptions() error = %v", err)
+		}
+		removeCerts(t, crt)
+		if _, err := newCertConfigFromOptions(opts); !errors.Is(err, ErrBadCA) {
+			t.Errorf("newCertConfigFromOptions() error = %v, want %v", err, ErrBadCA)
+		}
+	})
+
+	t.Run("options sharing the parsed credentials do not need the files", func(t *testing.T) {
+		crt, err := writeTestingCerts(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := newCertConfigFromOptions(&config.OpenVPNOptions{CertPath: crt.cert, KeyPath: crt.key, CAPath: crt.ca})
+		if err != nil {
+			t.Fatal(err)
+		}
+		removeCerts(t, crt)
+		creds := &config.Credentials{Certificate: stdCertificate(parsed.cert), CAPool: parsed.ca}
+		for i := 0; i < 2; i++ {
+			opts := &config.OpenVPNOptions{CertPath: crt.cert, KeyPath: crt.key, CAPath: crt.ca, Credentials: creds}
+			cfg, err := newCertConfigFromOptions(opts)
+			if err != nil {
+				t.Fatalf("newCertConfigFromOptions() error = %v", err)
+			}
+			if _, err := initTLS(cfg); err != nil {
+				t.Fatalf("initTLS() error = %v", err)
+			}
+		}
+	})
+}
@@ -1,10 +1,15 @@
 package tlssession
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/ooni/minivpn/internal/bytesx"
 	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/session"
 	"github.com/ooni/minivpn/internal/workers"
@@ -38,6 +43,15 @@ type Service struct {
 	// TLSRecordDown is data being transferred down from us to the control
 	// channel.
 	TLSRecordDown *chan []byte
+
+	// OnServerControl is an OPTIONAL callback invoked when the server sends us
+	// a RESTART or HALT control message once the tunnel is established. After
+	// invoking it, we shut down the workers.
+	OnServerControl func(message *model.ServerControl)
+
+	// RemoteAddr is the OPTIONAL address of the remote we connected to, whose
+	// address family we announce to the server.
+	RemoteAddr net.Addr
 }
 
 // StartWorkers starts the tlssession workers. See the [ARCHITECTURE]
@@ -49,17 +63,26 @@ func (svc *Service) StartWorkers(
 	workersManager *workers.Manager,
 	sessionManager *session.Manager,
 ) {
+	pushRequestInterval, pushRequestAttempts := config.PushRequestRetry()
+	options := config.OpenVPNOptions()
 	ws := &workersState{
-		keyUp:          *svc.KeyUp,
-		logger:         config.Logger(),
-		notifyTLS:      svc.NotifyTLS,
-		options:        config.OpenVPNOptions(),
-		tlsRecordDown:  *svc.TLSRecordDown,
-		tlsRecordUp:    svc.TLSRecordUp,
-		sessionManager: sessionManager,
-		workersManager: workersManager,
+		credentialProvider:  config.CredentialProvider(),
+		keyUp:               *svc.KeyUp,
+		logger:              config.Logger(),
+		onServerControl:     svc.OnServerControl,
+		notifyTLS:           svc.NotifyTLS,
+		options:             options,
+		password:            config.Password(),
+		serverOptions:       options.ServerOptionsStringForAddr(svc.RemoteAddr),
+		pushRequestAttempts: pushRequestAttempts,
+		pushRequestInterval: pushRequestInterval,
+		tlsRecordDown:       *svc.TLSRecordDown,
+		tlsRecordUp:         svc.TLSRecordUp,
+		sessionManager:      sessionManager,
+		workersManager:      workersManager,
 	}
 	workersManager.StartWorker(ws.worker)
+	workersManager.StartWorker(ws.recordRouter)
 }
 
 // workersState contains the control channel state.
@@ -72,6 +95,102 @@ type workersState struct {
 	keyUp          chan<- *session.DataChannelKey
 	sessionManager *session.Manager
 	workersManager *workers.Manager
+
+	// serverOptions is the options string we send to the server, which is also
+	// the one we expect the server to have, when it tells us.
+	serverOptions string
+
+	// credentialProvider is the OPTIONAL provider of the credentials.
+	credentialProvider config.CredentialProvider
+
+	// password is our private copy of the configured password. With auth-nocache, it is the
+	// only copy (see [config.Config.Password]), which we zero once we have sent it.
+	password []byte
+
+	// username is the username returned by the credential provider, which
+	// we reuse along with the auth-token pushed by the server.
+	username string
+
+	// pushRequestInterval is how long we wait for the push reply before sending the
+	// push request again, and pushRequestAttempts is how many times we send it.
+	pushRequestInterval time.Duration
+	pushRequestAttempts int
+
+	// onServerControl is the OPTIONAL callback for RESTART and HALT messages.
+	onServerControl func(message *model.ServerControl)
+
+	// activeConn is the conn of the established TLS session, which we keep
+	// open to read the control messages sent by the server.
+	activeConn net.Conn
+
+	// ownerMu guards owner.
+	ownerMu sync.Mutex
+
+	// owner is the only TLS session receiving the records coming up from the control
+	// channel, so that an old session cannot steal the records of a new one.
+	owner *recordOwner
+}
+
+// recordOwner is the TLS session receiving the records routed by recordRouter.
+type recordOwner struct {
+	// records is where we deliver the records.
+	records chan<- []byte
+
+	// hangup is closed when the owner does not want records anymore.
+	hangup <-chan any
+}
+
+// newRecordOwnerBio returns a [*tlsBio] that becomes the only receiver of the records
+// coming up from the control channel, until another one replaces it.
+func (ws *workersState) newRecordOwnerBio() *tlsBio {
+	records := make(chan []byte)
+	conn := newTLSBio(ws.logger, records, ws.tlsRecordDown)
+	ws.ownerMu.Lock()
+	ws.owner = &recordOwner{records: records, hangup: conn.hangup}
+	ws.ownerMu.Unlock()
+	return conn
+}
+
+// currentOwner returns the current record owner, if any.
+func (ws *workersState) currentOwner() *recordOwner {
+	defer ws.ownerMu.Unlock()
+	ws.ownerMu.Lock()
+	return ws.owner
+}
+
+// recordRouter is the only reader of the records coming up from the control channel,
+// and it delivers each of them to the TLS session that owned the records when we received
+// it. When the owner goes away in the meanwhile, the record belonged to its session, so
+// we drop it.
+func (ws *workersState) recordRouter() {
+	workerName := fmt.Sprintf("%s: recordRouter", serviceName)
+
+	defer func() {
+		ws.workersManager.OnWorkerDone(workerName)
+		ws.workersManager.StartShutdown()
+	}()
+
+	ws.logger.Debugf("%s: started", workerName)
+	for {
+		select {
+		case record := <-ws.tlsRecordUp:
+			owner := ws.currentOwner()
+			if owner == nil {
+				ws.logger.Debugf("%s: dropping record without a TLS session", workerName)
+				continue
+			}
+			select {
+			case owner.records <- record:
+			case <-owner.hangup:
+				ws.logger.Debugf("%s: dropping record of a closed TLS session", workerName)
+			case <-ws.workersManager.ShouldShutdown():
+				return
+			}
+
+		case <-ws.workersManager.ShouldShutdown():
+			return
+		}
+	}
 }
 
 // worker is the main loop of the tlssession
@@ -79,6 +198,7 @@ func (ws *workersState) worker() {
 	workerName := fmt.Sprintf("%s: worker", serviceName)
 
 	defer func() {
+		ws.closeActiveConn()
 		ws.workersManager.OnWorkerDone(workerName)
 		ws.workersManager.StartShutdown()
 	}()
@@ -92,8 +212,11 @@ func (ws *workersState) worker() {
 
 					// TODO(ainghazal): pass the failure to the tracer too.
 
-					if errors.Is(err, ErrBadCA) {
-						ws.sessionManager.Failure <- err
+					if IsFatalError(err) {
+						select {
+						case ws.sessionManager.Failure <- err:
+						case <-ws.workersManager.ShouldShutdown():
+						}
 						return
 					}
 					// The following errors are not handled, will just appear
@@ -109,11 +232,45 @@ func (ws *workersState) worker() {
 	}
 }
 
+// IsFatalError returns whether the given error is an unrecoverable handshake failure, which
+// a new handshake with the same config would not fix (e.g., a bad CA or rejected credentials).
+func IsFatalError(err error) bool {
+	for _, target := range []error{ErrBadCA, ErrBadKeypair, errBadAuth, errPushRejected,
+		errCompressionNotAllowed, ErrNoPushReply, errOptionsMismatch, config.ErrNoCommonCipher,
+		errPasswordNotCached} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeActiveConn closes the conn of the established TLS session, if any, which
+// stops reading the control messages sent by the server.
+func (ws *workersState) closeActiveConn() {
+	if ws.activeConn != nil {
+		ws.activeConn.Close()
+		ws.activeConn = nil
+	}
+}
+
 // tlsAuth runs the TLS auth algorithm
 func (ws *workersState) tlsAuth() error {
-	// create the BIO to use channels as a socket
-	conn := newTLSBio(ws.logger, ws.tlsRecordUp, ws.tlsRecordDown)
-	defer conn.Close()
+	// the previous session, if any, must not read the records of the new one
+	ws.closeActiveConn()
+
+	// create the BIO to use channels as a socket, which receives all the records from now on
+	conn := ws.newRecordOwnerBio()
+
+	// on success, we keep the conn open to read the control messages
+	success := false
+	defer func() {
+		if success {
+			ws.activeConn = conn
+			return
+		}
+		conn.Close()
+	}()
 
 	// we construct the certCfg from options, that has access to the certificate material
 	certCfg, err := newCertConfigFromOptions(ws.options)
@@ -127,12 +284,22 @@ func (ws *workersState) tlsAuth() error {
 		return err
 	}
 
-	// run the real algorithm in a background goroutine
-	errorch := make(chan error)
-	go ws.doTLSAuth(conn, tlsConf, errorch)
+	// factory is the TLS client implementation selected by the options
+	factory, err := tlsFactoryFromOptions(ws.options)
+	if err != nil {
+		return err
+	}
+
+	// run the real algorithm in a background goroutine, which stops as soon as we return
+	// without waiting for it (e.g., on shutdown), since we also close the conn
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errorch := make(chan error, 1)
+	go ws.doTLSAuth(ctx, conn, tlsConf, factory, errorch)
 
 	select {
 	case err := <-errorch:
+		success = err == nil
 		return err
 
 	case <-ws.workersManager.ShouldShutdown():
@@ -141,17 +308,20 @@ func (ws *workersState) tlsAuth() error {
 }
 
 // doTLSAuth is the internal implementation of tlsAuth such that tlsAuth
-// can interrupt this function early if needed.
-func (ws *workersState) doTLSAuth(conn net.Conn, config *tls.Config, errorch chan<- error) {
+// can interrupt this function early if needed, by canceling the context and closing the
+// conn. The errorch channel MUST be buffered, since nobody may be reading it anymore.
+func (ws *workersState) doTLSAuth(ctx context.Context, conn net.Conn, config *tls.Config,
+	factory tlsFactory, errorch chan<- error) {
 	ws.logger.Debug("tlsession: doTLSAuth: started")
 	defer ws.logger.Debug("tlssession: doTLSAuth: done")
 
 	// do the TLS handshake
-	tlsConn, err := tlsHandshakeFn(conn, config)
+	tlsConn, err := tlsHandshakeFn(conn, config, factory)
 	if err != nil {
 		errorch <- err
 		return
 	}
+	ws.sessionManager.ReportProgress(model.ProgressTLSDone)
 	// In case you're wondering why we don't need to close the conn:
 	// we don't care since the underlying conn is a tlsBio
 	// defer tlsConn.Close()
@@ -188,17 +358,21 @@ func (ws *workersState) doTLSAuth(conn net.Conn, config *tls.Config, errorch cha
 	activeKey.AddRemoteKey(remoteKey)
 	ws.sessionManager.SetNegotiationState(model.S_GOT_KEY)
 
-	// send the push request
-	if err := ws.sendPushRequestMessage(tlsConn); err != nil {
+	// send the push request, and obtain tunnel info from the push response
+	tinfo, pushedOptions, err := ws.pushRequest(ctx, tlsConn)
+	if err != nil {
 		errorch <- err
 		return
 	}
+	ws.sessionManager.ReportProgress(model.ProgressPushReceived)
 
-	// obtain tunnel info from the push response
-	tinfo, err := ws.recvPushResponseMessage(tlsConn)
-	if err != nil {
-		errorch <- err
-		return
+	// make sure the remote options are compatible with ours
+	if err := checkOptionsConsistency(ws.serverOptions, serverOptions, tinfo.Cipher, pushedOptions); err != nil {
+		if ws.options.StrictOCC {
+			errorch <- err
+			return
+		}
+		ws.logger.Warnf("tlssession: %s", err.Error())
 	}
 
 	// update with extra information obtained from push response
@@ -208,21 +382,150 @@ func (ws *workersState) doTLSAuth(conn net.Conn, config *tls.Config, errorch cha
 	ws.sessionManager.SetNegotiationState(model.S_ACTIVE)
 
 	// notify the datachannel that we've got a key pair ready to use
-	ws.keyUp <- activeKey
+	select {
+	case ws.keyUp <- activeKey:
+	case <-ctx.Done():
+		errorch <- ctx.Err()
+		return
+	}
 
 	errorch <- nil
+
+	// keep reading the control messages sent by the server
+	ws.readControlMessages(tlsConn)
+}
+
+// maxPendingControlMessage is the maximum size of a control message that we buffer while
+// waiting for its terminating NUL byte.
+const maxPendingControlMessage = 1 << 16
+
+// readControlMessages reads the control messages sent by the server over the established
+// TLS session, until the conn is closed. Since a NUL-terminated message may span several
+// reads, we buffer the incomplete ones. When the server tells us to restart or halt, we
+// invoke the OnServerControl callback, if any, and shut down the workers.
+func (ws *workersState) readControlMessages(conn net.Conn) {
+	buffer := make([]byte, 1<<17)
+	var pending []byte
+	for {
+		count, err := conn.Read(buffer)
+		if err != nil {
+			ws.logger.Debugf("tlssession: stop reading control messages: %s", err.Error())
+			return
+		}
+		pending = append(pending, buffer[:count]...)
+		for {
+			end := bytes.IndexByte(pending, 0x00)
+			if end < 0 {
+				break
+			}
+			message := pending[:end]
+			pending = pending[end+1:]
+			if len(message) == 0 {
+				continue
+			}
+			control, ok := model.ParseServerControl(message)
+			if !ok {
+				ws.logger.Debugf("tlssession: ignoring control message: %s", message)
+				continue
+			}
+			ws.logger.Warnf("tlssession: server sent %s: %s", control.Kind, control.Reason)
+			if ws.onServerControl != nil {
+				ws.onServerControl(control)
+			}
+			ws.workersManager.StartShutdown()
+			return
+		}
+		if len(pending) > maxPendingControlMessage {
+			ws.logger.Warnf("tlssession: dropping %d bytes of unterminated control message", len(pending))
+			pending = nil
+		}
+	}
+}
+
+// errCannotGetCredentials indicates that the credential provider failed.
+var errCannotGetCredentials = errors.New("cannot get credentials")
+
+// errPasswordNotCached indicates that, with auth-nocache, we have already sent and wiped
+// the password, and the server did not push an auth-token we could use instead.
+var errPasswordNotCached = errors.New("auth-nocache: the password is not available anymore")
+
+// authOptions returns the options carrying the username to send in the auth request, and
+// the password to send, which is a copy that the caller should wipe after use.
+func (ws *workersState) authOptions() (*config.OpenVPNOptions, []byte, error) {
+	// if the server pushed an auth-token, we must use it in place of the password
+	if token := ws.sessionManager.AuthToken(); token != "" {
+		options := *ws.options
+		if ws.username != "" {
+			options.Username = ws.username
+		}
+		return &options, []byte(token), nil
+	}
+
+	provider := ws.credentialProvider
+	if provider == nil {
+		if ws.options.StaticChallenge != "" {
+			return nil, nil, fmt.Errorf("%w: %s", errCannotGetCredentials, "static-challenge requires a challenge responder")
+		}
+		if ws.options.AuthNoCache && ws.options.Username != "" && len(ws.password) == 0 {
+			return nil, nil, errPasswordNotCached
+		}
+		options := *ws.options
+		return &options, append([]byte{}, ws.password...), nil
+	}
+
+	// ask the provider for the credentials (e.g., a one-time password)
+	username, password, err := provider.Credentials()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errCannotGetCredentials, err)
+	}
+	ws.username = username
+	options := *ws.options
+	options.Username = username
+
+	// answer the static challenge, if any
+	if ws.options.StaticChallenge != "" {
+		responder, ok := provider.(config.ChallengeResponder)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s", errCannotGetCredentials, "static-challenge requires a challenge responder")
+		}
+		response, err := responder.ChallengeResponse(ws.options.StaticChallenge, ws.options.StaticChallengeEcho)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", errCannotGetCredentials, err)
+		}
+		password = encodeStaticChallengeResponse(password, response)
+	}
+	return &options, []byte(password), nil
 }
 
 // sendAuthRequestMessage sends the auth request message
 func (ws *workersState) sendAuthRequestMessage(tlsConn net.Conn, activeKey *session.DataChannelKey) error {
 	// this message is sending our options and asking the server to get AUTH
-	ctrlMsg, err := encodeClientControlMessageAsBytes(activeKey.Local(), ws.options)
+	options, password, err := ws.authOptions()
+	if err != nil {
+		return err
+	}
+	// the password is a copy we only need for this message
+	defer bytesx.ZeroBytes(password)
+
+	var ctrlMsg []byte
+	if ws.options.KeyMethod == 1 {
+		ctrlMsg, err = encodeClientControlMessageKeyMethod1AsBytes(activeKey.Local(), options, ws.serverOptions)
+	} else {
+		ctrlMsg, err = encodeClientControlMessageAsBytes(activeKey.Local(), options, ws.serverOptions, password)
+	}
 	if err != nil {
 		return err
 	}
 
 	// let's fire off the message
 	_, err = tlsConn.Write(ctrlMsg)
+
+	if ws.options.AuthNoCache {
+		// the message contains the credentials, and we won't need them again
+		bytesx.ZeroBytes(ctrlMsg)
+		bytesx.ZeroBytes(ws.password)
+		ws.password = nil
+	}
 	return err
 }
 
@@ -237,9 +540,56 @@ func (ws *workersState) recvAuthReplyMessage(conn net.Conn) (*session.KeySource,
 	data := buffer[:count]
 
 	// parse what we received
+	if ws.options.KeyMethod == 1 {
+		return parseServerControlMessageKeyMethod1(data, ws.options)
+	}
 	return parseServerControlMessage(data)
 }
 
+// ErrNoPushReply indicates that the server did not answer any of our push requests.
+var ErrNoPushReply = errors.New("no push reply")
+
+// pushRequest sends the push request and returns the tunnel info and all the pushed options.
+// Like the reference implementation, we send the push request again when the server does
+// not reply in time, and we fail with [ErrNoPushReply] after the configured attempts. We
+// stop retrying and return the context error as soon as the context is done.
+func (ws *workersState) pushRequest(ctx context.Context, conn net.Conn) (*model.TunnelInfo, remoteOptions, error) {
+	type readResult struct {
+		data []byte
+		err  error
+	}
+	// the read returns when the conn is closed, which happens when the handshake fails
+	readch := make(chan readResult, 1)
+	go func() {
+		buffer := make([]byte, 1<<17)
+		count, err := conn.Read(buffer)
+		readch <- readResult{buffer[:count], err}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		if err := ws.sendPushRequestMessage(conn); err != nil {
+			return nil, nil, err
+		}
+		timer := time.NewTimer(ws.pushRequestInterval)
+		select {
+		case result := <-readch:
+			timer.Stop()
+			if result.err != nil {
+				return nil, nil, result.err
+			}
+			return ws.parsePushResponseMessage(result.data)
+		case <-timer.C:
+			if attempt >= ws.pushRequestAttempts {
+				return nil, nil, fmt.Errorf("%w: after %d attempts", ErrNoPushReply, attempt)
+			}
+			ws.logger.Infof("tlssession: no push reply, sending the push request again")
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
 // sendPushRequestMessage sends the push request message
 func (ws *workersState) sendPushRequestMessage(conn net.Conn) error {
 	data := append([]byte("PUSH_REQUEST"), 0x00)
@@ -247,16 +597,32 @@ func (ws *workersState) sendPushRequestMessage(conn net.Conn) error {
 	return err
 }
 
-// recvPushResponseMessage receives and parses the push response message
-func (ws *workersState) recvPushResponseMessage(conn net.Conn) (*model.TunnelInfo, error) {
-	// read raw bytes
-	buffer := make([]byte, 1<<17)
-	count, err := conn.Read(buffer)
+// parsePushResponseMessage parses the push response message, returning the tunnel
+// info and all the pushed options.
+func (ws *workersState) parsePushResponseMessage(data []byte) (*model.TunnelInfo, remoteOptions, error) {
+	var err error
+
+	// drop the pushed options we do not want, if any
+	data, err = filterPushReply(ws.logger, ws.options, data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	data := buffer[:count]
 
 	// parse what we received
-	return parseServerPushReply(ws.logger, data)
+	tinfo, err := parseServerPushReply(ws.logger, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	mergeLocalRouting(ws.options, tinfo)
+
+	// decide which data channel cipher to use
+	if tinfo.Cipher, err = ws.options.NegotiateCipher(tinfo.Cipher); err != nil {
+		return nil, nil, err
+	}
+
+	// keep the auth-token, if any, for the next renegotiation
+	if token := parsePushedAuthToken(data); token != "" {
+		ws.sessionManager.SetAuthToken(token)
+	}
+	return tinfo, pushedOptionsAsMap(data), nil
 }
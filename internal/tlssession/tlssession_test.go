@@ -0,0 +1,683 @@
+package tlssession
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/session"
+	"github.com/ooni/minivpn/internal/vpntest"
+	"github.com/ooni/minivpn/internal/workers"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+func Test_workersState_sendAuthRequestMessage(t *testing.T) {
+	// sendAuthRequest sends the auth request over a conn that keeps a reference
+	// to the written buffer, and returns such buffer.
+	sendAuthRequest := func(t *testing.T, options *config.OpenVPNOptions, password []byte) []byte {
+		var written []byte
+		conn := &vpntest.Conn{
+			MockWrite: func(b []byte) (int, error) {
+				written = b
+				return len(b), nil
+			},
+		}
+		localKey, err := session.NewKeySource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		activeKey := &session.DataChannelKey{}
+		activeKey.AddLocalKey(localKey)
+		ws := &workersState{
+			logger:         model.NewTestLogger(),
+			options:        options,
+			password:       password,
+			sessionManager: makeTestingSession(),
+		}
+		if err := ws.sendAuthRequestMessage(conn, activeKey); err != nil {
+			t.Fatal(err)
+		}
+		return written
+	}
+
+	newOptions := func(authNoCache bool) *config.OpenVPNOptions {
+		return &config.OpenVPNOptions{
+			Cipher:      "AES-128-GCM",
+			Auth:        "SHA512",
+			Proto:       config.ProtoUDP,
+			Username:    "user",
+			Password:    "secret",
+			AuthNoCache: authNoCache,
+		}
+	}
+
+	t.Run("with auth-nocache the credentials are wiped after use", func(t *testing.T) {
+		options := newOptions(true)
+		password := []byte(options.Password)
+		written := sendAuthRequest(t, options, password)
+		if !bytes.Equal(written, make([]byte, len(written))) {
+			t.Error("expected the control message buffer to be zeroed")
+		}
+		if !bytes.Equal(password, make([]byte, len(password))) {
+			t.Error("expected our copy of the password to be zeroed")
+		}
+		if options.Password != "secret" {
+			t.Error("the shared options should not be modified")
+		}
+	})
+
+	t.Run("with auth-nocache a rekey needs an auth-token", func(t *testing.T) {
+		var written []byte
+		conn := &vpntest.Conn{
+			MockWrite: func(b []byte) (int, error) {
+				written = append([]byte{}, b...)
+				return len(b), nil
+			},
+		}
+		localKey, err := session.NewKeySource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		activeKey := &session.DataChannelKey{}
+		activeKey.AddLocalKey(localKey)
+		ws := &workersState{
+			logger:         model.NewTestLogger(),
+			options:        newOptions(true),
+			password:       []byte("secret"),
+			sessionManager: makeTestingSession(),
+		}
+		if err := ws.sendAuthRequestMessage(conn, activeKey); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(written, []byte("secret")) {
+			t.Fatal("expected the first auth request to contain the password")
+		}
+
+		// test that a rekey fails clearly rather than sending an empty password
+		written = nil
+		err = ws.sendAuthRequestMessage(conn, activeKey)
+		if !errors.Is(err, errPasswordNotCached) {
+			t.Fatalf("sendAuthRequestMessage() error = %v, want %v", err, errPasswordNotCached)
+		}
+		if !IsFatalError(err) {
+			t.Error("expected the error to be fatal")
+		}
+		if written != nil {
+			t.Error("expected no auth request to be sent")
+		}
+
+		// test that a rekey with a pushed auth-token works
+		ws.sessionManager.SetAuthToken("token")
+		if err := ws.sendAuthRequestMessage(conn, activeKey); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(written, []byte("token")) || bytes.Contains(written, []byte("secret")) {
+			t.Error("expected the rekey auth request to contain the auth-token only")
+		}
+	})
+
+	t.Run("without auth-nocache the credentials are kept", func(t *testing.T) {
+		options := newOptions(false)
+		password := []byte(options.Password)
+		written := sendAuthRequest(t, options, password)
+		if !bytes.Contains(written, []byte("secret")) {
+			t.Error("expected the control message to contain the password")
+		}
+		if string(password) != "secret" {
+			t.Error("expected the password to be kept")
+		}
+	})
+}
+
+func Test_workersState_parsePushResponseMessage_cipher(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    string
+		wantErr error
+	}{
+		{"we use an accepted pushed cipher", "PUSH_REPLY,cipher AES-256-GCM\x00", "AES-256-GCM", nil},
+		{"we fail when the pushed cipher is not accepted", "PUSH_REPLY,cipher AES-128-CBC\x00", "", config.ErrNoCommonCipher},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := &workersState{
+				logger: model.NewTestLogger(),
+				options: &config.OpenVPNOptions{
+					Cipher:      "AES-128-GCM",
+					DataCiphers: []string{"AES-256-GCM", "AES-128-GCM"},
+				},
+				sessionManager: makeTestingSession(),
+			}
+			tinfo, _, err := ws.parsePushResponseMessage([]byte(tt.reply))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parsePushResponseMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && tinfo.Cipher != tt.want {
+				t.Errorf("parsePushResponseMessage() cipher = %q, want %q", tinfo.Cipher, tt.want)
+			}
+		})
+	}
+}
+
+// test that the OCC accepts a negotiated cipher that differs from the configured one
+func Test_workersState_parsePushResponseMessage_ncp(t *testing.T) {
+	ws := &workersState{
+		logger: model.NewTestLogger(),
+		options: &config.OpenVPNOptions{
+			Cipher:      "AES-256-CBC",
+			Auth:        "SHA1",
+			DataCiphers: []string{"AES-256-GCM", "AES-256-CBC"},
+		},
+		sessionManager: makeTestingSession(),
+	}
+	tinfo, pushed, err := ws.parsePushResponseMessage([]byte("PUSH_REPLY,cipher AES-256-GCM,ping 10\x00"))
+	if err != nil {
+		t.Fatalf("parsePushResponseMessage() error = %v", err)
+	}
+	remote := "V4,dev-type tun,link-mtu 1601,tun-mtu 1500,proto UDPv4,cipher AES-256-CBC,auth [null-digest],keysize 256,key-method 2,tls-server"
+	if err := checkOptionsConsistency(ws.options.ServerOptionsString(), remote, tinfo.Cipher, pushed); err != nil {
+		t.Errorf("checkOptionsConsistency() error = %v", err)
+	}
+}
+
+func Test_workersState_parsePushResponseMessage_compression(t *testing.T) {
+	newWorkersState := func(policy config.AllowCompression) *workersState {
+		return &workersState{
+			logger: model.NewTestLogger(),
+			options: &config.OpenVPNOptions{
+				Cipher:           "AES-128-GCM",
+				Auth:             "SHA1",
+				Compress:         config.CompressionStub,
+				AllowCompression: policy,
+			},
+			sessionManager: makeTestingSession(),
+		}
+	}
+	reply := []byte("PUSH_REPLY,compress lz4,ping 10\x00")
+
+	t.Run("allow-compression no fails when the remote pushes compression", func(t *testing.T) {
+		ws := newWorkersState(config.AllowCompressionNo)
+		_, _, err := ws.parsePushResponseMessage(reply)
+		if !errors.Is(err, errCompressionNotAllowed) {
+			t.Fatalf("parsePushResponseMessage() error = %v, want %v", err, errCompressionNotAllowed)
+		}
+		// test that we fail fast rather than retrying the handshake
+		if !IsFatalError(err) {
+			t.Error("expected the error to be fatal")
+		}
+	})
+
+	t.Run("allow-compression asym lets the OCC see the pushed compression", func(t *testing.T) {
+		ws := newWorkersState(config.AllowCompressionAsym)
+		tinfo, pushed, err := ws.parsePushResponseMessage(reply)
+		if err != nil {
+			t.Fatalf("parsePushResponseMessage() error = %v", err)
+		}
+		err = checkOptionsConsistency(ws.options.ServerOptionsString(), "", tinfo.Cipher, pushed)
+		if !errors.Is(err, errOptionsMismatch) || !strings.Contains(err.Error(), "compress lz4") {
+			t.Errorf("checkOptionsConsistency() error = %v", err)
+		}
+	})
+}
+
+func Test_workersState_authToken(t *testing.T) {
+	ws := &workersState{
+		logger: model.NewTestLogger(),
+		options: &config.OpenVPNOptions{
+			Cipher:   "AES-128-GCM",
+			Auth:     "SHA512",
+			Proto:    config.ProtoUDP,
+			Username: "user",
+			Password: "secret",
+		},
+		sessionManager: makeTestingSession(),
+	}
+
+	// receive a push reply containing an auth-token
+	pushReply := []byte("PUSH_REPLY,auth-token SESS_ID_c2VjcmV0dG9rZW4=,ifconfig 10.8.0.6 255.255.255.0\x00")
+	if _, _, err := ws.parsePushResponseMessage(pushReply); err != nil {
+		t.Fatal(err)
+	}
+	if token := ws.sessionManager.AuthToken(); token != "SESS_ID_c2VjcmV0dG9rZW4=" {
+		t.Fatalf("unexpected auth-token: %q", token)
+	}
+
+	// the next control message should carry the token instead of the password
+	var written []byte
+	conn := &vpntest.Conn{
+		MockWrite: func(b []byte) (int, error) {
+			written = b
+			return len(b), nil
+		},
+	}
+	localKey, err := session.NewKeySource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeKey := &session.DataChannelKey{}
+	activeKey.AddLocalKey(localKey)
+	if err := ws.sendAuthRequestMessage(conn, activeKey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(written, []byte("SESS_ID_c2VjcmV0dG9rZW4=")) {
+		t.Error("expected the control message to contain the auth-token")
+	}
+	if bytes.Contains(written, []byte("secret\x00")) {
+		t.Error("expected the control message not to contain the password")
+	}
+	if ws.options.Password != "secret" {
+		t.Error("the original options should not be modified")
+	}
+}
+
+func Test_workersState_pushRequest(t *testing.T) {
+	// newConn returns a conn that answers the push request number replyAt with a push
+	// reply, or never answers when replyAt is zero, and counts the push requests.
+	newConn := func(replyAt int32, requests *atomic.Int32) *vpntest.Conn {
+		replies := make(chan []byte, 1)
+		closed := make(chan any)
+		return &vpntest.Conn{
+			MockWrite: func(b []byte) (int, error) {
+				if requests.Add(1) == replyAt {
+					replies <- []byte("PUSH_REPLY,ifconfig 10.8.0.6 255.255.255.0\x00")
+				}
+				return len(b), nil
+			},
+			MockRead: func(b []byte) (int, error) {
+				select {
+				case reply := <-replies:
+					return copy(b, reply), nil
+				case <-closed:
+					return 0, net.ErrClosed
+				}
+			},
+			MockClose: func() error {
+				close(closed)
+				return nil
+			},
+		}
+	}
+	newWorkersState := func() *workersState {
+		return &workersState{
+			logger:              model.NewTestLogger(),
+			options:             &config.OpenVPNOptions{},
+			pushRequestAttempts: 3,
+			pushRequestInterval: 10 * time.Millisecond,
+			sessionManager:      makeTestingSession(),
+		}
+	}
+
+	t.Run("we fail after the configured attempts if the server never replies", func(t *testing.T) {
+		var requests atomic.Int32
+		conn := newConn(0, &requests)
+		defer conn.Close()
+		_, _, err := newWorkersState().pushRequest(context.Background(), conn)
+		if !errors.Is(err, ErrNoPushReply) {
+			t.Fatalf("pushRequest() error = %v, want %v", err, ErrNoPushReply)
+		}
+		if got := requests.Load(); got != 3 {
+			t.Errorf("sent %d push requests, want 3", got)
+		}
+	})
+
+	t.Run("we resend the push request until the server replies", func(t *testing.T) {
+		var requests atomic.Int32
+		conn := newConn(2, &requests)
+		defer conn.Close()
+		tinfo, _, err := newWorkersState().pushRequest(context.Background(), conn)
+		if err != nil {
+			t.Fatalf("pushRequest() error = %v", err)
+		}
+		if tinfo.IP != "10.8.0.6" {
+			t.Errorf("unexpected tunnel IP: %q", tinfo.IP)
+		}
+		if got := requests.Load(); got != 2 {
+			t.Errorf("sent %d push requests, want 2", got)
+		}
+	})
+
+	t.Run("we stop retrying when the context is canceled", func(t *testing.T) {
+		var requests atomic.Int32
+		conn := newConn(0, &requests)
+		defer conn.Close()
+		ws := newWorkersState()
+		ws.pushRequestAttempts = 1000
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, _, err := ws.pushRequest(ctx, conn)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("pushRequest() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("pushRequest() returned after %s", elapsed)
+		}
+	})
+}
+
+// otpProvider is a [config.CredentialProvider] composing the password with a one-time code.
+type otpProvider struct {
+	otp string
+	err error
+}
+
+func (p *otpProvider) Credentials() (string, string, error) {
+	if p.err != nil {
+		return "", "", p.err
+	}
+	return "otpuser", "secret" + p.otp, nil
+}
+
+func Test_workersState_credentialProvider(t *testing.T) {
+	sendAuthRequest := func(options *config.OpenVPNOptions) ([]byte, error) {
+		var written []byte
+		conn := &vpntest.Conn{
+			MockWrite: func(b []byte) (int, error) {
+				written = append([]byte{}, b...)
+				return len(b), nil
+			},
+		}
+		localKey, err := session.NewKeySource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		activeKey := &session.DataChannelKey{}
+		activeKey.AddLocalKey(localKey)
+		ws := &workersState{
+			credentialProvider: options.CredentialProvider,
+			logger:             model.NewTestLogger(),
+			options:            options,
+			sessionManager:     makeTestingSession(),
+		}
+		err = ws.sendAuthRequestMessage(conn, activeKey)
+		return written, err
+	}
+
+	t.Run("the provider credentials take precedence over the static ones", func(t *testing.T) {
+		options := &config.OpenVPNOptions{
+			Cipher:             "AES-128-GCM",
+			Auth:               "SHA512",
+			Proto:              config.ProtoUDP,
+			Username:           "user",
+			Password:           "static",
+			CredentialProvider: &otpProvider{otp: "123456"},
+		}
+		written, err := sendAuthRequest(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(written, []byte("otpuser\x00")) {
+			t.Error("expected the control message to contain the provided username")
+		}
+		if !bytes.Contains(written, []byte("secret123456\x00")) {
+			t.Error("expected the control message to contain the composed password")
+		}
+		if bytes.Contains(written, []byte("static")) {
+			t.Error("expected the control message not to contain the static password")
+		}
+	})
+
+	t.Run("a provider error is propagated", func(t *testing.T) {
+		options := &config.OpenVPNOptions{
+			Cipher:             "AES-128-GCM",
+			Auth:               "SHA512",
+			Proto:              config.ProtoUDP,
+			CredentialProvider: &otpProvider{err: errors.New("user cancelled")},
+		}
+		if _, err := sendAuthRequest(options); !errors.Is(err, errCannotGetCredentials) {
+			t.Errorf("expected %v, got %v", errCannotGetCredentials, err)
+		}
+	})
+}
+
+// challengeProvider is a [config.ChallengeResponder] returning a fixed response.
+type challengeProvider struct {
+	otpProvider
+	gotChallenge string
+	gotEcho      bool
+}
+
+func (p *challengeProvider) ChallengeResponse(challenge string, echo bool) (string, error) {
+	p.gotChallenge, p.gotEcho = challenge, echo
+	return "123456", nil
+}
+
+func Test_workersState_authOptionsStaticChallenge(t *testing.T) {
+	newOptions := func(provider config.CredentialProvider) *config.OpenVPNOptions {
+		return &config.OpenVPNOptions{
+			Username:            "user",
+			Password:            "static",
+			StaticChallenge:     "Enter PIN",
+			StaticChallengeEcho: true,
+			CredentialProvider:  provider,
+		}
+	}
+
+	t.Run("the challenge response is encoded with SCRV1", func(t *testing.T) {
+		provider := &challengeProvider{}
+		ws := &workersState{
+			credentialProvider: provider,
+			options:            newOptions(provider),
+			sessionManager:     makeTestingSession(),
+		}
+		options, password, err := ws.authOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if options.Username != "otpuser" {
+			t.Errorf("expected username otpuser, got %q", options.Username)
+		}
+		// base64("secret") and base64("123456")
+		if want := "SCRV1:c2VjcmV0:MTIzNDU2"; string(password) != want {
+			t.Errorf("expected password %q, got %q", want, password)
+		}
+		if provider.gotChallenge != "Enter PIN" || !provider.gotEcho {
+			t.Errorf("unexpected challenge: %q %v", provider.gotChallenge, provider.gotEcho)
+		}
+	})
+
+	t.Run("a provider that cannot respond to the challenge fails", func(t *testing.T) {
+		ws := &workersState{
+			credentialProvider: &otpProvider{},
+			options:            newOptions(&otpProvider{}),
+			sessionManager:     makeTestingSession(),
+		}
+		if _, _, err := ws.authOptions(); !errors.Is(err, errCannotGetCredentials) {
+			t.Errorf("expected %v, got %v", errCannotGetCredentials, err)
+		}
+	})
+
+	t.Run("a static challenge without provider fails", func(t *testing.T) {
+		ws := &workersState{
+			options:        newOptions(nil),
+			sessionManager: makeTestingSession(),
+		}
+		if _, _, err := ws.authOptions(); !errors.Is(err, errCannotGetCredentials) {
+			t.Errorf("expected %v, got %v", errCannotGetCredentials, err)
+		}
+	})
+
+	t.Run("with an auth-token we do not answer the challenge again", func(t *testing.T) {
+		provider := &challengeProvider{}
+		ws := &workersState{
+			credentialProvider: provider,
+			options:            newOptions(provider),
+			sessionManager:     makeTestingSession(),
+			username:           "otpuser",
+		}
+		ws.sessionManager.SetAuthToken("token")
+		options, password, err := ws.authOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if options.Username != "otpuser" || string(password) != "token" {
+			t.Errorf("unexpected credentials: %q %q", options.Username, password)
+		}
+		if provider.gotChallenge != "" {
+			t.Error("expected the challenge not to be asked")
+		}
+	})
+}
+
+func Test_encodeStaticChallengeResponse(t *testing.T) {
+	got := encodeStaticChallengeResponse("pass", "OTP")
+	if want := "SCRV1:cGFzcw==:T1RQ"; got != want {
+		t.Errorf("encodeStaticChallengeResponse() = %q, want %q", got, want)
+	}
+}
+
+func Test_workersState_readControlMessages(t *testing.T) {
+	// newConn returns a conn delivering the given messages, and then net.ErrClosed.
+	newConn := func(messages ...string) net.Conn {
+		return &vpntest.Conn{
+			MockRead: func(b []byte) (int, error) {
+				if len(messages) == 0 {
+					return 0, net.ErrClosed
+				}
+				count := copy(b, messages[0])
+				messages = messages[1:]
+				return count, nil
+			},
+		}
+	}
+
+	t.Run("a RESTART message fires the callback and starts the shutdown", func(t *testing.T) {
+		var got *model.ServerControl
+		ws := &workersState{
+			logger: model.NewTestLogger(),
+			onServerControl: func(message *model.ServerControl) {
+				got = message
+			},
+			workersManager: workers.NewManager(model.NewTestLogger()),
+		}
+		ws.readControlMessages(newConn("INFO,hello\x00", "RESTART,server shutting down\x00"))
+		want := &model.ServerControl{Kind: model.ServerControlRestart, Reason: "server shutting down"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Error(diff)
+		}
+		select {
+		case <-ws.workersManager.ShouldShutdown():
+		default:
+			t.Error("expected the shutdown to start")
+		}
+	})
+
+	t.Run("a HALT message works without a callback", func(t *testing.T) {
+		ws := &workersState{
+			logger:         model.NewTestLogger(),
+			workersManager: workers.NewManager(model.NewTestLogger()),
+		}
+		ws.readControlMessages(newConn("HALT\x00"))
+		select {
+		case <-ws.workersManager.ShouldShutdown():
+		default:
+			t.Error("expected the shutdown to start")
+		}
+	})
+
+	t.Run("other messages are ignored until the conn is closed", func(t *testing.T) {
+		called := false
+		ws := &workersState{
+			logger: model.NewTestLogger(),
+			onServerControl: func(message *model.ServerControl) {
+				called = true
+			},
+			workersManager: workers.NewManager(model.NewTestLogger()),
+		}
+		ws.readControlMessages(newConn("INFO,hello\x00", "PUSH_REPLY,ping 10\x00"))
+		if called {
+			t.Error("expected the callback not to be called")
+		}
+		select {
+		case <-ws.workersManager.ShouldShutdown():
+			t.Error("expected the shutdown not to start")
+		default:
+		}
+	})
+
+	t.Run("a message split across reads is reassembled", func(t *testing.T) {
+		var got *model.ServerControl
+		ws := &workersState{
+			logger: model.NewTestLogger(),
+			onServerControl: func(message *model.ServerControl) {
+				got = message
+			},
+			workersManager: workers.NewManager(model.NewTestLogger()),
+		}
+		ws.readControlMessages(newConn("INFO,hello\x00RESTART,server ", "shutting down\x00"))
+		want := &model.ServerControl{Kind: model.ServerControlRestart, Reason: "server shutting down"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Error(diff)
+		}
+	})
+}
+
+func Test_workersState_recordRouter(t *testing.T) {
+	workersManager := workers.NewManager(model.NewTestLogger())
+	recordUp := make(chan []byte)
+	ws := &workersState{
+		logger:         model.NewTestLogger(),
+		tlsRecordUp:    recordUp,
+		tlsRecordDown:  make(chan []byte),
+		workersManager: workersManager,
+	}
+	workersManager.StartWorker(ws.recordRouter)
+	defer func() {
+		workersManager.StartShutdown()
+		workersManager.WaitWorkersShutdown()
+	}()
+
+	oldConn := ws.newRecordOwnerBio()
+	recordUp <- []byte("old")
+	buffer := make([]byte, 16)
+	count, err := oldConn.Read(buffer)
+	if err != nil || string(buffer[:count]) != "old" {
+		t.Fatalf("old conn: got %q, %v", buffer[:count], err)
+	}
+
+	// once a new session owns the records, the old one must not steal them
+	newConn := ws.newRecordOwnerBio()
+	oldConn.Close()
+	recordUp <- []byte("new")
+	count, err = newConn.Read(buffer)
+	if err != nil || string(buffer[:count]) != "new" {
+		t.Fatalf("new conn: got %q, %v", buffer[:count], err)
+	}
+	if _, err := oldConn.Read(buffer); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("old conn: expected net.ErrClosed, got %v", err)
+	}
+}
+
+func TestIsFatalError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad ca", fmt.Errorf("%w: %s", ErrBadCA, "cannot parse ca cert"), true},
+		{"bad keypair", fmt.Errorf("%w: %s", ErrBadKeypair, "no key"), true},
+		{"auth failure", &AuthError{Reason: "bad password"}, true},
+		{"no push reply", fmt.Errorf("%w: after %d attempts", ErrNoPushReply, 3), true},
+		{"no common cipher", config.ErrNoCommonCipher, true},
+		{"compression not allowed", fmt.Errorf("%w: compress lz4", errCompressionNotAllowed), true},
+		{"tls handshake failure", fmt.Errorf("%w: %s", ErrBadTLSHandshake, "eof"), false},
+		{"shutdown", workers.ErrShutdown, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsFatalError(tt.err); got != tt.want {
+				t.Errorf("IsFatalError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
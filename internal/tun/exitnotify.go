@@ -0,0 +1,77 @@
+package tun
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/networkio"
+)
+
+// exitNotifyTimeout is the maximum time we wait for the exit-notify to reach the network.
+const exitNotifyTimeout = 250 * time.Millisecond
+
+// dataObserverConn is a [networkio.FramingConn] that signals when a data packet has
+// been written to the network, which allows us to flush the exit-notify before closing.
+type dataObserverConn struct {
+	networkio.FramingConn
+	dataWritten chan any
+}
+
+// newDataObserverConn wraps the given conn.
+func newDataObserverConn(conn networkio.FramingConn) *dataObserverConn {
+	return &dataObserverConn{
+		FramingConn: conn,
+		dataWritten: make(chan any, 1),
+	}
+}
+
+// WriteRawPacket implements networkio.FramingConn
+func (c *dataObserverConn) WriteRawPacket(pkt []byte) error {
+	if err := c.FramingConn.WriteRawPacket(pkt); err != nil {
+		return err
+	}
+	if len(pkt) > 0 && model.Opcode(pkt[0]>>3).IsData() {
+		select {
+		case c.dataWritten <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+// sendExitNotify tells the remote that we're going away, so that it can release our
+// session immediately, when configured using explicit-exit-notify. We only do this for UDP,
+// since with TCP the remote notices that we're closing the connection. We do not wait for
+// the data channel to accept the message, and we wait for at most exitNotifyTimeout for
+// the message to reach the network.
+func (t *TUN) sendExitNotify() {
+	if !t.exitNotify || !strings.HasPrefix(t.network, "udp") {
+		return
+	}
+	if t.session.NegotiationState() < model.S_GENERATED_KEYS {
+		return
+	}
+
+	// forget about data packets we've written before
+	select {
+	case <-t.conn.dataWritten:
+	default:
+	}
+
+	select {
+	case t.tunDown <- model.OCCExitPayload():
+	default:
+		t.logger.Warn("tun: data channel busy, not sending exit-notify")
+		return
+	}
+
+	timer := time.NewTimer(exitNotifyTimeout)
+	defer timer.Stop()
+	select {
+	case <-t.conn.dataWritten:
+		t.logger.Debug("tun: exit-notify sent")
+	case <-timer.C:
+		t.logger.Warn("tun: timeout flushing exit-notify")
+	}
+}
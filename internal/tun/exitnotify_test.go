@@ -0,0 +1,111 @@
+package tun
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/vpntest"
+)
+
+// setGeneratedKeys moves the session to the S_GENERATED_KEYS state.
+func setGeneratedKeys(tunnel *TUN) {
+	go func() {
+		<-tunnel.session.Ready
+	}()
+	tunnel.session.SetNegotiationState(model.S_GENERATED_KEYS)
+}
+
+func TestTUN_CloseSendsExitNotify(t *testing.T) {
+	// events records the order in which things happen to the conn
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	conn := &vpntest.Conn{
+		MockWrite: func(b []byte) (int, error) {
+			record("write")
+			return len(b), nil
+		},
+		MockClose: func() error {
+			record("close")
+			return nil
+		},
+	}
+
+	t.Run("with keys, the exit-notify is sent before closing the transport", func(t *testing.T) {
+		events = nil
+		tunnel := makeTestingTUNWithConn(t, conn)
+		tunnel.exitNotify = true
+		tunnel.tunDown = make(chan []byte, 1)
+		setGeneratedKeys(tunnel)
+
+		// simulate the workers moving the exit-notify down to the network
+		go func() {
+			payload := <-tunnel.tunDown
+			if !bytes.Equal(payload, model.OCCExitPayload()) {
+				t.Errorf("unexpected payload: %x", payload)
+			}
+			dataPacket := []byte{byte(model.P_DATA_V2) << 3, 0x00, 0x00, 0x01}
+			tunnel.conn.WriteRawPacket(dataPacket)
+		}()
+
+		tunnel.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(events) != 2 || events[0] != "write" || events[1] != "close" {
+			t.Errorf("unexpected events: %v", events)
+		}
+	})
+
+	t.Run("without explicit-exit-notify, we just close the transport", func(t *testing.T) {
+		events = nil
+		tunnel := makeTestingTUNWithConn(t, conn)
+		tunnel.tunDown = make(chan []byte, 1)
+		setGeneratedKeys(tunnel)
+		tunnel.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(events) != 1 || events[0] != "close" {
+			t.Errorf("unexpected events: %v", events)
+		}
+		if len(tunnel.tunDown) != 0 {
+			t.Errorf("unexpected exit-notify")
+		}
+	})
+
+	t.Run("without keys, we just close the transport", func(t *testing.T) {
+		events = nil
+		tunnel := makeTestingTUNWithConn(t, conn)
+		tunnel.exitNotify = true
+		tunnel.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(events) != 1 || events[0] != "close" {
+			t.Errorf("unexpected events: %v", events)
+		}
+	})
+
+	t.Run("a busy data channel does not block Close", func(t *testing.T) {
+		events = nil
+		tunnel := makeTestingTUNWithConn(t, conn)
+		tunnel.exitNotify = true
+		setGeneratedKeys(tunnel)
+		tunnel.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(events) != 1 || events[0] != "close" {
+			t.Errorf("unexpected events: %v", events)
+		}
+	})
+}
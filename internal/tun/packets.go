@@ -0,0 +1,16 @@
+package tun
+
+// PacketChannels returns the channels to exchange raw IP packets with the tunnel, which is
+// useful for users that have their own packet source (e.g., a userspace network stack). We
+// deliver each decrypted IP packet on up, and we encrypt and send each IP packet written to
+// down. Do not mix these channels with [TUN.Read] and [TUN.Write], which consume the same
+// packets. The channels are not closed when the TUN is closed: use [TUN.Done] to know when
+// to stop using them.
+func (t *TUN) PacketChannels() (up <-chan []byte, down chan<- []byte) {
+	return t.tunUp, t.tunDown
+}
+
+// Done returns a channel that is closed when the TUN is closed.
+func (t *TUN) Done() <-chan any {
+	return t.hangup
+}
@@ -0,0 +1,110 @@
+package tun
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/minivpn/internal/datachannel"
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/session"
+	"github.com/ooni/minivpn/internal/vpntest"
+	"github.com/ooni/minivpn/internal/workers"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+// makeTestingDataChannelKey returns a ready data channel key with random key sources.
+func makeTestingDataChannelKey(t *testing.T) *session.DataChannelKey {
+	local, err := session.NewKeySource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := session.NewKeySource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &session.DataChannelKey{}
+	key.AddLocalKey(local)
+	key.AddRemoteKey(remote)
+	return key
+}
+
+func TestTUN_PacketChannels(t *testing.T) {
+	tunnel := makeTestingTUN(t)
+	tunnel.session.SetRemoteSessionID(model.SessionID{0x01})
+
+	// wire the TUN to a datachannel service, like startWorkers does
+	datach := datachannel.NewService(16)
+	tunnel.tunDown = datach.TUNToData
+	tunnel.tunUp = datach.DataToTUN
+	dataToMuxer := make(chan *model.Packet, 16)
+	datach.DataOrControlToMuxer = &dataToMuxer
+
+	crt, err := vpntest.WriteTestingCerts(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.NewConfig(config.WithOpenVPNOptions(&config.OpenVPNOptions{
+		Cipher:   "AES-128-GCM",
+		Auth:     "SHA512",
+		CertPath: crt.Cert,
+		KeyPath:  crt.Key,
+		CAPath:   crt.CA,
+	}))
+	manager := workers.NewManager(log.Log)
+	datach.StartWorkers(cfg, manager, tunnel.session)
+	defer func() {
+		manager.StartShutdown()
+		manager.WaitWorkersShutdown()
+	}()
+
+	datach.KeyReady <- makeTestingDataChannelKey(t)
+	<-tunnel.session.Ready
+
+	up, down := tunnel.PacketChannels()
+
+	t.Run("an IP packet written to down is encrypted and sent to the muxer", func(t *testing.T) {
+		packet := []byte("\x45\x00\x00\x1c this is an IP packet")
+		down <- packet
+		select {
+		case pkt := <-dataToMuxer:
+			if pkt.Opcode != model.P_DATA_V2 {
+				t.Errorf("expected a data packet, got %v", pkt.Opcode)
+			}
+			if len(pkt.Payload) <= len(packet) || bytes.Contains(pkt.Payload, packet) {
+				t.Error("expected the packet to be encrypted")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the encrypted packet")
+		}
+	})
+
+	t.Run("an IP packet delivered by the data channel is received from up", func(t *testing.T) {
+		packet := []byte("\x45\x00\x00\x1c this is another IP packet")
+		datach.DataToTUN <- packet
+		select {
+		case got := <-up:
+			if !bytes.Equal(got, packet) {
+				t.Errorf("got %v, want %v", got, packet)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the packet")
+		}
+	})
+}
+
+func TestTUN_Done(t *testing.T) {
+	tunnel := makeTestingTUN(t)
+	select {
+	case <-tunnel.Done():
+		t.Fatal("expected Done not to be closed")
+	default:
+	}
+	tunnel.Close()
+	select {
+	case <-tunnel.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected Done to be closed")
+	}
+}
@@ -0,0 +1,373 @@
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ooni/minivpn/internal/model"
+)
+
+// ErrCannotResolve is returned when we cannot perform a DNS exchange through the tunnel.
+var ErrCannotResolve = errors.New("cannot resolve through the tunnel")
+
+// maxSpilledPackets is the number of packets read by the resolver that are not DNS responses
+// and that we buffer for [TUN.Read] and [TUN.ReadPacket]. We drop the packets exceeding it.
+const maxSpilledPackets = 64
+
+// Resolver returns a [*net.Resolver] that sends DNS queries over UDP through the tunnel.
+// Queries go to the first DNS server pushed by the remote for which we have a tunnel address
+// of the same family or, if the remote did not push any, to the server the resolver would
+// otherwise use. Both IPv4 and IPv6 servers work, provided that the remote assigned us an
+// address of the same family.
+//
+// Since we do not have a network stack on top of the TUN, while there are queries in flight
+// we read the raw IP packets from the TUN and deliver each DNS response to the query that is
+// waiting for it, which allows concurrent queries. We buffer the other packets for [TUN.Read]
+// and [TUN.ReadPacket], and we drop them with a warning when nobody reads them. Concurrent
+// reads from the TUN may steal the DNS responses, causing the queries to time out.
+func (t *TUN) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     t.dialResolver,
+	}
+}
+
+// dialResolver implements the Dial func of the [*net.Resolver].
+func (t *TUN) dialResolver(ctx context.Context, network, address string) (net.Conn, error) {
+	info := t.session.TunnelInfo()
+	servers := []string{address}
+	if len(info.DNS) > 0 {
+		servers = nil
+		for _, dns := range info.DNS {
+			servers = append(servers, net.JoinHostPort(dns, "53"))
+		}
+	}
+	for _, server := range servers {
+		remote, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrCannotResolve, err)
+		}
+		local := info.LocalIP()
+		if remote.IP.To4() == nil {
+			local = info.LocalIPv6()
+		} else {
+			remote.IP = remote.IP.To4()
+		}
+		if local == nil {
+			continue
+		}
+		return t.resolverMux.register(t, local, remote), nil
+	}
+	return nil, fmt.Errorf("%w: no tunnel address for %s", ErrCannotResolve, strings.Join(servers, ", "))
+}
+
+// resolverMux delivers the DNS responses read from the TUN to the conns of the [*net.Resolver].
+type resolverMux struct {
+	// mu guards conns and stop.
+	mu sync.Mutex
+
+	// conns are the conns waiting for responses, by local port.
+	conns map[int]*resolverConn
+
+	// stop is closed to stop the goroutine reading from the TUN, which runs while there
+	// are conns, and is nil when it's not running.
+	stop chan any
+
+	// spilled contains the packets we read that are not DNS responses.
+	spilled chan []byte
+}
+
+// newResolverMux creates a new [*resolverMux].
+func newResolverMux() *resolverMux {
+	return &resolverMux{
+		conns:   make(map[int]*resolverConn),
+		spilled: make(chan []byte, maxSpilledPackets),
+	}
+}
+
+// register returns a new conn for exchanging DNS messages with the given remote, and
+// starts reading from the TUN, unless we're already doing that.
+func (m *resolverMux) register(t *TUN, local net.IP, remote *net.UDPAddr) *resolverConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	port := 49152 + rand.Intn(16384)
+	for m.conns[port] != nil {
+		port = 49152 + rand.Intn(16384)
+	}
+	conn := &resolverConn{
+		closed:        make(chan any),
+		local:         &net.UDPAddr{IP: local, Port: port},
+		readDeadline:  makeTUNDeadline(),
+		remote:        remote,
+		responses:     make(chan []byte, 4),
+		tun:           t,
+		writeDeadline: makeTUNDeadline(),
+	}
+	m.conns[port] = conn
+	if m.stop == nil {
+		m.stop = make(chan any)
+		go m.readLoop(t, m.stop)
+	}
+	return conn
+}
+
+// unregister forgets about the given conn, and stops reading from the TUN if there are
+// no more conns.
+func (m *resolverMux) unregister(conn *resolverConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conns, conn.local.Port)
+	if len(m.conns) == 0 && m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+// readLoop reads the packets coming up from the tunnel until stop is closed.
+func (m *resolverMux) readLoop(t *TUN, stop <-chan any) {
+	for {
+		select {
+		case packet := <-t.tunUp:
+			if !m.deliver(packet) {
+				m.spill(t.logger, packet)
+			}
+		case <-stop:
+			return
+		case <-t.hangup:
+			return
+		}
+	}
+}
+
+// deliver returns true if the packet is a DNS response for one of the conns, and
+// delivers it, unless the conn has too many undelivered responses.
+func (m *resolverMux) deliver(packet []byte) bool {
+	src, dst, payload, ok := decapsulateUDP(packet)
+	if !ok {
+		return false
+	}
+	m.mu.Lock()
+	conn := m.conns[dst.Port]
+	m.mu.Unlock()
+	if conn == nil || !conn.isResponse(src, dst) {
+		return false
+	}
+	select {
+	case conn.responses <- payload:
+	default:
+		// the resolver retries the query, so we can drop the response
+	}
+	return true
+}
+
+// spill buffers the packet for the TUN readers, or drops it if the buffer is full.
+func (m *resolverMux) spill(logger model.Logger, packet []byte) {
+	select {
+	case m.spilled <- packet:
+	default:
+		logger.Warnf("tun: resolver: dropping a %d bytes packet: nobody is reading from the TUN", len(packet))
+	}
+}
+
+// spilledPacket returns the oldest packet buffered for the TUN readers, if any, so that
+// the readers consume these packets before the ones coming up from the tunnel.
+func (m *resolverMux) spilledPacket() ([]byte, bool) {
+	select {
+	case packet := <-m.spilled:
+		return packet, true
+	default:
+		return nil, false
+	}
+}
+
+// resolverConn is the conn returned to the [*net.Resolver]. It implements [net.PacketConn],
+// so that the resolver uses datagram framing for the queries.
+type resolverConn struct {
+	closeOnce     sync.Once
+	closed        chan any
+	local         *net.UDPAddr
+	readDeadline  tunDeadline
+	remote        *net.UDPAddr
+	responses     chan []byte
+	tun           *TUN
+	writeDeadline tunDeadline
+}
+
+var (
+	_ net.Conn       = &resolverConn{}
+	_ net.PacketConn = &resolverConn{}
+)
+
+// Write sends the query through the tunnel.
+func (c *resolverConn) Write(query []byte) (int, error) {
+	packet, err := encapsulateUDP(c.local, c.remote, query)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrCannotResolve, err)
+	}
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	select {
+	case c.tun.tunDown <- packet:
+		c.tun.queuedPackets.Add(1)
+		return len(query), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.tun.hangup:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Read returns the next response sent by the DNS server.
+func (c *resolverConn) Read(data []byte) (int, error) {
+	if isClosedChan(c.readDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	select {
+	case response := <-c.responses:
+		return copy(data, response), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.tun.hangup:
+		return 0, net.ErrClosed
+	case <-c.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *resolverConn) ReadFrom(data []byte) (int, net.Addr, error) {
+	count, err := c.Read(data)
+	return count, c.remote, err
+}
+
+// WriteTo implements net.PacketConn
+func (c *resolverConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+	return c.Write(data)
+}
+
+// Close implements net.Conn
+func (c *resolverConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.tun.resolverMux.unregister(c)
+	})
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (c *resolverConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr implements net.Conn
+func (c *resolverConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline implements net.Conn
+func (c *resolverConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn
+func (c *resolverConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *resolverConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// isResponse returns true if the packet with the given addresses comes from the DNS
+// server and is addressed to us.
+func (c *resolverConn) isResponse(src, dst *net.UDPAddr) bool {
+	return src.IP.Equal(c.remote.IP) && src.Port == c.remote.Port &&
+		dst.IP.Equal(c.local.IP) && dst.Port == c.local.Port
+}
+
+// encapsulateUDP serializes a UDP/IPv4 or UDP/IPv6 packet with the given addresses and
+// payload, depending on the family of the addresses.
+func encapsulateUDP(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	var network gopacket.NetworkLayer
+	var ipLayer gopacket.SerializableLayer
+	if src.IP.To4() != nil {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    src.IP.To4(),
+			DstIP:    dst.IP.To4(),
+		}
+		network, ipLayer = ip, ip
+	} else {
+		ip := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      src.IP,
+			DstIP:      dst.IP,
+		}
+		network, ipLayer = ip, ip
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port),
+		DstPort: layers.UDPPort(dst.Port),
+	}
+	if err := udp.SetNetworkLayerForChecksum(network); err != nil {
+		return nil, err
+	}
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, ipLayer, udp, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decapsulateUDP parses a UDP/IPv4 or UDP/IPv6 packet, returning the addresses and the payload.
+func decapsulateUDP(packet []byte) (*net.UDPAddr, *net.UDPAddr, []byte, bool) {
+	if len(packet) < 1 {
+		return nil, nil, nil, false
+	}
+	first := layers.LayerTypeIPv4
+	if packet[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+	parsed := gopacket.NewPacket(packet, first, gopacket.Default)
+	var srcIP, dstIP net.IP
+	switch ip := parsed.NetworkLayer().(type) {
+	case *layers.IPv4:
+		srcIP, dstIP = ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		srcIP, dstIP = ip.SrcIP, ip.DstIP
+	default:
+		return nil, nil, nil, false
+	}
+	udp, ok := parsed.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	src := &net.UDPAddr{IP: srcIP, Port: int(udp.SrcPort)}
+	dst := &net.UDPAddr{IP: dstIP, Port: int(udp.DstPort)}
+	return src, dst, udp.Payload, true
+}
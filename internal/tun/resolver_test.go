@@ -0,0 +1,219 @@
+package tun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ooni/minivpn/internal/model"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mockedAAAA is the address in the AAAA answers of the mocked DNS server.
+var mockedAAAA = [16]byte{0xfd, 15: 0x99}
+
+// runMockedDNSServer answers the A queries sent through the TUN with the given answer, and the
+// AAAA queries with mockedAAAA, until ctx is done. When extra is not nil, it sends extra up the
+// TUN before each response.
+func runMockedDNSServer(ctx context.Context, t *testing.T, tunnel *TUN, server string, answer [4]byte, extra []byte) {
+	for {
+		var packet []byte
+		select {
+		case packet = <-tunnel.tunDown:
+		case <-ctx.Done():
+			return
+		}
+		src, dst, payload, ok := decapsulateUDP(packet)
+		if !ok || dst.IP.String() != server || dst.Port != 53 {
+			continue
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(payload); err != nil {
+			t.Error(err)
+			return
+		}
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		for _, q := range query.Questions {
+			var body dnsmessage.ResourceBody
+			switch q.Type {
+			case dnsmessage.TypeA:
+				body = &dnsmessage.AResource{A: answer}
+			case dnsmessage.TypeAAAA:
+				body = &dnsmessage.AAAAResource{AAAA: mockedAAAA}
+			default:
+				continue
+			}
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   body,
+			})
+		}
+		raw, err := response.Pack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		reply, err := encapsulateUDP(dst, src, raw)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if extra != nil {
+			select {
+			case tunnel.tunUp <- extra:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case tunnel.tunUp <- reply:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func TestTUN_Resolver(t *testing.T) {
+	t.Run("a lookup is resolved by the pushed DNS server through the tunnel", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.session.UpdateTunnelInfo(&model.TunnelInfo{
+			IP:  "10.8.0.6",
+			GW:  "10.8.0.1",
+			DNS: []string{"10.8.0.1"},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		go runMockedDNSServer(ctx, t, tunnel, "10.8.0.1", [4]byte{10, 9, 9, 9}, nil)
+
+		ips, err := tunnel.Resolver().LookupIP(ctx, "ip4", "vpn.example.org.")
+		if err != nil {
+			t.Fatalf("LookupIP() error = %v", err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 9, 9, 9)) {
+			t.Errorf("LookupIP() = %v, want [10.9.9.9]", ips)
+		}
+	})
+
+	t.Run("concurrent queries get their own responses", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.session.UpdateTunnelInfo(&model.TunnelInfo{
+			IP:  "10.8.0.6",
+			GW:  "10.8.0.1",
+			DNS: []string{"10.8.0.1"},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		go runMockedDNSServer(ctx, t, tunnel, "10.8.0.1", [4]byte{10, 9, 9, 9}, nil)
+
+		// each lookup sends the A and AAAA queries concurrently
+		errs := make(chan error, 4)
+		for i := 0; i < cap(errs); i++ {
+			go func() {
+				ips, err := tunnel.Resolver().LookupIP(ctx, "ip", "vpn.example.org.")
+				if err == nil && len(ips) != 2 {
+					err = fmt.Errorf("got %v, want the A and the AAAA answers", ips)
+				}
+				errs <- err
+			}()
+		}
+		for i := 0; i < cap(errs); i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("LookupIP() error = %v", err)
+			}
+		}
+	})
+
+	t.Run("we resolve through an IPv6 server", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.session.UpdateTunnelInfo(&model.TunnelInfo{
+			IPv6: "fd00::1000",
+			DNS:  []string{"fd00::1"},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		go runMockedDNSServer(ctx, t, tunnel, "fd00::1", [4]byte{10, 9, 9, 9}, nil)
+
+		ips, err := tunnel.Resolver().LookupIP(ctx, "ip6", "vpn.example.org.")
+		if err != nil {
+			t.Fatalf("LookupIP() error = %v", err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IP(mockedAAAA[:])) {
+			t.Errorf("LookupIP() = %v, want [%v]", ips, net.IP(mockedAAAA[:]))
+		}
+	})
+
+	t.Run("other packets are left for the TUN readers", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.session.UpdateTunnelInfo(&model.TunnelInfo{
+			IP:  "10.8.0.6",
+			DNS: []string{"10.8.0.1"},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		other := []byte("\x45\x00\x00\x1c not a dns response")
+		go runMockedDNSServer(ctx, t, tunnel, "10.8.0.1", [4]byte{10, 9, 9, 9}, other)
+
+		if _, err := tunnel.Resolver().LookupIP(ctx, "ip4", "vpn.example.org."); err != nil {
+			t.Fatalf("LookupIP() error = %v", err)
+		}
+		packet, err := tunnel.ReadPacket()
+		if err != nil || !bytes.Equal(packet, other) {
+			t.Fatalf("ReadPacket() = %q, %v, want %q", packet, err, other)
+		}
+	})
+
+	t.Run("the lookup honors the context deadline without touching the TUN deadlines", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.session.UpdateTunnelInfo(&model.TunnelInfo{
+			IP:  "10.8.0.6",
+			DNS: []string{"10.8.0.1"},
+		})
+		// the caller uses a read deadline in the past, which must still apply afterwards
+		tunnel.SetReadDeadline(time.Now().Add(-time.Second))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		// nobody answers the queries
+		go func() {
+			for {
+				select {
+				case <-tunnel.tunDown:
+				case <-tunnel.hangup:
+					return
+				}
+			}
+		}()
+		defer tunnel.Close()
+		start := time.Now()
+		if _, err := tunnel.Resolver().LookupIP(ctx, "ip4", "vpn.example.org."); err == nil {
+			t.Fatal("expected LookupIP() to fail")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("LookupIP() took %v, want about the context timeout", elapsed)
+		}
+		if _, err := tunnel.ReadPacket(); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("ReadPacket() error = %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	})
+
+	t.Run("we cannot resolve without a tunnel address", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		_, err := tunnel.dialResolver(context.Background(), "udp", "8.8.8.8:53")
+		if !errors.Is(err, ErrCannotResolve) {
+			t.Errorf("dialResolver() error = %v, want %v", err, ErrCannotResolve)
+		}
+	})
+}
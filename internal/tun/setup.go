@@ -54,13 +54,14 @@ func startWorkers(config *config.Config, conn networkio.FramingConn,
 	connectChannel(muxer.NetworkToMuxer, &nio.NetworkToMuxer)
 
 	// create the datachannel service.
-	datach := &datachannel.Service{
-		MuxerToData:          make(chan *model.Packet),
-		DataOrControlToMuxer: nil,
-		KeyReady:             make(chan *session.DataChannelKey, 1),
-		TUNToData:            tunDevice.tunDown,
-		DataToTUN:            tunDevice.tunUp,
-	}
+	datach := datachannel.NewService(config.ChannelBufferSize())
+
+	// the TUN device moves bytes to and from the datachannel service
+	tunDevice.tunDown = datach.TUNToData
+	tunDevice.tunUp = datach.DataToTUN
+	tunDevice.healthCheck = datach.HealthCheck
+	tunDevice.settledPackets = datach.SettledPackets
+	tunDevice.dataChannelStats = datach.Stats
 
 	// connect the packetmuxer and the datachannel
 	connectChannel(datach.MuxerToData, &muxer.MuxerToData)
@@ -74,6 +75,8 @@ func startWorkers(config *config.Config, conn networkio.FramingConn,
 		ReliableToControl:    nil,
 	}
 
+	tunDevice.reliabilityStats = rel.Stats
+
 	// connect reliable service and packetmuxer.
 	connectChannel(rel.MuxerToReliable, &muxer.MuxerToReliable)
 	connectChannel(muxer.DataOrControlToMuxer, &rel.DataOrControlToMuxer)
@@ -93,10 +96,12 @@ func startWorkers(config *config.Config, conn networkio.FramingConn,
 
 	// create the tlssession service
 	tlsx := &tlssession.Service{
-		NotifyTLS:     make(chan *model.Notification, 1),
-		KeyUp:         nil,
-		TLSRecordUp:   make(chan []byte),
-		TLSRecordDown: nil,
+		NotifyTLS:       make(chan *model.Notification, 1),
+		KeyUp:           nil,
+		TLSRecordUp:     make(chan []byte),
+		TLSRecordDown:   nil,
+		OnServerControl: tunDevice.serverControl.Store,
+		RemoteAddr:      conn.RemoteAddr(),
 	}
 
 	// connect the tlsstate service and the controlchannel service
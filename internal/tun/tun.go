@@ -8,26 +8,55 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ooni/minivpn/internal/datachannel"
 	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/networkio"
+	"github.com/ooni/minivpn/internal/reliabletransport"
 	"github.com/ooni/minivpn/internal/session"
 	"github.com/ooni/minivpn/pkg/config"
 )
 
 var (
-	// default TLS handshake timeout, in seconds.
-	tlsHandshakeTimeoutSeconds = 60
-
 	// ErrCannotHandshake is the generic error we return when we cannot complete a handshake.
 	ErrCannotHandshake = errors.New("openvpn handshake error")
+
+	// ErrHandshakeTimeout indicates that the handshake did not complete within the
+	// configured handshake timeout. We wrap it with [ErrCannotHandshake].
+	ErrHandshakeTimeout = errors.New("handshake timeout")
+
+	// ErrHealthCheck indicates that [TUN.HealthCheck] did not receive the ping of the remote.
+	ErrHealthCheck = errors.New("health check failed")
+
+	// flushPollInterval is how often [TUN.Flush] checks whether the writes are drained.
+	flushPollInterval = 10 * time.Millisecond
 )
 
+// defaultHealthCheckTimeout is the time [TUN.HealthCheck] waits by default.
+const defaultHealthCheckTimeout = 5 * time.Second
+
 // StartTUN initializes and starts the TUN device over the vpn.
 // If the passed context expires before the TUN device is ready,
 // an error will be returned.
 func StartTUN(ctx context.Context, conn networkio.FramingConn, config *config.Config) (*TUN, error) {
+	tunnel, err := StartTUNAsync(conn, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := tunnel.WaitReady(ctx); err != nil {
+		config.Logger().Warn(err.Error())
+		tunnel.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// StartTUNAsync is like [StartTUN], but it returns as soon as the workers are started,
+// without waiting for the handshake to complete. Use [TUN.WaitReady] to wait until
+// the data channel is usable.
+func StartTUNAsync(conn networkio.FramingConn, config *config.Config) (*TUN, error) {
 	// create a session
 	sessionManager, err := session.NewManager(config)
 	if err != nil {
@@ -36,44 +65,63 @@ func StartTUN(ctx context.Context, conn networkio.FramingConn, config *config.Co
 
 	// create the TUN that will OWN the connection
 	tunnel := newTUN(config.Logger(), conn, sessionManager)
+	tunnel.exitNotify = config.OpenVPNOptions().ExplicitExitNotify > 0
+	config.SetConnectionState(model.ConnectionConnecting)
 
 	// start all the workers
-	workers := startWorkers(config, conn, sessionManager, tunnel)
+	workers := startWorkers(config, tunnel.conn, sessionManager, tunnel)
 	tunnel.whenDone(func() {
 		workers.StartShutdown()
 		workers.WaitWorkersShutdown()
+		config.SetConnectionState(model.ConnectionClosed)
 	})
 
-	tlsTimeout := time.NewTimer(time.Duration(tlsHandshakeTimeoutSeconds) * time.Second)
+	// close the TUN when the workers shut down on their own (e.g., on ping-restart
+	// timeout), so that readers get [net.ErrClosed] and can reconnect.
+	go func() {
+		<-workers.ShouldShutdown()
+		tunnel.Close()
+	}()
 
-	// Await for the signal from the session manager to tell us we're ready to start accepting data.
-	// In practice, this means that we already have a valid TunnelInfo at this point
-	// (i.e., three way handshake has completed, and we have valid keys).
+	go tunnel.awaitHandshake(config.HandshakeTimeout())
+	return tunnel, nil
+}
+
+// awaitHandshake waits for the signal from the session manager telling us we're ready to
+// start accepting data, or for the handshake to fail, and then unblocks [TUN.WaitReady].
+// In practice, when ready we already have a valid TunnelInfo (i.e., the three way handshake
+// has completed, and we have valid keys). On failure, or if the handshake does not complete
+// within the given timeout, it closes the TUN.
+func (t *TUN) awaitHandshake(timeout time.Duration) {
+	handshakeTimeout := time.NewTimer(timeout)
+	defer handshakeTimeout.Stop()
 
+	var err error
 	select {
-	case <-sessionManager.Ready:
-		return tunnel, nil
-	case failure := <-sessionManager.Failure:
-		err := fmt.Errorf("%w: %s", ErrCannotHandshake, failure)
-		defer func() {
-			config.Logger().Warn(err.Error())
-			tunnel.Close()
-		}()
-		return nil, err
-	case <-tlsTimeout.C:
-		err := fmt.Errorf("%w: %s", ErrCannotHandshake, "tls timeout")
-		defer func() {
-			config.Logger().Warn(err.Error())
-			tunnel.Close()
-		}()
-		return nil, err
+	case <-t.session.Ready:
+	case failure := <-t.session.Failure:
+		err = fmt.Errorf("%w: %w", ErrCannotHandshake, failure)
+	case <-handshakeTimeout.C:
+		err = fmt.Errorf("%w: %w", ErrCannotHandshake, ErrHandshakeTimeout)
+	case <-t.hangup:
+		err = fmt.Errorf("%w: %w", ErrCannotHandshake, net.ErrClosed)
+	}
+	t.handshakeErr = err
+	close(t.handshakeDone)
+	if err != nil {
+		t.Close()
+	}
+}
+
+// WaitReady blocks until the handshake has completed and the data channel is usable, and
+// returns nil; or until the handshake fails, and returns the handshake error; or until the
+// passed context is done, and returns an error wrapping the context error.
+func (t *TUN) WaitReady(ctx context.Context) error {
+	select {
+	case <-t.handshakeDone:
+		return t.handshakeErr
 	case <-ctx.Done():
-		err := fmt.Errorf("%w: %w", ErrCannotHandshake, ctx.Err())
-		defer func() {
-			config.Logger().Warn(err.Error())
-			tunnel.Close()
-		}()
-		return nil, err
+		return fmt.Errorf("%w: %w", ErrCannotHandshake, ctx.Err())
 	}
 }
 
@@ -84,26 +132,56 @@ type TUN struct {
 	closeOnce sync.Once
 
 	// conn is the underlying connection.
-	conn networkio.FramingConn
+	conn *dataObserverConn
+
+	// exitNotify tells whether Close should send an exit-notify (see explicit-exit-notify).
+	exitNotify bool
+
+	// healthCheck sends a ping and waits for the next data packet.
+	healthCheck func(ctx context.Context) (time.Duration, error)
 
 	// hangup is used to let methods know the connection is closed.
 	hangup chan any
 
+	// handshakeDone is closed when the handshake is over, and handshakeErr is the
+	// handshake error, which is only safe to read once handshakeDone is closed.
+	handshakeDone chan any
+	handshakeErr  error
+
 	// logger implements model.Logger
 	logger model.Logger
 
 	// network is the underlying network for the passed [networkio.FramingConn].
 	network string
 
+	// queuedPackets counts the packets successfully passed to tunDown by [TUN.Write].
+	queuedPackets atomic.Int64
+
 	// used to buffer reads from above.
 	readBuffer *bytes.Buffer
 
 	// readDeadline is used to set the read deadline.
 	readDeadline tunDeadline
 
+	// dataChannelStats returns the data channel counters.
+	dataChannelStats func() datachannel.Stats
+
+	// reliabilityStats returns the control channel reliability counters.
+	reliabilityStats func() reliabletransport.Stats
+
+	// resolverMux delivers the DNS responses to the conns of [TUN.Resolver].
+	resolverMux *resolverMux
+
+	// serverControl is the RESTART or HALT message sent by the server, if any.
+	serverControl atomic.Pointer[model.ServerControl]
+
 	// session is the session manager
 	session *session.Manager
 
+	// settledPackets returns how many of the queued packets the data channel has
+	// delivered to the muxer or dropped.
+	settledPackets func() int64
+
 	// tunDown moves bytes down to the data channel.
 	tunDown chan []byte
 
@@ -121,16 +199,18 @@ type TUN struct {
 // This function TAKES OWNERSHIP of the conn.
 func newTUN(logger model.Logger, conn networkio.FramingConn, session *session.Manager) *TUN {
 	return &TUN{
-		closeOnce:    sync.Once{},
-		conn:         conn,
-		hangup:       make(chan any),
-		logger:       logger,
-		network:      conn.LocalAddr().Network(),
-		readBuffer:   &bytes.Buffer{},
-		readDeadline: makeTUNDeadline(),
-		session:      session,
-		tunDown:      make(chan []byte),
-		tunUp:        make(chan []byte),
+		closeOnce:     sync.Once{},
+		conn:          newDataObserverConn(conn),
+		hangup:        make(chan any),
+		handshakeDone: make(chan any),
+		logger:        logger,
+		network:       conn.LocalAddr().Network(),
+		readBuffer:    &bytes.Buffer{},
+		readDeadline:  makeTUNDeadline(),
+		resolverMux:   newResolverMux(),
+		session:       session,
+		tunDown:       make(chan []byte),
+		tunUp:         make(chan []byte),
 		// this function is explicitely set empty so that we can safely use a callback even if not set.
 		whenDoneFn:    func() {},
 		writeDeadline: makeTUNDeadline(),
@@ -144,10 +224,14 @@ func (t *TUN) whenDone(fn func()) {
 }
 
 // Close is an idempotent method that closes the underlying connection (owned by us) and
-// potentially executes any registed callback.
+// potentially executes any registed callback. The shutdown is ordered: we stop reading
+// and writing on behalf of the user, we tell the remote we're exiting, we close the
+// connection, and eventually we shut down the workers.
 func (t *TUN) Close() error {
 	t.closeOnce.Do(func() {
 		close(t.hangup)
+		// Let the remote know that we're going away
+		t.sendExitNotify()
 		// We OWN the connection
 		t.conn.Close()
 		// execute any shutdown callback
@@ -167,7 +251,13 @@ func (t *TUN) Read(data []byte) (int, error) {
 		if isClosedChan(t.readDeadline.wait()) {
 			return 0, os.ErrDeadlineExceeded
 		}
+		if extra, found := t.resolverMux.spilledPacket(); found {
+			t.readBuffer.Write(extra)
+			continue
+		}
 		select {
+		case extra := <-t.resolverMux.spilled:
+			t.readBuffer.Write(extra)
 		case extra := <-t.tunUp:
 			t.readBuffer.Write(extra)
 		case <-t.hangup:
@@ -178,6 +268,33 @@ func (t *TUN) Read(data []byte) (int, error) {
 	}
 }
 
+// ReadPacket returns the next decrypted packet, keeping the packet boundaries that
+// Read loses when it buffers the packets. If a previous Read only consumed part of
+// a packet, ReadPacket returns the rest of that packet first.
+func (t *TUN) ReadPacket() ([]byte, error) {
+	if t.readBuffer.Len() > 0 {
+		rest := bytes.Clone(t.readBuffer.Bytes())
+		t.readBuffer.Reset()
+		return rest, nil
+	}
+	if isClosedChan(t.readDeadline.wait()) {
+		return nil, os.ErrDeadlineExceeded
+	}
+	if packet, found := t.resolverMux.spilledPacket(); found {
+		return packet, nil
+	}
+	select {
+	case packet := <-t.resolverMux.spilled:
+		return packet, nil
+	case packet := <-t.tunUp:
+		return packet, nil
+	case <-t.hangup:
+		return nil, net.ErrClosed
+	case <-t.readDeadline.wait():
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
 // Write implements net.Conn
 func (t *TUN) Write(data []byte) (int, error) {
 	if isClosedChan(t.writeDeadline.wait()) {
@@ -185,6 +302,7 @@ func (t *TUN) Write(data []byte) (int, error) {
 	}
 	select {
 	case t.tunDown <- data:
+		t.queuedPackets.Add(1)
 		return len(data), nil
 	case <-t.hangup:
 		return 0, net.ErrClosed
@@ -193,6 +311,30 @@ func (t *TUN) Write(data []byte) (int, error) {
 	}
 }
 
+// Flush blocks until the data channel has handed all the packets previously written
+// with [TUN.Write] to the muxer, so that calling [TUN.Close] right after does not lose
+// them. Packets the data channel drops (see [config.WithWritePolicy]) count as handed
+// off. It returns nil on success, [net.ErrClosed] if the TUN is closed, or the context
+// error if the context is done first. Data packets are not acknowledged by the remote,
+// thus Flush does not wait for any ACK, on TCP or otherwise.
+func (t *TUN) Flush(ctx context.Context) error {
+	if t.settledPackets == nil {
+		return nil
+	}
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for t.settledPackets() < t.queuedPackets.Load() {
+		select {
+		case <-ticker.C:
+		case <-t.hangup:
+			return net.ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 // LocalAddr implements net.Conn
 func (t *TUN) LocalAddr() net.Addr {
 	ip := t.session.TunnelInfo().IP
@@ -247,3 +389,118 @@ func (t *tunBioAddr) String() string {
 func (t *TUN) NetMask() net.IPMask {
 	return net.IPMask(net.ParseIP(t.session.TunnelInfo().NetMask))
 }
+
+// TunnelIP returns the IP address assigned to us by the remote, or nil if the
+// tunnel has not been configured yet.
+func (t *TUN) TunnelIP() net.IP {
+	return net.ParseIP(t.session.TunnelInfo().IP)
+}
+
+// GatewayIP returns the IP address of the gateway pushed by the remote, or nil
+// if the tunnel has not been configured yet.
+func (t *TUN) GatewayIP() net.IP {
+	return net.ParseIP(t.session.TunnelInfo().GW)
+}
+
+// LocalIP returns the IPv4 address assigned to us by the remote, or nil if the
+// tunnel has not been configured yet or the address is invalid.
+func (t *TUN) LocalIP() net.IP {
+	return t.session.TunnelInfo().LocalIP()
+}
+
+// RedirectGateway returns whether the remote pushed, or the config contains, the
+// redirect-gateway directive, along with its flags. We do not change the routes: the
+// platform integration should route all the traffic through the tunnel accordingly.
+func (t *TUN) RedirectGateway() (bool, model.RedirectGatewayFlags) {
+	info := t.session.TunnelInfo()
+	return info.RedirectGateway, info.RedirectGatewayFlags
+}
+
+// BlockOutsideDNS returns whether the remote pushed, or the config contains, the
+// block-outside-dns directive, which the platform integration may want to honor.
+func (t *TUN) BlockOutsideDNS() bool {
+	return t.session.TunnelInfo().BlockOutsideDNS
+}
+
+// IPNet returns the address assigned to us along with the mask of the tunnel network,
+// according to the topology pushed by the remote, which is what we need to configure
+// the TUN interface. See [model.TunnelInfo.IPNet] for the details.
+func (t *TUN) IPNet() (*net.IPNet, error) {
+	return t.session.TunnelInfo().IPNet()
+}
+
+// RemoteSessionID returns the session ID of the remote, or nil if the
+// remote session ID is not known yet.
+func (t *TUN) RemoteSessionID() []byte {
+	if !t.session.IsRemoteSessionIDSet() {
+		return nil
+	}
+	return t.session.RemoteSessionID()
+}
+
+// LocalSessionID returns our session ID, which is random and differs for each TUN.
+func (t *TUN) LocalSessionID() []byte {
+	return t.session.LocalSessionID()
+}
+
+// MTU returns the tun-mtu announced by the remote.
+func (t *TUN) MTU() int {
+	return t.session.TunnelInfo().MTU
+}
+
+// PeerID returns the peer-id assigned to us by the remote.
+func (t *TUN) PeerID() int {
+	return t.session.TunnelInfo().PeerID
+}
+
+// ServerControl returns the RESTART or HALT message sent by the server, or nil if the server
+// did not send any. When the server sends one of these messages, we close the TUN: use this
+// method to decide whether to reconnect or to terminate.
+func (t *TUN) ServerControl() *model.ServerControl {
+	return t.serverControl.Load()
+}
+
+// ReliabilityStats returns the retransmissions, duplicates and out-of-order counters of
+// the control channel, which help debugging lossy links.
+func (t *TUN) ReliabilityStats() reliabletransport.Stats {
+	if t.reliabilityStats == nil {
+		return reliabletransport.Stats{}
+	}
+	return t.reliabilityStats()
+}
+
+// DataChannelStats returns the data channel counters, including how many incoming packets
+// we could not decrypt, which helps debugging a wrong key or a corrupting link.
+func (t *TUN) DataChannelStats() datachannel.Stats {
+	if t.dataChannelStats == nil {
+		return datachannel.Stats{}
+	}
+	return t.dataChannelStats()
+}
+
+// HealthCheck is a cheap probe telling whether the tunnel is alive. It sends a single data
+// channel ping and waits for the next ping from the remote for at most the given timeout,
+// or until the context is done. A zero timeout means five seconds. It returns the elapsed
+// time on success, and an error wrapping [ErrHealthCheck] otherwise.
+func (t *TUN) HealthCheck(ctx context.Context, timeout time.Duration) (time.Duration, error) {
+	if t.healthCheck == nil {
+		return 0, fmt.Errorf("%w: %s", ErrHealthCheck, "tunnel not started")
+	}
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-t.hangup:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	elapsed, err := t.healthCheck(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrHealthCheck, err)
+	}
+	return elapsed, nil
+}
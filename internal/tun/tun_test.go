@@ -0,0 +1,354 @@
+package tun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/networkio"
+	"github.com/ooni/minivpn/internal/session"
+	"github.com/ooni/minivpn/internal/vpntest"
+	"github.com/ooni/minivpn/pkg/config"
+)
+
+// makeTestingTUN returns a TUN backed by a mocked connection and a fresh session manager.
+func makeTestingTUN(t *testing.T) *TUN {
+	conn := &vpntest.Conn{
+		MockClose: func() error {
+			return nil
+		},
+	}
+	return makeTestingTUNWithConn(t, conn)
+}
+
+// makeTestingTUNWithConn returns a TUN backed by the given mocked UDP connection
+// and a fresh session manager.
+func makeTestingTUNWithConn(t *testing.T, conn *vpntest.Conn) *TUN {
+	cfg := config.NewConfig(config.WithLogger(model.NewTestLogger()))
+	manager, err := session.NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.MockLocalAddr = func() net.Addr {
+		return &vpntest.Addr{
+			MockString:  func() string { return "10.0.0.1:1194" },
+			MockNetwork: func() string { return "udp" },
+		}
+	}
+	dialer := networkio.NewDialer(cfg.Logger(), &vpntest.Dialer{
+		MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return conn, nil
+		},
+	})
+	framingConn, err := dialer.DialContext(context.Background(), "udp", "10.0.0.1:1194")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTUN(cfg.Logger(), framingConn, manager)
+}
+
+func TestTUN_TunnelIPAndGatewayIP(t *testing.T) {
+	t.Run("the getters return nil before the tunnel is configured", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		if ip := tunnel.TunnelIP(); ip != nil {
+			t.Errorf("TunnelIP() = %v, want nil", ip)
+		}
+		if ip := tunnel.GatewayIP(); ip != nil {
+			t.Errorf("GatewayIP() = %v, want nil", ip)
+		}
+	})
+
+	t.Run("the getters return the parsed tunnel info", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.session.UpdateTunnelInfo(&model.TunnelInfo{
+			IP: "10.8.0.6",
+			GW: "10.8.0.1",
+		})
+		if ip := tunnel.TunnelIP(); !ip.Equal(net.ParseIP("10.8.0.6")) {
+			t.Errorf("TunnelIP() = %v, want 10.8.0.6", ip)
+		}
+		if ip := tunnel.GatewayIP(); !ip.Equal(net.ParseIP("10.8.0.1")) {
+			t.Errorf("GatewayIP() = %v, want 10.8.0.1", ip)
+		}
+	})
+}
+
+func TestTUN_Metadata(t *testing.T) {
+	tunnel := makeTestingTUN(t)
+	tunnel.session.SetRemoteSessionID(model.SessionID{1, 2, 3, 4, 5, 6, 7, 8})
+	tunnel.session.UpdateTunnelInfo(&model.TunnelInfo{
+		IP:     "10.8.0.6",
+		GW:     "10.8.0.1",
+		PeerID: 7,
+	})
+
+	// code having only a net.Conn should be able to obtain the metadata
+	var conn net.Conn = tunnel
+	metadata, ok := conn.(interface {
+		TunnelIP() net.IP
+		RemoteSessionID() []byte
+		MTU() int
+		PeerID() int
+	})
+	if !ok {
+		t.Fatal("expected the TUN to implement the metadata interface")
+	}
+	if ip := metadata.TunnelIP(); !ip.Equal(net.ParseIP("10.8.0.6")) {
+		t.Errorf("TunnelIP() = %v, want 10.8.0.6", ip)
+	}
+	if sid := metadata.RemoteSessionID(); !bytes.Equal(sid, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("RemoteSessionID() = %x", sid)
+	}
+	if mtu := metadata.MTU(); mtu != 0 {
+		t.Errorf("MTU() = %d, want 0", mtu)
+	}
+	if peerID := metadata.PeerID(); peerID != 7 {
+		t.Errorf("PeerID() = %d, want 7", peerID)
+	}
+}
+
+func TestTUN_RemoteSessionIDNotSet(t *testing.T) {
+	tunnel := makeTestingTUN(t)
+	if sid := tunnel.RemoteSessionID(); sid != nil {
+		t.Errorf("RemoteSessionID() = %x, want nil", sid)
+	}
+}
+
+func TestTUN_ServerControl(t *testing.T) {
+	tunnel := makeTestingTUN(t)
+	if got := tunnel.ServerControl(); got != nil {
+		t.Fatalf("ServerControl() = %v, want nil", got)
+	}
+	message := &model.ServerControl{Kind: model.ServerControlHalt, Reason: "bye"}
+	tunnel.serverControl.Store(message)
+	if got := tunnel.ServerControl(); got != message {
+		t.Errorf("ServerControl() = %v, want %v", got, message)
+	}
+}
+
+func TestTUN_WaitReady(t *testing.T) {
+	t.Run("returns once the handshake reaches S_GENERATED_KEYS", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		defer tunnel.Close()
+		go tunnel.awaitHandshake(config.DefaultHandshakeTimeout)
+		go tunnel.session.SetNegotiationState(model.S_GENERATED_KEYS)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tunnel.WaitReady(ctx); err != nil {
+			t.Fatalf("WaitReady() error = %v, want nil", err)
+		}
+	})
+
+	t.Run("surfaces the handshake failure", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		go tunnel.awaitHandshake(config.DefaultHandshakeTimeout)
+		failure := errors.New("mocked failure")
+		go func() { tunnel.session.Failure <- failure }()
+
+		err := tunnel.WaitReady(context.Background())
+		if !errors.Is(err, ErrCannotHandshake) || !errors.Is(err, failure) {
+			t.Fatalf("WaitReady() error = %v, want %v and %v", err, ErrCannotHandshake, failure)
+		}
+	})
+
+	t.Run("fails once the handshake timeout expires", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		go tunnel.awaitHandshake(10 * time.Millisecond)
+
+		err := tunnel.WaitReady(context.Background())
+		if !errors.Is(err, ErrCannotHandshake) || !errors.Is(err, ErrHandshakeTimeout) {
+			t.Fatalf("WaitReady() error = %v, want %v and %v", err, ErrCannotHandshake, ErrHandshakeTimeout)
+		}
+	})
+
+	t.Run("returns the context error on cancel", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		defer tunnel.Close()
+		go tunnel.awaitHandshake(config.DefaultHandshakeTimeout)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := tunnel.WaitReady(ctx)
+		if !errors.Is(err, ErrCannotHandshake) || !errors.Is(err, context.Canceled) {
+			t.Fatalf("WaitReady() error = %v, want %v and %v", err, ErrCannotHandshake, context.Canceled)
+		}
+	})
+}
+
+func TestTUN_HealthCheck(t *testing.T) {
+	t.Run("we return the latency when the data channel answers", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.healthCheck = func(ctx context.Context) (time.Duration, error) {
+			return 42 * time.Millisecond, nil
+		}
+		elapsed, err := tunnel.HealthCheck(context.Background(), 0)
+		if err != nil || elapsed != 42*time.Millisecond {
+			t.Fatalf("HealthCheck() = %v, %v, want 42ms and no error", elapsed, err)
+		}
+	})
+
+	t.Run("we fail after the health check timeout", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.healthCheck = func(ctx context.Context) (time.Duration, error) {
+			<-ctx.Done()
+			return 0, ctx.Err()
+		}
+		_, err := tunnel.HealthCheck(context.Background(), 10*time.Millisecond)
+		if !errors.Is(err, ErrHealthCheck) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("HealthCheck() error = %v, want %v and %v", err, ErrHealthCheck, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("a zero timeout means the default timeout", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.healthCheck = func(ctx context.Context) (time.Duration, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok || time.Until(deadline) <= defaultHealthCheckTimeout/2 {
+				t.Errorf("unexpected deadline %v", deadline)
+			}
+			return 0, nil
+		}
+		if _, err := tunnel.HealthCheck(context.Background(), 0); err != nil {
+			t.Fatalf("HealthCheck() error = %v", err)
+		}
+	})
+
+	t.Run("we fail when the tunnel is not started", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		if _, err := tunnel.HealthCheck(context.Background(), 0); !errors.Is(err, ErrHealthCheck) {
+			t.Fatalf("HealthCheck() error = %v, want %v", err, ErrHealthCheck)
+		}
+	})
+}
+
+func TestTUN_ReadPacket(t *testing.T) {
+	t.Run("each decrypted packet is returned separately", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		first, second := []byte("first packet"), []byte("second")
+		go func() {
+			tunnel.tunUp <- first
+			tunnel.tunUp <- second
+		}()
+		for _, want := range [][]byte{first, second} {
+			got, err := tunnel.ReadPacket()
+			if err != nil {
+				t.Fatalf("ReadPacket() error = %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("ReadPacket() = %q, want %q", got, want)
+			}
+		}
+	})
+
+	t.Run("we first return the rest of a partially read packet", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		go func() {
+			tunnel.tunUp <- []byte("abcdef")
+		}()
+		buffer := make([]byte, 2)
+		if _, err := tunnel.Read(buffer); err != nil {
+			t.Fatal(err)
+		}
+		got, err := tunnel.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket() error = %v", err)
+		}
+		if string(got) != "cdef" {
+			t.Errorf("ReadPacket() = %q, want %q", got, "cdef")
+		}
+	})
+
+	t.Run("we honor the read deadline", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.SetReadDeadline(time.Now().Add(-time.Second))
+		if _, err := tunnel.ReadPacket(); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("ReadPacket() error = %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	})
+
+	t.Run("we fail after close", func(t *testing.T) {
+		tunnel := makeTestingTUN(t)
+		tunnel.Close()
+		if _, err := tunnel.ReadPacket(); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("ReadPacket() error = %v, want %v", err, net.ErrClosed)
+		}
+	})
+}
+
+func TestTUN_Flush(t *testing.T) {
+	// makeFlushingTUN returns a TUN whose writes reach a slow mocked muxer.
+	makeFlushingTUN := func(t *testing.T) (*TUN, *[][]byte) {
+		tunnel := makeTestingTUN(t)
+		tunnel.tunDown = make(chan []byte, 10)
+		var (
+			muxer   [][]byte
+			settled atomic.Int64
+		)
+		tunnel.settledPackets = settled.Load
+		go func() {
+			for {
+				select {
+				case packet := <-tunnel.tunDown:
+					time.Sleep(20 * time.Millisecond)
+					muxer = append(muxer, packet)
+					settled.Add(1)
+				case <-tunnel.hangup:
+					return
+				}
+			}
+		}()
+		return tunnel, &muxer
+	}
+
+	t.Run("the pending writes reach the muxer before we return", func(t *testing.T) {
+		tunnel, muxer := makeFlushingTUN(t)
+		for _, packet := range []string{"aaa", "bbb", "ccc"} {
+			if _, err := tunnel.Write([]byte(packet)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tunnel.Flush(ctx); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+		if len(*muxer) != 3 || string((*muxer)[2]) != "ccc" {
+			t.Errorf("muxer got %q, want three packets", *muxer)
+		}
+		tunnel.Close()
+	})
+
+	// makeStuckTUN returns a TUN whose writes never reach the muxer.
+	makeStuckTUN := func(t *testing.T) *TUN {
+		tunnel := makeTestingTUN(t)
+		tunnel.tunDown = make(chan []byte, 10)
+		tunnel.settledPackets = func() int64 { return 0 }
+		tunnel.Write([]byte("aaa"))
+		return tunnel
+	}
+
+	t.Run("we honor the context", func(t *testing.T) {
+		tunnel := makeStuckTUN(t)
+		defer tunnel.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := tunnel.Flush(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("Flush() error = %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("we fail after close", func(t *testing.T) {
+		tunnel := makeStuckTUN(t)
+		tunnel.Close()
+		if err := tunnel.Flush(context.Background()); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Flush() error = %v, want %v", err, net.ErrClosed)
+		}
+	})
+}
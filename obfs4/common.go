@@ -1,12 +1,49 @@
 package obfs4
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/url"
+	"strconv"
+	"strings"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// IATMode is the obfs4 inter-arrival time obfuscation mode.
+type IATMode int
+
+const (
+	// IATModeNone disables the inter-arrival time obfuscation. This is the default.
+	IATModeNone = IATMode(iota)
+
+	// IATModeEnabled splits the writes and delays them, to defeat timing analysis.
+	IATModeEnabled
+
+	// IATModeParanoid also randomizes the size of the writes, at the cost of throughput.
+	IATModeParanoid
 )
 
+// ErrBadIATMode indicates that the iat-mode is not one of the supported modes.
+var ErrBadIATMode = errors.New("obfs4: invalid iat-mode")
+
+// iatModeArg is the name of the iat-mode argument.
+const iatModeArg = "iat-mode"
+
+// parseIATMode parses the value of the iat-mode argument. An empty value means [IATModeNone].
+func parseIATMode(value string) (IATMode, error) {
+	if value == "" {
+		return IATModeNone, nil
+	}
+	mode, err := strconv.Atoi(value)
+	if err != nil || mode < int(IATModeNone) || mode > int(IATModeParanoid) {
+		return IATModeNone, fmt.Errorf("%w: %q", ErrBadIATMode, value)
+	}
+	return IATMode(mode), nil
+}
+
 // Node is a proxy node, that can be used to construct a proxy chain.
 type Node struct {
 	Addr     string     // ag: I'm guessing this is used like ip:port
@@ -14,6 +51,7 @@ type Node struct {
 	Protocol string     // obfs4 in this case
 	url      *url.URL   // url
 	Values   url.Values // contains the cert and iat-mode parameters
+	IATMode  IATMode    // the iat-mode we pass to the client factory, overriding the one in Values
 	//Transport string     // this only makes sense if/when we do use different transporters for obfs4. for the time being this can be removed, or perhaps denoted as "raw"
 }
 
@@ -33,11 +71,64 @@ func NewNodeFromURI(uri string) (Node, error) {
 		return Node{}, fmt.Errorf("expected obfs4:// uri")
 	}
 
+	values := u.Query()
+	iatMode, err := parseIATMode(values.Get(iatModeArg))
+	if err != nil {
+		return Node{}, err
+	}
+
 	return Node{
 		Protocol: u.Scheme,
 		Addr:     net.JoinHostPort(u.Hostname(), u.Port()),
 		Host:     u.Hostname(),
 		url:      u,
-		Values:   u.Query(),
+		Values:   values,
+		IATMode:  iatMode,
 	}, nil
 }
+
+// NewNodeFromBridgeLine returns a configured proxy node from a bridge line, in the form
+// used by Tor and obfs4proxy, where the transport name and the fingerprint are optional:
+// obfs4 <ip>:<port> <fingerprint> cert=<deadbeef> iat-mode=<int>
+func NewNodeFromBridgeLine(line string) (Node, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "obfs4" {
+		fields = fields[1:]
+	}
+	if len(fields) < 1 {
+		return Node{}, fmt.Errorf("expected obfs4 bridge line")
+	}
+	host, _, err := net.SplitHostPort(fields[0])
+	if err != nil {
+		return Node{}, err
+	}
+	values := url.Values{}
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			continue // the fingerprint
+		}
+		values.Set(key, value)
+	}
+	iatMode, err := parseIATMode(values.Get(iatModeArg))
+	if err != nil {
+		return Node{}, err
+	}
+	return Node{
+		Protocol: "obfs4",
+		Addr:     fields[0],
+		Host:     host,
+		Values:   values,
+		IATMode:  iatMode,
+	}, nil
+}
+
+// ptArgs returns the arguments for the pluggable transport client factory.
+func (n Node) ptArgs() pt.Args {
+	args := pt.Args{}
+	for key, values := range n.Values {
+		args[key] = append([]string{}, values...)
+	}
+	args[iatModeArg] = []string{strconv.Itoa(int(n.IATMode))}
+	return args
+}
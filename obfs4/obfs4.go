@@ -15,9 +15,9 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
 
-	pt "git.torproject.org/pluggable-transports/goptlib.git"
-
+	"github.com/ooni/minivpn/pkg/transport"
 	"gitlab.com/yawning/obfs4.git/transports/base"
 	"gitlab.com/yawning/obfs4.git/transports/obfs4"
 	"golang.org/x/net/proxy"
@@ -32,24 +32,106 @@ type obfs4Context struct {
 	cargs interface{} // type obfs4ClientArgs
 }
 
-var obfs4Map = make(map[string]obfs4Context)
+var (
+	// obfs4MapMu protects obfs4Map.
+	obfs4MapMu sync.Mutex
+
+	// obfs4Map maps the address of each initialized node to its obfs4 context.
+	obfs4Map = make(map[string]obfs4Context)
+)
+
+func init() {
+	if err := transport.Register("obfs4", NewTransport); err != nil {
+		panic(err)
+	}
+}
+
+// NewTransport returns the obfs4 [transport.PluggableTransport] for the node at the given
+// obfs4://... URI, initializing the obfs4 client for the node unless already initialized.
+// The transport reaches the node using the dialer of the environment.
+func NewTransport(uri string, env *transport.Environment) (transport.PluggableTransport, error) {
+	node, err := NewNodeFromURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	obfs4MapMu.Lock()
+	defer obfs4MapMu.Unlock()
+	if _, found := obfs4Map[node.Addr]; !found {
+		if err := obfs4ClientInitLocked(node); err != nil {
+			return nil, err
+		}
+	}
+	return NewDialer(node, WithUnderlyingDialer(env.Dialer)), nil
+}
 
 type Dialer struct {
 	node Node
+
+	// overrideArgs is true when we need to parse the client args again, because
+	// the dialer options changed the node initialized by Obfs4ClientInit.
+	overrideArgs bool
+
+	// underlying is the OPTIONAL dialer we use to reach the node.
+	underlying transport.ContextDialer
+}
+
+// DialerOption is an option to configure a [Dialer].
+type DialerOption func(*Dialer)
+
+// WithIATMode overrides the iat-mode of the node.
+func WithIATMode(mode IATMode) DialerOption {
+	return func(d *Dialer) {
+		d.node.IATMode = mode
+		d.overrideArgs = true
+	}
 }
 
-func NewDialer(node Node) *Dialer {
-	return &Dialer{node}
+// WithUnderlyingDialer sets the dialer we use to reach the node. By default, we dial directly.
+func WithUnderlyingDialer(dialer transport.ContextDialer) DialerOption {
+	return func(d *Dialer) {
+		d.underlying = dialer
+	}
+}
+
+// NewDialer returns a [Dialer] for a node initialized using Obfs4ClientInit.
+func NewDialer(node Node, opts ...DialerOption) *Dialer {
+	d := &Dialer{node: node}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
 func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
-	// TODO(ainghazal): honor ctx
-	dialFn := dialer(d.node.Addr)
+	dialFn, err := d.dialer(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return dialFn(network, address)
 }
 
+// Dial implements transport.PluggableTransport.
+func (d *Dialer) Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	return d.DialContext(ctx, network, address)
+}
+
+var _ transport.PluggableTransport = &Dialer{}
+
+// StreamFraming tells the OpenVPN layer to always use the stream framing over our conns,
+// since obfs4 carries a byte stream regardless of the network the conns report.
+func (d *Dialer) StreamFraming() bool {
+	return true
+}
+
 // Obfs4ClientInit initializes the obfs4 client
 func Obfs4ClientInit(node Node) error {
+	obfs4MapMu.Lock()
+	defer obfs4MapMu.Unlock()
+	return obfs4ClientInitLocked(node)
+}
+
+// obfs4ClientInitLocked is like Obfs4ClientInit but assumes we hold obfs4MapMu.
+func obfs4ClientInitLocked(node Node) error {
 	if _, ok := obfs4Map[node.Addr]; ok {
 		return fmt.Errorf("obfs4 context already initialized")
 	}
@@ -61,7 +143,7 @@ func Obfs4ClientInit(node Node) error {
 		stateDir = "."
 	}
 
-	ptArgs := pt.Args(node.Values)
+	ptArgs := node.ptArgs()
 
 	// we're only dealing with the client side here, we assume
 	// server side is running obfs4proxy or the likes. in the future it would perhaps be
@@ -84,8 +166,24 @@ func Obfs4ClientInit(node Node) error {
 
 type DialFunc func(string, string) (net.Conn, error)
 
-func dialer(nodeAddr string) DialFunc {
-	oc := obfs4Map[nodeAddr]
+// dialer returns the DialFunc for the node of the dialer, parsing again the client args
+// if the dialer options changed them. We use the ctx to reach the node.
+func (d *Dialer) dialer(ctx context.Context) (DialFunc, error) {
+	obfs4MapMu.Lock()
+	oc, found := obfs4Map[d.node.Addr]
+	obfs4MapMu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("obfs4 context not initialized")
+	}
+	if d.overrideArgs {
+		ptArgs := d.node.ptArgs()
+		cargs, err := oc.cf.ParseArgs(&ptArgs)
+		if err != nil {
+			return nil, err
+		}
+		oc.cargs = cargs
+	}
+	nodeAddr := d.node.Addr
 	// From the documentation of the ClientFactory interface:
 	// https://github.com/Yawning/obfs4/blob/master/transports/base/base.go#L42
 	// Dial creates an outbound net.Conn, and does whatever is required
@@ -93,7 +191,12 @@ func dialer(nodeAddr string) DialFunc {
 	// ready to relay data.
 	// Dial(network, address string, dialFn DialFunc, args interface{}) (net.Conn, error)
 	dialFn := proxy.Direct.Dial
+	if d.underlying != nil {
+		dialFn = func(network, address string) (net.Conn, error) {
+			return d.underlying.DialContext(ctx, network, address)
+		}
+	}
 	return func(network, address string) (net.Conn, error) {
 		return oc.cf.Dial(network, nodeAddr, dialFn, oc.cargs)
-	}
+	}, nil
 }
@@ -0,0 +1,140 @@
+package obfs4
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	"gitlab.com/yawning/obfs4.git/transports/base"
+
+	"github.com/ooni/minivpn/pkg/transport"
+)
+
+func TestNewNodeFromURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    IATMode
+		wantErr error
+	}{
+		{"iat-mode defaults to none", "obfs4://10.0.0.1:443?cert=abc", IATModeNone, nil},
+		{"iat-mode enabled", "obfs4://10.0.0.1:443?cert=abc&iat-mode=1", IATModeEnabled, nil},
+		{"iat-mode paranoid", "obfs4://10.0.0.1:443?cert=abc&iat-mode=2", IATModeParanoid, nil},
+		{"iat-mode out of range", "obfs4://10.0.0.1:443?cert=abc&iat-mode=3", IATModeNone, ErrBadIATMode},
+		{"iat-mode not a number", "obfs4://10.0.0.1:443?cert=abc&iat-mode=x", IATModeNone, ErrBadIATMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := NewNodeFromURI(tt.uri)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewNodeFromURI() error = %v, want %v", err, tt.wantErr)
+			}
+			if node.IATMode != tt.want {
+				t.Errorf("IATMode = %d, want %d", node.IATMode, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewNodeFromBridgeLine(t *testing.T) {
+	t.Run("we parse a full bridge line", func(t *testing.T) {
+		line := "obfs4 10.0.0.1:443 4352E58420E68F5E40BF7C74FADDCCD9D1349413 cert=abc iat-mode=2"
+		node, err := NewNodeFromBridgeLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Addr != "10.0.0.1:443" || node.Host != "10.0.0.1" || node.Protocol != "obfs4" {
+			t.Errorf("got node %+v", node)
+		}
+		if node.Values.Get("cert") != "abc" || node.IATMode != IATModeParanoid {
+			t.Errorf("got values %v and iat-mode %d", node.Values, node.IATMode)
+		}
+	})
+
+	for _, line := range []string{"", "obfs4", "obfs4 10.0.0.1", "10.0.0.1:443 cert=abc iat-mode=9"} {
+		if _, err := NewNodeFromBridgeLine(line); err == nil {
+			t.Errorf("NewNodeFromBridgeLine(%q): expected an error", line)
+		}
+	}
+}
+
+// mockedClientFactory is a [base.ClientFactory] recording the parsed args.
+type mockedClientFactory struct {
+	base.ClientFactory
+	parsed []pt.Args
+	dialed []interface{}
+}
+
+func (cf *mockedClientFactory) ParseArgs(args *pt.Args) (interface{}, error) {
+	cf.parsed = append(cf.parsed, *args)
+	return *args, nil
+}
+
+func (cf *mockedClientFactory) Dial(network, address string, dialFn base.DialFunc, args interface{}) (net.Conn, error) {
+	cf.dialed = append(cf.dialed, args)
+	return nil, errors.New("mocked dial")
+}
+
+func TestDialerIATMode(t *testing.T) {
+	node, err := NewNodeFromURI("obfs4://10.0.0.9:443?cert=abc&iat-mode=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := &mockedClientFactory{}
+	initial := node.ptArgs()
+	obfs4Map[node.Addr] = obfs4Context{cf: cf, cargs: initial}
+	defer delete(obfs4Map, node.Addr)
+
+	t.Run("by default we use the args of the node", func(t *testing.T) {
+		NewDialer(node).DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+		args := cf.dialed[len(cf.dialed)-1].(pt.Args)
+		if mode, _ := args.Get("iat-mode"); mode != "0" {
+			t.Errorf("iat-mode = %q, want %q", mode, "0")
+		}
+	})
+
+	t.Run("the option overrides the iat-mode passed to the client factory", func(t *testing.T) {
+		NewDialer(node, WithIATMode(IATModeEnabled)).DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+		if len(cf.parsed) != 1 {
+			t.Fatalf("parsed the args %d times, want once", len(cf.parsed))
+		}
+		args := cf.dialed[len(cf.dialed)-1].(pt.Args)
+		if mode, _ := args.Get("iat-mode"); mode != "1" {
+			t.Errorf("iat-mode = %q, want %q", mode, "1")
+		}
+		if cert, _ := args.Get("cert"); cert != "abc" {
+			t.Errorf("cert = %q, want %q", cert, "abc")
+		}
+	})
+}
+
+func TestNewTransportConcurrent(t *testing.T) {
+	const uri = "obfs4://10.0.0.7:443?cert=4UbQjIfjJEQHPOs8vs5sagrSXx1gfrDCGdVh2hpIPSKH0nklv1e4f29r7jb91VIrq4q5Jw&iat-mode=0"
+	defer func() {
+		obfs4MapMu.Lock()
+		delete(obfs4Map, "10.0.0.7:443")
+		obfs4MapMu.Unlock()
+	}()
+
+	// the first caller initializes the node and the others reuse it
+	errs := make(chan error, 8)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := NewTransport(uri, &transport.Environment{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
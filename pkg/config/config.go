@@ -1,7 +1,11 @@
 package config
 
 import (
+	"errors"
+	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/ooni/minivpn/internal/model"
@@ -18,14 +22,78 @@ type Config struct {
 
 	// if a tracer is provided, it will be used to trace the openvpn handshake.
 	tracer model.HandshakeTracer
+
+	// channelBufferSize is the size of the channels moving data packets between workers.
+	channelBufferSize int
+
+	// maxControlPayload is the maximum payload size of the control packets we send.
+	maxControlPayload int
+
+	// writePolicy and writeTimeout tell what the data channel does when the layer below is busy.
+	writePolicy  WritePolicy
+	writeTimeout time.Duration
+
+	// handshakeTimeout is the deadline for the whole handshake.
+	handshakeTimeout time.Duration
+
+	// pushRequestInterval and pushRequestAttempts control the PUSH_REQUEST retransmissions.
+	pushRequestInterval time.Duration
+	pushRequestAttempts int
+
+	// hardResetInterval and hardResetAttempts control the hard reset retransmissions.
+	hardResetInterval time.Duration
+	hardResetAttempts int
+
+	// captureSink, if set, receives the decrypted IP packets.
+	captureSink func(model.Direction, []byte)
+
+	// receiveTimestampSink, if set, receives each raw packet read from the network,
+	// along with the time at which we read it.
+	receiveTimestampSink func(time.Time, []byte)
+
+	// stateCallback, if set, is called on each change of the connection state.
+	stateCallback func(model.ConnectionState)
+
+	// callbackMu serializes the state changes, so that stateCallback observes them in order.
+	callbackMu sync.Mutex
+
+	// stateMu guards state.
+	stateMu sync.Mutex
+
+	// state is the current connection state.
+	state model.ConnectionState
+
+	// progress, if set, receives the handshake progress events.
+	progress chan<- model.ProgressEvent
+
+	// progressStart is when we last started connecting, guarded by stateMu.
+	progressStart time.Time
+
+	// credentialsOnce ensures we create the cachingProvider at most once.
+	credentialsOnce sync.Once
+
+	// cachingProvider wraps the configured credential provider with auth-retry nointeract.
+	cachingProvider *cachingProvider
+
+	// randomSource, if set, replaces crypto/rand for the session ID and the key material.
+	randomSource io.Reader
 }
 
 // NewConfig returns a Config ready to intialize a vpn tunnel.
 func NewConfig(options ...Option) *Config {
 	cfg := &Config{
-		openvpnOptions: &OpenVPNOptions{},
-		logger:         log.Log,
-		tracer:         &model.DummyTracer{},
+		openvpnOptions:   &OpenVPNOptions{},
+		logger:           log.Log,
+		tracer:           &model.DummyTracer{},
+		writePolicy:      WritePolicyBlock,
+		writeTimeout:     DefaultWriteTimeout,
+		handshakeTimeout: DefaultHandshakeTimeout,
+
+		pushRequestInterval: DefaultPushRequestInterval,
+		pushRequestAttempts: DefaultPushRequestAttempts,
+
+		hardResetInterval: DefaultHardResetInterval,
+		hardResetAttempts: DefaultHardResetAttempts,
 	}
 	for _, opt := range options {
 		opt(cfg)
@@ -43,11 +111,21 @@ func WithLogger(logger model.Logger) Option {
 	}
 }
 
-// Logger returns the configured logger.
+// Logger returns the configured logger. When the OpenVPN options set the verbosity, the
+// logger only emits the messages allowed by the verbosity. See [VerbLogLevel].
 func (c *Config) Logger() model.Logger {
+	if c.openvpnOptions.VerbSet {
+		return model.NewLevelLogger(c.logger, VerbLogLevel(c.openvpnOptions.Verb))
+	}
 	return c.logger
 }
 
+// PacketDumps returns whether we should log the hex dumps of the packets we send and
+// receive, which happens when the OpenVPN options set verb [PacketDumpsVerb] or more.
+func (c *Config) PacketDumps() bool {
+	return c.openvpnOptions.VerbSet && c.openvpnOptions.Verb >= PacketDumpsVerb
+}
+
 // WithHandshakeTracer configures the passed [HandshakeTracer].
 func WithHandshakeTracer(tracer model.HandshakeTracer) Option {
 	return func(config *Config) {
@@ -60,6 +138,274 @@ func (c *Config) Tracer() model.HandshakeTracer {
 	return c.tracer
 }
 
+// WithChannelBufferSize configures the number of packets that the channels moving data
+// packets between the TUN and the workers can hold. Larger buffers absorb bursts without
+// blocking the TUN, at the cost of memory (each slot may hold a full-sized packet) and of
+// added latency under sustained load. The default value (zero) means unbuffered channels,
+// and a negative value selects the default.
+func WithChannelBufferSize(size int) Option {
+	return func(config *Config) {
+		if size < 0 {
+			size = 0
+		}
+		config.channelBufferSize = size
+	}
+}
+
+// ChannelBufferSize returns the configured channel buffer size.
+func (c *Config) ChannelBufferSize() int {
+	return c.channelBufferSize
+}
+
+// WithMaxControlPayload configures the maximum number of TLS bytes we send in a single control
+// packet. We split larger TLS writes (e.g., the certificate chain) into several packets, which
+// avoids the IP fragmentation of the handshake packets on UDP; the remote reassembles them. A
+// value around 1250 bytes suits most links. The default value (zero) means no limit.
+func WithMaxControlPayload(size int) Option {
+	return func(config *Config) {
+		config.maxControlPayload = size
+	}
+}
+
+// MaxControlPayload returns the configured maximum control packet payload size.
+func (c *Config) MaxControlPayload() int {
+	return c.maxControlPayload
+}
+
+// WritePolicy tells what the data channel does with an outgoing packet when the layer
+// below is busy, e.g., because the link is slower than the applications writing to the TUN.
+type WritePolicy int
+
+const (
+	// WritePolicyBlock blocks the writer until the packet can be delivered, which applies
+	// backpressure to the applications, or until the write timeout expires, in which case
+	// the packet is dropped. This is the default, and it suits TCP-based applications.
+	WritePolicyBlock = WritePolicy(iota)
+
+	// WritePolicyDrop immediately drops the packet, which favors latency over delivery
+	// and may suit real-time UDP-based applications.
+	WritePolicyDrop
+)
+
+// DefaultWriteTimeout is the default write timeout for [WritePolicyBlock].
+const DefaultWriteTimeout = 5 * time.Second
+
+// WithWritePolicy configures what the data channel does with an outgoing packet when the
+// layer below is busy. With [WritePolicyBlock], the timeout is how long we block before
+// dropping the packet, and zero means that we block indefinitely; with [WritePolicyDrop],
+// the timeout is ignored. The default is [WritePolicyBlock] with [DefaultWriteTimeout].
+func WithWritePolicy(policy WritePolicy, timeout time.Duration) Option {
+	return func(config *Config) {
+		config.writePolicy = policy
+		config.writeTimeout = timeout
+	}
+}
+
+// WritePolicy returns the configured write policy and write timeout.
+func (c *Config) WritePolicy() (WritePolicy, time.Duration) {
+	return c.writePolicy, c.writeTimeout
+}
+
+// DefaultHandshakeTimeout is the default value for [WithHandshakeTimeout].
+const DefaultHandshakeTimeout = 60 * time.Second
+
+// WithHandshakeTimeout configures the deadline for the whole handshake, from the reset
+// to the data channel initialization, after which starting the tunnel fails. A zero or
+// negative value selects [DefaultHandshakeTimeout]. The context passed when starting the
+// tunnel can still abort the handshake earlier.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(config *Config) {
+		if timeout <= 0 {
+			timeout = DefaultHandshakeTimeout
+		}
+		config.handshakeTimeout = timeout
+	}
+}
+
+// HandshakeTimeout returns the configured handshake timeout.
+func (c *Config) HandshakeTimeout() time.Duration {
+	return c.handshakeTimeout
+}
+
+const (
+	// DefaultPushRequestInterval is the default interval for [WithPushRequestRetry], which
+	// matches the one used by the reference implementation.
+	DefaultPushRequestInterval = 5 * time.Second
+
+	// DefaultPushRequestAttempts is the default number of attempts for [WithPushRequestRetry].
+	DefaultPushRequestAttempts = 6
+)
+
+// WithPushRequestRetry configures how many times we send the PUSH_REQUEST, waiting interval
+// for the PUSH_REPLY after each of them, before failing the handshake. Zero or negative values
+// select [DefaultPushRequestInterval] and [DefaultPushRequestAttempts], respectively.
+func WithPushRequestRetry(interval time.Duration, attempts int) Option {
+	return func(config *Config) {
+		if interval <= 0 {
+			interval = DefaultPushRequestInterval
+		}
+		if attempts <= 0 {
+			attempts = DefaultPushRequestAttempts
+		}
+		config.pushRequestInterval = interval
+		config.pushRequestAttempts = attempts
+	}
+}
+
+// PushRequestRetry returns the configured PUSH_REQUEST interval and number of attempts.
+func (c *Config) PushRequestRetry() (time.Duration, int) {
+	return c.pushRequestInterval, c.pushRequestAttempts
+}
+
+const (
+	// DefaultHardResetInterval is the default initial interval for [WithHardResetRetry].
+	DefaultHardResetInterval = 2 * time.Second
+
+	// DefaultHardResetAttempts is the default number of attempts for [WithHardResetRetry].
+	DefaultHardResetAttempts = 8
+)
+
+// WithHardResetRetry configures how many times we send the hard reset that starts the
+// handshake before giving up. We wait interval for the server reply after the first attempt,
+// and we double the wait after each further attempt, up to eight times interval. Zero or
+// negative values select [DefaultHardResetInterval] and [DefaultHardResetAttempts].
+func WithHardResetRetry(interval time.Duration, attempts int) Option {
+	return func(config *Config) {
+		if interval <= 0 {
+			interval = DefaultHardResetInterval
+		}
+		if attempts <= 0 {
+			attempts = DefaultHardResetAttempts
+		}
+		config.hardResetInterval = interval
+		config.hardResetAttempts = attempts
+	}
+}
+
+// HardResetRetry returns the configured hard reset interval and number of attempts.
+func (c *Config) HardResetRetry() (time.Duration, int) {
+	return c.hardResetInterval, c.hardResetAttempts
+}
+
+// WithRandomSource configures the source of the random bytes we use for the session ID and
+// the key material, in place of crypto/rand. This is meant for reproducible tests and for
+// using a hardware RNG: a predictable source makes the tunnel insecure. Since it should
+// never happen by accident, we log a warning each time we use a custom source.
+func WithRandomSource(source io.Reader) Option {
+	return func(config *Config) {
+		config.randomSource = source
+	}
+}
+
+// RandomSource returns the configured random source, or nil if we should use crypto/rand.
+func (c *Config) RandomSource() io.Reader {
+	return c.randomSource
+}
+
+// WithCaptureSink configures a function receiving each decrypted IP packet moving through
+// the data channel, in either direction, which is useful to capture the tunnel traffic for
+// offline analysis (see the extras/pcap package). We do not pass the keepalive pings. The
+// sink is called synchronously from the data channel workers: it must be fast, and it must
+// neither modify nor retain the packet. The direction is a tunnel.Direction.
+func WithCaptureSink(sink func(direction model.Direction, packet []byte)) Option {
+	return func(config *Config) {
+		config.captureSink = sink
+	}
+}
+
+// CaptureSink returns the configured capture sink, or nil.
+func (c *Config) CaptureSink() func(direction model.Direction, packet []byte) {
+	return c.captureSink
+}
+
+// WithReceiveTimestampSink configures a function receiving each raw packet we read from the
+// network, control or data, along with the time at which the read returned, which is useful
+// to measure the jitter. The timestamps come from [time.Now], hence they contain a monotonic
+// clock reading. Like the capture sink, this sink is called synchronously from the network
+// workers: it must be fast, and it must neither modify nor retain the packet.
+func WithReceiveTimestampSink(sink func(received time.Time, packet []byte)) Option {
+	return func(config *Config) {
+		config.receiveTimestampSink = sink
+	}
+}
+
+// ReceiveTimestampSink returns the configured receive timestamp sink, or nil.
+func (c *Config) ReceiveTimestampSink() func(received time.Time, packet []byte) {
+	return c.receiveTimestampSink
+}
+
+// WithStateChangeCallback configures a callback invoked each time the connection state
+// changes, which is useful to drive a status indicator. Because the config may be reused
+// across reconnections (see StartWithRetry in the tunnel package), the callback observes
+// the whole connection lifecycle. The callback is called synchronously and must not block.
+// It may call [Config.ConnectionState], but it must not change the connection state.
+func WithStateChangeCallback(fn func(state model.ConnectionState)) Option {
+	return func(config *Config) {
+		config.stateCallback = fn
+	}
+}
+
+// ConnectionState returns the current connection state.
+func (c *Config) ConnectionState() model.ConnectionState {
+	defer c.stateMu.Unlock()
+	c.stateMu.Lock()
+	return c.state
+}
+
+// SetConnectionState updates the connection state and invokes the state change callback, if
+// any, unless the state did not change. It is meant to be called by the tunnel implementation.
+func (c *Config) SetConnectionState(state model.ConnectionState) {
+	defer c.callbackMu.Unlock()
+	c.callbackMu.Lock()
+
+	c.stateMu.Lock()
+	if state == c.state {
+		c.stateMu.Unlock()
+		return
+	}
+	c.state = state
+	if state == model.ConnectionConnecting {
+		c.progressStart = time.Now()
+	}
+	c.stateMu.Unlock()
+
+	// we invoke the callback without holding stateMu, so it can query the state
+	if c.stateCallback != nil {
+		c.stateCallback(state)
+	}
+}
+
+// WithProgress configures a channel receiving a [model.ProgressEvent] for each milestone of
+// the handshake, in order, which is useful to render a progress bar. Like the state change
+// callback, the channel observes all the handshakes performed using this config. We never
+// block on the channel: we drop the events that do not fit, so it should be buffered.
+func WithProgress(ch chan<- model.ProgressEvent) Option {
+	return func(config *Config) {
+		config.progress = ch
+	}
+}
+
+// ReportProgress emits a [model.ProgressEvent] for the given stage on the channel configured
+// using [WithProgress], if any. It is meant to be called by the tunnel implementation.
+func (c *Config) ReportProgress(stage model.ProgressStage) {
+	if c.progress == nil {
+		return
+	}
+	now := time.Now()
+	c.stateMu.Lock()
+	start := c.progressStart
+	c.stateMu.Unlock()
+	event := model.ProgressEvent{Stage: stage, Time: now}
+	if !start.IsZero() {
+		event.Elapsed = now.Sub(start)
+	}
+	select {
+	case c.progress <- event:
+	default:
+		c.Logger().Warnf("config: dropping progress event: %s", stage)
+	}
+}
+
 // WithConfigFile configures OpenVPNOptions parsed from the given file.
 func WithConfigFile(configPath string) Option {
 	return func(config *Config) {
@@ -82,6 +428,73 @@ func (c *Config) OpenVPNOptions() *OpenVPNOptions {
 	return c.openvpnOptions
 }
 
+// Password returns a copy of the configured password, to send in the auth request. With
+// auth-nocache, the first call hands over the password and clears [OpenVPNOptions.Password],
+// so that we do not keep it in memory: the caller must wipe the returned bytes after use,
+// and the following calls return nil.
+func (c *Config) Password() []byte {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	o := c.openvpnOptions
+	if o.Password == "" {
+		return nil
+	}
+	password := []byte(o.Password)
+	if o.AuthNoCache {
+		o.Password = ""
+	}
+	return password
+}
+
+// CredentialProvider returns the [CredentialProvider] to use when building the auth request,
+// or nil if none is configured. With auth-retry nointeract, the configured provider is only
+// called once, and the subsequent handshakes using this config reuse its credentials, unless
+// auth-nocache tells us not to keep the credentials in memory.
+func (c *Config) CredentialProvider() CredentialProvider {
+	provider := c.openvpnOptions.CredentialProvider
+	if provider == nil || c.openvpnOptions.AuthRetry != AuthRetryNoInteract || c.openvpnOptions.AuthNoCache {
+		return provider
+	}
+	c.credentialsOnce.Do(func() {
+		c.cachingProvider = &cachingProvider{provider: provider}
+	})
+	return c.cachingProvider
+}
+
+// cachingProvider is a [ChallengeResponder] that only calls the wrapped provider once
+// for the credentials, and then keeps returning the same credentials.
+type cachingProvider struct {
+	provider CredentialProvider
+
+	mu       sync.Mutex
+	cached   bool
+	username string
+	password string
+}
+
+// Credentials implements CredentialProvider.
+func (p *cachingProvider) Credentials() (string, string, error) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+	if !p.cached {
+		username, password, err := p.provider.Credentials()
+		if err != nil {
+			return "", "", err
+		}
+		p.username, p.password, p.cached = username, password, true
+	}
+	return p.username, p.password, nil
+}
+
+// ChallengeResponse implements ChallengeResponder.
+func (p *cachingProvider) ChallengeResponse(challenge string, echo bool) (string, error) {
+	responder, ok := p.provider.(ChallengeResponder)
+	if !ok {
+		return "", errors.New("the credential provider cannot answer challenges")
+	}
+	return responder.ChallengeResponse(challenge, echo)
+}
+
 // Remote has info about the OpenVPN remote, useful to pass to the external dialer.
 type Remote struct {
 	// IPAddr is the IP Address for the remote.
@@ -94,11 +507,12 @@ type Remote struct {
 	Protocol string
 }
 
-// Remote returns the OpenVPN remote.
+// Remote returns the OpenVPN remote. When [OpenVPNOptions.RemoteIP] is set, the
+// returned remote uses it instead of [OpenVPNOptions.Remote].
 func (c *Config) Remote() *Remote {
 	return &Remote{
-		IPAddr:   c.openvpnOptions.Remote,
-		Endpoint: net.JoinHostPort(c.openvpnOptions.Remote, c.openvpnOptions.Port),
+		IPAddr:   c.openvpnOptions.dialHost(),
+		Endpoint: net.JoinHostPort(c.openvpnOptions.dialHost(), c.openvpnOptions.Port),
 		Protocol: c.openvpnOptions.Proto.String(),
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"os"
 	fp "path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/ooni/minivpn/internal/model"
@@ -34,6 +35,62 @@ func TestNewConfig(t *testing.T) {
 		}
 	})
 
+	t.Run("WithChannelBufferSize sets the channel buffer size", func(t *testing.T) {
+		c := NewConfig(WithChannelBufferSize(64))
+		if c.ChannelBufferSize() != 64 {
+			t.Errorf("expected channel buffer size to be 64, got %d", c.ChannelBufferSize())
+		}
+	})
+
+	t.Run("WithChannelBufferSize selects the default for negative sizes", func(t *testing.T) {
+		c := NewConfig(WithChannelBufferSize(-1))
+		if c.ChannelBufferSize() != 0 {
+			t.Errorf("expected channel buffer size to be 0, got %d", c.ChannelBufferSize())
+		}
+		// test that we can use the size to make a channel
+		_ = make(chan []byte, c.ChannelBufferSize())
+	})
+
+	t.Run("WithMaxControlPayload sets the maximum control payload", func(t *testing.T) {
+		c := NewConfig(WithMaxControlPayload(1250))
+		if c.MaxControlPayload() != 1250 {
+			t.Errorf("expected max control payload to be 1250, got %d", c.MaxControlPayload())
+		}
+	})
+
+	t.Run("WithHardResetRetry sets the hard reset retransmissions", func(t *testing.T) {
+		interval, attempts := NewConfig().HardResetRetry()
+		if interval != DefaultHardResetInterval || attempts != DefaultHardResetAttempts {
+			t.Errorf("unexpected default hard reset retry: %v, %d", interval, attempts)
+		}
+		interval, attempts = NewConfig(WithHardResetRetry(time.Second, 3)).HardResetRetry()
+		if interval != time.Second || attempts != 3 {
+			t.Errorf("expected hard reset retry to be 1s, 3, got %v, %d", interval, attempts)
+		}
+		interval, attempts = NewConfig(WithHardResetRetry(0, -1)).HardResetRetry()
+		if interval != DefaultHardResetInterval || attempts != DefaultHardResetAttempts {
+			t.Errorf("expected zero values to select the defaults, got %v, %d", interval, attempts)
+		}
+	})
+
+	t.Run("WithProgress reports the progress since we started connecting", func(t *testing.T) {
+		progress := make(chan model.ProgressEvent, 1)
+		c := NewConfig(WithLogger(model.NewTestLogger()), WithProgress(progress))
+		c.SetConnectionState(model.ConnectionConnecting)
+		time.Sleep(10 * time.Millisecond)
+		c.ReportProgress(model.ProgressDialed)
+		event := <-progress
+		if event.Stage != model.ProgressDialed || event.Elapsed < 10*time.Millisecond {
+			t.Errorf("ReportProgress() = %+v, want %s after at least 10ms", event, model.ProgressDialed)
+		}
+	})
+
+	t.Run("ReportProgress does not block when the channel is full", func(t *testing.T) {
+		progress := make(chan model.ProgressEvent)
+		c := NewConfig(WithLogger(model.NewTestLogger()), WithProgress(progress))
+		c.ReportProgress(model.ProgressDialed)
+	})
+
 	t.Run("WithConfigFile sets OpenVPNOptions after parsing the configured file", func(t *testing.T) {
 		configFile := writeValidConfigFile(t.TempDir())
 		c := NewConfig(WithConfigFile(configFile))
@@ -51,6 +108,108 @@ func TestNewConfig(t *testing.T) {
 		}
 	})
 
+	t.Run("Remote dials RemoteIP while keeping the hostname for verification", func(t *testing.T) {
+		opts := &OpenVPNOptions{Remote: "vpn.example.org", RemoteIP: "2.3.4.5", Port: "443", Proto: ProtoTCP}
+		c := NewConfig(WithOpenVPNOptions(opts))
+		wantRemote := &Remote{
+			IPAddr:   "2.3.4.5",
+			Endpoint: "2.3.4.5:443",
+			Protocol: "tcp",
+		}
+		if diff := cmp.Diff(c.Remote(), wantRemote); diff != "" {
+			t.Error(diff)
+		}
+		if got := opts.VerifyHostname(); got != "vpn.example.org" {
+			t.Errorf("VerifyHostname() = %q, want %q", got, "vpn.example.org")
+		}
+	})
+
+	t.Run("Password returns a copy of the password", func(t *testing.T) {
+		opts := &OpenVPNOptions{Username: "user", Password: "secret"}
+		c := NewConfig(WithOpenVPNOptions(opts))
+		password := c.Password()
+		if string(password) != "secret" {
+			t.Fatalf("Password() = %q, want %q", password, "secret")
+		}
+		password[0] = 'S'
+		if string(c.Password()) != "secret" || opts.Password != "secret" {
+			t.Error("expected the password to be kept")
+		}
+	})
+
+	t.Run("with auth-nocache Password hands over the password once", func(t *testing.T) {
+		opts := &OpenVPNOptions{Username: "user", Password: "secret", AuthNoCache: true}
+		c := NewConfig(WithOpenVPNOptions(opts))
+		if got := c.Password(); string(got) != "secret" {
+			t.Fatalf("Password() = %q, want %q", got, "secret")
+		}
+		if opts.Password != "" {
+			t.Error("expected the options to forget the password")
+		}
+		if got := c.Password(); got != nil {
+			t.Errorf("Password() = %q, want nil", got)
+		}
+	})
+}
+
+func TestConfigVerb(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     *OpenVPNOptions
+		wantLines   []string
+		wantDumps   bool
+		wantWrapped bool
+	}{
+		{
+			name:      "without verb we do not filter",
+			options:   &OpenVPNOptions{},
+			wantLines: []string{"debug", "info", "warn"},
+		},
+		{
+			name:        "verb 0 only emits warnings",
+			options:     &OpenVPNOptions{Verb: 0, VerbSet: true},
+			wantLines:   []string{"warn"},
+			wantWrapped: true,
+		},
+		{
+			name:        "verb 3 emits moderate logs",
+			options:     &OpenVPNOptions{Verb: 3, VerbSet: true},
+			wantLines:   []string{"info", "warn"},
+			wantWrapped: true,
+		},
+		{
+			name:        "verb 5 emits debug logs",
+			options:     &OpenVPNOptions{Verb: 5, VerbSet: true},
+			wantLines:   []string{"debug", "info", "warn"},
+			wantWrapped: true,
+		},
+		{
+			name:        "verb 9 enables packet dumps",
+			options:     &OpenVPNOptions{Verb: 9, VerbSet: true},
+			wantLines:   []string{"debug", "info", "warn"},
+			wantDumps:   true,
+			wantWrapped: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testLogger := model.NewTestLogger()
+			c := NewConfig(WithLogger(testLogger), WithOpenVPNOptions(tt.options))
+			logger := c.Logger()
+			if wrapped := logger != model.Logger(testLogger); wrapped != tt.wantWrapped {
+				t.Errorf("expected the logger to be wrapped: %v", tt.wantWrapped)
+			}
+			logger.Debugf("%s", "debug")
+			logger.Infof("%s", "info")
+			logger.Warnf("%s", "warn")
+			if diff := cmp.Diff(tt.wantLines, testLogger.Lines); diff != "" {
+				t.Error(diff)
+			}
+			if c.PacketDumps() != tt.wantDumps {
+				t.Errorf("PacketDumps() = %v, want %v", c.PacketDumps(), tt.wantDumps)
+			}
+		})
+	}
 }
 
 var sampleConfigFile = `
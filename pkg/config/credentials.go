@@ -0,0 +1,50 @@
+package config
+
+//
+// Parsed credentials shared across handshakes and tunnels.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+)
+
+// Credentials contains the parsed client certificate and key, and the CA pool used to verify
+// the server. Tunnels created from options sharing the same Credentials do not read and parse
+// the certificate, the key and the CA again.
+type Credentials struct {
+	// Certificate is the client certificate and its private key (or signer).
+	Certificate tls.Certificate
+
+	// CAPool contains the CA certificates.
+	CAPool *x509.CertPool
+}
+
+// persistMu protects the persisted credentials of all the options.
+var persistMu sync.Mutex
+
+// LoadCredentials returns the credentials to use for a handshake. When the Credentials field is
+// set, we return it. Otherwise, we call load, which reads and parses the credentials configured
+// in the options. With persist-key, we keep what load returns the first time it succeeds, and we
+// return it to the next handshakes (renegotiations and reconnections) using these options,
+// without calling load again, like the reference implementation does on restart.
+func (o *OpenVPNOptions) LoadCredentials(load func() (*Credentials, error)) (*Credentials, error) {
+	if o.Credentials != nil {
+		return o.Credentials, nil
+	}
+	if !o.PersistKey {
+		return load()
+	}
+	persistMu.Lock()
+	defer persistMu.Unlock()
+	if o.persistedCredentials != nil {
+		return o.persistedCredentials, nil
+	}
+	creds, err := load()
+	if err != nil {
+		return nil, err
+	}
+	o.persistedCredentials = creds
+	return creds, nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+func TestOpenVPNOptions_LoadCredentials(t *testing.T) {
+	// countingLoad returns a load function counting its calls
+	countingLoad := func(calls *int, err error) func() (*Credentials, error) {
+		return func() (*Credentials, error) {
+			*calls++
+			if err != nil {
+				return nil, err
+			}
+			return &Credentials{CAPool: x509.NewCertPool()}, nil
+		}
+	}
+
+	t.Run("without persist-key we load every time", func(t *testing.T) {
+		var calls int
+		o := &OpenVPNOptions{}
+		for i := 0; i < 2; i++ {
+			if _, err := o.LoadCredentials(countingLoad(&calls, nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if calls != 2 {
+			t.Errorf("load called %d times, want 2", calls)
+		}
+	})
+
+	t.Run("with persist-key we load once", func(t *testing.T) {
+		var calls int
+		o := &OpenVPNOptions{PersistKey: true}
+		first, err := o.LoadCredentials(countingLoad(&calls, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := o.LoadCredentials(countingLoad(&calls, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != 1 || first != second {
+			t.Errorf("load called %d times, want 1", calls)
+		}
+	})
+
+	t.Run("with persist-key we do not keep failures", func(t *testing.T) {
+		var calls int
+		o := &OpenVPNOptions{PersistKey: true}
+		errMocked := errors.New("mocked error")
+		if _, err := o.LoadCredentials(countingLoad(&calls, errMocked)); !errors.Is(err, errMocked) {
+			t.Fatalf("LoadCredentials() error = %v, want %v", err, errMocked)
+		}
+		if _, err := o.LoadCredentials(countingLoad(&calls, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if calls != 2 {
+			t.Errorf("load called %d times, want 2", calls)
+		}
+	})
+
+	t.Run("the passed credentials take precedence", func(t *testing.T) {
+		var calls int
+		creds := &Credentials{}
+		o := &OpenVPNOptions{Credentials: creds, PersistKey: true}
+		got, err := o.LoadCredentials(countingLoad(&calls, nil))
+		if err != nil || got != creds || calls != 0 {
+			t.Errorf("LoadCredentials() = %v, %v; load called %d times", got, err, calls)
+		}
+	})
+}
+
+func Test_parsePersistKey(t *testing.T) {
+	o, err := parsePersistKey([]string{}, &OpenVPNOptions{})
+	if err != nil || !o.PersistKey {
+		t.Errorf("parsePersistKey() = %v, %v", o.PersistKey, err)
+	}
+	if _, err := parsePersistKey([]string{"yes"}, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("parsePersistKey() error = %v, want %v", err, ErrBadConfig)
+	}
+}
@@ -0,0 +1,134 @@
+package config
+
+//
+// Dry-run validation of config files.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Problem is a problem found while parsing or validating a config file.
+type Problem struct {
+	// Line is the 1-based number of the offending line, or zero when the
+	// problem does not concern a specific line (e.g., a bad certificate).
+	Line int
+
+	// Directive is the offending line, if any.
+	Directive string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements error.
+func (p Problem) Error() string {
+	if p.Line == 0 {
+		return p.Err.Error()
+	}
+	return fmt.Sprintf("line %d: %q: %s", p.Line, p.Directive, p.Err.Error())
+}
+
+// Unwrap allows to use [errors.Is] with the underlying error.
+func (p Problem) Unwrap() error {
+	return p.Err
+}
+
+// ValidateConfigFile parses the config file at the given path without connecting. Unlike
+// [ReadConfigFile], it does not stop at the first error: it returns all the problems in the
+// directives and in the inline blocks, followed by the problems loading the certificates
+// and the keys. It returns an empty list if the config file is valid.
+func ValidateConfigFile(path string) []Problem {
+	lines, err := getLinesFromFile(path)
+	if err != nil {
+		return []Problem{{Err: fmt.Errorf("%w: %s", ErrBadConfig, err)}}
+	}
+	dir, _ := filepath.Split(path)
+	opt, problems := parseLines(lines, dir, true, false)
+	return append(problems, validateCredentials(opt)...)
+}
+
+// validateCredentials returns the problems loading the CA, the certificate and the key
+// configured in the passed options, and whether we lack any auth info.
+func validateCredentials(o *OpenVPNOptions) []Problem {
+	var problems []Problem
+	fail := func(err error) {
+		problems = append(problems, Problem{Err: err})
+	}
+
+	if !o.HasAuthInfo() {
+		fail(fmt.Errorf("%w: %s", ErrBadConfig, "missing auth info"))
+	}
+
+	if err := validateCA(o); err != nil {
+		fail(err)
+	}
+
+	if o.Signer == nil {
+		cert, key := o.Cert, o.Key
+		if o.CertPath != "" && o.KeyPath != "" {
+			var err error
+			if cert, err = os.ReadFile(o.CertPath); err != nil {
+				fail(fmt.Errorf("%w: cert: %s", ErrBadConfig, err))
+				return problems
+			}
+			if key, err = os.ReadFile(o.KeyPath); err != nil {
+				fail(fmt.Errorf("%w: key: %s", ErrBadConfig, err))
+				return problems
+			}
+		}
+		if len(cert) != 0 && len(key) != 0 {
+			if _, err := tls.X509KeyPair(cert, key); err != nil {
+				fail(fmt.Errorf("%w: cert and key: %s", ErrBadConfig, err))
+			}
+		}
+	}
+	return problems
+}
+
+// errNoCACert indicates that a CA file or block does not contain any certificate.
+var errNoCACert = errors.New("cannot parse ca cert")
+
+// validateCA returns an error if any of the configured CA files, or the inline CA
+// block, does not contain a certificate, or if the CA directory contains none.
+func validateCA(o *OpenVPNOptions) error {
+	pool := x509.NewCertPool()
+	if len(o.CA) != 0 && !pool.AppendCertsFromPEM(o.CA) {
+		return fmt.Errorf("%w: inline ca: %w", ErrBadConfig, errNoCACert)
+	}
+	files := o.ExtraCAPaths
+	if o.CAPath != "" {
+		files = append([]string{o.CAPath}, files...)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("%w: ca: %s", ErrBadConfig, err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%w: %s: %w", ErrBadConfig, file, errNoCACert)
+		}
+	}
+	if o.CADir != "" {
+		entries, err := os.ReadDir(o.CADir)
+		if err != nil {
+			return fmt.Errorf("%w: capath: %s", ErrBadConfig, err)
+		}
+		found := false
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(o.CADir, entry.Name()))
+			if err == nil && entry.Type().IsRegular() && pool.AppendCertsFromPEM(data) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %s: %w", ErrBadConfig, o.CADir, errNoCACert)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"errors"
+	"os"
+	fp "path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ooni/minivpn/internal/vpntest"
+)
+
+// writeConfigFile writes the given lines as a config file in dir and returns its path.
+func writeConfigFile(t *testing.T, dir string, lines ...string) string {
+	path := fp.Join(dir, "config.ovpn")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	t.Run("a valid config has no problems", func(t *testing.T) {
+		d := t.TempDir()
+		crt, err := vpntest.WriteTestingCerts(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := writeConfigFile(t, d,
+			"remote 0.0.0.0 1194",
+			"cipher AES-256-GCM",
+			"auth SHA512",
+			"ca "+fp.Base(crt.CA),
+			"cert "+fp.Base(crt.Cert),
+			"key "+fp.Base(crt.Key),
+		)
+		if problems := ValidateConfigFile(path); len(problems) != 0 {
+			t.Errorf("ValidateConfigFile() = %v, want no problems", problems)
+		}
+	})
+
+	t.Run("all the problems are reported", func(t *testing.T) {
+		d := t.TempDir()
+		crt, err := vpntest.WriteTestingCerts(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(fp.Join(d, "bad-ca.crt"), []byte("not a cert"), 0600)
+		path := writeConfigFile(t, d,
+			"remote 0.0.0.0 1194",
+			"cipher AES-256-XYZ",
+			"ca missing.crt",
+			"ca bad-ca.crt",
+			"cert "+fp.Base(crt.Cert),
+			"auth MD4",
+			"<key>",
+			"key_string",
+		)
+		problems := ValidateConfigFile(path)
+
+		wantLines := []int{2, 3, 6, 7}
+		var gotLines []int
+		for _, p := range problems {
+			if !errors.Is(p, ErrBadConfig) {
+				t.Errorf("problem %v does not wrap %v", p, ErrBadConfig)
+			}
+			if p.Line != 0 {
+				gotLines = append(gotLines, p.Line)
+			}
+		}
+		if len(gotLines) != len(wantLines) {
+			t.Fatalf("got problems at lines %v, want %v (problems: %v)", gotLines, wantLines, problems)
+		}
+		for i := range wantLines {
+			if gotLines[i] != wantLines[i] {
+				t.Errorf("got problems at lines %v, want %v", gotLines, wantLines)
+			}
+		}
+
+		// the problems loading the credentials come after the ones in the lines
+		var credentials []string
+		for _, p := range problems {
+			if p.Line == 0 {
+				credentials = append(credentials, p.Error())
+			}
+		}
+		joined := strings.Join(credentials, "\n")
+		if !strings.Contains(joined, "bad-ca.crt") {
+			t.Errorf("expected a problem with bad-ca.crt, got %q", joined)
+		}
+	})
+
+	t.Run("a missing file is a problem", func(t *testing.T) {
+		problems := ValidateConfigFile(fp.Join(t.TempDir(), "missing.ovpn"))
+		if len(problems) != 1 || !errors.Is(problems[0], ErrBadConfig) {
+			t.Errorf("ValidateConfigFile() = %v, want a single %v", problems, ErrBadConfig)
+		}
+	})
+}
@@ -13,7 +13,7 @@ package config
 //
 // Following the configuration format in the reference implementation, `minivpn`
 // allows including files in the main configuration file, but only for the `ca`,
-// `cert` and `key` options.
+// `cert`, `key`, `tls-crypt-v2` and `tls-auth` options.
 //
 // Each inline file is started by the line <option> and ended by the line
 // </option>.
@@ -31,15 +31,25 @@ package config
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/runtimex"
+	"golang.org/x/exp/slices"
 )
 
 type (
@@ -56,6 +66,33 @@ const (
 
 	// CompressionLZONo is lzo-no (another type of no-compression, older).
 	CompressionLZONo = Compression("lzo-no")
+
+	// CompressionLZOAdaptive is comp-lzo adaptive, where the decision to compress is
+	// taken for each packet. It uses the same framing as lzo-no. Since we do not implement
+	// LZO, we send every packet uncompressed and cannot read the compressed packets sent by
+	// the remote, which would be rejected by the data channel.
+	CompressionLZOAdaptive = Compression("lzo-adaptive")
+
+	// CompressionMigrate is compress migrate, which allows to connect to servers that are
+	// migrating away from compression. We do not announce any compression with it.
+	CompressionMigrate = Compression("migrate")
+)
+
+// AllowCompression tells whether we allow compression, as configured with allow-compression.
+type AllowCompression string
+
+const (
+	// AllowCompressionNo forbids any compression: we fail when the remote pushes compression,
+	// we reject compressed packets and we never compress, but we still use the configured
+	// compression framing.
+	AllowCompressionNo = AllowCompression("no")
+
+	// AllowCompressionAsym allows the remote to compress, but we never compress. Since we do
+	// not implement LZO and LZ4, we still cannot decompress the packets it compresses.
+	AllowCompressionAsym = AllowCompression("asym")
+
+	// AllowCompressionYes allows compression in both directions.
+	AllowCompressionYes = AllowCompression("yes")
 )
 
 // Proto is the main vpn mode (e.g., TCP or UDP).
@@ -77,21 +114,159 @@ const ProtoUDP = Proto("udp")
 // ErrBadConfig is the generic error returned for invalid config files
 var ErrBadConfig = errors.New("openvpn: bad config")
 
-// SupportedCiphers defines the supported ciphers.
-var SupportedCiphers = []string{
-	"AES-128-CBC",
-	"AES-192-CBC",
-	"AES-256-CBC",
-	"AES-128-GCM",
-	"AES-192-GCM",
-	"AES-256-GCM",
+// ErrUnknownDirective is returned by [ReadConfigFileStrict] when the config file
+// contains a directive we do not know. It always wraps ErrBadConfig.
+var ErrUnknownDirective = errors.New("unknown directive")
+
+// TLSMode selects the TLS client we use for the control channel handshake.
+type TLSMode string
+
+const (
+	// TLSModeParrot parrots the ClientHello of the reference implementation with uTLS,
+	// which makes the handshake harder to fingerprint. This is the default.
+	TLSModeParrot = TLSMode("parrot")
+
+	// TLSModeDefault uses the stock TLS client, which may be needed for servers that
+	// do not cope with the parroted ClientHello.
+	TLSModeDefault = TLSMode("default")
+)
+
+// KeyDirection selects which halves of the tls-auth static key we use to send and to
+// receive, as configured with `key-direction` or with the second argument of `tls-auth`.
+type KeyDirection string
+
+const (
+	// KeyDirectionBidirectional uses the same halves of the key in both directions. This
+	// is the default, and it only works with servers that do not set a direction either.
+	KeyDirectionBidirectional = KeyDirection("")
+
+	// KeyDirectionNormal is key-direction 0, which is usually set by the server.
+	KeyDirectionNormal = KeyDirection("0")
+
+	// KeyDirectionInverse is key-direction 1, which is usually set by the client.
+	KeyDirectionInverse = KeyDirection("1")
+)
+
+// AuthRetry is what we do when the server rejects our credentials, as configured
+// with `auth-retry none|nointeract|interact`.
+type AuthRetry string
+
+const (
+	// AuthRetryNone fails as soon as the server rejects our credentials. This is the default.
+	AuthRetryNone = AuthRetry("none")
+
+	// AuthRetryNoInteract retries the handshake once, reusing the same credentials.
+	AuthRetryNoInteract = AuthRetry("nointeract")
+
+	// AuthRetryInteract retries the handshake once, asking the [CredentialProvider]
+	// for the credentials again.
+	AuthRetryInteract = AuthRetry("interact")
+)
+
+// PullFilterAction is what we do with the pushed options matching a [PullFilter].
+type PullFilterAction string
+
+const (
+	// PullFilterAccept keeps the matching pushed options.
+	PullFilterAccept = PullFilterAction("accept")
+
+	// PullFilterIgnore drops the matching pushed options.
+	PullFilterIgnore = PullFilterAction("ignore")
+
+	// PullFilterReject fails the handshake when the remote pushes a matching option.
+	PullFilterReject = PullFilterAction("reject")
+)
+
+// PullFilter is a filter for the options pushed by the remote, as configured
+// with `pull-filter action "text"`. A pushed option matches the filter when it
+// starts with the filter text.
+type PullFilter struct {
+	Action PullFilterAction
+	Text   string
+}
+
+// SupportedCiphers is a static snapshot of the built-in ciphers, taken from the table of
+// the data channel at init time. It does not include the ciphers added later on with
+// [RegisterDataCipher], which we nonetheless accept when parsing the config.
+var SupportedCiphers = supportedCiphers()
+
+// SupportedAuth is a static snapshot of the built-in authentication methods, taken from
+// the table of the data channel at init time.
+var SupportedAuth = supportedAuth()
+
+// supportedCiphers returns the names of the data channel ciphers currently registered.
+func supportedCiphers() []string {
+	var names []string
+	for _, dc := range model.DataCiphers() {
+		names = append(names, dc.Name)
+	}
+	return names
+}
+
+// supportedAuth returns the names of the data channel HMAC digests we support.
+func supportedAuth() []string {
+	var names []string
+	for _, auth := range model.DataAuths {
+		names = append(names, auth.Name)
+	}
+	return names
 }
 
-// SupportedAuth defines the supported authentication methods.
-var SupportedAuth = []string{
-	"SHA1",
-	"SHA256",
-	"SHA512",
+// DataCipherMode is the block cipher mode of a data channel cipher.
+type DataCipherMode string
+
+const (
+	// DataCipherModeCBC is the CBC mode, which we use along with the auth HMAC.
+	DataCipherModeCBC = DataCipherMode("cbc")
+
+	// DataCipherModeGCM is the GCM mode, which does not use the auth HMAC.
+	DataCipherModeGCM = DataCipherMode("gcm")
+)
+
+// ErrBadDataCipher indicates that [RegisterDataCipher] cannot register a cipher.
+var ErrBadDataCipher = model.ErrBadDataCipher
+
+// ErrDataCipherAlreadyRegistered indicates that [RegisterDataCipher] cannot register
+// a cipher because its name is already taken.
+var ErrDataCipherAlreadyRegistered = model.ErrDataCipherAlreadyRegistered
+
+// RegisterDataCipher registers an additional data channel cipher, which the cipher and
+// data-ciphers options then accept, using keys of keyBits bits and the given mode. The data
+// channel creates the block cipher using newBlock (e.g., aes.NewCipher), which must accept
+// the keys and return ciphers with 16-byte blocks. It fails with [ErrBadDataCipher] if the
+// name is empty or contains spaces, commas or colons, if keyBits is not a multiple of 8
+// between 128 and 512, if the mode is unknown, or if newBlock fails; and it fails with
+// [ErrDataCipherAlreadyRegistered] if the name, compared case-insensitively, is taken.
+func RegisterDataCipher(name string, keyBits int, mode DataCipherMode, newBlock func(key []byte) (cipher.Block, error)) error {
+	return model.RegisterDataCipher(model.DataCipher{
+		Name:     name,
+		KeyBits:  keyBits,
+		Mode:     string(mode),
+		NewBlock: newBlock,
+	})
+}
+
+// UnregisterDataCipher removes a cipher registered with [RegisterDataCipher]. The
+// built-in ciphers cannot be removed.
+func UnregisterDataCipher(name string) {
+	model.UnregisterDataCipher(name)
+}
+
+// CredentialProvider supplies the credentials when we build the auth request sent to
+// the server, which allows, e.g., to prompt the user for a one-time password.
+type CredentialProvider interface {
+	// Credentials returns the username and the password to send to the server.
+	Credentials() (username, password string, err error)
+}
+
+// ChallengeResponder is a [CredentialProvider] that can also answer the static
+// challenge configured with the static-challenge option.
+type ChallengeResponder interface {
+	CredentialProvider
+
+	// ChallengeResponse returns the response to the given challenge text. When echo
+	// is true, the response may be echoed back to the user while typing it.
+	ChallengeResponse(challenge string, echo bool) (string, error)
 }
 
 // OpenVPNOptions make all the relevant openvpn configuration options accessible to the
@@ -113,122 +288,909 @@ type OpenVPNOptions struct {
 	Auth      string
 	TLSMaxVer string
 
+	// ExtraCAPaths are the CA files passed with any ca option after the first one,
+	// and CADir is the directory passed with capath. Their certificates are added
+	// to the same pool as the ones in CAPath. Repeated inline ca blocks are
+	// appended to CA instead.
+	ExtraCAPaths []string
+	CADir        string
+
+	// DataCiphers are the data channel ciphers we accept from the cipher negotiation, as
+	// configured with data-ciphers, which we announce to the remote. DataCiphersFallback,
+	// as configured with data-ciphers-fallback, is the cipher we use when the remote does
+	// not push any cipher. See also [OpenVPNOptions.NegotiateCipher].
+	DataCiphers         []string
+	DataCiphersFallback string
+
+	// TLSCipher and TLSCipherSuites are the IDs of the TLS 1.2 and TLS 1.3 cipher
+	// suites we allow for the control channel, as configured with tls-cipher and
+	// tls-ciphersuites. When either is empty, we offer the default suites for that TLS
+	// version. Like crypto/tls, we only restrict the TLS 1.3 suites when parroting.
+	TLSCipher       []uint16
+	TLSCipherSuites []uint16
+
+	// KeyMethod is the key exchange method (1 or 2). The zero value means key-method 2,
+	// which is the default for the reference implementation.
+	KeyMethod int
+
+	// SndBuf and RcvBuf are the sizes of the UDP socket send and receive buffers.
+	// The zero value keeps the operating system defaults.
+	SndBuf int
+	RcvBuf int
+
+	// LocalHost and LocalPort are the local address and port to which we bind, as configured
+	// with local and lport. NoBind, as configured with nobind, causes us to ignore them. When
+	// they are empty, we bind to an ephemeral port. See [OpenVPNOptions.LocalAddr].
+	LocalHost string
+	LocalPort string
+	NoBind    bool
+
+	// BindInterface is the name of the network interface (e.g., eth1) to which we bind the
+	// socket we use to reach the remote, as configured with bind-dev. This is useful on hosts
+	// with many uplinks. Use LocalHost to bind to a source address instead.
+	BindInterface string
+
+	// RemoteIP, when set, is the IP address we dial instead of the address of Remote, which
+	// we keep using as the TLS SNI and as the name to verify in the server certificate. This
+	// allows to reach a server at a fixed IP address while presenting its hostname.
+	RemoteIP string
+
+	// Float, as configured with float, allows the remote to send us packets from an address
+	// other than the configured one. Without it, we drop such packets when we receive them
+	// using a [net.PacketConn]; a connected UDP socket only receives from the remote anyway.
+	Float bool
+
+	// Ping is the interval, in seconds, after which we send a ping to the remote if we
+	// have not sent anything else. PingRestart is the interval, in seconds, after which we
+	// give up on the tunnel if we have not received any packet. The zero value disables them.
+	// The values pushed by the remote take precedence over these.
+	Ping        int
+	PingRestart int
+
+	// Verb is the verbosity configured with verb, from 0 to 11, and VerbSet tells whether
+	// the config sets it. When set, the verbosity selects the level of the logger and, from
+	// [PacketDumpsVerb] on, enables the hex dumps of the packets. See [VerbLogLevel].
+	Verb    int
+	VerbSet bool
+
+	// Settings, when not nil, overrides the [DefaultSettings] we announce to the server.
+	// Since each tunnel has its own options, tunnels can announce different settings.
+	Settings *Settings
+
+	// StaticChallenge is the challenge text configured with static-challenge, and
+	// StaticChallengeEcho tells whether the response should be echoed. When the
+	// challenge is set, the CredentialProvider must be a [ChallengeResponder].
+	StaticChallenge     string
+	StaticChallengeEcho bool
+
+	// PeerFingerprints are the SHA-256 fingerprints of the server leaf certificates we
+	// accept, as configured with peer-fingerprint. When set, the leaf certificate must
+	// match one of them, and we do not build the chain to the CA.
+	PeerFingerprints [][32]byte
+
+	// Env holds the environment variables set with setenv and setenv-safe, which
+	// we do not use ourselves, but which scripts and plugins may reference. As in
+	// the reference implementation, the names set with setenv-safe are prefixed
+	// with OPENVPN_.
+	Env map[string]string
+
+	// PullFilters are the filters we apply, in order, to each pushed option: the first
+	// matching filter decides what we do with the option, and the options matching no
+	// filter are kept. RouteNoPull, when set, causes us to drop the pushed routes and
+	// the pushed DHCP options (e.g., the DNS servers).
+	PullFilters []PullFilter
+	RouteNoPull bool
+
+	// RedirectGateway and RedirectGatewayFlags are set by the redirect-gateway directive,
+	// and BlockOutsideDNS by the block-outside-dns directive. We do not change the routes
+	// nor the firewall: we surface them, together with the pushed ones, in the tunnel info.
+	RedirectGateway      bool
+	RedirectGatewayFlags model.RedirectGatewayFlags
+	BlockOutsideDNS      bool
+
+	// AuthNoCache, when set, causes the password and the key sources to be wiped from memory
+	// as soon as they have been used during the handshake. The tunnel takes the password
+	// and clears the Password field (see [Config.Password]), so that it can authenticate
+	// once, and then only renegotiate using the auth-token pushed by the server, if any.
+	AuthNoCache bool
+
+	// ExplicitExitNotify is the number of exit-notify messages the explicit-exit-notify
+	// directive asks us to send when closing a UDP tunnel. Since we do not retry, any
+	// positive value sends a single message. The zero value disables it.
+	ExplicitExitNotify int
+
+	// AuthRetry tells whether we retry the handshake when the server rejects our
+	// credentials. The zero value is the same as AuthRetryNone.
+	AuthRetry AuthRetry
+
 	// Below are options that do not conform strictly to the OpenVPN configuration format, but still can
 	// be understood by us in a configuration file:
 
 	Compress   Compression
 	ProxyOBFS4 string
+
+	// AllowCompression is the allow-compression policy. The zero value is the same as
+	// AllowCompressionNo, like in the reference implementation. See [OpenVPNOptions.CompressionAllowed].
+	AllowCompression AllowCompression
+
+	// Transport is the name of the pluggable transport selected using a proto-<name>
+	// directive, and TransportURI is the URI configuring it. See [OpenVPNOptions.PluggableTransport].
+	Transport    string
+	TransportURI string
+
+	// TransportBaseDir is the directory against which the transport resolves the relative
+	// paths in TransportURI. When parsing a config file, we use the directory of the file.
+	TransportBaseDir string
+
+	// TLSMode selects how we perform the control channel TLS handshake. The zero
+	// value is the same as TLSModeParrot.
+	TLSMode TLSMode
+
+	// ClientHelloID is the name of the uTLS preset to parrot (e.g., HelloChrome_Auto),
+	// and ClientHelloHex is the hex representation of a captured ClientHello record
+	// to parrot instead. They are only used with TLSModeParrot, and at most one of
+	// them may be set: setting either with TLSModeDefault is an error. By default,
+	// we parrot the reference implementation.
+	ClientHelloID  string
+	ClientHelloHex string
+
+	// StrictOCC causes the handshake to fail when the options sent or pushed by the
+	// server are not compatible with ours. By default, we only log a warning.
+	StrictOCC bool
+
+	// TLSCryptV2 is the PEM-encoded tls-crypt-v2 client key, read either from
+	// the file passed to the tls-crypt-v2 option or from the inline block.
+	TLSCryptV2 []byte
+
+	// TLSAuth is the tls-auth static key, read either from the file passed to the
+	// tls-auth option or from the inline block. It is ignored with TLSCryptV2.
+	TLSAuth []byte
+
+	// KeyDirection is the tls-auth key direction.
+	KeyDirection KeyDirection
+
+	// Signer, when set, is used to perform the client signature during the TLS
+	// handshake instead of loading a private key from Key or KeyPath. This
+	// allows to keep the private key in a smartcard or HSM.
+	Signer crypto.Signer
+
+	// Credentials, when set, are the parsed client certificate, key and CA we use
+	// instead of loading the ones configured using cert, key and ca (or Signer).
+	// Set it to share the parsed credentials across tunnels.
+	Credentials *Credentials
+
+	// PersistKey is set by persist-key: we load the client certificate, key and CA only
+	// once, and reuse them for all the handshakes using these options. See [OpenVPNOptions.LoadCredentials].
+	PersistKey bool
+
+	// persistedCredentials are the credentials we have loaded with persist-key.
+	persistedCredentials *Credentials
+
+	// VerifyPeerCertificate, when set, replaces our verification of the server certificate,
+	// which checks the chain against the CA (or the peer fingerprints) without checking the
+	// name, allowing to implement custom pinning or policies. Like the homonymous field of
+	// [tls.Config], it receives the raw certificates sent by the server, leaf first; since we
+	// do not use the standard verification, verifiedChains is always nil. Returning an error
+	// fails the handshake.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+	// CredentialProvider, when set, is invoked each time we send the auth request
+	// to the server, and takes precedence over Username and Password.
+	CredentialProvider CredentialProvider
+
+	// UnknownDirectives are the directives in the config file that we do not know,
+	// and that we have ignored. Because this also includes valid directives that we
+	// do not implement, it may help spotting typos, like `ciper AES-256-GCM`.
+	UnknownDirectives []string
 }
 
 // ReadConfigFile expects a string with a path to a valid config file,
 // and returns a pointer to a Options struct after parsing the file, and an
-// error if the operation could not be completed.
+// error if the operation could not be completed. It is a wrapper around
+// [ParseConfig] using the directory of the config file as the base dir.
 func ReadConfigFile(filePath string) (*OpenVPNOptions, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer mustClose(f)
+	dir, _ := filepath.Split(filePath)
+	return ParseConfig(f, dir)
+}
+
+// ParseConfig reads a config from the given reader (e.g., embedded bytes, a network source,
+// or stdin) and returns the parsed options, or an error if the config is not valid. We resolve
+// the relative paths of the certificates and keys against baseDir, and we refuse the paths
+// outside of it. When baseDir is empty, we use the current directory. A config that only uses
+// inline blocks does not need a baseDir.
+func ParseConfig(r io.Reader, baseDir string) (*OpenVPNOptions, error) {
+	lines, err := getLinesFromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadConfig, err)
+	}
+	return getOptionsFromLines(lines, baseDir)
+}
+
+// ReadConfigFileStrict is like [ReadConfigFile], but it fails with [ErrUnknownDirective]
+// when the config file contains a directive we do not know, rather than ignoring it.
+func ReadConfigFileStrict(filePath string) (*OpenVPNOptions, error) {
 	lines, err := getLinesFromFile(filePath)
 	dir, _ := filepath.Split(filePath)
 	if err != nil {
 		return nil, err
 	}
-	return getOptionsFromLines(lines, dir)
+	return optionsFromLines(lines, dir, true)
+}
+
+// LocalAddr returns the local address, in the host:port format, to which we should bind
+// before dialing the remote, or an empty string if we do not need to bind.
+func (o *OpenVPNOptions) LocalAddr() string {
+	if o.NoBind || (o.LocalHost == "" && o.LocalPort == "") {
+		return ""
+	}
+	port := o.LocalPort
+	if port == "" {
+		port = "0"
+	}
+	return net.JoinHostPort(o.LocalHost, port)
+}
+
+// PluggableTransport returns the name of the pluggable transport we should use to reach the
+// remote and the URI configuring it, or empty strings when we should dial the remote directly.
+// The proxy-obfs4 directive is the same as proto-obfs4.
+func (o *OpenVPNOptions) PluggableTransport() (string, string) {
+	if o.Transport != "" {
+		return o.Transport, o.TransportURI
+	}
+	if o.ProxyOBFS4 != "" {
+		return "obfs4", o.ProxyOBFS4
+	}
+	return "", ""
+}
+
+// ShouldLoadCertsFromPath returns true when the options object is configured to load
+// certificates from paths; false when we have inline certificates. We do not need a CA
+// path when we pin the server certificate with peer-fingerprint.
+func (o *OpenVPNOptions) ShouldLoadCertsFromPath() bool {
+	hasCA := o.hasCAPath() || o.hasPeerFingerprints()
+	if o.Signer != nil {
+		return o.CertPath != "" && hasCA
+	}
+	return o.CertPath != "" && o.KeyPath != "" && hasCA
+}
+
+// hasPeerFingerprints returns true when we pin the server certificate, in which
+// case we verify it without a CA.
+func (o *OpenVPNOptions) hasPeerFingerprints() bool {
+	return len(o.PeerFingerprints) != 0
+}
+
+// hasCAPath returns true when we have at least a CA file or a CA directory.
+func (o *OpenVPNOptions) hasCAPath() bool {
+	return o.CAPath != "" || len(o.ExtraCAPaths) != 0 || o.CADir != ""
+}
+
+// HasAuthInfo returns true if:
+// - we have paths for cert, key and ca; or
+// - we have inline byte arrays for cert, key and ca; or
+// - we have a signer, and a cert and ca (either paths or inline); or
+// - we have username + password info; or
+// - we have a credential provider.
+// When we have peer-fingerprint, the ca is not needed.
+// TODO(ainghazal): add sanity checks for valid/existing credentials.
+func (o *OpenVPNOptions) HasAuthInfo() bool {
+	hasCAPath := o.hasCAPath() || o.hasPeerFingerprints()
+	hasCA := len(o.CA) != 0 || o.hasPeerFingerprints()
+	if o.CertPath != "" && o.KeyPath != "" && hasCAPath {
+		return true
+	}
+	if len(o.Cert) != 0 && len(o.Key) != 0 && hasCA {
+		return true
+	}
+	if o.Signer != nil && o.CertPath != "" && hasCAPath {
+		return true
+	}
+	if o.Signer != nil && len(o.Cert) != 0 && hasCA {
+		return true
+	}
+	if o.Username != "" && o.Password != "" {
+		return true
+	}
+	if o.CredentialProvider != nil {
+		return true
+	}
+	return false
+}
+
+// clientOptions is the options line we're passing to the OpenVPN server during the handshake.
+const clientOptions = "V4,dev-type tun,link-mtu %d,tun-mtu %d,proto %s%s,cipher %s,auth %s,keysize %s%s,key-method %d,tls-client"
+
+// Settings are the values we announce to the server, in the options string, for the settings
+// that do not come from the config directives. A zero field means using the default value.
+type Settings struct {
+	// LinkMTU is the announced link-mtu.
+	LinkMTU int
+
+	// TunMTU is the announced tun-mtu.
+	TunMTU int
+
+	// KeySize is the announced keysize, in bits. By default, we use the key size of the cipher.
+	KeySize int
+}
+
+// DefaultSettings returns the [Settings] we use by default, which match the reference
+// implementation. Each call returns a new value, so changing it affects no other tunnel.
+func DefaultSettings() Settings {
+	return Settings{
+		LinkMTU: 1549,
+		TunMTU:  1500,
+	}
+}
+
+// settings returns the settings to announce, where the zero fields of the configured
+// settings, if any, are replaced by the default values. When only the tun-mtu is set,
+// we keep the default overhead between the link-mtu and the tun-mtu.
+func (o *OpenVPNOptions) settings() Settings {
+	settings := DefaultSettings()
+	if o.Settings == nil {
+		return settings
+	}
+	if o.Settings.TunMTU > 0 {
+		settings.LinkMTU += o.Settings.TunMTU - settings.TunMTU
+		settings.TunMTU = o.Settings.TunMTU
+	}
+	if o.Settings.LinkMTU > 0 {
+		settings.LinkMTU = o.Settings.LinkMTU
+	}
+	if o.Settings.KeySize > 0 {
+		settings.KeySize = o.Settings.KeySize
+	}
+	return settings
+}
+
+// ServerOptionsString produces a comma-separated representation of the options, in the same
+// order and format that the OpenVPN server expects from us.
+func (o *OpenVPNOptions) ServerOptionsString() string {
+	return o.ServerOptionsStringForAddr(nil)
+}
+
+// ServerOptionsStringForAddr is like [OpenVPNOptions.ServerOptionsString], but announces the
+// address family of remote, the address we actually connected to, which matters when the remote
+// is a hostname. We ignore remote when it is not an IP address, or when we reach the server
+// through a pluggable transport, since then it is the address of the transport.
+func (o *OpenVPNOptions) ServerOptionsStringForAddr(remote net.Addr) string {
+	if o.Cipher == "" {
+		return ""
+	}
+	settings := o.settings()
+	keysize := ""
+	if dc, found := model.LookupDataCipher(o.Cipher); found {
+		keysize = strconv.Itoa(dc.KeyBits)
+	}
+	if settings.KeySize > 0 {
+		keysize = strconv.Itoa(settings.KeySize)
+	}
+	proto := strings.ToUpper(ProtoUDP.String())
+	// the pluggable transports carry a byte stream, so the server sees a TCP client
+	if name, _ := o.PluggableTransport(); o.Proto == ProtoTCP || name != "" {
+		proto = strings.ToUpper(ProtoTCP.String())
+	}
+	// the reference implementation announces the address family of the remote
+	family := "v4"
+	if ip := o.remoteIP(remote); ip != nil && ip.To4() == nil {
+		family = "v6"
+	}
+	keyMethod := 2
+	if o.KeyMethod == 1 {
+		keyMethod = 1
+	}
+	// like the reference implementation, we announce tls-auth before the key method
+	tlsAuth := ""
+	if len(o.TLSAuth) > 0 && len(o.TLSCryptV2) == 0 {
+		tlsAuth = ",tls-auth"
+	}
+	s := fmt.Sprintf(clientOptions, settings.LinkMTU, settings.TunMTU, proto, family, o.Cipher, o.Auth, keysize,
+		tlsAuth, keyMethod)
+	if o.Compress == CompressionStub {
+		s = s + ",compress stub"
+	} else if o.Compress == "lzo-no" {
+		s = s + ",lzo-comp no"
+	} else if o.Compress == CompressionLZOAdaptive {
+		s = s + ",comp-lzo"
+	} else if o.Compress == CompressionEmpty {
+		s = s + ",compress"
+	}
+	return s
+}
+
+// remoteIP returns the IP address of the remote whose family we announce.
+func (o *OpenVPNOptions) remoteIP(remote net.Addr) net.IP {
+	if name, _ := o.PluggableTransport(); name == "" {
+		switch addr := remote.(type) {
+		case *net.TCPAddr:
+			return addr.IP
+		case *net.UDPAddr:
+			return addr.IP
+		}
+	}
+	return net.ParseIP(o.dialHost())
+}
+
+func parseProto(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "proto needs one arg")
+	}
+	m := p[0]
+	switch m {
+	case ProtoUDP.String():
+		o.Proto = ProtoUDP
+	case ProtoTCP.String():
+		o.Proto = ProtoTCP
+	default:
+		return o, fmt.Errorf("%w: bad proto: %s", ErrBadConfig, m)
+
+	}
+	return o, nil
+}
+
+func parseRemote(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 2 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "remote needs two args")
+	}
+	host := p[0]
+	if strings.HasPrefix(host, "[") || strings.HasSuffix(host, "]") {
+		// a bracketed IPv6 literal: we store the bare address, so that joining it with
+		// the port using net.JoinHostPort produces a valid endpoint
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		ip := net.ParseIP(host)
+		if len(host) != len(p[0])-2 || ip == nil || ip.To4() != nil {
+			return o, fmt.Errorf("%w: invalid IPv6 remote: %s", ErrBadConfig, p[0])
+		}
+	}
+	o.Remote, o.Port = host, p[1]
+	return o, nil
+}
+
+func parseCipher(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "cipher expects one arg")
+	}
+	cipher := p[0]
+	if supported := supportedCiphers(); !hasElement(cipher, supported) {
+		return o, fmt.Errorf("%w: unsupported cipher: %s (try one of: %s)",
+			ErrBadConfig, cipher, strings.Join(supported, ", "))
+	}
+	o.Cipher = cipher
+	return o, nil
+}
+
+func parseDataCiphers(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "data-ciphers expects one arg")
+	}
+	supported := supportedCiphers()
+	ciphers := strings.Split(p[0], ":")
+	for idx, cipher := range ciphers {
+		// like the reference implementation, we match the cipher names ignoring case
+		canonical := slices.IndexFunc(supported, func(name string) bool {
+			return strings.EqualFold(name, cipher)
+		})
+		if canonical < 0 {
+			return o, fmt.Errorf("%w: unsupported data cipher: %s (try one of: %s)",
+				ErrBadConfig, cipher, strings.Join(supported, ", "))
+		}
+		ciphers[idx] = supported[canonical]
+	}
+	o.DataCiphers = ciphers
+	return o, nil
+}
+
+func parseDataCiphersFallback(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "data-ciphers-fallback expects one arg")
+	}
+	if supported := supportedCiphers(); !hasElement(p[0], supported) {
+		return o, fmt.Errorf("%w: unsupported fallback cipher: %s (try one of: %s)",
+			ErrBadConfig, p[0], strings.Join(supported, ", "))
+	}
+	o.DataCiphersFallback = p[0]
+	return o, nil
+}
+
+// ErrNoCommonCipher indicates that the cipher negotiation did not yield any cipher we accept.
+var ErrNoCommonCipher = errors.New("no common data channel cipher")
+
+// NegotiateCipher returns the data channel cipher to use given the cipher pushed by the
+// remote, if any, like the reference implementation does: we use the pushed cipher when we
+// accept it, and we fail with [ErrNoCommonCipher] otherwise. The fallback cipher is only
+// for remotes that do not push any cipher: when there is no fallback either, we return the
+// empty string, meaning that we use the configured cipher.
+func (o *OpenVPNOptions) NegotiateCipher(pushed string) (string, error) {
+	accepted := len(o.DataCiphers) == 0 || slices.ContainsFunc(o.DataCiphers, func(cipher string) bool {
+		return strings.EqualFold(cipher, pushed)
+	})
+	switch {
+	case pushed == "":
+		return o.DataCiphersFallback, nil
+	case accepted:
+		return pushed, nil
+	default:
+		return "", fmt.Errorf("%w: the remote pushed %s, but we accept %s",
+			ErrNoCommonCipher, pushed, strings.Join(o.DataCiphers, ":"))
+	}
+}
+
+func parseAuth(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "invalid auth entry")
+	}
+	auth := p[0]
+	if supported := supportedAuth(); !hasElement(auth, supported) {
+		return o, fmt.Errorf("%w: unsupported auth: %s (try one of: %s)",
+			ErrBadConfig, auth, strings.Join(supported, ", "))
+	}
+	o.Auth = auth
+	return o, nil
+}
+
+func parseKeyMethod(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "key-method expects one arg")
+	}
+	switch p[0] {
+	case "1":
+		o.KeyMethod = 1
+	case "2":
+		o.KeyMethod = 2
+	default:
+		return o, fmt.Errorf("%w: unsupported key-method: %s", ErrBadConfig, p[0])
+	}
+	return o, nil
+}
+
+// parseNonNegativeInt parses the single non-negative integer argument of the given option.
+func parseNonNegativeInt(name string, p []string) (int, error) {
+	if len(p) != 1 {
+		return 0, fmt.Errorf("%w: %s expects one arg", ErrBadConfig, name)
+	}
+	value, err := strconv.Atoi(p[0])
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%w: bad %s value: %s", ErrBadConfig, name, p[0])
+	}
+	return value, nil
+}
+
+func parseSndBuf(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	size, err := parseNonNegativeInt("sndbuf", p)
+	if err != nil {
+		return o, err
+	}
+	o.SndBuf = size
+	return o, nil
+}
+
+func parseRcvBuf(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	size, err := parseNonNegativeInt("rcvbuf", p)
+	if err != nil {
+		return o, err
+	}
+	o.RcvBuf = size
+	return o, nil
+}
+
+func parseLocal(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "local expects one arg")
+	}
+	o.LocalHost = p[0]
+	return o, nil
+}
+
+func parseLPort(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	port, err := parseNonNegativeInt("lport", p)
+	if err != nil {
+		return o, err
+	}
+	if port > 65535 {
+		return o, fmt.Errorf("%w: bad lport value: %s", ErrBadConfig, p[0])
+	}
+	o.LocalPort = p[0]
+	return o, nil
+}
+
+// dialHost returns the host we dial, which is RemoteIP when set and Remote otherwise.
+func (o *OpenVPNOptions) dialHost() string {
+	if o.RemoteIP != "" {
+		return o.RemoteIP
+	}
+	return o.Remote
+}
+
+// VerifyHostname returns the hostname we should use for the TLS SNI and for verifying
+// the server certificate, which is Remote when we dial RemoteIP instead, and the empty
+// string otherwise, since in general we do not know the name of a VPN gateway.
+func (o *OpenVPNOptions) VerifyHostname() string {
+	if o.RemoteIP == "" || net.ParseIP(o.Remote) != nil {
+		return ""
+	}
+	return o.Remote
+}
+
+func parseNoBind(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 0 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "nobind expects no args")
+	}
+	o.NoBind = true
+	return o, nil
+}
+
+func parseBindDev(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 || p[0] == "" {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "bind-dev expects one arg")
+	}
+	o.BindInterface = p[0]
+	return o, nil
+}
+
+func parsePersistKey(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 0 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "persist-key expects no args")
+	}
+	o.PersistKey = true
+	return o, nil
+}
+
+func parseFloat(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 0 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "float expects no args")
+	}
+	o.Float = true
+	return o, nil
+}
+
+func parseExplicitExitNotify(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) == 0 {
+		// like the reference implementation, the count defaults to one
+		o.ExplicitExitNotify = 1
+		return o, nil
+	}
+	count, err := parseNonNegativeInt("explicit-exit-notify", p)
+	if err != nil {
+		return o, err
+	}
+	o.ExplicitExitNotify = count
+	return o, nil
+}
+
+func parsePing(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	seconds, err := parseNonNegativeInt("ping", p)
+	if err != nil {
+		return o, err
+	}
+	o.Ping = seconds
+	return o, nil
+}
+
+// maxVerb is the maximum verbosity accepted by the reference implementation.
+const maxVerb = 11
+
+// PacketDumpsVerb is the verbosity from which we log the hex dumps of the packets.
+const PacketDumpsVerb = 9
+
+// VerbLogLevel maps the given verbosity to the level of the logger: verb 0 only emits
+// the warnings, verb 1 to 4 (the normal usage range) also emit the informational
+// messages, and verb 5 or more also emit the debug messages. The level is a tunnel.LogLevel.
+func VerbLogLevel(verb int) model.LogLevel {
+	switch {
+	case verb <= 0:
+		return model.LogLevelWarn
+	case verb <= 4:
+		return model.LogLevelInfo
+	default:
+		return model.LogLevelDebug
+	}
+}
+
+func parseVerb(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	verb, err := parseNonNegativeInt("verb", p)
+	if err != nil {
+		return o, err
+	}
+	if verb > maxVerb {
+		return o, fmt.Errorf("%w: verb: must be at most %d", ErrBadConfig, maxVerb)
+	}
+	o.Verb, o.VerbSet = verb, true
+	return o, nil
+}
+
+// minMTU is the minimum tun-mtu and link-mtu accepted by the reference implementation.
+const minMTU = 100
+
+// parseMTU parses the value of the tun-mtu or link-mtu directive with the given name.
+func parseMTU(name string, p []string) (int, error) {
+	mtu, err := parseNonNegativeInt(name, p)
+	if err != nil {
+		return 0, err
+	}
+	if mtu < minMTU {
+		return 0, fmt.Errorf("%w: %s: must be at least %d", ErrBadConfig, name, minMTU)
+	}
+	return mtu, nil
+}
+
+func parseTunMTU(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	mtu, err := parseMTU("tun-mtu", p)
+	if err != nil {
+		return o, err
+	}
+	if o.Settings == nil {
+		o.Settings = &Settings{}
+	}
+	o.Settings.TunMTU = mtu
+	return o, nil
+}
+
+func parseLinkMTU(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	mtu, err := parseMTU("link-mtu", p)
+	if err != nil {
+		return o, err
+	}
+	if o.Settings == nil {
+		o.Settings = &Settings{}
+	}
+	o.Settings.LinkMTU = mtu
+	return o, nil
+}
+
+func parsePingRestart(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	seconds, err := parseNonNegativeInt("ping-restart", p)
+	if err != nil {
+		return o, err
+	}
+	o.PingRestart = seconds
+	return o, nil
+}
+
+// parseStaticChallenge parses the static-challenge option, which has the
+// format `static-challenge "challenge text" echo`, where echo is 0 or 1.
+func parseStaticChallenge(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	e := fmt.Errorf("%w: %s", ErrBadConfig, "static-challenge expects a quoted text and 0 or 1")
+	// the line has been split on spaces, so we need to join the parts back
+	line := strings.Join(p, " ")
+	start, end := strings.Index(line, `"`), strings.LastIndex(line, `"`)
+	if start != 0 || end <= start {
+		return o, e
+	}
+	text := line[start+1 : end]
+	if text == "" {
+		return o, e
+	}
+	switch strings.TrimSpace(line[end+1:]) {
+	case "0":
+		o.StaticChallengeEcho = false
+	case "1":
+		o.StaticChallengeEcho = true
+	default:
+		return o, e
+	}
+	o.StaticChallenge = text
+	return o, nil
+}
+
+func parsePeerFingerprint(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	e := fmt.Errorf("%w: %s", ErrBadConfig, "peer-fingerprint expects a SHA-256 fingerprint")
+	if len(p) != 1 {
+		return o, e
+	}
+	raw, err := hex.DecodeString(strings.ReplaceAll(p[0], ":", ""))
+	if err != nil || len(raw) != sha256.Size {
+		return o, e
+	}
+	o.PeerFingerprints = append(o.PeerFingerprints, [32]byte(raw))
+	return o, nil
 }
 
-// ShouldLoadCertsFromPath returns true when the options object is configured to load
-// certificates from paths; false when we have inline certificates.
-func (o *OpenVPNOptions) ShouldLoadCertsFromPath() bool {
-	return o.CertPath != "" && o.KeyPath != "" && o.CAPath != ""
+// parseSetenv parses the setenv option, which has the format `setenv name value`. The
+// value may contain spaces and may be quoted. We ignore `setenv opt`, which the
+// reference implementation uses to mark the directive that follows as optional.
+func parseSetenv(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	return parseEnv("setenv", "", p, o)
 }
 
-// HasAuthInfo returns true if:
-// - we have paths for cert, key and ca; or
-// - we have inline byte arrays for cert, key and ca; or
-// - we have username + password info.
-// TODO(ainghazal): add sanity checks for valid/existing credentials.
-func (o *OpenVPNOptions) HasAuthInfo() bool {
-	if o.CertPath != "" && o.KeyPath != "" && o.CAPath != "" {
-		return true
+// parseSetenvSafe is like parseSetenv, but it prefixes the name with OPENVPN_.
+func parseSetenvSafe(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	return parseEnv("setenv-safe", "OPENVPN_", p, o)
+}
+
+func parseEnv(option, prefix string, p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) == 0 || p[0] == "" {
+		return o, fmt.Errorf("%w: %s expects a name and an optional value", ErrBadConfig, option)
 	}
-	if len(o.Cert) != 0 && len(o.Key) != 0 && len(o.CA) != 0 {
-		return true
+	if p[0] == "opt" && option == "setenv" {
+		return o, nil
 	}
-	if o.Username != "" && o.Password != "" {
-		return true
+	value := strings.Join(p[1:], " ")
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
 	}
-	return false
+	if o.Env == nil {
+		o.Env = make(map[string]string)
+	}
+	o.Env[prefix+p[0]] = value
+	return o, nil
 }
 
-// clientOptions is the options line we're passing to the OpenVPN server during the handshake.
-const clientOptions = "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto %sv4,cipher %s,auth %s,keysize %s,key-method 2,tls-client"
-
-// ServerOptionsString produces a comma-separated representation of the options, in the same
-// order and format that the OpenVPN server expects from us.
-func (o *OpenVPNOptions) ServerOptionsString() string {
-	if o.Cipher == "" {
-		return ""
+// parsePullFilter parses the pull-filter option, which has the format
+// `pull-filter accept|ignore|reject "text"`. The quotes are optional.
+func parsePullFilter(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	e := fmt.Errorf("%w: %s", ErrBadConfig, "pull-filter expects accept, ignore or reject and a text")
+	if len(p) < 2 {
+		return o, e
 	}
-	// TODO(ainghazal): this line of code crashes if the ciphers are not well formed
-	keysize := strings.Split(o.Cipher, "-")[1]
-	proto := strings.ToUpper(ProtoUDP.String())
-	if o.Proto == ProtoTCP {
-		proto = strings.ToUpper(ProtoTCP.String())
+	action := PullFilterAction(p[0])
+	switch action {
+	case PullFilterAccept, PullFilterIgnore, PullFilterReject:
+	default:
+		return o, e
 	}
-	s := fmt.Sprintf(clientOptions, proto, o.Cipher, o.Auth, keysize)
-	if o.Compress == CompressionStub {
-		s = s + ",compress stub"
-	} else if o.Compress == "lzo-no" {
-		s = s + ",lzo-comp no"
-	} else if o.Compress == CompressionEmpty {
-		s = s + ",compress"
+	// the line has been split on spaces, so we need to join the parts back
+	text := strings.Join(p[1:], " ")
+	if len(text) >= 2 && strings.HasPrefix(text, `"`) && strings.HasSuffix(text, `"`) {
+		text = text[1 : len(text)-1]
 	}
-	return s
+	if text == "" {
+		return o, e
+	}
+	o.PullFilters = append(o.PullFilters, PullFilter{Action: action, Text: text})
+	return o, nil
 }
 
-func parseProto(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
-	if len(p) != 1 {
-		return o, fmt.Errorf("%w: %s", ErrBadConfig, "proto needs one arg")
+func parseRouteNoPull(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 0 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "route-nopull expects no args")
 	}
-	m := p[0]
-	switch m {
-	case ProtoUDP.String():
-		o.Proto = ProtoUDP
-	case ProtoTCP.String():
-		o.Proto = ProtoTCP
-	default:
-		return o, fmt.Errorf("%w: bad proto: %s", ErrBadConfig, m)
+	o.RouteNoPull = true
+	return o, nil
+}
 
+func parseRedirectGateway(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	flags, err := model.ParseRedirectGatewayFlags(p)
+	if err != nil {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, err)
 	}
+	o.RedirectGateway = true
+	o.RedirectGatewayFlags = flags
 	return o, nil
 }
 
-func parseRemote(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
-	if len(p) != 2 {
-		return o, fmt.Errorf("%w: %s", ErrBadConfig, "remote needs two args")
+func parseBlockOutsideDNS(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 0 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "block-outside-dns expects no args")
 	}
-	o.Remote, o.Port = p[0], p[1]
+	o.BlockOutsideDNS = true
 	return o, nil
 }
 
-func parseCipher(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
-	if len(p) != 1 {
-		return o, fmt.Errorf("%w: %s", ErrBadConfig, "cipher expects one arg")
-	}
-	cipher := p[0]
-	if !hasElement(cipher, SupportedCiphers) {
-		return o, fmt.Errorf("%w: unsupported cipher: %s", ErrBadConfig, cipher)
+func parseAuthNoCache(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 0 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "auth-nocache expects no args")
 	}
-	o.Cipher = cipher
+	o.AuthNoCache = true
 	return o, nil
 }
 
-func parseAuth(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+// parseAuthRetry parses the auth-retry option.
+func parseAuthRetry(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
 	if len(p) != 1 {
-		return o, fmt.Errorf("%w: %s", ErrBadConfig, "invalid auth entry")
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "auth-retry expects none, nointeract or interact")
 	}
-	auth := p[0]
-	if !hasElement(auth, SupportedAuth) {
-		return o, fmt.Errorf("%w: unsupported auth: %s", ErrBadConfig, auth)
+	switch mode := AuthRetry(p[0]); mode {
+	case AuthRetryNone, AuthRetryNoInteract, AuthRetryInteract:
+		o.AuthRetry = mode
+		return o, nil
+	default:
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "auth-retry expects none, nointeract or interact")
 	}
-	o.Auth = auth
-	return o, nil
 }
 
 func parseCA(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, error) {
@@ -243,10 +1205,30 @@ func parseCA(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, er
 	if !existsFile(ca) {
 		return o, e
 	}
+	if o.CAPath != "" {
+		o.ExtraCAPaths = append(o.ExtraCAPaths, ca)
+		return o, nil
+	}
 	o.CAPath = ca
 	return o, nil
 }
 
+func parseCADir(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, error) {
+	e := fmt.Errorf("%w: %s", ErrBadConfig, "capath expects a valid directory")
+	if len(p) != 1 {
+		return o, e
+	}
+	dir := toAbs(p[0], basedir)
+	if sub, _ := isSubdir(basedir, dir); !sub {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "capath must be below config path")
+	}
+	if !existsDir(dir) {
+		return o, e
+	}
+	o.CADir = dir
+	return o, nil
+}
+
 func parseCert(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, error) {
 	e := fmt.Errorf("%w: %s", ErrBadConfig, "cert expects a valid file")
 	if len(p) != 1 {
@@ -279,11 +1261,48 @@ func parseKey(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, e
 	return o, nil
 }
 
+const (
+	// EnvUsername is the environment variable from which a bare auth-user-pass
+	// reads the username.
+	EnvUsername = "OPENVPN_USER"
+
+	// EnvPassword is the environment variable from which a bare auth-user-pass
+	// reads the password.
+	EnvPassword = "OPENVPN_PASS"
+)
+
+// credentialsFromEnv reads the credentials from the environment. It returns empty
+// credentials when neither variable is set, and an error when only one of them is set.
+func credentialsFromEnv() (string, string, error) {
+	username, password := os.Getenv(EnvUsername), os.Getenv(EnvPassword)
+	switch {
+	case username == "" && password == "":
+		return "", "", nil
+	case username == "":
+		return "", "", fmt.Errorf("%w: %s is not set", ErrBadConfig, EnvUsername)
+	case password == "":
+		return "", "", fmt.Errorf("%w: %s is not set", ErrBadConfig, EnvPassword)
+	default:
+		return username, password, nil
+	}
+}
+
 // parseAuthUser reads credentials from a given file, according to the openvpn
 // format (user and pass on a line each). To avoid path traversal / LFI, the
-// credentials file is expected to be in a subdirectory of the base dir.
+// credentials file is expected to be in a subdirectory of the base dir. When
+// no file is given, the credentials are read from the [EnvUsername] and [EnvPassword]
+// environment variables; when those are not set either, the caller must obtain the
+// credentials in a different way (e.g., from stdin) using a [CredentialProvider].
 func parseAuthUser(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, error) {
 	e := fmt.Errorf("%w: %s", ErrBadConfig, "auth-user-pass expects a valid file")
+	if len(p) == 0 {
+		username, password, err := credentialsFromEnv()
+		if err != nil {
+			return o, err
+		}
+		o.Username, o.Password = username, password
+		return o, nil
+	}
 	if len(p) != 1 {
 		return o, e
 	}
@@ -302,26 +1321,106 @@ func parseAuthUser(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptio
 	return o, nil
 }
 
+// parseTLSCryptV2 reads the tls-crypt-v2 client key from a given file. To avoid
+// path traversal / LFI, the key file is expected to be in a subdirectory of the base dir.
+func parseTLSCryptV2(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, error) {
+	e := fmt.Errorf("%w: %s", ErrBadConfig, "tls-crypt-v2 expects a valid file")
+	if len(p) != 1 {
+		return o, e
+	}
+	keyFile := toAbs(p[0], basedir)
+	if sub, _ := isSubdir(basedir, keyFile); !sub {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "tls-crypt-v2 must be below config path")
+	}
+	if !existsFile(keyFile) {
+		return o, e
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, err)
+	}
+	o.TLSCryptV2 = key
+	return o, nil
+}
+
+// parseTLSAuth reads the tls-auth static key from a given file, followed by an optional
+// key direction. To avoid path traversal, the file must be below the config path.
+func parseTLSAuth(p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, error) {
+	e := fmt.Errorf("%w: %s", ErrBadConfig, "tls-auth expects a valid file")
+	if len(p) != 1 && len(p) != 2 {
+		return o, e
+	}
+	if len(p) == 2 {
+		if _, err := parseKeyDirection(p[1:], o); err != nil {
+			return o, err
+		}
+	}
+	keyFile := toAbs(p[0], basedir)
+	if sub, _ := isSubdir(basedir, keyFile); !sub {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "tls-auth must be below config path")
+	}
+	if !existsFile(keyFile) {
+		return o, e
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, err)
+	}
+	o.TLSAuth = key
+	return o, nil
+}
+
+// parseKeyDirection parses the key-direction option, which applies to tls-auth.
+func parseKeyDirection(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "key-direction expects 0 or 1")
+	}
+	switch direction := KeyDirection(p[0]); direction {
+	case KeyDirectionNormal, KeyDirectionInverse:
+		o.KeyDirection = direction
+		return o, nil
+	default:
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "key-direction expects 0 or 1")
+	}
+}
+
 func parseCompress(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
 	if len(p) > 1 {
-		return o, fmt.Errorf("%w: %s", ErrBadConfig, "compress: only empty/stub options supported")
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "compress: only empty/stub/migrate options supported")
 	}
 	if len(p) == 0 {
 		o.Compress = CompressionEmpty
 		return o, nil
 	}
-	if p[0] == "stub" {
+	switch p[0] {
+	case "stub":
 		o.Compress = CompressionStub
 		return o, nil
+	case "migrate":
+		o.Compress = CompressionMigrate
+		return o, nil
 	}
-	return o, fmt.Errorf("%w: %s", ErrBadConfig, "compress: only empty/stub options supported")
+	return o, fmt.Errorf("%w: %s", ErrBadConfig, "compress: only empty/stub/migrate options supported")
 }
 
+// parseCompLZO parses the comp-lzo option. A bare comp-lzo means adaptive, like in the
+// reference implementation. We reject "comp-lzo yes", which would compress every packet.
 func parseCompLZO(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
-	if p[0] != "no" {
-		return o, fmt.Errorf("%w: %s", ErrBadConfig, "comp-lzo: compression not supported")
+	if len(p) > 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "comp-lzo: expects at most one arg")
+	}
+	if len(p) == 0 {
+		o.Compress = CompressionLZOAdaptive
+		return o, nil
+	}
+	switch p[0] {
+	case "no":
+		o.Compress = CompressionLZONo
+	case "adaptive":
+		o.Compress = CompressionLZOAdaptive
+	default:
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "comp-lzo: only the 'no' and 'adaptive' options are supported")
 	}
-	o.Compress = "lzo-no"
 	return o, nil
 }
 
@@ -338,6 +1437,66 @@ func parseTLSVerMax(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
 	return o, nil
 }
 
+// parseTLSCipher sets the TLS 1.2 cipher suites from a colon-separated list of
+// IANA names (e.g., TLS-ECDHE-RSA-WITH-AES-256-GCM-SHA384).
+func parseTLSCipher(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "tls-cipher expects a list of cipher suites")
+	}
+	suites, err := parseCipherSuiteList(p[0], false)
+	if err != nil {
+		return o, err
+	}
+	o.TLSCipher = suites
+	return o, nil
+}
+
+// parseTLSCiphersuites sets the TLS 1.3 cipher suites from a colon-separated list
+// of IANA names (e.g., TLS_AES_256_GCM_SHA384).
+func parseTLSCiphersuites(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "tls-ciphersuites expects a list of cipher suites")
+	}
+	suites, err := parseCipherSuiteList(p[0], true)
+	if err != nil {
+		return o, err
+	}
+	o.TLSCipherSuites = suites
+	return o, nil
+}
+
+// parseCipherSuiteList maps the colon-separated cipher suite names to their IDs. We
+// accept both the dash-separated names used by the reference implementation and the
+// underscore-separated IANA names, but only for the suites that are not insecure.
+func parseCipherSuiteList(list string, tls13 bool) ([]uint16, error) {
+	var suites []uint16
+	for _, name := range strings.Split(list, ":") {
+		normalized := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if !strings.HasPrefix(normalized, "TLS_") {
+			normalized = "TLS_" + normalized
+		}
+		id, ok := lookupCipherSuite(normalized, tls13)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown cipher suite: %s", ErrBadConfig, name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// lookupCipherSuite returns the ID of the secure cipher suite with the given IANA
+// name, if it is a TLS 1.3 suite when tls13 is true, or a TLS 1.2 one otherwise.
+func lookupCipherSuite(name string, tls13 bool) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name != name {
+			continue
+		}
+		isTLS13 := len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13
+		return cs.ID, isTLS13 == tls13
+	}
+	return 0, false
+}
+
 func parseProxyOBFS4(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
 	if len(p) != 1 {
 		return o, fmt.Errorf("%w: %s", ErrBadConfig, "proto-obfs4: need a properly configured proxy")
@@ -347,46 +1506,168 @@ func parseProxyOBFS4(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
 	return o, nil
 }
 
+// parseAllowCompression parses the allow-compression directive.
+func parseAllowCompression(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "allow-compression expects one arg")
+	}
+	switch policy := AllowCompression(p[0]); policy {
+	case AllowCompressionNo, AllowCompressionAsym, AllowCompressionYes:
+		o.AllowCompression = policy
+		return o, nil
+	default:
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "allow-compression expects no, asym or yes")
+	}
+}
+
+// parseCompNoAdapt parses the comp-noadapt directive, which disables the adaptive compression
+// of the packets we send. Since we never compress, we accept it without recording it.
+func parseCompNoAdapt(p []string, o *OpenVPNOptions) (*OpenVPNOptions, error) {
+	if len(p) != 0 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "comp-noadapt expects no args")
+	}
+	return o, nil
+}
+
+// CompressionAllowed returns whether we accept the compression pushed by the remote and the
+// compressed packets it sends, which is the case with allow-compression asym or yes. Regardless
+// of this setting, we never compress the packets we send, and we cannot decompress the packets
+// we receive, because we do not implement any compression algorithm.
+func (o *OpenVPNOptions) CompressionAllowed() bool {
+	return o.AllowCompression == AllowCompressionAsym || o.AllowCompression == AllowCompressionYes
+}
+
+// transportDirectivePrefix is the prefix of the directives selecting a pluggable transport.
+const transportDirectivePrefix = "proto-"
+
+// isTransportDirective returns true if the key is a proto-<name> directive selecting a
+// pluggable transport, rather than an OpenVPN directive sharing the same prefix.
+func isTransportDirective(key string) bool {
+	switch key {
+	case "proto-force":
+		return false
+	default:
+		return strings.HasPrefix(key, transportDirectivePrefix)
+	}
+}
+
+// parseTransport parses a proto-<name> directive selecting the named pluggable transport.
+// The transport resolves the relative paths in its URI against basedir.
+func parseTransport(name string, p []string, o *OpenVPNOptions, basedir string) (*OpenVPNOptions, error) {
+	if name == "" || len(p) != 1 {
+		return o, fmt.Errorf("%w: %s", ErrBadConfig, "proto-<transport>: need a transport name and uri")
+	}
+	o.Transport = name
+	o.TransportURI = p[0]
+	o.TransportBaseDir = basedir
+	return o, nil
+}
+
 var pMap = map[string]interface{}{
-	"proto":           parseProto,
-	"remote":          parseRemote,
-	"cipher":          parseCipher,
-	"auth":            parseAuth,
-	"compress":        parseCompress,
-	"comp-lzo":        parseCompLZO,
-	"proxy-obfs4":     parseProxyOBFS4,
-	"tls-version-max": parseTLSVerMax, // this is currently ignored because of uTLS
+	"proto":                 parseProto,
+	"remote":                parseRemote,
+	"cipher":                parseCipher,
+	"auth":                  parseAuth,
+	"compress":              parseCompress,
+	"comp-lzo":              parseCompLZO,
+	"comp-noadapt":          parseCompNoAdapt,
+	"allow-compression":     parseAllowCompression,
+	"persist-key":           parsePersistKey,
+	"proxy-obfs4":           parseProxyOBFS4,
+	"tls-version-max":       parseTLSVerMax, // this is currently ignored because of uTLS
+	"tls-cipher":            parseTLSCipher,
+	"tls-ciphersuites":      parseTLSCiphersuites,
+	"key-method":            parseKeyMethod,
+	"sndbuf":                parseSndBuf,
+	"rcvbuf":                parseRcvBuf,
+	"auth-nocache":          parseAuthNoCache,
+	"auth-retry":            parseAuthRetry,
+	"static-challenge":      parseStaticChallenge,
+	"peer-fingerprint":      parsePeerFingerprint,
+	"ping":                  parsePing,
+	"explicit-exit-notify":  parseExplicitExitNotify,
+	"ping-restart":          parsePingRestart,
+	"verb":                  parseVerb,
+	"tun-mtu":               parseTunMTU,
+	"link-mtu":              parseLinkMTU,
+	"setenv":                parseSetenv,
+	"setenv-safe":           parseSetenvSafe,
+	"pull-filter":           parsePullFilter,
+	"route-nopull":          parseRouteNoPull,
+	"local":                 parseLocal,
+	"lport":                 parseLPort,
+	"nobind":                parseNoBind,
+	"bind-dev":              parseBindDev,
+	"float":                 parseFloat,
+	"redirect-gateway":      parseRedirectGateway,
+	"data-ciphers":          parseDataCiphers,
+	"data-ciphers-fallback": parseDataCiphersFallback,
+	"block-outside-dns":     parseBlockOutsideDNS,
+	"key-direction":         parseKeyDirection,
 }
 
 var pMapDir = map[string]interface{}{
 	"ca":             parseCA,
+	"capath":         parseCADir,
 	"cert":           parseCert,
 	"key":            parseKey,
 	"auth-user-pass": parseAuthUser,
+	"tls-crypt-v2":   parseTLSCryptV2,
+	"tls-auth":       parseTLSAuth,
 }
 
 func parseOption(opt *OpenVPNOptions, dir, key string, p []string, lineno int) (*OpenVPNOptions, error) {
 	switch key {
-	case "proto", "remote", "cipher", "auth", "compress", "comp-lzo", "tls-version-max", "proxy-obfs4":
+	case "proto", "remote", "cipher", "auth", "compress", "comp-lzo", "tls-version-max", "proxy-obfs4",
+		"key-method", "sndbuf", "rcvbuf", "auth-nocache", "ping", "ping-restart", "static-challenge",
+		"peer-fingerprint", "tls-cipher", "tls-ciphersuites", "setenv", "setenv-safe",
+		"pull-filter", "route-nopull", "local", "lport", "nobind", "bind-dev", "verb",
+		"tun-mtu", "link-mtu", "key-direction", "auth-retry", "float", "redirect-gateway",
+		"block-outside-dns", "data-ciphers", "data-ciphers-fallback", "comp-noadapt", "allow-compression",
+		"persist-key", "explicit-exit-notify":
 		fn := pMap[key].(func([]string, *OpenVPNOptions) (*OpenVPNOptions, error))
 		if updatedOpt, e := fn(p, opt); e != nil {
 			return updatedOpt, e
 		}
-	case "ca", "cert", "key", "auth-user-pass":
+	case "ca", "capath", "cert", "key", "auth-user-pass", "tls-crypt-v2", "tls-auth":
 		fn := pMapDir[key].(func([]string, *OpenVPNOptions, string) (*OpenVPNOptions, error))
 		if updatedOpt, e := fn(p, opt, dir); e != nil {
 			return updatedOpt, e
 		}
 	default:
-		log.Printf("warn: unsupported key in line %d\n", lineno)
+		if isTransportDirective(key) {
+			name := strings.TrimPrefix(key, transportDirectivePrefix)
+			return parseTransport(name, p, opt, dir)
+		}
+		log.Printf("warn: unsupported key %q in line %d\n", key, lineno+1)
+		opt.UnknownDirectives = append(opt.UnknownDirectives, key)
 	}
 	return opt, nil
 }
 
 // getOptionsFromLines tries to parse all the lines coming from a config file
 // and raises validation errors if the values do not conform to the expected
-// format. The config file supports inline file inclusion for <ca>, <cert> and <key>.
+// format. The config file supports inline file inclusion for <ca>, <cert>, <key>,
+// <tls-crypt-v2> and <tls-auth>.
 func getOptionsFromLines(lines []string, dir string) (*OpenVPNOptions, error) {
+	return optionsFromLines(lines, dir, false)
+}
+
+// optionsFromLines implements getOptionsFromLines. When strict is true, unknown
+// directives cause an error rather than being collected into UnknownDirectives.
+func optionsFromLines(lines []string, dir string, strict bool) (*OpenVPNOptions, error) {
+	opt, problems := parseLines(lines, dir, false, strict)
+	if len(problems) != 0 {
+		// the problem tells the line number and the directive that failed
+		return nil, problems[0]
+	}
+	return opt, nil
+}
+
+// parseLines implements getOptionsFromLines. It returns the parsed options and the
+// problems it found: when keepGoing is false, it stops at the first problem. Unknown
+// directives are problems only when strict is true.
+func parseLines(lines []string, dir string, keepGoing, strict bool) (*OpenVPNOptions, []Problem) {
 	opt := &OpenVPNOptions{
 		Remote:     "",
 		Port:       "",
@@ -406,43 +1687,32 @@ func getOptionsFromLines(lines []string, dir string) (*OpenVPNOptions, error) {
 		ProxyOBFS4: "",
 	}
 
-	// tag and inlineBuf are used to parse inline files.
-	// these follow the format used by the reference openvpn implementation.
-	// each block (any of ca, key, cert) is marked by a <option> line, and
-	// closed by a </option> line; lines in between are expected to contain
-	// the crypto block.
-	tag := ""
-	inlineBuf := new(bytes.Buffer)
+	var problems []Problem
+	inline := newInlineScanner()
 
 	for lineno, l := range lines {
-		if strings.HasPrefix(l, "#") {
+		if strings.HasPrefix(l, "#") || strings.HasPrefix(l, ";") {
 			continue
 		}
 		l = strings.TrimSpace(l)
-
-		// inline certs
-		if isClosingTag(l) {
-			// we expect an already existing inlineBuf
-			e := parseInlineTag(opt, tag, inlineBuf)
-			if e != nil {
-				return nil, e
-			}
-			tag = ""
-			inlineBuf = new(bytes.Buffer)
+		if l == "" {
 			continue
 		}
-		if tag != "" {
-			inlineBuf.Write([]byte(l))
-			inlineBuf.Write([]byte("\n"))
-			continue
+
+		// inline certs
+		consumed, block, err := inline.scan(l, lineno)
+		if err != nil {
+			return opt, append(problems, Problem{Line: lineno + 1, Directive: l, Err: err})
 		}
-		if isOpeningTag(l) {
-			if len(inlineBuf.Bytes()) != 0 {
-				// something wrong: an opening tag should not be found
-				// when we still have bytes in the inline buffer.
-				return opt, fmt.Errorf("%w: %s", ErrBadConfig, "tag not closed")
+		if block != nil {
+			if e := parseInlineTag(opt, block.tag, block.content); e != nil {
+				problems = append(problems, Problem{Line: lineno + 1, Directive: l, Err: e})
+				if !keepGoing {
+					return nil, problems
+				}
 			}
-			tag = parseTag(l)
+		}
+		if consumed {
 			continue
 		}
 
@@ -460,18 +1730,172 @@ func getOptionsFromLines(lines []string, dir string) (*OpenVPNOptions, error) {
 		} else {
 			key, parts = p[0], p[1:]
 		}
-		var err error
-		opt, err = parseOption(opt, dir, key, parts, lineno)
+		if strict && !isKnownDirective(key) {
+			e := fmt.Errorf("%w: %w: %s", ErrBadConfig, ErrUnknownDirective, key)
+			problems = append(problems, Problem{Line: lineno + 1, Directive: l, Err: e})
+			if !keepGoing {
+				return nil, problems
+			}
+			continue
+		}
+		updated, err := parseOption(opt, dir, key, parts, lineno)
 		if err != nil {
-			return nil, err
+			problems = append(problems, Problem{Line: lineno + 1, Directive: l, Err: err})
+			if !keepGoing {
+				return nil, problems
+			}
+		}
+		if updated != nil {
+			opt = updated
 		}
 	}
-	return opt, nil
+	if problem := inline.unclosed(); problem != nil {
+		problems = append(problems, *problem)
+	}
+	if err := checkKeyMethod(opt); err != nil {
+		problems = append(problems, Problem{Err: err})
+	}
+	return opt, problems
+}
+
+// checkKeyMethod returns an error if the cipher cannot work with the key method: like in
+// the reference implementation, key-method 1 does not support the AEAD ciphers, since it
+// only exchanges the cipher and hmac keys.
+func checkKeyMethod(o *OpenVPNOptions) error {
+	if o.KeyMethod != 1 {
+		return nil
+	}
+	if dc, found := model.LookupDataCipher(o.Cipher); found && dc.Mode == "gcm" {
+		return fmt.Errorf("%w: key-method 1 does not support the AEAD cipher %s", ErrBadConfig, o.Cipher)
+	}
+	return nil
+}
+
+// ParseInlineBlocks returns the content of the inline blocks (e.g., <ca>, <cert>, <key>,
+// <tls-auth> and <tls-crypt-v2>) of the given config, indexed by tag name (e.g., "ca"),
+// without parsing the directives. Like when parsing the config, we concatenate the
+// content of repeated ca blocks, and we keep the last one of the other blocks. It
+// returns a [Problem] wrapping [ErrBadConfig] if a block is empty or not closed.
+func ParseInlineBlocks(config string) (map[string][]byte, error) {
+	blocks := make(map[string][]byte)
+	inline := newInlineScanner()
+	for lineno, l := range strings.Split(config, "\n") {
+		if strings.HasPrefix(l, "#") || strings.HasPrefix(l, ";") {
+			continue
+		}
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		_, block, err := inline.scan(l, lineno)
+		if err == nil && block != nil {
+			err = block.validate()
+		}
+		if err != nil {
+			return nil, Problem{Line: lineno + 1, Directive: l, Err: err}
+		}
+		if block == nil {
+			continue
+		}
+		if block.tag == "ca" {
+			blocks[block.tag] = append(blocks[block.tag], block.content...)
+		} else {
+			blocks[block.tag] = block.content
+		}
+	}
+	if problem := inline.unclosed(); problem != nil {
+		return nil, *problem
+	}
+	return blocks, nil
+}
+
+// inlineScanner finds the inline blocks of a config file. These follow the format used
+// by the reference openvpn implementation: each block (any of ca, key, cert, tls-auth,
+// tls-crypt-v2) is marked by a <option> line, and closed by a </option> line; lines in
+// between are expected to contain the crypto block.
+type inlineScanner struct {
+	// tag is the name of the block we're reading, if any.
+	tag string
+
+	// lineno is the zero-based number of the line opening the block.
+	lineno int
+
+	// buf contains the lines of the block we've read so far.
+	buf *bytes.Buffer
+}
+
+// newInlineScanner returns a new inlineScanner.
+func newInlineScanner() *inlineScanner {
+	return &inlineScanner{buf: new(bytes.Buffer)}
+}
+
+// inlineBlock is an inline block found by the inlineScanner.
+type inlineBlock struct {
+	tag     string
+	content []byte
+}
+
+// validate returns an error if the block is empty or has an unknown tag.
+func (b *inlineBlock) validate() error {
+	if len(b.content) == 0 {
+		return fmt.Errorf("%w: empty inline tag: %d", ErrBadConfig, len(b.content))
+	}
+	if b.tag == "" {
+		return fmt.Errorf("%w: unknown tag: %s", ErrBadConfig, b.tag)
+	}
+	return nil
+}
+
+// scan processes the next trimmed, non-empty line of the config, whose zero-based number
+// is lineno. It returns whether the line
+// belongs to an inline block, and the block the line closes, if any. It returns an error if
+// the line opens a block before the previous one is closed.
+func (s *inlineScanner) scan(l string, lineno int) (bool, *inlineBlock, error) {
+	if isClosingTag(l) {
+		block := &inlineBlock{tag: s.tag, content: s.buf.Bytes()}
+		s.tag = ""
+		s.buf = new(bytes.Buffer)
+		return true, block, nil
+	}
+	if s.tag != "" {
+		s.buf.WriteString(l)
+		s.buf.WriteString("\n")
+		return true, nil, nil
+	}
+	if isOpeningTag(l) {
+		if s.buf.Len() != 0 {
+			// something wrong: an opening tag should not be found
+			// when we still have bytes in the inline buffer.
+			return true, nil, fmt.Errorf("%w: %s", ErrBadConfig, "tag not closed")
+		}
+		s.tag = parseTag(l)
+		s.lineno = lineno
+		return true, nil, nil
+	}
+	return false, nil, nil
+}
+
+// unclosed returns a problem if the last block is not closed.
+func (s *inlineScanner) unclosed() *Problem {
+	if s.tag == "" {
+		return nil
+	}
+	e := fmt.Errorf("%w: %s", ErrBadConfig, "tag not closed")
+	return &Problem{Line: s.lineno + 1, Directive: "<" + s.tag + ">", Err: e}
+}
+
+// isKnownDirective returns true if parseOption knows how to parse the given key.
+func isKnownDirective(key string) bool {
+	_, found := pMap[key]
+	if !found {
+		_, found = pMapDir[key]
+	}
+	return found || isTransportDirective(key)
 }
 
 func isOpeningTag(key string) bool {
 	switch key {
-	case "<ca>", "<cert>", "<key>":
+	case "<ca>", "<cert>", "<key>", "<tls-crypt-v2>", "<tls-auth>":
 		return true
 	default:
 		return false
@@ -480,7 +1904,7 @@ func isOpeningTag(key string) bool {
 
 func isClosingTag(key string) bool {
 	switch key {
-	case "</ca>", "</cert>", "</key>":
+	case "</ca>", "</cert>", "</key>", "</tls-crypt-v2>", "</tls-auth>":
 		return true
 	default:
 		return false
@@ -495,24 +1919,32 @@ func parseTag(tag string) string {
 		return "cert"
 	case "<key>", "</key>":
 		return "key"
+	case "<tls-crypt-v2>", "</tls-crypt-v2>":
+		return "tls-crypt-v2"
+	case "<tls-auth>", "</tls-auth>":
+		return "tls-auth"
 	default:
 		return ""
 	}
 }
 
-// parseInlineTag
-func parseInlineTag(o *OpenVPNOptions, tag string, buf *bytes.Buffer) error {
-	b := buf.Bytes()
+// parseInlineTag sets the option corresponding to the given tag to the given block content.
+func parseInlineTag(o *OpenVPNOptions, tag string, b []byte) error {
 	if len(b) == 0 {
 		return fmt.Errorf("%w: empty inline tag: %d", ErrBadConfig, len(b))
 	}
 	switch tag {
 	case "ca":
-		o.CA = b
+		// several ca blocks are appended into a single PEM bundle
+		o.CA = append(o.CA, b...)
 	case "cert":
 		o.Cert = b
 	case "key":
 		o.Key = b
+	case "tls-crypt-v2":
+		o.TLSCryptV2 = b
+	case "tls-auth":
+		o.TLSAuth = b
 	default:
 		return fmt.Errorf("%w: unknown tag: %s", ErrBadConfig, tag)
 	}
@@ -537,6 +1969,11 @@ func existsFile(path string) bool {
 	return !errors.Is(err, os.ErrNotExist) && statbuf.Mode().IsRegular()
 }
 
+func existsDir(path string) bool {
+	statbuf, err := os.Stat(path)
+	return err == nil && statbuf.IsDir()
+}
+
 func mustClose(c io.Closer) {
 	err := c.Close()
 	runtimex.PanicOnError(err, "could not close")
@@ -550,14 +1987,17 @@ func getLinesFromFile(path string) ([]string, error) {
 		return nil, err
 	}
 	defer mustClose(f)
+	return getLinesFromReader(f)
+}
 
+// getLinesFromReader returns the lines read from the given reader.
+func getLinesFromReader(r io.Reader) ([]string, error) {
 	lines := make([]string, 0)
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
-	err = scanner.Err()
-	if err != nil {
+	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 	return lines, nil
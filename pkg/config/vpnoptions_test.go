@@ -1,11 +1,21 @@
 package config
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/tls"
 	"errors"
+	"io"
+	"net"
 	"os"
 	fp "path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/ooni/minivpn/internal/model"
 )
 
 func writeDummyCertFiles(d string) {
@@ -27,6 +37,7 @@ func TestOptions_String(t *testing.T) {
 		Cipher    string
 		Auth      string
 		TLSMaxVer string
+		KeyMethod int
 
 		Compress   Compression
 		ProxyOBFS4 string
@@ -70,6 +81,37 @@ func TestOptions_String(t *testing.T) {
 			},
 			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-128-GCM,auth sha512,keysize 128,key-method 2,tls-client,lzo-comp no",
 		},
+		{
+			name: "compress lzo-adaptive",
+			fields: fields{
+				Cipher:   "AES-128-GCM",
+				Auth:     "sha512",
+				Proto:    ProtoUDP,
+				Compress: CompressionLZOAdaptive,
+			},
+			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-128-GCM,auth sha512,keysize 128,key-method 2,tls-client,comp-lzo",
+		},
+		{
+			name: "key-method 1",
+			fields: fields{
+				Cipher:    "AES-128-CBC",
+				Auth:      "sha1",
+				Proto:     ProtoTCP,
+				KeyMethod: 1,
+			},
+			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto TCPv4,cipher AES-128-CBC,auth sha1,keysize 128,key-method 1,tls-client",
+		},
+		{
+			name: "proto udp over a pluggable transport",
+			fields: fields{
+				Cipher:     "AES-128-GCM",
+				Auth:       "sha512",
+				Proto:      ProtoUDP,
+				Compress:   CompressionStub,
+				ProxyOBFS4: "obfs4://10.0.0.1:443",
+			},
+			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto TCPv4,cipher AES-128-GCM,auth sha512,keysize 128,key-method 2,tls-client,compress stub",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -86,6 +128,7 @@ func TestOptions_String(t *testing.T) {
 				Cipher:     tt.fields.Cipher,
 				Auth:       tt.fields.Auth,
 				TLSMaxVer:  tt.fields.TLSMaxVer,
+				KeyMethod:  tt.fields.KeyMethod,
 				ProxyOBFS4: tt.fields.ProxyOBFS4,
 			}
 			if got := o.ServerOptionsString(); got != tt.want {
@@ -95,6 +138,161 @@ func TestOptions_String(t *testing.T) {
 	}
 }
 
+func TestOptions_Settings(t *testing.T) {
+	base := OpenVPNOptions{Cipher: "AES-256-GCM", Auth: "SHA512", Proto: ProtoUDP}
+	first, second := base, base
+
+	// changing the settings of a tunnel, or the default settings we obtained, must
+	// not affect the other tunnels
+	first.Settings = &Settings{LinkMTU: 1600, KeySize: 192}
+	defaults := DefaultSettings()
+	defaults.TunMTU = 1400
+
+	want := "V4,dev-type tun,link-mtu 1600,tun-mtu 1500,proto UDPv4,cipher AES-256-GCM,auth SHA512,keysize 192,key-method 2,tls-client"
+	if got := first.ServerOptionsString(); got != want {
+		t.Errorf("first.ServerOptionsString() = %v, want %v", got, want)
+	}
+	want = "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-256-GCM,auth SHA512,keysize 256,key-method 2,tls-client"
+	if got := second.ServerOptionsString(); got != want {
+		t.Errorf("second.ServerOptionsString() = %v, want %v", got, want)
+	}
+	if DefaultSettings() != (Settings{LinkMTU: 1549, TunMTU: 1500}) {
+		t.Errorf("DefaultSettings() = %+v, which we changed", DefaultSettings())
+	}
+}
+
+func TestOptions_StringMTUAndProto(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "defaults",
+			lines: []string{"remote 10.0.0.1 1194", "proto udp"},
+			want:  "link-mtu 1549,tun-mtu 1500,proto UDPv4,",
+		},
+		{
+			name:  "tun-mtu keeps the default overhead",
+			lines: []string{"remote 10.0.0.1 1194", "proto tcp", "tun-mtu 1400"},
+			want:  "link-mtu 1449,tun-mtu 1400,proto TCPv4,",
+		},
+		{
+			name:  "link-mtu and tun-mtu",
+			lines: []string{"remote 10.0.0.1 1194", "tun-mtu 1300", "link-mtu 1500"},
+			want:  "link-mtu 1500,tun-mtu 1300,proto TCPv4,",
+		},
+		{
+			name:  "ipv6 remote",
+			lines: []string{"remote [2001:db8::1] 1194", "proto udp"},
+			want:  "link-mtu 1549,tun-mtu 1500,proto UDPv6,",
+		},
+		{
+			name:    "tun-mtu too small",
+			lines:   []string{"tun-mtu 42"},
+			wantErr: ErrBadConfig,
+		},
+		{
+			name:    "link-mtu not a number",
+			lines:   []string{"link-mtu large"},
+			wantErr: ErrBadConfig,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := getOptionsFromLines(append(tt.lines, "cipher AES-256-GCM", "auth SHA512"), "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("getOptionsFromLines() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := o.ServerOptionsString(); !strings.Contains(got, tt.want) {
+				t.Errorf("ServerOptionsString() = %v, want it to contain %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptions_StringRegisteredCipher(t *testing.T) {
+	// test that we take the key size from the registry, so any cipher name works
+	if err := RegisterDataCipher("MYCIPHER", 192, DataCipherModeGCM, aes.NewCipher); err != nil {
+		t.Fatalf("RegisterDataCipher() error = %v", err)
+	}
+	t.Cleanup(func() { UnregisterDataCipher("MYCIPHER") })
+	o, err := getOptionsFromLines([]string{"cipher MYCIPHER", "auth SHA512"}, "")
+	if err != nil {
+		t.Fatalf("getOptionsFromLines() error = %v", err)
+	}
+	if got := o.ServerOptionsString(); !strings.Contains(got, ",cipher MYCIPHER,auth SHA512,keysize 192,") {
+		t.Errorf("ServerOptionsString() = %v", got)
+	}
+}
+
+func TestOptions_ServerOptionsStringForAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		remote net.Addr
+		want   string
+	}{
+		{
+			name:   "a hostname dialed over ipv6",
+			lines:  []string{"remote vpn.example.com 1194", "proto udp"},
+			remote: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1194},
+			want:   "proto UDPv6,",
+		},
+		{
+			name:   "a hostname dialed over ipv4",
+			lines:  []string{"remote vpn.example.com 1194", "proto tcp"},
+			remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1194},
+			want:   "proto TCPv4,",
+		},
+		{
+			name:  "a nil address uses the remote",
+			lines: []string{"remote [2001:db8::1] 1194", "proto udp"},
+			want:  "proto UDPv6,",
+		},
+		{
+			name:   "an address that is not an ip uses the remote",
+			lines:  []string{"remote 10.0.0.1 1194", "proto udp"},
+			remote: &net.UnixAddr{Name: "/tmp/vpn.sock", Net: "unix"},
+			want:   "proto UDPv4,",
+		},
+		{
+			name:   "the address of a pluggable transport is ignored",
+			lines:  []string{"remote 10.0.0.1 1194", "proto tcp", "proxy-obfs4 obfs4://192.0.2.1:443"},
+			remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			want:   "proto TCPv4,",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := getOptionsFromLines(append(tt.lines, "cipher AES-256-GCM", "auth SHA512"), "")
+			if err != nil {
+				t.Fatalf("getOptionsFromLines() error = %v", err)
+			}
+			if got := o.ServerOptionsStringForAddr(tt.remote); !strings.Contains(got, tt.want) {
+				t.Errorf("ServerOptionsStringForAddr() = %v, want it to contain %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseMTU(t *testing.T) {
+	// test that a failed parse does not allocate the settings
+	for _, parse := range []func([]string, *OpenVPNOptions) (*OpenVPNOptions, error){parseTunMTU, parseLinkMTU} {
+		o := &OpenVPNOptions{}
+		if _, err := parse([]string{"42"}, o); !errors.Is(err, ErrBadConfig) {
+			t.Fatalf("expected ErrBadConfig, got %v", err)
+		}
+		if o.Settings != nil {
+			t.Errorf("expected nil settings, got %+v", o.Settings)
+		}
+	}
+}
+
 func TestGetOptionsFromLines(t *testing.T) {
 	t.Run("valid options return a valid option object", func(t *testing.T) {
 		d := t.TempDir()
@@ -152,6 +350,382 @@ func TestGetOptionsFromLinesInlineCerts(t *testing.T) {
 	})
 }
 
+func TestGetOptionsFromLinesInlineTLSCryptV2(t *testing.T) {
+	t.Run("inline tls-crypt-v2 key is correctly parsed", func(t *testing.T) {
+		l := []string{
+			"<tls-crypt-v2>",
+			"-----BEGIN OpenVPN tls-crypt-v2 client key-----",
+			"deadbeef",
+			"-----END OpenVPN tls-crypt-v2 client key-----",
+			"</tls-crypt-v2>",
+		}
+		o, err := getOptionsFromLines(l, "")
+		if err != nil {
+			t.Errorf("Good options should not fail: %s", err)
+		}
+		want := "-----BEGIN OpenVPN tls-crypt-v2 client key-----\ndeadbeef\n-----END OpenVPN tls-crypt-v2 client key-----\n"
+		if string(o.TLSCryptV2) != want {
+			t.Errorf("Expected %s, got: %s.", want, string(o.TLSCryptV2))
+		}
+	})
+}
+
+func Test_parseTLSCryptV2(t *testing.T) {
+	t.Run("the key file is read", func(t *testing.T) {
+		d := t.TempDir()
+		os.WriteFile(fp.Join(d, "client.key"), []byte("dummy"), 0600)
+		o, err := parseTLSCryptV2([]string{"client.key"}, &OpenVPNOptions{}, d)
+		if err != nil {
+			t.Fatalf("parseTLSCryptV2(): unexpected error %v", err)
+		}
+		if string(o.TLSCryptV2) != "dummy" {
+			t.Errorf("parseTLSCryptV2(): got %s", string(o.TLSCryptV2))
+		}
+	})
+
+	t.Run("empty parts should fail", func(t *testing.T) {
+		_, err := parseTLSCryptV2([]string{}, &OpenVPNOptions{}, "")
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseTLSCryptV2(): want %v, got %v", ErrBadConfig, err)
+		}
+	})
+
+	t.Run("non-existent key file path should fail", func(t *testing.T) {
+		d := t.TempDir()
+		_, err := parseTLSCryptV2([]string{"nonexistent"}, &OpenVPNOptions{}, d)
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseTLSCryptV2(): want %v, got %v", ErrBadConfig, err)
+		}
+	})
+
+	t.Run("key file outside the config dir should fail", func(t *testing.T) {
+		d := t.TempDir()
+		_, err := parseTLSCryptV2([]string{"/etc/passwd"}, &OpenVPNOptions{}, d)
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseTLSCryptV2(): want %v, got %v", ErrBadConfig, err)
+		}
+	})
+}
+
+func Test_parseTLSAuth(t *testing.T) {
+	t.Run("the key file and the direction are read", func(t *testing.T) {
+		d := t.TempDir()
+		os.WriteFile(fp.Join(d, "ta.key"), []byte("dummy"), 0600)
+		o, err := parseTLSAuth([]string{"ta.key", "1"}, &OpenVPNOptions{}, d)
+		if err != nil {
+			t.Fatalf("parseTLSAuth(): unexpected error %v", err)
+		}
+		if string(o.TLSAuth) != "dummy" {
+			t.Errorf("parseTLSAuth(): got %s", string(o.TLSAuth))
+		}
+		if o.KeyDirection != KeyDirectionInverse {
+			t.Errorf("parseTLSAuth(): got direction %q", o.KeyDirection)
+		}
+	})
+
+	t.Run("without a direction the key is bidirectional", func(t *testing.T) {
+		d := t.TempDir()
+		os.WriteFile(fp.Join(d, "ta.key"), []byte("dummy"), 0600)
+		o, err := parseTLSAuth([]string{"ta.key"}, &OpenVPNOptions{}, d)
+		if err != nil {
+			t.Fatalf("parseTLSAuth(): unexpected error %v", err)
+		}
+		if o.KeyDirection != KeyDirectionBidirectional {
+			t.Errorf("parseTLSAuth(): got direction %q", o.KeyDirection)
+		}
+	})
+
+	t.Run("a bad direction should fail", func(t *testing.T) {
+		d := t.TempDir()
+		os.WriteFile(fp.Join(d, "ta.key"), []byte("dummy"), 0600)
+		_, err := parseTLSAuth([]string{"ta.key", "2"}, &OpenVPNOptions{}, d)
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseTLSAuth(): want %v, got %v", ErrBadConfig, err)
+		}
+	})
+
+	t.Run("key file outside the config dir should fail", func(t *testing.T) {
+		d := t.TempDir()
+		_, err := parseTLSAuth([]string{"/etc/passwd"}, &OpenVPNOptions{}, d)
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseTLSAuth(): want %v, got %v", ErrBadConfig, err)
+		}
+	})
+}
+
+func Test_parseKeyDirection(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    KeyDirection
+		wantErr error
+	}{
+		{"zero", []string{"0"}, KeyDirectionNormal, nil},
+		{"one", []string{"1"}, KeyDirectionInverse, nil},
+		{"bad value", []string{"2"}, KeyDirectionBidirectional, ErrBadConfig},
+		{"no value", []string{}, KeyDirectionBidirectional, ErrBadConfig},
+		{"too many values", []string{"0", "1"}, KeyDirectionBidirectional, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseKeyDirection(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseKeyDirection() error = %v, want %v", err, tt.wantErr)
+			}
+			if o.KeyDirection != tt.want {
+				t.Errorf("parseKeyDirection() = %q, want %q", o.KeyDirection, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseAuthRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    AuthRetry
+		wantErr error
+	}{
+		{"none", []string{"none"}, AuthRetryNone, nil},
+		{"nointeract", []string{"nointeract"}, AuthRetryNoInteract, nil},
+		{"interact", []string{"interact"}, AuthRetryInteract, nil},
+		{"bad mode", []string{"forever"}, "", ErrBadConfig},
+		{"no mode", []string{}, "", ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseAuthRetry(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseAuthRetry() error = %v, want %v", err, tt.wantErr)
+			}
+			if o.AuthRetry != tt.want {
+				t.Errorf("parseAuthRetry() = %q, want %q", o.AuthRetry, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseRedirectGateway(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    model.RedirectGatewayFlags
+		wantErr error
+	}{
+		{"no flags", []string{}, model.RedirectGatewayFlags{}, nil},
+		{"def1 and bypass-dhcp", []string{"def1", "bypass-dhcp"}, model.RedirectGatewayFlags{Def1: true, BypassDHCP: true}, nil},
+		{"autolocal and block-local", []string{"autolocal", "block-local"}, model.RedirectGatewayFlags{AutoLocal: true, BlockLocal: true}, nil},
+		{"unknown flag", []string{"def1", "frobnicate"}, model.RedirectGatewayFlags{}, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseRedirectGateway(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseRedirectGateway() error = %v, want %v", err, tt.wantErr)
+			}
+			if o.RedirectGateway != (tt.wantErr == nil) {
+				t.Errorf("parseRedirectGateway() RedirectGateway = %v", o.RedirectGateway)
+			}
+			if o.RedirectGatewayFlags != tt.want {
+				t.Errorf("parseRedirectGateway() = %+v, want %+v", o.RedirectGatewayFlags, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseBlockOutsideDNS(t *testing.T) {
+	o, err := parseBlockOutsideDNS([]string{}, &OpenVPNOptions{})
+	if err != nil || !o.BlockOutsideDNS {
+		t.Errorf("parseBlockOutsideDNS() = %v, %v, want true, nil", o.BlockOutsideDNS, err)
+	}
+	if _, err := parseBlockOutsideDNS([]string{"yes"}, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("parseBlockOutsideDNS() error = %v, want %v", err, ErrBadConfig)
+	}
+}
+
+func Test_parseDataCiphers(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    []string
+		wantErr error
+	}{
+		{"one cipher", []string{"AES-256-GCM"}, []string{"AES-256-GCM"}, nil},
+		{"many ciphers", []string{"AES-256-GCM:AES-128-GCM"}, []string{"AES-256-GCM", "AES-128-GCM"}, nil},
+		{"ciphers are case insensitive", []string{"aes-256-gcm:Aes-128-Gcm"}, []string{"AES-256-GCM", "AES-128-GCM"}, nil},
+		{"unsupported cipher", []string{"AES-256-GCM:CHACHA20-POLY1305"}, nil, ErrBadConfig},
+		{"no ciphers", []string{}, nil, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseDataCiphers(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseDataCiphers() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(o.DataCiphers, tt.want) {
+				t.Errorf("parseDataCiphers() = %v, want %v", o.DataCiphers, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseDataCiphersFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    string
+		wantErr error
+	}{
+		{"supported cipher", []string{"AES-256-CBC"}, "AES-256-CBC", nil},
+		{"unsupported cipher", []string{"BF-CBC"}, "", ErrBadConfig},
+		{"many ciphers", []string{"AES-256-CBC", "AES-128-CBC"}, "", ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseDataCiphersFallback(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseDataCiphersFallback() error = %v, want %v", err, tt.wantErr)
+			}
+			if o.DataCiphersFallback != tt.want {
+				t.Errorf("parseDataCiphersFallback() = %q, want %q", o.DataCiphersFallback, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseAllowCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    AllowCompression
+		wantErr error
+	}{
+		{"no", []string{"no"}, AllowCompressionNo, nil},
+		{"asym", []string{"asym"}, AllowCompressionAsym, nil},
+		{"yes", []string{"yes"}, AllowCompressionYes, nil},
+		{"unknown policy", []string{"maybe"}, "", ErrBadConfig},
+		{"no args", []string{}, "", ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseAllowCompression(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseAllowCompression() error = %v, want %v", err, tt.wantErr)
+			}
+			if o.AllowCompression != tt.want {
+				t.Errorf("parseAllowCompression() = %q, want %q", o.AllowCompression, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseCompNoAdapt(t *testing.T) {
+	if _, err := parseCompNoAdapt([]string{}, &OpenVPNOptions{}); err != nil {
+		t.Errorf("parseCompNoAdapt() error = %v", err)
+	}
+	if _, err := parseCompNoAdapt([]string{"yes"}, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("parseCompNoAdapt() error = %v, want %v", err, ErrBadConfig)
+	}
+}
+
+func TestOpenVPNOptions_CompressionAllowed(t *testing.T) {
+	tests := []struct {
+		policy AllowCompression
+		want   bool
+	}{
+		{"", false},
+		{AllowCompressionNo, false},
+		{AllowCompressionAsym, true},
+		{AllowCompressionYes, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			o := &OpenVPNOptions{AllowCompression: tt.policy}
+			if got := o.CompressionAllowed(); got != tt.want {
+				t.Errorf("CompressionAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenVPNOptions_NegotiateCipher(t *testing.T) {
+	accepted := []string{"AES-256-GCM", "AES-128-GCM"}
+	tests := []struct {
+		name     string
+		ciphers  []string
+		fallback string
+		pushed   string
+		want     string
+		wantErr  error
+	}{
+		{"the pushed cipher matches", accepted, "", "aes-128-gcm", "aes-128-gcm", nil},
+		{"without data-ciphers we accept the pushed cipher", nil, "", "AES-256-CBC", "AES-256-CBC", nil},
+		{"we do not use the fallback when the pushed cipher does not match", accepted, "AES-256-CBC", "AES-128-CBC", "", ErrNoCommonCipher},
+		{"we use the fallback when nothing is pushed", accepted, "AES-256-CBC", "", "AES-256-CBC", nil},
+		{"we keep the configured cipher when nothing is pushed", accepted, "", "", "", nil},
+		{"we fail without a common cipher", accepted, "", "AES-128-CBC", "", ErrNoCommonCipher},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &OpenVPNOptions{DataCiphers: tt.ciphers, DataCiphersFallback: tt.fallback}
+			got, err := o.NegotiateCipher(tt.pushed)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NegotiateCipher() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NegotiateCipher() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseFloat(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    bool
+		wantErr error
+	}{
+		{"float", []string{}, true, nil},
+		{"float with args", []string{"yes"}, false, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseFloat(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseFloat() error = %v, want %v", err, tt.wantErr)
+			}
+			if o.Float != tt.want {
+				t.Errorf("parseFloat() = %v, want %v", o.Float, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOptionsFromLinesInlineTLSAuth(t *testing.T) {
+	lines := []string{
+		"cipher AES-256-GCM",
+		"auth SHA512",
+		"key-direction 1",
+		"<tls-auth>",
+		"dummy",
+		"</tls-auth>",
+	}
+	o, err := getOptionsFromLines(lines, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(o.TLSAuth), "dummy") {
+		t.Errorf("unexpected tls-auth key: %q", o.TLSAuth)
+	}
+	if o.KeyDirection != KeyDirectionInverse {
+		t.Errorf("unexpected key direction: %q", o.KeyDirection)
+	}
+	if !strings.Contains(o.ServerOptionsString(), ",tls-auth,key-method 2") {
+		t.Errorf("expected tls-auth in the options string")
+	}
+}
+
 func TestGetOptionsFromLinesNoFiles(t *testing.T) {
 	t.Run("getting certificatee should fail if no file passed", func(t *testing.T) {
 		l := []string{"ca ca.crt"}
@@ -161,6 +735,51 @@ func TestGetOptionsFromLinesNoFiles(t *testing.T) {
 	})
 }
 
+func TestGetOptionsFromLinesErrorContext(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{
+			name:  "bad cipher",
+			lines: []string{"remote 0.0.0.0 1194", "# a comment", "cipher AES-256-XYZ"},
+			want:  `line 3: "cipher AES-256-XYZ"`,
+		},
+		{
+			name:  "missing ca file",
+			lines: []string{"ca missing.crt"},
+			want:  `line 1: "ca missing.crt"`,
+		},
+		{
+			name:  "bad proto",
+			lines: []string{"auth SHA256", "proto sctp"},
+			want:  `line 2: "proto sctp"`,
+		},
+		{
+			name:  "empty inline block",
+			lines: []string{"auth SHA256", "<ca>", "</ca>"},
+			want:  `line 3: "</ca>"`,
+		},
+		{
+			name:  "unclosed inline block",
+			lines: []string{"<key>", "key_string"},
+			want:  `line 1: "<key>"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getOptionsFromLines(tt.lines, t.TempDir())
+			if !errors.Is(err, ErrBadConfig) {
+				t.Fatalf("getOptionsFromLines() error = %v, want %v", err, ErrBadConfig)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("getOptionsFromLines() error = %q, want it to contain %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
 func TestGetOptionsNoCompression(t *testing.T) {
 	t.Run("compress is parsed as literal empty", func(t *testing.T) {
 		l := []string{"compress"}
@@ -302,6 +921,68 @@ func Test_ParseConfigFile(t *testing.T) {
 	})
 }
 
+func TestParseConfig(t *testing.T) {
+	inlineConfig := func() string {
+		return strings.Join([]string{
+			"remote 0.0.0.0 1194",
+			"cipher AES-256-GCM",
+			"auth SHA512",
+			"<ca>",
+			"ca",
+			"</ca>",
+			"<cert>",
+			"cert",
+			"</cert>",
+			"<key>",
+			"key",
+			"</key>",
+		}, "\n")
+	}
+
+	t.Run("we parse a config from a strings.Reader", func(t *testing.T) {
+		o, err := ParseConfig(strings.NewReader(inlineConfig()), "")
+		if err != nil {
+			t.Fatalf("ParseConfig() error = %v", err)
+		}
+		if o.Remote != "0.0.0.0" || o.Port != "1194" || o.Cipher != "AES-256-GCM" {
+			t.Errorf("unexpected options: remote=%q port=%q cipher=%q", o.Remote, o.Port, o.Cipher)
+		}
+	})
+
+	t.Run("we parse inline certs from a bytes.Buffer without a base dir", func(t *testing.T) {
+		o, err := ParseConfig(bytes.NewBufferString(inlineConfig()), "")
+		if err != nil {
+			t.Fatalf("ParseConfig() error = %v", err)
+		}
+		if !o.HasAuthInfo() {
+			t.Error("expected the inline certs to provide the auth info")
+		}
+		if string(o.CA) != "ca\n" || string(o.Cert) != "cert\n" || string(o.Key) != "key\n" {
+			t.Errorf("unexpected inline blocks: ca=%q cert=%q key=%q", o.CA, o.Cert, o.Key)
+		}
+	})
+
+	t.Run("relative paths are resolved against the base dir", func(t *testing.T) {
+		d := t.TempDir()
+		writeDummyCertFiles(d)
+		config := "remote 0.0.0.0 1194\nca ca.crt\ncert cert.pem\nkey key.pem\n"
+		o, err := ParseConfig(strings.NewReader(config), d)
+		if err != nil {
+			t.Fatalf("ParseConfig() error = %v", err)
+		}
+		if o.CAPath != fp.Join(d, "ca.crt") {
+			t.Errorf("expected CAPath = %q, got %q", fp.Join(d, "ca.crt"), o.CAPath)
+		}
+	})
+
+	t.Run("a reader error is a config error", func(t *testing.T) {
+		_, err := ParseConfig(iotest.ErrReader(io.ErrUnexpectedEOF), "")
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("ParseConfig() error = %v, want %v", err, ErrBadConfig)
+		}
+	})
+}
+
 func Test_parseProto(t *testing.T) {
 	t.Run("fail with empty array of strings", func(t *testing.T) {
 		_, err := parseProto([]string{}, &OpenVPNOptions{})
@@ -341,14 +1022,461 @@ func Test_parseProto(t *testing.T) {
 		}
 	})
 
-	t.Run("unknown proto fails", func(t *testing.T) {
-		opt := &OpenVPNOptions{}
-		_, err := parseProto([]string{"kcp"}, opt)
-		wantErr := ErrBadConfig
-		if !errors.Is(err, wantErr) {
-			t.Errorf("parseProto(): wantErr: %v, got %v", ErrBadConfig, err)
-		}
-	})
+	t.Run("unknown proto fails", func(t *testing.T) {
+		opt := &OpenVPNOptions{}
+		_, err := parseProto([]string{"kcp"}, opt)
+		wantErr := ErrBadConfig
+		if !errors.Is(err, wantErr) {
+			t.Errorf("parseProto(): wantErr: %v, got %v", ErrBadConfig, err)
+		}
+	})
+}
+
+func Test_parseKeyMethod(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    int
+		wantErr error
+	}{
+		{"key-method 1", []string{"1"}, 1, nil},
+		{"key-method 2", []string{"2"}, 2, nil},
+		{"unknown key-method", []string{"3"}, 0, ErrBadConfig},
+		{"no args", []string{}, 0, ErrBadConfig},
+		{"too many args", []string{"1", "2"}, 0, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseKeyMethod(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseKeyMethod() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if o.KeyMethod != tt.want {
+				t.Errorf("parseKeyMethod() = %v, want %v", o.KeyMethod, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getOptionsFromLines_keyMethod1(t *testing.T) {
+	tests := []struct {
+		name    string
+		cipher  string
+		wantErr error
+	}{
+		{"a CBC cipher works", "AES-256-CBC", nil},
+		{"an AEAD cipher fails", "AES-256-GCM", ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the order of the directives does not matter
+			lines := []string{"key-method 1", "cipher " + tt.cipher, "auth SHA1"}
+			_, err := getOptionsFromLines(lines, t.TempDir())
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("getOptionsFromLines() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("key-method 2 supports the AEAD ciphers", func(t *testing.T) {
+		lines := []string{"key-method 2", "cipher AES-256-GCM", "auth SHA1"}
+		if _, err := getOptionsFromLines(lines, t.TempDir()); err != nil {
+			t.Errorf("getOptionsFromLines() error = %v", err)
+		}
+	})
+}
+
+func Test_parseVerb(t *testing.T) {
+	tests := []struct {
+		name     string
+		p        []string
+		wantVerb int
+		wantErr  error
+	}{
+		{"verb 0", []string{"0"}, 0, nil},
+		{"verb 3", []string{"3"}, 3, nil},
+		{"verb 11", []string{"11"}, 11, nil},
+		{"verb above 11", []string{"12"}, 0, ErrBadConfig},
+		{"negative verb", []string{"-1"}, 0, ErrBadConfig},
+		{"missing verb", []string{}, 0, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseVerb(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseVerb(): wantErr %v, got %v", tt.wantErr, err)
+			}
+			if o.Verb != tt.wantVerb || o.VerbSet != (tt.wantErr == nil) {
+				t.Errorf("parseVerb(): got verb %d (set: %v), want %d", o.Verb, o.VerbSet, tt.wantVerb)
+			}
+		})
+	}
+}
+
+func TestVerbLogLevel(t *testing.T) {
+	want := []model.LogLevel{
+		model.LogLevelWarn,
+		model.LogLevelInfo, model.LogLevelInfo, model.LogLevelInfo, model.LogLevelInfo,
+		model.LogLevelDebug, model.LogLevelDebug, model.LogLevelDebug, model.LogLevelDebug,
+		model.LogLevelDebug, model.LogLevelDebug, model.LogLevelDebug,
+	}
+	for verb := 0; verb <= maxVerb; verb++ {
+		if got := VerbLogLevel(verb); got != want[verb] {
+			t.Errorf("VerbLogLevel(%d) = %d, want %d", verb, got, want[verb])
+		}
+	}
+}
+
+func Test_parsePingAndPingRestart(t *testing.T) {
+	lines := []string{"ping 10", "ping-restart 120"}
+	o, err := getOptionsFromLines(lines, "")
+	if err != nil {
+		t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+	}
+	if o.Ping != 10 {
+		t.Errorf("expected Ping = 10, got %d", o.Ping)
+	}
+	if o.PingRestart != 120 {
+		t.Errorf("expected PingRestart = 120, got %d", o.PingRestart)
+	}
+
+	if _, err := parsePing([]string{"soon"}, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("parsePing(): wantErr %v, got %v", ErrBadConfig, err)
+	}
+	if _, err := parsePingRestart([]string{}, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("parsePingRestart(): wantErr %v, got %v", ErrBadConfig, err)
+	}
+}
+
+func Test_parseExplicitExitNotify(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []string
+		want    int
+		wantErr error
+	}{
+		{"the count defaults to one", []string{}, 1, nil},
+		{"explicit count", []string{"3"}, 3, nil},
+		{"zero disables it", []string{"0"}, 0, nil},
+		{"bad count", []string{"many"}, 0, ErrBadConfig},
+		{"too many args", []string{"1", "2"}, 0, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseExplicitExitNotify(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseExplicitExitNotify() error = %v, want %v", err, tt.wantErr)
+			}
+			if o.ExplicitExitNotify != tt.want {
+				t.Errorf("ExplicitExitNotify = %d, want %d", o.ExplicitExitNotify, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseAuthNoCache(t *testing.T) {
+	t.Run("without args", func(t *testing.T) {
+		o, err := parseAuthNoCache([]string{}, &OpenVPNOptions{})
+		if err != nil {
+			t.Fatalf("parseAuthNoCache(): unexpected error %v", err)
+		}
+		if !o.AuthNoCache {
+			t.Error("parseAuthNoCache(): expected AuthNoCache to be set")
+		}
+	})
+
+	t.Run("with args", func(t *testing.T) {
+		_, err := parseAuthNoCache([]string{"yes"}, &OpenVPNOptions{})
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseAuthNoCache(): wantErr %v, got %v", ErrBadConfig, err)
+		}
+	})
+}
+
+func Test_parseSetenv(t *testing.T) {
+	t.Run("multiple lines are collected", func(t *testing.T) {
+		lines := []string{
+			"setenv UV_ID 1234",
+			`setenv UV_NAME "my vpn provider"`,
+			"setenv opt block-outside-dns",
+			"setenv-safe FORWARD_COMPATIBLE 1",
+			"setenv UV_EMPTY",
+		}
+		o, err := getOptionsFromLines(lines, "")
+		if err != nil {
+			t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+		}
+		want := map[string]string{
+			"UV_ID":                      "1234",
+			"UV_NAME":                    "my vpn provider",
+			"OPENVPN_FORWARD_COMPATIBLE": "1",
+			"UV_EMPTY":                   "",
+		}
+		if !reflect.DeepEqual(o.Env, want) {
+			t.Errorf("expected Env = %v, got %v", want, o.Env)
+		}
+	})
+
+	t.Run("setenv without a name", func(t *testing.T) {
+		if _, err := parseSetenv([]string{}, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseSetenv(): wantErr %v, got %v", ErrBadConfig, err)
+		}
+		if _, err := parseSetenvSafe([]string{""}, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseSetenvSafe(): wantErr %v, got %v", ErrBadConfig, err)
+		}
+	})
+}
+
+func Test_parsePullFilter(t *testing.T) {
+	t.Run("filters are collected in order", func(t *testing.T) {
+		lines := []string{
+			`pull-filter accept "dhcp-option DNS 10.8.0.1"`,
+			`pull-filter ignore "dhcp-option"`,
+			"pull-filter reject redirect-gateway",
+			"route-nopull",
+		}
+		o, err := getOptionsFromLines(lines, "")
+		if err != nil {
+			t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+		}
+		want := []PullFilter{
+			{Action: PullFilterAccept, Text: "dhcp-option DNS 10.8.0.1"},
+			{Action: PullFilterIgnore, Text: "dhcp-option"},
+			{Action: PullFilterReject, Text: "redirect-gateway"},
+		}
+		if !reflect.DeepEqual(o.PullFilters, want) {
+			t.Errorf("expected PullFilters = %v, got %v", want, o.PullFilters)
+		}
+		if !o.RouteNoPull {
+			t.Error("expected RouteNoPull to be set")
+		}
+	})
+
+	for _, p := range [][]string{{}, {"ignore"}, {"drop", "route"}, {"ignore", `""`}} {
+		if _, err := parsePullFilter(p, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parsePullFilter(%v): wantErr %v, got %v", p, ErrBadConfig, err)
+		}
+	}
+	if _, err := parseRouteNoPull([]string{"yes"}, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("parseRouteNoPull(): wantErr %v, got %v", ErrBadConfig, err)
+	}
+}
+
+func Test_parseRemote(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         string
+		wantRemote   string
+		wantEndpoint string
+	}{
+		{"ipv4", "remote 10.0.0.1 1194", "10.0.0.1", "10.0.0.1:1194"},
+		{"bracketed ipv6", "remote [2001:db8::1] 1194", "2001:db8::1", "[2001:db8::1]:1194"},
+		{"bare ipv6", "remote 2001:db8::1 1194", "2001:db8::1", "[2001:db8::1]:1194"},
+		{"hostname", "remote vpn.example.org 443", "vpn.example.org", "vpn.example.org:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := getOptionsFromLines([]string{tt.line}, "")
+			if err != nil {
+				t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+			}
+			if o.Remote != tt.wantRemote {
+				t.Errorf("Remote = %q, want %q", o.Remote, tt.wantRemote)
+			}
+			if got := net.JoinHostPort(o.Remote, o.Port); got != tt.wantEndpoint {
+				t.Errorf("JoinHostPort() = %q, want %q", got, tt.wantEndpoint)
+			}
+		})
+	}
+
+	for _, line := range []string{"remote [2001:db8::1 1194", "remote [10.0.0.1] 1194", "remote [vpn.example.org] 1194"} {
+		if _, err := getOptionsFromLines([]string{line}, ""); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("getOptionsFromLines(%q): wantErr %v, got %v", line, ErrBadConfig, err)
+		}
+	}
+}
+
+func TestOpenVPNOptions_LocalAddr(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"by default we do not bind", []string{}, ""},
+		{"lport binds to all the interfaces", []string{"lport 1194"}, ":1194"},
+		{"local binds to an ephemeral port", []string{"local 10.0.0.1"}, "10.0.0.1:0"},
+		{"local and lport", []string{"local ::1", "lport 0"}, "[::1]:0"},
+		{"nobind wins", []string{"lport 1194", "nobind"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := getOptionsFromLines(tt.lines, "")
+			if err != nil {
+				t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+			}
+			if got := o.LocalAddr(); got != tt.want {
+				t.Errorf("LocalAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, line := range []string{"lport", "lport -1", "lport 65536", "lport x", "local", "nobind yes"} {
+		if _, err := getOptionsFromLines([]string{line}, ""); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("getOptionsFromLines(%q): wantErr %v, got %v", line, ErrBadConfig, err)
+		}
+	}
+}
+
+func Test_parseBindDev(t *testing.T) {
+	o, err := getOptionsFromLines([]string{"bind-dev eth1", "nobind"}, "")
+	if err != nil {
+		t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+	}
+	if o.BindInterface != "eth1" {
+		t.Errorf("BindInterface = %q, want %q", o.BindInterface, "eth1")
+	}
+	for _, line := range []string{"bind-dev", "bind-dev eth1 eth2"} {
+		if _, err := getOptionsFromLines([]string{line}, ""); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("getOptionsFromLines(%q): wantErr %v, got %v", line, ErrBadConfig, err)
+		}
+	}
+}
+
+func Test_parsePeerFingerprint(t *testing.T) {
+	pin := strings.Repeat("ab:", 31) + "ab"
+	want := [32]byte(bytes.Repeat([]byte{0xab}, 32))
+
+	t.Run("colon-separated fingerprints are accumulated", func(t *testing.T) {
+		o, err := parsePeerFingerprint([]string{pin}, &OpenVPNOptions{})
+		if err != nil {
+			t.Fatalf("parsePeerFingerprint(): unexpected error %v", err)
+		}
+		o, err = parsePeerFingerprint([]string{strings.ReplaceAll(pin, ":", "")}, o)
+		if err != nil {
+			t.Fatalf("parsePeerFingerprint(): unexpected error %v", err)
+		}
+		if len(o.PeerFingerprints) != 2 || o.PeerFingerprints[0] != want || o.PeerFingerprints[1] != want {
+			t.Errorf("parsePeerFingerprint(): got %x", o.PeerFingerprints)
+		}
+	})
+
+	for _, p := range [][]string{{}, {pin, pin}, {"ab:cd"}, {"zz" + pin[2:]}} {
+		if _, err := parsePeerFingerprint(p, &OpenVPNOptions{}); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parsePeerFingerprint(%v): wantErr %v, got %v", p, ErrBadConfig, err)
+		}
+	}
+}
+
+func Test_parseTLSCipher(t *testing.T) {
+	tests := []struct {
+		name    string
+		fn      func([]string, *OpenVPNOptions) (*OpenVPNOptions, error)
+		p       []string
+		want    []uint16
+		wantErr error
+	}{
+		{
+			name: "tls-cipher with reference names",
+			fn:   parseTLSCipher,
+			p:    []string{"TLS-ECDHE-RSA-WITH-AES-256-GCM-SHA384:TLS-ECDHE-ECDSA-WITH-CHACHA20-POLY1305-SHA256"},
+			want: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+		},
+		{
+			name: "tls-cipher with iana names",
+			fn:   parseTLSCipher,
+			p:    []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			want: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		},
+		{
+			name: "tls-ciphersuites",
+			fn:   parseTLSCiphersuites,
+			p:    []string{"TLS_AES_256_GCM_SHA384:TLS_CHACHA20_POLY1305_SHA256"},
+			want: []uint16{tls.TLS_AES_256_GCM_SHA384, tls.TLS_CHACHA20_POLY1305_SHA256},
+		},
+		{
+			name:    "tls-cipher with an unknown suite",
+			fn:      parseTLSCipher,
+			p:       []string{"TLS-ECDHE-RSA-WITH-AES-256-GCM-SHA384:TLS-FOO-WITH-BAR"},
+			wantErr: ErrBadConfig,
+		},
+		{
+			name:    "tls-cipher with a tls 1.3 suite",
+			fn:      parseTLSCipher,
+			p:       []string{"TLS_AES_256_GCM_SHA384"},
+			wantErr: ErrBadConfig,
+		},
+		{
+			name:    "tls-ciphersuites with a tls 1.2 suite",
+			fn:      parseTLSCiphersuites,
+			p:       []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			wantErr: ErrBadConfig,
+		},
+		{
+			name:    "tls-cipher with an insecure suite",
+			fn:      parseTLSCipher,
+			p:       []string{"TLS_ECDHE_RSA_WITH_RC4_128_SHA"},
+			wantErr: ErrBadConfig,
+		},
+		{
+			name:    "tls-cipher without args",
+			fn:      parseTLSCipher,
+			p:       []string{},
+			wantErr: ErrBadConfig,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := tt.fn(tt.p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := append(o.TLSCipher, o.TLSCipherSuites...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got suites %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseStaticChallenge(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantText string
+		wantEcho bool
+		wantErr  error
+	}{
+		{"echo enabled", `"Enter PIN" 1`, "Enter PIN", true, nil},
+		{"echo disabled", `"Enter  your OTP code" 0`, "Enter  your OTP code", false, nil},
+		{"single word", `"OTP" 1`, "OTP", true, nil},
+		{"missing echo", `"Enter PIN"`, "", false, ErrBadConfig},
+		{"bad echo", `"Enter PIN" yes`, "", false, ErrBadConfig},
+		{"unquoted text", `PIN 1`, "", false, ErrBadConfig},
+		{"empty text", `"" 1`, "", false, ErrBadConfig},
+		{"empty", ``, "", false, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p []string
+			if tt.line != "" {
+				p = strings.Split(tt.line, " ")
+			}
+			o, err := parseStaticChallenge(p, &OpenVPNOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseStaticChallenge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if o.StaticChallenge != tt.wantText {
+				t.Errorf("parseStaticChallenge() text = %q, want %q", o.StaticChallenge, tt.wantText)
+			}
+			if o.StaticChallengeEcho != tt.wantEcho {
+				t.Errorf("parseStaticChallenge() echo = %v, want %v", o.StaticChallengeEcho, tt.wantEcho)
+			}
+		})
+	}
 }
 
 func Test_parseProxyOBFS4(t *testing.T) {
@@ -375,6 +1503,72 @@ func Test_parseProxyOBFS4(t *testing.T) {
 	})
 }
 
+func Test_parseTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		wantName string
+		wantURI  string
+		wantErr  error
+	}{
+		{"proto-<name> selects the named transport", []string{"proto-ss ss://example.org:8388"}, "ss", "ss://example.org:8388", nil},
+		{"proxy-obfs4 selects obfs4", []string{"proxy-obfs4 obfs4://10.0.0.1:443"}, "obfs4", "obfs4://10.0.0.1:443", nil},
+		{"proto-<name> wins over proxy-obfs4", []string{"proxy-obfs4 obfs4://10.0.0.1:443", "proto-meek https://example.org"}, "meek", "https://example.org", nil},
+		{"no transport by default", []string{"proto tcp"}, "", "", nil},
+		{"proto-force is not a transport", []string{"proto-force udp"}, "", "", nil},
+		{"the uri is required", []string{"proto-ss"}, "", "", ErrBadConfig},
+		{"the name is required", []string{"proto- ss://example.org:8388"}, "", "", ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := getOptionsFromLines(tt.lines, "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("getOptionsFromLines() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			name, uri := o.PluggableTransport()
+			if name != tt.wantName || uri != tt.wantURI {
+				t.Errorf("PluggableTransport() = %q, %q, want %q, %q", name, uri, tt.wantName, tt.wantURI)
+			}
+		})
+	}
+
+	t.Run("the transport resolves its relative paths against the config dir", func(t *testing.T) {
+		o, err := getOptionsFromLines([]string{"proto-stunnel stunnel://?ca=ca.pem"}, "/etc/openvpn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.TransportBaseDir != "/etc/openvpn" {
+			t.Errorf("TransportBaseDir = %q, want %q", o.TransportBaseDir, "/etc/openvpn")
+		}
+	})
+
+	t.Run("a udp config over a transport announces tcp", func(t *testing.T) {
+		lines := []string{"proto udp", "proto-ss ss://example.org:8388", "cipher AES-128-GCM", "auth SHA512"}
+		o, err := getOptionsFromLines(lines, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := o.ServerOptionsString(); !strings.Contains(got, ",proto TCPv4,") {
+			t.Errorf("ServerOptionsString() = %v, want proto TCPv4", got)
+		}
+	})
+
+	t.Run("proto-<name> is known in strict mode", func(t *testing.T) {
+		if !isKnownDirective("proto-ss") {
+			t.Error("expected proto-ss to be a known directive")
+		}
+	})
+
+	t.Run("proto-force is unknown in strict mode", func(t *testing.T) {
+		if isKnownDirective("proto-force") {
+			t.Error("expected proto-force not to be a known directive")
+		}
+	})
+}
+
 func Test_parseCA(t *testing.T) {
 	t.Run("more than one part should fail", func(t *testing.T) {
 		_, err := parseCA([]string{"one", "two"}, &OpenVPNOptions{}, "")
@@ -393,6 +1587,55 @@ func Test_parseCA(t *testing.T) {
 	})
 }
 
+func Test_parseCA_multiple(t *testing.T) {
+	d := t.TempDir()
+	for _, name := range []string{"ca1.crt", "ca2.crt"} {
+		if err := os.WriteFile(fp.Join(d, name), []byte("dummy"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o, err := parseCA([]string{"ca1.crt"}, &OpenVPNOptions{}, d)
+	if err != nil {
+		t.Fatalf("parseCA(): unexpected error %v", err)
+	}
+	o, err = parseCA([]string{"ca2.crt"}, o, d)
+	if err != nil {
+		t.Fatalf("parseCA(): unexpected error %v", err)
+	}
+	if o.CAPath != fp.Join(d, "ca1.crt") {
+		t.Errorf("parseCA(): got CAPath %v", o.CAPath)
+	}
+	if !reflect.DeepEqual(o.ExtraCAPaths, []string{fp.Join(d, "ca2.crt")}) {
+		t.Errorf("parseCA(): got ExtraCAPaths %v", o.ExtraCAPaths)
+	}
+}
+
+func Test_parseCADir(t *testing.T) {
+	d := t.TempDir()
+	if err := os.Mkdir(fp.Join(d, "cas"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fp.Join(d, "ca.crt"), []byte("dummy"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("a directory below the config path is accepted", func(t *testing.T) {
+		o, err := parseCADir([]string{"cas"}, &OpenVPNOptions{}, d)
+		if err != nil {
+			t.Fatalf("parseCADir(): unexpected error %v", err)
+		}
+		if o.CADir != fp.Join(d, "cas") {
+			t.Errorf("parseCADir(): got %v", o.CADir)
+		}
+	})
+
+	for _, p := range [][]string{{}, {"cas", "cas"}, {"ca.crt"}, {"missing"}, {"/tmp"}} {
+		if _, err := parseCADir(p, &OpenVPNOptions{}, d); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseCADir(%v): want %v, got %v", p, ErrBadConfig, err)
+		}
+	}
+}
+
 func Test_parseCert(t *testing.T) {
 	t.Run("more than one part should fail", func(t *testing.T) {
 		_, err := parseCert([]string{"one", "two"}, &OpenVPNOptions{}, "")
@@ -453,16 +1696,65 @@ func Test_parseCompress(t *testing.T) {
 			t.Errorf("parseCompress(): want %v, got %v", wantErr, err)
 		}
 	})
+
+	t.Run("migrate is recognized", func(t *testing.T) {
+		o, err := parseCompress([]string{"migrate"}, &OpenVPNOptions{})
+		if err != nil {
+			t.Fatalf("parseCompress(): unexpected error %v", err)
+		}
+		if o.Compress != CompressionMigrate {
+			t.Errorf("parseCompress(): want %v, got %v", CompressionMigrate, o.Compress)
+		}
+	})
+
+	t.Run("an unknown algorithm should fail", func(t *testing.T) {
+		_, err := parseCompress([]string{"lz4"}, &OpenVPNOptions{})
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseCompress(): want %v, got %v", ErrBadConfig, err)
+		}
+	})
 }
 
 func Test_parseCompLZO(t *testing.T) {
-	t.Run("any other string than 'no' should fail", func(t *testing.T) {
-		_, err := parseCompLZO([]string{"yes"}, &OpenVPNOptions{})
-		wantErr := ErrBadConfig
-		if !errors.Is(err, wantErr) {
-			t.Errorf("parseCompLZO(): want %v, got %v", wantErr, err)
+	t.Run("no is parsed as lzo-no", func(t *testing.T) {
+		o, err := parseCompLZO([]string{"no"}, &OpenVPNOptions{})
+		if err != nil {
+			t.Fatalf("parseCompLZO(): unexpected error %v", err)
+		}
+		if o.Compress != CompressionLZONo {
+			t.Errorf("parseCompLZO(): want %v, got %v", CompressionLZONo, o.Compress)
 		}
 	})
+
+	tests := []struct {
+		name string
+		p    []string
+		want Compression
+	}{
+		{"adaptive", []string{"adaptive"}, CompressionLZOAdaptive},
+		{"bare comp-lzo means adaptive", []string{}, CompressionLZOAdaptive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseCompLZO(tt.p, &OpenVPNOptions{})
+			if err != nil {
+				t.Fatalf("parseCompLZO(): unexpected error %v", err)
+			}
+			if o.Compress != tt.want {
+				t.Errorf("parseCompLZO(): want %v, got %v", tt.want, o.Compress)
+			}
+		})
+	}
+
+	// we cannot compress every packet
+	for _, p := range [][]string{{"yes"}, {"no", "extra"}} {
+		t.Run(strings.Join(append([]string{"comp-lzo"}, p...), " ")+" should fail", func(t *testing.T) {
+			_, err := parseCompLZO(p, &OpenVPNOptions{})
+			if !errors.Is(err, ErrBadConfig) {
+				t.Errorf("parseCompLZO(): want %v, got %v", ErrBadConfig, err)
+			}
+		})
+	}
 }
 
 func Test_parseOption(t *testing.T) {
@@ -475,6 +1767,68 @@ func Test_parseOption(t *testing.T) {
 	})
 }
 
+func TestReadConfigFileStrict(t *testing.T) {
+	lines := []string{
+		"; a comment",
+		"remote 0.0.0.0 1194",
+		"",
+		"ciper AES-256-GCM",
+		"auth SHA512",
+	}
+
+	t.Run("lenient mode collects unknown directives", func(t *testing.T) {
+		path := writeConfigFile(t, t.TempDir(), lines...)
+		o, err := ReadConfigFile(path)
+		if err != nil {
+			t.Fatalf("ReadConfigFile(): unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(o.UnknownDirectives, []string{"ciper"}) {
+			t.Errorf("expected UnknownDirectives = [ciper], got %v", o.UnknownDirectives)
+		}
+		if o.Auth != "SHA512" {
+			t.Errorf("expected Auth = SHA512, got %s", o.Auth)
+		}
+	})
+
+	t.Run("strict mode fails on unknown directives", func(t *testing.T) {
+		path := writeConfigFile(t, t.TempDir(), lines...)
+		_, err := ReadConfigFileStrict(path)
+		if !errors.Is(err, ErrUnknownDirective) || !errors.Is(err, ErrBadConfig) {
+			t.Fatalf("ReadConfigFileStrict(): wantErr %v, got %v", ErrUnknownDirective, err)
+		}
+		if !strings.Contains(err.Error(), "line 4") {
+			t.Errorf("ReadConfigFileStrict(): expected the error to mention line 4, got %v", err)
+		}
+	})
+
+	t.Run("strict mode accepts known directives", func(t *testing.T) {
+		path := writeConfigFile(t, t.TempDir(), "remote 0.0.0.0 1194", "cipher AES-256-GCM")
+		o, err := ReadConfigFileStrict(path)
+		if err != nil {
+			t.Fatalf("ReadConfigFileStrict(): unexpected error %v", err)
+		}
+		if len(o.UnknownDirectives) != 0 {
+			t.Errorf("expected no UnknownDirectives, got %v", o.UnknownDirectives)
+		}
+	})
+}
+
+func Test_parseCipherAndAuthSuggestSupported(t *testing.T) {
+	_, err := parseCipher([]string{"BF-CBC"}, &OpenVPNOptions{})
+	if !errors.Is(err, ErrBadConfig) || !strings.Contains(err.Error(), "try one of: AES-128-CBC") {
+		t.Errorf("parseCipher(): expected a suggestion, got %v", err)
+	}
+	_, err = parseAuth([]string{"MD5"}, &OpenVPNOptions{})
+	if !errors.Is(err, ErrBadConfig) || !strings.Contains(err.Error(), "try one of: SHA1, SHA256, SHA512") {
+		t.Errorf("parseAuth(): expected a suggestion, got %v", err)
+	}
+	for _, cipher := range SupportedCiphers {
+		if _, err := parseCipher([]string{cipher}, &OpenVPNOptions{}); err != nil {
+			t.Errorf("parseCipher(%s): %v", cipher, err)
+		}
+	}
+}
+
 func Test_parseAuth(t *testing.T) {
 	type args struct {
 		p []string
@@ -522,6 +1876,10 @@ func Test_parseAuth(t *testing.T) {
 }
 
 func Test_parseAuthUser(t *testing.T) {
+	// make sure we do not pick the credentials from the environment
+	t.Setenv(EnvUsername, "")
+	t.Setenv(EnvPassword, "")
+
 	makeCreds := func(credStr string) string {
 		f, err := os.CreateTemp(t.TempDir(), "tmpfile-")
 		if err != nil {
@@ -574,15 +1932,6 @@ func Test_parseAuthUser(t *testing.T) {
 			},
 			wantErr: ErrBadConfig,
 		},
-		{
-			name: "parse empty parts should fail",
-			args: args{
-				p: []string{},
-				o: &OpenVPNOptions{},
-				d: baseDir(),
-			},
-			wantErr: ErrBadConfig,
-		},
 		{
 			name: "parse less than two lines should fail",
 			args: args{
@@ -602,6 +1951,64 @@ func Test_parseAuthUser(t *testing.T) {
 	}
 }
 
+func Test_parseAuthUserWithoutFile(t *testing.T) {
+	t.Run("credentials are read from the environment", func(t *testing.T) {
+		t.Setenv(EnvUsername, "user")
+		t.Setenv(EnvPassword, "secret")
+		o, err := parseAuthUser([]string{}, &OpenVPNOptions{}, os.TempDir())
+		if err != nil {
+			t.Fatalf("parseAuthUser() error = %v", err)
+		}
+		if o.Username != "user" || o.Password != "secret" {
+			t.Errorf("parseAuthUser() got = %q/%q, want user/secret", o.Username, o.Password)
+		}
+	})
+
+	t.Run("a missing password in the environment should fail", func(t *testing.T) {
+		t.Setenv(EnvUsername, "user")
+		t.Setenv(EnvPassword, "")
+		if _, err := parseAuthUser([]string{}, &OpenVPNOptions{}, os.TempDir()); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseAuthUser() error = %v, want %v", err, ErrBadConfig)
+		}
+	})
+
+	t.Run("a missing username in the environment should fail", func(t *testing.T) {
+		t.Setenv(EnvUsername, "")
+		t.Setenv(EnvPassword, "secret")
+		if _, err := parseAuthUser([]string{}, &OpenVPNOptions{}, os.TempDir()); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("parseAuthUser() error = %v, want %v", err, ErrBadConfig)
+		}
+	})
+
+	t.Run("without credentials in the environment we expect a provider", func(t *testing.T) {
+		t.Setenv(EnvUsername, "")
+		t.Setenv(EnvPassword, "")
+		o, err := parseAuthUser([]string{}, &OpenVPNOptions{}, os.TempDir())
+		if err != nil {
+			t.Fatalf("parseAuthUser() error = %v", err)
+		}
+		if o.HasAuthInfo() {
+			t.Fatal("expected no auth info without a provider")
+		}
+		o.CredentialProvider = &mockCredentialProvider{}
+		if !o.HasAuthInfo() {
+			t.Fatal("expected auth info with a provider")
+		}
+	})
+
+	t.Run("a config file with a bare auth-user-pass uses the environment", func(t *testing.T) {
+		t.Setenv(EnvUsername, "user")
+		t.Setenv(EnvPassword, "secret")
+		o, err := getOptionsFromLines([]string{"auth-user-pass"}, os.TempDir())
+		if err != nil {
+			t.Fatalf("getOptionsFromLines() error = %v", err)
+		}
+		if o.Username != "user" || o.Password != "secret" {
+			t.Errorf("getOptionsFromLines() got = %q/%q, want user/secret", o.Username, o.Password)
+		}
+	})
+}
+
 // TODO(ainghazal): either check returned value or check mutation of the options argument.
 func Test_parseTLSVerMax(t *testing.T) {
 	type args struct {
@@ -798,6 +2205,35 @@ func TestOpenVPNOptions_ShouldLoadCertsFromPath(t *testing.T) {
 			t.Error("expected false")
 		}
 	})
+	t.Run("cert and ca paths with a signer should return true", func(t *testing.T) {
+		opt := OpenVPNOptions{CAPath: "/path", CertPath: "/path", Signer: &mockSigner{}}
+		if !opt.ShouldLoadCertsFromPath() {
+			t.Error("expected true")
+		}
+	})
+	t.Run("cert and key paths with a peer fingerprint should return true", func(t *testing.T) {
+		opt := OpenVPNOptions{KeyPath: "/path", CertPath: "/path", PeerFingerprints: [][32]byte{{}}}
+		if !opt.ShouldLoadCertsFromPath() {
+			t.Error("expected true")
+		}
+	})
+}
+
+// mockSigner is a crypto.Signer that does nothing.
+type mockSigner struct{}
+
+func (s *mockSigner) Public() crypto.PublicKey {
+	return nil
+}
+
+func (s *mockSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, nil
+}
+
+type mockCredentialProvider struct{}
+
+func (*mockCredentialProvider) Credentials() (string, string, error) {
+	return "user", "password", nil
 }
 
 func TestOpenVPNOptions_HasAuthInfo(t *testing.T) {
@@ -807,6 +2243,12 @@ func TestOpenVPNOptions_HasAuthInfo(t *testing.T) {
 			t.Error("expected true")
 		}
 	})
+	t.Run("a credential provider should return true", func(t *testing.T) {
+		opt := OpenVPNOptions{CredentialProvider: &mockCredentialProvider{}}
+		if !opt.HasAuthInfo() {
+			t.Error("expected true")
+		}
+	})
 	t.Run("paths for ca cert and key should return true", func(t *testing.T) {
 		opt := OpenVPNOptions{CAPath: "/path]", KeyPath: "/path", CertPath: "/path"}
 		if !opt.HasAuthInfo() {
@@ -819,6 +2261,30 @@ func TestOpenVPNOptions_HasAuthInfo(t *testing.T) {
 			t.Error("expected true")
 		}
 	})
+	t.Run("signer with inline ca and cert should return true", func(t *testing.T) {
+		opt := OpenVPNOptions{CA: []byte("stuff"), Cert: []byte("stuff"), Signer: &mockSigner{}}
+		if !opt.HasAuthInfo() {
+			t.Error("expected true")
+		}
+	})
+	t.Run("cert and key with a peer fingerprint and no ca should return true", func(t *testing.T) {
+		opt := OpenVPNOptions{Key: []byte("stuff"), Cert: []byte("stuff"), PeerFingerprints: [][32]byte{{}}}
+		if !opt.HasAuthInfo() {
+			t.Error("expected true")
+		}
+	})
+	t.Run("cert and key without a ca should return false", func(t *testing.T) {
+		opt := OpenVPNOptions{Key: []byte("stuff"), Cert: []byte("stuff")}
+		if opt.HasAuthInfo() {
+			t.Error("expected false")
+		}
+	})
+	t.Run("signer without a cert should return false", func(t *testing.T) {
+		opt := OpenVPNOptions{CA: []byte("stuff"), Signer: &mockSigner{}}
+		if opt.HasAuthInfo() {
+			t.Error("expected false")
+		}
+	})
 	t.Run("empty values should return false", func(t *testing.T) {
 		opt := OpenVPNOptions{}
 		if opt.HasAuthInfo() {
@@ -826,3 +2292,113 @@ func TestOpenVPNOptions_HasAuthInfo(t *testing.T) {
 		}
 	})
 }
+
+func Test_parseSocketBuffers(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		p       []string
+		want    int
+		wantErr error
+	}{
+		{"sndbuf", "sndbuf", []string{"393216"}, 393216, nil},
+		{"rcvbuf", "rcvbuf", []string{"393216"}, 393216, nil},
+		{"zero is allowed", "rcvbuf", []string{"0"}, 0, nil},
+		{"negative size", "sndbuf", []string{"-1"}, 0, ErrBadConfig},
+		{"not a number", "rcvbuf", []string{"big"}, 0, ErrBadConfig},
+		{"no args", "sndbuf", []string{}, 0, ErrBadConfig},
+		{"too many args", "rcvbuf", []string{"1", "2"}, 0, ErrBadConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseOption(&OpenVPNOptions{}, "", tt.key, tt.p, 0)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseOption() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			got := o.RcvBuf
+			if tt.key == "sndbuf" {
+				got = o.SndBuf
+			}
+			if got != tt.want {
+				t.Errorf("parseOption() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInlineBlocks(t *testing.T) {
+	t.Run("we extract all the blocks", func(t *testing.T) {
+		config := strings.Join([]string{
+			"remote 0.0.0.0 1194",
+			"<ca>",
+			"ca1",
+			"</ca>",
+			"cipher AES-256-GCM",
+			"<cert>",
+			"cert",
+			"</cert>",
+			"<key>",
+			"# a comment is not part of the block",
+			"key",
+			"</key>",
+			"<tls-auth>",
+			"tls-auth",
+			"</tls-auth>",
+			"<ca>",
+			"ca2",
+			"</ca>",
+		}, "\n")
+		got, err := ParseInlineBlocks(config)
+		if err != nil {
+			t.Fatalf("ParseInlineBlocks() error = %v", err)
+		}
+		want := map[string][]byte{
+			"ca":       []byte("ca1\nca2\n"),
+			"cert":     []byte("cert\n"),
+			"key":      []byte("key\n"),
+			"tls-auth": []byte("tls-auth\n"),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseInlineBlocks() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("opening tags inside a block are content", func(t *testing.T) {
+		config := "<tls-crypt-v2>\n<ca>\n<cert>\ndata\n</tls-crypt-v2>\r\n"
+		got, err := ParseInlineBlocks(config)
+		if err != nil {
+			t.Fatalf("ParseInlineBlocks() error = %v", err)
+		}
+		if want := "<ca>\n<cert>\ndata\n"; string(got["tls-crypt-v2"]) != want {
+			t.Errorf("got %q, want %q", got["tls-crypt-v2"], want)
+		}
+		if _, found := got["ca"]; found {
+			t.Error("unexpected ca block")
+		}
+	})
+
+	t.Run("an unterminated block is an error", func(t *testing.T) {
+		_, err := ParseInlineBlocks("remote 0.0.0.0 1194\n<key>\nkey\n")
+		var problem Problem
+		if !errors.As(err, &problem) || !errors.Is(err, ErrBadConfig) {
+			t.Fatalf("ParseInlineBlocks() error = %v, want a problem wrapping %v", err, ErrBadConfig)
+		}
+		if problem.Line != 2 || problem.Directive != "<key>" {
+			t.Errorf("got problem at line %d (%q), want line 2 (<key>)", problem.Line, problem.Directive)
+		}
+	})
+
+	t.Run("an empty block is an error", func(t *testing.T) {
+		if _, err := ParseInlineBlocks("<ca>\n</ca>\n"); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("ParseInlineBlocks() error = %v, want %v", err, ErrBadConfig)
+		}
+	})
+
+	t.Run("a config without blocks has no blocks", func(t *testing.T) {
+		got, err := ParseInlineBlocks("remote 0.0.0.0 1194\n")
+		if err != nil || len(got) != 0 {
+			t.Errorf("ParseInlineBlocks() = %v, %v", got, err)
+		}
+	})
+}
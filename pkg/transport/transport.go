@@ -0,0 +1,103 @@
+// Package transport allows to register pluggable transports (e.g., obfs4) by name, so that
+// the tunnel can reach the remote through the transport selected by a proto-<name> directive.
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrUnknownTransport indicates that no transport has been registered with the given name.
+	ErrUnknownTransport = errors.New("transport: unknown transport")
+
+	// ErrAlreadyRegistered indicates that a transport with the same name already exists.
+	ErrAlreadyRegistered = errors.New("transport: already registered")
+)
+
+// PluggableTransport establishes connections to the remote through a pluggable transport.
+type PluggableTransport interface {
+	// Dial establishes a connection to the given address through the transport.
+	Dial(ctx context.Context, network, address string) (net.Conn, error)
+
+	// StreamFraming returns whether the conns of the transport always carry a byte stream,
+	// regardless of the network we dial, in which case we use the OpenVPN stream framing.
+	StreamFraming() bool
+}
+
+// ContextDialer dials the conns a transport needs to reach its server (e.g., the obfs4 bridge).
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Environment is what the tunnel provides to the transports it creates.
+type Environment struct {
+	// Dialer is the dialer the transport should use to reach its server. The tunnel binds
+	// it like the conn to the remote (e.g., honoring local, lport and bind-dev), and uses
+	// the dialer passed to the tunnel underneath it.
+	Dialer ContextDialer
+
+	// BaseDir is the directory against which we resolve the relative paths in the URI
+	// (e.g., the directory of the config file). When empty, we use the current directory.
+	BaseDir string
+}
+
+// Factory creates a [PluggableTransport] from the URI configured in the proto-<name>
+// directive (e.g., the obfs4://... URI of the obfs4 bridge) and the given environment.
+type Factory func(uri string, env *Environment) (PluggableTransport, error)
+
+var (
+	// registryMu protects registry.
+	registryMu sync.Mutex
+
+	// registry maps the name of each transport to its factory.
+	registry = make(map[string]Factory)
+)
+
+// Register registers the factory of the transport with the given name, which is the
+// suffix of the proto-<name> directive selecting it.
+func Register(name string, factory Factory) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, found := registry[name]; found {
+		return fmt.Errorf("%w: %s", ErrAlreadyRegistered, name)
+	}
+	registry[name] = factory
+	return nil
+}
+
+// New creates the transport registered with the given name from the given URI. A nil env,
+// or an env without a dialer, means using a [net.Dialer] and the current directory.
+func New(name, uri string, env *Environment) (PluggableTransport, error) {
+	registryMu.Lock()
+	factory, found := registry[name]
+	registryMu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTransport, name)
+	}
+	if env == nil {
+		env = &Environment{}
+	}
+	if env.Dialer == nil {
+		env = &Environment{Dialer: &net.Dialer{}, BaseDir: env.BaseDir}
+	}
+	return factory(uri, env)
+}
+
+// Dialer adapts a [PluggableTransport] to the dialer interface used by the tunnel.
+type Dialer struct {
+	Transport PluggableTransport
+}
+
+// DialContext implements model.Dialer.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.Transport.Dial(ctx, network, address)
+}
+
+// StreamFraming implements networkio.StreamTransport.
+func (d *Dialer) StreamFraming() bool {
+	return d.Transport.StreamFraming()
+}
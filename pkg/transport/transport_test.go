@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeTransport is a [PluggableTransport] returning one end of an in-memory pipe.
+type fakeTransport struct {
+	uri    string
+	dialed []string
+	peer   net.Conn
+}
+
+func (ft *fakeTransport) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	ft.dialed = append(ft.dialed, network+"/"+address)
+	client, server := net.Pipe()
+	ft.peer = server
+	return client, nil
+}
+
+func (ft *fakeTransport) StreamFraming() bool {
+	return true
+}
+
+func TestRegister(t *testing.T) {
+	var (
+		created *fakeTransport
+		gotEnv  *Environment
+	)
+	factory := func(uri string, env *Environment) (PluggableTransport, error) {
+		created = &fakeTransport{uri: uri}
+		gotEnv = env
+		return created, nil
+	}
+	if err := Register("fake-register", factory); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("we cannot register the same name twice", func(t *testing.T) {
+		if err := Register("fake-register", factory); !errors.Is(err, ErrAlreadyRegistered) {
+			t.Errorf("Register() error = %v, want %v", err, ErrAlreadyRegistered)
+		}
+	})
+
+	t.Run("we cannot create an unknown transport", func(t *testing.T) {
+		if _, err := New("fake-missing", "fake://", nil); !errors.Is(err, ErrUnknownTransport) {
+			t.Errorf("New() error = %v, want %v", err, ErrUnknownTransport)
+		}
+	})
+
+	t.Run("we can dial through a registered transport", func(t *testing.T) {
+		pt, err := New("fake-register", "fake://10.0.0.1:443", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.uri != "fake://10.0.0.1:443" {
+			t.Errorf("factory got uri %q", created.uri)
+		}
+		if _, ok := gotEnv.Dialer.(*net.Dialer); !ok || gotEnv.BaseDir != "" {
+			t.Errorf("factory got env %+v, want the default env", gotEnv)
+		}
+		dialer := &Dialer{Transport: pt}
+		if !dialer.StreamFraming() {
+			t.Error("expected the dialer to use the framing of the transport")
+		}
+		conn, err := dialer.DialContext(context.Background(), "udp", "10.0.0.2:1194")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if len(created.dialed) != 1 || created.dialed[0] != "udp/10.0.0.2:1194" {
+			t.Errorf("dialed %v", created.dialed)
+		}
+		go created.peer.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := conn.Read(buf); err != nil || string(buf) != "hello" {
+			t.Errorf("Read() = %q, %v", buf, err)
+		}
+	})
+
+	t.Run("the factory gets the passed env", func(t *testing.T) {
+		env := &Environment{Dialer: &net.Dialer{Timeout: time.Second}, BaseDir: "/etc/openvpn"}
+		if _, err := New("fake-register", "fake://10.0.0.1:443", env); err != nil {
+			t.Fatal(err)
+		}
+		if gotEnv != env {
+			t.Errorf("factory got env %+v, want %+v", gotEnv, env)
+		}
+	})
+}
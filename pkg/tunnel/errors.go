@@ -0,0 +1,101 @@
+package tunnel
+
+//
+// Typed errors allowing to tell why we could not start a tunnel.
+//
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ooni/minivpn/internal/tlssession"
+	"github.com/ooni/minivpn/pkg/config"
+	"github.com/ooni/minivpn/pkg/transport"
+)
+
+// ConfigError is returned by [Start] and its variants when the config cannot work (e.g., the
+// CA or the key pair are invalid, or the pluggable transport is unknown). Retrying with the
+// same config is pointless. It wraps the underlying error, so that [errors.Is] still matches
+// the sentinel errors (e.g., [config.ErrBadConfig]).
+type ConfigError struct {
+	Err error
+}
+
+// Error implements error.
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("config error: %s", e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// TransportError is returned by [Start] and its variants when we cannot establish the
+// connection with the remote (e.g., the remote is unreachable). It wraps the dial error.
+type TransportError struct {
+	// Network and Address are the network and the address we dialed.
+	Network string
+	Address string
+
+	// Err is the dial error.
+	Err error
+}
+
+// Error implements error.
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("dial %s/%s: %s", e.Network, e.Address, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// HandshakeError is returned by [Start] and its variants when the OpenVPN handshake fails for
+// any reason other than the config or the credentials (e.g., the TLS handshake fails, or the
+// handshake does not complete in time). It wraps the underlying error, so that [errors.Is]
+// still matches, e.g., [ErrHandshakeTimeout] or [ErrNoPushReply].
+//
+// When the server rejects our credentials we return an [*AuthError] instead.
+type HandshakeError struct {
+	Err error
+}
+
+// Error implements error.
+func (e *HandshakeError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// configErrors are the sentinel errors telling that the config cannot work.
+var configErrors = []error{
+	config.ErrBadConfig,
+	tlssession.ErrBadCA,
+	tlssession.ErrBadKeypair,
+	tlssession.ErrBadTLSInit,
+	tlssession.ErrBadParrot,
+	transport.ErrUnknownTransport,
+}
+
+// newHandshakeError returns the typed error corresponding to a handshake failure, which is
+// either an [*AuthError], a [*ConfigError] or a [*HandshakeError], or nil if err is nil.
+func newHandshakeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return err
+	}
+	for _, target := range configErrors {
+		if errors.Is(err, target) {
+			return &ConfigError{Err: err}
+		}
+	}
+	return &HandshakeError{Err: err}
+}
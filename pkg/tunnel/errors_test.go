@@ -0,0 +1,132 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/minivpn/internal/testserver"
+	"github.com/ooni/minivpn/internal/tlssession"
+	"github.com/ooni/minivpn/internal/vpntest"
+	"github.com/ooni/minivpn/pkg/config"
+	"github.com/ooni/minivpn/pkg/transport"
+)
+
+func TestStartErrors(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejectingServer, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejectingServer.PushReply = "AUTH_FAILED,bad password"
+
+	// silentDialer connects to a remote that never answers
+	silentDialer := &vpntest.Dialer{
+		MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, remote := net.Pipe()
+			go io.Copy(io.Discard, remote)
+			return client, nil
+		},
+	}
+	errMocked := errors.New("mocked error")
+	failingDialer := &vpntest.Dialer{
+		MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errMocked
+		},
+	}
+
+	tests := []struct {
+		name     string
+		dialer   SimpleDialer
+		options  func() *config.OpenVPNOptions
+		check    func(err error) bool
+		sentinel error
+	}{
+		{
+			name:    "a dial failure is a transport error",
+			dialer:  failingDialer,
+			options: server.Options,
+			check: func(err error) bool {
+				var target *TransportError
+				return errors.As(err, &target) && target.Address == "10.0.0.1:1194"
+			},
+			sentinel: errMocked,
+		},
+		{
+			name:   "an unknown transport is a config error",
+			dialer: server,
+			options: func() *config.OpenVPNOptions {
+				options := server.Options()
+				options.Transport = "fake-missing"
+				return options
+			},
+			check: func(err error) bool {
+				var target *ConfigError
+				return errors.As(err, &target)
+			},
+			sentinel: transport.ErrUnknownTransport,
+		},
+		{
+			name:   "a bad CA is a config error",
+			dialer: server,
+			options: func() *config.OpenVPNOptions {
+				options := server.Options()
+				options.CA = []byte("not a certificate")
+				return options
+			},
+			check: func(err error) bool {
+				var target *ConfigError
+				return errors.As(err, &target)
+			},
+			sentinel: tlssession.ErrBadCA,
+		},
+		{
+			name:    "rejected credentials are an auth error",
+			dialer:  rejectingServer,
+			options: rejectingServer.Options,
+			check: func(err error) bool {
+				var target *AuthError
+				return errors.As(err, &target) && target.Reason == "bad password"
+			},
+		},
+		{
+			name:    "a handshake timeout is a handshake error",
+			dialer:  silentDialer,
+			options: server.Options,
+			check: func(err error) bool {
+				var target *HandshakeError
+				return errors.As(err, &target)
+			},
+			sentinel: ErrHandshakeTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewConfig(
+				config.WithLogger(log.Log),
+				config.WithOpenVPNOptions(tt.options()),
+				config.WithHandshakeTimeout(2*time.Second),
+			)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			tunnel, err := Start(ctx, tt.dialer, cfg)
+			if err == nil {
+				tunnel.Close()
+				t.Fatal("Start() succeeded")
+			}
+			if !tt.check(err) {
+				t.Errorf("Start() error = %v (%T), which is not of the expected type", err, err)
+			}
+			if tt.sentinel != nil && !errors.Is(err, tt.sentinel) {
+				t.Errorf("Start() error = %v, want %v", err, tt.sentinel)
+			}
+		})
+	}
+}
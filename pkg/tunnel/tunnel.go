@@ -3,12 +3,20 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"net"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/ooni/minivpn/internal/datachannel"
+	"github.com/ooni/minivpn/internal/model"
 	"github.com/ooni/minivpn/internal/networkio"
+	"github.com/ooni/minivpn/internal/packetmuxer"
+	"github.com/ooni/minivpn/internal/reliabletransport"
+	"github.com/ooni/minivpn/internal/tlssession"
 	"github.com/ooni/minivpn/internal/tun"
 	"github.com/ooni/minivpn/pkg/config"
+	"github.com/ooni/minivpn/pkg/transport"
 )
 
 // SimpleDialer establishes network connections.
@@ -19,15 +27,330 @@ type SimpleDialer interface {
 // We're creating a type alias to expose the internal TUN implementation on the public API.
 type TUN = tun.TUN
 
+// AuthError is the error returned by [Start] when the server rejects our credentials. Use
+// [errors.As] to obtain it and inspect the reason sent by the server.
+type AuthError = tlssession.AuthError
+
+// ErrHandshakeTimeout is returned by [Start] when the handshake does not complete within
+// the timeout configured using [config.WithHandshakeTimeout].
+var ErrHandshakeTimeout = tun.ErrHandshakeTimeout
+
+// ErrNoPushReply is returned by [Start] when the server does not answer any of the push
+// requests, whose retransmissions are configured using [config.WithPushRequestRetry].
+var ErrNoPushReply = tlssession.ErrNoPushReply
+
+// ErrHandshakeResetFailed is returned by [Start] when the server does not answer any of the
+// hard resets, whose retransmissions are configured using [config.WithHardResetRetry].
+var ErrHandshakeResetFailed = packetmuxer.ErrHandshakeResetFailed
+
+// ErrNoCommonCipher is returned by [Start] when the server pushes a data channel cipher
+// that is not among the data-ciphers we accept.
+var ErrNoCommonCipher = config.ErrNoCommonCipher
+
+// ErrHealthCheck is returned by [TUN.HealthCheck] when the tunnel does not look alive.
+var ErrHealthCheck = tun.ErrHealthCheck
+
+// ErrBadTunnelAddress is returned by [TUN.IPNet] when we cannot make sense of the address
+// or of the topology pushed by the remote.
+var ErrBadTunnelAddress = model.ErrBadTunnelAddress
+
+// RedirectGatewayFlags are the flags of the redirect-gateway directive. See [TUN.RedirectGateway].
+type RedirectGatewayFlags = model.RedirectGatewayFlags
+
+// ServerControl is a RESTART or HALT message sent by the server. See [TUN.ServerControl].
+type ServerControl = model.ServerControl
+
+// ServerControlKind tells whether a [ServerControl] asks to reconnect or terminate.
+type ServerControlKind = model.ServerControlKind
+
+const (
+	// ServerControlRestart means that the server asks us to reconnect.
+	ServerControlRestart = model.ServerControlRestart
+
+	// ServerControlHalt means that the server asks us to terminate.
+	ServerControlHalt = model.ServerControlHalt
+)
+
+// ConnectionState is the high-level state of the connection. Use [config.WithStateChangeCallback]
+// to observe its changes, and [config.Config.ConnectionState] to get the current one.
+type ConnectionState = model.ConnectionState
+
+const (
+	// ConnectionIdle means that we have not started connecting yet.
+	ConnectionIdle = model.ConnectionIdle
+
+	// ConnectionConnecting means that we are dialing the remote or performing the three-way handshake.
+	ConnectionConnecting = model.ConnectionConnecting
+
+	// ConnectionAuthenticating means that we are performing the TLS handshake and exchanging the keys.
+	ConnectionAuthenticating = model.ConnectionAuthenticating
+
+	// ConnectionConnected means that the tunnel can carry data.
+	ConnectionConnected = model.ConnectionConnected
+
+	// ConnectionReconnecting means that [StartWithRetry] or [Reconnect] is about to start a new tunnel.
+	ConnectionReconnecting = model.ConnectionReconnecting
+
+	// ConnectionClosed means that the tunnel has been closed.
+	ConnectionClosed = model.ConnectionClosed
+)
+
+// ProgressEvent tells that the handshake reached a milestone. Use [config.WithProgress] to
+// receive them as they happen.
+type ProgressEvent = model.ProgressEvent
+
+// ProgressStage is a milestone of the handshake.
+type ProgressStage = model.ProgressStage
+
+const (
+	// ProgressDialed means that we have established the connection with the remote.
+	ProgressDialed = model.ProgressDialed
+
+	// ProgressResetAcked means that the remote has answered our hard reset.
+	ProgressResetAcked = model.ProgressResetAcked
+
+	// ProgressTLSDone means that we have completed the TLS handshake.
+	ProgressTLSDone = model.ProgressTLSDone
+
+	// ProgressKeysReady means that we have exchanged the key material with the remote.
+	ProgressKeysReady = model.ProgressKeysReady
+
+	// ProgressPushReceived means that we have received the push reply.
+	ProgressPushReceived = model.ProgressPushReceived
+)
+
+// Direction tells whether a packet passed to the [config.WithCaptureSink] sink is
+// moving towards the remote or coming from it.
+type Direction = model.Direction
+
+const (
+	// DirectionIncoming marks the packets coming from the remote.
+	DirectionIncoming = model.DirectionIncoming
+
+	// DirectionOutgoing marks the packets moving towards the remote.
+	DirectionOutgoing = model.DirectionOutgoing
+)
+
+// LogLevel is the level of the least severe messages we log. See [config.VerbLogLevel].
+type LogLevel = model.LogLevel
+
+const (
+	// LogLevelWarn only emits the warnings.
+	LogLevelWarn = model.LogLevelWarn
+
+	// LogLevelInfo emits the warnings and the informational messages.
+	LogLevelInfo = model.LogLevelInfo
+
+	// LogLevelDebug emits all the messages.
+	LogLevelDebug = model.LogLevelDebug
+)
+
+// ReliabilityStats contains the control channel reliability counters. See [TUN.ReliabilityStats].
+type ReliabilityStats = reliabletransport.Stats
+
+// DataChannelStats contains the data channel counters. See [TUN.DataChannelStats].
+type DataChannelStats = datachannel.Stats
+
+// Metadata allows to introspect the tunnel returned by [Start]. Since [TUN] implements
+// [net.Conn], code that only has a [net.Conn] can obtain the metadata using a type assertion.
+type Metadata interface {
+	// TunnelIP returns the IP address assigned to us by the remote.
+	TunnelIP() net.IP
+
+	// GatewayIP returns the IP address of the gateway pushed by the remote.
+	GatewayIP() net.IP
+
+	// LocalSessionID returns our session ID.
+	LocalSessionID() []byte
+
+	// RemoteSessionID returns the session ID of the remote.
+	RemoteSessionID() []byte
+
+	// MTU returns the tun-mtu announced by the remote.
+	MTU() int
+
+	// PeerID returns the peer-id assigned to us by the remote.
+	PeerID() int
+}
+
+var _ Metadata = &TUN{}
+
 // Start starts a VPN tunnel initialized with the passed dialer and config, and returns a TUN device
 // that can later be stopped. In case there was any error during the initialization of the tunnel,
-// they will also be returned by this function.
+// they will also be returned by this function, as either a [*ConfigError], a [*TransportError],
+// an [*AuthError] or a [*HandshakeError]. When the server rejects our credentials and the
+// config sets auth-retry nointeract or interact, we retry the handshake once (see [config.AuthRetry]).
 func Start(ctx context.Context, underlyingDialer SimpleDialer, cfg *config.Config) (*TUN, error) {
-	dialer := networkio.NewDialer(cfg.Logger(), underlyingDialer)
+	tunnel, err := startOnce(ctx, underlyingDialer, cfg)
+	var authErr *AuthError
+	if err == nil || !errors.As(err, &authErr) {
+		return tunnel, err
+	}
+	switch cfg.OpenVPNOptions().AuthRetry {
+	case config.AuthRetryNoInteract, config.AuthRetryInteract:
+		cfg.Logger().Warnf("tunnel: %s: retrying (auth-retry %s)", err.Error(), cfg.OpenVPNOptions().AuthRetry)
+		cfg.SetConnectionState(model.ConnectionReconnecting)
+		return startOnce(ctx, underlyingDialer, cfg)
+	default:
+		return nil, err
+	}
+}
+
+// startOnce dials and starts the TUN without retrying.
+func startOnce(ctx context.Context, underlyingDialer SimpleDialer, cfg *config.Config) (*TUN, error) {
+	conn, err := dial(ctx, underlyingDialer, cfg)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := tun.StartTUN(ctx, conn, cfg)
+	return tunnel, newHandshakeError(err)
+}
+
+// StartAsync is like [Start], but it returns as soon as the connection is established, without
+// waiting for the handshake. Call [TUN.WaitReady] to block until the tunnel can carry data; the
+// returned TUN is closed if the handshake fails.
+func StartAsync(ctx context.Context, underlyingDialer SimpleDialer, cfg *config.Config) (*TUN, error) {
+	conn, err := dial(ctx, underlyingDialer, cfg)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := tun.StartTUNAsync(conn, cfg)
+	return tunnel, newHandshakeError(err)
+}
+
+// StartWithConn is like [Start], but runs the tunnel over a conn established by the caller
+// (e.g., by a pluggable transport) rather than dialing the remote in the config. We use the
+// datagram framing only when the config uses UDP and the conn is datagram-based, and the
+// stream framing otherwise. This function TAKES OWNERSHIP of the conn.
+func StartWithConn(ctx context.Context, conn net.Conn, cfg *config.Config) (*TUN, error) {
+	tunnel, err := tun.StartTUN(ctx, networkio.WrapConn(cfg.Remote().Protocol, conn), cfg)
+	return tunnel, newHandshakeError(err)
+}
+
+// StartWithPacketConn is like [StartWithConn], but runs the tunnel over a [net.PacketConn]
+// using the datagram framing, and exchanges packets with the given remote address. Unless the
+// config sets float, we drop the packets coming from other addresses. The config should use
+// UDP, since the OpenVPN options we send to the server depend on it.
+func StartWithPacketConn(ctx context.Context, pconn net.PacketConn, remote net.Addr, cfg *config.Config) (*TUN, error) {
+	float := cfg.OpenVPNOptions().Float
+	tunnel, err := tun.StartTUN(ctx, networkio.WrapPacketConn(pconn, remote, float), cfg)
+	return tunnel, newHandshakeError(err)
+}
+
+// dial establishes the framing connection to the remote in the passed config. When the config
+// selects a pluggable transport, we dial through the transport, which uses the passed dialer,
+// bound and tuned like the conn to the remote would be, to reach its own server.
+func dial(ctx context.Context, underlyingDialer SimpleDialer, cfg *config.Config) (networkio.FramingConn, error) {
+	cfg.SetConnectionState(model.ConnectionConnecting)
+	options := dialerOptions(underlyingDialer, cfg)
+	if name, uri := cfg.OpenVPNOptions().PluggableTransport(); name != "" {
+		env := &transport.Environment{
+			Dialer:  rawDialer{networkio.NewDialer(cfg.Logger(), underlyingDialer, options...)},
+			BaseDir: cfg.OpenVPNOptions().TransportBaseDir,
+		}
+		pt, err := transport.New(name, uri, env)
+		if err != nil {
+			log.WithError(err).Error("transport.New")
+			cfg.SetConnectionState(model.ConnectionClosed)
+			return nil, &ConfigError{Err: err}
+		}
+		// the transport tells whether we need the stream framing
+		underlyingDialer = &transport.Dialer{Transport: pt}
+		options = nil
+	}
+	dialer := networkio.NewDialer(cfg.Logger(), underlyingDialer, options...)
 	conn, err := dialer.DialContext(ctx, cfg.Remote().Protocol, cfg.Remote().Endpoint)
 	if err != nil {
 		log.WithError(err).Error("dialer.DialContext")
-		return nil, err
+		cfg.SetConnectionState(model.ConnectionClosed)
+		return nil, &TransportError{Network: cfg.Remote().Protocol, Address: cfg.Remote().Endpoint, Err: err}
+	}
+	cfg.ReportProgress(model.ProgressDialed)
+	return conn, nil
+}
+
+// dialerOptions returns the options to dial using the passed dialer, as configured by cfg.
+func dialerOptions(underlyingDialer SimpleDialer, cfg *config.Config) []networkio.DialerOption {
+	options := []networkio.DialerOption{
+		networkio.WithReadBuffer(cfg.OpenVPNOptions().RcvBuf),
+		networkio.WithWriteBuffer(cfg.OpenVPNOptions().SndBuf),
+		networkio.WithLocalAddr(cfg.OpenVPNOptions().LocalAddr()),
+		networkio.WithBindInterface(cfg.OpenVPNOptions().BindInterface),
+	}
+	// we race the addresses of dual-stack remotes only when the dialer would resolve
+	// locally anyway, since other dialers (e.g., proxies) may resolve remotely
+	if netDialer, ok := underlyingDialer.(*net.Dialer); ok {
+		resolver := netDialer.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		options = append(options, networkio.WithHappyEyeballs(resolver, 0))
+	}
+	return options
+}
+
+// rawDialer adapts [networkio.Dialer] to [transport.ContextDialer], returning the conns
+// without the OpenVPN framing, which is the business of the conns of the transport.
+type rawDialer struct {
+	dialer *networkio.Dialer
+}
+
+// DialContext implements transport.ContextDialer.
+func (d rawDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialer.DialRawContext(ctx, network, address)
+}
+
+// Reconnect closes the passed tunnel, if not nil, and starts a new one like [Start], using the
+// same dialer and config. The new tunnel dials a new connection, and uses a fresh session with
+// a new session ID. This is the building block for supervising long-running tunnels, which
+// should reconnect when the [TUN.Done] channel is closed (e.g., on ping-restart timeout).
+func Reconnect(ctx context.Context, underlyingDialer SimpleDialer, cfg *config.Config, tunnel *TUN) (*TUN, error) {
+	if tunnel != nil {
+		tunnel.Close()
+	}
+	cfg.SetConnectionState(model.ConnectionReconnecting)
+	return Start(ctx, underlyingDialer, cfg)
+}
+
+// SelfTest runs known-answer tests for all the supported data channel ciphers and HMACs,
+// and returns an error if any of them fails. Call it once at startup, before [Start].
+func SelfTest() error {
+	return datachannel.SelfTest()
+}
+
+// startFn is the function used by [StartWithRetry] to start each attempt. It is
+// monkeypatchable for testing.
+var startFn = Start
+
+// StartWithRetry is like [Start], but it performs up to attempts attempts, waiting backoff
+// between them. Each attempt dials a new connection and uses a fresh session, which is useful
+// when the handshake fails transiently (e.g., on flaky or censored links). It does not retry
+// the failures that a new attempt with the same config would not fix (e.g., a bad CA or rejected
+// credentials). It returns the error of the last attempt, or the context error if the context
+// is done while waiting.
+func StartWithRetry(ctx context.Context, underlyingDialer SimpleDialer, cfg *config.Config,
+	attempts int, backoff time.Duration) (*TUN, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var tunnel *TUN
+		if tunnel, err = startFn(ctx, underlyingDialer, cfg); err == nil {
+			return tunnel, nil
+		}
+		if attempt == attempts || tlssession.IsFatalError(err) {
+			break
+		}
+		cfg.Logger().Warnf("tunnel: attempt %d/%d failed: %s", attempt, attempts, err.Error())
+		cfg.SetConnectionState(model.ConnectionReconnecting)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
 	}
-	return tun.StartTUN(ctx, conn, cfg)
+	return nil, err
 }
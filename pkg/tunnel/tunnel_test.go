@@ -0,0 +1,755 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/ooni/minivpn/internal/model"
+	"github.com/ooni/minivpn/internal/testserver"
+	"github.com/ooni/minivpn/internal/tlssession"
+	"github.com/ooni/minivpn/internal/tun"
+	"github.com/ooni/minivpn/internal/vpntest"
+	"github.com/ooni/minivpn/pkg/config"
+	"github.com/ooni/minivpn/pkg/transport"
+)
+
+func TestStartWithRetry(t *testing.T) {
+	errHandshake := errors.New("mocked handshake error")
+
+	// mockStart fails the first failures calls, and records the number of calls.
+	mockStart := func(failures int, calls *int) func(context.Context, SimpleDialer, *config.Config) (*TUN, error) {
+		return func(context.Context, SimpleDialer, *config.Config) (*TUN, error) {
+			*calls++
+			if *calls <= failures {
+				return nil, errHandshake
+			}
+			return &TUN{}, nil
+		}
+	}
+
+	tests := []struct {
+		name      string
+		failures  int
+		attempts  int
+		wantCalls int
+		wantErr   error
+	}{
+		{"succeeds at the first attempt", 0, 3, 1, nil},
+		{"succeeds after transient failures", 2, 3, 3, nil},
+		{"fails when all the attempts fail", 3, 3, 3, errHandshake},
+		{"performs at least one attempt", 0, 0, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			startFn = mockStart(tt.failures, &calls)
+			defer func() { startFn = Start }()
+
+			cfg := config.NewConfig(config.WithLogger(model.NewTestLogger()))
+			tunnel, err := StartWithRetry(context.Background(), nil, cfg, tt.attempts, time.Millisecond)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("StartWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (err == nil) != (tunnel != nil) {
+				t.Errorf("StartWithRetry() tunnel = %v, err = %v", tunnel, err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("StartWithRetry() calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		for _, permanent := range []error{
+			tlssession.ErrBadCA,
+			tlssession.ErrBadKeypair,
+			&AuthError{Reason: "mocked"},
+			ErrNoPushReply,
+		} {
+			calls := 0
+			startFn = func(context.Context, SimpleDialer, *config.Config) (*TUN, error) {
+				calls++
+				return nil, fmt.Errorf("%w: %w", tun.ErrCannotHandshake, permanent)
+			}
+			cfg := config.NewConfig(config.WithLogger(model.NewTestLogger()))
+			_, err := StartWithRetry(context.Background(), nil, cfg, 3, time.Hour)
+			startFn = Start
+			if !errors.Is(err, permanent) {
+				t.Fatalf("StartWithRetry() error = %v, want %v", err, permanent)
+			}
+			if calls != 1 {
+				t.Errorf("StartWithRetry() calls = %d, want 1", calls)
+			}
+		}
+	})
+
+	t.Run("stops waiting when the context is done", func(t *testing.T) {
+		calls := 0
+		startFn = mockStart(10, &calls)
+		defer func() { startFn = Start }()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		cfg := config.NewConfig(config.WithLogger(model.NewTestLogger()))
+		_, err := StartWithRetry(ctx, nil, cfg, 3, time.Hour)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("StartWithRetry() error = %v, want %v", err, context.Canceled)
+		}
+		if calls != 1 {
+			t.Errorf("StartWithRetry() calls = %d, want 1", calls)
+		}
+	})
+}
+
+// countingProvider is a [config.CredentialProvider] returning a new password on each call.
+type countingProvider struct {
+	calls int
+}
+
+func (p *countingProvider) Credentials() (string, string, error) {
+	p.calls++
+	return "user", fmt.Sprintf("password%d", p.calls), nil
+}
+
+func TestStartAuthRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          config.AuthRetry
+		noCache       bool
+		wantProvider  int
+		wantPasswords []string
+	}{
+		{"none fails fast", config.AuthRetryNone, false, 1, []string{"password1"}},
+		{"the default is none", "", false, 1, []string{"password1"}},
+		{"nointeract retries with the same credentials", config.AuthRetryNoInteract, false, 1,
+			[]string{"password1", "password1"}},
+		{"nointeract with auth-nocache asks the provider again", config.AuthRetryNoInteract, true, 2,
+			[]string{"password1", "password2"}},
+		{"interact asks the provider again", config.AuthRetryInteract, false, 2,
+			[]string{"password1", "password2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := testserver.New(log.Log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the server records the passwords it receives and always rejects them
+			var (
+				mu        sync.Mutex
+				passwords []string
+			)
+			server.CheckAuth = func(username, password string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				passwords = append(passwords, password)
+				return errors.New("bad credentials")
+			}
+
+			provider := &countingProvider{}
+			options := server.Options()
+			options.AuthRetry = tt.mode
+			options.AuthNoCache = tt.noCache
+			options.CredentialProvider = provider
+			cfg := config.NewConfig(
+				config.WithLogger(log.Log),
+				config.WithOpenVPNOptions(options),
+			)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			_, err = Start(ctx, server, cfg)
+			var authErr *AuthError
+			if !errors.As(err, &authErr) {
+				t.Fatalf("Start() error = %v, want an *AuthError", err)
+			}
+			if authErr.Reason != "bad credentials" {
+				t.Errorf("AuthError.Reason = %q", authErr.Reason)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Join(passwords, ",") != strings.Join(tt.wantPasswords, ",") {
+				t.Errorf("got passwords %v, want %v", passwords, tt.wantPasswords)
+			}
+			if provider.calls != tt.wantProvider {
+				t.Errorf("got %d calls to the provider, want %d", provider.calls, tt.wantProvider)
+			}
+		})
+	}
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		errDial := errors.New("mocked dial error")
+		calls := 0
+		dialer := &vpntest.Dialer{
+			MockDialContext: func(context.Context, string, string) (net.Conn, error) {
+				calls++
+				return nil, errDial
+			},
+		}
+
+		options := &config.OpenVPNOptions{
+			Remote:    "10.0.0.1",
+			Port:      "1194",
+			Proto:     config.ProtoTCP,
+			AuthRetry: config.AuthRetryInteract,
+		}
+		cfg := config.NewConfig(
+			config.WithLogger(model.NewTestLogger()),
+			config.WithOpenVPNOptions(options),
+		)
+		if _, err := Start(context.Background(), dialer, cfg); !errors.Is(err, errDial) {
+			t.Errorf("Start() error = %v, want %v", err, errDial)
+		}
+		if calls != 1 {
+			t.Errorf("got %d attempts, want 1", calls)
+		}
+	})
+}
+
+func TestStartWithRetryConnectionStates(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first attempt fails because the remote hangs up, the second one succeeds
+	var dials atomic.Int32
+	dialer := &vpntest.Dialer{
+		MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if dials.Add(1) == 1 {
+				client, remote := net.Pipe()
+				remote.Close()
+				return client, nil
+			}
+			return server.DialContext(ctx, network, address)
+		},
+	}
+
+	// the callback runs on the workers goroutines, and it may query the state
+	var (
+		mu       sync.Mutex
+		got      []ConnectionState
+		observed []ConnectionState
+		cfg      *config.Config
+	)
+	cfg = config.NewConfig(
+		config.WithLogger(log.Log),
+		config.WithOpenVPNOptions(server.Options()),
+		config.WithStateChangeCallback(func(state ConnectionState) {
+			current := cfg.ConnectionState()
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, state)
+			observed = append(observed, current)
+		}),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := StartWithRetry(ctx, dialer, cfg, 2, time.Millisecond)
+	if err != nil {
+		t.Fatalf("StartWithRetry() error = %v", err)
+	}
+	defer tunnel.Close()
+
+	want := []ConnectionState{
+		ConnectionConnecting,
+		ConnectionClosed,
+		ConnectionReconnecting,
+		ConnectionConnecting,
+		ConnectionAuthenticating,
+		ConnectionConnected,
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected states (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(got, observed); diff != "" {
+		t.Errorf("the callback observed a different state (-notified +observed):\n%s", diff)
+	}
+	if cfg.ConnectionState() != ConnectionConnected {
+		t.Errorf("ConnectionState() = %s, want %s", cfg.ConnectionState(), ConnectionConnected)
+	}
+}
+
+func TestStartWithTestServer(t *testing.T) {
+	// the workers log concurrently, so we cannot use the testing logger
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.NewConfig(config.WithLogger(log.Log), config.WithOpenVPNOptions(server.Options()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := Start(ctx, server, cfg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tunnel.Close()
+
+	if state := cfg.ConnectionState(); state != ConnectionConnected {
+		t.Errorf("ConnectionState() = %s, want %s", state, ConnectionConnected)
+	}
+	if ip := tunnel.TunnelIP(); !ip.Equal(net.ParseIP("10.8.0.6")) {
+		t.Errorf("TunnelIP() = %v, want 10.8.0.6", ip)
+	}
+	if gw := tunnel.GatewayIP(); !gw.Equal(net.ParseIP("10.8.0.1")) {
+		t.Errorf("GatewayIP() = %v, want 10.8.0.1", gw)
+	}
+	if ip := tunnel.LocalIP(); !ip.Equal(net.ParseIP("10.8.0.6")) {
+		t.Errorf("LocalIP() = %v, want 10.8.0.6", ip)
+	}
+	// the test server pushes the subnet topology, so we use the pushed netmask
+	ipnet, err := tunnel.IPNet()
+	if err != nil || ipnet.String() != "10.8.0.6/24" {
+		t.Errorf("IPNet() = %v, %v, want 10.8.0.6/24", ipnet, err)
+	}
+}
+
+func TestStartWithTopology(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.PushReply = "PUSH_REPLY,route-gateway 10.8.0.1,topology p2p,ping 10,ping-restart 60," +
+		"ifconfig 10.8.0.6 255.255.255.0"
+	cfg := config.NewConfig(config.WithLogger(log.Log), config.WithOpenVPNOptions(server.Options()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := Start(ctx, server, cfg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tunnel.Close()
+
+	// with the p2p topology, we ignore the pushed netmask
+	ipnet, err := tunnel.IPNet()
+	if err != nil || ipnet.String() != "10.8.0.6/32" {
+		t.Errorf("IPNet() = %v, %v, want 10.8.0.6/32", ipnet, err)
+	}
+}
+
+func TestStartWithRedirectGateway(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.PushReply = testserver.DefaultPushReply + ",redirect-gateway def1 bypass-dhcp,block-outside-dns"
+	cfg := config.NewConfig(config.WithLogger(log.Log), config.WithOpenVPNOptions(server.Options()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := Start(ctx, server, cfg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tunnel.Close()
+
+	redirect, flags := tunnel.RedirectGateway()
+	if want := (RedirectGatewayFlags{Def1: true, BypassDHCP: true}); !redirect || flags != want {
+		t.Errorf("RedirectGateway() = %v, %+v, want true, %+v", redirect, flags, want)
+	}
+	if !tunnel.BlockOutsideDNS() {
+		t.Error("expected BlockOutsideDNS() to be true")
+	}
+}
+
+func TestStartWithMaxControlPayload(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the certificates do not fit in such small packets, so the server must reassemble them
+	cfg := config.NewConfig(
+		config.WithLogger(log.Log),
+		config.WithOpenVPNOptions(server.Options()),
+		config.WithMaxControlPayload(100),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := Start(ctx, server, cfg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tunnel.Close()
+	if ip := tunnel.TunnelIP(); !ip.Equal(net.ParseIP("10.8.0.6")) {
+		t.Errorf("TunnelIP() = %v, want 10.8.0.6", ip)
+	}
+}
+
+func TestStartProgress(t *testing.T) {
+	// the workers log concurrently, so we cannot use the testing logger
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := make(chan ProgressEvent, 16)
+	cfg := config.NewConfig(
+		config.WithLogger(log.Log),
+		config.WithOpenVPNOptions(server.Options()),
+		config.WithProgress(progress),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := Start(ctx, server, cfg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tunnel.Close()
+
+	want := []ProgressStage{
+		ProgressDialed,
+		ProgressResetAcked,
+		ProgressTLSDone,
+		ProgressKeysReady,
+		ProgressPushReceived,
+	}
+	var previous ProgressEvent
+	for _, stage := range want {
+		event := <-progress
+		if event.Stage != stage {
+			t.Fatalf("got stage %s, want %s", event.Stage, stage)
+		}
+		if event.Elapsed < previous.Elapsed || event.Time.Before(previous.Time) {
+			t.Errorf("stage %s happened before stage %s", event.Stage, previous.Stage)
+		}
+		previous = event
+	}
+}
+
+// test that a soft reset from the server renegotiates the keys within the same session, going
+// through the reliable transport, the control channel and the TLS session again
+func TestStartRenegotiation(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Renegotiate = make(chan struct{})
+	progress := make(chan ProgressEvent, 16)
+	cfg := config.NewConfig(
+		config.WithLogger(log.Log),
+		config.WithOpenVPNOptions(server.Options()),
+		config.WithProgress(progress),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := Start(ctx, server, cfg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tunnel.Close()
+
+	awaitPushReceived := func() {
+		for {
+			select {
+			case event := <-progress:
+				if event.Stage == ProgressPushReceived {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for the push reply")
+			}
+		}
+	}
+	awaitPushReceived()
+
+	select {
+	case server.Renegotiate <- struct{}{}:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the server to renegotiate")
+	}
+
+	// the server fails the session unless our soft reset and the TLS records of the new
+	// key restart from packet ID zero, and we only get the new push reply if we accept the
+	// server packets of the new key, whose IDs restart from zero as well
+	awaitPushReceived()
+}
+
+func TestStartWithConn(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.NewConfig(config.WithLogger(log.Log), config.WithOpenVPNOptions(server.Options()))
+
+	// the caller owns the transport: here, an in-memory pipe served by the test server
+	client, serverConn := net.Pipe()
+	go server.Serve(serverConn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := StartWithConn(ctx, client, cfg)
+	if err != nil {
+		t.Fatalf("StartWithConn() error = %v", err)
+	}
+	defer tunnel.Close()
+
+	if state := cfg.ConnectionState(); state != ConnectionConnected {
+		t.Errorf("ConnectionState() = %s, want %s", state, ConnectionConnected)
+	}
+	if ip := tunnel.TunnelIP(); !ip.Equal(net.ParseIP("10.8.0.6")) {
+		t.Errorf("TunnelIP() = %v, want 10.8.0.6", ip)
+	}
+}
+
+func TestStartHandshakeTimeout(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.NewConfig(
+		config.WithLogger(log.Log),
+		config.WithOpenVPNOptions(server.Options()),
+		config.WithHandshakeTimeout(200*time.Millisecond),
+	)
+
+	// the remote accepts the connection but never answers
+	dialer := &vpntest.Dialer{
+		MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, remote := net.Pipe()
+			go io.Copy(io.Discard, remote)
+			return client, nil
+		},
+	}
+
+	start := time.Now()
+	_, err = Start(context.Background(), dialer, cfg)
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Start() error = %v, want %v", err, ErrHandshakeTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Start() took %v, want about 200ms", elapsed)
+	}
+	if state := cfg.ConnectionState(); state != ConnectionClosed {
+		t.Errorf("ConnectionState() = %s, want %s", state, ConnectionClosed)
+	}
+}
+
+func TestStartCanceledDuringKeyExchange(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server completes the TLS handshake but never sends its key material
+	server.NoAuthReply = true
+	progress := make(chan ProgressEvent, 16)
+	cfg := config.NewConfig(
+		config.WithLogger(log.Log),
+		config.WithOpenVPNOptions(server.Options()),
+		config.WithProgress(progress),
+		config.WithHandshakeTimeout(time.Minute),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errch := make(chan error, 1)
+	go func() {
+		_, err := Start(ctx, server, cfg)
+		errch <- err
+	}()
+
+	// cancel as soon as we are waiting for the key material
+	for event := range progress {
+		if event.Stage == ProgressTLSDone {
+			break
+		}
+	}
+	cancel()
+	canceled := time.Now()
+
+	select {
+	case err := <-errch:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Start() error = %v, want %v", err, context.Canceled)
+		}
+		var handshakeErr *HandshakeError
+		if !errors.As(err, &handshakeErr) {
+			t.Errorf("Start() error = %T, want %T", err, handshakeErr)
+		}
+		if elapsed := time.Since(canceled); elapsed > 5*time.Second {
+			t.Errorf("Start() returned %v after the cancellation", elapsed)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Start() did not return after the cancellation")
+	}
+	if state := cfg.ConnectionState(); state != ConnectionClosed {
+		t.Errorf("ConnectionState() = %s, want %s", state, ConnectionClosed)
+	}
+}
+
+// testServerTransport is a [transport.PluggableTransport] reaching a test server, which it
+// pretends to reach through its own server at address, using the dialer of the environment.
+type testServerTransport struct {
+	address string
+	env     *transport.Environment
+	dialed  chan string
+}
+
+func (tt *testServerTransport) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	tt.dialed <- network + "/" + address
+	return tt.env.Dialer.DialContext(ctx, "tcp", tt.address)
+}
+
+func (tt *testServerTransport) StreamFraming() bool {
+	return true
+}
+
+func TestStartWithPluggableTransport(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt := &testServerTransport{dialed: make(chan string, 1)}
+	var uri string
+	err = transport.Register("fake-testserver", func(u string, env *transport.Environment) (transport.PluggableTransport, error) {
+		uri = u
+		pt.address = strings.TrimPrefix(u, "fake://")
+		pt.env = env
+		return pt, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the transport carries a byte stream even if the config uses UDP
+	options := server.Options()
+	options.Proto = config.ProtoUDP
+	options.Transport = "fake-testserver"
+	options.TransportURI = "fake://10.0.0.1:443"
+	options.TransportBaseDir = "/etc/openvpn"
+	cfg := config.NewConfig(config.WithLogger(log.Log), config.WithOpenVPNOptions(options))
+
+	// the transport reaches its own server using the passed dialer
+	underlying := make(chan string, 1)
+	dialer := &vpntest.Dialer{
+		MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			underlying <- network + "/" + address
+			return server.DialContext(ctx, network, address)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tunnel, err := Start(ctx, dialer, cfg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer tunnel.Close()
+
+	if uri != "fake://10.0.0.1:443" {
+		t.Errorf("factory got uri %q", uri)
+	}
+	if pt.env.BaseDir != "/etc/openvpn" {
+		t.Errorf("factory got base dir %q", pt.env.BaseDir)
+	}
+	if dialed := <-underlying; dialed != "tcp/10.0.0.1:443" {
+		t.Errorf("the passed dialer dialed %q", dialed)
+	}
+	if dialed := <-pt.dialed; dialed != "udp/10.0.0.1:1194" {
+		t.Errorf("dialed %q", dialed)
+	}
+	if ip := tunnel.TunnelIP(); !ip.Equal(net.ParseIP("10.8.0.6")) {
+		t.Errorf("TunnelIP() = %v, want 10.8.0.6", ip)
+	}
+
+	t.Run("an unknown transport is an error", func(t *testing.T) {
+		options := server.Options()
+		options.Transport = "fake-missing"
+		cfg := config.NewConfig(config.WithLogger(log.Log), config.WithOpenVPNOptions(options))
+		dialer := &vpntest.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				t.Error("unexpected dial using the passed dialer")
+				return nil, errors.New("mocked error")
+			},
+		}
+		if _, err := Start(ctx, dialer, cfg); !errors.Is(err, transport.ErrUnknownTransport) {
+			t.Errorf("Start() error = %v, want %v", err, transport.ErrUnknownTransport)
+		}
+	})
+}
+
+func TestReconnect(t *testing.T) {
+	server, err := testserver.New(log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.NewConfig(config.WithLogger(log.Log), config.WithOpenVPNOptions(server.Options()))
+
+	// we keep the server side of each conn, to simulate a drop
+	remotes := make(chan net.Conn, 2)
+	dialer := &vpntest.Dialer{
+		MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, remote := net.Pipe()
+			remotes <- remote
+			go server.Serve(remote)
+			return client, nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	first, err := Start(ctx, dialer, cfg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	firstID := append([]byte{}, first.LocalSessionID()...)
+
+	// the remote goes away and the tunnel dies
+	(<-remotes).Close()
+	select {
+	case <-first.Done():
+	case <-ctx.Done():
+		t.Fatal("the tunnel did not notice the drop")
+	}
+
+	second, err := Reconnect(ctx, dialer, cfg, first)
+	if err != nil {
+		t.Fatalf("Reconnect() error = %v", err)
+	}
+	defer second.Close()
+
+	if bytes.Equal(second.LocalSessionID(), firstID) {
+		t.Errorf("Reconnect() reused the session ID %x", firstID)
+	}
+	if state := cfg.ConnectionState(); state != ConnectionConnected {
+		t.Errorf("ConnectionState() = %s, want %s", state, ConnectionConnected)
+	}
+	if ip := second.TunnelIP(); !ip.Equal(net.ParseIP("10.8.0.6")) {
+		t.Errorf("TunnelIP() = %v, want 10.8.0.6", ip)
+	}
+}
+
+// test that programs can use the config options taking internal types through our aliases.
+func TestPublicAliases(t *testing.T) {
+	var got []Direction
+	sink := func(direction Direction, packet []byte) {
+		got = append(got, direction)
+	}
+	cfg := config.NewConfig(config.WithCaptureSink(sink))
+	cfg.CaptureSink()(DirectionIncoming, nil)
+	cfg.CaptureSink()(DirectionOutgoing, nil)
+	if len(got) != 2 || got[0] != DirectionIncoming || got[1] != DirectionOutgoing {
+		t.Errorf("the sink got %v", got)
+	}
+
+	for verb, want := range map[int]LogLevel{0: LogLevelWarn, 3: LogLevelInfo, 5: LogLevelDebug} {
+		if level := config.VerbLogLevel(verb); level != want {
+			t.Errorf("VerbLogLevel(%d) = %v, want %v", verb, level, want)
+		}
+	}
+}
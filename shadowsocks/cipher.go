@@ -0,0 +1,74 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// subkeyInfo is the HKDF info used to derive the session subkey from the master key.
+var subkeyInfo = []byte("ss-subkey")
+
+// aeadCipher is an AEAD cipher of the shadowsocks protocol.
+type aeadCipher struct {
+	// keySize is the size of the key and of the salt.
+	keySize int
+
+	// newAEAD creates the AEAD from the session subkey.
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// ciphers maps the name of each supported method to its cipher.
+var ciphers = map[string]aeadCipher{
+	"aes-128-gcm":            {keySize: 16, newAEAD: newGCM},
+	"aes-256-gcm":            {keySize: 32, newAEAD: newGCM},
+	"chacha20-ietf-poly1305": {keySize: 32, newAEAD: chacha20poly1305.New},
+}
+
+// newGCM creates an AES-GCM AEAD from the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// masterKey derives the master key from the password, like OpenSSL's EVP_BytesToKey
+// with MD5, a single iteration and no salt, which is what shadowsocks uses.
+func (c aeadCipher) masterKey(password string) []byte {
+	var key, prev []byte
+	for len(key) < c.keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:c.keySize]
+}
+
+// sessionAEAD derives the session subkey from the master key and the salt, and returns
+// the AEAD to seal or open the chunks of one direction of the stream.
+func (c aeadCipher) sessionAEAD(key, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.keySize)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, subkeyInfo), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// incrementNonce increments the nonce, which is a little endian counter.
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxChunkSize is the maximum size of the payload of a chunk.
+const maxChunkSize = 0x3fff
+
+// ErrBadChunk indicates that we could not authenticate a chunk sent by the proxy.
+var ErrBadChunk = errors.New("shadowsocks: cannot authenticate chunk")
+
+// conn is a [net.Conn] that encrypts the stream using the shadowsocks AEAD construction:
+// each direction starts with a random salt, followed by chunks consisting of the sealed two
+// bytes length of the payload and of the sealed payload, using an incrementing nonce.
+type conn struct {
+	net.Conn
+
+	// cipher is the cipher to use.
+	cipher aeadCipher
+
+	// key is the master key.
+	key []byte
+
+	// rand is the source of the salt we send.
+	rand io.Reader
+
+	// writeMu serializes the writes.
+	writeMu sync.Mutex
+
+	// writer seals the chunks we write, and writeNonce is its nonce. We initialize
+	// the writer and send the salt on the first write.
+	writer     cipher.AEAD
+	writeNonce []byte
+
+	// reader opens the chunks we read, and readNonce is its nonce. We initialize
+	// the reader when we receive the salt on the first read.
+	reader    cipher.AEAD
+	readNonce []byte
+
+	// pending contains the plaintext we read but did not return yet.
+	pending []byte
+}
+
+// newConn wraps the given conn using the given cipher and master key.
+func newConn(c net.Conn, ciph aeadCipher, key []byte) *conn {
+	return &conn{Conn: c, cipher: ciph, key: key, rand: rand.Reader}
+}
+
+// Write implements net.Conn
+func (c *conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var out []byte
+	if c.writer == nil {
+		salt := make([]byte, c.cipher.keySize)
+		if _, err := io.ReadFull(c.rand, salt); err != nil {
+			return 0, err
+		}
+		writer, err := c.cipher.sessionAEAD(c.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		c.writer, c.writeNonce = writer, make([]byte, writer.NonceSize())
+		out = salt
+	}
+
+	for offset := 0; offset < len(b); offset += maxChunkSize {
+		end := offset + maxChunkSize
+		if end > len(b) {
+			end = len(b)
+		}
+		length := binary.BigEndian.AppendUint16(nil, uint16(end-offset))
+		out = c.writer.Seal(out, c.writeNonce, length, nil)
+		incrementNonce(c.writeNonce)
+		out = c.writer.Seal(out, c.writeNonce, b[offset:end], nil)
+		incrementNonce(c.writeNonce)
+	}
+
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read implements net.Conn
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		payload, err := c.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = payload
+	}
+	count := copy(b, c.pending)
+	c.pending = c.pending[count:]
+	return count, nil
+}
+
+// readChunk reads and opens the next chunk, reading the salt first if needed.
+func (c *conn) readChunk() ([]byte, error) {
+	if c.reader == nil {
+		salt := make([]byte, c.cipher.keySize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return nil, err
+		}
+		reader, err := c.cipher.sessionAEAD(c.key, salt)
+		if err != nil {
+			return nil, err
+		}
+		c.reader, c.readNonce = reader, make([]byte, reader.NonceSize())
+	}
+
+	length, err := c.open(2)
+	if err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(length)) & maxChunkSize
+	return c.open(size)
+}
+
+// open reads and opens a sealed field whose plaintext has the given size.
+func (c *conn) open(size int) ([]byte, error) {
+	sealed := make([]byte, size+c.reader.Overhead())
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.reader.Open(sealed[:0], c.readNonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadChunk, err)
+	}
+	incrementNonce(c.readNonce)
+	return plaintext, nil
+}
@@ -0,0 +1,8 @@
+// Package shadowsocks allows to reach the OpenVPN remote through a shadowsocks proxy, using
+// the AEAD ciphers of the shadowsocks protocol. The proxy relays a TCP stream to the remote, so
+// the remote must accept TCP connections, and the OpenVPN packets use the stream framing even
+// when the config uses UDP. Importing this package registers the "ss" pluggable transport,
+// which is selected using the proto-ss directive with a SIP002 URI, in this format:
+//
+//	proto-ss ss://BASE64URL(METHOD:PASSWORD)@RHOST:RPORT
+package shadowsocks
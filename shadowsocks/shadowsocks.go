@@ -0,0 +1,186 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ooni/minivpn/pkg/transport"
+)
+
+var (
+	// ErrBadURI indicates that we cannot parse the ss://... URI.
+	ErrBadURI = errors.New("shadowsocks: invalid uri")
+
+	// ErrUnsupportedMethod indicates that we do not support the method in the URI.
+	ErrUnsupportedMethod = errors.New("shadowsocks: unsupported method")
+
+	// ErrBadAddress indicates that we cannot encode the address to dial.
+	ErrBadAddress = errors.New("shadowsocks: invalid address")
+)
+
+// The address types of the target address we send to the proxy.
+const (
+	addrTypeIPv4   = 1
+	addrTypeDomain = 3
+	addrTypeIPv6   = 4
+)
+
+func init() {
+	if err := transport.Register("ss", NewTransport); err != nil {
+		panic(err)
+	}
+}
+
+// Config contains the parameters to reach a shadowsocks proxy.
+type Config struct {
+	// Server is the address of the proxy, in the host:port format.
+	Server string
+
+	// Method is the name of the AEAD cipher (e.g., chacha20-ietf-poly1305).
+	Method string
+
+	// Password is the password from which we derive the master key.
+	Password string
+}
+
+// ParseURI parses a SIP002 URI, in the ss://USERINFO@HOST:PORT format, where USERINFO is
+// either METHOD:PASSWORD, percent-encoded, or its base64url encoding.
+func ParseURI(uri string) (*Config, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadURI, err)
+	}
+	if u.Scheme != "ss" || u.User == nil || u.Port() == "" {
+		return nil, fmt.Errorf("%w: %s", ErrBadURI, "expected ss://USERINFO@HOST:PORT")
+	}
+	method, password, found := u.User.Username(), "", false
+	if password, found = u.User.Password(); !found {
+		method, password, found = decodeUserInfo(u.User.Username())
+	}
+	if !found || method == "" {
+		return nil, fmt.Errorf("%w: %s", ErrBadURI, "cannot parse the method and the password")
+	}
+	if _, ok := ciphers[strings.ToLower(method)]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, method)
+	}
+	cfg := &Config{
+		Server:   u.Host,
+		Method:   strings.ToLower(method),
+		Password: password,
+	}
+	return cfg, nil
+}
+
+// decodeUserInfo decodes the base64 encoding of METHOD:PASSWORD, with or without padding.
+func decodeUserInfo(userinfo string) (string, string, bool) {
+	encodings := []*base64.Encoding{
+		base64.RawURLEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.StdEncoding,
+	}
+	for _, encoding := range encodings {
+		if decoded, err := encoding.DecodeString(userinfo); err == nil {
+			return strings.Cut(string(decoded), ":")
+		}
+	}
+	return "", "", false
+}
+
+// encodeAddress encodes the address the proxy should connect to, using the SOCKS5 format.
+func encodeAddress(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadAddress, err)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadAddress, err)
+	}
+	var out []byte
+	switch ip := net.ParseIP(host); {
+	case ip != nil && ip.To4() != nil:
+		out = append([]byte{addrTypeIPv4}, ip.To4()...)
+	case ip != nil:
+		out = append([]byte{addrTypeIPv6}, ip.To16()...)
+	case len(host) > 0 && len(host) <= 255:
+		out = append([]byte{addrTypeDomain, byte(len(host))}, host...)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrBadAddress, host)
+	}
+	return append(out, byte(port>>8), byte(port)), nil
+}
+
+// Transport is the shadowsocks [transport.PluggableTransport].
+type Transport struct {
+	config *Config
+	cipher aeadCipher
+	key    []byte
+
+	// dialer is the dialer we use to reach the proxy.
+	dialer transport.ContextDialer
+}
+
+var _ transport.PluggableTransport = &Transport{}
+
+// New returns a [Transport] reaching the proxy in the given config, which dials directly.
+func New(config *Config) (*Transport, error) {
+	ciph, found := ciphers[config.Method]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, config.Method)
+	}
+	t := &Transport{
+		config: config,
+		cipher: ciph,
+		key:    ciph.masterKey(config.Password),
+		dialer: &net.Dialer{},
+	}
+	return t, nil
+}
+
+// NewTransport returns the [Transport] for the proxy at the given ss://... URI, which reaches
+// the proxy using the dialer of the environment.
+func NewTransport(uri string, env *transport.Environment) (transport.PluggableTransport, error) {
+	config, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	t, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	if env.Dialer != nil {
+		t.dialer = env.Dialer
+	}
+	return t, nil
+}
+
+// Dial implements transport.PluggableTransport. It connects to the proxy, and asks it to
+// connect to the given address using TCP, regardless of the network.
+func (t *Transport) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	target, err := encodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.dialer.DialContext(ctx, "tcp", t.config.Server)
+	if err != nil {
+		return nil, err
+	}
+	sc := newConn(c, t.cipher, t.key)
+	if _, err := sc.Write(target); err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// StreamFraming implements transport.PluggableTransport. The proxy relays a byte stream.
+func (t *Transport) StreamFraming() bool {
+	return true
+}
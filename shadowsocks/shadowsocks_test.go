@@ -0,0 +1,394 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/ooni/minivpn/pkg/transport"
+)
+
+func TestParseURI(t *testing.T) {
+	userinfo := base64.RawURLEncoding.EncodeToString([]byte("chacha20-ietf-poly1305:s3cr:t"))
+	tests := []struct {
+		name    string
+		uri     string
+		want    Config
+		wantErr error
+	}{
+		{
+			name: "base64url userinfo",
+			uri:  "ss://" + userinfo + "@10.0.0.1:8388",
+			want: Config{Server: "10.0.0.1:8388", Method: "chacha20-ietf-poly1305", Password: "s3cr:t"},
+		},
+		{
+			name: "plain userinfo",
+			uri:  "ss://AES-256-GCM:pass%40word@[2001:db8::1]:8388/?plugin=",
+			want: Config{Server: "[2001:db8::1]:8388", Method: "aes-256-gcm", Password: "pass@word"},
+		},
+		{name: "wrong scheme", uri: "obfs4://" + userinfo + "@10.0.0.1:8388", wantErr: ErrBadURI},
+		{name: "missing userinfo", uri: "ss://10.0.0.1:8388", wantErr: ErrBadURI},
+		{name: "missing port", uri: "ss://" + userinfo + "@10.0.0.1", wantErr: ErrBadURI},
+		{name: "bad userinfo", uri: "ss://!!!@10.0.0.1:8388", wantErr: ErrBadURI},
+		{name: "stream ciphers are not supported", uri: "ss://rc4-md5:pass@10.0.0.1:8388", wantErr: ErrUnsupportedMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseURI(tt.uri)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseURI() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("ParseURI() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_encodeAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    []byte
+		wantErr error
+	}{
+		{"10.0.0.1:1194", []byte{1, 10, 0, 0, 1, 0x04, 0xaa}, nil},
+		{"[::1]:443", append(append([]byte{4}, net.IPv6loopback...), 0x01, 0xbb), nil},
+		{"vpn.example.org:1194", append(append([]byte{3, 15}, "vpn.example.org"...), 0x04, 0xaa), nil},
+		{"10.0.0.1", nil, ErrBadAddress},
+		{"10.0.0.1:65536", nil, ErrBadAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got, err := encodeAddress(tt.address)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("encodeAddress() error = %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("encodeAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// readAddress reads a target address in the SOCKS5 format, like the proxy does.
+func readAddress(r io.Reader) (string, error) {
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(r, kind); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch kind[0] {
+	case addrTypeIPv4:
+		host = make([]byte, net.IPv4len)
+	case addrTypeIPv6:
+		host = make([]byte, net.IPv6len)
+	default:
+		return "", ErrBadAddress
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(net.IP(host).String(), strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// stubAEAD seals or opens the chunks of one direction of a stream, like a shadowsocks
+// server does. We implement it independently of [conn], to test that they interoperate.
+type stubAEAD struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+// newStubAEAD derives the session subkey for the given method, password and salt.
+func newStubAEAD(method, password string, salt []byte) (*stubAEAD, error) {
+	// the master key is EVP_BytesToKey(MD5), and the subkey is HKDF-SHA1(master key, salt)
+	var master, prev []byte
+	for len(master) < len(salt) {
+		sum := md5.Sum(append(prev, password...))
+		prev = sum[:]
+		master = append(master, prev...)
+	}
+	subkey := make([]byte, len(salt))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, master[:len(salt)], salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	var (
+		aead cipher.AEAD
+		err  error
+	)
+	if method == "chacha20-ietf-poly1305" {
+		aead, err = chacha20poly1305.New(subkey)
+	} else {
+		var block cipher.Block
+		if block, err = aes.NewCipher(subkey); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stubAEAD{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+// next increments the little endian nonce.
+func (s *stubAEAD) next() {
+	for i := 0; i < len(s.nonce); i++ {
+		if s.nonce[i]++; s.nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// writeChunk seals the payload as a single chunk and writes it.
+func (s *stubAEAD) writeChunk(w io.Writer, payload []byte) error {
+	out := s.aead.Seal(nil, s.nonce, []byte{byte(len(payload) >> 8), byte(len(payload))}, nil)
+	s.next()
+	out = s.aead.Seal(out, s.nonce, payload, nil)
+	s.next()
+	_, err := w.Write(out)
+	return err
+}
+
+// readChunk reads and opens the next chunk.
+func (s *stubAEAD) readChunk(r io.Reader) ([]byte, error) {
+	sealed := make([]byte, 2+s.aead.Overhead())
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	length, err := s.aead.Open(nil, s.nonce, sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.next()
+	sealed = make([]byte, (int(length[0])<<8|int(length[1]))&0x3fff+s.aead.Overhead())
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	payload, err := s.aead.Open(nil, s.nonce, sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.next()
+	return payload, nil
+}
+
+// runStubProxy runs a shadowsocks proxy relaying the first connection to its target.
+func runStubProxy(t *testing.T, method, password string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		client, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+
+		// the client sends its salt, followed by the chunks
+		salt := make([]byte, ciphers[method].keySize)
+		if _, err := io.ReadFull(client, salt); err != nil {
+			t.Error(err)
+			return
+		}
+		up, err := newStubAEAD(method, password, salt)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		header, err := up.readChunk(client)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		target, err := readAddress(bytes.NewReader(header))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		remote, err := net.Dial("tcp", target)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer remote.Close()
+		go func() {
+			for {
+				payload, err := up.readChunk(client)
+				if err != nil {
+					return
+				}
+				if _, err := remote.Write(payload); err != nil {
+					return
+				}
+			}
+		}()
+
+		// we answer with our own salt, followed by the chunks
+		if _, err := rand.Read(salt); err != nil {
+			t.Error(err)
+			return
+		}
+		down, err := newStubAEAD(method, password, salt)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := client.Write(salt); err != nil {
+			return
+		}
+		buf := make([]byte, 4096)
+		for {
+			count, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := down.writeChunk(client, buf[:count]); err != nil {
+				return
+			}
+		}
+	}()
+	return listener
+}
+
+// runEchoServer runs a TCP server echoing what it reads on the first connection.
+func runEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+	return listener
+}
+
+func TestTransport(t *testing.T) {
+	for method := range ciphers {
+		t.Run(method, func(t *testing.T) {
+			proxy := runStubProxy(t, method, "s3cret")
+			defer proxy.Close()
+			echo := runEchoServer(t)
+			defer echo.Close()
+
+			userinfo := base64.RawURLEncoding.EncodeToString([]byte(method + ":s3cret"))
+			pt, err := NewTransport("ss://"+userinfo+"@"+proxy.Addr().String(), &transport.Environment{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pt.StreamFraming() {
+				t.Error("expected the stream framing")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := pt.Dial(ctx, "udp", echo.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			// a message larger than a chunk spans several chunks
+			messages := [][]byte{[]byte("hello"), bytes.Repeat([]byte{0xab}, 3*maxChunkSize+7)}
+			for _, message := range messages {
+				if _, err := conn.Write(message); err != nil {
+					t.Fatal(err)
+				}
+				got := make([]byte, len(message))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, message) {
+					t.Errorf("got %d bytes back, which differ from the %d we sent", len(got), len(message))
+				}
+			}
+		})
+	}
+}
+
+func TestConnKnownVector(t *testing.T) {
+	// the stream we expect for the given salt and payload, computed with an independent
+	// implementation of EVP_BytesToKey, HKDF-SHA1 and ChaCha20-Poly1305 (RFC 8439)
+	const stream = "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20" +
+		"31376a52fb6f36bcac60b1c983bfb579d74d" +
+		"c1d186b644eef2ec661549b0143000f135d1f1e65d8029696356906ae4965afcf3e8"
+	want, _ := hex.DecodeString(stream)
+	salt, payload := want[:32], []byte("hello, shadowsocks")
+	ciph := ciphers["chacha20-ietf-poly1305"]
+
+	t.Run("we write the expected stream", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		sender := newConn(client, ciph, ciph.masterKey("s3cret"))
+		sender.rand = bytes.NewReader(salt)
+		go sender.Write(payload)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Write() sent %x, want %x", got, want)
+		}
+	})
+
+	t.Run("we read the expected payload", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		receiver := newConn(client, ciph, ciph.masterKey("s3cret"))
+		go server.Write(want)
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(receiver, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("Read() = %q, want %q", got, payload)
+		}
+	})
+}
+
+func TestConnRejectsWrongKey(t *testing.T) {
+	client, server := net.Pipe()
+	ciph := ciphers["aes-128-gcm"]
+	sender := newConn(client, ciph, ciph.masterKey("right"))
+	receiver := newConn(server, ciph, ciph.masterKey("wrong"))
+	go sender.Write([]byte("hello"))
+	if _, err := receiver.Read(make([]byte, 16)); !errors.Is(err, ErrBadChunk) {
+		t.Errorf("Read() error = %v, want %v", err, ErrBadChunk)
+	}
+}
+
+func Test_aeadCipher_masterKey(t *testing.T) {
+	// the first block is MD5(password), and the second one is MD5(first block || password)
+	key := ciphers["aes-256-gcm"].masterKey("password")
+	want := "5f4dcc3b5aa765d61d8327deb882cf99"
+	if got := hex.EncodeToString(key[:16]); got != want {
+		t.Errorf("masterKey() = %s, want %s...", hex.EncodeToString(key), want)
+	}
+	if len(key) != 32 {
+		t.Errorf("len(masterKey()) = %d, want 32", len(key))
+	}
+}
@@ -0,0 +1,15 @@
+// Package stunnel allows to reach the OpenVPN remote through an outer TLS connection, as
+// done by deployments that put stunnel (or a similar TLS terminator) in front of an OpenVPN
+// TCP server, so that the traffic looks like HTTPS. We perform the outer TLS handshake first,
+// and then run OpenVPN inside it: the remote must accept TCP connections, and the OpenVPN
+// packets use the stream framing even when the config uses UDP. Importing this package
+// registers the "stunnel" pluggable transport, which is selected using the proto-stunnel
+// directive with a URI in this format:
+//
+//	proto-stunnel stunnel://[HOST:PORT][?sni=NAME][&ca=PATH]
+//
+// HOST:PORT is the address of the TLS terminator, which defaults to the remote. NAME is the
+// server name we send and verify, which defaults to the host we dial. PATH is a file
+// containing the PEM-encoded CA certificates to verify the terminator, and, when missing,
+// we use the system roots. A relative PATH is relative to the current directory.
+package stunnel
@@ -0,0 +1,147 @@
+package stunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/ooni/minivpn/pkg/transport"
+)
+
+var (
+	// ErrBadURI indicates that we cannot parse the stunnel://... URI.
+	ErrBadURI = errors.New("stunnel: invalid uri")
+
+	// ErrBadCA indicates that we cannot load the CA certificates.
+	ErrBadCA = errors.New("stunnel: cannot load ca")
+)
+
+func init() {
+	if err := transport.Register("stunnel", NewTransport); err != nil {
+		panic(err)
+	}
+}
+
+// Config contains the parameters to reach the remote through the outer TLS connection.
+type Config struct {
+	// Server is the OPTIONAL address of the TLS terminator, in the host:port format. When
+	// empty, we establish the outer TLS connection with the remote itself.
+	Server string
+
+	// SNI is the OPTIONAL server name we send and verify. When empty, we use the host we dial.
+	SNI string
+
+	// CA contains the OPTIONAL PEM-encoded CA certificates to verify the TLS terminator.
+	// When empty, we use the system roots.
+	CA []byte
+}
+
+// ParseURI parses a URI in the stunnel://[HOST:PORT][?sni=NAME][&ca=PATH] format, reading
+// the CA certificates from PATH, if present. We resolve a relative PATH against baseDir
+// (e.g., the directory of the config file) or, when baseDir is empty, the current directory.
+func ParseURI(uri, baseDir string) (*Config, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadURI, err)
+	}
+	if u.Scheme != "stunnel" || u.User != nil || (u.Host != "" && u.Port() == "") {
+		return nil, fmt.Errorf("%w: %s", ErrBadURI, "expected stunnel://[HOST:PORT][?sni=NAME][&ca=PATH]")
+	}
+	query := u.Query()
+	cfg := &Config{
+		Server: u.Host,
+		SNI:    query.Get("sni"),
+	}
+	if path := query.Get("ca"); path != "" {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		if cfg.CA, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadCA, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Transport is the stunnel [transport.PluggableTransport].
+type Transport struct {
+	config *Config
+
+	// rootCAs is the pool to verify the TLS terminator, or nil to use the system roots.
+	rootCAs *x509.CertPool
+
+	// dialer is the dialer we use to reach the TLS terminator.
+	dialer transport.ContextDialer
+}
+
+var _ transport.PluggableTransport = &Transport{}
+
+// New returns a [Transport] using the given config, which dials directly.
+func New(config *Config) (*Transport, error) {
+	t := &Transport{config: config, dialer: &net.Dialer{}}
+	if len(config.CA) != 0 {
+		t.rootCAs = x509.NewCertPool()
+		if !t.rootCAs.AppendCertsFromPEM(config.CA) {
+			return nil, fmt.Errorf("%w: %s", ErrBadCA, "no certificates found")
+		}
+	}
+	return t, nil
+}
+
+// NewTransport returns the [Transport] for the given stunnel://... URI, which reaches the TLS
+// terminator using the dialer of the environment, and reads the CA relative to its BaseDir.
+func NewTransport(uri string, env *transport.Environment) (transport.PluggableTransport, error) {
+	config, err := ParseURI(uri, env.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+	t, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	if env.Dialer != nil {
+		t.dialer = env.Dialer
+	}
+	return t, nil
+}
+
+// Dial implements transport.PluggableTransport. It connects to the TLS terminator using TCP,
+// regardless of the network, and returns the conn once the outer TLS handshake is complete.
+func (t *Transport) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if t.config.Server != "" {
+		address = t.config.Server
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	sni := t.config.SNI
+	if sni == "" {
+		sni = host
+	}
+	c, err := t.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(c, &tls.Config{
+		ServerName: sni,
+		RootCAs:    t.rootCAs,
+		MinVersion: tls.VersionTLS12,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// StreamFraming implements transport.PluggableTransport. The outer TLS conn carries a byte stream.
+func (t *Transport) StreamFraming() bool {
+	return true
+}
@@ -0,0 +1,230 @@
+package stunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ooni/minivpn/pkg/transport"
+)
+
+func TestParseURI(t *testing.T) {
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caPath, []byte("ca"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		uri     string
+		want    Config
+		wantErr error
+	}{
+		{
+			name: "server, sni and ca",
+			uri:  "stunnel://10.0.0.1:443?sni=www.example.org&ca=" + caPath,
+			want: Config{Server: "10.0.0.1:443", SNI: "www.example.org", CA: []byte("ca")},
+		},
+		{
+			name: "we default to the remote",
+			uri:  "stunnel://",
+			want: Config{},
+		},
+		{name: "wrong scheme", uri: "ss://10.0.0.1:443", wantErr: ErrBadURI},
+		{name: "missing port", uri: "stunnel://10.0.0.1", wantErr: ErrBadURI},
+		{name: "userinfo", uri: "stunnel://user@10.0.0.1:443", wantErr: ErrBadURI},
+		{name: "missing ca", uri: "stunnel://?ca=" + filepath.Join(t.TempDir(), "missing.pem"), wantErr: ErrBadCA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseURI(tt.uri, "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseURI() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Server != tt.want.Server || got.SNI != tt.want.SNI || !bytes.Equal(got.CA, tt.want.CA) {
+				t.Errorf("ParseURI() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+	t.Run("we resolve a relative ca against the base dir", func(t *testing.T) {
+		got, err := ParseURI("stunnel://?ca=ca.pem", filepath.Dir(caPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.CA, []byte("ca")) {
+			t.Errorf("CA = %q, want %q", got.CA, "ca")
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(&Config{CA: []byte("not a certificate")}); !errors.Is(err, ErrBadCA) {
+		t.Errorf("New() error = %v, want %v", err, ErrBadCA)
+	}
+}
+
+// newTestingCertificate returns a self-signed certificate valid for the given name and for
+// the loopback address, and the PEM encoding of the certificate, to use as the CA.
+func newTestingCertificate(t *testing.T, name string) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// startEchoServer starts a TLS server that echoes the OpenVPN packets it receives, using
+// the stream framing, and returns its address and the PEM-encoded CA to verify it.
+func startEchoServer(t *testing.T, name string) (string, []byte) {
+	cert, caPEM := newTestingCertificate(t, name)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					header := make([]byte, 2)
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					packet := make([]byte, int(header[0])<<8|int(header[1]))
+					if _, err := io.ReadFull(conn, packet); err != nil {
+						return
+					}
+					if _, err := conn.Write(append(header, packet...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), caPEM
+}
+
+func TestTransport_Dial(t *testing.T) {
+	address, caPEM := startEchoServer(t, "vpn.example.org")
+	packet := append([]byte{0x00, 0x05}, "hello"...)
+
+	t.Run("the packets traverse the outer TLS conn", func(t *testing.T) {
+		for _, cfg := range []*Config{
+			{CA: caPEM},
+			{CA: caPEM, SNI: "vpn.example.org"},
+			{CA: caPEM, Server: address},
+		} {
+			tr, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tr.StreamFraming() {
+				t.Error("expected the stream framing")
+			}
+			conn, err := tr.Dial(context.Background(), "udp", address)
+			if err != nil {
+				t.Fatalf("Dial() with %+v error = %v", cfg, err)
+			}
+			if _, err := conn.Write(packet); err != nil {
+				t.Fatal(err)
+			}
+			echo := make([]byte, len(packet))
+			if _, err := io.ReadFull(conn, echo); err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if !bytes.Equal(echo, packet) {
+				t.Errorf("echo = %x, want %x", echo, packet)
+			}
+		}
+	})
+
+	t.Run("we verify the TLS terminator", func(t *testing.T) {
+		_, otherCA := newTestingCertificate(t, "vpn.example.org")
+		for _, cfg := range []*Config{
+			{CA: otherCA},
+			{CA: caPEM, SNI: "www.example.com"},
+		} {
+			tr, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tr.Dial(context.Background(), "tcp", address); err == nil {
+				t.Errorf("Dial() with %+v: expected an error", cfg)
+			}
+		}
+	})
+}
+
+// recordingDialer is a [transport.ContextDialer] recording what it dials.
+type recordingDialer struct {
+	dialed []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, network+"/"+address)
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestNewTransport(t *testing.T) {
+	address, caPEM := startEchoServer(t, "vpn.example.org")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the transport uses the dialer and the base dir of the environment
+	dialer := &recordingDialer{}
+	env := &transport.Environment{Dialer: dialer, BaseDir: dir}
+	pt, err := NewTransport("stunnel://"+address+"?sni=vpn.example.org&ca=ca.pem", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := pt.Dial(context.Background(), "udp", "10.0.0.1:1194")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(dialer.dialed) != 1 || dialer.dialed[0] != "tcp/"+address {
+		t.Errorf("dialed %v", dialer.dialed)
+	}
+}